@@ -0,0 +1,169 @@
+package ratus
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// keyBlob is the only key of offloaded payloads, whose value is the key of the
+// blob containing the JSON encoded payload in the blob store.
+const keyBlob = "blob"
+
+// DefaultOffloadThreshold is the default size in bytes of JSON encoded payloads
+// above which they are offloaded to the blob store.
+const DefaultOffloadThreshold = 256 * 1024
+
+// ErrOffloadedPayload is returned when decoding an offloaded payload without
+// a blob store, e.g. if the task was not retrieved by a client with a blob
+// store.
+var ErrOffloadedPayload = errors.New("payload is offloaded")
+
+// BlobStore stores large payloads outside of Ratus on the client side, so that
+// tasks stay small in the storage engine and on the wire. Implementations can
+// delegate to object storage services such as S3 or GCS by wrapping their SDKs,
+// in which case blobs are usually expired by the lifecycle rules of buckets.
+type BlobStore interface {
+
+	// Put stores the data as the blob with the key.
+	Put(ctx context.Context, key string, data []byte) error
+
+	// Get returns the data of the blob with the key.
+	Get(ctx context.Context, key string) ([]byte, error)
+}
+
+// dirBlobStore is a BlobStore keeping blobs as files in a directory.
+type dirBlobStore struct {
+	dir string
+}
+
+// NewDirBlobStore creates a BlobStore keeping blobs as files in the directory,
+// which can be shared by producers and consumers through network file systems
+// or mounted object storage buckets.
+func NewDirBlobStore(dir string) (BlobStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &dirBlobStore{dir}, nil
+}
+
+// Put implements the BlobStore interface. Blobs are written to temporary files
+// first, which are then renamed, so that partially written blobs are never
+// read.
+func (s *dirBlobStore) Put(ctx context.Context, key string, data []byte) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(s.dir, ".blob-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), p)
+}
+
+// Get implements the BlobStore interface.
+func (s *dirBlobStore) Get(ctx context.Context, key string) ([]byte, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(p)
+}
+
+// path returns the path of the file of the blob, rejecting keys that would
+// escape the directory.
+func (s *dirBlobStore) path(key string) (string, error) {
+	if key == "" || key == "." || key == ".." || key != filepath.Base(key) {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	return filepath.Join(s.dir, key), nil
+}
+
+// offload returns a reference to the payload after storing it in the blob
+// store if it is larger than the threshold. Empty, small and already offloaded
+// payloads are returned as is.
+func offload(ctx context.Context, s BlobStore, threshold int, v any) (any, error) {
+	if s == nil || v == nil {
+		return v, nil
+	}
+	if _, ok := blobKey(v); ok {
+		return v, nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) <= threshold {
+		return v, nil
+	}
+	k := make([]byte, 16)
+	if _, err := rand.Read(k); err != nil {
+		return nil, err
+	}
+	key := hex.EncodeToString(k)
+	if err := s.Put(ctx, key, b); err != nil {
+		return nil, err
+	}
+	return map[string]any{keyBlob: key}, nil
+}
+
+// fetch returns the payload referenced by an offloaded payload from the blob
+// store. Payloads that are not offloaded are returned as is. Numbers are kept
+// as json.Number to be encoded again without losing precision.
+func fetch(ctx context.Context, s BlobStore, v any) (any, error) {
+	k, ok := blobKey(v)
+	if !ok {
+		return v, nil
+	}
+	if s == nil {
+		return nil, ErrOffloadedPayload
+	}
+	b, err := s.Get(ctx, k)
+	if err != nil {
+		return nil, err
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var p any
+	if err := d.Decode(&p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// blobKey returns the key of the blob referenced by the payload and whether
+// the payload is offloaded.
+func blobKey(v any) (string, bool) {
+	m, ok := v.(map[string]any)
+	if !ok || len(m) != 1 {
+		return "", false
+	}
+	s, ok := m[keyBlob].(string)
+	return s, ok
+}
+
+// offloadBody returns a copy of the request body with large payloads offloaded
+// to the blob store, without modifying the original body.
+func offloadBody(ctx context.Context, s BlobStore, threshold int, body any) (any, error) {
+	if s == nil {
+		return body, nil
+	}
+	return mapPayloads(body, func(v any) (any, error) {
+		return offload(ctx, s, threshold, v)
+	})
+}
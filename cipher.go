@@ -0,0 +1,267 @@
+package ratus
+
+import (
+	"cmp"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+)
+
+// envelopeVersion is the version of the format of encrypted payloads, which
+// marks payloads as encrypted explicitly, so that plaintext payloads that
+// happen to have a ciphertext field are never mistaken for encrypted ones.
+const envelopeVersion = "ratus/v1"
+
+// envelope is the encrypted form of a payload or result. The ciphertext is the
+// base64 encoded encryption of the JSON encoded plaintext, with the ID of the
+// task and the topic recorded in the envelope as additional authenticated
+// data. The topic is recorded since results are retrieved without their tasks
+// and tasks may be moved to other topics after being encrypted, while the ID
+// is taken from the task when decrypting, so that encrypted payloads can not
+// be copied to other tasks.
+type envelope struct {
+	Encryption string `json:"encryption"`
+	Topic      string `json:"topic,omitempty"`
+	Ciphertext string `json:"ciphertext"`
+}
+
+// ErrEncryptedPayload is returned when decoding an encrypted payload without
+// a cipher, e.g. if the task was not retrieved by a client with a cipher.
+var ErrEncryptedPayload = errors.New("payload is encrypted")
+
+// errUnboundCommit is returned when encrypting the payload of a commit whose
+// target task is unknown, e.g. if the commit is sent with Client.Request.
+var errUnboundCommit = errors.New("cannot encrypt the payload of a commit without the ID of its task")
+
+// Cipher encrypts and decrypts task payloads on the client side, so that
+// sensitive payloads are never stored in plaintext. Implementations can
+// delegate to key management services, e.g. by encrypting payloads with data
+// keys wrapped by the service.
+type Cipher interface {
+
+	// Encrypt returns the ciphertext of the plaintext, authenticating the
+	// additional data without encrypting it.
+	Encrypt(plaintext, additionalData []byte) ([]byte, error)
+
+	// Decrypt returns the plaintext of the ciphertext, which must fail if the
+	// additional data differs from the one used for encryption.
+	Decrypt(ciphertext, additionalData []byte) ([]byte, error)
+}
+
+// aesCipher is a Cipher using AES in Galois/Counter Mode. Random nonces are
+// generated for each encryption and prepended to the ciphertext.
+type aesCipher struct {
+	aead cipher.AEAD
+}
+
+// NewAESCipher creates a Cipher using AES-GCM with the key, which must be
+// either 16, 24 or 32 bytes long to select AES-128, AES-192 or AES-256.
+func NewAESCipher(key []byte) (Cipher, error) {
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	a, err := cipher.NewGCM(b)
+	if err != nil {
+		return nil, err
+	}
+	return &aesCipher{a}, nil
+}
+
+// Encrypt implements the Cipher interface.
+func (c *aesCipher) Encrypt(plaintext, additionalData []byte) ([]byte, error) {
+	n := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(plaintext)+c.aead.Overhead())
+	if _, err := rand.Read(n); err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(n, n, plaintext, additionalData), nil
+}
+
+// Decrypt implements the Cipher interface.
+func (c *aesCipher) Decrypt(ciphertext, additionalData []byte) ([]byte, error) {
+	s := c.aead.NonceSize()
+	if len(ciphertext) < s {
+		return nil, errors.New("ciphertext too short")
+	}
+	return c.aead.Open(nil, ciphertext[:s], ciphertext[s:], additionalData)
+}
+
+// associatedData returns the additional authenticated data binding encrypted
+// payloads to the ID of the task and the topic.
+func associatedData(id, topic string) []byte {
+	return []byte(id + "\x00" + topic)
+}
+
+// seal returns the encrypted form of the payload of the task in the topic.
+// Empty payloads and payloads retrieved in encrypted form are returned as is.
+func seal(c Cipher, id, topic string, v any) (any, error) {
+	if c == nil || v == nil {
+		return v, nil
+	}
+	if _, ok := v.(*envelope); ok {
+		return v, nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if b, err = c.Encrypt(b, associatedData(id, topic)); err != nil {
+		return nil, err
+	}
+	return &envelope{
+		Encryption: envelopeVersion,
+		Topic:      topic,
+		Ciphertext: base64.StdEncoding.EncodeToString(b),
+	}, nil
+}
+
+// open returns the JSON encoded plaintext of the payload of the task. Payloads
+// that are not encrypted are encoded as is.
+func open(c Cipher, id string, v any) ([]byte, error) {
+	e, ok := sealed(v)
+	if !ok {
+		return json.Marshal(v)
+	}
+	if c == nil {
+		return nil, ErrEncryptedPayload
+	}
+	b, err := base64.StdEncoding.DecodeString(e.Ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	return c.Decrypt(b, associatedData(id, e.Topic))
+}
+
+// sealed returns the envelope of the payload and whether the payload is
+// encrypted. Payloads are only considered encrypted if they are marked with
+// the version of the envelope format.
+func sealed(v any) (*envelope, bool) {
+	if e, ok := v.(*envelope); ok {
+		return e, true
+	}
+	m, ok := v.(map[string]any)
+	if !ok || m["encryption"] != envelopeVersion {
+		return nil, false
+	}
+	s, ok := m["ciphertext"].(string)
+	if !ok {
+		return nil, false
+	}
+	t, _ := m["topic"].(string)
+	return &envelope{Encryption: envelopeVersion, Topic: t, Ciphertext: s}, true
+}
+
+// sealBody returns a copy of the request body with payloads encrypted, without
+// modifying the original body. Payloads of tasks are bound to their IDs and
+// topics, while payloads of commits are bound to the task and topic specified
+// in the options of the request.
+func sealBody(c Cipher, o *requestOptions, body any) (any, error) {
+	if c == nil {
+		return body, nil
+	}
+	switch x := body.(type) {
+	case *Task:
+		return mapPayloads(x, func(v any) (any, error) {
+			return seal(c, x.ID, x.Topic, v)
+		})
+	case *Tasks:
+		u := Tasks{Data: make([]*Task, len(x.Data))}
+		for i, t := range x.Data {
+			v, err := mapPayloads(t, func(v any) (any, error) {
+				return seal(c, t.ID, t.Topic, v)
+			})
+			if err != nil {
+				return nil, err
+			}
+			u.Data[i] = v.(*Task)
+		}
+		return &u, nil
+	case *Commit:
+		if x.Payload == nil && x.Result == nil {
+			return body, nil
+		}
+		if o == nil || o.task == "" {
+			return nil, errUnboundCommit
+		}
+		return mapPayloads(x, func(v any) (any, error) {
+			return seal(c, o.task, cmp.Or(x.Topic, o.topic), v)
+		})
+	}
+	return body, nil
+}
+
+// mapPayloads returns a copy of the request body with payloads and results of
+// tasks and commits replaced by the results of the function, without modifying the
+// original body.
+func mapPayloads(body any, f func(any) (any, error)) (any, error) {
+	var err error
+	switch x := body.(type) {
+	case *Task:
+		u := *x
+		if u.Payload, err = f(x.Payload); err != nil {
+			return nil, err
+		}
+		if u.Result, err = f(x.Result); err != nil {
+			return nil, err
+		}
+		return &u, nil
+	case *Tasks:
+		u := Tasks{Data: make([]*Task, len(x.Data))}
+		for i, t := range x.Data {
+			v := *t
+			if v.Payload, err = f(t.Payload); err != nil {
+				return nil, err
+			}
+			if v.Result, err = f(t.Result); err != nil {
+				return nil, err
+			}
+			u.Data[i] = &v
+		}
+		return &u, nil
+	case *Commit:
+		u := *x
+		if u.Payload, err = f(x.Payload); err != nil {
+			return nil, err
+		}
+		if u.Result, err = f(x.Result); err != nil {
+			return nil, err
+		}
+		return &u, nil
+	}
+	return body, nil
+}
+
+// attach associates the cipher and the blob store with the tasks in the
+// response body, so that their payloads and results can be fetched and decrypted when
+// decoding. Encrypted payloads are kept in their envelopes, so that tasks sent
+// back as is are not encrypted again.
+func attach(c Cipher, s BlobStore, result any) {
+	if c == nil && s == nil {
+		return
+	}
+	switch x := result.(type) {
+	case *Task:
+		x.cipher, x.blobs = c, s
+		x.Payload, x.Result = envelop(x.Payload), envelop(x.Result)
+	case *Tasks:
+		for _, t := range x.Data {
+			t.cipher, t.blobs = c, s
+			t.Payload, t.Result = envelop(t.Payload), envelop(t.Result)
+		}
+	case *Result:
+		x.cipher, x.blobs = c, s
+		x.Result = envelop(x.Result)
+	}
+}
+
+// envelop returns the envelope of the payload if it is encrypted, or the
+// payload as is otherwise.
+func envelop(v any) any {
+	if e, ok := sealed(v); ok {
+		return e
+	}
+	return v
+}
@@ -2,16 +2,23 @@ package ratus
 
 import (
 	"bytes"
+	"cmp"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/sync/errgroup"
+
+	"github.com/hyperonym/ratus/clock"
+	"github.com/hyperonym/ratus/internal/wire"
 )
 
 // DefaultConcurrencyDelay is the default value of SubscribeOptions's ConcurrencyDelay.
@@ -23,6 +30,16 @@ const DefaultDrainInterval = 5 * time.Second
 // DefaultErrorInterval is the default value of SubscribeOptions's ErrorInterval.
 const DefaultErrorInterval = 30 * time.Second
 
+// DefaultCommitMargin is the default value of SubscribeOptions's CommitMargin.
+const DefaultCommitMargin = 5 * time.Second
+
+// Media types of the wire formats supported for request and response bodies.
+const (
+	ContentTypeJSON    = wire.JSON
+	ContentTypeMsgPack = wire.MsgPack
+	ContentTypeCBOR    = wire.CBOR
+)
+
 // ClientOptions contains options to configure a Ratus client.
 type ClientOptions struct {
 
@@ -34,15 +51,64 @@ type ClientOptions struct {
 	// Common header key-value pairs for every outgoing request.
 	Headers map[string]string
 
-	// Timeout specifies a time limit for requests made by this client.
+	// Timeout specifies a time limit for requests made by this client,
+	// which can be overridden for individual requests with WithTimeout.
 	// This is not related to the timeout for task execution.
 	// A Timeout of zero means no timeout.
 	Timeout time.Duration
+
+	// Media type of the wire format for exchanging request and response
+	// bodies, such as ContentTypeMsgPack or ContentTypeCBOR. Binary formats
+	// reduce the overhead of serializing tasks with large payloads. Empty
+	// values fall back to JSON.
+	ContentType string
+
+	// If not nil, request and response bodies are encoded and decoded with
+	// the codec instead of the built-in implementations, in the wire format
+	// of its media type, which takes precedence over ContentType.
+	Codec Codec
+
+	// If not nil, payloads of tasks and commits are encrypted with the
+	// cipher before being sent, and decrypted when decoding the payloads of
+	// tasks retrieved by the client, so that sensitive payloads are never
+	// stored in plaintext. Use NewAESCipher to encrypt payloads with a key,
+	// or implement the Cipher interface to integrate with key management
+	// services.
+	Cipher Cipher
+
+	// If not nil, payloads of tasks and commits larger than the offload
+	// threshold are stored in the blob store and replaced by references
+	// before being sent, after being encrypted if a cipher is configured.
+	// Referenced payloads are fetched when decoding the payloads of tasks
+	// retrieved by the client.
+	BlobStore BlobStore
+
+	// Payloads whose JSON encoding is larger than this number of bytes are
+	// offloaded to the blob store. Zero values fall back to
+	// DefaultOffloadThreshold.
+	OffloadThreshold int
+
+	// Clock for waiting between polls and retries, which allows tests to
+	// advance time without sleeping. If nil, the system clock is used.
+	Clock clock.Clock
 }
 
 // Client is an HTTP client that talks to Ratus.
 type Client struct {
 	client *http.Client
+	format string
+	codec  Codec
+	cipher Cipher
+	blobs  BlobStore
+
+	// Size of payloads above which they are offloaded to the blob store.
+	threshold int
+
+	// Default time limit for requests made by the client.
+	timeout time.Duration
+
+	// Clock for waiting between polls and retries.
+	clock clock.Clock
 }
 
 // NewClient creates a new Ratus client instance.
@@ -55,13 +121,30 @@ func NewClient(o *ClientOptions) (*Client, error) {
 		return nil, err
 	}
 
-	// Create the internal HTTP client using the custom transport.
-	c := http.Client{
-		Transport: t,
-		Timeout:   o.Timeout,
+	// Validate the wire format for request and response bodies.
+	f, m := ContentTypeJSON, o.ContentType
+	if o.Codec != nil {
+		m = o.Codec.ContentType()
+	}
+	if m != "" {
+		if f = wire.Parse(m); f == "" {
+			return nil, fmt.Errorf("unsupported content type %q", m)
+		}
+	}
+	if o.OffloadThreshold < 0 {
+		return nil, fmt.Errorf("invalid offload threshold %d", o.OffloadThreshold)
 	}
 
-	return &Client{&c}, nil
+	// Create the internal HTTP client using the custom transport. Timeouts
+	// are applied to the context of each request instead of the client, so
+	// that they can be overridden for individual requests.
+	c := http.Client{Transport: t}
+	k := o.Clock
+	if k == nil {
+		k = clock.System
+	}
+
+	return &Client{&c, f, o.Codec, o.Cipher, o.BlobStore, cmp.Or(o.OffloadThreshold, DefaultOffloadThreshold), o.Timeout, k}, nil
 }
 
 // SubscribeOptions contains options for subscribing to a topic.
@@ -74,8 +157,14 @@ type SubscribeOptions struct {
 	// Name of the topic to subscribe to.
 	Topic string
 
-	// Maximum number of tasks to be executed concurrently.
+	// Maximum number of tasks to be executed concurrently, or the minimum
+	// if MaxConcurrency is greater.
 	Concurrency int
+	// Maximum number of tasks to be executed concurrently when there is a
+	// backlog. If greater than Concurrency, polling goroutines are added one
+	// at a time while polls keep claiming tasks, and removed while the topic
+	// is drained, so that the concurrency adapts to the backlog.
+	MaxConcurrency int
 	// Delay added before starting each polling goroutine to avoid spikes.
 	// If zero, DefaultConcurrencyDelay is used.
 	ConcurrencyDelay time.Duration
@@ -83,12 +172,78 @@ type SubscribeOptions struct {
 	// Pause duration after successful polls.
 	// By default will proceed to the next poll immediately without pausing.
 	PollInterval time.Duration
-	// Pause duration when the topic has been emptied.
+	// Pause duration when the topic has been emptied, which is shortened if
+	// the server advises that the next task is scheduled earlier.
 	// If zero, DefaultDrainInterval is used.
 	DrainInterval time.Duration
 	// Pause duration when an error occurs.
 	// If zero, DefaultErrorInterval is used.
 	ErrorInterval time.Duration
+
+	// Time limit for the handler to execute each task, after which the
+	// context passed to the handler is canceled. The limit is shortened to
+	// leave CommitMargin before the deadline of the task, so that the task
+	// can still be committed. Tasks are retried with an error recorded if the
+	// handler exceeds the limit without committing or choosing another state.
+	// If zero, the handler is only limited by the deadline of the task.
+	HandlerTimeout time.Duration
+	// Time reserved for committing before the deadline of the task if
+	// HandlerTimeout is set, which is at most half of the time left.
+	// If zero, DefaultCommitMargin is used.
+	CommitMargin time.Duration
+
+	// Maximum number of times a task is retried after the handler reported
+	// an error, i.e. left the task to be committed in the "pending" state with
+	// an error set by Context.SetError. The task is dead-lettered the next
+	// time the handler reports an error for it. Failures are counted by each
+	// subscription, so tasks retried by other consumers may be attempted more
+	// times in total. If zero, tasks are retried indefinitely.
+	MaxHandlerRetries int
+	// Name of the topic to move dead-lettered tasks to, in the "failed" state
+	// with the last error recorded. If empty, dead-lettered tasks are marked
+	// as failed in their topics.
+	DeadLetterTopic string
+
+	// Time given to the tasks being executed to finish and be committed after
+	// the context of the subscription is canceled. Polling stops as soon as
+	// the context is canceled, while the contexts of the tasks remain valid
+	// until the timeout. If zero, the contexts of the tasks are canceled along
+	// with the subscription.
+	ShutdownTimeout time.Duration
+
+	// Whether to fetch the operational hints of the topic on startup, which
+	// are used for the concurrency, intervals and promise timeout left unset.
+	// Recommended rate limits are followed by extending PollInterval, so
+	// that each polling goroutine claims no more than its share of the rate.
+	UseTopicConfig bool
+}
+
+// hint returns a copy of the options with the unset fields filled in with
+// the operational hints. Invalid durations in the hints are ignored.
+func (o SubscribeOptions) hint(h *TopicConfig) *SubscribeOptions {
+	p := *o.Promise
+	o.Promise = &p
+	o.Promise.Timeout = cmp.Or(o.Promise.Timeout, h.Timeout)
+	o.Concurrency = cmp.Or(o.Concurrency, h.Concurrency)
+	o.MaxConcurrency = cmp.Or(o.MaxConcurrency, h.MaxConcurrency)
+	for _, x := range []struct {
+		v *time.Duration
+		s string
+	}{
+		{&o.ConcurrencyDelay, h.ConcurrencyDelay},
+		{&o.PollInterval, h.PollInterval},
+		{&o.DrainInterval, h.DrainInterval},
+		{&o.ErrorInterval, h.ErrorInterval},
+	} {
+		if d, err := time.ParseDuration(x.s); err == nil && *x.v == 0 {
+			*x.v = d
+		}
+	}
+	if h.RateLimit > 0 {
+		n := max(o.Concurrency, o.MaxConcurrency, 1)
+		o.PollInterval = max(o.PollInterval, time.Duration(float64(n)/h.RateLimit*float64(time.Second)))
+	}
+	return &o
 }
 
 // SubscribeHandler defines the signature of handler functions for the
@@ -100,6 +255,15 @@ type SubscribeHandler func(ctx *Context, err error)
 // unless the context times out or gets canceled.
 func (c *Client) Subscribe(ctx context.Context, o *SubscribeOptions, f SubscribeHandler) error {
 
+	// Fill in the options left unset with the hints of the topic.
+	if o.UseTopicConfig {
+		h, err := c.GetTopicConfig(ctx, o.Topic)
+		if err != nil {
+			return err
+		}
+		o = o.hint(h)
+	}
+
 	// Copy consumer and timeout settings to create a reusable wildcard promise.
 	p := &Promise{
 		Consumer: o.Promise.Consumer,
@@ -123,326 +287,925 @@ func (c *Client) Subscribe(ctx context.Context, o *SubscribeOptions, f Subscribe
 	if ed <= 0 {
 		ed = DefaultErrorInterval
 	}
+	cm := o.CommitMargin
+	if cm <= 0 {
+		cm = DefaultCommitMargin
+	}
+
+	// Count failures reported by the handler across polling goroutines.
+	fs := failures{max: o.MaxHandlerRetries, topic: o.DeadLetterTopic, counts: make(map[string]int)}
+
+	// Derive the contexts of claimed tasks from a context that outlives the
+	// subscription by the shutdown timeout, so that the tasks being executed
+	// can still be committed once polling has stopped.
+	tc := ctx
+	if o.ShutdownTimeout > 0 {
+		var cancel context.CancelFunc
+		tc, cancel = context.WithCancel(context.WithoutCancel(ctx))
+		defer cancel()
+		stop := context.AfterFunc(ctx, func() {
+			select {
+			case <-c.clock.After(o.ShutdownTimeout):
+			case <-tc.Done():
+			}
+			cancel()
+		})
+		defer stop()
+	}
 
 	// Start polling goroutines with a delay between each two to avoid spikes.
+	// Goroutines that keep claiming tasks start another one after a delay, up
+	// to the maximum concurrency, while those finding the topic drained stop
+	// until the minimum concurrency is reached.
+	sc := scaler{min: n, max: max(o.MaxConcurrency, n)}
 	e, ctx := errgroup.WithContext(ctx)
-	for i := 0; i < n; i++ {
-		d := cd * time.Duration(i)
+	if o.ShutdownTimeout <= 0 {
+		tc = ctx
+	}
+	var start func(d time.Duration)
+	start = func(d time.Duration) {
 		e.Go(func() error {
-			r := time.NewTimer(d)
+			r := c.clock.After(d)
 			xc := make(chan *Context, 1)
 			ec := make(chan error, 1)
+			var k int
+			// Automatically commit the updates if no commit has been made
+			// explicitly in the handler function.
+			run := func(x *Context) error {
+				handle(c.clock, x, f, o.HandlerTimeout, cm)
+				fs.observe(x)
+				return x.Commit()
+			}
 			for {
 				select {
 				case <-ctx.Done():
-					r.Stop()
+
+					// Execute the task claimed right before the cancellation
+					// if tasks are given time to finish.
+					select {
+					case x := <-xc:
+						if o.ShutdownTimeout > 0 {
+							run(x)
+						}
+					default:
+					}
 					return ctx.Err()
-				case <-r.C:
-					x, err := c.Poll(ctx, o.Topic, p)
+				case <-r:
+					t, err := c.PostPromises(ctx, o.Topic, p)
 					if err != nil {
 						ec <- err
 						break
 					}
-					xc <- x
+					xc <- c.context(tc, t)
 				case x := <-xc:
-					f(x, nil)
-
-					// Automatically commit the updates if no commit has been
-					// made explicitly in the handler function.
-					if err := x.Commit(); err != nil {
+					if err := run(x); err != nil {
 						ec <- err
 						break
 					}
-					r.Reset(o.PollInterval)
+					if k++; k >= scaleUpStreak {
+						k = 0
+						if sc.grow() {
+							start(cd)
+						}
+					}
+					r = c.clock.After(o.PollInterval)
 				case err := <-ec:
+					k = 0
 
-					// The topic has been emptied or no task has reached its
-					// scheduled time of execution, then poll again later.
-					if errors.Is(err, ErrNotFound) {
-						r.Reset(dd)
+					// The topic has been emptied, no task has reached its
+					// scheduled time of execution, or the concurrency limit
+					// of the topic has been reached, then poll again later
+					// unless there are more goroutines than the minimum.
+					if errors.Is(err, ErrNotFound) || errors.Is(err, ErrTooManyRequests) {
+						if sc.shrink() {
+							return nil
+						}
+						r = c.clock.After(pause(err, dd))
 						break
 					}
 
 					// Handle unexpected errors.
 					if ctx.Err() == nil {
 						f(nil, err)
-						r.Reset(ed)
+						r = c.clock.After(pause(err, ed))
 					}
 				}
 			}
 		})
 	}
+	for i := 0; i < n; i++ {
+		sc.grow()
+		start(cd * time.Duration(i))
+	}
 
 	return e.Wait()
 }
 
+// pause returns how long to pause after a failed poll, taking the advice of
+// the server in the Retry-After header of the response into account. Polls
+// that found the topic empty are resumed earlier if the next task in the topic
+// is scheduled before the interval ends, but not later, since tasks inserted
+// in the meantime may become available sooner. Otherwise, the interval is
+// extended if the server asked to wait longer, e.g. under backpressure.
+func pause(err error, interval time.Duration) time.Duration {
+	d, ok := RetryAfter(err)
+	switch {
+	case !ok:
+		return interval
+	case errors.Is(err, ErrNotFound):
+		return min(d, interval)
+	default:
+		return max(d, interval)
+	}
+}
+
+// handle calls the handler with a context limited by the timeout, leaving the
+// margin before the deadline of the task. The task is left to be retried with
+// an error if the handler exceeded the limit without committing or choosing
+// another state than the default "completed".
+func handle(k clock.Clock, x *Context, f SubscribeHandler, timeout, margin time.Duration) {
+	if timeout <= 0 {
+		f(x, nil)
+		return
+	}
+	n := k.Now()
+	d := n.Add(timeout)
+	if v, ok := x.Context.Deadline(); ok {
+		if u := v.Add(-min(margin, v.Sub(n)/2)); u.Before(d) {
+			d = u
+		}
+	}
+
+	// Restore the context of the task for committing after the handler has
+	// returned.
+	pc := x.Context
+	hc, cancel := context.WithDeadline(pc, d)
+	defer cancel()
+	x.Context = hc
+	f(x, nil)
+	x.Context = pc
+
+	if errors.Is(hc.Err(), context.DeadlineExceeded) && !x.committed && x.commit.State != nil && *x.commit.State == TaskStateCompleted {
+		x.Abstain().SetError(errors.New("handler timed out"))
+	}
+}
+
+// scaleUpStreak is the number of consecutive tasks a polling goroutine has to
+// claim and commit before starting another one.
+const scaleUpStreak = 3
+
+// scaler counts the polling goroutines of a subscription, whose number scales
+// between the minimum and the maximum concurrency.
+type scaler struct {
+	mu  sync.Mutex
+	min int
+	max int
+	n   int
+}
+
+// grow reserves a slot for a new polling goroutine, and returns whether the
+// maximum has not been reached.
+func (s *scaler) grow() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.n >= s.max {
+		return false
+	}
+	s.n++
+	return true
+}
+
+// shrink releases the slot of a polling goroutine, and returns whether there
+// were more goroutines than the minimum.
+func (s *scaler) shrink() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.n <= s.min {
+		return false
+	}
+	s.n--
+	return true
+}
+
+// maxFailures is the maximum number of tasks whose failures are counted by a
+// subscription, beyond which the counts are reset to bound the memory usage.
+const maxFailures = 10000
+
+// failures counts the failures reported by the handler of a subscription for
+// each task, to dead-letter tasks that keep failing.
+type failures struct {
+	mu     sync.Mutex
+	max    int
+	topic  string
+	counts map[string]int
+}
+
+// observe counts the failure if the handler has reported an error for the
+// task, and updates the pending commit to dead-letter the task once it has
+// been retried for the maximum number of times. Tasks committed explicitly by
+// the handler are not counted.
+func (fs *failures) observe(x *Context) {
+	if fs.max <= 0 || x.committed {
+		return
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	m := &x.commit
+	if m.State == nil || *m.State != TaskStatePending || m.Error == "" {
+		delete(fs.counts, x.Task.ID)
+		return
+	}
+	if fs.counts[x.Task.ID] < fs.max {
+		if len(fs.counts) >= maxFailures {
+			clear(fs.counts)
+		}
+		fs.counts[x.Task.ID]++
+		return
+	}
+	delete(fs.counts, x.Task.ID)
+	m.Scheduled = nil
+	m.Defer = ""
+	x.SetState(TaskStateFailed)
+	if fs.topic != "" {
+		x.SetTopic(fs.topic)
+	}
+}
+
 // Poll claims and returns the next available task in a topic.
 // An error wrapping ErrNotFound is returned if the topic is empty,
 // or if no task in the topic has reached its scheduled time of execution.
-func (c *Client) Poll(ctx context.Context, topic string, p *Promise) (*Context, error) {
+// An error wrapping ErrTooManyRequests is returned if the number of active
+// tasks in the topic has reached the concurrency limit of the topic.
+// RetryAfter reports how long until the next task is scheduled, if any.
+// Tasks delivered at most once are completed when polled, and committing
+// their contexts has no effect.
+func (c *Client) Poll(ctx context.Context, topic string, p *Promise, opts ...RequestOption) (*Context, error) {
 
 	// Get the next available task in the topic.
-	t, err := c.PostPromises(ctx, topic, p)
+	t, err := c.PostPromises(ctx, topic, p, opts...)
 	if err != nil {
 		return nil, err
 	}
 
+	return c.context(ctx, t), nil
+}
+
+// context creates the context of a claimed task.
+func (c *Client) context(parent context.Context, t *Task) *Context {
+
 	// Create context with a timeout calculated from the deadline of the task.
 	// To avoid clock synchronization issues, instead of using deadline directly,
 	// use the time difference between the task's deadline and consumed time as
 	// the timeout duration for the context.
+	ctx := parent
 	var n context.CancelFunc
 	if t.Consumed != nil && t.Deadline != nil {
-		ctx, n = context.WithTimeout(ctx, t.Deadline.Sub(*t.Consumed))
+		ctx, n = context.WithTimeoutCause(ctx, t.Deadline.Sub(*t.Consumed), ErrPromiseExpired)
 	}
 
 	// Create commit instance with the default target state set as "completed".
-	// The nonce string from the task is also populated to enable strict mode.
+	// The nonce string and consumer from the task are also populated to enable
+	// strict mode.
 	s := TaskStateCompleted
 	m := Commit{
-		Nonce: t.Nonce,
-		State: &s,
+		Nonce:    t.Nonce,
+		Consumer: t.Consumer,
+		State:    &s,
 	}
 
 	return &Context{
-		Context: ctx,
-		cancel:  n,
-		commit:  m,
-		client:  c,
-		Task:    t,
-	}, nil
+		Context:   ctx,
+		parent:    parent,
+		cancel:    n,
+		committed: t.State == TaskStateCompleted,
+		commit:    m,
+		client:    c,
+		Task:      t,
+	}
 }
 
 // Request calls an API endpoint and stores the response body in the value
 // pointed to by result. Error messages from Ratus will be translated into
 // errors and returned.
-func (c *Client) Request(ctx context.Context, method, endpoint string, body, result any) error {
+func (c *Client) Request(ctx context.Context, method, endpoint string, body, result any, opts ...RequestOption) error {
+	o := newRequestOptions(c, method, opts)
+	if o.confirm != "" {
+		endpoint = withQuery(endpoint, "confirm", o.confirm)
+	}
+	if o.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.timeout)
+		defer cancel()
+	}
 
-	// Encode the request body in JSON.
-	var b io.Reader
+	// Encrypt payloads, offload large ones and encode the request body in the
+	// configured wire format once, so that it can be sent again in retries.
+	var b []byte
 	if body != nil {
-		d, err := json.Marshal(body)
+		body, err := sealBody(c.cipher, o, body)
 		if err != nil {
 			return err
 		}
-		b = bytes.NewBuffer(d)
+		if body, err = offloadBody(ctx, c.blobs, c.threshold, body); err != nil {
+			return err
+		}
+		var d bytes.Buffer
+		if err := encode(c.codec, &d, c.format, body); err != nil {
+			return err
+		}
+		b = d.Bytes()
 	}
 
+	// Retry failed requests with exponential backoff until the retries are
+	// exhausted or the context is done.
+	for i, w := 0, o.backoff; ; i++ {
+		retry, err := c.do(ctx, method, endpoint, o.header, b, result)
+		if err == nil || !retry || i >= o.retries || ctx.Err() != nil {
+			return err
+		}
+
+		// Wait for at least as long as the server advised, if it did.
+		d, _ := RetryAfter(err)
+		c.sleep(ctx, max(w, d))
+		w *= 2
+	}
+}
+
+// do makes a single attempt of a request, and returns whether the request can
+// be retried if it fails due to network errors or temporary conditions.
+func (c *Client) do(ctx context.Context, method, endpoint string, header http.Header, body []byte, result any) (bool, error) {
+
 	// Create request and execute it using the internal HTTP client.
+	var b io.Reader
+	if body != nil {
+		b = bytes.NewReader(body)
+	}
 	req, err := http.NewRequestWithContext(ctx, method, endpoint, b)
 	if err != nil {
-		return err
+		return false, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", c.format)
 	}
+	req.Header.Set("Accept", c.format)
 	res, err := c.client.Do(req)
 	if err != nil {
-		return err
+		return true, err
 	}
 	defer res.Body.Close()
 
+	// Decode the response body in the wire format it is encoded in, which
+	// may differ from the requested one, e.g. for error responses.
+	f := wire.Parse(res.Header.Get("Content-Type"))
+
 	// Handle failed request and parse the error message.
 	if res.StatusCode >= http.StatusBadRequest {
 		var r Error
-		if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
-			return err
+		if err := decode(c.codec, res.Body, f, &r); err != nil {
+			return false, err
 		}
-		return r.Err()
+		err := r.Err()
+		retry := errors.Is(err, ErrTooManyRequests) || errors.Is(err, ErrServiceUnavailable)
+		if d, ok := parseRetryAfter(res.Header.Get("Retry-After"), c.clock.Now()); ok {
+			err = &retryAfterError{err, d}
+		}
+		return retry, err
 	}
 
 	// Discard the response body if unmarshalling is not required.
 	if result == nil {
 		io.Copy(io.Discard, res.Body)
-		return err
+		return false, nil
+	}
+
+	if err := decode(c.codec, res.Body, f, result); err != nil {
+		return false, err
+	}
+	attach(c.cipher, c.blobs, result)
+	return false, nil
+}
+
+// retryAfterError is an error response carrying the advice of the server on
+// how long to wait before retrying the request.
+type retryAfterError struct {
+	err   error
+	delay time.Duration
+}
+
+func (e *retryAfterError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retryAfterError) Unwrap() error {
+	return e.err
+}
+
+// RetryAfter returns how long the server advised to wait before retrying the
+// request that failed with the error, as specified by the Retry-After header
+// of the response. The boolean is false if the server gave no advice. Polls
+// that found no available task are advised to retry once the next task in the
+// topic is scheduled.
+func RetryAfter(err error) (time.Duration, bool) {
+	var e *retryAfterError
+	if !errors.As(err, &e) {
+		return 0, false
 	}
+	return e.delay, true
+}
 
-	return json.NewDecoder(res.Body).Decode(result)
+// parseRetryAfter parses the value of a Retry-After header, which is either a
+// number of seconds or an HTTP date. Dates in the past result in zero.
+func parseRetryAfter(h string, now time.Time) (time.Duration, bool) {
+	if h == "" {
+		return 0, false
+	}
+	if n, err := strconv.Atoi(h); err == nil {
+		return time.Duration(max(n, 0)) * time.Second, true
+	}
+	if t, err := http.ParseTime(h); err == nil {
+		return max(t.Sub(now), 0), true
+	}
+	return 0, false
 }
 
 // ListTopics lists all topics.
-func (c *Client) ListTopics(ctx context.Context, limit, offset int) ([]*Topic, error) {
+func (c *Client) ListTopics(ctx context.Context, limit, offset int, opts ...RequestOption) ([]*Topic, error) {
 	var v Topics
-	if err := c.Request(ctx, http.MethodGet, fmt.Sprintf("/v1/topics?limit=%d&offset=%d", limit, offset), nil, &v); err != nil {
+	if err := c.Request(ctx, http.MethodGet, fmt.Sprintf("/v1/topics?limit=%d&offset=%d", limit, offset), nil, &v, opts...); err != nil {
 		return nil, err
 	}
 	return v.Data, nil
 }
 
-// DeleteTopics deletes all topics and tasks.
-func (c *Client) DeleteTopics(ctx context.Context) (*Deleted, error) {
+// ListTopicsByCursor lists a page of topics starting from the cursor, which is
+// empty for the first page. The cursor of the next page is returned in the
+// result, and is empty if there are no more topics.
+func (c *Client) ListTopicsByCursor(ctx context.Context, cursor string, limit int, opts ...RequestOption) (*Topics, error) {
+	var v Topics
+	if err := c.Request(ctx, http.MethodGet, fmt.Sprintf("/v2/topics?cursor=%s&limit=%d", url.QueryEscape(cursor), limit), nil, &v, opts...); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// DeleteTopics deletes all topics and tasks. The deletion must be confirmed
+// with WithConfirm and the number of topics to be deleted, otherwise an error
+// wrapping ErrPreconditionRequired is returned, unless the server allows
+// unconfirmed deletions.
+func (c *Client) DeleteTopics(ctx context.Context, opts ...RequestOption) (*Deleted, error) {
 	var v Deleted
-	if err := c.Request(ctx, http.MethodDelete, "/v1/topics", nil, &v); err != nil {
+	if err := c.Request(ctx, http.MethodDelete, "/v1/topics", nil, &v, opts...); err != nil {
 		return nil, err
 	}
 	return &v, nil
 }
 
 // GetTopic gets information about a topic.
-func (c *Client) GetTopic(ctx context.Context, topic string) (*Topic, error) {
+func (c *Client) GetTopic(ctx context.Context, topic string, opts ...RequestOption) (*Topic, error) {
 	var v Topic
-	if err := c.Request(ctx, http.MethodGet, fmt.Sprintf("/v1/topics/%s", url.PathEscape(topic)), nil, &v); err != nil {
+	if err := c.Request(ctx, http.MethodGet, fmt.Sprintf("/v1/topics/%s", url.PathEscape(topic)), nil, &v, opts...); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// GetTopicConfig gets the operational hints for consumers of a topic, which
+// are empty if none have been set.
+func (c *Client) GetTopicConfig(ctx context.Context, topic string, opts ...RequestOption) (*TopicConfig, error) {
+	var v TopicConfig
+	if err := c.Request(ctx, http.MethodGet, fmt.Sprintf("/v1/topics/%s/config", url.PathEscape(topic)), nil, &v, opts...); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// UpsertTopic inserts or updates the settings of a topic.
+func (c *Client) UpsertTopic(ctx context.Context, t *Topic, opts ...RequestOption) (*Updated, error) {
+	var v Updated
+	if err := c.Request(ctx, http.MethodPut, fmt.Sprintf("/v1/topics/%s", url.PathEscape(t.Name)), t, &v, opts...); err != nil {
 		return nil, err
 	}
 	return &v, nil
 }
 
-// DeleteTopic deletes a topic and its tasks.
-func (c *Client) DeleteTopic(ctx context.Context, topic string) (*Deleted, error) {
+// DeleteTopic deletes a topic and its tasks. Since the topic is named
+// explicitly, the deletion is confirmed with the name of the topic by default,
+// which can be overridden with WithConfirm.
+func (c *Client) DeleteTopic(ctx context.Context, topic string, opts ...RequestOption) (*Deleted, error) {
 	var v Deleted
-	if err := c.Request(ctx, http.MethodDelete, fmt.Sprintf("/v1/topics/%s", url.PathEscape(topic)), nil, &v); err != nil {
+	opts = append([]RequestOption{WithConfirm(topic)}, opts...)
+	if err := c.Request(ctx, http.MethodDelete, fmt.Sprintf("/v1/topics/%s", url.PathEscape(topic)), nil, &v, opts...); err != nil {
 		return nil, err
 	}
 	return &v, nil
 }
 
 // ListTasks lists all tasks in a topic.
-func (c *Client) ListTasks(ctx context.Context, topic string, limit, offset int) ([]*Task, error) {
+func (c *Client) ListTasks(ctx context.Context, topic string, limit, offset int, opts ...RequestOption) ([]*Task, error) {
 	var v Tasks
-	if err := c.Request(ctx, http.MethodGet, fmt.Sprintf("/v1/topics/%s/tasks?limit=%d&offset=%d", url.PathEscape(topic), limit, offset), nil, &v); err != nil {
+	if err := c.Request(ctx, http.MethodGet, fmt.Sprintf("/v1/topics/%s/tasks?limit=%d&offset=%d", url.PathEscape(topic), limit, offset), nil, &v, opts...); err != nil {
 		return nil, err
 	}
 	return v.Data, nil
 }
 
+// ListTasksByLabels lists all tasks in a topic that match the label selector.
+func (c *Client) ListTasksByLabels(ctx context.Context, topic string, labels map[string]string, limit, offset int, opts ...RequestOption) ([]*Task, error) {
+	var v Tasks
+	if err := c.Request(ctx, http.MethodGet, fmt.Sprintf("/v1/topics/%s/tasks?labels=%s&limit=%d&offset=%d", url.PathEscape(topic), url.QueryEscape(selector(labels)), limit, offset), nil, &v, opts...); err != nil {
+		return nil, err
+	}
+	return v.Data, nil
+}
+
+// ListTasksByCursor lists a page of tasks in a topic that match the label
+// selector starting from the cursor, which is empty for the first page. The
+// cursor of the next page is returned in the result, and is empty if there are
+// no more tasks.
+func (c *Client) ListTasksByCursor(ctx context.Context, topic string, labels map[string]string, cursor string, limit int, opts ...RequestOption) (*Tasks, error) {
+	var v Tasks
+	if err := c.Request(ctx, http.MethodGet, fmt.Sprintf("/v2/topics/%s/tasks?labels=%s&cursor=%s&limit=%d", url.PathEscape(topic), url.QueryEscape(selector(labels)), url.QueryEscape(cursor), limit), nil, &v, opts...); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// ListArchive lists a page of archived tasks in a topic consumed within the
+// time range in the order of their consumed times, starting from the cursor,
+// which is empty for the first page. The range includes from and excludes to,
+// either of which can be the zero time to leave the range unbounded. The
+// cursor of the next page is returned in the result, and is empty if there are
+// no more tasks.
+func (c *Client) ListArchive(ctx context.Context, topic string, from, to time.Time, cursor string, limit int, opts ...RequestOption) (*Tasks, error) {
+	q := url.Values{"cursor": {cursor}, "limit": {strconv.Itoa(limit)}}
+	if !from.IsZero() {
+		q.Set("from", from.Format(time.RFC3339Nano))
+	}
+	if !to.IsZero() {
+		q.Set("to", to.Format(time.RFC3339Nano))
+	}
+	var v Tasks
+	if err := c.Request(ctx, http.MethodGet, fmt.Sprintf("/v2/topics/%s/archive?%s", url.PathEscape(topic), q.Encode()), nil, &v, opts...); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
 // InsertTasks inserts a batch of tasks while ignoring existing ones.
-func (c *Client) InsertTasks(ctx context.Context, ts []*Task) (*Updated, error) {
+func (c *Client) InsertTasks(ctx context.Context, ts []*Task, opts ...RequestOption) (*Updated, error) {
 	var v Updated
-	if err := c.Request(ctx, http.MethodPost, "/v1/topics//tasks", &Tasks{ts}, &v); err != nil {
+	if err := c.Request(ctx, http.MethodPost, "/v1/topics//tasks", &Tasks{Data: ts}, &v, opts...); err != nil {
 		return nil, err
 	}
 	return &v, nil
 }
 
 // UpsertTasks inserts or updates a batch of tasks.
-func (c *Client) UpsertTasks(ctx context.Context, ts []*Task) (*Updated, error) {
+func (c *Client) UpsertTasks(ctx context.Context, ts []*Task, opts ...RequestOption) (*Updated, error) {
 	var v Updated
-	if err := c.Request(ctx, http.MethodPut, "/v1/topics//tasks", &Tasks{ts}, &v); err != nil {
+	if err := c.Request(ctx, http.MethodPut, "/v1/topics//tasks", &Tasks{Data: ts}, &v, opts...); err != nil {
 		return nil, err
 	}
 	return &v, nil
 }
 
 // DeleteTasks deletes all tasks in a topic.
-func (c *Client) DeleteTasks(ctx context.Context, topic string) (*Deleted, error) {
+func (c *Client) DeleteTasks(ctx context.Context, topic string, opts ...RequestOption) (*Deleted, error) {
+	var v Deleted
+	if err := c.Request(ctx, http.MethodDelete, fmt.Sprintf("/v1/topics/%s/tasks", url.PathEscape(topic)), nil, &v, opts...); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// DeleteTasksByLabels deletes all tasks in a topic that match the label selector.
+func (c *Client) DeleteTasksByLabels(ctx context.Context, topic string, labels map[string]string, opts ...RequestOption) (*Deleted, error) {
 	var v Deleted
-	if err := c.Request(ctx, http.MethodDelete, fmt.Sprintf("/v1/topics/%s/tasks", url.PathEscape(topic)), nil, &v); err != nil {
+	if err := c.Request(ctx, http.MethodDelete, fmt.Sprintf("/v1/topics/%s/tasks?labels=%s", url.PathEscape(topic), url.QueryEscape(selector(labels))), nil, &v, opts...); err != nil {
 		return nil, err
 	}
 	return &v, nil
 }
 
 // GetTask gets a task by its unique ID.
-func (c *Client) GetTask(ctx context.Context, id string) (*Task, error) {
+func (c *Client) GetTask(ctx context.Context, id string, opts ...RequestOption) (*Task, error) {
 	var v Task
-	if err := c.Request(ctx, http.MethodGet, fmt.Sprintf("/v1/topics//tasks/%s", url.PathEscape(id)), nil, &v); err != nil {
+	if err := c.Request(ctx, http.MethodGet, fmt.Sprintf("/v1/topics//tasks/%s", url.PathEscape(id)), nil, &v, opts...); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// GetTasks gets tasks by their unique IDs in a single request, in the order of
+// the IDs. Tasks that do not exist are skipped.
+func (c *Client) GetTasks(ctx context.Context, ids []string, opts ...RequestOption) ([]*Task, error) {
+	var v Tasks
+	if err := c.Request(ctx, http.MethodPost, "/v1/tasks:batchGet", &BatchGet{IDs: ids}, &v, opts...); err != nil {
+		return nil, err
+	}
+	return v.Data, nil
+}
+
+// WatchTask blocks until the version of the task differs from the version and
+// returns the task, so that callers awaiting changes of the task do not need
+// to poll it in a tight loop. The server is long-polled until the task changes
+// or the context is done, thus the timeout of requests must be longer than the
+// time the server waits for changes. A version of zero returns the task as
+// soon as it exists.
+func (c *Client) WatchTask(ctx context.Context, id string, version int64, opts ...RequestOption) (*Task, error) {
+	e := fmt.Sprintf("/v1/topics//tasks/%s/watch?version=%d", url.PathEscape(id), version)
+	for {
+		var v Task
+		if err := c.Request(ctx, http.MethodGet, e, nil, &v, opts...); err != nil {
+			return nil, err
+		}
+		if v.Version != version {
+			return &v, nil
+		}
+	}
+}
+
+// GetResult gets the result of a task by its unique ID.
+func (c *Client) GetResult(ctx context.Context, id string, opts ...RequestOption) (*Result, error) {
+	var v Result
+	if err := c.Request(ctx, http.MethodGet, fmt.Sprintf("/v1/topics//tasks/%s/result", url.PathEscape(id)), nil, &v, opts...); err != nil {
 		return nil, err
 	}
 	return &v, nil
 }
 
 // InsertTask inserts a new task.
-func (c *Client) InsertTask(ctx context.Context, t *Task) (*Updated, error) {
+func (c *Client) InsertTask(ctx context.Context, t *Task, opts ...RequestOption) (*Updated, error) {
 	var v Updated
-	if err := c.Request(ctx, http.MethodPost, fmt.Sprintf("/v1/topics//tasks/%s", url.PathEscape(t.ID)), t, &v); err != nil {
+	if err := c.Request(ctx, http.MethodPost, fmt.Sprintf("/v1/topics//tasks/%s", url.PathEscape(t.ID)), t, &v, opts...); err != nil {
 		return nil, err
 	}
 	return &v, nil
 }
 
-// UpsertTask inserts or updates a task.
-func (c *Client) UpsertTask(ctx context.Context, t *Task) (*Updated, error) {
+// ErrTaskFailed is returned by InsertAndWait when the task has failed.
+var ErrTaskFailed = errors.New("task failed")
+
+// InsertAndWait inserts a new task and waits for it to be executed, checking
+// its state at the interval, which allows request/response style usage over
+// the queue. The task is returned once it has been completed or archived, and
+// its result committed by the consumer can be decoded with DecodeResult.
+// The task is returned along with an error wrapping ErrTaskFailed if it has
+// failed, or with ErrNotFound if it has been deleted. The context bounds the
+// time to wait, after which the task is left in the queue.
+func (c *Client) InsertAndWait(ctx context.Context, t *Task, interval time.Duration, opts ...RequestOption) (*Task, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("invalid interval %s", interval)
+	}
+	if _, err := c.InsertTask(ctx, t, opts...); err != nil {
+		return nil, err
+	}
+	for {
+		c.sleep(ctx, interval)
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		v, err := c.GetTask(ctx, t.ID, opts...)
+		if err != nil {
+			return nil, err
+		}
+		switch v.State {
+		case TaskStateCompleted, TaskStateArchived:
+			return v, nil
+		case TaskStateFailed:
+			if v.LastError != "" {
+				return v, fmt.Errorf("%w: %s", ErrTaskFailed, v.LastError)
+			}
+			return v, ErrTaskFailed
+		}
+	}
+}
+
+// UpsertTask inserts or updates a task. If the version of the task is not
+// zero, e.g. if the task was retrieved with GetTask, the task is only updated
+// if it has not been modified since, otherwise ErrConflict is returned.
+func (c *Client) UpsertTask(ctx context.Context, t *Task, opts ...RequestOption) (*Updated, error) {
 	var v Updated
-	if err := c.Request(ctx, http.MethodPut, fmt.Sprintf("/v1/topics//tasks/%s", url.PathEscape(t.ID)), t, &v); err != nil {
+	if t.Version > 0 {
+		opts = append([]RequestOption{WithHeader("If-Match", strconv.Quote(strconv.FormatInt(t.Version, 10)))}, opts...)
+	}
+	if err := c.Request(ctx, http.MethodPut, fmt.Sprintf("/v1/topics//tasks/%s", url.PathEscape(t.ID)), t, &v, opts...); err != nil {
 		return nil, err
 	}
 	return &v, nil
 }
 
 // DeleteTask deletes a task by its unique ID.
-func (c *Client) DeleteTask(ctx context.Context, id string) (*Deleted, error) {
+func (c *Client) DeleteTask(ctx context.Context, id string, opts ...RequestOption) (*Deleted, error) {
 	var v Deleted
-	if err := c.Request(ctx, http.MethodDelete, fmt.Sprintf("/v1/topics//tasks/%s", url.PathEscape(id)), nil, &v); err != nil {
+	if err := c.Request(ctx, http.MethodDelete, fmt.Sprintf("/v1/topics//tasks/%s", url.PathEscape(id)), nil, &v, opts...); err != nil {
 		return nil, err
 	}
 	return &v, nil
 }
 
 // PatchTask applies a set of updates to a task and returns the updated task.
-func (c *Client) PatchTask(ctx context.Context, id string, m *Commit) (*Task, error) {
+func (c *Client) PatchTask(ctx context.Context, id string, m *Commit, opts ...RequestOption) (*Task, error) {
 	var v Task
-	if err := c.Request(ctx, http.MethodPatch, fmt.Sprintf("/v1/topics//tasks/%s", url.PathEscape(id)), m, &v); err != nil {
+	opts = append([]RequestOption{withTask(id, "")}, opts...)
+	if err := c.Request(ctx, http.MethodPatch, fmt.Sprintf("/v1/topics//tasks/%s", url.PathEscape(id)), m, &v, opts...); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// CommitToken applies a set of updates to the task claimed with the commit
+// token, e.g. one recorded along with the side effects of the task, and
+// returns the updated task. The commit is accepted only if the task has not
+// been claimed again since the token was issued.
+func (c *Client) CommitToken(ctx context.Context, token string, m *Commit, opts ...RequestOption) (*Task, error) {
+	t, err := ParseToken(token)
+	if err != nil {
+		return nil, err
+	}
+	n := *m
+	n.Token = token
+	return c.PatchTask(ctx, t.ID, &n, opts...)
+}
+
+// CommitNext applies a set of updates to a task and claims the next available
+// task in the topic in the same request, returning both tasks. The next task
+// is omitted if none can be claimed, in which case consumers should poll as
+// usual. The commit is applied even if the task is moved to another topic.
+func (c *Client) CommitNext(ctx context.Context, topic, id string, m *Commit, p *Promise, opts ...RequestOption) (*Handoff, error) {
+	q := url.Values{"next": {"true"}}
+	if p != nil {
+		if p.Consumer != "" {
+			q.Set("consumer", p.Consumer)
+		}
+		if p.Deadline != nil {
+			q.Set("deadline", p.Deadline.Format(time.RFC3339Nano))
+		}
+		if p.Timeout != "" {
+			q.Set("timeout", p.Timeout)
+		}
+		if len(p.Labels) > 0 {
+			q.Set("labels", selector(p.Labels))
+		}
+		if p.AtMostOnce {
+			q.Set("at_most_once", "true")
+		}
+	}
+	var v Handoff
+	opts = append([]RequestOption{withTask(id, topic)}, opts...)
+	if err := c.Request(ctx, http.MethodPatch, fmt.Sprintf("/v1/topics/%s/tasks/%s?%s", url.PathEscape(topic), url.PathEscape(id), q.Encode()), m, &v, opts...); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// UpdateProgress reports the progress of an active task during execution,
+// without changing its state or nonce.
+func (c *Client) UpdateProgress(ctx context.Context, id string, p *Progress, opts ...RequestOption) (*Updated, error) {
+	var v Updated
+	if err := c.Request(ctx, http.MethodPatch, fmt.Sprintf("/v1/topics//tasks/%s/progress", url.PathEscape(id)), p, &v, opts...); err != nil {
 		return nil, err
 	}
 	return &v, nil
 }
 
 // ListPromises lists all promises in a topic.
-func (c *Client) ListPromises(ctx context.Context, topic string, limit, offset int) ([]*Promise, error) {
+func (c *Client) ListPromises(ctx context.Context, topic string, limit, offset int, opts ...RequestOption) ([]*Promise, error) {
 	var v Promises
-	if err := c.Request(ctx, http.MethodGet, fmt.Sprintf("/v1/topics/%s/promises?limit=%d&offset=%d", url.PathEscape(topic), limit, offset), nil, &v); err != nil {
+	if err := c.Request(ctx, http.MethodGet, fmt.Sprintf("/v1/topics/%s/promises?limit=%d&offset=%d", url.PathEscape(topic), limit, offset), nil, &v, opts...); err != nil {
 		return nil, err
 	}
 	return v.Data, nil
 }
 
+// ListPromisesByCursor lists a page of promises in a topic starting from the
+// cursor, which is empty for the first page. The cursor of the next page is
+// returned in the result, and is empty if there are no more promises.
+func (c *Client) ListPromisesByCursor(ctx context.Context, topic, cursor string, limit int, opts ...RequestOption) (*Promises, error) {
+	var v Promises
+	if err := c.Request(ctx, http.MethodGet, fmt.Sprintf("/v2/topics/%s/promises?cursor=%s&limit=%d", url.PathEscape(topic), url.QueryEscape(cursor), limit), nil, &v, opts...); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
 // PostPromises makes a promise to claim and execute the next available task in a topic.
-func (c *Client) PostPromises(ctx context.Context, topic string, p *Promise) (*Task, error) {
+func (c *Client) PostPromises(ctx context.Context, topic string, p *Promise, opts ...RequestOption) (*Task, error) {
 	var v Task
-	if err := c.Request(ctx, http.MethodPost, fmt.Sprintf("/v1/topics/%s/promises", url.PathEscape(topic)), p, &v); err != nil {
+	if err := c.Request(ctx, http.MethodPost, fmt.Sprintf("/v1/topics/%s/promises", url.PathEscape(topic)), p, &v, opts...); err != nil {
 		return nil, err
 	}
 	return &v, nil
 }
 
 // DeletePromises deletes all promises in a topic.
-func (c *Client) DeletePromises(ctx context.Context, topic string) (*Deleted, error) {
+func (c *Client) DeletePromises(ctx context.Context, topic string, opts ...RequestOption) (*Deleted, error) {
 	var v Deleted
-	if err := c.Request(ctx, http.MethodDelete, fmt.Sprintf("/v1/topics/%s/promises", url.PathEscape(topic)), nil, &v); err != nil {
+	if err := c.Request(ctx, http.MethodDelete, fmt.Sprintf("/v1/topics/%s/promises", url.PathEscape(topic)), nil, &v, opts...); err != nil {
 		return nil, err
 	}
 	return &v, nil
 }
 
 // GetPromise gets a promise by the unique ID of its target task.
-func (c *Client) GetPromise(ctx context.Context, id string) (*Promise, error) {
+func (c *Client) GetPromise(ctx context.Context, id string, opts ...RequestOption) (*Promise, error) {
 	var v Promise
-	if err := c.Request(ctx, http.MethodGet, fmt.Sprintf("/v1/topics//promises/%s", url.PathEscape(id)), nil, &v); err != nil {
+	if err := c.Request(ctx, http.MethodGet, fmt.Sprintf("/v1/topics//promises/%s", url.PathEscape(id)), nil, &v, opts...); err != nil {
 		return nil, err
 	}
 	return &v, nil
 }
 
 // InsertPromise makes a promise to claim and execute a task if it is in pending state.
-func (c *Client) InsertPromise(ctx context.Context, p *Promise) (*Task, error) {
+func (c *Client) InsertPromise(ctx context.Context, p *Promise, opts ...RequestOption) (*Task, error) {
 	var v Task
-	if err := c.Request(ctx, http.MethodPost, fmt.Sprintf("/v1/topics//promises/%s", url.PathEscape(p.ID)), p, &v); err != nil {
+	if err := c.Request(ctx, http.MethodPost, fmt.Sprintf("/v1/topics//promises/%s", url.PathEscape(p.ID)), p, &v, opts...); err != nil {
 		return nil, err
 	}
 	return &v, nil
 }
 
 // UpsertPromise makes a promise to claim and execute a task regardless of its current state.
-func (c *Client) UpsertPromise(ctx context.Context, p *Promise) (*Task, error) {
+func (c *Client) UpsertPromise(ctx context.Context, p *Promise, opts ...RequestOption) (*Task, error) {
 	var v Task
-	if err := c.Request(ctx, http.MethodPut, fmt.Sprintf("/v1/topics//promises/%s", url.PathEscape(p.ID)), p, &v); err != nil {
+	if err := c.Request(ctx, http.MethodPut, fmt.Sprintf("/v1/topics//promises/%s", url.PathEscape(p.ID)), p, &v, opts...); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// StealPromise transfers the promise of an active task to another consumer,
+// invalidating the nonce of the previous promise.
+func (c *Client) StealPromise(ctx context.Context, p *Promise, opts ...RequestOption) (*Task, error) {
+	var v Task
+	if err := c.Request(ctx, http.MethodPost, fmt.Sprintf("/v1/topics//promises/%s:steal", url.PathEscape(p.ID)), p, &v, opts...); err != nil {
 		return nil, err
 	}
 	return &v, nil
 }
 
 // DeletePromise deletes a promise by the unique ID of its target task.
-func (c *Client) DeletePromise(ctx context.Context, id string) (*Deleted, error) {
+func (c *Client) DeletePromise(ctx context.Context, id string, opts ...RequestOption) (*Deleted, error) {
 	var v Deleted
-	if err := c.Request(ctx, http.MethodDelete, fmt.Sprintf("/v1/topics//promises/%s", url.PathEscape(id)), nil, &v); err != nil {
+	if err := c.Request(ctx, http.MethodDelete, fmt.Sprintf("/v1/topics//promises/%s", url.PathEscape(id)), nil, &v, opts...); err != nil {
 		return nil, err
 	}
 	return &v, nil
 }
 
+// ListConsumers lists consumers along with their in-flight tasks.
+func (c *Client) ListConsumers(ctx context.Context, opts ...RequestOption) ([]*Consumer, error) {
+	var v Consumers
+	if err := c.Request(ctx, http.MethodGet, "/v1/consumers", nil, &v, opts...); err != nil {
+		return nil, err
+	}
+	return v.Data, nil
+}
+
+// Heartbeat records a heartbeat of the consumer, which keeps it listed as
+// being seen even if it is idle.
+func (c *Client) Heartbeat(ctx context.Context, consumer string, opts ...RequestOption) error {
+	return c.Request(ctx, http.MethodPost, fmt.Sprintf("/v1/consumers/%s", url.PathEscape(consumer)), nil, nil, opts...)
+}
+
 // GetLiveness checks the liveness of the instance.
-func (c *Client) GetLiveness(ctx context.Context) error {
-	return c.Request(ctx, http.MethodGet, "/v1/livez", nil, nil)
+func (c *Client) GetLiveness(ctx context.Context, opts ...RequestOption) error {
+	return c.Request(ctx, http.MethodGet, "/v1/livez", nil, nil, opts...)
 }
 
 // GetReadiness checks the readiness of the instance.
-func (c *Client) GetReadiness(ctx context.Context) error {
-	return c.Request(ctx, http.MethodGet, "/v1/readyz", nil, nil)
+func (c *Client) GetReadiness(ctx context.Context, opts ...RequestOption) error {
+	return c.Request(ctx, http.MethodGet, "/v1/readyz", nil, nil, opts...)
+}
+
+// GetCapabilities gets the optional features supported by the storage engine.
+func (c *Client) GetCapabilities(ctx context.Context, opts ...RequestOption) (*Capabilities, error) {
+	var v Capabilities
+	if err := c.Request(ctx, http.MethodGet, "/v1/capabilities", nil, &v, opts...); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// GetVersion gets the version and configuration of the instance.
+func (c *Client) GetVersion(ctx context.Context, opts ...RequestOption) (*Build, error) {
+	var v Build
+	if err := c.Request(ctx, http.MethodGet, "/v1/version", nil, &v, opts...); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// selector encodes labels as a label selector consisting of comma-separated
+// key-value pairs sorted by key.
+func selector(labels map[string]string) string {
+	ps := make([]string, 0, len(labels))
+	for k, v := range labels {
+		ps = append(ps, k+"="+v)
+	}
+	sort.Strings(ps)
+	return strings.Join(ps, ",")
 }
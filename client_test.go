@@ -1,12 +1,17 @@
 package ratus_test
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -14,36 +19,82 @@ import (
 	"github.com/gin-gonic/gin"
 
 	"github.com/hyperonym/ratus"
+	"github.com/hyperonym/ratus/clock"
 	"github.com/hyperonym/ratus/internal/config"
 	"github.com/hyperonym/ratus/internal/controller"
+	"github.com/hyperonym/ratus/internal/engine/memdb"
 	"github.com/hyperonym/ratus/internal/engine/stub"
 	"github.com/hyperonym/ratus/internal/middleware"
 	"github.com/hyperonym/ratus/internal/router"
 )
 
 func newClient(t *testing.T, g *stub.Engine) *ratus.Client {
+	t.Helper()
+	c, err := ratus.NewClient(&ratus.ClientOptions{
+		Origin:  newServer(t, g),
+		Headers: map[string]string{"foo": "bar"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// jsonCodec is a Codec counting the values encoded and decoded with
+// encoding/json.
+type jsonCodec struct {
+	marshaled   atomic.Int32
+	unmarshaled atomic.Int32
+}
+
+func (c *jsonCodec) ContentType() string {
+	return ratus.ContentTypeJSON
+}
+
+func (c *jsonCodec) Marshal(v any) ([]byte, error) {
+	c.marshaled.Add(1)
+	return json.Marshal(v)
+}
+
+func (c *jsonCodec) Unmarshal(data []byte, v any) error {
+	c.unmarshaled.Add(1)
+	return json.Unmarshal(data, v)
+}
+
+// protobufCodec is a Codec in a wire format that is not supported by the API.
+type protobufCodec struct {
+	jsonCodec
+}
+
+func (c *protobufCodec) ContentType() string {
+	return "application/x-protobuf"
+}
+
+func newServer(t *testing.T, g *stub.Engine) string {
 	t.Helper()
 	o := config.PaginationConfig{MaxLimit: 10, MaxOffset: 10}
-	r := router.New(&controller.V1{
+	watch, err := middleware.Watch(&config.WatchConfig{Timeout: time.Second, CheckInterval: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := controller.V1{
 		Pagination: middleware.Pagination(&o),
-		Topic:      controller.NewTopicController(g),
-		Task:       controller.NewTaskController(g),
-		Promise:    controller.NewPromiseController(g),
+		Watch:      watch,
+		Topic:      controller.NewTopicController(g, &config.DeleteConfig{}),
+		Task:       controller.NewTaskController(g, &config.TokenConfig{}),
+		Promise:    controller.NewPromiseController(g, &config.TokenConfig{}),
 		Health:     controller.NewHealthController(g),
 		Metrics:    controller.NewMetricsController(g),
-	})
+		Consumer:   controller.NewConsumerController(g, &config.ConsumerConfig{Window: time.Minute}),
+	}
+	v2 := controller.V2{V1: v}
+	v2.Pagination = middleware.Cursor(&o)
+	r := router.New(nil, &v, &v2)
 	ts := httptest.NewServer(r.Handler())
 	t.Cleanup(func() {
 		ts.Close()
 	})
-	c, err := ratus.NewClient(&ratus.ClientOptions{
-		Origin:  ts.URL,
-		Headers: map[string]string{"foo": "bar"},
-	})
-	if err != nil {
-		t.Fatal(err)
-	}
-	return c
+	return ts.URL
 }
 
 func TestClient(t *testing.T) {
@@ -87,6 +138,9 @@ func TestClient(t *testing.T) {
 			if err != nil {
 				t.Error(err)
 			}
+			if err := c.Report(50, "halfway"); err != nil {
+				t.Error(err)
+			}
 			if err := c.Commit(); err != nil {
 				t.Error(err)
 			}
@@ -106,9 +160,23 @@ func TestClient(t *testing.T) {
 				}
 			})
 
+			t.Run("cursor", func(t *testing.T) {
+				t.Parallel()
+				v, err := client.ListTopicsByCursor(ctx, "", 10)
+				if err != nil {
+					t.Error(err)
+				}
+				if v == nil || len(v.Data) == 0 || v.Next != "" {
+					t.Fail()
+				}
+			})
+
 			t.Run("delete", func(t *testing.T) {
 				t.Parallel()
-				v, err := client.DeleteTopics(ctx)
+				if _, err := client.DeleteTopics(ctx); !errors.Is(err, ratus.ErrPreconditionRequired) {
+					t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrPreconditionRequired, err)
+				}
+				v, err := client.DeleteTopics(ctx, ratus.WithConfirm("1"))
 				if err != nil {
 					t.Error(err)
 				}
@@ -132,8 +200,33 @@ func TestClient(t *testing.T) {
 				}
 			})
 
+			t.Run("config", func(t *testing.T) {
+				t.Parallel()
+				v, err := client.GetTopicConfig(ctx, "topic")
+				if err != nil {
+					t.Error(err)
+				}
+				if v == nil || v.Concurrency != 0 {
+					t.Fail()
+				}
+			})
+
+			t.Run("upsert", func(t *testing.T) {
+				t.Parallel()
+				v, err := client.UpsertTopic(ctx, &ratus.Topic{Name: "topic", Retention: "1h"})
+				if err != nil {
+					t.Error(err)
+				}
+				if v == nil || v.Updated == 0 {
+					t.Fail()
+				}
+			})
+
 			t.Run("delete", func(t *testing.T) {
 				t.Parallel()
+				if _, err := client.DeleteTopic(ctx, "topic", ratus.WithConfirm("other")); !errors.Is(err, ratus.ErrPreconditionRequired) {
+					t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrPreconditionRequired, err)
+				}
 				v, err := client.DeleteTopic(ctx, "topic")
 				if err != nil {
 					t.Error(err)
@@ -158,6 +251,39 @@ func TestClient(t *testing.T) {
 				}
 			})
 
+			t.Run("labels", func(t *testing.T) {
+				t.Parallel()
+				v, err := client.ListTasksByLabels(ctx, "topic", map[string]string{"tenant": "foo"}, 10, 0)
+				if err != nil {
+					t.Error(err)
+				}
+				if len(v) == 0 {
+					t.Fail()
+				}
+			})
+
+			t.Run("cursor", func(t *testing.T) {
+				t.Parallel()
+				v, err := client.ListTasksByCursor(ctx, "topic", map[string]string{"tenant": "foo"}, "", 10)
+				if err != nil {
+					t.Error(err)
+				}
+				if v == nil || len(v.Data) == 0 || v.Next != "" {
+					t.Fail()
+				}
+			})
+
+			t.Run("archive", func(t *testing.T) {
+				t.Parallel()
+				v, err := client.ListArchive(ctx, "topic", time.Now().Add(-time.Hour), time.Time{}, "", 10)
+				if err != nil {
+					t.Error(err)
+				}
+				if v == nil || len(v.Data) == 0 || v.Data[0].State != ratus.TaskStateArchived {
+					t.Fail()
+				}
+			})
+
 			t.Run("post", func(t *testing.T) {
 				t.Parallel()
 				v, err := client.InsertTasks(ctx, []*ratus.Task{{ID: "id", Topic: "topic"}})
@@ -190,6 +316,17 @@ func TestClient(t *testing.T) {
 					t.Fail()
 				}
 			})
+
+			t.Run("delete-labels", func(t *testing.T) {
+				t.Parallel()
+				v, err := client.DeleteTasksByLabels(ctx, "topic", map[string]string{"tenant": "foo", "region": "bar"})
+				if err != nil {
+					t.Error(err)
+				}
+				if v == nil || v.Deleted == 0 {
+					t.Fail()
+				}
+			})
 		})
 
 		t.Run("task", func(t *testing.T) {
@@ -206,6 +343,28 @@ func TestClient(t *testing.T) {
 				}
 			})
 
+			t.Run("watch", func(t *testing.T) {
+				t.Parallel()
+				v, err := client.WatchTask(ctx, "id", 0)
+				if err != nil {
+					t.Error(err)
+				}
+				if v == nil || v.Version != 1 {
+					t.Fail()
+				}
+			})
+
+			t.Run("batch", func(t *testing.T) {
+				t.Parallel()
+				v, err := client.GetTasks(ctx, []string{"a", "b"})
+				if err != nil {
+					t.Error(err)
+				}
+				if len(v) != 2 || v[0].ID != "a" || v[1].ID != "b" {
+					t.Fail()
+				}
+			})
+
 			t.Run("post", func(t *testing.T) {
 				t.Parallel()
 				v, err := client.InsertTask(ctx, &ratus.Task{ID: "id", Topic: "topic"})
@@ -249,6 +408,28 @@ func TestClient(t *testing.T) {
 					t.Fail()
 				}
 			})
+
+			t.Run("progress", func(t *testing.T) {
+				t.Parallel()
+				v, err := client.UpdateProgress(ctx, "id", &ratus.Progress{Percent: 50})
+				if err != nil {
+					t.Error(err)
+				}
+				if v == nil || v.Updated == 0 {
+					t.Fail()
+				}
+			})
+
+			t.Run("next", func(t *testing.T) {
+				t.Parallel()
+				v, err := client.CommitNext(ctx, "topic", "id", &ratus.Commit{}, &ratus.Promise{Consumer: "consumer"})
+				if err != nil {
+					t.Error(err)
+				}
+				if v == nil || v.Committed == nil || v.Next == nil {
+					t.Fail()
+				}
+			})
 		})
 
 		t.Run("promises", func(t *testing.T) {
@@ -265,6 +446,17 @@ func TestClient(t *testing.T) {
 				}
 			})
 
+			t.Run("cursor", func(t *testing.T) {
+				t.Parallel()
+				v, err := client.ListPromisesByCursor(ctx, "topic", "", 10)
+				if err != nil {
+					t.Error(err)
+				}
+				if v == nil || len(v.Data) == 0 || v.Next != "" {
+					t.Fail()
+				}
+			})
+
 			t.Run("post", func(t *testing.T) {
 				t.Parallel()
 				v, err := client.PostPromises(ctx, "topic", &ratus.Promise{})
@@ -324,6 +516,17 @@ func TestClient(t *testing.T) {
 				}
 			})
 
+			t.Run("steal", func(t *testing.T) {
+				t.Parallel()
+				v, err := client.StealPromise(ctx, &ratus.Promise{ID: "id", Consumer: "thief"})
+				if err != nil {
+					t.Error(err)
+				}
+				if v == nil || v.State != ratus.TaskStateActive {
+					t.Fail()
+				}
+			})
+
 			t.Run("delete", func(t *testing.T) {
 				t.Parallel()
 				v, err := client.DeletePromise(ctx, "id")
@@ -336,6 +539,28 @@ func TestClient(t *testing.T) {
 			})
 		})
 
+		t.Run("consumer", func(t *testing.T) {
+			t.Parallel()
+
+			t.Run("heartbeat", func(t *testing.T) {
+				t.Parallel()
+				if err := client.Heartbeat(ctx, "consumer"); err != nil {
+					t.Error(err)
+				}
+			})
+
+			t.Run("list", func(t *testing.T) {
+				t.Parallel()
+				v, err := client.ListConsumers(ctx)
+				if err != nil {
+					t.Error(err)
+				}
+				if len(v) == 0 || v[0].Name != "consumer" {
+					t.Fail()
+				}
+			})
+		})
+
 		t.Run("health", func(t *testing.T) {
 			t.Parallel()
 
@@ -352,6 +577,24 @@ func TestClient(t *testing.T) {
 					t.Error(err)
 				}
 			})
+
+			t.Run("capabilities", func(t *testing.T) {
+				t.Parallel()
+				v, err := client.GetCapabilities(ctx)
+				if err != nil {
+					t.Error(err)
+				}
+				if v == nil || v.TTL || v.ChangeStreams {
+					t.Fail()
+				}
+			})
+
+			t.Run("version", func(t *testing.T) {
+				t.Parallel()
+				if _, err := client.GetVersion(ctx); err != nil {
+					t.Error(err)
+				}
+			})
 		})
 	})
 
@@ -362,25 +605,35 @@ func TestClient(t *testing.T) {
 		for _, f := range []func() (any, error){
 			func() (any, error) { return client.Poll(ctx, "topic", &ratus.Promise{Timeout: "30s"}) },
 			func() (any, error) { return client.ListTopics(ctx, 10, 0) },
-			func() (any, error) { return client.DeleteTopics(ctx) },
+			func() (any, error) { return client.ListTopicsByCursor(ctx, "", 10) },
+			func() (any, error) { return client.DeleteTopics(ctx, ratus.WithConfirm("1")) },
 			func() (any, error) { return client.GetTopic(ctx, "topic") },
-			func() (any, error) { return client.DeleteTopic(ctx, "topic") },
+			func() (any, error) { return client.UpsertTopic(ctx, &ratus.Topic{Name: "topic"}) },
+			func() (any, error) { return client.DeleteTopic(ctx, "topic", ratus.WithConfirm("topic")) },
 			func() (any, error) { return client.ListTasks(ctx, "topic", 10, 0) },
 			func() (any, error) { return client.InsertTasks(ctx, []*ratus.Task{{ID: "id", Topic: "topic"}}) },
 			func() (any, error) { return client.UpsertTasks(ctx, []*ratus.Task{{ID: "id", Topic: "topic"}}) },
 			func() (any, error) { return client.DeleteTasks(ctx, "topic") },
+			func() (any, error) { return client.ListTasksByLabels(ctx, "topic", nil, 10, 0) },
+			func() (any, error) { return client.ListTasksByCursor(ctx, "topic", nil, "", 10) },
+			func() (any, error) { return client.ListArchive(ctx, "topic", time.Time{}, time.Time{}, "", 10) },
+			func() (any, error) { return client.DeleteTasksByLabels(ctx, "topic", nil) },
 			func() (any, error) { return client.GetTask(ctx, "id") },
 			func() (any, error) { return client.InsertTask(ctx, &ratus.Task{ID: "id", Topic: "topic"}) },
 			func() (any, error) { return client.UpsertTask(ctx, &ratus.Task{ID: "id", Topic: "topic"}) },
 			func() (any, error) { return client.DeleteTask(ctx, "id") },
 			func() (any, error) { return client.PatchTask(ctx, "id", &ratus.Commit{}) },
+			func() (any, error) { return client.UpdateProgress(ctx, "id", &ratus.Progress{}) },
 			func() (any, error) { return client.ListPromises(ctx, "topic", 10, 0) },
+			func() (any, error) { return client.ListPromisesByCursor(ctx, "topic", "", 10) },
 			func() (any, error) { return client.PostPromises(ctx, "topic", &ratus.Promise{}) },
 			func() (any, error) { return client.DeletePromises(ctx, "topic") },
 			func() (any, error) { return client.GetPromise(ctx, "id") },
 			func() (any, error) { return client.InsertPromise(ctx, &ratus.Promise{ID: "id"}) },
 			func() (any, error) { return client.UpsertPromise(ctx, &ratus.Promise{ID: "id"}) },
+			func() (any, error) { return client.StealPromise(ctx, &ratus.Promise{ID: "id"}) },
 			func() (any, error) { return client.DeletePromise(ctx, "id") },
+			func() (any, error) { return client.ListConsumers(ctx) },
 			func() (any, error) { return nil, client.GetReadiness(ctx) },
 		} {
 			if _, err := f(); !errors.Is(err, ratus.ErrServiceUnavailable) {
@@ -389,57 +642,1415 @@ func TestClient(t *testing.T) {
 		}
 	})
 
-	t.Run("event", func(t *testing.T) {
+	t.Run("scripted", func(t *testing.T) {
 		t.Parallel()
+		ctx := context.Background()
+		g := &stub.Engine{}
+		g.Script("InsertTask",
+			stub.Response{Err: ratus.ErrServiceUnavailable},
+			stub.Response{Err: ratus.ErrTooManyRequests},
+		)
+		client := newClient(t, g)
 
-		t.Run("drain", func(t *testing.T) {
-			t.Parallel()
-			ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
-			defer cancel()
-
-			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				w.WriteHeader(http.StatusNotFound)
-				w.Header().Add("Content-Type", "application/json")
-				e := ratus.NewError(ratus.ErrNotFound)
-				b, _ := json.Marshal(e)
-				fmt.Fprintln(w, string(b))
-			}))
-			defer ts.Close()
+		// Transient errors are retried until the engine succeeds.
+		if _, err := client.InsertTask(ctx, &ratus.Task{ID: "id", Topic: "topic"}, ratus.WithRetry(2, time.Millisecond)); err != nil {
+			t.Error(err)
+		}
+		if n := len(g.Calls("InsertTask")); n != 3 {
+			t.Errorf("incorrect number of attempts, expected 3, got %d", n)
+		}
 
-			client, err := ratus.NewClient(&ratus.ClientOptions{Origin: ts.URL})
-			if err != nil {
-				t.Error(err)
-			}
+		// Conflicts are returned to the caller without retrying.
+		g.Script("InsertTask", stub.Response{Err: ratus.ErrConflict})
+		if _, err := client.InsertTask(ctx, &ratus.Task{ID: "id", Topic: "topic"}, ratus.WithRetry(2, time.Millisecond)); !errors.Is(err, ratus.ErrConflict) {
+			t.Errorf("incorrect error, expected %v, got %v", ratus.ErrConflict, err)
+		}
+		if n := len(g.Calls("InsertTask")); n != 4 {
+			t.Errorf("incorrect number of attempts, expected 4, got %d", n)
+		}
+	})
 
-			var a atomic.Int32
-			if err := client.Subscribe(ctx, &ratus.SubscribeOptions{
-				Promise:          &ratus.Promise{Timeout: "30s"},
-				Topic:            "topic",
-				Concurrency:      1,
-				ConcurrencyDelay: 1 * time.Microsecond,
-				PollInterval:     1 * time.Millisecond,
-				DrainInterval:    100 * time.Millisecond,
-				ErrorInterval:    1 * time.Millisecond,
-			}, func(c *ratus.Context, err error) {
+	t.Run("format", func(t *testing.T) {
+		t.Parallel()
+		ctx := context.Background()
+		for _, f := range []string{ratus.ContentTypeMsgPack, ratus.ContentTypeCBOR} {
+			f := f
+			t.Run(f, func(t *testing.T) {
+				t.Parallel()
+				client, err := ratus.NewClient(&ratus.ClientOptions{
+					Origin:      newServer(t, &stub.Engine{}),
+					ContentType: f,
+				})
 				if err != nil {
+					t.Fatal(err)
+				}
+				if v, err := client.InsertTask(ctx, &ratus.Task{ID: "id", Topic: "topic", Payload: map[string]any{"foo": "bar"}}); err != nil {
 					t.Error(err)
-					return
+				} else if v.Created != 1 {
+					t.Fail()
 				}
-				a.Add(1)
-			}); !errors.Is(err, context.DeadlineExceeded) {
-				t.Error(err)
+				if v, err := client.GetTask(ctx, "id"); err != nil {
+					t.Error(err)
+				} else if v.Produced == nil || v.Payload == nil {
+					t.Errorf("incorrect task decoded from %s: %+v", f, v)
+				}
+				c, err := client.Poll(ctx, "topic", &ratus.Promise{Timeout: "30s"})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := c.Commit(); err != nil {
+					t.Error(err)
+				}
+
+				// Error responses are encoded in JSON regardless of the
+				// requested wire format.
+				if _, err := client.PatchTask(ctx, "id", &ratus.Commit{Defer: "foo"}); !errors.Is(err, ratus.ErrBadRequest) {
+					t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrBadRequest, err)
+				}
+			})
+		}
+	})
+
+	t.Run("codec", func(t *testing.T) {
+		t.Parallel()
+		ctx := context.Background()
+		var k jsonCodec
+		client, err := ratus.NewClient(&ratus.ClientOptions{
+			Origin:      newServer(t, &stub.Engine{}),
+			ContentType: ratus.ContentTypeCBOR,
+			Codec:       &k,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.InsertTask(ctx, &ratus.Task{ID: "id", Topic: "topic", Payload: map[string]any{"foo": "bar"}}); err != nil {
+			t.Error(err)
+		}
+		if v, err := client.GetTask(ctx, "id"); err != nil {
+			t.Error(err)
+		} else if v.Produced == nil || v.Payload == nil {
+			t.Errorf("incorrect task decoded with codec: %+v", v)
+		}
+		if k.marshaled.Load() != 1 || k.unmarshaled.Load() != 2 {
+			t.Errorf("codec should take precedence over content type, got %d encoded and %d decoded", k.marshaled.Load(), k.unmarshaled.Load())
+		}
+	})
+
+	t.Run("options", func(t *testing.T) {
+		t.Parallel()
+		ctx := context.Background()
+
+		var mu sync.Mutex
+		var keys []string
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if d, err := time.ParseDuration(r.URL.Query().Get("sleep")); err == nil {
+				time.Sleep(d)
 			}
-			if a.Load() != 0 {
-				t.Fail()
+			mu.Lock()
+			keys = append(keys, r.Header.Get("Idempotency-Key"))
+			n := len(keys)
+			mu.Unlock()
+			w.Header().Set("Content-Type", "application/json")
+			if r.Header.Get("X-Attempts") != "" && strconv.Itoa(n) != r.Header.Get("X-Attempts") {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				json.NewEncoder(w).Encode(ratus.NewError(ratus.ErrServiceUnavailable))
+				return
 			}
-		})
+			json.NewEncoder(w).Encode(&ratus.Updated{Created: 1})
+		}))
+		defer ts.Close()
 
-		t.Run("error", func(t *testing.T) {
-			t.Parallel()
-			ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
-			defer cancel()
+		client, err := ratus.NewClient(&ratus.ClientOptions{Origin: ts.URL, Timeout: 50 * time.Millisecond})
+		if err != nil {
+			t.Fatal(err)
+		}
 
-			client := newClient(t, &stub.Engine{Err: ratus.ErrInternalServerError})
+		// Requests should be retried with the same idempotency key.
+		var v ratus.Updated
+		if err := client.Request(ctx, http.MethodPost, "/", &ratus.Task{}, &v, ratus.WithRetry(2, time.Millisecond), ratus.WithHeader("X-Attempts", "3")); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		if len(keys) != 3 || keys[0] == "" || keys[0] != keys[1] || keys[1] != keys[2] {
+			t.Errorf("incorrect idempotency keys of retries: %q", keys)
+		}
+		keys = nil
+		mu.Unlock()
+
+		// Errors should be returned once the retries are exhausted.
+		if err := client.Request(ctx, http.MethodPost, "/", &ratus.Task{}, &v, ratus.WithRetry(1, time.Millisecond), ratus.WithHeader("X-Attempts", "3")); !errors.Is(err, ratus.ErrServiceUnavailable) {
+			t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrServiceUnavailable, err)
+		}
+
+		// Timeouts of individual requests should override the client's.
+		if err := client.Request(ctx, http.MethodGet, "/?sleep=100ms", nil, &v); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("incorrect error type, expected %q, got %q", context.DeadlineExceeded, err)
+		}
+		if err := client.Request(ctx, http.MethodGet, "/?sleep=100ms", nil, &v, ratus.WithTimeout(time.Second)); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("clock", func(t *testing.T) {
+		t.Parallel()
+		ctx := context.Background()
+		var n atomic.Int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			if n.Add(1) == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				json.NewEncoder(w).Encode(ratus.NewError(ratus.ErrServiceUnavailable))
+				return
+			}
+			json.NewEncoder(w).Encode(&ratus.Updated{Created: 1})
+		}))
+		defer ts.Close()
+
+		k := clock.NewFake(time.Now())
+		client, err := ratus.NewClient(&ratus.ClientOptions{Origin: ts.URL, Clock: k})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Retries wait on the clock of the client, which is advanced instead
+		// of sleeping through the backoff.
+		done := make(chan error, 1)
+		go func() {
+			var v ratus.Updated
+			done <- client.Request(ctx, http.MethodPost, "/", &ratus.Task{}, &v, ratus.WithRetry(1, time.Hour))
+		}()
+		for k.Waiters() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		k.Advance(time.Hour)
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Error(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the request to be retried after advancing the clock")
+		}
+		if v := n.Load(); v != 2 {
+			t.Errorf("incorrect number of attempts, expected 2, got %d", v)
+		}
+	})
+
+	t.Run("retry-after", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		// Polls find the topic empty with the next task scheduled in 2
+		// seconds, and requests to other endpoints are rejected with the
+		// advice to wait for a minute.
+		var polls atomic.Int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			switch {
+			case r.Method == http.MethodPost && r.URL.Path == "/v1/topics/topic/promises":
+				if polls.Add(1) == 2 {
+					json.NewEncoder(w).Encode(&ratus.Task{ID: "id", Topic: "topic", Nonce: "nonce"})
+					return
+				}
+				w.Header().Set("Retry-After", "2")
+				w.WriteHeader(http.StatusNotFound)
+				json.NewEncoder(w).Encode(ratus.NewError(ratus.ErrNotFound))
+			case r.Method == http.MethodPatch:
+				json.NewEncoder(w).Encode(&ratus.Task{ID: "id", Topic: "topic"})
+			default:
+				w.Header().Set("Retry-After", "60")
+				w.WriteHeader(http.StatusServiceUnavailable)
+				json.NewEncoder(w).Encode(ratus.NewError(ratus.ErrServiceUnavailable))
+			}
+		}))
+		defer ts.Close()
+
+		k := clock.NewFake(time.Now())
+		client, err := ratus.NewClient(&ratus.ClientOptions{Origin: ts.URL, Clock: k})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The advice should be exposed along with the error.
+		_, err = client.GetTopic(ctx, "topic")
+		if d, ok := ratus.RetryAfter(err); !errors.Is(err, ratus.ErrServiceUnavailable) || !ok || d != time.Minute {
+			t.Errorf("incorrect advice of %q, expected %v, got %v", err, time.Minute, d)
+		}
+		if _, ok := ratus.RetryAfter(ratus.ErrServiceUnavailable); ok {
+			t.Error("expected no advice for errors without responses")
+		}
+
+		// Retries should wait for at least as long as advised.
+		done := make(chan error, 1)
+		go func() {
+			_, err := client.GetTopic(ctx, "topic", ratus.WithRetry(1, time.Millisecond))
+			done <- err
+		}()
+		for k.Waiters() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		k.Advance(time.Second)
+		if k.Waiters() == 0 {
+			t.Error("expected the retry to wait for the advised duration")
+		}
+		k.Advance(time.Minute)
+		select {
+		case err := <-done:
+			if !errors.Is(err, ratus.ErrServiceUnavailable) {
+				t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrServiceUnavailable, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the request to be retried after advancing the clock")
+		}
+
+		// Subscriptions should poll again once the next task is scheduled
+		// instead of waiting for the drain interval.
+		handled := make(chan struct{})
+		go client.Subscribe(ctx, &ratus.SubscribeOptions{
+			Promise:       &ratus.Promise{},
+			Topic:         "topic",
+			DrainInterval: time.Hour,
+		}, func(c *ratus.Context, err error) {
+			if err == nil {
+				close(handled)
+			}
+		})
+		for k.Waiters() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		k.Advance(2 * time.Second)
+		select {
+		case <-handled:
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the task to be handled after the advised duration")
+		}
+	})
+
+	t.Run("commit", func(t *testing.T) {
+		t.Parallel()
+		ctx := context.Background()
+
+		// The task is claimed again with a fresh nonce once the consumer has
+		// polled it, and the first commit fails due to a temporary error.
+		var unavailable atomic.Int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			switch r.Method {
+			case http.MethodPost:
+				json.NewEncoder(w).Encode(&ratus.Task{ID: "id", Topic: "topic", Nonce: "stale"})
+			case http.MethodGet:
+				json.NewEncoder(w).Encode(&ratus.Task{ID: "id", Topic: "topic", Nonce: "fresh"})
+			case http.MethodPatch:
+				var m ratus.Commit
+				json.NewDecoder(r.Body).Decode(&m)
+				switch {
+				case unavailable.Add(-1) >= 0:
+					w.WriteHeader(http.StatusServiceUnavailable)
+					json.NewEncoder(w).Encode(ratus.NewError(ratus.ErrServiceUnavailable))
+				case m.Nonce != "" && m.Nonce != "fresh":
+					w.WriteHeader(http.StatusConflict)
+					json.NewEncoder(w).Encode(ratus.NewError(ratus.ErrConflict))
+				default:
+					json.NewEncoder(w).Encode(&ratus.Task{ID: "id", Topic: "topic", Nonce: m.Nonce})
+				}
+			}
+		}))
+		defer ts.Close()
+
+		client, err := ratus.NewClient(&ratus.ClientOptions{Origin: ts.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		poll := func() *ratus.Context {
+			c, err := client.Poll(ctx, "topic", &ratus.Promise{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return c
+		}
+
+		// Conflicts should be returned without a handler or when abandoned.
+		if err := poll().Commit(); !errors.Is(err, ratus.ErrConflict) {
+			t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrConflict, err)
+		}
+		abandon := func(ctx *ratus.Context, current *ratus.Task) ratus.ConflictResolution {
+			return ratus.ConflictAbandon
+		}
+		if err := poll().OnConflict(abandon).Commit(); !errors.Is(err, ratus.ErrConflict) {
+			t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrConflict, err)
+		}
+
+		// Conflicts should be resolved by refetching or forcing.
+		for _, r := range []ratus.ConflictResolution{ratus.ConflictRefetch, ratus.ConflictForce} {
+			var seen string
+			if err := poll().OnConflict(func(ctx *ratus.Context, current *ratus.Task) ratus.ConflictResolution {
+				seen = current.Nonce
+				return r
+			}).Commit(); err != nil {
+				t.Error(err)
+			}
+			if seen != "fresh" {
+				t.Errorf("handler should receive the current state of the task, got nonce %q", seen)
+			}
+		}
+
+		// Temporary errors should be retried.
+		unavailable.Store(1)
+		if err := poll().Force().Commit(); !errors.Is(err, ratus.ErrServiceUnavailable) {
+			t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrServiceUnavailable, err)
+		}
+		unavailable.Store(1)
+		if err := poll().Force().SetRetry(1, time.Millisecond).Commit(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("conflict", func(t *testing.T) {
+		t.Parallel()
+		ctx := context.Background()
+
+		// Commits always conflict, and the nonce of the task changes on every
+		// fetch unless it is pinned.
+		var fetched, patched atomic.Int32
+		var pinned atomic.Bool
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			switch r.Method {
+			case http.MethodPost:
+				json.NewEncoder(w).Encode(&ratus.Task{ID: "id", Topic: "topic", Nonce: "0"})
+			case http.MethodGet:
+				n := fetched.Add(1)
+				if pinned.Load() {
+					n = 0
+				}
+				json.NewEncoder(w).Encode(&ratus.Task{ID: "id", Topic: "topic", Nonce: strconv.Itoa(int(n))})
+			case http.MethodPatch:
+				patched.Add(1)
+				w.WriteHeader(http.StatusConflict)
+				json.NewEncoder(w).Encode(ratus.NewError(ratus.ErrConflict))
+			}
+		}))
+		defer ts.Close()
+
+		client, err := ratus.NewClient(&ratus.ClientOptions{Origin: ts.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		refetch := func(ctx *ratus.Context, current *ratus.Task) ratus.ConflictResolution {
+			return ratus.ConflictRefetch
+		}
+
+		// Resolutions should be attempted a limited number of times.
+		c, err := client.Poll(ctx, "topic", &ratus.Promise{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.OnConflict(refetch).Commit(); !errors.Is(err, ratus.ErrConflict) {
+			t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrConflict, err)
+		}
+		if n := patched.Load(); n != 4 {
+			t.Errorf("incorrect number of commits, expected 4, got %d", n)
+		}
+
+		// Resolutions that would not change the commit should give up.
+		pinned.Store(true)
+		patched.Store(0)
+		c, err = client.Poll(ctx, "topic", &ratus.Promise{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.OnConflict(refetch).Commit(); !errors.Is(err, ratus.ErrConflict) {
+			t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrConflict, err)
+		}
+		if n := patched.Load(); n != 1 {
+			t.Errorf("incorrect number of commits, expected 1, got %d", n)
+		}
+	})
+
+	t.Run("masked", func(t *testing.T) {
+		t.Parallel()
+		ctx := context.Background()
+
+		// Nonces are masked on reads when the server binds them to consumers.
+		g, err := memdb.New(&memdb.Config{RetentionPeriod: time.Hour})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := g.Open(ctx); err != nil {
+			t.Fatal(err)
+		}
+		defer g.Destroy(ctx)
+		o := config.PaginationConfig{MaxLimit: 10, MaxOffset: 10}
+		tc := config.TokenConfig{NonceKey: "secret"}
+		v := controller.V1{
+			Pagination: middleware.Pagination(&o),
+			Topic:      controller.NewTopicController(g, &config.DeleteConfig{}),
+			Task:       controller.NewTaskController(g, &tc),
+			Promise:    controller.NewPromiseController(g, &tc),
+			Health:     controller.NewHealthController(g),
+			Metrics:    controller.NewMetricsController(g),
+		}
+		ts := httptest.NewServer(router.New(nil, &v).Handler())
+		defer ts.Close()
+
+		client, err := ratus.NewClient(&ratus.ClientOptions{Origin: ts.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.InsertTask(ctx, &ratus.Task{ID: "id", Topic: "topic"}); err != nil {
+			t.Fatal(err)
+		}
+		c, err := client.Poll(ctx, "topic", &ratus.Promise{Consumer: "owner"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.StealPromise(ctx, &ratus.Promise{ID: "id", Consumer: "thief"}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Refetching should give up instead of committing without a nonce.
+		if err := c.OnConflict(func(ctx *ratus.Context, current *ratus.Task) ratus.ConflictResolution {
+			return ratus.ConflictRefetch
+		}).Commit(); !errors.Is(err, ratus.ErrConflict) {
+			t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrConflict, err)
+		}
+		x, err := g.GetTask(ctx, "id")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if x.State != ratus.TaskStateActive || x.Consumer != "thief" {
+			t.Errorf("claim of the other consumer should survive, got state %d and consumer %q", x.State, x.Consumer)
+		}
+	})
+
+	t.Run("handoff", func(t *testing.T) {
+		t.Parallel()
+		ctx := context.Background()
+
+		// The first commit hands off the next task, and the second one finds
+		// the topic empty.
+		var polled, patched atomic.Int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			switch {
+			case r.Method == http.MethodPost && polled.Add(1) == 1:
+				json.NewEncoder(w).Encode(&ratus.Task{ID: "1", Topic: "topic", State: ratus.TaskStateActive})
+			case r.Method == http.MethodPost:
+				w.WriteHeader(http.StatusNotFound)
+				json.NewEncoder(w).Encode(ratus.NewError(ratus.ErrNotFound))
+			case r.Method == http.MethodPatch:
+				q := r.URL.Query()
+				if r.URL.Path != "/v1/topics/topic/tasks/1" && r.URL.Path != "/v1/topics/topic/tasks/2" || q.Get("next") != "true" || q.Get("timeout") != "30s" || q.Get("labels") != "tenant=foo" {
+					w.WriteHeader(http.StatusBadRequest)
+					json.NewEncoder(w).Encode(ratus.NewError(ratus.ErrBadRequest))
+					return
+				}
+				h := ratus.Handoff{Committed: &ratus.Task{ID: "1", Topic: "topic", State: ratus.TaskStateCompleted}}
+				if patched.Add(1) == 1 {
+					h.Next = &ratus.Task{ID: "2", Topic: "topic", State: ratus.TaskStateActive}
+				}
+				json.NewEncoder(w).Encode(&h)
+			}
+		}))
+		defer ts.Close()
+
+		client, err := ratus.NewClient(&ratus.ClientOptions{Origin: ts.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := &ratus.Promise{Timeout: "30s", Labels: map[string]string{"tenant": "foo"}}
+		c, err := client.Poll(ctx, "topic", p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		x, err := c.CommitNext(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if x.Task.ID != "2" {
+			t.Errorf("incorrect next task, expected %q, got %q", "2", x.Task.ID)
+		}
+
+		// Committed contexts should not be committed again.
+		if err := c.Commit(); err != nil {
+			t.Error(err)
+		}
+		if patched.Load() != 1 {
+			t.Errorf("incorrect number of commits, expected 1, got %d", patched.Load())
+		}
+
+		// Empty topics should be reported in the same way as polls.
+		if _, err := x.CommitNext(p); !errors.Is(err, ratus.ErrNotFound) {
+			t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrNotFound, err)
+		}
+		if patched.Load() != 2 {
+			t.Errorf("incorrect number of commits, expected 2, got %d", patched.Load())
+		}
+	})
+
+	t.Run("watch", func(t *testing.T) {
+		t.Parallel()
+		ctx := context.Background()
+
+		// Long polls are renewed until the version of the task changes.
+		var n atomic.Int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			if r.URL.Path != "/v1/topics//tasks/1/watch" || r.URL.Query().Get("version") != "1" {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(ratus.NewError(ratus.ErrBadRequest))
+				return
+			}
+			v := ratus.Task{ID: "1", Topic: "topic", Version: 1}
+			if n.Add(1) == 3 {
+				v.State, v.Version = ratus.TaskStateCompleted, 2
+			}
+			json.NewEncoder(w).Encode(&v)
+		}))
+		defer ts.Close()
+
+		client, err := ratus.NewClient(&ratus.ClientOptions{Origin: ts.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := client.WatchTask(ctx, "1", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.Version != 2 || v.State != ratus.TaskStateCompleted {
+			t.Errorf("incorrect task, expected completed task of version 2, got %+v", v)
+		}
+		if n.Load() != 3 {
+			t.Errorf("incorrect number of requests, expected 3, got %d", n.Load())
+		}
+	})
+
+	t.Run("hints", func(t *testing.T) {
+		t.Parallel()
+		ctx := context.Background()
+
+		// Polls should follow the hinted timeout until the topic is drained.
+		var timeouts sync.Map
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			switch {
+			case r.Method == http.MethodGet && r.URL.Path == "/v1/topics/topic/config":
+				json.NewEncoder(w).Encode(&ratus.TopicConfig{Concurrency: 2, Timeout: "45s", DrainInterval: "1h", RateLimit: 10})
+			case r.Method == http.MethodGet:
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(ratus.NewError(errors.New("unavailable")))
+			case r.Method == http.MethodPost:
+				var p ratus.Promise
+				json.NewDecoder(r.Body).Decode(&p)
+				timeouts.Store(p.Timeout, true)
+				w.WriteHeader(http.StatusNotFound)
+				json.NewEncoder(w).Encode(ratus.NewError(ratus.ErrNotFound))
+			}
+		}))
+		defer ts.Close()
+
+		client, err := ratus.NewClient(&ratus.ClientOptions{Origin: ts.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+		if err := client.Subscribe(sctx, &ratus.SubscribeOptions{
+			Promise:        &ratus.Promise{},
+			Topic:          "topic",
+			UseTopicConfig: true,
+		}, func(c *ratus.Context, err error) {
+			t.Error("unexpected call to handler")
+		}); !errors.Is(err, context.DeadlineExceeded) {
+			t.Error(err)
+		}
+		if _, ok := timeouts.Load("45s"); !ok {
+			t.Error("expected polls with the hinted timeout")
+		}
+		if _, ok := timeouts.Load(""); ok {
+			t.Error("unexpected polls without the hinted timeout")
+		}
+
+		// Subscribers should not start without the hints they asked for.
+		if err := client.Subscribe(ctx, &ratus.SubscribeOptions{
+			Promise:        &ratus.Promise{},
+			Topic:          "other",
+			UseTopicConfig: true,
+		}, nil); err == nil {
+			t.Error("expected error when hints can not be fetched")
+		}
+	})
+
+	t.Run("once", func(t *testing.T) {
+		t.Parallel()
+		ctx := context.Background()
+
+		// Tasks delivered at most once should never be committed.
+		var patched atomic.Int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			if r.Method == http.MethodPatch {
+				patched.Add(1)
+			}
+			json.NewEncoder(w).Encode(&ratus.Task{ID: "id", Topic: "topic", State: ratus.TaskStateCompleted})
+		}))
+		defer ts.Close()
+
+		client, err := ratus.NewClient(&ratus.ClientOptions{Origin: ts.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := client.Poll(ctx, "topic", &ratus.Promise{AtMostOnce: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Commit(); err != nil {
+			t.Error(err)
+		}
+		if n := patched.Load(); n != 0 {
+			t.Errorf("incorrect number of commits, expected 0, got %d", n)
+		}
+	})
+
+	t.Run("dead-letter", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		// The same task is claimed repeatedly and the commits are recorded.
+		var mu sync.Mutex
+		var ms []ratus.Commit
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			if r.Method == http.MethodPatch {
+				var m ratus.Commit
+				json.NewDecoder(r.Body).Decode(&m)
+				mu.Lock()
+				ms = append(ms, m)
+				if len(ms) == 4 {
+					cancel()
+				}
+				mu.Unlock()
+			}
+			json.NewEncoder(w).Encode(&ratus.Task{ID: "id", Topic: "topic", Nonce: "nonce"})
+		}))
+		defer ts.Close()
+
+		client, err := ratus.NewClient(&ratus.ClientOptions{Origin: ts.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var a atomic.Int32
+		if err := client.Subscribe(ctx, &ratus.SubscribeOptions{
+			Promise:           &ratus.Promise{},
+			Topic:             "topic",
+			MaxHandlerRetries: 2,
+			DeadLetterTopic:   "dead",
+		}, func(c *ratus.Context, err error) {
+			if err != nil {
+				return
+			}
+			if a.Add(1) == 4 {
+				return
+			}
+			c.Retry("1m").SetError(errors.New("unavailable"))
+		}); !errors.Is(err, context.Canceled) {
+			t.Error(err)
+		}
+
+		// The task should be dead-lettered after two retries, and the count
+		// should be reset for the task claimed again afterwards.
+		mu.Lock()
+		defer mu.Unlock()
+		if len(ms) != 4 {
+			t.Fatalf("incorrect number of commits, expected 4, got %d", len(ms))
+		}
+		for i, m := range ms {
+			s, topic := ratus.TaskStatePending, ""
+			switch i {
+			case 2:
+				s, topic = ratus.TaskStateFailed, "dead"
+			case 3:
+				s = ratus.TaskStateCompleted
+			}
+			if *m.State != s || m.Topic != topic {
+				t.Errorf("incorrect commit %d, expected state %d and topic %q, got %d and %q", i, s, topic, *m.State, m.Topic)
+			}
+			if i < 3 && m.Error != "unavailable" {
+				t.Errorf("incorrect error of commit %d, expected %q, got %q", i, "unavailable", m.Error)
+			}
+		}
+		if ms[2].Defer != "" || ms[2].Scheduled != nil {
+			t.Error("dead-lettered tasks should not be rescheduled")
+		}
+	})
+
+	t.Run("scale", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		// Serve a backlog of tasks and then report the topic as drained,
+		// counting the polls made after draining.
+		var backlog, drained atomic.Int32
+		backlog.Store(60)
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			if r.Method == http.MethodPost && backlog.Add(-1) < 0 {
+				drained.Add(1)
+				w.WriteHeader(http.StatusNotFound)
+				json.NewEncoder(w).Encode(ratus.NewError(ratus.ErrNotFound))
+				return
+			}
+			json.NewEncoder(w).Encode(&ratus.Task{ID: "id", Topic: "topic"})
+		}))
+		defer ts.Close()
+
+		client, err := ratus.NewClient(&ratus.ClientOptions{Origin: ts.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var active, peak atomic.Int32
+		go func() {
+			for drained.Load() == 0 {
+				time.Sleep(time.Millisecond)
+			}
+			time.Sleep(200 * time.Millisecond)
+			cancel()
+		}()
+		if err := client.Subscribe(ctx, &ratus.SubscribeOptions{
+			Promise:          &ratus.Promise{},
+			Topic:            "topic",
+			Concurrency:      1,
+			MaxConcurrency:   4,
+			ConcurrencyDelay: time.Microsecond,
+			DrainInterval:    100 * time.Millisecond,
+		}, func(c *ratus.Context, err error) {
+			if err != nil {
+				return
+			}
+			n := active.Add(1)
+			defer active.Add(-1)
+			for v := peak.Load(); n > v && !peak.CompareAndSwap(v, n); v = peak.Load() {
+			}
+			time.Sleep(5 * time.Millisecond)
+		}); !errors.Is(err, context.Canceled) {
+			t.Error(err)
+		}
+
+		// The concurrency should grow with the backlog, and shrink back to
+		// a single goroutine polling at the drain interval.
+		if n := peak.Load(); n <= 1 || n > 4 {
+			t.Errorf("incorrect peak concurrency, expected between 2 and 4, got %d", n)
+		}
+		if n := drained.Load(); n > 7 {
+			t.Errorf("too many polls after draining, expected at most 7, got %d", n)
+		}
+	})
+
+	t.Run("handler-timeout", func(t *testing.T) {
+		t.Parallel()
+
+		// Tasks are claimed with a deadline of 200 milliseconds.
+		ms := make(chan ratus.Commit, 1)
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			if r.Method == http.MethodPatch {
+				var m ratus.Commit
+				json.NewDecoder(r.Body).Decode(&m)
+				select {
+				case ms <- m:
+				default:
+				}
+			}
+			n := time.Now()
+			d := n.Add(200 * time.Millisecond)
+			json.NewEncoder(w).Encode(&ratus.Task{ID: "id", Topic: "topic", Consumed: &n, Deadline: &d})
+		}))
+		defer ts.Close()
+
+		client, err := ratus.NewClient(&ratus.ClientOptions{Origin: ts.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, x := range []struct {
+			name    string
+			timeout time.Duration
+			margin  time.Duration
+			handler time.Duration
+			state   ratus.TaskState
+		}{
+			{"timeout", 50 * time.Millisecond, time.Millisecond, 50 * time.Millisecond, ratus.TaskStatePending},
+			{"margin", time.Minute, 150 * time.Millisecond, 100 * time.Millisecond, ratus.TaskStatePending},
+			{"fast", time.Minute, time.Millisecond, 0, ratus.TaskStateCompleted},
+		} {
+			// Stop the subscription once the task has been committed.
+			ctx, cancel := context.WithCancel(context.Background())
+			var m ratus.Commit
+			go func() {
+				m = <-ms
+				cancel()
+			}()
+			var elapsed time.Duration
+			if err := client.Subscribe(ctx, &ratus.SubscribeOptions{
+				Promise:        &ratus.Promise{},
+				Topic:          "topic",
+				HandlerTimeout: x.timeout,
+				CommitMargin:   x.margin,
+			}, func(c *ratus.Context, err error) {
+				if err != nil || x.handler == 0 || elapsed > 0 {
+					return
+				}
+				s := time.Now()
+				<-c.Done()
+				elapsed = time.Since(s)
+			}); !errors.Is(err, context.Canceled) {
+				t.Error(err)
+			}
+
+			// Handlers exceeding the limit should be canceled before the
+			// deadline of the task, and the task should be retried.
+			if *m.State != x.state {
+				t.Errorf("incorrect state after %s, expected %d, got %d", x.name, x.state, *m.State)
+			}
+			if x.handler > 0 && (elapsed < x.handler-10*time.Millisecond || elapsed > x.handler+50*time.Millisecond) {
+				t.Errorf("incorrect handler duration for %s, expected about %v, got %v", x.name, x.handler, elapsed)
+			}
+			if x.state == ratus.TaskStatePending && m.Error != "handler timed out" {
+				t.Errorf("incorrect error after %s, got %q", x.name, m.Error)
+			}
+		}
+	})
+
+	t.Run("shutdown-timeout", func(t *testing.T) {
+		t.Parallel()
+		ms := make(chan ratus.Commit, 1)
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			if r.Method == http.MethodPatch {
+				var m ratus.Commit
+				json.NewDecoder(r.Body).Decode(&m)
+				select {
+				case ms <- m:
+				default:
+				}
+			}
+			n := time.Now()
+			d := n.Add(time.Minute)
+			json.NewEncoder(w).Encode(&ratus.Task{ID: "id", Topic: "topic", Consumed: &n, Deadline: &d})
+		}))
+		defer ts.Close()
+
+		client, err := ratus.NewClient(&ratus.ClientOptions{Origin: ts.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Tasks being executed when the subscription is canceled should be
+		// given the shutdown timeout to finish and be committed.
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		var alive bool
+		if err := client.Subscribe(ctx, &ratus.SubscribeOptions{
+			Promise:         &ratus.Promise{},
+			Topic:           "topic",
+			ShutdownTimeout: time.Minute,
+		}, func(c *ratus.Context, err error) {
+			if err != nil || ctx.Err() != nil {
+				return
+			}
+			cancel()
+			time.Sleep(10 * time.Millisecond)
+			alive = c.Err() == nil
+		}); !errors.Is(err, context.Canceled) {
+			t.Error(err)
+		}
+		if !alive {
+			t.Error("expected the context of the task to remain valid during shutdown")
+		}
+		select {
+		case m := <-ms:
+			if *m.State != ratus.TaskStateCompleted {
+				t.Errorf("incorrect state, expected %d, got %d", ratus.TaskStateCompleted, *m.State)
+			}
+		default:
+			t.Error("expected the task to be committed during shutdown")
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		t.Parallel()
+		ctx := context.Background()
+
+		// Tasks are claimed with a deadline of 50 milliseconds.
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n := time.Now()
+			d := n.Add(50 * time.Millisecond)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(&ratus.Task{ID: "id", Topic: "topic", State: ratus.TaskStateActive, Consumed: &n, Deadline: &d})
+		}))
+		defer ts.Close()
+
+		client, err := ratus.NewClient(&ratus.ClientOptions{Origin: ts.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := client.Poll(ctx, "topic", &ratus.Promise{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d, ok := c.Remaining(); !ok || d <= 0 || d > 50*time.Millisecond {
+			t.Errorf("incorrect remaining duration, got %v", d)
+		}
+
+		// Remaining durations should be measured with the clock of the client.
+		k := clock.NewFake(time.Now())
+		fc, err := ratus.NewClient(&ratus.ClientOptions{Origin: ts.URL, Clock: k})
+		if err != nil {
+			t.Fatal(err)
+		}
+		x, err := fc.Poll(ctx, "topic", &ratus.Promise{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		k.Advance(time.Minute)
+		if d, ok := x.Remaining(); !ok || d != 0 {
+			t.Errorf("incorrect remaining duration after advancing the clock, got %v", d)
+		}
+		<-c.Done()
+		if err := context.Cause(c); !errors.Is(err, ratus.ErrPromiseExpired) {
+			t.Errorf("incorrect cause, expected %q, got %v", ratus.ErrPromiseExpired, err)
+		}
+		if !errors.Is(c.Err(), context.DeadlineExceeded) {
+			t.Errorf("incorrect error, expected %q, got %v", context.DeadlineExceeded, c.Err())
+		}
+		if d, ok := c.Remaining(); !ok || d != 0 {
+			t.Errorf("incorrect remaining duration after expiration, got %v", d)
+		}
+
+		// Contexts of tasks without deadlines have no budget.
+		if _, ok := (&ratus.Context{Context: ctx}).Remaining(); ok {
+			t.Error("expected no remaining duration without a deadline")
+		}
+	})
+
+	t.Run("wait", func(t *testing.T) {
+		t.Parallel()
+		ctx := context.Background()
+
+		// Tasks stay pending for a few checks before reaching the state
+		// indicated by their IDs.
+		var gets atomic.Int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			if r.Method == http.MethodPost {
+				json.NewEncoder(w).Encode(&ratus.Updated{Created: 1})
+				return
+			}
+			v := ratus.Task{ID: path.Base(r.URL.Path), Topic: "topic"}
+			if gets.Add(1)%3 == 0 {
+				switch v.ID {
+				case "completed":
+					v.State = ratus.TaskStateCompleted
+					v.Payload = "input"
+					v.Result = "result"
+				case "failed":
+					v.State = ratus.TaskStateFailed
+					v.LastError = "unavailable"
+				}
+			}
+			json.NewEncoder(w).Encode(&v)
+		}))
+		defer ts.Close()
+
+		client, err := ratus.NewClient(&ratus.ClientOptions{Origin: ts.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := client.InsertAndWait(ctx, &ratus.Task{ID: "completed", Topic: "topic"}, time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var p string
+		if err := v.Decode(&p); err != nil || p != "input" {
+			t.Errorf("incorrect payload, expected %q, got %q", "input", p)
+		}
+		if err := v.DecodeResult(&p); err != nil || p != "result" {
+			t.Errorf("incorrect result, expected %q, got %q", "result", p)
+		}
+		if _, err := client.InsertAndWait(ctx, &ratus.Task{ID: "failed", Topic: "topic"}, time.Millisecond); !errors.Is(err, ratus.ErrTaskFailed) || !strings.Contains(err.Error(), "unavailable") {
+			t.Errorf("incorrect error, expected %q, got %v", ratus.ErrTaskFailed, err)
+		}
+		ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		if _, err := client.InsertAndWait(ctx, &ratus.Task{ID: "pending", Topic: "topic"}, time.Millisecond); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("incorrect error, expected %q, got %v", context.DeadlineExceeded, err)
+		}
+		if _, err := client.InsertAndWait(ctx, &ratus.Task{ID: "pending", Topic: "topic"}, 0); err == nil {
+			t.Error("expected error with invalid interval")
+		}
+	})
+
+	t.Run("token", func(t *testing.T) {
+		t.Parallel()
+		ctx := context.Background()
+
+		// Commits should be sent to the task identified by the token.
+		var path, token string
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var m ratus.Commit
+			json.NewDecoder(r.Body).Decode(&m)
+			path, token = r.URL.Path, m.Token
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(&ratus.Task{ID: "id", Topic: "topic"})
+		}))
+		defer ts.Close()
+
+		client, err := ratus.NewClient(&ratus.ClientOptions{Origin: ts.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := (&ratus.Token{Topic: "topic", ID: "id", Nonce: "nonce"}).Sign([]byte("secret"))
+		if _, err := client.CommitToken(ctx, s, &ratus.Commit{}); err != nil {
+			t.Error(err)
+		}
+		if path != "/v1/topics//tasks/id" || token != s {
+			t.Errorf("incorrect commit, got path %q and token %q", path, token)
+		}
+		if _, err := client.CommitToken(ctx, "foo", &ratus.Commit{}); !errors.Is(err, ratus.ErrInvalidToken) {
+			t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrInvalidToken, err)
+		}
+	})
+
+	t.Run("version", func(t *testing.T) {
+		t.Parallel()
+		ctx := context.Background()
+
+		// The version of the task should be sent in the If-Match header.
+		var mu sync.Mutex
+		var h []string
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			h = append(h, r.Header.Get("If-Match"))
+			mu.Unlock()
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(&ratus.Updated{Updated: 1})
+		}))
+		defer ts.Close()
+
+		client, err := ratus.NewClient(&ratus.ClientOptions{Origin: ts.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, v := range []int64{0, 3} {
+			if _, err := client.UpsertTask(ctx, &ratus.Task{ID: "id", Topic: "topic", Version: v}); err != nil {
+				t.Error(err)
+			}
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if len(h) != 2 || h[0] != "" || h[1] != `"3"` {
+			t.Errorf("incorrect If-Match headers, got %q", h)
+		}
+	})
+
+	t.Run("cipher", func(t *testing.T) {
+		t.Parallel()
+		ctx := context.Background()
+
+		// The server stores the task as is and returns it on subsequent
+		// requests, so that the stored payload can be inspected.
+		var mu sync.Mutex
+		var stored ratus.Task
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			w.Header().Set("Content-Type", "application/json")
+			switch r.Method {
+			case http.MethodPost:
+				json.NewDecoder(r.Body).Decode(&stored)
+				w.WriteHeader(http.StatusCreated)
+				json.NewEncoder(w).Encode(&ratus.Updated{Created: 1})
+			case http.MethodPatch:
+				var m ratus.Commit
+				json.NewDecoder(r.Body).Decode(&m)
+				stored.Payload = m.Payload
+				if m.Result != nil {
+					stored.Result = m.Result
+				}
+				json.NewEncoder(w).Encode(&stored)
+			default:
+				if path.Base(r.URL.Path) == "result" {
+					json.NewEncoder(w).Encode(&ratus.Result{ID: stored.ID, State: stored.State, Result: stored.Result})
+					return
+				}
+				json.NewEncoder(w).Encode(&stored)
+			}
+		}))
+		defer ts.Close()
+
+		k, err := ratus.NewAESCipher(bytes.Repeat([]byte{1}, 16))
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, err := ratus.NewClient(&ratus.ClientOptions{Origin: ts.URL, Cipher: k})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Payloads should be encrypted without modifying the original task.
+		x := ratus.Task{ID: "id", Topic: "topic", Payload: "secret"}
+		if _, err := client.InsertTask(ctx, &x); err != nil {
+			t.Fatal(err)
+		}
+		if x.Payload != "secret" {
+			t.Errorf("original payload should not be modified, got %v", x.Payload)
+		}
+		mu.Lock()
+		b, _ := json.Marshal(stored.Payload)
+		mu.Unlock()
+		if bytes.Contains(b, []byte("secret")) || !bytes.Contains(b, []byte(`"encryption":"ratus/v1"`)) {
+			t.Errorf("payload should be stored encrypted, got %s", b)
+		}
+
+		// Tasks retrieved by the client should be decrypted when decoding.
+		v, err := client.GetTask(ctx, "id")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var p string
+		if err := v.Decode(&p); err != nil {
+			t.Error(err)
+		} else if p != "secret" {
+			t.Errorf("incorrect payload, expected %q, got %q", "secret", p)
+		}
+
+		// Payloads in commits should be encrypted as well.
+		if v, err = client.PatchTask(ctx, "id", &ratus.Commit{Payload: "another"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := v.Decode(&p); err != nil {
+			t.Error(err)
+		} else if p != "another" {
+			t.Errorf("incorrect payload, expected %q, got %q", "another", p)
+		}
+
+		// Results should be encrypted and decrypted in the same way.
+		if _, err = client.PatchTask(ctx, "id", &ratus.Commit{Payload: "another", Result: "output"}); err != nil {
+			t.Fatal(err)
+		}
+		mu.Lock()
+		b, _ = json.Marshal(stored.Result)
+		mu.Unlock()
+		if bytes.Contains(b, []byte("output")) {
+			t.Errorf("result should be stored encrypted, got %s", b)
+		}
+		r, err := client.GetResult(ctx, "id")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Decode(&p); err != nil {
+			t.Error(err)
+		} else if p != "output" {
+			t.Errorf("incorrect result, expected %q, got %q", "output", p)
+		}
+
+		// Clients without the cipher should not be able to decode payloads.
+		other, err := ratus.NewClient(&ratus.ClientOptions{Origin: ts.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, err = other.GetTask(ctx, "id"); err != nil {
+			t.Fatal(err)
+		}
+		if err := v.Decode(&p); !errors.Is(err, ratus.ErrEncryptedPayload) {
+			t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrEncryptedPayload, err)
+		}
+
+		// Encrypted payloads should be bound to their tasks.
+		mu.Lock()
+		stored.ID = "other"
+		mu.Unlock()
+		if v, err = client.GetTask(ctx, "other"); err != nil {
+			t.Fatal(err)
+		}
+		if err := v.Decode(&p); err == nil {
+			t.Error("expected error for payload copied from another task")
+		}
+
+		// Plaintext payloads shaped like encrypted ones should be encrypted.
+		x = ratus.Task{ID: "id", Topic: "topic", Payload: map[string]any{"ciphertext": "secret"}}
+		if _, err := client.InsertTask(ctx, &x); err != nil {
+			t.Fatal(err)
+		}
+		mu.Lock()
+		b, _ = json.Marshal(stored.Payload)
+		mu.Unlock()
+		if bytes.Contains(b, []byte("secret")) {
+			t.Errorf("payload should be stored encrypted, got %s", b)
+		}
+
+		// Tasks retrieved in encrypted form should not be encrypted again when
+		// sent back as is.
+		if v, err = client.GetTask(ctx, "id"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.UpsertTask(ctx, v); err != nil {
+			t.Fatal(err)
+		}
+		if v, err = client.GetTask(ctx, "id"); err != nil {
+			t.Fatal(err)
+		}
+		var m map[string]string
+		if err := v.Decode(&m); err != nil {
+			t.Error(err)
+		} else if m["ciphertext"] != "secret" {
+			t.Errorf("incorrect payload, expected %q, got %v", "secret", m)
+		}
+	})
+
+	t.Run("blob", func(t *testing.T) {
+		t.Parallel()
+		ctx := context.Background()
+
+		// The server stores the tasks as is and returns them on subsequent
+		// requests, so that the stored payloads can be inspected.
+		var mu sync.Mutex
+		stored := make(map[string]*ratus.Task)
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			w.Header().Set("Content-Type", "application/json")
+			id := path.Base(r.URL.Path)
+			switch r.Method {
+			case http.MethodPost:
+				var v ratus.Task
+				json.NewDecoder(r.Body).Decode(&v)
+				stored[id] = &v
+				w.WriteHeader(http.StatusCreated)
+				json.NewEncoder(w).Encode(&ratus.Updated{Created: 1})
+			default:
+				json.NewEncoder(w).Encode(stored[id])
+			}
+		}))
+		defer ts.Close()
+
+		s, err := ratus.NewDirBlobStore(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		k, err := ratus.NewAESCipher(bytes.Repeat([]byte{1}, 16))
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, err := ratus.NewClient(&ratus.ClientOptions{Origin: ts.URL, Cipher: k, BlobStore: s, OffloadThreshold: 150})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Only payloads larger than the threshold should be offloaded, after
+		// being encrypted.
+		large := map[string]any{"text": strings.Repeat("secret", 20), "n": json.Number("12345678901234567890")}
+		for id, p := range map[string]any{"small": "secret", "large": large} {
+			if _, err := client.InsertTask(ctx, &ratus.Task{ID: id, Topic: "topic", Payload: p}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		mu.Lock()
+		a, _ := json.Marshal(stored["small"].Payload)
+		b, _ := json.Marshal(stored["large"].Payload)
+		mu.Unlock()
+		if !bytes.Contains(a, []byte(`"encryption":"ratus/v1"`)) {
+			t.Errorf("small payload should be stored encrypted, got %s", a)
+		}
+		if !bytes.HasPrefix(b, []byte(`{"blob":`)) {
+			t.Errorf("large payload should be stored as a reference, got %s", b)
+		}
+
+		// Offloaded payloads should be fetched and decrypted when decoding.
+		v, err := client.GetTask(ctx, "large")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var p struct {
+			Text string      `json:"text"`
+			N    json.Number `json:"n"`
+		}
+		if err := v.Decode(&p); err != nil {
+			t.Error(err)
+		} else if p.Text != large["text"] || p.N != large["n"] {
+			t.Errorf("incorrect payload, got %+v", p)
+		}
+
+		// Clients without the blob store should not be able to decode
+		// offloaded payloads.
+		other, err := ratus.NewClient(&ratus.ClientOptions{Origin: ts.URL, Cipher: k})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, err = other.GetTask(ctx, "large"); err != nil {
+			t.Fatal(err)
+		}
+		if err := v.Decode(&p); !errors.Is(err, ratus.ErrOffloadedPayload) {
+			t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrOffloadedPayload, err)
+		}
+		if _, err := ratus.NewClient(&ratus.ClientOptions{Origin: ts.URL, OffloadThreshold: -1}); err == nil {
+			t.Error("expected error for negative offload threshold")
+		}
+	})
+
+	t.Run("event", func(t *testing.T) {
+		t.Parallel()
+
+		t.Run("drain", func(t *testing.T) {
+			t.Parallel()
+			ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
+			defer cancel()
+
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNotFound)
+				w.Header().Add("Content-Type", "application/json")
+				e := ratus.NewError(ratus.ErrNotFound)
+				b, _ := json.Marshal(e)
+				fmt.Fprintln(w, string(b))
+			}))
+			defer ts.Close()
+
+			client, err := ratus.NewClient(&ratus.ClientOptions{Origin: ts.URL})
+			if err != nil {
+				t.Error(err)
+			}
+
+			var a atomic.Int32
+			if err := client.Subscribe(ctx, &ratus.SubscribeOptions{
+				Promise:          &ratus.Promise{Timeout: "30s"},
+				Topic:            "topic",
+				Concurrency:      1,
+				ConcurrencyDelay: 1 * time.Microsecond,
+				PollInterval:     1 * time.Millisecond,
+				DrainInterval:    100 * time.Millisecond,
+				ErrorInterval:    1 * time.Millisecond,
+			}, func(c *ratus.Context, err error) {
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				a.Add(1)
+			}); !errors.Is(err, context.DeadlineExceeded) {
+				t.Error(err)
+			}
+			if a.Load() != 0 {
+				t.Fail()
+			}
+		})
+
+		t.Run("error", func(t *testing.T) {
+			t.Parallel()
+			ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
+			defer cancel()
+
+			client := newClient(t, &stub.Engine{Err: ratus.ErrInternalServerError})
 
 			var a atomic.Int32
 			if err := client.Subscribe(ctx, &ratus.SubscribeOptions{
@@ -495,6 +2106,20 @@ func TestClient(t *testing.T) {
 			}
 		})
 
+		t.Run("format", func(t *testing.T) {
+			t.Parallel()
+			if _, err := ratus.NewClient(&ratus.ClientOptions{ContentType: "text/plain"}); err == nil {
+				t.Fail()
+			}
+		})
+
+		t.Run("codec", func(t *testing.T) {
+			t.Parallel()
+			if _, err := ratus.NewClient(&ratus.ClientOptions{Codec: &protobufCodec{}}); err == nil {
+				t.Fail()
+			}
+		})
+
 		t.Run("context", func(t *testing.T) {
 			t.Parallel()
 			var c ratus.Context
@@ -508,6 +2133,7 @@ func TestClient(t *testing.T) {
 			c.Force()
 			c.Abstain()
 			c.Archive()
+			c.Fail(errors.New("foo"))
 			c.Reschedule(time.Now())
 			c.Retry("")
 			c.Reset()
@@ -0,0 +1,120 @@
+// Package clock abstracts the passage of time, so that the logic of
+// scheduling, retention and timeouts can be tested deterministically by
+// advancing a fake clock instead of sleeping.
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the current time and waits for durations to elapse.
+type Clock interface {
+
+	// Now returns the current time.
+	Now() time.Time
+	// After waits for the duration to elapse and then sends the current time
+	// on the returned channel.
+	After(d time.Duration) <-chan time.Time
+}
+
+// System is the clock backed by the system time.
+var System Clock = system{}
+
+// system implements Clock with the functions of the time package.
+type system struct{}
+
+// Now returns the current local time.
+func (system) Now() time.Time {
+	return time.Now()
+}
+
+// After waits for the duration to elapse and then sends the current time on
+// the returned channel.
+func (system) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// Fake is a clock that only moves when it is advanced or set explicitly.
+// It is safe for concurrent use.
+type Fake struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []waiter
+}
+
+// waiter is a pending call to After, which is fired once the fake clock
+// reaches the time.
+type waiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+// NewFake creates a fake clock starting at the time.
+func NewFake(t time.Time) *Fake {
+	return &Fake{now: t}
+}
+
+// Now returns the current time of the fake clock.
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// After returns a channel that receives the time of the fake clock once it
+// has been advanced by the duration. The channel receives immediately if the
+// duration is not positive.
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- f.now
+		return ch
+	}
+	f.waiters = append(f.waiters, waiter{f.now.Add(d), ch})
+	return ch
+}
+
+// Advance moves the fake clock forward by the duration, firing the channels
+// returned by After that are due.
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.set(f.now.Add(d))
+}
+
+// Set moves the fake clock to the time, firing the channels returned by After
+// that are due. Setting the clock backward does not fire any channel.
+func (f *Fake) Set(t time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.set(t)
+}
+
+// Waiters returns the number of channels returned by After that have not been
+// fired, which allows tests to wait until the code under test is blocked on
+// the clock before advancing it.
+func (f *Fake) Waiters() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.waiters)
+}
+
+// set moves the clock to the time and fires the waiters that are due. The
+// lock must be held by the caller.
+func (f *Fake) set(t time.Time) {
+	f.now = t
+	k := 0
+	for _, w := range f.waiters {
+		if w.at.After(t) {
+			f.waiters[k] = w
+			k++
+			continue
+		}
+		w.ch <- t
+	}
+	clear(f.waiters[k:])
+	f.waiters = f.waiters[:k]
+}
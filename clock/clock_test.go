@@ -0,0 +1,75 @@
+package clock_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hyperonym/ratus/clock"
+)
+
+func TestSystem(t *testing.T) {
+	if d := time.Since(clock.System.Now()); d < 0 || d > time.Second {
+		t.Errorf("incorrect system time, off by %s", d)
+	}
+	select {
+	case <-clock.System.After(time.Millisecond):
+	case <-time.After(time.Second):
+		t.Error("expected the channel to receive")
+	}
+}
+
+func TestFake(t *testing.T) {
+	n := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	f := clock.NewFake(n)
+	if v := f.Now(); !v.Equal(n) {
+		t.Errorf("incorrect time, expected %s, got %s", n, v)
+	}
+
+	// Channels with non-positive durations receive immediately.
+	select {
+	case <-f.After(0):
+	default:
+		t.Error("expected the channel to receive immediately")
+	}
+
+	a := f.After(time.Minute)
+	b := f.After(time.Hour)
+	if v := f.Waiters(); v != 2 {
+		t.Errorf("incorrect number of waiters, expected 2, got %d", v)
+	}
+	f.Advance(30 * time.Second)
+	select {
+	case <-a:
+		t.Error("expected the channel not to receive before the duration")
+	default:
+	}
+	f.Advance(30 * time.Second)
+	select {
+	case v := <-a:
+		if !v.Equal(n.Add(time.Minute)) {
+			t.Errorf("incorrect time received, got %s", v)
+		}
+	default:
+		t.Error("expected the channel to receive after the duration")
+	}
+	if v := f.Waiters(); v != 1 {
+		t.Errorf("incorrect number of waiters, expected 1, got %d", v)
+	}
+
+	// Setting the clock backward does not fire channels.
+	f.Set(n)
+	select {
+	case <-b:
+		t.Error("expected the channel not to receive")
+	default:
+	}
+	f.Set(n.Add(2 * time.Hour))
+	select {
+	case <-b:
+	default:
+		t.Error("expected the channel to receive after the time is set")
+	}
+	if v := f.Now(); !v.Equal(n.Add(2 * time.Hour)) {
+		t.Errorf("incorrect time, got %s", v)
+	}
+}
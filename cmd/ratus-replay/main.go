@@ -0,0 +1,68 @@
+// Command ratus-replay replays API traffic recorded by instances started with
+// --record-path against another instance, typically a local one, to reproduce
+// issues depending on the order and timing of concurrent requests.
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/alexflint/go-arg"
+
+	"github.com/hyperonym/ratus/internal/record"
+)
+
+// args contains the command line arguments.
+type args struct {
+	Origin string  `arg:"-o,--origin,env:ORIGIN" placeholder:"URL" help:"origin of the instance to which requests are sent, such as http://127.0.0.1:8080" default:"http://127.0.0.1:80"`
+	Speed  float64 `arg:"-s,--speed,env:SPEED" placeholder:"FACTOR" help:"factor by which the recorded timing is sped up, such as 2 to replay twice as fast or 0.5 to replay at half speed" default:"1"`
+	Path   string  `arg:"positional,required" placeholder:"PATH" help:"path to the file of recorded requests"`
+}
+
+func main() {
+	if err := run(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run() error {
+	var a args
+	arg.MustParse(&a)
+
+	f, err := os.Open(a.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Stop sending requests when an interrupt or SIGTERM signal is received.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	rs, err := record.Replay(ctx, strings.TrimSuffix(a.Origin, "/"), f, a.Speed)
+	if err != nil {
+		return err
+	}
+
+	// Report requests whose outcomes differ from the recorded ones.
+	var n int
+	for _, x := range rs {
+		if x.Err != nil {
+			n++
+			log.Printf("%s %s: %v\n", x.Entry.Method, x.Entry.Path, x.Err)
+		} else if x.Status != x.Entry.Status {
+			n++
+			log.Printf("%s %s: expected status %d, got %d\n", x.Entry.Method, x.Entry.Path, x.Entry.Status, x.Status)
+		}
+	}
+	log.Printf("replayed %d requests, %d with different outcomes\n", len(rs), n)
+	if n > 0 {
+		return fmt.Errorf("%d requests had different outcomes", n)
+	}
+	return nil
+}
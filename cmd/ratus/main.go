@@ -1,32 +1,71 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"reflect"
+	"regexp"
+	"runtime"
 	"runtime/debug"
 	"strings"
 	"syscall"
 	"time"
 
 	"github.com/alexflint/go-arg"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"golang.org/x/sync/errgroup"
 
+	"github.com/hyperonym/ratus"
 	"github.com/hyperonym/ratus/docs"
+	"github.com/hyperonym/ratus/internal/bridge"
 	"github.com/hyperonym/ratus/internal/config"
 	"github.com/hyperonym/ratus/internal/controller"
 	"github.com/hyperonym/ratus/internal/engine"
 	"github.com/hyperonym/ratus/internal/engine/memdb"
 	"github.com/hyperonym/ratus/internal/engine/mongodb"
+	"github.com/hyperonym/ratus/internal/export"
 	"github.com/hyperonym/ratus/internal/metrics"
 	"github.com/hyperonym/ratus/internal/middleware"
+	"github.com/hyperonym/ratus/internal/nonce"
+	"github.com/hyperonym/ratus/internal/notify"
+	"github.com/hyperonym/ratus/internal/push"
+	"github.com/hyperonym/ratus/internal/record"
 	"github.com/hyperonym/ratus/internal/router"
+	"github.com/hyperonym/ratus/ui"
 )
 
+// choreLease is the name of the lease for electing the instance that runs
+// background jobs.
+const choreLease = "chore"
+
+// Roles of instances, which determine whether they serve API requests, run
+// background jobs, or both.
+const (
+	roleAPI    = "api"
+	roleWorker = "worker"
+	roleAll    = "all"
+)
+
+// monitorInterval is the interval at which instances that only serve API
+// requests check whether any instance is running background jobs.
+const monitorInterval = 30 * time.Second
+
+// webhookTimeout is the time limit for posting the results of background jobs
+// to the webhook.
+const webhookTimeout = 10 * time.Second
+
 // version contains the version string set by -ldflags.
 var version string
 
@@ -39,9 +78,32 @@ type (
 // args contains the command line arguments.
 type args struct {
 	Engine string `arg:"--engine,env:ENGINE" placeholder:"NAME" help:"name of the storage engine to be used" default:"memdb"`
+	Role   string `arg:"--role,env:ROLE" placeholder:"ROLE" help:"role of the instance, either \"api\" to serve API requests only, \"worker\" to run background jobs only, or \"all\" for both" default:"all"`
 	config.ServerConfig
+	config.TimeoutConfig
+	config.CORSConfig
+	config.CompressionConfig
+	config.AdminConfig
 	config.ChoreConfig
+	config.ExpiryConfig
+	config.BridgeConfig
+	config.PushConfig
+	config.NotifyConfig
+	config.PromiseConfig
+	config.SkewConfig
+	config.WatchConfig
 	config.PaginationConfig
+	config.NameConfig
+	config.TransitionConfig
+	config.IdempotencyConfig
+	config.ConsumerConfig
+	config.QuotaConfig
+	config.BackpressureConfig
+	config.CapacityConfig
+	config.DeleteConfig
+	config.TokenConfig
+	config.UIConfig
+	config.RecordConfig
 	memdbConfig
 	mongodbConfig
 }
@@ -53,14 +115,111 @@ type args struct {
 func (args) Version() string {
 	if info, ok := debug.ReadBuildInfo(); ok && version == "" {
 		version = info.Main.Version
+		if r := revision(); r != "" {
+			version += "-" + r
+		}
+	}
+	return version
+}
+
+// revision returns the commit hash from the embedded build information, or an
+// empty string if it is not available.
+func revision() string {
+	if info, ok := debug.ReadBuildInfo(); ok {
 		for _, s := range info.Settings {
 			if s.Key == "vcs.revision" {
-				version += "-" + s.Value
-				break
+				return s.Value
 			}
 		}
 	}
-	return version
+	return ""
+}
+
+// urlPattern matches URLs in the values of settings, which are reduced to
+// their schemes and hosts since credentials may be embedded in any part.
+var urlPattern = regexp.MustCompile(`[A-Za-z][A-Za-z0-9+.-]*://[^\s,]+`)
+
+// settings returns the arguments keyed by the names of their environment
+// variables for reporting, omitting empty strings but not other zero values.
+// Values of arguments tagged with `secret:"true"` are redacted, and arguments
+// of storage engines other than the one in use are omitted.
+func (a *args) settings() map[string]string {
+	m := make(map[string]string)
+	var walk func(v reflect.Value)
+	walk = func(v reflect.Value) {
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f, x := t.Field(i), v.Field(i)
+			if f.Anonymous && x.Kind() == reflect.Struct {
+				walk(x)
+				continue
+			}
+			var env string
+			for _, s := range strings.Split(f.Tag.Get("arg"), ",") {
+				if k, ok := strings.CutPrefix(s, "env:"); ok {
+					env = k
+				}
+			}
+			if env == "" {
+				continue
+			}
+			if p, _, _ := strings.Cut(env, "_"); (p == "MEMDB" || p == "MONGODB") && !strings.EqualFold(p, a.Engine) {
+				continue
+			}
+			// Values of embedded engine configurations are not accessible as
+			// interfaces since the aliases are unexported, so durations are
+			// formatted explicitly.
+			s := fmt.Sprint(x)
+			if x.Type() == reflect.TypeOf(time.Duration(0)) {
+				s = time.Duration(x.Int()).String()
+			}
+			if s == "" {
+				continue
+			}
+			if f.Tag.Get("secret") == "true" {
+				s = "REDACTED"
+			}
+			m[env] = urlPattern.ReplaceAllStringFunc(s, func(s string) string {
+				u, err := url.Parse(s)
+				if err != nil {
+					return "REDACTED"
+				}
+				return u.Scheme + "://" + u.Host
+			})
+		}
+	}
+	walk(reflect.ValueOf(a).Elem())
+	return m
+}
+
+// check validates the role of the instance against the other arguments, so
+// that instances that would do nothing, or could not coordinate with the
+// instances in other roles, are reported before starting.
+func (a *args) check() error {
+	shared := !strings.EqualFold(a.Engine, "memdb")
+	switch strings.ToLower(a.Role) {
+	case roleAll:
+		if a.ServerConfig.Port == 0 && a.ChoreConfig.Interval <= 0 && a.PushConfig.Endpoints == "" {
+			return errors.New("instance neither serves API requests nor runs background jobs")
+		}
+	case roleAPI:
+		if a.ServerConfig.Port == 0 {
+			return fmt.Errorf("port must be specified for role %s", roleAPI)
+		}
+		if !shared {
+			return fmt.Errorf("storage engine %s can not be shared with instances in other roles", a.Engine)
+		}
+	case roleWorker:
+		if a.ChoreConfig.Interval <= 0 {
+			return fmt.Errorf("chore interval must be specified for role %s", roleWorker)
+		}
+		if !shared {
+			return fmt.Errorf("storage engine %s can not be shared with instances in other roles", a.Engine)
+		}
+	default:
+		return fmt.Errorf("unknown role: %s", a.Role)
+	}
+	return nil
 }
 
 func main() {
@@ -78,19 +237,86 @@ func run() error {
 	// Parse command line arguments.
 	var a args
 	arg.MustParse(&a)
+	if err := a.check(); err != nil {
+		return err
+	}
+	role := strings.ToLower(a.Role)
+
+	// Create middlewares before connecting to the storage engine, so that
+	// invalid configurations are reported early.
+	cors, err := middleware.CORS(&a.CORSConfig)
+	if err != nil {
+		return err
+	}
+	compression, err := middleware.Compression(&a.CompressionConfig, "/metrics")
+	if err != nil {
+		return err
+	}
+	names, err := middleware.Names(&a.NameConfig)
+	if err != nil {
+		return err
+	}
+	timeouts, err := middleware.PromiseTimeouts(&a.PromiseConfig)
+	if err != nil {
+		return err
+	}
+	skew, err := middleware.Skew(&a.SkewConfig)
+	if err != nil {
+		return err
+	}
+	watch, err := middleware.Watch(&a.WatchConfig)
+	if err != nil {
+		return err
+	}
+	b, err := bridge.NewAMQP(&a.BridgeConfig)
+	if err != nil {
+		return err
+	}
+	ns, err := notify.NewNATS(&a.NotifyConfig)
+	if err != nil {
+		return err
+	}
+
+	// Open the file for recording API traffic if configured, which can be
+	// replayed against other instances with ratus-replay.
+	rec, err := record.New(&a.RecordConfig)
+	if err != nil {
+		return err
+	}
+	if rec != nil {
+		defer rec.Close()
+	}
+
+	// Open the file for exporting expired tasks if configured, which is
+	// exclusive with moving expired tasks to a topic.
+	var x engine.Exporter
+	if a.ExportPath != "" {
+		if a.ExpiryConfig.Topic != "" {
+			return errors.New("expired tasks can not be both exported and moved to a topic")
+		}
+		f, err := export.NewFile(a.ExportPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		x = f
+	}
 
 	// Create a context without timeout for the initialization phase.
 	ctx := context.Background()
 
 	// Create a storage engine instance of the specified type.
-	var (
-		g   engine.Engine
-		err error
-	)
+	var g engine.Engine
 	switch strings.ToLower(a.Engine) {
 	case "memdb":
+		a.memdbConfig.ExpiryTopic = a.ExpiryConfig.Topic
+		a.memdbConfig.ExpiryExporter = x
 		g, err = memdb.New(&a.memdbConfig)
 	case "mongodb":
+		a.mongodbConfig.ChoreBatchSize = a.BatchSize
+		a.mongodbConfig.ChoreTimeBudget = a.TimeBudget
+		a.mongodbConfig.ExpiryTopic = a.ExpiryConfig.Topic
+		a.mongodbConfig.ExpiryExporter = x
 		g, err = mongodb.New(&a.mongodbConfig)
 	default:
 		err = fmt.Errorf("unknown storage engine: %s", a.Engine)
@@ -99,6 +325,34 @@ func run() error {
 		return err
 	}
 
+	// Create the middleware validating state transitions of commits, which
+	// fetches the current states of tasks from the storage engine.
+	transitions, err := middleware.Transitions(&a.TransitionConfig, g)
+	if err != nil {
+		return err
+	}
+
+	// Create a pusher if tasks are to be pushed to consumer endpoints, which
+	// runs alongside background jobs. Pushed tasks are also republished by the
+	// bridge once committed.
+	p, err := push.New(g, &a.PushConfig)
+	if err != nil {
+		return err
+	}
+	if p != nil && b != nil {
+		p.Bridge = b.Publish
+	}
+
+	// Commits in the responses of push endpoints are validated by the same
+	// rules as the ones submitted through the API.
+	if p != nil {
+		v, err := middleware.NewCommitValidator(&a.NameConfig, &a.TransitionConfig, g)
+		if err != nil {
+			return err
+		}
+		p.Validate = v.Validate
+	}
+
 	// Initialize the storage engine instance and defer the close method for
 	// graceful shutdown.
 	if err := g.Open(ctx); err != nil {
@@ -106,24 +360,122 @@ func run() error {
 	}
 	defer g.Close(ctx)
 
-	// Create router and mount API endpoints.
-	r := router.New(&controller.V1{
-		Pagination: middleware.Pagination(&a.PaginationConfig),
-		Topic:      controller.NewTopicController(g),
-		Task:       controller.NewTaskController(g),
-		Promise:    controller.NewPromiseController(g),
-		Health:     controller.NewHealthController(g),
-		Metrics:    controller.NewMetricsController(g),
-	}, &docs.Swagger{})
-
-	// Start API server and background jobs.
+	// Instances running background jobs announce themselves through the
+	// storage engine if supported, so that instances only serving API requests
+	// are able to detect clusters where nobody runs background jobs. Instances
+	// in dedicated roles require the support to be aware of each other.
+	var ann engine.Announcer
+	if v, ok := g.(engine.Announcer); ok {
+		if _, err := v.Announced(ctx, roleWorker); err == nil {
+			ann = v
+		} else if role != roleAll {
+			return err
+		}
+	} else if role != roleAll {
+		return errors.New("storage engine does not support announcing instances")
+	}
+
+	// Notifications of available tasks are driven by the storage engine, so
+	// that tasks inserted through any instance are notified.
+	var w engine.Watcher
+	if ns != nil {
+		v, ok := g.(engine.Watcher)
+		if !ok {
+			return errors.New("storage engine does not support watching tasks")
+		}
+		w = v
+	}
+
+	// Controllers access the storage engine through a wrapper recording the
+	// duration of its operations, which tells storage latency apart from the
+	// response time of requests.
+	m := metrics.Instrument(g)
+
+	// Create router and mount API endpoints. Admin endpoints are only enabled
+	// if a token is configured for authentication, and the web dashboard is
+	// only served if enabled explicitly. API version 2 shares the controllers
+	// with version 1 but paginates lists with cursors.
+	v := controller.V1{
+		Pagination:   middleware.Pagination(&a.PaginationConfig),
+		AdminAuth:    middleware.Admin(&a.AdminConfig),
+		Deadline:     middleware.Timeout(&a.TimeoutConfig),
+		Idempotency:  middleware.Idempotency(&a.IdempotencyConfig),
+		Names:        names,
+		Timeouts:     timeouts,
+		Skew:         skew,
+		Transitions:  transitions,
+		Backpressure: middleware.Backpressure(&a.BackpressureConfig, m),
+		Capacity:     middleware.Capacity(&a.CapacityConfig, m),
+		Watch:        watch,
+		Topic:        controller.NewTopicController(m, &a.DeleteConfig),
+		Task:         controller.NewTaskController(m, &a.TokenConfig),
+		Promise:      controller.NewPromiseController(m, &a.TokenConfig),
+		Consumer:     controller.NewConsumerController(m, &a.ConsumerConfig),
+		Quota:        controller.NewQuotaController(m, &a.QuotaConfig),
+		Health:       controller.NewHealthController(m),
+		Metrics:      controller.NewMetricsController(m),
+	}
+	if a.AdminConfig.Token != "" {
+		v.Admin = controller.NewAdminController(m)
+	}
+	if b != nil {
+		v.Task.Bridge = b.Publish
+	}
+	v.Health.Build = &ratus.Build{
+		Version: a.Version(),
+		Commit:  revision(),
+		Go:      runtime.Version(),
+		Engine:  strings.ToLower(a.Engine),
+		Role:    role,
+		Config:  a.settings(),
+	}
+	if x, ok := g.(engine.TaskWatcher); ok {
+		v.Task.Watcher = x
+	}
+	v2 := controller.V2{V1: v}
+	v2.Pagination = middleware.Cursor(&a.PaginationConfig)
+	groups := []router.Group{&v, &v2, &docs.Swagger{}}
+	if a.UIConfig.Enabled {
+		groups = append(groups, &ui.Dashboard{})
+	}
+	mw := []gin.HandlerFunc{cors, compression}
+	if rec != nil {
+		mw = append(mw, rec.Handler())
+	}
+	r := router.New(mw, groups...)
+
+	// Start API server and background jobs according to the role. Instances
+	// that only serve API requests monitor the others instead.
 	e, ctx := errgroup.WithContext(ctx)
-	e.Go(func() error {
-		return serve(ctx, r.Handler(), &a.ServerConfig)
-	})
-	e.Go(func() error {
-		return chore(ctx, g, &a.ChoreConfig)
-	})
+	if role != roleWorker {
+		e.Go(func() error {
+			return serve(ctx, r.Handler(), &a.ServerConfig)
+		})
+		if b != nil {
+			e.Go(func() error {
+				return relay(ctx, b)
+			})
+		}
+	}
+	if role != roleAPI {
+		e.Go(func() error {
+			return chore(ctx, g, ann, &a.ChoreConfig)
+		})
+		if p != nil {
+			e.Go(func() error {
+				return deliver(ctx, p)
+			})
+		}
+		if ns != nil {
+			e.Go(func() error {
+				return broadcast(ctx, ns, w)
+			})
+		}
+	} else {
+		e.Go(func() error {
+			return monitor(ctx, ann)
+		})
+	}
 
 	return e.Wait()
 }
@@ -136,11 +488,22 @@ func serve(ctx context.Context, h http.Handler, c *config.ServerConfig) error {
 		return nil
 	}
 
-	// Create HTTP server using the provided handler.
+	// Accept HTTP/2 requests without TLS if enabled, which are otherwise
+	// served over HTTP/1.1 by the standard library.
+	if c.H2C {
+		h = h2c.NewHandler(h, &http2.Server{IdleTimeout: c.IdleTimeout})
+	}
+
+	// Create HTTP server using the provided handler. Timeouts protect the
+	// server from clients that hold connections open without making progress.
 	a := fmt.Sprintf("%s:%d", c.Bind, c.Port)
 	s := &http.Server{
-		Addr:    a,
-		Handler: h,
+		Addr:              a,
+		Handler:           h,
+		ReadHeaderTimeout: c.ReadHeaderTimeout,
+		ReadTimeout:       c.ReadTimeout,
+		WriteTimeout:      c.WriteTimeout,
+		IdleTimeout:       c.IdleTimeout,
 	}
 
 	// Listen for termination signals.
@@ -169,7 +532,7 @@ func serve(ctx context.Context, h http.Handler, c *config.ServerConfig) error {
 	return nil
 }
 
-func chore(ctx context.Context, g engine.Engine, c *config.ChoreConfig) error {
+func chore(ctx context.Context, g engine.Engine, ann engine.Announcer, c *config.ChoreConfig) error {
 
 	// An interval of zero will not start the background jobs.
 	// This allows the instance to be responsible for handling requests only.
@@ -177,6 +540,45 @@ func chore(ctx context.Context, g engine.Engine, c *config.ChoreConfig) error {
 		return nil
 	}
 
+	// The interval adapts to the workload within the bounds, which default to
+	// the normal interval so that the interval is fixed unless configured.
+	lo, hi := cmp.Or(c.MinInterval, c.Interval), cmp.Or(c.MaxInterval, c.Interval)
+	if lo > c.Interval || hi < c.Interval {
+		return fmt.Errorf("chore interval %s must be between the minimum %s and the maximum %s", c.Interval, lo, hi)
+	}
+	if c.Webhook != "" {
+		if _, err := url.ParseRequestURI(c.Webhook); err != nil {
+			return fmt.Errorf("invalid chore webhook: %w", err)
+		}
+	}
+
+	// Identify the instance by its host name and a random suffix if it has to
+	// coordinate with other instances through the storage engine.
+	var h string
+	if c.LeaderElection || ann != nil {
+		n, err := os.Hostname()
+		if err != nil {
+			return err
+		}
+		h = n + "-" + nonce.Generate(8)
+	}
+
+	// Elect a leader through the storage engine if required, so that only the
+	// instance holding the lease runs background jobs. The lease is renewed on
+	// every tick, and is taken over by another instance once it expires.
+	var l engine.Leaser
+	if c.LeaderElection {
+		v, ok := g.(engine.Leaser)
+		if !ok {
+			return errors.New("storage engine does not support leader election")
+		}
+		if c.LeaseDuration <= hi {
+			return fmt.Errorf("lease duration %s must be longer than the chore interval %s", c.LeaseDuration, hi)
+		}
+		l = v
+		defer l.Release(context.Background(), choreLease, h)
+	}
+
 	// Calculate initial delay for the ticker.
 	m := 1.0
 	if c.InitialRandom {
@@ -185,13 +587,27 @@ func chore(ctx context.Context, g engine.Engine, c *config.ChoreConfig) error {
 	}
 	d := time.Duration(c.InitialDelay.Seconds()*m*float64(time.Second) + 1)
 
+	// Announce that the instance is running background jobs regardless of
+	// whether it is the leader, starting before the initial delay. Each
+	// announcement lasts for several intervals to tolerate slow executions.
+	announce := func(d time.Duration) {
+		if ann == nil {
+			return
+		}
+		if err := ann.Announce(ctx, roleWorker, h, d+3*hi); err != nil {
+			log.Println(err)
+		}
+	}
+	announce(d)
+
 	// Listen for termination signals.
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
 
 	// Start ticker for background jobs. The ticker will adjust the time
 	// interval or drop ticks to make up for slow receivers.
-	var n bool
+	var n, p bool
+	i := c.Interval
 	r := time.NewTicker(d)
 	for {
 		select {
@@ -208,15 +624,192 @@ func chore(ctx context.Context, g engine.Engine, c *config.ChoreConfig) error {
 			if !n {
 				log.Println("start running background jobs")
 				n = true
-				r.Reset(c.Interval)
+				r.Reset(i)
+			}
+			announce(0)
+
+			// Skip the execution if another instance is the leader.
+			if l != nil {
+				ok, err := l.Acquire(ctx, choreLease, h, c.LeaseDuration)
+				if err != nil {
+					log.Println(err)
+					continue
+				}
+				if ok != p {
+					p = ok
+					if ok {
+						log.Printf("elected as the leader for background jobs as %s\n", h)
+					} else {
+						log.Println("lost the leadership for background jobs")
+					}
+				}
+				if !ok {
+					continue
+				}
 			}
 
 			// Run background jobs and collect the elapsed time.
 			t := time.Now()
-			if err := g.Chore(ctx); err != nil {
+			v, err := g.Chore(ctx)
+			if err != nil {
 				log.Println(err)
 			}
 			metrics.ChoreHistogram.Observe(time.Since(t).Seconds())
+
+			// Report recovered tasks, which are otherwise silently retried.
+			if v != nil {
+				metrics.ObserveChore(v)
+				if err := report(ctx, v, c.Webhook); err != nil {
+					log.Println(err)
+				}
+			}
+
+			// Adjust the interval based on the results.
+			if x := adapt(i, v, c, lo, hi); x != i {
+				i = x
+				r.Reset(i)
+			}
+		}
+	}
+}
+
+// monitor periodically checks whether any instance is running background jobs,
+// and warns when there is none, in which case timed out tasks are never
+// recovered and expired tasks are never deleted. It runs on instances that
+// only serve API requests.
+func monitor(ctx context.Context, ann engine.Announcer) error {
+
+	// Listen for termination signals.
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+
+	// Check immediately and then at the interval, logging only the changes
+	// between having and not having instances running background jobs.
+	k := -1
+	r := time.NewTicker(monitorInterval)
+	defer r.Stop()
+	for {
+		v, err := ann.Announced(ctx, roleWorker)
+		if err != nil {
+			log.Println(err)
+		} else {
+			metrics.WorkersGauge.Set(float64(len(v)))
+			if len(v) == 0 && k != 0 {
+				log.Println("no instance is running background jobs, timed out tasks will not be recovered")
+			} else if len(v) > 0 && k <= 0 {
+				log.Printf("found %d instances running background jobs\n", len(v))
+			}
+			k = len(v)
 		}
+		select {
+		case <-ch:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-r.C:
+		}
+	}
+}
+
+// relay runs the AMQP bridge until a termination signal is received. Tasks
+// still buffered at that time are not republished.
+func relay(ctx context.Context, b *bridge.AMQP) error {
+	return interruptible(ctx, b.Run, func() {
+		if n := b.Len(); n > 0 {
+			log.Printf("stop AMQP bridge with %d tasks not republished\n", n)
+		}
+	})
+}
+
+// deliver runs the pusher until a termination signal is received, after which
+// the tasks being posted are committed before returning.
+func deliver(ctx context.Context, p *push.Pusher) error {
+	return interruptible(ctx, p.Run, func() {
+		log.Println("stop pushing tasks")
+	})
+}
+
+// broadcast publishes notifications of available tasks until a termination
+// signal is received.
+func broadcast(ctx context.Context, n *notify.NATS, w engine.Watcher) error {
+	return interruptible(ctx, func(ctx context.Context) error {
+		return n.Run(ctx, w)
+	}, func() {
+		log.Println("stop publishing notifications")
+	})
+}
+
+// interruptible runs the function with a context that is canceled when a
+// termination signal is received, calling stop before canceling it, or when
+// the context has been canceled by another goroutine in the error group.
+func interruptible(ctx context.Context, f func(context.Context) error, stop func()) error {
+
+	// Listen for termination signals.
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-ch:
+			stop()
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return f(ctx)
+}
+
+// report logs the number of timed out tasks recovered by background jobs, and
+// posts the results to the webhook if configured, so that operators can be
+// alerted when consumers repeatedly fail to commit tasks before the deadlines.
+func report(ctx context.Context, v *ratus.Chore, webhook string) error {
+	if v.Recovered <= 0 {
+		return nil
+	}
+	log.Printf("recovered %d timed out tasks\n", v.Recovered)
+	if webhook == "" {
+		return nil
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("chore webhook responded with status %s", res.Status)
+	}
+	return nil
+}
+
+// adapt returns the interval for the next execution of background jobs based
+// on the results of the previous one. The interval is halved after recovering
+// many tasks to catch up with failing consumers sooner, doubled while there is
+// nothing to do to reduce load, and reset to the normal interval otherwise,
+// without going beyond the bounds.
+func adapt(d time.Duration, v *ratus.Chore, c *config.ChoreConfig, lo, hi time.Duration) time.Duration {
+	switch {
+	case v == nil:
+		return d
+	case v.Recovered > 0 && v.Recovered >= c.Threshold:
+		return max(d/2, lo)
+	case v.Recovered == 0 && v.Expired == 0 && v.Archived == 0:
+		return min(d*2, hi)
+	default:
+		return c.Interval
 	}
 }
@@ -0,0 +1,55 @@
+package ratus
+
+import (
+	"io"
+
+	"github.com/hyperonym/ratus/internal/wire"
+)
+
+// Codec encodes and decodes request and response bodies on the client side,
+// so that faster implementations of the wire formats can be plugged in, e.g.
+// JSON libraries that generate code or use SIMD instructions. Since bodies
+// are also decoded by the server, the media type must be one of the wire
+// formats supported by the API.
+type Codec interface {
+
+	// ContentType returns the media type of the wire format, such as
+	// ContentTypeJSON or ContentTypeMsgPack.
+	ContentType() string
+
+	// Marshal returns the encoding of the value.
+	Marshal(v any) ([]byte, error)
+
+	// Unmarshal parses the encoded data and stores the result in the value
+	// pointed to by v.
+	Unmarshal(data []byte, v any) error
+}
+
+// encode writes the value to the writer with the codec, or with the built-in
+// implementation of the wire format if the codec is nil.
+func encode(c Codec, w io.Writer, format string, v any) error {
+	if c == nil {
+		return wire.Encode(w, format, v)
+	}
+	b, err := c.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// decode reads a value in the specified wire format from the reader with the
+// codec, falling back to the built-in implementation if the codec is nil or
+// does not support the format, e.g. for error responses that are always
+// encoded in JSON.
+func decode(c Codec, r io.Reader, format string, v any) error {
+	if c == nil || wire.Parse(c.ContentType()) != format {
+		return wire.Decode(r, format, v)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return c.Unmarshal(b, v)
+}
@@ -4,20 +4,59 @@ import (
 	"context"
 	"errors"
 	"time"
+
+	"github.com/hyperonym/ratus/clock"
+)
+
+// ErrPromiseExpired is reported by context.Cause for contexts of tasks whose
+// deadlines have passed, in which case the tasks may have been recovered and
+// claimed by other consumers.
+var ErrPromiseExpired = errors.New("promise expired")
+
+// ConflictResolution specifies how to proceed when a commit conflicts with
+// the current state of the task, e.g. because the task has timed out and been
+// claimed by another consumer, which changes its nonce.
+type ConflictResolution int
+
+// Resolutions of commit conflicts.
+const (
+	// ConflictAbandon gives up the commit and returns the conflict error.
+	ConflictAbandon ConflictResolution = iota
+	// ConflictRefetch retries the commit with the nonce of the current state
+	// of the task, which still fails if the task changes again. It gives up
+	// if the nonce is not returned by the server, e.g. because the server
+	// masks nonces on reads.
+	ConflictRefetch
+	// ConflictForce retries the commit without a nonce, which overwrites the
+	// task regardless of its current state.
+	ConflictForce
 )
 
+// ConflictHandler decides how to resolve a commit conflict based on the
+// current state of the task.
+type ConflictHandler func(ctx *Context, current *Task) ConflictResolution
+
+// maxConflictResolutions is the maximum number of times a conflict handler is
+// consulted for a single commit, which prevents tasks that keep changing from
+// retrying the commit forever.
+const maxConflictResolutions = 3
+
 // Context wraps around context.Context to carry scoped values throughout the
 // poll-execute-commit workflow. Its deadline will be automatically set based
-// on the execution deadline of the acquired task. It also provides chainable
+// on the execution deadline of the acquired task, and context.Cause reports
+// ErrPromiseExpired once the deadline has passed. It also provides chainable
 // methods for setting up commits. Since the custom context is only used in
 // parameters and return values, it is not considered anti-pattern.
 // Reference: https://github.com/golang/go/issues/22602
 type Context struct {
 	context.Context
+	parent    context.Context
 	cancel    context.CancelFunc
 	committed bool
 	commit    Commit
 	client    *Client
+	retry     []RequestOption
+	conflict  ConflictHandler
 
 	// Task acquired by the polling operation.
 	Task *Task
@@ -38,8 +77,42 @@ func (ctx *Context) Commit() error {
 	if ctx.client == nil {
 		return errors.New("cannot commit without an associated client")
 	}
-	if _, err := ctx.client.PatchTask(ctx.Context, ctx.Task.ID, &ctx.commit); err != nil {
-		return err
+	for i := 0; ; i++ {
+		_, err := ctx.client.PatchTask(ctx.Context, ctx.Task.ID, &ctx.commit, append(ctx.retry[:len(ctx.retry):len(ctx.retry)], withTask(ctx.Task.ID, ctx.Task.Topic))...)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, ErrConflict) || ctx.conflict == nil || i >= maxConflictResolutions {
+			return err
+		}
+
+		// Let the handler decide how to resolve the conflict based on the
+		// current state of the task.
+		t, gerr := ctx.client.GetTask(ctx.Context, ctx.Task.ID, ctx.retry...)
+		if gerr != nil {
+			return err
+		}
+		// Give up if the resolution would retry the same commit, since the
+		// conflict is not caused by a change of the task in that case.
+		var nonce, consumer string
+		switch ctx.conflict(ctx, t) {
+		case ConflictRefetch:
+			// Nonces are masked on reads when the server binds them to
+			// consumers, in which case committing without one would
+			// overwrite the claim of the other consumer.
+			if t.Nonce == "" {
+				return err
+			}
+			nonce, consumer = t.Nonce, t.Consumer
+		case ConflictForce:
+		default:
+			return err
+		}
+		if nonce == ctx.commit.Nonce && consumer == ctx.commit.Consumer {
+			return err
+		}
+		ctx.commit.Nonce = nonce
+		ctx.commit.Consumer = consumer
 	}
 
 	// Update committed flag and cancel timeout on success.
@@ -51,12 +124,85 @@ func (ctx *Context) Commit() error {
 	return nil
 }
 
+// CommitNext applies updates to the acquired task and claims the next
+// available task in its topic in the same request, which saves a round trip in
+// tight worker loops. The context of the next task is derived from the one the
+// acquired task was polled with, and inherits its retry options and conflict
+// handler. If the commit conflicts and a conflict handler is set, or if no
+// task is claimed along with the commit, it falls back to Commit and Poll, so
+// errors are returned in the same way as Poll when the topic is empty.
+func (ctx *Context) CommitNext(p *Promise) (*Context, error) {
+	if ctx.client == nil {
+		return nil, errors.New("cannot commit without an associated client")
+	}
+	var t *Task
+	if !ctx.committed {
+		h, err := ctx.client.CommitNext(ctx.Context, ctx.Task.Topic, ctx.Task.ID, &ctx.commit, p, ctx.retry...)
+		if errors.Is(err, ErrConflict) && ctx.conflict != nil {
+			err = ctx.Commit()
+		} else if err == nil {
+			t = h.Next
+			ctx.committed = true
+			if ctx.cancel != nil {
+				ctx.cancel()
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var x *Context
+	if t != nil {
+		x = ctx.client.context(ctx.parent, t)
+	} else {
+		var err error
+		if x, err = ctx.client.Poll(ctx.parent, ctx.Task.Topic, p, ctx.retry...); err != nil {
+			return nil, err
+		}
+	}
+	x.retry = ctx.retry
+	x.conflict = ctx.conflict
+	return x, nil
+}
+
+// Report reports the progress of the acquired task immediately, so that it can
+// be shown while the task is still being executed. Unlike the other methods,
+// it does not affect the commit.
+func (ctx *Context) Report(percent int, message string) error {
+	if ctx.client == nil {
+		return errors.New("cannot report progress without an associated client")
+	}
+	_, err := ctx.client.UpdateProgress(ctx.Context, ctx.Task.ID, &Progress{
+		Nonce:   ctx.Task.Nonce,
+		Percent: percent,
+		Message: message,
+	}, ctx.retry...)
+	return err
+}
+
+// Remaining returns the execution budget left before the deadline of the task,
+// which is zero once the deadline has passed. The boolean is false if the
+// context has no deadline, in the same way as Deadline.
+func (ctx *Context) Remaining() (time.Duration, bool) {
+	d, ok := ctx.Deadline()
+	if !ok {
+		return 0, false
+	}
+	k := clock.System
+	if ctx.client != nil {
+		k = ctx.client.clock
+	}
+	return max(d.Sub(k.Now()), 0), true
+}
+
 // Reset discards all uncommitted updates.
 func (ctx *Context) Reset() *Context {
 	s := TaskStateCompleted
 	ctx.commit = Commit{State: &s}
 	if ctx.Task != nil {
 		ctx.commit.Nonce = ctx.Task.Nonce
+		ctx.commit.Consumer = ctx.Task.Consumer
 	}
 	return ctx
 }
@@ -91,15 +237,49 @@ func (ctx *Context) SetPayload(v any) *Context {
 	return ctx
 }
 
+// SetResult sets the value for the Result field of the commit.
+func (ctx *Context) SetResult(v any) *Context {
+	ctx.commit.Result = v
+	return ctx
+}
+
 // SetDefer sets the value for the Defer field of the commit.
 func (ctx *Context) SetDefer(duration string) *Context {
 	ctx.commit.Defer = duration
 	return ctx
 }
 
-// Force sets the Nonce field of the commit to empty to allow force commits.
+// SetError records the error message as the last error of the task. Errors
+// set along with the "pending" state are counted by subscriptions with
+// MaxHandlerRetries as failures of the handler.
+func (ctx *Context) SetError(err error) *Context {
+	if err != nil {
+		ctx.commit.Error = err.Error()
+	}
+	return ctx
+}
+
+// SetRetry retries the commit up to n times if it fails due to network errors
+// or temporary conditions, with the same backoff as WithRetry.
+func (ctx *Context) SetRetry(n int, backoff time.Duration) *Context {
+	ctx.retry = []RequestOption{WithRetry(n, backoff)}
+	return ctx
+}
+
+// OnConflict sets the handler for resolving conflicts of the commit. Without
+// a handler, commits that conflict with the current state of the task are
+// abandoned. The handler is consulted at most three times per commit, and the
+// conflict is returned early if a resolution would not change the commit.
+func (ctx *Context) OnConflict(f ConflictHandler) *Context {
+	ctx.conflict = f
+	return ctx
+}
+
+// Force sets the Nonce and Consumer fields of the commit to empty to allow
+// force commits.
 func (ctx *Context) Force() *Context {
 	ctx.commit.Nonce = ""
+	ctx.commit.Consumer = ""
 	return ctx
 }
 
@@ -113,6 +293,15 @@ func (ctx *Context) Archive() *Context {
 	return ctx.SetState(TaskStateArchived)
 }
 
+// Fail is equivalent to calling SetState(TaskStateFailed) and recording the
+// error message as the last error of the task.
+func (ctx *Context) Fail(err error) *Context {
+	if err != nil {
+		ctx.commit.Error = err.Error()
+	}
+	return ctx.SetState(TaskStateFailed)
+}
+
 // Reschedule is equivalent to calling Abstain followed by SetScheduled(t).
 func (ctx *Context) Reschedule(t time.Time) *Context {
 	return ctx.Abstain().SetScheduled(t)
@@ -1,6 +1,8 @@
 // Package docs embeds documentation files.
 package docs
 
+//go:generate go run generate.go
+
 import (
 	"embed"
 	"net/http"
@@ -15,6 +17,7 @@ var index []byte
 //go:embed swagger-ui
 //go:embed swagger.json swagger.yaml
 //go:embed openapi.json openapi.yaml
+//go:embed openapi-3.1.json openapi-3.1.yaml
 var swagger embed.FS
 
 // Swagger implements endpoint mounting for API specifications.
@@ -50,4 +53,10 @@ func (s *Swagger) Mount(r *gin.RouterGroup) {
 	r.GET("/openapi.yaml", func(c *gin.Context) {
 		c.FileFromFS("/openapi.yaml", fs)
 	})
+	r.GET("/openapi-3.1.json", func(c *gin.Context) {
+		c.FileFromFS("/openapi-3.1.json", fs)
+	})
+	r.GET("/openapi-3.1.yaml", func(c *gin.Context) {
+		c.FileFromFS("/openapi-3.1.yaml", fs)
+	})
 }
@@ -1,8 +1,10 @@
 package docs_test
 
 import (
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"testing"
 
 	"github.com/gin-gonic/gin"
@@ -57,6 +59,23 @@ func TestSwagger(t *testing.T) {
 		r.AssertBodyContains("openapi: ")
 	})
 
+	t.Run("openapi-3.1.json", func(t *testing.T) {
+		t.Parallel()
+		req := httptest.NewRequest(http.MethodGet, "/openapi-3.1.json", nil)
+		r := reqtest.Record(t, h, req)
+		r.AssertStatusCode(http.StatusOK)
+		r.AssertHeaderContains("Content-Type", "application/json")
+		r.AssertBodyContains(`"openapi": "3.1.0"`)
+	})
+
+	t.Run("openapi-3.1.yaml", func(t *testing.T) {
+		t.Parallel()
+		req := httptest.NewRequest(http.MethodGet, "/openapi-3.1.yaml", nil)
+		r := reqtest.Record(t, h, req)
+		r.AssertStatusCode(http.StatusOK)
+		r.AssertBodyContains("openapi: 3.1.0")
+	})
+
 	t.Run("swagger-ui.min.css", func(t *testing.T) {
 		t.Parallel()
 		req := httptest.NewRequest(http.MethodGet, "/swagger-ui/swagger-ui.min.css", nil)
@@ -66,3 +85,59 @@ func TestSwagger(t *testing.T) {
 		r.AssertBodyContains(".swagger-ui")
 	})
 }
+
+func TestOpenAPI31(t *testing.T) {
+	type spec struct {
+		Paths      map[string]map[string]any `json:"paths"`
+		Components struct {
+			Schemas map[string]any `json:"schemas"`
+		} `json:"components"`
+	}
+	read := func(name string) *spec {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var s spec
+		if err := json.Unmarshal(b, &s); err != nil {
+			t.Fatal(err)
+		}
+		return &s
+	}
+
+	// The generated specification must cover the same operations and schemas
+	// as its source, otherwise "go generate" has not been run after updating
+	// the specifications.
+	a, b := read("openapi.json"), read("openapi-3.1.json")
+	for p, ops := range a.Paths {
+		for m := range ops {
+			if _, ok := b.Paths[p][m]; !ok {
+				t.Errorf("missing operation %s %s in OpenAPI 3.1 specification", m, p)
+			}
+		}
+	}
+	if len(a.Paths) != len(b.Paths) {
+		t.Errorf("expected %d paths, got %d", len(a.Paths), len(b.Paths))
+	}
+	for n := range a.Components.Schemas {
+		if _, ok := b.Components.Schemas[n]; !ok {
+			t.Errorf("missing schema %s in OpenAPI 3.1 specification", n)
+		}
+	}
+
+	// Operations added after the initial release must be documented as well.
+	for _, x := range []struct{ method, path string }{
+		{"get", "/stats"},
+		{"get", "/consumers"},
+		{"post", "/consumers/{consumer}"},
+	} {
+		if _, ok := b.Paths[x.path][x.method]; !ok {
+			t.Errorf("missing operation %s %s in OpenAPI 3.1 specification", x.method, x.path)
+		}
+	}
+	for _, n := range []string{"ratus.Stats", "ratus.Consumers"} {
+		if _, ok := b.Components.Schemas[n]; !ok {
+			t.Errorf("missing schema %s in OpenAPI 3.1 specification", n)
+		}
+	}
+}
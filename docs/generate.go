@@ -0,0 +1,173 @@
+//go:build ignore
+
+// This program generates the OpenAPI 3.1 specification from the OpenAPI 3.0
+// specification converted from the Swagger 2.0 specification, since neither
+// swag nor the converter supports OpenAPI 3.1 yet. The order of fields is
+// preserved so that the generated files are comparable with their sources.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+func main() {
+	b, err := os.ReadFile("openapi.json")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// JSON is a subset of YAML, so decoding into a YAML node retains the
+	// order of fields.
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		log.Fatal(err)
+	}
+	root := doc.Content[0]
+	set(root, "openapi", &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "3.1.0"})
+	upgrade(root)
+
+	// Write the specification in both JSON and YAML.
+	var j bytes.Buffer
+	writeJSON(&j, root, 0)
+	j.WriteByte('\n')
+	if err := os.WriteFile("openapi-3.1.json", j.Bytes(), 0644); err != nil {
+		log.Fatal(err)
+	}
+	block(root)
+	var y bytes.Buffer
+	e := yaml.NewEncoder(&y)
+	e.SetIndent(2)
+	if err := e.Encode(root); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile("openapi-3.1.yaml", y.Bytes(), 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// upgrade recursively rewrites the constructs that have changed in OpenAPI
+// 3.1, which aligns schemas with JSON Schema 2020-12:
+//   - "nullable" is replaced by adding "null" to the types.
+//   - "allOf" with a single reference, which is used to attach descriptions
+//     to references, is replaced by the reference itself, since sibling
+//     keywords of "$ref" are no longer ignored.
+func upgrade(n *yaml.Node) {
+	for _, c := range n.Content {
+		upgrade(c)
+	}
+	if n.Kind != yaml.MappingNode {
+		return
+	}
+	if v := get(n, "nullable"); v != nil {
+		del(n, "nullable")
+		if t := get(n, "type"); t != nil && v.Value == "true" {
+			set(n, "type", &yaml.Node{Kind: yaml.SequenceNode, Content: []*yaml.Node{
+				t,
+				{Kind: yaml.ScalarNode, Tag: "!!str", Value: "null"},
+			}})
+		}
+	}
+	if a := get(n, "allOf"); a != nil && len(a.Content) == 1 && get(a.Content[0], "$ref") != nil {
+		del(n, "type")
+		for i := 0; i < len(n.Content); i += 2 {
+			if n.Content[i].Value == "allOf" {
+				n.Content[i].Value = "$ref"
+				n.Content[i+1] = get(a.Content[0], "$ref")
+			}
+		}
+	}
+}
+
+// get returns the value of the key in the mapping node, or nil if not found.
+func get(n *yaml.Node, key string) *yaml.Node {
+	if n.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// set replaces the value of the key in the mapping node, or appends the key
+// if not found.
+func set(n *yaml.Node, key string, v *yaml.Node) {
+	for i := 0; i < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			n.Content[i+1] = v
+			return
+		}
+	}
+	n.Content = append(n.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, v)
+}
+
+// del removes the key from the mapping node.
+func del(n *yaml.Node, key string) {
+	for i := 0; i < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			n.Content = append(n.Content[:i], n.Content[i+2:]...)
+			return
+		}
+	}
+}
+
+// block resets the styles of nodes decoded from JSON, so that the YAML output
+// is written in block style with quotes only where necessary.
+func block(n *yaml.Node) {
+	n.Style = 0
+	for _, c := range n.Content {
+		block(c)
+	}
+}
+
+// writeJSON writes the node as JSON indented with four spaces, which is the
+// format of the existing JSON specifications.
+func writeJSON(b *bytes.Buffer, n *yaml.Node, depth int) {
+	indent := strings.Repeat("    ", depth+1)
+	switch n.Kind {
+	case yaml.MappingNode, yaml.SequenceNode:
+		open, close, step := "{", "}", 2
+		if n.Kind == yaml.SequenceNode {
+			open, close, step = "[", "]", 1
+		}
+		if len(n.Content) == 0 {
+			b.WriteString(open + close)
+			return
+		}
+		b.WriteString(open + "\n")
+		for i := 0; i < len(n.Content); i += step {
+			if i > 0 {
+				b.WriteString(",\n")
+			}
+			b.WriteString(indent)
+			if step == 2 {
+				quote(b, n.Content[i].Value)
+				b.WriteString(": ")
+			}
+			writeJSON(b, n.Content[i+step-1], depth+1)
+		}
+		b.WriteString("\n" + indent[4:] + close)
+	default:
+		if n.Tag == "!!str" {
+			quote(b, n.Value)
+		} else {
+			b.WriteString(n.Value)
+		}
+	}
+}
+
+// quote writes the string as JSON without escaping HTML characters.
+func quote(b *bytes.Buffer, s string) {
+	e := json.NewEncoder(b)
+	e.SetEscapeHTML(false)
+	e.Encode(s)
+	b.Truncate(b.Len() - 1)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/hyperonym/ratus"
+	"github.com/hyperonym/ratus/worker"
+)
+
+func main() {
+
+	// Parse command-line flags to get the origin and create a client instance.
+	origin := flag.String("origin", "http://127.0.0.1:80", "origin of the Ratus instance")
+	flag.Parse()
+	client, err := ratus.NewClient(&ratus.ClientOptions{Origin: *origin})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Describe two workers: "resize" crashes on malformed payloads and is
+	// restarted by the supervisor, while "notify" is temporary and is left
+	// stopped if it crashes.
+	resize := worker.Spec{
+		Name:    "resize",
+		Options: &ratus.SubscribeOptions{Promise: &ratus.Promise{Consumer: "resizer", Timeout: "30s"}, Topic: "images", Concurrency: 4},
+		Handler: func(ctx *ratus.Context, err error) {
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			var url string
+			if err := ctx.Task.Decode(&url); err != nil {
+				panic(err)
+			}
+			fmt.Println("resizing", url)
+		},
+		Restart: worker.Permanent,
+	}
+	notify := worker.Spec{
+		Name:    "notify",
+		Options: &ratus.SubscribeOptions{Promise: &ratus.Promise{Consumer: "notifier", Timeout: "10s"}, Topic: "emails"},
+		Handler: func(ctx *ratus.Context, err error) {
+			if err == nil {
+				fmt.Println("sending", ctx.Task.Payload)
+			}
+		},
+		Restart: worker.Temporary,
+	}
+
+	// Give up if workers are restarted more than 5 times within a minute, and
+	// keep idle workers listed as consumers by sending heartbeats.
+	s, err := worker.New(client, &worker.Options{
+		MaxRestarts:       5,
+		Period:            time.Minute,
+		HeartbeatInterval: 30 * time.Second,
+	}, resize, notify)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Report the liveness of the workers periodically.
+	go func() {
+		for range time.Tick(10 * time.Second) {
+			for _, v := range s.Status() {
+				log.Printf("%s: running=%t restarts=%d last_seen=%s last_error=%v\n", v.Name, v.Running, v.Restarts, v.LastSeen.Format(time.RFC3339), v.LastError)
+			}
+		}
+	}()
+
+	// Run the workers until interrupted, which lets them finish the tasks
+	// being executed before returning.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if err := s.Run(ctx); errors.Is(err, worker.ErrTooManyRestarts) {
+		log.Fatal(err)
+	} else if err != nil {
+		log.Println(err)
+	}
+}
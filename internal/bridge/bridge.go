@@ -0,0 +1,175 @@
+// Package bridge republishes committed tasks to external message brokers, so
+// that downstream consumers of existing brokers keep receiving the results of
+// tasks while producers are being migrated to Ratus.
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"github.com/hyperonym/ratus"
+	"github.com/hyperonym/ratus/internal/config"
+	"github.com/hyperonym/ratus/internal/metrics"
+)
+
+// retryInterval is the duration to wait before reconnecting to the broker
+// after the connection is lost or can not be established.
+const retryInterval = 5 * time.Second
+
+// states contains the names of the states in which tasks can be republished,
+// which are used as the last segments of routing keys.
+var states = map[string]ratus.TaskState{
+	"completed": ratus.TaskStateCompleted,
+	"failed":    ratus.TaskStateFailed,
+}
+
+// AMQP republishes committed tasks to an AMQP exchange as JSON messages, with
+// routing keys in the form of "<topic>.<state>". Tasks are buffered in memory
+// and published by a background loop with publisher confirms, so that the
+// availability of the broker never affects committing tasks. Publishing is
+// best-effort: buffered tasks are lost when the instance stops, and tasks are
+// dropped when the buffer is full.
+type AMQP struct {
+	url      string
+	exchange string
+	states   map[ratus.TaskState]string
+	queue    chan *ratus.Task
+
+	// Task whose publishing was interrupted, which is retried first after
+	// reconnecting.
+	pending *ratus.Task
+}
+
+// NewAMQP creates an AMQP bridge with the configuration. A nil bridge is
+// returned if no broker is configured.
+func NewAMQP(bc *config.BridgeConfig) (*AMQP, error) {
+	if bc.URL == "" {
+		return nil, nil
+	}
+	if _, err := amqp.ParseURI(bc.URL); err != nil {
+		return nil, fmt.Errorf("invalid AMQP URL: %w", err)
+	}
+	if bc.Buffer <= 0 {
+		return nil, fmt.Errorf("invalid AMQP buffer size %d", bc.Buffer)
+	}
+	b := AMQP{
+		url:      bc.URL,
+		exchange: bc.Exchange,
+		states:   make(map[ratus.TaskState]string),
+		queue:    make(chan *ratus.Task, bc.Buffer),
+	}
+	for _, s := range strings.Split(bc.States, ",") {
+		s = strings.ToLower(strings.TrimSpace(s))
+		v, ok := states[s]
+		if !ok {
+			return nil, fmt.Errorf("unsupported AMQP bridge state %q", s)
+		}
+		b.states[v] = s
+	}
+	return &b, nil
+}
+
+// Publish enqueues the task for publishing if it is in one of the configured
+// states. It never blocks, tasks are dropped if the buffer is full.
+func (b *AMQP) Publish(t *ratus.Task) {
+	if _, ok := b.states[t.State]; !ok {
+		return
+	}
+	select {
+	case b.queue <- t:
+	default:
+		metrics.DroppedCounter.WithLabelValues(t.Topic).Add(1)
+	}
+}
+
+// Len returns the number of tasks waiting to be published.
+func (b *AMQP) Len() int {
+	return len(b.queue)
+}
+
+// Run connects to the broker and publishes buffered tasks until the context
+// is canceled, reconnecting after the connection is lost.
+func (b *AMQP) Run(ctx context.Context) error {
+	for {
+		err := b.run(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		log.Printf("AMQP bridge: %v, reconnecting in %v\n", err, retryInterval)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+// run publishes buffered tasks over a single connection until it fails.
+func (b *AMQP) run(ctx context.Context) error {
+	conn, err := amqp.Dial(b.url)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	if err := ch.Confirm(false); err != nil {
+		return err
+	}
+	closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+
+	for {
+		if b.pending == nil {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case err := <-closed:
+				return fmt.Errorf("connection closed: %v", err)
+			case b.pending = <-b.queue:
+			}
+		}
+		if err := b.publish(ctx, ch, b.pending); err != nil {
+			return err
+		}
+		b.pending = nil
+	}
+}
+
+// publish publishes the task and waits for the broker to confirm it. Tasks
+// that can not be encoded are dropped instead of being retried.
+func (b *AMQP) publish(ctx context.Context, ch *amqp.Channel, t *ratus.Task) error {
+	body, err := json.Marshal(t)
+	if err != nil {
+		log.Printf("AMQP bridge: dropped task %q: %v\n", t.ID, err)
+		metrics.DroppedCounter.WithLabelValues(t.Topic).Add(1)
+		return nil
+	}
+	d, err := ch.PublishWithDeferredConfirmWithContext(ctx, b.exchange, t.Topic+"."+b.states[t.State], false, false, amqp.Publishing{
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		MessageId:    t.ID,
+		Timestamp:    time.Now(),
+		Body:         body,
+	})
+	if err != nil {
+		return err
+	}
+	ok, err := d.WaitContext(ctx)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("message is not acknowledged by the broker")
+	}
+	return nil
+}
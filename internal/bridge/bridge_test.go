@@ -0,0 +1,67 @@
+package bridge_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hyperonym/ratus"
+	"github.com/hyperonym/ratus/internal/bridge"
+	"github.com/hyperonym/ratus/internal/config"
+)
+
+func TestAMQP(t *testing.T) {
+	t.Run("disabled", func(t *testing.T) {
+		b, err := bridge.NewAMQP(&config.BridgeConfig{})
+		if err != nil {
+			t.Error(err)
+		}
+		if b != nil {
+			t.Error("expected nil bridge without URL")
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, c := range []config.BridgeConfig{
+			{URL: "http://localhost:5672/", States: "completed", Buffer: 1},
+			{URL: "amqp://localhost:5672/", States: "completed", Buffer: 0},
+			{URL: "amqp://localhost:5672/", States: "pending", Buffer: 1},
+		} {
+			if _, err := bridge.NewAMQP(&c); err == nil {
+				t.Errorf("expected error for configuration %+v", c)
+			}
+		}
+	})
+
+	t.Run("publish", func(t *testing.T) {
+		b, err := bridge.NewAMQP(&config.BridgeConfig{
+			URL:    "amqp://localhost:1/",
+			States: "completed, Failed",
+			Buffer: 2,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Only tasks in the configured states are buffered, and tasks beyond
+		// the size of the buffer are dropped.
+		b.Publish(&ratus.Task{ID: "1", Topic: "test", State: ratus.TaskStatePending})
+		b.Publish(&ratus.Task{ID: "2", Topic: "test", State: ratus.TaskStateCompleted})
+		b.Publish(&ratus.Task{ID: "3", Topic: "test", State: ratus.TaskStateFailed})
+		b.Publish(&ratus.Task{ID: "4", Topic: "test", State: ratus.TaskStateCompleted})
+		if n := b.Len(); n != 2 {
+			t.Errorf("incorrect number of buffered tasks, expected 2, got %d", n)
+		}
+
+		// Running against an unreachable broker keeps the tasks buffered
+		// until the context is canceled.
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		if err := b.Run(ctx); err != nil {
+			t.Error(err)
+		}
+		if n := b.Len(); n != 2 {
+			t.Errorf("incorrect number of buffered tasks, expected 2, got %d", n)
+		}
+	})
+}
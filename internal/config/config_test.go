@@ -23,27 +23,217 @@ func parse(t *testing.T, cmd string, v any) {
 
 func TestServerConfig(t *testing.T) {
 	var c config.ServerConfig
-	parse(t, "-p 8000 --bind=192.168.1.1", &c)
+	parse(t, "-p 8000 --bind=192.168.1.1 --h2c --read-header-timeout 5s --read-timeout 1m --write-timeout 2m --idle-timeout 3m", &c)
 	if c.Port != 8000 {
 		t.Fail()
 	}
 	if c.Bind != "192.168.1.1" {
 		t.Fail()
 	}
+	if !c.H2C {
+		t.Fail()
+	}
+	if c.ReadHeaderTimeout != 5*time.Second {
+		t.Fail()
+	}
+	if c.ReadTimeout != time.Minute {
+		t.Fail()
+	}
+	if c.WriteTimeout != 2*time.Minute {
+		t.Fail()
+	}
+	if c.IdleTimeout != 3*time.Minute {
+		t.Fail()
+	}
+}
+
+func TestTimeoutConfig(t *testing.T) {
+	var c config.TimeoutConfig
+	parse(t, "--request-read-timeout 5s --request-write-timeout 10s --request-admin-timeout 1h", &c)
+	if c.Read != 5*time.Second {
+		t.Fail()
+	}
+	if c.Write != 10*time.Second {
+		t.Fail()
+	}
+	if c.Admin != time.Hour {
+		t.Fail()
+	}
+}
+
+func TestCORSConfig(t *testing.T) {
+	var c config.CORSConfig
+	parse(t, "--cors-allow-origins https://example.com,https://*.example.org --cors-allow-methods GET --cors-allow-headers Content-Type --cors-allow-credentials --cors-max-age 1h", &c)
+	if c.AllowOrigins != "https://example.com,https://*.example.org" {
+		t.Fail()
+	}
+	if c.AllowMethods != "GET" {
+		t.Fail()
+	}
+	if c.AllowHeaders != "Content-Type" {
+		t.Fail()
+	}
+	if !c.AllowCredentials {
+		t.Fail()
+	}
+	if c.MaxAge != time.Hour {
+		t.Fail()
+	}
+}
+
+func TestCompressionConfig(t *testing.T) {
+	var c config.CompressionConfig
+	parse(t, "--compression zstd --compression-level 3 --compression-min-size 512", &c)
+	if c.Algorithm != "zstd" {
+		t.Fail()
+	}
+	if c.Level != 3 {
+		t.Fail()
+	}
+	if c.MinSize != 512 {
+		t.Fail()
+	}
+}
+
+func TestAdminConfig(t *testing.T) {
+	var c config.AdminConfig
+	parse(t, "--admin-token secret", &c)
+	if c.Token != "secret" {
+		t.Fail()
+	}
 }
 
 func TestChoreConfig(t *testing.T) {
 	var c config.ChoreConfig
-	parse(t, "--chore-interval 3m -chore-initial-delay 3500ms --chore-initial-random", &c)
+	parse(t, "--chore-interval 3m --chore-min-interval 1m --chore-max-interval 10m -chore-initial-delay 3500ms --chore-initial-random --chore-batch-size 500 --chore-leader-election --chore-webhook http://127.0.0.1/hook", &c)
 	if c.Interval != 3*time.Minute {
 		t.Fail()
 	}
+	if c.MinInterval != time.Minute || c.MaxInterval != 10*time.Minute {
+		t.Fail()
+	}
+	if c.Threshold != 100 {
+		t.Fail()
+	}
 	if c.InitialDelay != 3500*time.Millisecond {
 		t.Fail()
 	}
 	if !c.InitialRandom {
 		t.Fail()
 	}
+	if c.BatchSize != 500 {
+		t.Fail()
+	}
+	if c.TimeBudget != 5*time.Second {
+		t.Fail()
+	}
+	if !c.LeaderElection {
+		t.Fail()
+	}
+	if c.LeaseDuration != 30*time.Second {
+		t.Fail()
+	}
+	if c.Webhook != "http://127.0.0.1/hook" {
+		t.Fail()
+	}
+}
+
+func TestExpiryConfig(t *testing.T) {
+	var c config.ExpiryConfig
+	parse(t, "--expiry-export-path expired.ndjson --expiry-topic archive", &c)
+	if c.ExportPath != "expired.ndjson" {
+		t.Fail()
+	}
+	if c.Topic != "archive" {
+		t.Fail()
+	}
+}
+
+func TestBridgeConfig(t *testing.T) {
+	var c config.BridgeConfig
+	parse(t, "--bridge-amqp-url amqp://localhost:5672/ --bridge-amqp-states failed --bridge-amqp-buffer 10", &c)
+	if c.URL != "amqp://localhost:5672/" {
+		t.Fail()
+	}
+	if c.Exchange != "amq.topic" {
+		t.Fail()
+	}
+	if c.States != "failed" {
+		t.Fail()
+	}
+	if c.Buffer != 10 {
+		t.Fail()
+	}
+}
+
+func TestNotifyConfig(t *testing.T) {
+	var c config.NotifyConfig
+	parse(t, "--notify-nats-url nats://localhost:4222 --notify-nats-throttle 1s", &c)
+	if c.URL != "nats://localhost:4222" {
+		t.Fail()
+	}
+	if c.Subject != "ratus.available" {
+		t.Fail()
+	}
+	if c.Throttle != time.Second {
+		t.Fail()
+	}
+}
+
+func TestPushConfig(t *testing.T) {
+	var c config.PushConfig
+	parse(t, "--push-endpoints a=http://localhost/a,b=http://localhost/b --push-concurrency 2 --push-timeout 5s --push-retry-delay 1m", &c)
+	if c.Endpoints != "a=http://localhost/a,b=http://localhost/b" {
+		t.Fail()
+	}
+	if c.Concurrency != 2 {
+		t.Fail()
+	}
+	if c.Timeout != 5*time.Second {
+		t.Fail()
+	}
+	if c.RetryDelay != time.Minute {
+		t.Fail()
+	}
+	if c.PollInterval != time.Second {
+		t.Fail()
+	}
+}
+
+func TestPromiseConfig(t *testing.T) {
+	var c config.PromiseConfig
+	parse(t, "--promise-default-timeout=1m --promise-max-timeout=1h", &c)
+	if c.DefaultTimeout != time.Minute {
+		t.Fail()
+	}
+	if c.MaxTimeout != time.Hour {
+		t.Fail()
+	}
+}
+
+func TestSkewConfig(t *testing.T) {
+	var c config.SkewConfig
+	parse(t, "--skew-threshold=5s --skew-reject --absolute-times=reject", &c)
+	if c.Threshold != 5*time.Second {
+		t.Fail()
+	}
+	if !c.Reject {
+		t.Fail()
+	}
+	if c.Absolute != "reject" {
+		t.Fail()
+	}
+}
+
+func TestWatchConfig(t *testing.T) {
+	var c config.WatchConfig
+	parse(t, "--watch-timeout=10s --watch-interval=100ms", &c)
+	if c.Timeout != 10*time.Second {
+		t.Fail()
+	}
+	if c.CheckInterval != 100*time.Millisecond {
+		t.Fail()
+	}
 }
 
 func TestPaginationConfig(t *testing.T) {
@@ -56,3 +246,124 @@ func TestPaginationConfig(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestNameConfig(t *testing.T) {
+	var c config.NameConfig
+	parse(t, "--name-max-length 64 --name-charset A-Za-z0-9._:-", &c)
+	if c.MaxLength != 64 {
+		t.Fail()
+	}
+	if c.Charset != "A-Za-z0-9._:-" {
+		t.Fail()
+	}
+}
+
+func TestTransitionConfig(t *testing.T) {
+	var c config.TransitionConfig
+	parse(t, "--forbidden-transitions completed>pending,failed>*", &c)
+	if c.Forbidden != "completed>pending,failed>*" {
+		t.Fail()
+	}
+}
+
+func TestIdempotencyConfig(t *testing.T) {
+	var c config.IdempotencyConfig
+	parse(t, "--idempotency-window=1h", &c)
+	if c.Window != time.Hour {
+		t.Fail()
+	}
+	if c.Capacity != 10000 {
+		t.Fail()
+	}
+}
+
+func TestConsumerConfig(t *testing.T) {
+	var c config.ConsumerConfig
+	parse(t, "--consumer-window=1m", &c)
+	if c.Window != time.Minute {
+		t.Fail()
+	}
+}
+
+func TestQuotaConfig(t *testing.T) {
+	var c config.QuotaConfig
+	parse(t, "--quota-rate=60 --quota-pending=1000", &c)
+	if c.Rate != 60 {
+		t.Fail()
+	}
+	if c.Pending != 1000 {
+		t.Fail()
+	}
+}
+
+func TestBackpressureConfig(t *testing.T) {
+	var c config.BackpressureConfig
+	parse(t, "--backpressure-threshold 1000 --backpressure-warning 500", &c)
+	if c.Threshold != 1000 {
+		t.Fail()
+	}
+	if c.Warning != 500 {
+		t.Fail()
+	}
+	if c.RetryAfter != 10*time.Second {
+		t.Fail()
+	}
+	if c.CacheTTL != time.Second {
+		t.Fail()
+	}
+}
+
+func TestCapacityConfig(t *testing.T) {
+	var c config.CapacityConfig
+	parse(t, "--capacity-pending 1000000 --capacity-topic-pending 10000 --capacity-cache-ttl 0s", &c)
+	if c.Pending != 1000000 {
+		t.Fail()
+	}
+	if c.TopicPending != 10000 {
+		t.Fail()
+	}
+	if c.CacheTTL != 0 {
+		t.Fail()
+	}
+}
+
+func TestDeleteConfig(t *testing.T) {
+	var c config.DeleteConfig
+	parse(t, "--delete-unconfirmed", &c)
+	if !c.Unconfirmed {
+		t.Fail()
+	}
+}
+
+func TestTokenConfig(t *testing.T) {
+	var c config.TokenConfig
+	parse(t, "--token-key secret --nonce-key other --strict-consumer", &c)
+	if c.Key != "secret" {
+		t.Fail()
+	}
+	if c.NonceKey != "other" {
+		t.Fail()
+	}
+	if !c.StrictConsumer {
+		t.Fail()
+	}
+}
+
+func TestUIConfig(t *testing.T) {
+	var c config.UIConfig
+	parse(t, "--ui", &c)
+	if !c.Enabled {
+		t.Fail()
+	}
+}
+
+func TestRecordConfig(t *testing.T) {
+	var c config.RecordConfig
+	parse(t, "--record-path traffic.ndjson --record-salt secret", &c)
+	if c.Path != "traffic.ndjson" {
+		t.Fail()
+	}
+	if c.Salt != "secret" {
+		t.Fail()
+	}
+}
@@ -0,0 +1,56 @@
+package controller
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"github.com/hyperonym/ratus"
+	"github.com/hyperonym/ratus/internal/engine"
+	"github.com/hyperonym/ratus/internal/metrics"
+	"github.com/hyperonym/ratus/internal/middleware"
+)
+
+// AdminController implements handlers for administrative endpoints.
+type AdminController struct {
+	Engine engine.Engine
+}
+
+// NewAdminController creates a new AdminController.
+func NewAdminController(g engine.Engine) *AdminController {
+	return &AdminController{g}
+}
+
+// PostChore runs background jobs immediately.
+// @summary   Run background jobs immediately
+// @router    /admin/chore [post]
+// @tags      admin
+// @security  BearerAuth
+// @produce   application/json
+// @success   200 {object} ratus.Chore
+// @failure   401 {object} ratus.Error
+// @failure   500 {object} ratus.Error
+func (r *AdminController) PostChore(c *gin.Context) {
+	v, err := r.Engine.Chore(c.Request.Context())
+	if err == nil {
+		metrics.ObserveChore(v)
+	}
+	send(c, v, err)
+}
+
+// PostMove moves tasks in a topic that match the filters to another topic.
+// @summary   Move tasks in a topic that match the filters to another topic
+// @router    /topics/{topic}/tasks:move [post]
+// @tags      admin
+// @security  BearerAuth
+// @param     topic path string true "Name of the topic"
+// @param     move body ratus.Move true "Destination topic and filters of the tasks to be moved"
+// @accept    application/json
+// @produce   application/json
+// @success   200 {object} ratus.Updated
+// @failure   400 {object} ratus.Error
+// @failure   401 {object} ratus.Error
+// @failure   500 {object} ratus.Error
+func (r *AdminController) PostMove(c *gin.Context) {
+	m := c.MustGet(middleware.ParamMove).(*ratus.Move)
+	v, err := r.Engine.MoveTasks(c.Request.Context(), c.Param(middleware.ParamTopic), m)
+	send(c, v, err)
+}
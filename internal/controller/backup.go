@@ -0,0 +1,209 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/hyperonym/ratus"
+	"github.com/hyperonym/ratus/internal/engine"
+)
+
+// Constants for backups and restores.
+const (
+
+	// snapshotVersion is the version of the snapshot format written by
+	// backups. Restores reject snapshots of other versions.
+	snapshotVersion = 1
+
+	// snapshotBatchSize is the number of resources read from or written to
+	// the storage engine at a time.
+	snapshotBatchSize = 1000
+)
+
+// record is a line of a snapshot in NDJSON, which contains exactly one of the
+// fields. The first line of a snapshot contains the metadata, followed by the
+// settings and tasks of each topic.
+type record struct {
+	Metadata *metadata    `json:"metadata,omitempty"`
+	Topic    *ratus.Topic `json:"topic,omitempty"`
+	Task     *ratus.Task  `json:"task,omitempty"`
+}
+
+// metadata describes a snapshot.
+type metadata struct {
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+}
+
+// GetBackup streams a snapshot of all topics and tasks.
+// @summary   Stream a snapshot of all topics and tasks
+// @router    /admin/backup [get]
+// @tags      admin
+// @security  BearerAuth
+// @produce   application/x-ndjson
+// @success   200 {object} string
+// @failure   401 {object} ratus.Error
+// @failure   500 {object} ratus.Error
+func (r *AdminController) GetBackup(c *gin.Context) {
+	c.Header("Content-Type", "application/x-ndjson")
+	err := r.backup(c.Request.Context(), c.Writer)
+	if err == nil {
+		return
+	}
+
+	// Errors can only be reported before the stream starts, afterwards the
+	// snapshot is truncated.
+	if !c.Writer.Written() {
+		send(c, nil, err)
+		return
+	}
+	c.Error(err)
+	c.Abort()
+}
+
+// PostRestore restores topics and tasks from a snapshot.
+// @summary   Restore topics and tasks from a snapshot
+// @router    /admin/restore [post]
+// @tags      admin
+// @security  BearerAuth
+// @param     snapshot body string true "Snapshot streamed from the backup endpoint"
+// @accept    application/x-ndjson
+// @produce   application/json
+// @success   200 {object} ratus.Updated
+// @success   201 {object} ratus.Updated
+// @failure   400 {object} ratus.Error
+// @failure   401 {object} ratus.Error
+// @failure   500 {object} ratus.Error
+func (r *AdminController) PostRestore(c *gin.Context) {
+	v, err := r.restore(c.Request.Context(), c.Request.Body)
+	send(c, v, err)
+}
+
+// backup writes a snapshot by paging through topics and tasks with the
+// storage engine interface. Snapshots are not taken at a single point in
+// time, so changes made during backups may or may not be included.
+func (r *AdminController) backup(ctx context.Context, w io.Writer) error {
+	e := json.NewEncoder(w)
+	for after, n := "", 0; ; n++ {
+		ts, err := r.Engine.ListTopics(ctx, &engine.Page{Limit: snapshotBatchSize, After: after})
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			if err := e.Encode(&record{Metadata: &metadata{Version: snapshotVersion, Created: time.Now()}}); err != nil {
+				return err
+			}
+		}
+		for _, t := range ts {
+			if err := r.backupTopic(ctx, e, t.Name); err != nil {
+				return err
+			}
+		}
+		if len(ts) < snapshotBatchSize {
+			return nil
+		}
+		after = ts[len(ts)-1].Name
+	}
+}
+
+// backupTopic writes the settings and tasks of a topic. Settings are omitted
+// if none has been specified for the topic.
+func (r *AdminController) backupTopic(ctx context.Context, e *json.Encoder, topic string) error {
+	t, err := r.Engine.GetTopic(ctx, topic)
+	if err != nil && !errors.Is(err, ratus.ErrNotFound) {
+		return err
+	}
+	if t != nil {
+		s := ratus.Topic{
+			Name:        t.Name,
+			Retention:   t.Retention,
+			Fair:        t.Fair,
+			Prioritized: t.Prioritized,
+			Concurrency: t.Concurrency,
+			DedupWindow: t.DedupWindow,
+			AtMostOnce:  t.AtMostOnce,
+			Defaults:    t.Defaults,
+			Config:      t.Config,
+		}
+		if s != (ratus.Topic{Name: t.Name}) {
+			if err := e.Encode(&record{Topic: &s}); err != nil {
+				return err
+			}
+		}
+	}
+	return r.Engine.StreamTasks(ctx, topic, func(t *ratus.Task) error {
+		return e.Encode(&record{Task: t})
+	})
+}
+
+// restore reads a snapshot and inserts or updates the topics and tasks in it.
+// Tasks are upserted in batches, so restoring a snapshot more than once has
+// the same effect as restoring it once.
+func (r *AdminController) restore(ctx context.Context, rd io.Reader) (*ratus.Updated, error) {
+	d := json.NewDecoder(rd)
+	var m record
+	if err := d.Decode(&m); err != nil {
+		if err == io.EOF {
+			return nil, fmt.Errorf("%w: missing request body", ratus.ErrBadRequest)
+		}
+		return nil, fmt.Errorf("%w: %v", ratus.ErrBadRequest, err)
+	}
+	if m.Metadata == nil {
+		return nil, fmt.Errorf("%w: snapshot must start with metadata", ratus.ErrBadRequest)
+	}
+	if m.Metadata.Version != snapshotVersion {
+		return nil, fmt.Errorf("%w: unsupported snapshot version %d", ratus.ErrBadRequest, m.Metadata.Version)
+	}
+
+	var v ratus.Updated
+	ts := make([]*ratus.Task, 0, snapshotBatchSize)
+	flush := func() error {
+		if len(ts) == 0 {
+			return nil
+		}
+		u, err := r.Engine.UpsertTasks(ctx, ts)
+		if err != nil {
+			return err
+		}
+		v.Created += u.Created
+		v.Updated += u.Updated
+		ts = ts[:0]
+		return nil
+	}
+	for {
+		var x record
+		if err := d.Decode(&x); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%w: %v", ratus.ErrBadRequest, err)
+		}
+		switch {
+		case x.Topic != nil:
+			if x.Topic.Name == "" {
+				return nil, fmt.Errorf("%w: topic must not be empty", ratus.ErrBadRequest)
+			}
+			if _, err := r.Engine.UpsertTopic(ctx, x.Topic); err != nil {
+				return nil, err
+			}
+		case x.Task != nil:
+			if x.Task.ID == "" || x.Task.Topic == "" {
+				return nil, fmt.Errorf("%w: task ID and topic must not be empty", ratus.ErrBadRequest)
+			}
+			if ts = append(ts, x.Task); len(ts) >= snapshotBatchSize {
+				if err := flush(); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
@@ -0,0 +1,106 @@
+package controller
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/hyperonym/ratus"
+	"github.com/hyperonym/ratus/internal/config"
+	"github.com/hyperonym/ratus/internal/engine"
+	"github.com/hyperonym/ratus/internal/middleware"
+)
+
+// ConsumerController implements handlers for consumer-related endpoints.
+// Consumers executing tasks are listed from the storage engine, while the
+// times consumers were last seen polling or sending heartbeats are kept in
+// the memory of each instance.
+type ConsumerController struct {
+	Engine engine.Engine
+
+	window time.Duration
+	mux    sync.Mutex
+	seen   map[string]time.Time
+}
+
+// NewConsumerController creates a new ConsumerController.
+func NewConsumerController(g engine.Engine, cc *config.ConsumerConfig) *ConsumerController {
+	return &ConsumerController{
+		Engine: g,
+		window: cc.Window,
+		seen:   make(map[string]time.Time),
+	}
+}
+
+// GetConsumers lists consumers along with their in-flight tasks.
+// @summary  List consumers along with their in-flight tasks
+// @router   /consumers [get]
+// @tags     consumers
+// @produce  application/json
+// @success  200 {object} ratus.Consumers
+// @failure  500 {object} ratus.Error
+func (r *ConsumerController) GetConsumers(c *gin.Context) {
+	v, err := r.Engine.ListConsumers(c.Request.Context())
+	if err == nil {
+		v = r.merge(v)
+	}
+	send(c, &ratus.Consumers{Data: v}, err)
+}
+
+// PostConsumer records a heartbeat of a consumer.
+// @summary  Record a heartbeat of a consumer
+// @router   /consumers/{consumer} [post]
+// @tags     consumers
+// @param    consumer path string true "Identifier of the consumer"
+// @success  204
+func (r *ConsumerController) PostConsumer(c *gin.Context) {
+	r.touch(c.Param(middleware.ParamConsumer))
+	c.Status(http.StatusNoContent)
+}
+
+// Track records the consumers of promises bound to requests as being seen,
+// which is used as a middleware on endpoints for making promises.
+func (r *ConsumerController) Track(c *gin.Context) {
+	if p := c.MustGet(middleware.ParamPromise).(*ratus.Promise); p.Consumer != "" {
+		r.touch(p.Consumer)
+	}
+}
+
+func (r *ConsumerController) touch(consumer string) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.seen[consumer] = time.Now()
+}
+
+// merge updates the times consumers were last seen with the ones recorded by
+// the instance, and adds idle consumers that have been seen within the window.
+// Consumers seen before the window are forgotten.
+func (r *ConsumerController) merge(v []*ratus.Consumer) []*ratus.Consumer {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	m := make(map[string]bool, len(v))
+	for _, x := range v {
+		m[x.Name] = true
+		if t, ok := r.seen[x.Name]; ok && (x.Seen == nil || t.After(*x.Seen)) {
+			x.Seen = &t
+		}
+	}
+	n := time.Now()
+	for k, t := range r.seen {
+		if n.Sub(t) > r.window {
+			delete(r.seen, k)
+			continue
+		}
+		if !m[k] {
+			v = append(v, &ratus.Consumer{Name: k, Seen: &t})
+		}
+	}
+	slices.SortFunc(v, func(a, b *ratus.Consumer) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return v
+}
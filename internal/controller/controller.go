@@ -3,11 +3,16 @@ package controller
 
 import (
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
 	"github.com/hyperonym/ratus"
+	"github.com/hyperonym/ratus/internal/engine"
 	"github.com/hyperonym/ratus/internal/middleware"
+	"github.com/hyperonym/ratus/internal/wire"
 )
 
 // @title        Ratus
@@ -22,29 +27,66 @@ import (
 
 // @basePath  /v1
 
+// @securityDefinitions.apikey  BearerAuth
+// @in                          header
+// @name                        Authorization
+
 // @tag.name  topics
 // @tag.name  tasks
 // @tag.name  promises
+// @tag.name  consumers
 // @tag.name  health
 // @tag.name  metrics
+// @tag.name  admin
+
+// Optional fields of resources that are only included in responses if
+// requested with the include query parameter.
+const (
+	includeHistory = "history"
+)
 
 // Middleware instances for binding and normalizing request bodies.
 var (
-	bindTask    = middleware.Task()
-	bindTasks   = middleware.Tasks()
-	bindPromise = middleware.Promise()
-	bindCommit  = middleware.Commit()
+	bindTopic    = middleware.Topic()
+	bindTask     = middleware.Task()
+	bindTasks    = middleware.Tasks()
+	bindPromise  = middleware.Promise()
+	bindCommit   = middleware.Commit()
+	bindLabels   = middleware.Labels()
+	bindQuota    = middleware.Quota()
+	bindMove     = middleware.Move()
+	bindRange    = middleware.Range()
+	bindProgress = middleware.Progress()
+	bindNext     = middleware.Next()
+	bindBatchGet = middleware.BatchGet()
+
+	bindTopicSort   = middleware.Sort("name")
+	bindTaskSort    = middleware.Sort("id", engine.SortScheduled, engine.SortProduced, engine.SortConsumed)
+	bindArchiveSort = middleware.Sort(engine.SortConsumed)
 )
 
 // V1 implements endpoint mounting for API version 1.
 type V1 struct {
-	Pagination gin.HandlerFunc
+	Pagination   gin.HandlerFunc
+	AdminAuth    gin.HandlerFunc
+	Deadline     gin.HandlerFunc
+	Idempotency  gin.HandlerFunc
+	Names        gin.HandlerFunc
+	Timeouts     gin.HandlerFunc
+	Skew         gin.HandlerFunc
+	Transitions  gin.HandlerFunc
+	Backpressure gin.HandlerFunc
+	Capacity     gin.HandlerFunc
+	Watch        gin.HandlerFunc
 
-	Topic   *TopicController
-	Task    *TaskController
-	Promise *PromiseController
-	Health  *HealthController
-	Metrics *MetricsController
+	Topic    *TopicController
+	Task     *TaskController
+	Promise  *PromiseController
+	Consumer *ConsumerController
+	Quota    *QuotaController
+	Health   *HealthController
+	Metrics  *MetricsController
+	Admin    *AdminController
 }
 
 // Prefixes returns the common path prefixes for endpoints in the group.
@@ -54,39 +96,217 @@ func (v *V1) Prefixes() []string {
 
 // Mount initializes group-level middlewares and mounts the endpoints.
 func (v *V1) Mount(r *gin.RouterGroup) {
-	r.Use(middleware.Prometheus())
+	r.Use(middleware.Prometheus(), middleware.ServerTime())
+	if v.Idempotency != nil {
+		r.Use(v.Idempotency)
+	}
+	if v.Names != nil {
+		r.Use(v.Names)
+	}
+	if v.Timeouts != nil {
+		r.Use(v.Timeouts)
+	}
+	if v.Skew != nil {
+		r.Use(v.Skew)
+	}
 
-	r.GET("/topics", v.Pagination, v.Topic.GetTopics)
+	// Admin endpoints are mounted in a group marking the requests to them, so
+	// that they are limited by the admin timeout instead of the timeout of
+	// their methods.
+	a := r.Group("", middleware.AdminRoute())
+	if v.Deadline != nil {
+		r.Use(v.Deadline)
+		a.Use(v.Deadline)
+	}
+
+	r.GET("/topics", v.Pagination, bindTopicSort, v.Topic.GetTopics)
 	r.DELETE("/topics", v.Topic.DeleteTopics)
 
 	r.GET("/topics/:topic", v.Topic.GetTopic)
+	r.PUT("/topics/:topic", bindTopic, v.Topic.PutTopic)
 	r.DELETE("/topics/:topic", v.Topic.DeleteTopic)
+	r.GET("/topics/:topic/config", v.Topic.GetTopicConfig)
+
+	// Task defaults of topics are loaded before binding tasks so that they
+	// are applied to unspecified fields. Quotas of producers are enforced on
+	// endpoints for inserting tasks if quotas are enabled, after rejecting
+	// inserts into topics with too many pending tasks if backpressure or
+	// maximum numbers of pending tasks are enabled.
+	limit := func(*gin.Context) {}
+	if v.Quota != nil {
+		limit = v.Quota.Limit
+	}
+	backpressure := func(*gin.Context) {}
+	if v.Backpressure != nil {
+		backpressure = v.Backpressure
+	}
+	capacity := func(*gin.Context) {}
+	if v.Capacity != nil {
+		capacity = v.Capacity
+	}
+
+	// Commits are validated against the rules of state transitions if any.
+	transition := func(*gin.Context) {}
+	if v.Transitions != nil {
+		transition = v.Transitions
+	}
 
-	r.GET("/topics/:topic/tasks", v.Pagination, v.Task.GetTasks)
-	r.POST("/topics/:topic/tasks", bindTasks, v.Task.PostTasks)
-	r.PUT("/topics/:topic/tasks", bindTasks, v.Task.PutTasks)
-	r.DELETE("/topics/:topic/tasks", v.Task.DeleteTasks)
+	r.GET("/topics/:topic/tasks", v.Pagination, bindTaskSort, bindLabels, v.Task.GetTasks)
+	r.POST("/topics/:topic/tasks", v.Task.Defaults, bindTasks, backpressure, capacity, limit, v.Task.PostTasks)
+	r.PUT("/topics/:topic/tasks", v.Task.Defaults, bindTasks, backpressure, capacity, limit, v.Task.PutTasks)
+	r.DELETE("/topics/:topic/tasks", bindLabels, v.Task.DeleteTasks)
 
 	r.GET("/topics/:topic/tasks/:id", v.Task.GetTask)
-	r.POST("/topics/:topic/tasks/:id", bindTask, v.Task.PostTask)
-	r.PUT("/topics/:topic/tasks/:id", bindTask, v.Task.PutTask)
+	r.POST("/topics/:topic/tasks/:id", v.Task.Defaults, bindTask, backpressure, capacity, limit, v.Task.PostTask)
+	r.PUT("/topics/:topic/tasks/:id", v.Task.Defaults, bindTask, backpressure, capacity, limit, v.Task.PutTask)
 	r.DELETE("/topics/:topic/tasks/:id", v.Task.DeleteTask)
-	r.PATCH("/topics/:topic/tasks/:id", bindCommit, v.Task.PatchTask)
+	r.PATCH("/topics/:topic/tasks/:id", bindCommit, bindNext, transition, v.Task.PatchTask)
+	r.GET("/topics/:topic/tasks/:id/result", v.Task.GetResult)
+	r.PATCH("/topics/:topic/tasks/:id/progress", bindProgress, v.Task.PatchProgress)
+	if v.Watch != nil {
+		r.GET("/topics/:topic/tasks/:id/watch", v.Watch, v.Task.GetWatch)
+	}
+	r.GET("/topics/:topic/archive", v.Pagination, bindArchiveSort, bindRange, v.Task.GetArchive)
+	r.POST("/tasks:action", verb(":batchGet"), bindBatchGet, v.Task.PostBatchGet)
+
+	// Consumers making promises are tracked if consumer endpoints are
+	// enabled.
+	track := func(*gin.Context) {}
+	if v.Consumer != nil {
+		track = v.Consumer.Track
+	}
 
 	r.GET("/topics/:topic/promises", v.Pagination, v.Promise.GetPromises)
-	r.POST("/topics/:topic/promises", bindPromise, v.Promise.PostPromises)
+	r.POST("/topics/:topic/promises", bindPromise, track, v.Promise.PostPromises)
 	r.DELETE("/topics/:topic/promises", v.Promise.DeletePromises)
 
 	r.GET("/topics/:topic/promises/:id", v.Promise.GetPromise)
-	r.POST("/topics/:topic/promises/:id", bindPromise, v.Promise.PostPromise)
-	r.PUT("/topics/:topic/promises/:id", bindPromise, v.Promise.PutPromise)
+	r.POST("/topics/:topic/promises/:id", method(":steal"), bindPromise, track, v.Promise.PostPromise)
+	r.PUT("/topics/:topic/promises/:id", bindPromise, track, v.Promise.PutPromise)
 	r.DELETE("/topics/:topic/promises/:id", v.Promise.DeletePromise)
 
+	if v.Consumer != nil {
+		r.GET("/consumers", v.Consumer.GetConsumers)
+		r.POST("/consumers/:consumer", v.Consumer.PostConsumer)
+	}
+
 	r.GET("/healthz", v.Health.GetLiveness)
 	r.GET("/livez", v.Health.GetLiveness)
 	r.GET("/readyz", v.Health.GetReadiness)
+	r.GET("/capabilities", v.Health.GetCapabilities)
+	r.GET("/version", v.Health.GetVersion)
 
 	r.GET("/metrics", v.Metrics.GetMetrics)
+	r.GET("/stats", v.Metrics.GetStats)
+
+	// Admin endpoints are only mounted if they are enabled.
+	if v.Admin != nil {
+		a.POST("/admin/chore", v.AdminAuth, v.Admin.PostChore)
+		a.GET("/admin/backup", v.AdminAuth, v.Admin.GetBackup)
+		a.POST("/admin/restore", v.AdminAuth, v.Admin.PostRestore)
+		a.POST("/topics/:topic/tasks:action", verb(":move"), v.AdminAuth, bindMove, v.Admin.PostMove)
+		if v.Quota != nil {
+			a.GET("/admin/quotas", v.AdminAuth, v.Quota.GetQuotas)
+			a.PUT("/admin/quotas/:producer", v.AdminAuth, bindQuota, v.Quota.PutQuota)
+			a.DELETE("/admin/quotas/:producer", v.AdminAuth, v.Quota.DeleteQuota)
+		}
+	}
+}
+
+// V2 implements endpoint mounting for API version 2. Endpoints and their
+// controllers are shared with version 1, except that lists are paginated with
+// opaque cursors rather than offsets, so the pagination middleware is expected
+// to be created with middleware.Cursor.
+type V2 struct {
+	V1
+}
+
+// Prefixes returns the common path prefixes for endpoints in the group.
+func (v *V2) Prefixes() []string {
+	return []string{"/v2"}
+}
+
+// page returns the range of resources to list based on the pagination options
+// in the request context. When paginating with cursors, an extra resource is
+// requested to tell whether there is a next page.
+func page(c *gin.Context) *engine.Page {
+	s := c.GetString(middleware.ParamSort)
+	p := engine.Page{
+		Limit:  c.GetInt(middleware.ParamLimit),
+		Offset: c.GetInt(middleware.ParamOffset),
+		Sort:   strings.TrimPrefix(s, "-"),
+		Desc:   strings.HasPrefix(s, "-"),
+		After:  c.GetString(middleware.ParamAfter),
+	}
+	if t, ok := c.Get(middleware.ParamTime); ok {
+		p.Time = t.(*time.Time)
+	}
+	if c.GetBool(middleware.ParamCursor) {
+		p.Limit++
+	}
+	return &p
+}
+
+// next removes the extra resource requested by page from the results, and
+// returns the cursor of the next page if there is one. The key function
+// returns the key of a resource and the value of the field it is sorted by.
+func next[T any](c *gin.Context, v []T, key func(T) (string, *time.Time)) ([]T, string) {
+	l := c.GetInt(middleware.ParamLimit)
+	if !c.GetBool(middleware.ParamCursor) || len(v) <= l || l <= 0 {
+		return v, ""
+	}
+	v = v[:l]
+	k, t := key(v[l-1])
+	return v, middleware.EncodeCursor(c.GetString(middleware.ParamSort), k, t)
+}
+
+// total sets the X-Total-Count header to the number of resources regardless of
+// pagination if it is requested. The header is omitted if the storage engine
+// is unable to count resources.
+func total(c *gin.Context, g engine.Engine, count func(engine.Counter) (int64, error)) error {
+	x, ok := g.(engine.Counter)
+	if !ok || !c.GetBool(middleware.ParamCount) {
+		return nil
+	}
+	n, err := count(x)
+	if err != nil {
+		return err
+	}
+	c.Header("X-Total-Count", strconv.FormatInt(n, 10))
+	return nil
+}
+
+// verb returns a middleware that matches custom methods on resources, which
+// are suffixed to the resource paths after colons such as "tasks:move". Gin
+// does not support colons in static paths, so the methods are captured by a
+// path parameter and requests for other methods are rejected as not found.
+func verb(method string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Param(middleware.ParamAction) != method {
+			send(c, nil, ratus.ErrNotFound)
+		}
+	}
+}
+
+// method returns a middleware that matches custom methods on individual
+// resources, which are suffixed to their IDs after colons such as "id:steal".
+// Gin captures the suffix along with the ID, so matched methods are moved from
+// the ID parameter to the action parameter for the handlers to dispatch on.
+func method(methods ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		for i, p := range c.Params {
+			if p.Key != middleware.ParamID {
+				continue
+			}
+			for _, m := range methods {
+				if id, ok := strings.CutSuffix(p.Value, m); ok && id != "" {
+					c.Params[i].Value = id
+					c.Params = append(c.Params, gin.Param{Key: middleware.ParamAction, Value: m})
+					return
+				}
+			}
+		}
+	}
 }
 
 func send(c *gin.Context, v any, err error) {
@@ -101,14 +321,76 @@ func send(c *gin.Context, v any, err error) {
 		return
 	}
 
-	// Determine status code for the successful response.
+	// Determine status code for the successful response. Histories of tasks
+	// are omitted unless they are explicitly requested, and versions of
+	// single tasks are exposed as entity tags.
 	s := http.StatusOK
+	h := included(c, includeHistory)
 	switch x := v.(type) {
 	case *ratus.Updated:
 		if x.Created > 0 {
 			s = http.StatusCreated
 		}
+	case *ratus.Task:
+		if !h {
+			x.History = nil
+		}
+		if x.Version > 0 {
+			c.Header("ETag", strconv.Quote(strconv.FormatInt(x.Version, 10)))
+		}
+	case *ratus.Handoff:
+		if !h {
+			x.Committed.History = nil
+			if x.Next != nil {
+				x.Next.History = nil
+			}
+		}
+		if x.Committed.Version > 0 {
+			c.Header("ETag", strconv.Quote(strconv.FormatInt(x.Committed.Version, 10)))
+		}
+	case *ratus.Tasks:
+		for _, t := range x.Data {
+			if !h {
+				t.History = nil
+			}
+		}
 	}
 
+	// Encode the response in the wire format negotiated with the Accept
+	// header, error responses are always encoded in JSON.
+	if f := wire.Negotiate(c.GetHeader("Accept")); f != wire.JSON {
+		c.Render(s, encoded{format: f, value: v})
+		return
+	}
 	c.JSON(s, v)
 }
+
+// encoded renders a value in a binary wire format.
+type encoded struct {
+	format string
+	value  any
+}
+
+// Render implements the render.Render interface.
+func (r encoded) Render(w http.ResponseWriter) error {
+	r.WriteContentType(w)
+	return wire.Encode(w, r.format, r.value)
+}
+
+// WriteContentType implements the render.Render interface.
+func (r encoded) WriteContentType(w http.ResponseWriter) {
+	if h := w.Header(); len(h["Content-Type"]) == 0 {
+		h["Content-Type"] = []string{r.format}
+	}
+}
+
+// included returns whether the optional field is requested in the
+// comma-separated list of the include query parameter.
+func included(c *gin.Context, field string) bool {
+	for _, s := range strings.Split(c.Query(middleware.ParamInclude), ",") {
+		if s == field {
+			return true
+		}
+	}
+	return false
+}
@@ -1,9 +1,17 @@
 package controller_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
@@ -12,9 +20,26 @@ import (
 	"github.com/hyperonym/ratus/internal/controller"
 	"github.com/hyperonym/ratus/internal/engine/stub"
 	"github.com/hyperonym/ratus/internal/middleware"
+	"github.com/hyperonym/ratus/internal/nonce"
 	"github.com/hyperonym/ratus/internal/reqtest"
+	"github.com/hyperonym/ratus/internal/router"
+	"github.com/hyperonym/ratus/internal/wire"
 )
 
+// settingless is a stub engine that has no settings for any topic, so that
+// errors of the stub are only returned by the handlers under test.
+type settingless struct {
+	stub.Engine
+}
+
+func (g *settingless) GetTopic(ctx context.Context, topic string) (*ratus.Topic, error) {
+	return nil, ratus.ErrNotFound
+}
+
+func (g *settingless) GetTopicSettings(ctx context.Context, topic string) (*ratus.Topic, error) {
+	return &ratus.Topic{Name: topic}, nil
+}
+
 func TestController(t *testing.T) {
 	gin.SetMode(gin.ReleaseMode)
 
@@ -25,13 +50,24 @@ func TestController(t *testing.T) {
 			t.Parallel()
 			o := config.PaginationConfig{MaxLimit: 10, MaxOffset: 10}
 			g := stub.Engine{Err: nil}
+			watch, err := middleware.Watch(&config.WatchConfig{Timeout: 50 * time.Millisecond, CheckInterval: 10 * time.Millisecond})
+			if err != nil {
+				t.Fatal(err)
+			}
+			health := controller.NewHealthController(&g)
+			health.Build = &ratus.Build{Version: "v1.0.0", Engine: "stub", Config: map[string]string{"PORT": "80"}}
 			h := reqtest.NewHandler(&controller.V1{
 				Pagination: middleware.Pagination(&o),
-				Topic:      controller.NewTopicController(&g),
-				Task:       controller.NewTaskController(&g),
-				Promise:    controller.NewPromiseController(&g),
-				Health:     controller.NewHealthController(&g),
+				AdminAuth:  middleware.Admin(&config.AdminConfig{Token: "secret"}),
+				Watch:      watch,
+				Topic:      controller.NewTopicController(&g, &config.DeleteConfig{}),
+				Task:       controller.NewTaskController(&g, &config.TokenConfig{}),
+				Promise:    controller.NewPromiseController(&g, &config.TokenConfig{}),
+				Consumer:   controller.NewConsumerController(&g, &config.ConsumerConfig{Window: time.Minute}),
+				Quota:      controller.NewQuotaController(&g, &config.QuotaConfig{}),
+				Health:     health,
 				Metrics:    controller.NewMetricsController(&g),
+				Admin:      controller.NewAdminController(&g),
 			})
 
 			t.Run("topics", func(t *testing.T) {
@@ -47,10 +83,25 @@ func TestController(t *testing.T) {
 					r.AssertBodyContains(`{"name":"topic"}`)
 				})
 
+				t.Run("count", func(t *testing.T) {
+					t.Parallel()
+					req := httptest.NewRequest(http.MethodGet, "/topics?count=true", nil)
+					r := reqtest.Record(t, h, req)
+					r.AssertStatusCode(http.StatusOK)
+					r.AssertHeaderContains("X-Total-Count", "1")
+				})
+
 				t.Run("delete", func(t *testing.T) {
 					t.Parallel()
 					req := httptest.NewRequest(http.MethodDelete, "/topics", nil)
 					r := reqtest.Record(t, h, req)
+					r.AssertStatusCode(http.StatusPreconditionRequired)
+					r.AssertBodyContains("deleting all 1 topics must be confirmed")
+					req = httptest.NewRequest(http.MethodDelete, "/topics?confirm=2", nil)
+					r = reqtest.Record(t, h, req)
+					r.AssertStatusCode(http.StatusPreconditionRequired)
+					req = httptest.NewRequest(http.MethodDelete, "/topics?confirm=1", nil)
+					r = reqtest.Record(t, h, req)
 					r.AssertStatusCode(http.StatusOK)
 					r.AssertHeaderContains("Content-Type", "application/json")
 					r.AssertBodyContains(`"deleted":`)
@@ -70,10 +121,36 @@ func TestController(t *testing.T) {
 					r.AssertBodyContains(`"count":`)
 				})
 
+				t.Run("config", func(t *testing.T) {
+					t.Parallel()
+					req := httptest.NewRequest(http.MethodGet, "/topics/topic/config", nil)
+					r := reqtest.Record(t, h, req)
+					r.AssertStatusCode(http.StatusOK)
+					r.AssertHeaderContains("Content-Type", "application/json")
+					r.AssertBodyContains(`{}`)
+				})
+
+				t.Run("put", func(t *testing.T) {
+					t.Parallel()
+					req := reqtest.NewRequestJSON(http.MethodPut, "/topics/topic", &ratus.Topic{Retention: "1h"})
+					r := reqtest.Record(t, h, req)
+					r.AssertStatusCode(http.StatusOK)
+					r.AssertHeaderContains("Content-Type", "application/json")
+					r.AssertBodyContains(`"created":`)
+					r.AssertBodyContains(`"updated":`)
+				})
+
 				t.Run("delete", func(t *testing.T) {
 					t.Parallel()
 					req := httptest.NewRequest(http.MethodDelete, "/topics/topic", nil)
 					r := reqtest.Record(t, h, req)
+					r.AssertStatusCode(http.StatusPreconditionRequired)
+					r.AssertBodyContains(`deleting topic \"topic\" must be confirmed`)
+					req = httptest.NewRequest(http.MethodDelete, "/topics/topic?confirm=other", nil)
+					r = reqtest.Record(t, h, req)
+					r.AssertStatusCode(http.StatusPreconditionRequired)
+					req = httptest.NewRequest(http.MethodDelete, "/topics/topic?confirm=topic", nil)
+					r = reqtest.Record(t, h, req)
 					r.AssertStatusCode(http.StatusOK)
 					r.AssertHeaderContains("Content-Type", "application/json")
 					r.AssertBodyContains(`"deleted":`)
@@ -93,6 +170,14 @@ func TestController(t *testing.T) {
 					r.AssertBodyContains(`"topic":"topic`)
 				})
 
+				t.Run("count", func(t *testing.T) {
+					t.Parallel()
+					req := httptest.NewRequest(http.MethodGet, "/topics/topic/tasks?count=true", nil)
+					r := reqtest.Record(t, h, req)
+					r.AssertStatusCode(http.StatusOK)
+					r.AssertHeaderContains("X-Total-Count", "1")
+				})
+
 				t.Run("post", func(t *testing.T) {
 					t.Parallel()
 					v := ratus.Tasks{Data: []*ratus.Task{{ID: "id"}}}
@@ -115,6 +200,24 @@ func TestController(t *testing.T) {
 					r.AssertBodyContains(`"updated":`)
 				})
 
+				t.Run("batch", func(t *testing.T) {
+					t.Parallel()
+					v := ratus.BatchGet{IDs: []string{"a", "b", "a"}}
+					req := reqtest.NewRequestJSON(http.MethodPost, "/tasks:batchGet", &v)
+					r := reqtest.Record(t, h, req)
+					r.AssertStatusCode(http.StatusOK)
+					r.AssertHeaderContains("Content-Type", "application/json")
+					r.AssertBodyContains(`"data":[{"_id":"a"`)
+					r.AssertBodyContains(`"_id":"b"`)
+					r.AssertBodyNotContains(`"next":`)
+					req = reqtest.NewRequestJSON(http.MethodPost, "/tasks:batchGet", &ratus.BatchGet{})
+					r = reqtest.Record(t, h, req)
+					r.AssertStatusCode(http.StatusBadRequest)
+					req = reqtest.NewRequestJSON(http.MethodPost, "/tasks:batchDelete", &v)
+					r = reqtest.Record(t, h, req)
+					r.AssertStatusCode(http.StatusNotFound)
+				})
+
 				t.Run("delete", func(t *testing.T) {
 					t.Parallel()
 					req := httptest.NewRequest(http.MethodDelete, "/topics/topic/tasks", nil)
@@ -134,7 +237,98 @@ func TestController(t *testing.T) {
 					r := reqtest.Record(t, h, req)
 					r.AssertStatusCode(http.StatusOK)
 					r.AssertHeaderContains("Content-Type", "application/json")
+					r.AssertHeaderContains("ETag", `"1"`)
+					r.AssertHeaderContains("X-Server-Time", "T")
 					r.AssertBodyContains(`"topic":"topic`)
+					r.AssertBodyNotContains(`"history":`)
+				})
+
+				t.Run("include", func(t *testing.T) {
+					t.Parallel()
+					req := httptest.NewRequest(http.MethodGet, "/topics/topic/tasks/id?include=history", nil)
+					r := reqtest.Record(t, h, req)
+					r.AssertStatusCode(http.StatusOK)
+					r.AssertHeaderContains("Content-Type", "application/json")
+					r.AssertBodyContains(`"history":[{"state":0`)
+				})
+
+				t.Run("archive", func(t *testing.T) {
+					t.Parallel()
+					req := httptest.NewRequest(http.MethodGet, "/topics/topic/archive?from=2022-01-01T00:00:00Z&sort=-consumed", nil)
+					r := reqtest.Record(t, h, req)
+					r.AssertStatusCode(http.StatusOK)
+					r.AssertHeaderContains("Content-Type", "application/json")
+					r.AssertBodyContains(`"state":3`)
+				})
+
+				t.Run("result", func(t *testing.T) {
+					t.Parallel()
+					req := httptest.NewRequest(http.MethodGet, "/topics/topic/tasks/id/result", nil)
+					r := reqtest.Record(t, h, req)
+					r.AssertStatusCode(http.StatusOK)
+					r.AssertHeaderContains("Content-Type", "application/json")
+					r.AssertBodyContains(`"_id":"id"`)
+					r.AssertBodyNotContains(`"payload":`)
+				})
+
+				t.Run("watch", func(t *testing.T) {
+					t.Parallel()
+
+					// Tasks whose versions differ are returned immediately,
+					// while unchanged tasks are returned as is once the wait
+					// is over.
+					req := httptest.NewRequest(http.MethodGet, "/topics/topic/tasks/id/watch?version=0&timeout=1h", nil)
+					n := time.Now()
+					r := reqtest.Record(t, h, req)
+					r.AssertStatusCode(http.StatusOK)
+					r.AssertBodyContains(`"version":1`)
+					if d := time.Since(n); d >= 50*time.Millisecond {
+						t.Errorf("incorrect duration of watch, expected immediate return, got %s", d)
+					}
+					req = httptest.NewRequest(http.MethodGet, "/topics/topic/tasks/id/watch", nil)
+					n = time.Now()
+					r = reqtest.Record(t, h, req)
+					r.AssertStatusCode(http.StatusOK)
+					r.AssertBodyContains(`"version":1`)
+					if d := time.Since(n); d < 50*time.Millisecond {
+						t.Errorf("incorrect duration of watch, expected at least 50ms, got %s", d)
+					}
+					req = httptest.NewRequest(http.MethodGet, "/topics/topic/tasks/id/watch?version=x", nil)
+					r = reqtest.Record(t, h, req)
+					r.AssertStatusCode(http.StatusBadRequest)
+				})
+
+				t.Run("progress", func(t *testing.T) {
+					t.Parallel()
+					req := reqtest.NewRequestJSON(http.MethodPatch, "/topics/topic/tasks/id/progress", &ratus.Progress{Percent: 50, Message: "halfway"})
+					r := reqtest.Record(t, h, req)
+					r.AssertStatusCode(http.StatusOK)
+					r.AssertHeaderContains("Content-Type", "application/json")
+					r.AssertBodyContains(`"updated":1`)
+				})
+
+				t.Run("msgpack", func(t *testing.T) {
+					t.Parallel()
+					req := httptest.NewRequest(http.MethodGet, "/topics/topic/tasks/id", nil)
+					req.Header.Set("Accept", "application/msgpack")
+					r := reqtest.Record(t, h, req)
+					r.AssertStatusCode(http.StatusOK)
+					r.AssertHeaderContains("Content-Type", "application/msgpack")
+					r.AssertBodyNotContains(`"_id":`)
+				})
+
+				t.Run("cbor", func(t *testing.T) {
+					t.Parallel()
+					var b bytes.Buffer
+					if err := wire.Encode(&b, wire.CBOR, &ratus.Task{Topic: "topic"}); err != nil {
+						t.Fatal(err)
+					}
+					req := httptest.NewRequest(http.MethodPost, "/topics/topic/tasks/id", &b)
+					req.Header.Set("Content-Type", "application/cbor")
+					req.Header.Set("Accept", "application/cbor")
+					r := reqtest.Record(t, h, req)
+					r.AssertStatusCode(http.StatusCreated)
+					r.AssertHeaderContains("Content-Type", "application/cbor")
 				})
 
 				t.Run("post", func(t *testing.T) {
@@ -177,6 +371,17 @@ func TestController(t *testing.T) {
 					r.AssertHeaderContains("Content-Type", "application/json")
 					r.AssertBodyContains(`"topic":"topic`)
 				})
+
+				t.Run("next", func(t *testing.T) {
+					t.Parallel()
+					req := reqtest.NewRequestJSON(http.MethodPatch, "/topics/topic/tasks/id?next=true&timeout=1m", &ratus.Commit{})
+					r := reqtest.Record(t, h, req)
+					r.AssertStatusCode(http.StatusOK)
+					r.AssertHeaderContains("Content-Type", "application/json")
+					r.AssertBodyContains(`"committed":{`)
+					r.AssertBodyContains(`"next":{`)
+					r.AssertBodyNotContains(`"history":`)
+				})
 			})
 
 			t.Run("promises", func(t *testing.T) {
@@ -192,6 +397,14 @@ func TestController(t *testing.T) {
 					r.AssertBodyContains(`"deadline":`)
 				})
 
+				t.Run("count", func(t *testing.T) {
+					t.Parallel()
+					req := httptest.NewRequest(http.MethodGet, "/topics/topic/promises?count=true", nil)
+					r := reqtest.Record(t, h, req)
+					r.AssertStatusCode(http.StatusOK)
+					r.AssertHeaderContains("X-Total-Count", "1")
+				})
+
 				t.Run("post", func(t *testing.T) {
 					t.Parallel()
 					var v ratus.Promise
@@ -254,6 +467,16 @@ func TestController(t *testing.T) {
 					r.AssertBodyContains(`"topic":"topic`)
 				})
 
+				t.Run("steal", func(t *testing.T) {
+					t.Parallel()
+					v := ratus.Promise{ID: "id"}
+					req := reqtest.NewRequestJSON(http.MethodPost, "/topics/topic/promises/id:steal", &v)
+					r := reqtest.Record(t, h, req)
+					r.AssertStatusCode(http.StatusOK)
+					r.AssertHeaderContains("Content-Type", "application/json")
+					r.AssertBodyContains(`"topic":"topic`)
+				})
+
 				t.Run("delete", func(t *testing.T) {
 					t.Parallel()
 					req := httptest.NewRequest(http.MethodDelete, "/topics/topic/promises/id", nil)
@@ -264,6 +487,23 @@ func TestController(t *testing.T) {
 				})
 			})
 
+			t.Run("consumers", func(t *testing.T) {
+				t.Parallel()
+				req := httptest.NewRequest(http.MethodPost, "/consumers/heartbeat", nil)
+				r := reqtest.Record(t, h, req)
+				r.AssertStatusCode(http.StatusNoContent)
+				req = reqtest.NewRequestJSON(http.MethodPost, "/topics/topic/promises", &ratus.Promise{Consumer: "poller"})
+				r = reqtest.Record(t, h, req)
+				r.AssertStatusCode(http.StatusOK)
+				req = httptest.NewRequest(http.MethodGet, "/consumers", nil)
+				r = reqtest.Record(t, h, req)
+				r.AssertStatusCode(http.StatusOK)
+				r.AssertHeaderContains("Content-Type", "application/json")
+				r.AssertBodyContains(`{"name":"consumer","seen":"2022-07-29T20:00:00Z","promises":[{"_id":"id","consumer":"consumer","deadline":"2022-07-29T20:00:00Z"}]}`)
+				r.AssertBodyContains(`{"name":"heartbeat","seen":`)
+				r.AssertBodyContains(`{"name":"poller","seen":`)
+			})
+
 			t.Run("health", func(t *testing.T) {
 				t.Parallel()
 
@@ -280,6 +520,28 @@ func TestController(t *testing.T) {
 					r := reqtest.Record(t, h, req)
 					r.AssertStatusCode(http.StatusOK)
 				})
+
+				t.Run("capabilities", func(t *testing.T) {
+					t.Parallel()
+					req := httptest.NewRequest(http.MethodGet, "/capabilities", nil)
+					r := reqtest.Record(t, h, req)
+					r.AssertStatusCode(http.StatusOK)
+					r.AssertHeaderContains("Content-Type", "application/json")
+					r.AssertBodyContains(`"ttl":false`)
+					r.AssertBodyContains(`"change_streams":false`)
+					r.AssertBodyContains(`"priorities":false`)
+					r.AssertBodyContains(`"filtered_list":false`)
+				})
+
+				t.Run("version", func(t *testing.T) {
+					t.Parallel()
+					req := httptest.NewRequest(http.MethodGet, "/version", nil)
+					r := reqtest.Record(t, h, req)
+					r.AssertStatusCode(http.StatusOK)
+					r.AssertHeaderContains("Content-Type", "application/json")
+					r.AssertBodyContains(`"version":"v1.0.0"`)
+					r.AssertBodyContains(`"config":{"PORT":"80"}`)
+				})
 			})
 
 			t.Run("metrics", func(t *testing.T) {
@@ -290,19 +552,445 @@ func TestController(t *testing.T) {
 					req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
 					r := reqtest.Record(t, h, req)
 					r.AssertStatusCode(http.StatusOK)
+					r.AssertBodyContains(`ratus_topic_tasks{state="pending",topic="topic"} 1`)
+					r.AssertBodyContains("ratus_topic_oldest_pending_age_seconds")
+				})
+
+				t.Run("stats", func(t *testing.T) {
+					t.Parallel()
+					req := httptest.NewRequest(http.MethodGet, "/stats", nil)
+					r := reqtest.Record(t, h, req)
+					r.AssertStatusCode(http.StatusOK)
+					r.AssertHeaderContains("Content-Type", "application/json")
+					r.AssertBodyContains(`"pending":1`)
+					r.AssertBodyContains(`"topics":[{"name":"topic"`)
+				})
+			})
+
+			t.Run("admin", func(t *testing.T) {
+				t.Parallel()
+
+				t.Run("chore", func(t *testing.T) {
+					t.Parallel()
+					req := httptest.NewRequest(http.MethodPost, "/admin/chore", nil)
+					req.Header.Set("Authorization", "Bearer secret")
+					r := reqtest.Record(t, h, req)
+					r.AssertStatusCode(http.StatusOK)
+					r.AssertHeaderContains("Content-Type", "application/json")
+					r.AssertBodyContains(`"recovered":1`)
+					r.AssertBodyContains(`"recoveries":[{"_id":"1","topic":"topic"}]`)
+				})
+
+				t.Run("unauthorized", func(t *testing.T) {
+					t.Parallel()
+					req := httptest.NewRequest(http.MethodPost, "/admin/chore", nil)
+					r := reqtest.Record(t, h, req)
+					r.AssertStatusCode(http.StatusUnauthorized)
+					r.AssertBodyContains("unauthorized")
+				})
+
+				t.Run("move", func(t *testing.T) {
+					t.Parallel()
+					req := reqtest.NewRequestJSON(http.MethodPost, "/topics/topic/tasks:move", &ratus.Move{Topic: "other"})
+					req.Header.Set("Authorization", "Bearer secret")
+					r := reqtest.Record(t, h, req)
+					r.AssertStatusCode(http.StatusOK)
+					r.AssertHeaderContains("Content-Type", "application/json")
+					r.AssertBodyContains(`"updated":1`)
+					req = reqtest.NewRequestJSON(http.MethodPost, "/topics/topic/tasks:move", &ratus.Move{Topic: "other"})
+					r = reqtest.Record(t, h, req)
+					r.AssertStatusCode(http.StatusUnauthorized)
+					req = reqtest.NewRequestJSON(http.MethodPost, "/topics/topic/tasks:copy", &ratus.Move{Topic: "other"})
+					req.Header.Set("Authorization", "Bearer secret")
+					r = reqtest.Record(t, h, req)
+					r.AssertStatusCode(http.StatusNotFound)
+				})
+
+				t.Run("backup", func(t *testing.T) {
+					t.Parallel()
+					req := httptest.NewRequest(http.MethodGet, "/admin/backup", nil)
+					req.Header.Set("Authorization", "Bearer secret")
+					r := reqtest.Record(t, h, req)
+					r.AssertStatusCode(http.StatusOK)
+					r.AssertHeaderContains("Content-Type", "application/x-ndjson")
+					r.AssertBodyContains(`{"metadata":{"version":1,"created":`)
+					r.AssertBodyContains(`{"task":{"_id":"id","topic":"topic"`)
+					r.AssertBodyNotContains(`{"topic":`)
+
+					// Snapshots should be restored by upserting the tasks.
+					req = httptest.NewRequest(http.MethodPost, "/admin/restore", bytes.NewReader(r.Body))
+					req.Header.Set("Authorization", "Bearer secret")
+					r = reqtest.Record(t, h, req)
+					r.AssertStatusCode(http.StatusCreated)
+					r.AssertBodyContains(`{"created":1,"updated":1}`)
+
+					// Snapshots must start with supported metadata.
+					req = httptest.NewRequest(http.MethodPost, "/admin/restore", bytes.NewBufferString(`{"task":{"_id":"id","topic":"topic"}}`))
+					req.Header.Set("Authorization", "Bearer secret")
+					r = reqtest.Record(t, h, req)
+					r.AssertStatusCode(http.StatusBadRequest)
+					r.AssertBodyContains("metadata")
+					req = httptest.NewRequest(http.MethodPost, "/admin/restore", bytes.NewBufferString(`{"metadata":{"version":2}}`))
+					req.Header.Set("Authorization", "Bearer secret")
+					r = reqtest.Record(t, h, req)
+					r.AssertStatusCode(http.StatusBadRequest)
+					r.AssertBodyContains("unsupported snapshot version")
+					req = httptest.NewRequest(http.MethodGet, "/admin/backup", nil)
+					r = reqtest.Record(t, h, req)
+					r.AssertStatusCode(http.StatusUnauthorized)
 				})
+
+				t.Run("settings", func(t *testing.T) {
+					t.Parallel()
+					var g stub.Engine
+					g.Script("GetTopic", stub.Response{Value: &ratus.Topic{Name: "topic", Retention: "1h", Config: &ratus.TopicConfig{Concurrency: 2, Timeout: "1m"}}})
+					h := reqtest.NewHandler(&controller.V1{
+						AdminAuth: middleware.Admin(&config.AdminConfig{Token: "secret"}),
+						Admin:     controller.NewAdminController(&g),
+					})
+					req := httptest.NewRequest(http.MethodGet, "/admin/backup", nil)
+					req.Header.Set("Authorization", "Bearer secret")
+					r := reqtest.Record(t, h, req)
+					r.AssertStatusCode(http.StatusOK)
+					r.AssertBodyContains(`{"topic":{"name":"topic","retention":"1h","config":{"concurrency":2,"timeout":"1m"}}}`)
+
+					// Settings of topics should be restored along with the tasks.
+					req = httptest.NewRequest(http.MethodPost, "/admin/restore", bytes.NewReader(r.Body))
+					req.Header.Set("Authorization", "Bearer secret")
+					r = reqtest.Record(t, h, req)
+					r.AssertStatusCode(http.StatusCreated)
+					cs := g.Calls("UpsertTopic")
+					if len(cs) != 1 {
+						t.Fatalf("incorrect number of upserted topics, expected 1, got %d", len(cs))
+					}
+					if u := cs[0].Args[0].(*ratus.Topic); u.Config == nil || u.Config.Concurrency != 2 || u.Config.Timeout != "1m" {
+						t.Errorf("incorrect restored topic config, got %+v", u.Config)
+					}
+				})
+
+				t.Run("hints", func(t *testing.T) {
+					t.Parallel()
+					var g stub.Engine
+					g.Script("GetTopicSettings", stub.Response{Value: &ratus.Topic{Name: "topic", Config: &ratus.TopicConfig{Concurrency: 2, Timeout: "1m"}}})
+					h := reqtest.NewHandler(&controller.V1{
+						Topic: controller.NewTopicController(&g, &config.DeleteConfig{}),
+					})
+					req := httptest.NewRequest(http.MethodGet, "/topics/topic/config", nil)
+					r := reqtest.Record(t, h, req)
+					r.AssertStatusCode(http.StatusOK)
+					r.AssertBodyContains(`{"concurrency":2,"timeout":"1m"}`)
+
+					// Hints should not count the tasks of the topic.
+					if cs := g.Calls("GetTopic"); len(cs) != 0 {
+						t.Errorf("incorrect number of topic reads, expected 0, got %d", len(cs))
+					}
+				})
+
+				t.Run("quotas", func(t *testing.T) {
+					t.Parallel()
+					quota := func(method, target string, q *ratus.Quota) *reqtest.ResponseRecord {
+						req := reqtest.NewRequestJSON(method, target, q)
+						req.Header.Set("Authorization", "Bearer secret")
+						return reqtest.Record(t, h, req)
+					}
+					insert := func(producer string) *reqtest.ResponseRecord {
+						req := reqtest.NewRequestJSON(http.MethodPost, "/topics/topic/tasks/id", &ratus.Task{Producer: producer})
+						return reqtest.Record(t, h, req)
+					}
+
+					// Quotas should be created, updated and listed.
+					r := quota(http.MethodPut, "/admin/quotas/rate", &ratus.Quota{Rate: 10})
+					r.AssertStatusCode(http.StatusCreated)
+					r = quota(http.MethodPut, "/admin/quotas/rate", &ratus.Quota{Rate: 1})
+					r.AssertStatusCode(http.StatusOK)
+					r = quota(http.MethodPut, "/admin/quotas/pending", &ratus.Quota{Pending: 1})
+					r.AssertStatusCode(http.StatusCreated)
+					r = quota(http.MethodGet, "/admin/quotas", nil)
+					r.AssertStatusCode(http.StatusOK)
+					r.AssertBodyContains(`{"data":[{"producer":"pending","pending":1},{"producer":"rate","rate":1}]}`)
+
+					// Producers should be rejected once they reach their quotas.
+					insert("rate").AssertStatusCode(http.StatusCreated)
+					r = insert("rate")
+					r.AssertStatusCode(http.StatusTooManyRequests)
+					r.AssertBodyContains("quota of 1 tasks per minute")
+					r = insert("pending")
+					r.AssertStatusCode(http.StatusTooManyRequests)
+					r.AssertBodyContains("quota of 1 pending tasks")
+
+					// Deleting quotas should restore the default quota.
+					r = quota(http.MethodDelete, "/admin/quotas/pending", nil)
+					r.AssertStatusCode(http.StatusOK)
+					r.AssertBodyContains(`"deleted":1`)
+					insert("pending").AssertStatusCode(http.StatusCreated)
+				})
+			})
+		})
+
+		t.Run("unconfirmed", func(t *testing.T) {
+			t.Parallel()
+			o := config.PaginationConfig{MaxLimit: 10, MaxOffset: 10}
+			g := stub.Engine{Err: nil}
+			h := reqtest.NewHandler(&controller.V1{
+				Pagination: middleware.Pagination(&o),
+				Topic:      controller.NewTopicController(&g, &config.DeleteConfig{Unconfirmed: true}),
+				Task:       controller.NewTaskController(&g, &config.TokenConfig{}),
+				Promise:    controller.NewPromiseController(&g, &config.TokenConfig{}),
+				Health:     controller.NewHealthController(&g),
+				Metrics:    controller.NewMetricsController(&g),
+			})
+			req := httptest.NewRequest(http.MethodDelete, "/topics", nil)
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusOK)
+			req = httptest.NewRequest(http.MethodDelete, "/topics/topic", nil)
+			r = reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusOK)
+		})
+
+		t.Run("token", func(t *testing.T) {
+			t.Parallel()
+			o := config.PaginationConfig{MaxLimit: 10, MaxOffset: 10}
+			g := stub.Engine{Err: nil}
+			h := reqtest.NewHandler(&controller.V1{
+				Pagination: middleware.Pagination(&o),
+				Topic:      controller.NewTopicController(&g, &config.DeleteConfig{}),
+				Task:       controller.NewTaskController(&g, &config.TokenConfig{Key: "secret"}),
+				Promise:    controller.NewPromiseController(&g, &config.TokenConfig{Key: "secret"}),
+				Health:     controller.NewHealthController(&g),
+				Metrics:    controller.NewMetricsController(&g),
+			})
+
+			// Tokens should be issued when claiming tasks.
+			var v ratus.Task
+			req := reqtest.NewRequestJSON(http.MethodPost, "/topics/topic/promises", &ratus.Promise{})
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusOK)
+			if err := json.Unmarshal(r.Body, &v); err != nil {
+				t.Fatal(err)
+			}
+			k, err := ratus.VerifyToken([]byte("secret"), v.Token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if k.ID != v.ID || k.Nonce != v.Nonce {
+				t.Errorf("incorrect claims, expected %q and %q, got %+v", v.ID, v.Nonce, k)
+			}
+
+			// Commits with valid tokens should be accepted.
+			req = reqtest.NewRequestJSON(http.MethodPatch, "/topics/topic/tasks/id", &ratus.Commit{Token: v.Token})
+			r = reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusOK)
+
+			// Commits with invalid tokens should be rejected.
+			for _, m := range []*ratus.Commit{
+				{Token: v.Token + "x"},
+				{Token: (&ratus.Token{ID: "id", Nonce: v.Nonce}).Sign([]byte("other"))},
+				{Token: (&ratus.Token{ID: "other", Nonce: v.Nonce}).Sign([]byte("secret"))},
+				{Token: v.Token, Nonce: "other"},
+			} {
+				req = reqtest.NewRequestJSON(http.MethodPatch, "/topics/topic/tasks/id", m)
+				r = reqtest.Record(t, h, req)
+				r.AssertStatusCode(http.StatusBadRequest)
+			}
+		})
+
+		t.Run("nonce", func(t *testing.T) {
+			t.Parallel()
+			o := config.PaginationConfig{MaxLimit: 10, MaxOffset: 10}
+			g := stub.Engine{Err: nil}
+			watch, err := middleware.Watch(&config.WatchConfig{Timeout: 50 * time.Millisecond, CheckInterval: 10 * time.Millisecond})
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := reqtest.NewHandler(&controller.V1{
+				Pagination: middleware.Pagination(&o),
+				Watch:      watch,
+				Topic:      controller.NewTopicController(&g, &config.DeleteConfig{}),
+				Task:       controller.NewTaskController(&g, &config.TokenConfig{NonceKey: "secret"}),
+				Promise:    controller.NewPromiseController(&g, &config.TokenConfig{NonceKey: "secret"}),
+				Health:     controller.NewHealthController(&g),
+				Metrics:    controller.NewMetricsController(&g),
+			})
+
+			// Nonces should be bound to the claimed tasks.
+			var v ratus.Task
+			req := reqtest.NewRequestJSON(http.MethodPost, "/topics/topic/promises", &ratus.Promise{})
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusOK)
+			if err := json.Unmarshal(r.Body, &v); err != nil {
+				t.Fatal(err)
+			}
+			n, err := nonce.Unbind([]byte("secret"), v.Nonce, v.ID, v.Consumer)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Commits with bound nonces should be accepted.
+			req = reqtest.NewRequestJSON(http.MethodPatch, "/topics/topic/tasks/id", &ratus.Commit{Nonce: v.Nonce})
+			r = reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusOK)
+
+			// Commits with nonces bound to other tasks should be rejected.
+			for _, m := range []*ratus.Commit{
+				{Nonce: n},
+				{Nonce: nonce.Bind([]byte("secret"), n, "other", v.Consumer)},
+				{Nonce: nonce.Bind([]byte("other"), n, v.ID, v.Consumer)},
+			} {
+				req = reqtest.NewRequestJSON(http.MethodPatch, "/topics/topic/tasks/id", m)
+				r = reqtest.Record(t, h, req)
+				r.AssertStatusCode(http.StatusConflict)
+			}
+
+			// Progress reports should accept bound nonces as well.
+			req = reqtest.NewRequestJSON(http.MethodPatch, "/topics/topic/tasks/id/progress", &ratus.Progress{Nonce: v.Nonce, Percent: 50})
+			r = reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusOK)
+			req = reqtest.NewRequestJSON(http.MethodPatch, "/topics/topic/tasks/id/progress", &ratus.Progress{Nonce: n, Percent: 50})
+			r = reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusConflict)
+
+			// Nonces should be removed from tasks returned by reads and
+			// commits, so that only the consumers claiming the tasks can
+			// obtain nonces to commit with.
+			for _, req := range []*http.Request{
+				httptest.NewRequest(http.MethodGet, "/topics/topic/tasks/id", nil),
+				httptest.NewRequest(http.MethodGet, "/topics/topic/tasks/id/watch?version=0", nil),
+				reqtest.NewRequestJSON(http.MethodPatch, "/topics/topic/tasks/id", &ratus.Commit{}),
+			} {
+				var u ratus.Task
+				r = reqtest.Record(t, h, req)
+				r.AssertStatusCode(http.StatusOK)
+				if err := json.Unmarshal(r.Body, &u); err != nil {
+					t.Fatal(err)
+				}
+				if u.Nonce != "" {
+					t.Errorf("expected nonce to be removed from %s %s, got %q", req.Method, req.URL, u.Nonce)
+				}
+			}
+			for _, req := range []*http.Request{
+				httptest.NewRequest(http.MethodGet, "/topics/topic/tasks", nil),
+				reqtest.NewRequestJSON(http.MethodPost, "/tasks:batchGet", &ratus.BatchGet{IDs: []string{"id"}}),
+			} {
+				var u ratus.Tasks
+				r = reqtest.Record(t, h, req)
+				r.AssertStatusCode(http.StatusOK)
+				if err := json.Unmarshal(r.Body, &u); err != nil {
+					t.Fatal(err)
+				}
+				for _, x := range u.Data {
+					if x.Nonce != "" {
+						t.Errorf("expected nonce to be removed from %s %s, got %q", req.Method, req.URL, x.Nonce)
+					}
+				}
+			}
+		})
+
+		t.Run("strict", func(t *testing.T) {
+			t.Parallel()
+			g := stub.Engine{Err: nil}
+			h := reqtest.NewHandler(&controller.V1{
+				Pagination: middleware.Pagination(&config.PaginationConfig{MaxLimit: 10, MaxOffset: 10}),
+				Task:       controller.NewTaskController(&g, &config.TokenConfig{StrictConsumer: true}),
+			})
+
+			// Commits with nonces should specify their consumers.
+			req := reqtest.NewRequestJSON(http.MethodPatch, "/topics/topic/tasks/id", &ratus.Commit{Nonce: "nonce"})
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusBadRequest)
+			r.AssertBodyContains("consumer must be specified")
+
+			// Commits with consumers or without nonces should be accepted.
+			for _, m := range []*ratus.Commit{
+				{Nonce: "nonce", Consumer: "consumer"},
+				{},
+			} {
+				req = reqtest.NewRequestJSON(http.MethodPatch, "/topics/topic/tasks/id", m)
+				r = reqtest.Record(t, h, req)
+				r.AssertStatusCode(http.StatusOK)
+			}
+		})
+
+		t.Run("bridge", func(t *testing.T) {
+			t.Parallel()
+			g := stub.Engine{Err: nil}
+			var ts []*ratus.Task
+			c := controller.NewTaskController(&g, &config.TokenConfig{})
+			c.Bridge = func(t *ratus.Task) {
+				ts = append(ts, t)
+			}
+			h := reqtest.NewHandler(&controller.V1{
+				Pagination: middleware.Pagination(&config.PaginationConfig{MaxLimit: 10, MaxOffset: 10}),
+				Task:       c,
 			})
+
+			// Committed tasks should be handed over to the bridge.
+			req := reqtest.NewRequestJSON(http.MethodPatch, "/topics/topic/tasks/id", &ratus.Commit{})
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusOK)
+			if len(ts) != 1 || ts[0].ID != "id" || ts[0].State != ratus.TaskStateCompleted {
+				t.Errorf("incorrect bridged tasks, expected the committed task, got %v", ts)
+			}
+		})
+
+		t.Run("empty", func(t *testing.T) {
+			t.Parallel()
+			g := stub.Engine{Err: nil}
+			s := time.Now().Add(90 * time.Second)
+			g.Script("Poll", stub.Response{Err: ratus.ErrNotFound}, stub.Response{Err: ratus.ErrNotFound})
+			g.Script("NextScheduled", stub.Response{Value: &s}, stub.Response{Err: ratus.ErrNotFound})
+			h := reqtest.NewHandler(&controller.V1{
+				Pagination: middleware.Pagination(&config.PaginationConfig{MaxLimit: 10, MaxOffset: 10}),
+				Promise:    controller.NewPromiseController(&g, &config.TokenConfig{}),
+			})
+
+			// Polls should be advised to retry once the next task is scheduled.
+			req := reqtest.NewRequestJSON(http.MethodPost, "/topics/topic/promises", &ratus.Promise{})
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusNotFound)
+			r.AssertHeaderContains("Retry-After", "90")
+			r.AssertBodyContains(`"scheduled":`)
+
+			// The header should be omitted if no task is scheduled.
+			req = reqtest.NewRequestJSON(http.MethodPost, "/topics/topic/promises", &ratus.Promise{})
+			r = reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusNotFound)
+			r.AssertBodyNotContains(`"scheduled":`)
+			if v := r.Header.Get("Retry-After"); v != "" {
+				t.Errorf("unexpected Retry-After header %q", v)
+			}
+		})
+
+		t.Run("handoff", func(t *testing.T) {
+			t.Parallel()
+			g := stub.Engine{Err: nil}
+			g.Script("Poll", stub.Response{Err: ratus.ErrNotFound})
+			h := reqtest.NewHandler(&controller.V1{
+				Pagination: middleware.Pagination(&config.PaginationConfig{MaxLimit: 10, MaxOffset: 10}),
+				Task:       controller.NewTaskController(&g, &config.TokenConfig{}),
+			})
+
+			// The commit should succeed even if no next task is available.
+			req := reqtest.NewRequestJSON(http.MethodPatch, "/topics/topic/tasks/id?next=true", &ratus.Commit{})
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusOK)
+			r.AssertBodyContains(`"committed":{`)
+			r.AssertBodyNotContains(`"next":`)
+
+			// The topic must be specified to claim the next task.
+			req = reqtest.NewRequestJSON(http.MethodPatch, "/topics//tasks/id?next=true", &ratus.Commit{})
+			r = reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusBadRequest)
 		})
 
 		t.Run("conflict", func(t *testing.T) {
 			t.Parallel()
 			o := config.PaginationConfig{MaxLimit: 10, MaxOffset: 10}
-			g := stub.Engine{Err: ratus.ErrConflict}
+			g := settingless{stub.Engine{Err: ratus.ErrConflict}}
 			h := reqtest.NewHandler(&controller.V1{
 				Pagination: middleware.Pagination(&o),
-				Topic:      controller.NewTopicController(&g),
-				Task:       controller.NewTaskController(&g),
-				Promise:    controller.NewPromiseController(&g),
+				Topic:      controller.NewTopicController(&g, &config.DeleteConfig{}),
+				Task:       controller.NewTaskController(&g, &config.TokenConfig{}),
+				Promise:    controller.NewPromiseController(&g, &config.TokenConfig{}),
 				Health:     controller.NewHealthController(&g),
 				Metrics:    controller.NewMetricsController(&g),
 			})
@@ -343,6 +1031,16 @@ func TestController(t *testing.T) {
 					r.AssertHeaderContains("Content-Type", "application/json")
 					r.AssertBodyContains("the target task is not in pending state")
 				})
+
+				t.Run("steal", func(t *testing.T) {
+					t.Parallel()
+					var v ratus.Promise
+					req := reqtest.NewRequestJSON(http.MethodPost, "/topics/topic/promises/id:steal", &v)
+					r := reqtest.Record(t, h, req)
+					r.AssertStatusCode(http.StatusConflict)
+					r.AssertHeaderContains("Content-Type", "application/json")
+					r.AssertBodyContains("the target task is not in active state")
+				})
 			})
 		})
 
@@ -352,9 +1050,9 @@ func TestController(t *testing.T) {
 			g := stub.Engine{Err: ratus.ErrServiceUnavailable}
 			h := reqtest.NewHandler(&controller.V1{
 				Pagination: middleware.Pagination(&o),
-				Topic:      controller.NewTopicController(&g),
-				Task:       controller.NewTaskController(&g),
-				Promise:    controller.NewPromiseController(&g),
+				Topic:      controller.NewTopicController(&g, &config.DeleteConfig{}),
+				Task:       controller.NewTaskController(&g, &config.TokenConfig{}),
+				Promise:    controller.NewPromiseController(&g, &config.TokenConfig{}),
 				Health:     controller.NewHealthController(&g),
 				Metrics:    controller.NewMetricsController(&g),
 			})
@@ -373,4 +1071,144 @@ func TestController(t *testing.T) {
 			})
 		})
 	})
+
+	t.Run("v2", func(t *testing.T) {
+		t.Parallel()
+		o := config.PaginationConfig{MaxLimit: 10, MaxOffset: 10}
+		g := stub.Engine{Err: nil}
+		h := reqtest.NewHandler(&controller.V2{V1: controller.V1{
+			Pagination: middleware.Cursor(&o),
+			Topic:      controller.NewTopicController(&g, &config.DeleteConfig{}),
+			Task:       controller.NewTaskController(&g, &config.TokenConfig{}),
+			Promise:    controller.NewPromiseController(&g, &config.TokenConfig{}),
+			Health:     controller.NewHealthController(&g),
+			Metrics:    controller.NewMetricsController(&g),
+		}})
+
+		t.Run("topics", func(t *testing.T) {
+			t.Parallel()
+			req := httptest.NewRequest(http.MethodGet, "/v2/topics?limit=5", nil)
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusOK)
+			r.AssertBodyContains(`{"name":"topic"}`)
+			r.AssertBodyNotContains(`"next":`)
+		})
+
+		t.Run("count", func(t *testing.T) {
+			t.Parallel()
+			req := httptest.NewRequest(http.MethodGet, "/v2/topics/topic/tasks?count=true&labels=k=v", nil)
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusOK)
+			r.AssertHeaderContains("X-Total-Count", "1")
+			req = httptest.NewRequest(http.MethodGet, "/v2/topics/topic/tasks", nil)
+			if r = reqtest.Record(t, h, req); r.Header.Get("X-Total-Count") != "" {
+				t.Error("expected no total count unless requested")
+			}
+		})
+
+		t.Run("tasks", func(t *testing.T) {
+			t.Parallel()
+			req := httptest.NewRequest(http.MethodGet, "/v2/topics/topic/tasks?cursor="+middleware.EncodeCursor("", "a", nil), nil)
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusOK)
+			r.AssertBodyContains(`"_id":"id"`)
+			r.AssertBodyNotContains(`"next":`)
+		})
+
+		t.Run("promises", func(t *testing.T) {
+			t.Parallel()
+			req := httptest.NewRequest(http.MethodGet, "/v2/topics/topic/promises?cursor=invalid", nil)
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusBadRequest)
+			r.AssertBodyContains("invalid cursor")
+		})
+
+		t.Run("sort", func(t *testing.T) {
+			t.Parallel()
+			req := httptest.NewRequest(http.MethodGet, "/v2/topics/topic/tasks?sort=-produced", nil)
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusOK)
+			req = httptest.NewRequest(http.MethodGet, "/v2/topics?sort=produced", nil)
+			r = reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusBadRequest)
+			r.AssertBodyContains("invalid sort order")
+		})
+
+		t.Run("v1", func(t *testing.T) {
+			t.Parallel()
+			req := httptest.NewRequest(http.MethodGet, "/v1/topics", nil)
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusNotFound)
+		})
+	})
+}
+
+func TestSpec(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+
+	// Mount all endpoints, including the ones that are optional.
+	g := stub.Engine{}
+	watch, err := middleware.Watch(&config.WatchConfig{Timeout: time.Second, CheckInterval: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := router.New(nil, &controller.V1{
+		Pagination: middleware.Pagination(&config.PaginationConfig{}),
+		Watch:      watch,
+		AdminAuth:  middleware.Admin(&config.AdminConfig{Token: "secret"}),
+		Topic:      controller.NewTopicController(&g, &config.DeleteConfig{}),
+		Task:       controller.NewTaskController(&g, &config.TokenConfig{}),
+		Promise:    controller.NewPromiseController(&g, &config.TokenConfig{}),
+		Consumer:   controller.NewConsumerController(&g, &config.ConsumerConfig{}),
+		Quota:      controller.NewQuotaController(&g, &config.QuotaConfig{}),
+		Health:     controller.NewHealthController(&g),
+		Metrics:    controller.NewMetricsController(&g),
+		Admin:      controller.NewAdminController(&g),
+	})
+
+	// Normalize path parameters to the form used by the specifications, and
+	// custom methods to wildcards since they are captured by parameters.
+	// Custom methods on individual resources are captured along with their
+	// IDs, so they are documented on the paths of the resources.
+	param := regexp.MustCompile(`/:(\w+)`)
+	method := regexp.MustCompile(`(\w):[\w{}]+$`)
+	suffix := regexp.MustCompile(`(\{\w+\}):\w+$`)
+	routes := make(map[string]bool)
+	for _, v := range r.Routes() {
+		if p, ok := strings.CutPrefix(v.Path, "/v1"); ok {
+			p = method.ReplaceAllString(param.ReplaceAllString(p, "/{$1}"), "$1:*")
+			routes[v.Method+" "+p] = true
+		}
+	}
+
+	// Endpoints kept for compatibility that are not documented.
+	delete(routes, "GET /healthz")
+
+	for _, name := range []string{"swagger.json", "openapi.json", "openapi-3.1.json"} {
+		b, err := os.ReadFile(filepath.Join("..", "..", "docs", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var s struct {
+			Paths map[string]map[string]any `json:"paths"`
+		}
+		if err := json.Unmarshal(b, &s); err != nil {
+			t.Fatal(err)
+		}
+		documented := make(map[string]bool)
+		for p, ops := range s.Paths {
+			for m := range ops {
+				k := strings.ToUpper(m) + " " + method.ReplaceAllString(suffix.ReplaceAllString(p, "$1"), "$1:*")
+				documented[k] = true
+				if !routes[k] {
+					t.Errorf("%s documents %s which is not mounted", name, k)
+				}
+			}
+		}
+		for k := range routes {
+			if !documented[k] {
+				t.Errorf("%s does not document %s", name, k)
+			}
+		}
+	}
 }
@@ -5,17 +5,21 @@ import (
 
 	"github.com/gin-gonic/gin"
 
+	"github.com/hyperonym/ratus"
 	"github.com/hyperonym/ratus/internal/engine"
 )
 
 // HealthController implements handlers for health-related endpoints.
 type HealthController struct {
 	Engine engine.Engine
+
+	// Version and configuration of the instance.
+	Build *ratus.Build
 }
 
 // NewHealthController creates a new HealthController.
 func NewHealthController(g engine.Engine) *HealthController {
-	return &HealthController{g}
+	return &HealthController{Engine: g}
 }
 
 // GetLiveness checks the liveness of the instance.
@@ -40,3 +44,33 @@ func (r *HealthController) GetReadiness(c *gin.Context) {
 	}
 	c.Status(http.StatusOK)
 }
+
+// GetCapabilities gets the optional features supported by the storage engine.
+// @summary  Get the optional features supported by the storage engine
+// @router   /capabilities [get]
+// @tags     health
+// @produce  application/json
+// @success  200 {object} ratus.Capabilities
+func (r *HealthController) GetCapabilities(c *gin.Context) {
+	c.JSON(http.StatusOK, &ratus.Capabilities{
+		TTL:           engine.Supports(r.Engine, engine.CapabilityTTL),
+		Transactions:  engine.Supports(r.Engine, engine.CapabilityTransactions),
+		ChangeStreams: engine.Supports(r.Engine, engine.CapabilityChangeStreams),
+		FilteredList:  engine.Supports(r.Engine, engine.CapabilityFilteredList),
+		Priorities:    engine.Supports(r.Engine, engine.CapabilityPriorities),
+	})
+}
+
+// GetVersion gets the version and configuration of the instance.
+// @summary  Get the version and configuration of the instance
+// @router   /version [get]
+// @tags     health
+// @produce  application/json
+// @success  200 {object} ratus.Build
+func (r *HealthController) GetVersion(c *gin.Context) {
+	v := r.Build
+	if v == nil {
+		v = &ratus.Build{}
+	}
+	c.JSON(http.StatusOK, v)
+}
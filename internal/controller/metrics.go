@@ -8,19 +8,26 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"github.com/hyperonym/ratus/internal/engine"
+	"github.com/hyperonym/ratus/internal/metrics"
 )
 
 // MetricsController implements handlers for metrics-related endpoints.
 type MetricsController struct {
+	Engine  engine.Engine
 	handler http.Handler
 }
 
-// NewMetricsController creates a new MetricsController.
+// NewMetricsController creates a new MetricsController. Statistics of the
+// storage engine are gathered along with the default metrics, and metrics
+// that are gathered successfully are still served if retrieving the
+// statistics fails.
 func NewMetricsController(g engine.Engine) *MetricsController {
-	o := promhttp.HandlerOpts{DisableCompression: true}
-	h := promhttp.HandlerFor(prometheus.DefaultGatherer, o)
+	s := prometheus.NewRegistry()
+	s.MustRegister(metrics.NewStatsCollector(g.Stats))
+	o := promhttp.HandlerOpts{DisableCompression: true, ErrorHandling: promhttp.ContinueOnError}
+	h := promhttp.HandlerFor(prometheus.Gatherers{prometheus.DefaultGatherer, s}, o)
 	h = promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer, h)
-	return &MetricsController{h}
+	return &MetricsController{g, h}
 }
 
 // GetMetrics gets Prometheus metrics of the instance.
@@ -32,3 +39,15 @@ func NewMetricsController(g engine.Engine) *MetricsController {
 func (r *MetricsController) GetMetrics(c *gin.Context) {
 	r.handler.ServeHTTP(c.Writer, c.Request)
 }
+
+// GetStats gets statistics of tasks across all topics.
+// @summary  Get statistics of tasks across all topics
+// @router   /stats [get]
+// @tags     metrics
+// @produce  application/json
+// @success  200 {object} ratus.Stats
+// @failure  500 {object} ratus.Error
+func (r *MetricsController) GetStats(c *gin.Context) {
+	v, err := r.Engine.Stats(c.Request.Context())
+	send(c, v, err)
+}
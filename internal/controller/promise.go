@@ -1,11 +1,16 @@
 package controller
 
 import (
+	"errors"
 	"fmt"
+	"math"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
 	"github.com/hyperonym/ratus"
+	"github.com/hyperonym/ratus/internal/config"
 	"github.com/hyperonym/ratus/internal/engine"
 	"github.com/hyperonym/ratus/internal/metrics"
 	"github.com/hyperonym/ratus/internal/middleware"
@@ -14,11 +19,18 @@ import (
 // PromiseController implements handlers for promise-related endpoints.
 type PromiseController struct {
 	Engine engine.Engine
+
+	// Key for signing commit tokens, no token is issued if empty.
+	key []byte
+
+	// Key for binding nonces to tasks and consumers, nonces are returned as
+	// is if empty.
+	nonceKey []byte
 }
 
 // NewPromiseController creates a new PromiseController.
-func NewPromiseController(g engine.Engine) *PromiseController {
-	return &PromiseController{g}
+func NewPromiseController(g engine.Engine, tc *config.TokenConfig) *PromiseController {
+	return &PromiseController{g, []byte(tc.Key), []byte(tc.NonceKey)}
 }
 
 // GetPromises lists all promises in a topic.
@@ -28,13 +40,22 @@ func NewPromiseController(g engine.Engine) *PromiseController {
 // @param    topic path string true "Name of the topic"
 // @param    limit query int false "Maximum number of resources to return"
 // @param    offset query int false "Number of resources to skip"
+// @param    cursor query string false "Opaque cursor of the page to return, only supported by API version 2"
+// @param    count query bool false "Whether to return the total number of resources in the X-Total-Count header"
 // @produce  application/json
 // @success  200 {object} ratus.Promises
+// @header   200 {integer} X-Total-Count "Total number of resources regardless of pagination, if requested and supported by the storage engine"
 // @failure  400 {object} ratus.Error
 // @failure  500 {object} ratus.Error
 func (r *PromiseController) GetPromises(c *gin.Context) {
-	v, err := r.Engine.ListPromises(c.Request.Context(), c.Param(middleware.ParamTopic), c.GetInt(middleware.ParamLimit), c.GetInt(middleware.ParamOffset))
-	send(c, &ratus.Promises{Data: v}, err)
+	ctx := c.Request.Context()
+	topic := c.Param(middleware.ParamTopic)
+	v, err := r.Engine.ListPromises(ctx, topic, page(c))
+	if err == nil {
+		err = total(c, r.Engine, func(x engine.Counter) (int64, error) { return x.CountPromises(ctx, topic) })
+	}
+	v, n := next(c, v, func(p *ratus.Promise) (string, *time.Time) { return p.ID, nil })
+	send(c, &ratus.Promises{Data: v, Next: n}, err)
 }
 
 // PostPromises makes a promise to claim and execute the next available task in a topic.
@@ -42,12 +63,15 @@ func (r *PromiseController) GetPromises(c *gin.Context) {
 // @router   /topics/{topic}/promises [post]
 // @tags     promises
 // @param    topic path string true "Name of the topic"
+// @param    labels query string false "Label selector in the form of comma-separated key=value pairs"
 // @param    promise body ratus.Promise false "Wildcard promise object to be inserted"
 // @accept   application/json
 // @produce  application/json
 // @success  200 {object} ratus.Task
 // @failure  400 {object} ratus.Error
 // @failure  404 {object} ratus.Error
+// @header   404 {integer} Retry-After "Number of seconds until the next pending task in the topic is scheduled, if any"
+// @failure  429 {object} ratus.Error
 // @failure  500 {object} ratus.Error
 func (r *PromiseController) PostPromises(c *gin.Context) {
 	p := c.MustGet(middleware.ParamPromise).(*ratus.Promise)
@@ -55,9 +79,31 @@ func (r *PromiseController) PostPromises(c *gin.Context) {
 		r.PostPromise(c)
 		return
 	}
-	v, err := r.Engine.Poll(c.Request.Context(), c.Param(middleware.ParamTopic), p)
+	topic := c.Param(middleware.ParamTopic)
+	v, err := r.Engine.Poll(c.Request.Context(), topic, p)
+	if errors.Is(err, ratus.ErrNotFound) {
+		r.empty(c, topic, err)
+		return
+	}
+	v = sign(r.key, r.nonceKey, v)
 	send(c, v, err)
-	r.collectMetrics(v)
+	collectConsumed(v)
+}
+
+// empty responds to a poll that found no available task in the topic. If a
+// pending task is scheduled in the future, the time until then is advised in
+// the Retry-After header and the scheduled time is included in the error, so
+// that consumers can sleep until then. The time is only advisory, since the
+// task may not match the label selector of the poll, and tasks scheduled
+// earlier may be inserted in the meantime.
+func (r *PromiseController) empty(c *gin.Context, topic string, err error) {
+	e := ratus.NewError(err)
+	n := middleware.Now(c)
+	if s, err := r.Engine.NextScheduled(c.Request.Context(), topic); err == nil && s.After(n) {
+		c.Header(middleware.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(s.Sub(n).Seconds()))))
+		e.Error.Scheduled = s
+	}
+	c.AbortWithStatusJSON(e.Error.Code, e)
 }
 
 // DeletePromises deletes all promises in a topic.
@@ -103,13 +149,18 @@ func (r *PromiseController) GetPromise(c *gin.Context) {
 // @failure  409 {object} ratus.Error
 // @failure  500 {object} ratus.Error
 func (r *PromiseController) PostPromise(c *gin.Context) {
+	if c.Param(middleware.ParamAction) == ":steal" {
+		r.StealPromise(c)
+		return
+	}
 	p := c.MustGet(middleware.ParamPromise).(*ratus.Promise)
 	v, err := r.Engine.InsertPromise(c.Request.Context(), p)
+	v = sign(r.key, r.nonceKey, v)
 	if err == ratus.ErrConflict {
 		err = fmt.Errorf("%w: the target task is not in pending state", err)
 	}
 	send(c, v, err)
-	r.collectMetrics(v)
+	collectConsumed(v)
 }
 
 // PutPromise makes a promise to claim and execute a task regardless of its current state.
@@ -128,8 +179,37 @@ func (r *PromiseController) PostPromise(c *gin.Context) {
 func (r *PromiseController) PutPromise(c *gin.Context) {
 	p := c.MustGet(middleware.ParamPromise).(*ratus.Promise)
 	v, err := r.Engine.UpsertPromise(c.Request.Context(), p)
+	v = sign(r.key, r.nonceKey, v)
 	send(c, v, err)
-	r.collectMetrics(v)
+	collectConsumed(v)
+}
+
+// StealPromise transfers the promise of an active task to another consumer.
+// The task is claimed again with a new nonce and deadline, so that commits of
+// the previous consumer are rejected, which recovers tasks from hung consumers
+// without waiting for their promises to time out.
+// @summary  Transfer the promise of an active task to another consumer
+// @router   /topics/{topic}/promises/{id}:steal [post]
+// @tags     promises
+// @param    topic path string true "Name of the topic"
+// @param    id path string true "Unique ID of the target task"
+// @param    promise body ratus.Promise false "Promise object to replace the current one"
+// @accept   application/json
+// @produce  application/json
+// @success  200 {object} ratus.Task
+// @failure  400 {object} ratus.Error
+// @failure  404 {object} ratus.Error
+// @failure  409 {object} ratus.Error
+// @failure  500 {object} ratus.Error
+func (r *PromiseController) StealPromise(c *gin.Context) {
+	p := c.MustGet(middleware.ParamPromise).(*ratus.Promise)
+	v, err := r.Engine.StealPromise(c.Request.Context(), p)
+	v = sign(r.key, r.nonceKey, v)
+	if err == ratus.ErrConflict {
+		err = fmt.Errorf("%w: the target task is not in active state", err)
+	}
+	send(c, v, err)
+	collectConsumed(v)
 }
 
 // DeletePromise deletes a promise by the unique ID of its target task.
@@ -146,8 +226,21 @@ func (r *PromiseController) DeletePromise(c *gin.Context) {
 	send(c, v, err)
 }
 
-// collectMetrics collects metrics while consuming a task.
-func (r *PromiseController) collectMetrics(t *ratus.Task) {
+// sign returns a copy of the claimed task with a commit token if the key is
+// specified, and with its nonce bound to the task and the consumer if the
+// nonce key is specified. Tasks delivered at most once are not signed since
+// they can not be committed.
+func sign(key, nonceKey []byte, t *ratus.Task) *ratus.Task {
+	if t == nil || t.Nonce == "" || len(key) == 0 {
+		return bindNonce(nonceKey, t)
+	}
+	u := *t
+	u.Token = (&ratus.Token{Topic: t.Topic, ID: t.ID, Nonce: t.Nonce}).Sign(key)
+	return bindNonce(nonceKey, &u)
+}
+
+// collectConsumed collects metrics while consuming a task.
+func collectConsumed(t *ratus.Task) {
 
 	// Collect task schedule delay.
 	if t != nil && t.Scheduled != nil && t.Consumed != nil {
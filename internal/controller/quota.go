@@ -0,0 +1,241 @@
+package controller
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/hyperonym/ratus"
+	"github.com/hyperonym/ratus/internal/config"
+	"github.com/hyperonym/ratus/internal/engine"
+	"github.com/hyperonym/ratus/internal/middleware"
+)
+
+// QuotaController implements handlers for endpoints managing quotas of
+// producers, and enforces the quotas on endpoints for inserting tasks. Quotas
+// set through the admin endpoints replace the default quota of the producers,
+// and are kept in the memory of each instance along with the numbers of tasks
+// the producers have recently inserted. They are neither stored in the
+// storage engine nor shared with other instances, so changes only apply to
+// the instance handling the request until it restarts.
+type QuotaController struct {
+	Engine engine.Engine
+
+	fallback ratus.Quota
+	mux      sync.Mutex
+	quotas   map[string]*ratus.Quota
+	buckets  map[string]*bucket
+	pruned   time.Time
+}
+
+// NewQuotaController creates a new QuotaController.
+func NewQuotaController(g engine.Engine, qc *config.QuotaConfig) *QuotaController {
+	return &QuotaController{
+		Engine:   g,
+		fallback: ratus.Quota{Rate: qc.Rate, Pending: qc.Pending},
+		quotas:   make(map[string]*ratus.Quota),
+		buckets:  make(map[string]*bucket),
+		pruned:   time.Now(),
+	}
+}
+
+// GetQuotas lists quotas of producers set through the admin endpoints of this
+// instance.
+// @summary   List quotas of producers
+// @router    /admin/quotas [get]
+// @tags      admin
+// @security  BearerAuth
+// @produce   application/json
+// @success   200 {object} ratus.Quotas
+// @failure   401 {object} ratus.Error
+func (r *QuotaController) GetQuotas(c *gin.Context) {
+	r.mux.Lock()
+	v := make([]*ratus.Quota, 0, len(r.quotas))
+	for _, x := range r.quotas {
+		q := *x
+		v = append(v, &q)
+	}
+	r.mux.Unlock()
+	slices.SortFunc(v, func(a, b *ratus.Quota) int {
+		return strings.Compare(a.Producer, b.Producer)
+	})
+	send(c, &ratus.Quotas{Data: v}, nil)
+}
+
+// PutQuota sets the quota of a producer on this instance only.
+// @summary   Set the quota of a producer
+// @router    /admin/quotas/{producer} [put]
+// @tags      admin
+// @security  BearerAuth
+// @param     producer path string true "Name of the producer"
+// @param     quota body ratus.Quota true "Quota object to be set"
+// @accept    application/json
+// @produce   application/json
+// @success   200 {object} ratus.Updated
+// @success   201 {object} ratus.Updated
+// @failure   400 {object} ratus.Error
+// @failure   401 {object} ratus.Error
+func (r *QuotaController) PutQuota(c *gin.Context) {
+	q := c.MustGet(middleware.ParamQuota).(*ratus.Quota)
+	r.mux.Lock()
+	_, ok := r.quotas[q.Producer]
+	r.quotas[q.Producer] = q
+	delete(r.buckets, q.Producer)
+	r.mux.Unlock()
+	if ok {
+		send(c, &ratus.Updated{Updated: 1}, nil)
+		return
+	}
+	send(c, &ratus.Updated{Created: 1}, nil)
+}
+
+// DeleteQuota deletes the quota of a producer on this instance only, which
+// restores the default quota of the producer.
+// @summary   Delete the quota of a producer
+// @router    /admin/quotas/{producer} [delete]
+// @tags      admin
+// @security  BearerAuth
+// @param     producer path string true "Name of the producer"
+// @produce   application/json
+// @success   200 {object} ratus.Deleted
+// @failure   401 {object} ratus.Error
+func (r *QuotaController) DeleteQuota(c *gin.Context) {
+	p := c.Param(middleware.ParamProducer)
+	r.mux.Lock()
+	_, ok := r.quotas[p]
+	delete(r.quotas, p)
+	delete(r.buckets, p)
+	r.mux.Unlock()
+	if ok {
+		send(c, &ratus.Deleted{Deleted: 1}, nil)
+		return
+	}
+	send(c, &ratus.Deleted{}, nil)
+}
+
+// Limit rejects requests with ErrTooManyRequests if the producers of tasks
+// bound to the requests have reached their quotas, which is used as a
+// middleware on endpoints for inserting tasks.
+func (r *QuotaController) Limit(c *gin.Context) {
+	var ts []*ratus.Task
+	if v, ok := c.Get(middleware.ParamTasks); ok {
+		ts = v.(*ratus.Tasks).Data
+	} else {
+		ts = []*ratus.Task{c.MustGet(middleware.ParamTask).(*ratus.Task)}
+	}
+
+	// Group the tasks by topics and producers in the order they appear, tasks
+	// in batches may belong to different producers.
+	type key struct {
+		topic    string
+		producer string
+	}
+	var ks []key
+	m := make(map[key]int)
+	for _, t := range ts {
+		k := key{t.Topic, t.Producer}
+		if m[k] == 0 {
+			ks = append(ks, k)
+		}
+		m[k]++
+	}
+
+	// Pending tasks are counted before inserting rather than atomically, so
+	// the limit may be exceeded slightly by concurrent requests.
+	var ps []string
+	ns := make(map[string]int)
+	for _, k := range ks {
+		if ns[k.producer] == 0 {
+			ps = append(ps, k.producer)
+		}
+		ns[k.producer] += m[k]
+		q := r.quota(k.producer)
+		if q.Pending <= 0 {
+			continue
+		}
+		n, err := r.Engine.CountPending(c.Request.Context(), k.topic, k.producer, q.Pending)
+		if err == nil && n+int64(m[k]) > q.Pending {
+			err = fmt.Errorf("%w: producer %q has reached its quota of %d pending tasks in topic %q", ratus.ErrTooManyRequests, k.producer, q.Pending, k.topic)
+		}
+		if err != nil {
+			send(c, nil, err)
+			return
+		}
+	}
+
+	// Tasks are only taken from the buckets of the producers if all of them
+	// are within their rate limits.
+	if err := r.take(ps, ns, middleware.Now(c)); err != nil {
+		send(c, nil, err)
+	}
+}
+
+// quota returns the quota of a producer, which falls back to the default
+// quota if it is not set.
+func (r *QuotaController) quota(producer string) ratus.Quota {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if q, ok := r.quotas[producer]; ok {
+		return *q
+	}
+	return r.fallback
+}
+
+// take removes the numbers of tasks to be inserted from the buckets of the
+// producers, or returns an error without removing any of them if a producer
+// has exceeded its rate limit. Buckets that have been refilled are forgotten
+// from time to time.
+func (r *QuotaController) take(ps []string, ns map[string]int, now time.Time) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	bs := make(map[string]*bucket, len(ps))
+	for _, p := range ps {
+		q := r.fallback
+		if x, ok := r.quotas[p]; ok {
+			q = *x
+		}
+		if q.Rate <= 0 {
+			continue
+		}
+		b, ok := r.buckets[p]
+		if !ok {
+			b = &bucket{tokens: float64(q.Rate), last: now}
+			r.buckets[p] = b
+		}
+		if b.refill(q.Rate, now) < float64(ns[p]) {
+			return fmt.Errorf("%w: producer %q has exceeded its quota of %d tasks per minute", ratus.ErrTooManyRequests, p, q.Rate)
+		}
+		bs[p] = b
+	}
+	for p, b := range bs {
+		b.tokens -= float64(ns[p])
+	}
+	if now.Sub(r.pruned) >= time.Minute {
+		for p, b := range r.buckets {
+			if now.Sub(b.last) >= time.Minute {
+				delete(r.buckets, p)
+			}
+		}
+		r.pruned = now
+	}
+	return nil
+}
+
+// bucket is a token bucket that holds at most the number of tasks a producer
+// can insert per minute, and is refilled continuously at the same rate.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens accumulated since the last refill to the bucket and
+// returns the number of tokens available.
+func (b *bucket) refill(rate int, now time.Time) float64 {
+	b.tokens = min(float64(rate), b.tokens+now.Sub(b.last).Minutes()*float64(rate))
+	b.last = now
+	return b.tokens
+}
@@ -1,25 +1,57 @@
 package controller
 
 import (
+	"cmp"
+	"context"
+	"errors"
 	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
 
 	"github.com/hyperonym/ratus"
+	"github.com/hyperonym/ratus/internal/config"
 	"github.com/hyperonym/ratus/internal/engine"
 	"github.com/hyperonym/ratus/internal/metrics"
 	"github.com/hyperonym/ratus/internal/middleware"
+	"github.com/hyperonym/ratus/internal/nonce"
 )
 
 // TaskController implements handlers for task-related endpoints.
 type TaskController struct {
 	Engine engine.Engine
+
+	// Function called with tasks after they are committed, e.g. to republish
+	// them to external message brokers. It must not block.
+	Bridge func(*ratus.Task)
+
+	// Storage engine used for waiting for changes of watched tasks, which are
+	// checked periodically if nil.
+	Watcher engine.TaskWatcher
+
+	// Key for verifying commit tokens, commit tokens are rejected if empty.
+	key []byte
+
+	// Key for binding nonces to tasks and consumers, nonces are returned and
+	// accepted as is if empty.
+	nonceKey []byte
+
+	// Whether commits with nonces or tokens must specify their consumers.
+	strict bool
+
+	// Cache of task defaults of topics, keyed by topic names, and the time
+	// expired entries were last evicted in Unix nanoseconds.
+	cache sync.Map
+	swept atomic.Int64
 }
 
 // NewTaskController creates a new TaskController.
-func NewTaskController(g engine.Engine) *TaskController {
-	return &TaskController{g}
+func NewTaskController(g engine.Engine, tc *config.TokenConfig) *TaskController {
+	return &TaskController{Engine: g, key: []byte(tc.Key), nonceKey: []byte(tc.NonceKey), strict: tc.StrictConsumer}
 }
 
 // GetTasks lists all tasks in a topic.
@@ -27,15 +59,57 @@ func NewTaskController(g engine.Engine) *TaskController {
 // @router   /topics/{topic}/tasks [get]
 // @tags     tasks
 // @param    topic path string true "Name of the topic"
+// @param    labels query string false "Label selector in the form of comma-separated key=value pairs"
 // @param    limit query int false "Maximum number of resources to return"
 // @param    offset query int false "Number of resources to skip"
+// @param    sort query string false "Field to sort by, one of id, scheduled, produced and consumed, prefixed by - for descending order"
+// @param    cursor query string false "Opaque cursor of the page to return, only supported by API version 2"
+// @param    count query bool false "Whether to return the total number of resources in the X-Total-Count header"
 // @produce  application/json
 // @success  200 {object} ratus.Tasks
+// @header   200 {integer} X-Total-Count "Total number of resources regardless of pagination, if requested and supported by the storage engine"
 // @failure  400 {object} ratus.Error
 // @failure  500 {object} ratus.Error
 func (r *TaskController) GetTasks(c *gin.Context) {
-	v, err := r.Engine.ListTasks(c.Request.Context(), c.Param(middleware.ParamTopic), c.GetInt(middleware.ParamLimit), c.GetInt(middleware.ParamOffset))
-	send(c, &ratus.Tasks{Data: v}, err)
+	ctx := c.Request.Context()
+	p := page(c)
+	topic, labels := c.Param(middleware.ParamTopic), c.GetStringMapString(middleware.ParamLabels)
+	v, err := r.Engine.ListTasks(ctx, topic, labels, p)
+	if err == nil {
+		err = total(c, r.Engine, func(x engine.Counter) (int64, error) { return x.CountTasks(ctx, topic, labels) })
+	}
+	v, n := next(c, v, func(t *ratus.Task) (string, *time.Time) { return t.ID, p.SortTime(t) })
+	for i, t := range v {
+		v[i] = maskNonce(r.nonceKey, t)
+	}
+	send(c, &ratus.Tasks{Data: v, Next: n}, err)
+}
+
+// GetArchive lists archived tasks in a topic consumed within a time range.
+// @summary  List archived tasks in a topic consumed within a time range
+// @router   /topics/{topic}/archive [get]
+// @tags     tasks
+// @param    topic path string true "Name of the topic"
+// @param    from query string false "Inclusive start of the range of consumed times in RFC 3339 format"
+// @param    to query string false "Exclusive end of the range of consumed times in RFC 3339 format"
+// @param    limit query int false "Maximum number of resources to return"
+// @param    offset query int false "Number of resources to skip"
+// @param    sort query string false "Order of consumed times, either consumed or -consumed for descending order"
+// @param    cursor query string false "Opaque cursor of the page to return, only supported by API version 2"
+// @produce  application/json
+// @success  200 {object} ratus.Tasks
+// @failure  400 {object} ratus.Error
+// @failure  500 {object} ratus.Error
+func (r *TaskController) GetArchive(c *gin.Context) {
+	p := page(c)
+	from, _ := c.Value(middleware.ParamFrom).(*time.Time)
+	to, _ := c.Value(middleware.ParamTo).(*time.Time)
+	v, err := r.Engine.ListArchive(c.Request.Context(), c.Param(middleware.ParamTopic), from, to, p)
+	v, n := next(c, v, func(t *ratus.Task) (string, *time.Time) { return t.ID, t.Consumed })
+	for i, t := range v {
+		v[i] = maskNonce(r.nonceKey, t)
+	}
+	send(c, &ratus.Tasks{Data: v, Next: n}, err)
 }
 
 // PostTasks inserts a batch of tasks while ignoring existing ones.
@@ -49,6 +123,8 @@ func (r *TaskController) GetTasks(c *gin.Context) {
 // @success  200 {object} ratus.Updated
 // @success  201 {object} ratus.Updated
 // @failure  400 {object} ratus.Error
+// @failure  429 {object} ratus.Error
+// @header   429 {integer} Retry-After "Number of seconds to wait before retrying, if the topic has too many pending tasks"
 // @failure  500 {object} ratus.Error
 func (r *TaskController) PostTasks(c *gin.Context) {
 	ts := c.MustGet(middleware.ParamTasks).(*ratus.Tasks)
@@ -72,6 +148,8 @@ func (r *TaskController) PostTasks(c *gin.Context) {
 // @success  200 {object} ratus.Updated
 // @success  201 {object} ratus.Updated
 // @failure  400 {object} ratus.Error
+// @failure  429 {object} ratus.Error
+// @header   429 {integer} Retry-After "Number of seconds to wait before retrying, if the topic has too many pending tasks"
 // @failure  500 {object} ratus.Error
 func (r *TaskController) PutTasks(c *gin.Context) {
 	ts := c.MustGet(middleware.ParamTasks).(*ratus.Tasks)
@@ -89,11 +167,13 @@ func (r *TaskController) PutTasks(c *gin.Context) {
 // @router   /topics/{topic}/tasks [delete]
 // @tags     tasks
 // @param    topic path string true "Name of the topic"
+// @param    labels query string false "Label selector in the form of comma-separated key=value pairs"
 // @produce  application/json
 // @success  200 {object} ratus.Deleted
+// @failure  400 {object} ratus.Error
 // @failure  500 {object} ratus.Error
 func (r *TaskController) DeleteTasks(c *gin.Context) {
-	v, err := r.Engine.DeleteTasks(c.Request.Context(), c.Param(middleware.ParamTopic))
+	v, err := r.Engine.DeleteTasks(c.Request.Context(), c.Param(middleware.ParamTopic), c.GetStringMapString(middleware.ParamLabels))
 	send(c, v, err)
 }
 
@@ -103,13 +183,119 @@ func (r *TaskController) DeleteTasks(c *gin.Context) {
 // @tags     tasks
 // @param    topic path string true "Name of the topic"
 // @param    id path string true "Unique ID of the task"
+// @param    include query string false "Comma-separated list of optional fields to include, such as history"
 // @produce  application/json
 // @success  200 {object} ratus.Task
 // @failure  404 {object} ratus.Error
 // @failure  500 {object} ratus.Error
 func (r *TaskController) GetTask(c *gin.Context) {
 	v, err := r.Engine.GetTask(c.Request.Context(), c.Param(middleware.ParamID))
-	send(c, v, err)
+	send(c, maskNonce(r.nonceKey, v), err)
+}
+
+// PostBatchGet gets tasks by their unique IDs in bulk.
+// @summary  Get tasks by their unique IDs in bulk
+// @router   /tasks:batchGet [post]
+// @tags     tasks
+// @param    ids body ratus.BatchGet true "Unique IDs of the tasks to retrieve"
+// @param    include query string false "Comma-separated list of optional fields to include, such as history"
+// @accept   application/json
+// @produce  application/json
+// @success  200 {object} ratus.Tasks
+// @failure  400 {object} ratus.Error
+// @failure  500 {object} ratus.Error
+func (r *TaskController) PostBatchGet(c *gin.Context) {
+	b := c.MustGet(middleware.ParamBatch).(*ratus.BatchGet)
+	v, err := r.Engine.GetTasks(c.Request.Context(), b.IDs)
+	for i, t := range v {
+		v[i] = maskNonce(r.nonceKey, t)
+	}
+	send(c, &ratus.Tasks{Data: v}, err)
+}
+
+// GetWatch waits for a task to change and returns it.
+// @summary  Wait for a task to change and return it
+// @router   /topics/{topic}/tasks/{id}/watch [get]
+// @tags     tasks
+// @param    topic path string true "Name of the topic"
+// @param    id path string true "Unique ID of the task"
+// @param    version query int false "Version of the task known to the caller, defaults to the current version"
+// @param    timeout query string false "Maximum duration to wait for changes, after which the task is returned as is"
+// @param    include query string false "Comma-separated list of optional fields to include, such as history"
+// @produce  application/json
+// @success  200 {object} ratus.Task
+// @failure  400 {object} ratus.Error
+// @failure  404 {object} ratus.Error
+// @failure  500 {object} ratus.Error
+func (r *TaskController) GetWatch(c *gin.Context) {
+	ctx := c.Request.Context()
+	id := c.Param(middleware.ParamID)
+	v, err := r.Engine.GetTask(ctx, id)
+	if err != nil {
+		send(c, nil, err)
+		return
+	}
+
+	// Tasks that have changed since the version known to the caller are
+	// returned immediately. Otherwise the unchanged task is returned once the
+	// wait is over, including when the request itself times out.
+	n := v.Version
+	if x, ok := c.Get(middleware.ParamVersion); ok {
+		n = x.(int64)
+	}
+	if v.Version == n {
+		ctx, cancel := context.WithTimeout(ctx, c.GetDuration(middleware.ParamTimeout))
+		defer cancel()
+		u, err := r.watch(ctx, id, n, c.GetDuration(middleware.ParamInterval))
+		if err == nil {
+			v = u
+		} else if ctx.Err() == nil {
+			send(c, nil, err)
+			return
+		}
+	}
+	send(c, maskNonce(r.nonceKey, v), nil)
+}
+
+// watch blocks until the version of the task differs from the version, using
+// the storage engine to wait for changes if supported, or checking the task at
+// the interval otherwise.
+func (r *TaskController) watch(ctx context.Context, id string, version int64, d time.Duration) (*ratus.Task, error) {
+	if r.Watcher != nil {
+		return r.Watcher.WatchTask(ctx, id, version)
+	}
+	t := time.NewTicker(d)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-t.C:
+		}
+		v, err := r.Engine.GetTask(ctx, id)
+		if err != nil || v.Version != version {
+			return v, err
+		}
+	}
+}
+
+// GetResult gets the result of a task by its unique ID.
+// @summary  Get the result of a task by its unique ID
+// @router   /topics/{topic}/tasks/{id}/result [get]
+// @tags     tasks
+// @param    topic path string true "Name of the topic"
+// @param    id path string true "Unique ID of the task"
+// @produce  application/json
+// @success  200 {object} ratus.Result
+// @failure  404 {object} ratus.Error
+// @failure  500 {object} ratus.Error
+func (r *TaskController) GetResult(c *gin.Context) {
+	v, err := r.Engine.GetTask(c.Request.Context(), c.Param(middleware.ParamID))
+	if err != nil {
+		send(c, nil, err)
+		return
+	}
+	send(c, &ratus.Result{ID: v.ID, State: v.State, Result: v.Result}, nil)
 }
 
 // PostTask inserts a new task.
@@ -124,6 +310,8 @@ func (r *TaskController) GetTask(c *gin.Context) {
 // @success  201 {object} ratus.Updated
 // @failure  400 {object} ratus.Error
 // @failure  409 {object} ratus.Error
+// @failure  429 {object} ratus.Error
+// @header   429 {integer} Retry-After "Number of seconds to wait before retrying, if the topic has too many pending tasks"
 // @failure  500 {object} ratus.Error
 func (r *TaskController) PostTask(c *gin.Context) {
 	t := c.MustGet(middleware.ParamTask).(*ratus.Task)
@@ -146,15 +334,23 @@ func (r *TaskController) PostTask(c *gin.Context) {
 // @param    topic path string true "Name of the topic"
 // @param    id path string true "Unique ID of the task"
 // @param    task body ratus.Task true "Task object to be inserted or updated"
+// @param    If-Match header string false "Current version of the task for the update to be applied"
 // @accept   application/json
 // @produce  application/json
 // @success  200 {object} ratus.Updated
 // @success  201 {object} ratus.Updated
 // @failure  400 {object} ratus.Error
+// @failure  404 {object} ratus.Error
+// @failure  409 {object} ratus.Error
+// @failure  429 {object} ratus.Error
+// @header   429 {integer} Retry-After "Number of seconds to wait before retrying, if the topic has too many pending tasks"
 // @failure  500 {object} ratus.Error
 func (r *TaskController) PutTask(c *gin.Context) {
 	t := c.MustGet(middleware.ParamTask).(*ratus.Task)
 	v, err := r.Engine.UpsertTask(c.Request.Context(), t)
+	if err == ratus.ErrConflict {
+		err = fmt.Errorf("%w: the task may have been modified by others", err)
+	}
 	send(c, v, err)
 
 	// Collect number of tasks produced.
@@ -184,6 +380,11 @@ func (r *TaskController) DeleteTask(c *gin.Context) {
 // @param    topic path string true "Name of the topic"
 // @param    id path string true "Unique ID of the task"
 // @param    commit body ratus.Commit false "Commit object to be applied"
+// @param    If-Match header string false "Current version of the task for the commit to be applied"
+// @param    next query bool false "Whether to claim the next available task in the topic after committing, in which case the committed task and the next task are returned in the committed and next fields"
+// @param    consumer query string false "Consumer of the promise for claiming the next task, which defaults to the consumer of the committed task"
+// @param    timeout query string false "Timeout of the promise for claiming the next task"
+// @param    labels query string false "Label selector of the promise for claiming the next task in the form of comma-separated key=value pairs"
 // @accept   application/json
 // @produce  application/json
 // @success  200 {object} ratus.Task
@@ -193,11 +394,33 @@ func (r *TaskController) DeleteTask(c *gin.Context) {
 // @failure  500 {object} ratus.Error
 func (r *TaskController) PatchTask(c *gin.Context) {
 	m := c.MustGet(middleware.ParamCommit).(*ratus.Commit)
+	if r.strict && m.Consumer == "" && (m.Nonce != "" || m.Token != "") {
+		send(c, nil, fmt.Errorf("%w: consumer must be specified along with the nonce or token", ratus.ErrBadRequest))
+		return
+	}
+	if m.Token != "" {
+		if err := r.verify(m, c.Param(middleware.ParamID)); err != nil {
+			send(c, nil, fmt.Errorf("%w: %v", ratus.ErrBadRequest, err))
+			return
+		}
+	} else if m.Nonce != "" && len(r.nonceKey) > 0 {
+		n, err := r.unbind(c.Request.Context(), m.Nonce, c.Param(middleware.ParamID))
+		if err != nil {
+			send(c, nil, err)
+			return
+		}
+		m.Nonce = n
+	}
 	v, err := r.Engine.Commit(c.Request.Context(), c.Param(middleware.ParamID), m)
 	if err == ratus.ErrConflict {
 		err = fmt.Errorf("%w: the task may have been modified by others", err)
 	}
-	send(c, v, err)
+	v = maskNonce(r.nonceKey, v)
+	if p, ok := c.Get(middleware.ParamNext); ok && err == nil {
+		send(c, r.handoff(c, v, m, p.(*ratus.Promise)), nil)
+	} else {
+		send(c, v, err)
+	}
 
 	// Collect task execution time.
 	if v != nil && v.Consumed != nil {
@@ -209,4 +432,164 @@ func (r *TaskController) PatchTask(c *gin.Context) {
 	if v != nil {
 		metrics.CommittedCounter.WithLabelValues(v.Topic, v.Producer, v.Consumer).Add(1)
 	}
+
+	// Hand the committed task over to the bridge if configured.
+	if v != nil && r.Bridge != nil {
+		r.Bridge(v)
+	}
+}
+
+// handoff claims the next task from the topic in the path after committing a
+// task. The commit has already been applied, so the next task is omitted
+// rather than failing the request if it can not be claimed, in which case
+// consumers are expected to poll as usual. Promises without consumers are made
+// on behalf of the consumer of the committed task.
+func (r *TaskController) handoff(c *gin.Context, v *ratus.Task, m *ratus.Commit, p *ratus.Promise) *ratus.Handoff {
+	h := &ratus.Handoff{Committed: v}
+	p.Consumer = cmp.Or(p.Consumer, m.Consumer, v.Consumer)
+	t, err := r.Engine.Poll(c.Request.Context(), c.Param(middleware.ParamTopic), p)
+	if err != nil {
+		if ratus.NewError(err).Error.Code >= http.StatusInternalServerError {
+			c.Error(err)
+		}
+		return h
+	}
+	h.Next = sign(r.key, r.nonceKey, t)
+	collectConsumed(h.Next)
+	return h
+}
+
+// PatchProgress reports the progress of an active task during execution.
+// @summary  Report the progress of an active task during execution
+// @router   /topics/{topic}/tasks/{id}/progress [patch]
+// @tags     tasks
+// @param    topic path string true "Name of the topic"
+// @param    id path string true "Unique ID of the task"
+// @param    progress body ratus.Progress true "Progress of the task"
+// @accept   application/json
+// @produce  application/json
+// @success  200 {object} ratus.Updated
+// @failure  400 {object} ratus.Error
+// @failure  404 {object} ratus.Error
+// @failure  409 {object} ratus.Error
+// @failure  500 {object} ratus.Error
+func (r *TaskController) PatchProgress(c *gin.Context) {
+	p := c.MustGet(middleware.ParamProgress).(*ratus.Progress)
+	if p.Nonce != "" && len(r.nonceKey) > 0 {
+		n, err := r.unbind(c.Request.Context(), p.Nonce, c.Param(middleware.ParamID))
+		if err != nil {
+			send(c, nil, err)
+			return
+		}
+		p.Nonce = n
+	}
+	v, err := r.Engine.UpdateProgress(c.Request.Context(), c.Param(middleware.ParamID), p)
+	if err == ratus.ErrConflict {
+		err = fmt.Errorf("%w: the task is not active or has been claimed by another consumer", err)
+	}
+	send(c, v, err)
+}
+
+// verify verifies the commit token of the commit, and replaces it with the
+// nonce in its claims.
+func (r *TaskController) verify(m *ratus.Commit, id string) error {
+	if len(r.key) == 0 {
+		return errors.New("commit tokens are not enabled")
+	}
+	t, err := ratus.VerifyToken(r.key, m.Token)
+	if err != nil {
+		return err
+	}
+	if t.ID != id {
+		return errors.New("commit token is issued for another task")
+	}
+	if n, _, _ := strings.Cut(m.Nonce, "."); n != "" && n != t.Nonce {
+		return errors.New("nonce is inconsistent with the commit token")
+	}
+	m.Nonce = t.Nonce
+	m.Token = ""
+	return nil
+}
+
+// unbind returns the original nonce of the bound nonce, after verifying that
+// it is bound to the task and its current consumer.
+func (r *TaskController) unbind(ctx context.Context, s, id string) (string, error) {
+	t, err := r.Engine.GetTask(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	n, err := nonce.Unbind(r.nonceKey, s, id, t.Consumer)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ratus.ErrConflict, err)
+	}
+	return n, nil
+}
+
+// bindNonce returns a copy of the task with its nonce bound to the task and
+// its consumer if the key is specified. Only tasks claimed by the requester
+// should be returned with bound nonces.
+func bindNonce(key []byte, t *ratus.Task) *ratus.Task {
+	if t == nil || t.Nonce == "" || len(key) == 0 {
+		return t
+	}
+	u := *t
+	u.Nonce = nonce.Bind(key, t.Nonce, t.ID, t.Consumer)
+	return &u
+}
+
+// maskNonce returns a copy of the task without its nonce if the key is
+// specified, so that tasks returned by reads can not be committed by anyone
+// other than the consumer that claimed them.
+func maskNonce(key []byte, t *ratus.Task) *ratus.Task {
+	if t == nil || t.Nonce == "" || len(key) == 0 {
+		return t
+	}
+	u := *t
+	u.Nonce = ""
+	return &u
+}
+
+// defaultsCacheTTL is the duration for caching task defaults of topics.
+const defaultsCacheTTL = 1 * time.Second
+
+// cachedDefaults is an entry in the cache of task defaults.
+type cachedDefaults struct {
+	defaults *ratus.TaskDefaults
+	expires  time.Time
+}
+
+// Defaults stores the task defaults of the topic in the request context, so
+// that they are applied when binding tasks. Defaults are cached for up to
+// defaultsCacheTTL, so changes may take that long to take effect.
+func (r *TaskController) Defaults(c *gin.Context) {
+	topic := c.Param(middleware.ParamTopic)
+	n := time.Now()
+	if v, ok := r.cache.Load(topic); ok {
+		if e := v.(*cachedDefaults); n.Before(e.expires) {
+			c.Set(middleware.ParamDefaults, e.defaults)
+			return
+		}
+	}
+	t, err := r.Engine.GetTopicSettings(c.Request.Context(), topic)
+	if err != nil && !errors.Is(err, ratus.ErrNotFound) {
+		send(c, nil, err)
+		return
+	}
+	var d *ratus.TaskDefaults
+	if t != nil {
+		d = t.Defaults
+	}
+	r.cache.Store(topic, &cachedDefaults{defaults: d, expires: n.Add(defaultsCacheTTL)})
+	c.Set(middleware.ParamDefaults, d)
+
+	// Evict expired entries at most once per TTL, so that the cache does not
+	// keep growing with every topic that has ever been inserted into.
+	if s := r.swept.Load(); n.UnixNano()-s >= int64(defaultsCacheTTL) && r.swept.CompareAndSwap(s, n.UnixNano()) {
+		r.cache.Range(func(k, v any) bool {
+			if !n.Before(v.(*cachedDefaults).expires) {
+				r.cache.CompareAndDelete(k, v)
+			}
+			return true
+		})
+	}
 }
@@ -1,9 +1,15 @@
 package controller
 
 import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
 	"github.com/gin-gonic/gin"
 
 	"github.com/hyperonym/ratus"
+	"github.com/hyperonym/ratus/internal/config"
 	"github.com/hyperonym/ratus/internal/engine"
 	"github.com/hyperonym/ratus/internal/middleware"
 )
@@ -11,11 +17,14 @@ import (
 // TopicController implements handlers for topic-related endpoints.
 type TopicController struct {
 	Engine engine.Engine
+
+	// Whether topics can be deleted without confirmation.
+	unconfirmed bool
 }
 
 // NewTopicController creates a new TopicController.
-func NewTopicController(g engine.Engine) *TopicController {
-	return &TopicController{g}
+func NewTopicController(g engine.Engine, dc *config.DeleteConfig) *TopicController {
+	return &TopicController{g, dc.Unconfirmed}
 }
 
 // GetTopics lists all topics.
@@ -24,24 +33,47 @@ func NewTopicController(g engine.Engine) *TopicController {
 // @tags     topics
 // @param    limit query int false "Maximum number of resources to return"
 // @param    offset query int false "Number of resources to skip"
+// @param    sort query string false "Field to sort by, only name is supported, prefixed by - for descending order"
+// @param    cursor query string false "Opaque cursor of the page to return, only supported by API version 2"
+// @param    count query bool false "Whether to return the total number of resources in the X-Total-Count header"
 // @produce  application/json
 // @success  200 {object} ratus.Topics
+// @header   200 {integer} X-Total-Count "Total number of resources regardless of pagination, if requested and supported by the storage engine"
 // @failure  400 {object} ratus.Error
 // @failure  500 {object} ratus.Error
 func (r *TopicController) GetTopics(c *gin.Context) {
-	v, err := r.Engine.ListTopics(c.Request.Context(), c.GetInt(middleware.ParamLimit), c.GetInt(middleware.ParamOffset))
-	send(c, &ratus.Topics{Data: v}, err)
+	ctx := c.Request.Context()
+	v, err := r.Engine.ListTopics(ctx, page(c))
+	if err == nil {
+		err = total(c, r.Engine, func(x engine.Counter) (int64, error) { return x.CountTopics(ctx) })
+	}
+	v, n := next(c, v, func(t *ratus.Topic) (string, *time.Time) { return t.Name, nil })
+	send(c, &ratus.Topics{Data: v, Next: n}, err)
 }
 
 // DeleteTopics deletes all topics and tasks.
 // @summary  Delete all topics and tasks
 // @router   /topics [delete]
 // @tags     topics
+// @param    confirm query int false "Number of topics to be deleted, required unless unconfirmed deletions are allowed"
 // @produce  application/json
 // @success  200 {object} ratus.Deleted
+// @failure  428 {object} ratus.Error
 // @failure  500 {object} ratus.Error
 func (r *TopicController) DeleteTopics(c *gin.Context) {
-	v, err := r.Engine.DeleteTopics(c.Request.Context())
+	ctx := c.Request.Context()
+	if !r.unconfirmed {
+		n, err := r.count(ctx)
+		if err != nil {
+			send(c, nil, err)
+			return
+		}
+		if c.Query(middleware.ParamConfirm) != strconv.FormatInt(n, 10) {
+			send(c, nil, fmt.Errorf("%w: deleting all %d topics must be confirmed with the number of topics", ratus.ErrPreconditionRequired, n))
+			return
+		}
+	}
+	v, err := r.Engine.DeleteTopics(ctx)
 	send(c, v, err)
 }
 
@@ -59,15 +91,83 @@ func (r *TopicController) GetTopic(c *gin.Context) {
 	send(c, v, err)
 }
 
+// GetTopicConfig gets the operational hints for consumers of a topic.
+// @summary  Get the operational hints for consumers of a topic
+// @router   /topics/{topic}/config [get]
+// @tags     topics
+// @param    topic path string true "Name of the topic"
+// @produce  application/json
+// @success  200 {object} ratus.TopicConfig
+// @failure  500 {object} ratus.Error
+func (r *TopicController) GetTopicConfig(c *gin.Context) {
+
+	// Topics without settings have no hints, so that subscribers do not need
+	// to tell them apart when fetching hints on startup. Only the settings are
+	// read, as counting the tasks of the topic is not needed for the hints.
+	v := &ratus.TopicConfig{}
+	t, err := r.Engine.GetTopicSettings(c.Request.Context(), c.Param(middleware.ParamTopic))
+	if err == nil && t.Config != nil {
+		v = t.Config
+	}
+	send(c, v, err)
+}
+
+// PutTopic inserts or updates the settings of a topic.
+// @summary  Insert or update the settings of a topic
+// @router   /topics/{topic} [put]
+// @tags     topics
+// @param    topic path string true "Name of the topic"
+// @param    settings body ratus.Topic true "Topic object containing the settings to be inserted or updated"
+// @accept   application/json
+// @produce  application/json
+// @success  200 {object} ratus.Updated
+// @success  201 {object} ratus.Updated
+// @failure  400 {object} ratus.Error
+// @failure  500 {object} ratus.Error
+func (r *TopicController) PutTopic(c *gin.Context) {
+	t := c.MustGet(middleware.ParamTopic).(*ratus.Topic)
+	v, err := r.Engine.UpsertTopic(c.Request.Context(), t)
+	send(c, v, err)
+}
+
 // DeleteTopic deletes a topic and its tasks.
 // @summary  Delete a topic and its tasks
 // @router   /topics/{topic} [delete]
 // @tags     topics
 // @param    topic path string true "Name of the topic"
+// @param    confirm query string false "Name of the topic, required unless unconfirmed deletions are allowed"
 // @produce  application/json
 // @success  200 {object} ratus.Deleted
+// @failure  428 {object} ratus.Error
 // @failure  500 {object} ratus.Error
 func (r *TopicController) DeleteTopic(c *gin.Context) {
-	v, err := r.Engine.DeleteTopic(c.Request.Context(), c.Param(middleware.ParamTopic))
+	topic := c.Param(middleware.ParamTopic)
+	if !r.unconfirmed && c.Query(middleware.ParamConfirm) != topic {
+		send(c, nil, fmt.Errorf("%w: deleting topic %q must be confirmed with the name of the topic", ratus.ErrPreconditionRequired, topic))
+		return
+	}
+	v, err := r.Engine.DeleteTopic(c.Request.Context(), topic)
 	send(c, v, err)
 }
+
+// count returns the number of topics, which is counted by the storage engine
+// if it implements the Counter interface, or by listing the topics in batches
+// otherwise.
+func (r *TopicController) count(ctx context.Context) (int64, error) {
+	if x, ok := r.Engine.(engine.Counter); ok {
+		return x.CountTopics(ctx)
+	}
+	const limit = 1000
+	var n int64
+	for after := ""; ; {
+		ts, err := r.Engine.ListTopics(ctx, &engine.Page{Limit: limit, After: after})
+		if err != nil {
+			return 0, err
+		}
+		n += int64(len(ts))
+		if len(ts) < limit {
+			return n, nil
+		}
+		after = ts[len(ts)-1].Name
+	}
+}
@@ -0,0 +1,164 @@
+// Package benchsuite provides a collection of benchmarks for comparing storage
+// engine implementations.
+package benchsuite
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hyperonym/ratus"
+	"github.com/hyperonym/ratus/internal/engine"
+)
+
+// batchSize is the number of tasks in each batch when preparing data.
+const batchSize = 1000
+
+// topicCounts are the numbers of topics that tasks are distributed across.
+var topicCounts = []int{1, 10, 100}
+
+// Benchmark runs a collection of benchmarks that are grouped for measuring
+// the performance of storage engine implementations. The benchmark suite
+// handles the initialization of the provided engine instance, and clears all
+// data when the benchmarks are completed. Each benchmark is run with tasks
+// distributed across different numbers of topics.
+func Benchmark(b *testing.B, g engine.Engine) {
+	ctx := context.Background()
+	if err := g.Open(ctx); err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		if err := g.Destroy(ctx); err != nil {
+			b.Error(err)
+		}
+	})
+
+	for _, k := range topicCounts {
+		b.Run(fmt.Sprintf("insert/topics=%d", k), func(b *testing.B) {
+			reset(b, g)
+			n := time.Now()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := g.InsertTask(ctx, task(i, k, ratus.TaskStatePending, n)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+
+		b.Run(fmt.Sprintf("insert-batch/topics=%d", k), func(b *testing.B) {
+			reset(b, g)
+			n := time.Now()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				ts := make([]*ratus.Task, batchSize)
+				for j := range ts {
+					ts[j] = task(i*batchSize+j, k, ratus.TaskStatePending, n)
+				}
+				if _, err := g.InsertTasks(ctx, ts); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+
+		// Consumers poll topics in a round-robin fashion so that every poll
+		// is guaranteed to find a task.
+		b.Run(fmt.Sprintf("poll/topics=%d", k), func(b *testing.B) {
+			reset(b, g)
+			prepare(b, g, b.N, k, ratus.TaskStatePending)
+			d := time.Now().Add(time.Hour)
+			var c atomic.Int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					i := int(c.Add(1) - 1)
+					if _, err := g.Poll(ctx, topic(i, k), &ratus.Promise{Deadline: &d}); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+
+		b.Run(fmt.Sprintf("commit/topics=%d", k), func(b *testing.B) {
+			reset(b, g)
+			prepare(b, g, b.N, k, ratus.TaskStateActive)
+			s := ratus.TaskStateCompleted
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := g.Commit(ctx, id(i), &ratus.Commit{State: &s}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+
+		// Each iteration recovers a full batch of timed out tasks.
+		b.Run(fmt.Sprintf("chore/topics=%d", k), func(b *testing.B) {
+			reset(b, g)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				reset(b, g)
+				prepare(b, g, batchSize, k, ratus.TaskStateActive)
+				b.StartTimer()
+				if _, err := g.Chore(ctx); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// reset deletes all tasks in the storage engine.
+func reset(b *testing.B, g engine.Engine) {
+	b.Helper()
+	if _, err := g.DeleteTopics(context.Background()); err != nil {
+		b.Fatal(err)
+	}
+}
+
+// prepare inserts tasks in the state distributed across topics in batches.
+// Active tasks are created with deadlines in the past.
+func prepare(b *testing.B, g engine.Engine, count, topics int, state ratus.TaskState) {
+	b.Helper()
+	n := time.Now()
+	for i := 0; i < count; i += batchSize {
+		ts := make([]*ratus.Task, 0, batchSize)
+		for j := i; j < count && j < i+batchSize; j++ {
+			ts = append(ts, task(j, topics, state, n))
+		}
+		if _, err := g.InsertTasks(context.Background(), ts); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// task creates the i-th task in the state distributed across topics.
+func task(i, topics int, state ratus.TaskState, n time.Time) *ratus.Task {
+	t := ratus.Task{
+		ID:        id(i),
+		Topic:     topic(i, topics),
+		State:     state,
+		Produced:  &n,
+		Scheduled: &n,
+		Payload:   "hello",
+	}
+	if state == ratus.TaskStateActive {
+		d := n.Add(-time.Minute)
+		t.Consumed = &n
+		t.Deadline = &d
+		t.Nonce = "benchmark"
+	}
+	return &t
+}
+
+// id returns the ID of the i-th task.
+func id(i int) string {
+	return fmt.Sprintf("%012d", i)
+}
+
+// topic returns the topic of the i-th task.
+func topic(i, topics int) string {
+	return fmt.Sprintf("topic-%d", i%topics)
+}
@@ -0,0 +1,331 @@
+// Package chaossuite provides a randomized workload for finding races in
+// storage engine implementations, which runs concurrent producers, consumers
+// and background jobs with injected faults while checking the invariants of
+// task execution.
+package chaossuite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hyperonym/ratus"
+	"github.com/hyperonym/ratus/internal/engine"
+)
+
+// Parameters of the workload.
+const (
+	topic         = "chaos"
+	taskCount     = 300
+	producerCount = 4
+	consumerCount = 8
+	choreInterval = 5 * time.Millisecond
+	checkInterval = 20 * time.Millisecond
+	timeLimit     = 30 * time.Second
+)
+
+// Probabilities of injecting faults into operations.
+const (
+
+	// Operations made with contexts that have already been canceled, whose
+	// outcomes are unknown to the caller.
+	cancelRate = 0.05
+	// Inserts and commits sent twice, as clients retrying requests would.
+	duplicateRate = 0.1
+	// Consumers stalling past the deadlines of their promises, which leaves
+	// the tasks to be recovered by background jobs and claimed again.
+	stallRate = 0.05
+)
+
+// Test runs a randomized workload of concurrent inserts, polls, commits and
+// background jobs against the storage engine, and verifies that:
+//   - No task is claimed while another consumer holds an unexpired promise.
+//   - No task is completed more than once.
+//   - Commits are only rejected after the deadlines of their promises.
+//   - Every inserted task is eventually completed, and no task is lost.
+//
+// The test suite handles the initialization of the provided engine instance,
+// and clears all data when the test is completed. Completed tasks must be
+// retained by the storage engine for the duration of the test. The seed of
+// the random faults is logged, although the interleaving of goroutines is
+// still up to the scheduler.
+func Test(t *testing.T, g engine.Engine) {
+	ctx := context.Background()
+	if err := g.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := g.Destroy(ctx); err != nil {
+			t.Error(err)
+		}
+	})
+	if _, err := g.UpsertTopic(ctx, &ratus.Topic{Name: topic, Retention: "1h"}); err != nil {
+		t.Fatal(err)
+	}
+
+	seed := time.Now().UnixNano()
+	t.Logf("seed: %d", seed)
+	random := func(i int) *rand.Rand {
+		return rand.New(rand.NewPCG(uint64(seed), uint64(i)))
+	}
+
+	// Run the workload until all tasks have been completed or the time limit
+	// is reached.
+	m := monitor{t: t, running: make(map[string]map[string]time.Time), completed: make(map[string]int)}
+	ctx, cancel := context.WithTimeout(ctx, timeLimit)
+	defer cancel()
+	var wg sync.WaitGroup
+	for i := range producerCount {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			produce(ctx, t, g, random(i), i)
+		}()
+	}
+	for i := range consumerCount {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			consume(ctx, t, g, random(producerCount+i), &m, fmt.Sprintf("consumer-%d", i))
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		chore(ctx, t, g)
+	}()
+	n, err := wait(ctx, g)
+	cancel()
+	wg.Wait()
+	if err != nil {
+		t.Fatalf("workload did not finish, %d of %d tasks completed: %v", n, taskCount, err)
+	}
+
+	// Every inserted task should be present and completed.
+	ids := make(map[string]bool)
+	if err := g.StreamTasks(context.Background(), topic, func(v *ratus.Task) error {
+		if v.State != ratus.TaskStateCompleted {
+			t.Errorf("incorrect state of task %q, expected %d, got %d", v.ID, ratus.TaskStateCompleted, v.State)
+		}
+		ids[v.ID] = true
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for i := range taskCount {
+		if id := taskID(i); !ids[id] {
+			t.Errorf("task %q is lost", id)
+		}
+	}
+	if len(ids) != taskCount {
+		t.Errorf("incorrect number of tasks, expected %d, got %d", taskCount, len(ids))
+	}
+}
+
+// monitor tracks the promises held by consumers and the completions of tasks
+// to check the invariants of task execution.
+type monitor struct {
+	t  *testing.T
+	mu sync.Mutex
+
+	// Deadlines of the promises held by consumers, keyed by task IDs and then
+	// by the names of the consumers.
+	running map[string]map[string]time.Time
+
+	// Number of successful commits completing each task.
+	completed map[string]int
+}
+
+// claim records the promise of the consumer, and reports other consumers that
+// still hold unexpired promises of the task. Storage engines only recover
+// tasks whose deadlines have passed before they are claimed again.
+func (m *monitor) claim(id, consumer string, deadline time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := time.Now()
+	for c, d := range m.running[id] {
+		if d.After(n) {
+			m.t.Errorf("task %q claimed by %s while %s holds a promise until %s", id, consumer, c, d.Format(time.RFC3339Nano))
+		}
+	}
+	if m.running[id] == nil {
+		m.running[id] = make(map[string]time.Time)
+	}
+	m.running[id][consumer] = deadline
+}
+
+// release forgets the promise of the consumer.
+func (m *monitor) release(id, consumer string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.running[id], consumer)
+}
+
+// complete records a successful commit completing the task.
+func (m *monitor) complete(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.completed[id]++; m.completed[id] > 1 {
+		m.t.Errorf("task %q completed %d times", id, m.completed[id])
+	}
+}
+
+// produce inserts the share of tasks of the producer in random batches, with
+// some tasks inserted twice.
+func produce(ctx context.Context, t *testing.T, g engine.Engine, r *rand.Rand, i int) {
+	var ids []string
+	for k := i; k < taskCount; k += producerCount {
+		ids = append(ids, taskID(k))
+	}
+	for len(ids) > 0 && ctx.Err() == nil {
+		b := ids[:min(1+r.IntN(8), len(ids))]
+		n := time.Now()
+		ts := make([]*ratus.Task, len(b))
+		for j, id := range b {
+			ts[j] = &ratus.Task{ID: id, Topic: topic, State: ratus.TaskStatePending, Producer: fmt.Sprintf("producer-%d", i), Produced: &n, Scheduled: &n}
+		}
+
+		// Inserts with canceled contexts are retried, since inserting tasks
+		// that already exist has no effect.
+		c := r.Float64() < cancelRate
+		if _, err := g.InsertTasks(fault(ctx, c), ts); err != nil && !c {
+			if ctx.Err() == nil {
+				t.Errorf("insert tasks: %v", err)
+			}
+			return
+		} else if err != nil {
+			continue
+		}
+		if r.Float64() < duplicateRate {
+			if _, err := g.InsertTask(ctx, ts[0]); err != nil && !errors.Is(err, ratus.ErrConflict) && ctx.Err() == nil {
+				t.Errorf("insert duplicate task: %v", err)
+			}
+		}
+		ids = ids[len(b):]
+	}
+}
+
+// consume claims tasks and completes them, occasionally stalling past the
+// deadlines of the promises, committing with canceled contexts or sending
+// commits twice.
+func consume(ctx context.Context, t *testing.T, g engine.Engine, r *rand.Rand, m *monitor, name string) {
+	for ctx.Err() == nil {
+		u := time.Now().Add(time.Duration(20+r.IntN(40)) * time.Millisecond)
+		c := r.Float64() < cancelRate
+		v, err := g.Poll(fault(ctx, c), topic, &ratus.Promise{Consumer: name, Deadline: &u})
+		if errors.Is(err, ratus.ErrNotFound) || errors.Is(err, ratus.ErrTooManyRequests) || (err != nil && c) {
+			sleep(ctx, time.Millisecond)
+			continue
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				t.Errorf("poll: %v", err)
+			}
+			return
+		}
+
+		// Use the deadline stored by the storage engine, which may have been
+		// truncated to its precision. The promise is not modified, since the
+		// storage engine may keep referencing its fields.
+		d := u
+		if v.Deadline != nil {
+			d = *v.Deadline
+		}
+		m.claim(v.ID, name, d)
+		if r.Float64() < stallRate {
+			sleep(ctx, time.Until(d)+time.Duration(r.IntN(10))*time.Millisecond)
+		} else {
+			sleep(ctx, time.Duration(r.IntN(2000))*time.Microsecond)
+		}
+
+		s := ratus.TaskStateCompleted
+		x := &ratus.Commit{Nonce: v.Nonce, State: &s}
+		c = r.Float64() < cancelRate
+		_, err = g.Commit(fault(ctx, c), v.ID, x)
+		n := time.Now()
+		m.release(v.ID, name)
+		switch {
+		case err == nil:
+			m.complete(v.ID)
+			if r.Float64() < duplicateRate {
+				if _, err := g.Commit(ctx, v.ID, x); err == nil {
+					t.Errorf("duplicate commit of task %q applied", v.ID)
+				} else if !errors.Is(err, ratus.ErrConflict) && ctx.Err() == nil {
+					t.Errorf("duplicate commit: %v", err)
+				}
+			}
+		case errors.Is(err, ratus.ErrConflict):
+			if d.After(n) {
+				t.Errorf("commit of task %q rejected before the deadline %s", v.ID, d.Format(time.RFC3339Nano))
+			}
+		case c || ctx.Err() != nil:
+
+			// The outcome of commits with canceled contexts is unknown, the
+			// task is either completed or recovered after the deadline.
+		default:
+			t.Errorf("commit: %v", err)
+		}
+	}
+}
+
+// chore runs background jobs periodically to recover timed out tasks.
+func chore(ctx context.Context, t *testing.T, g engine.Engine) {
+	for ctx.Err() == nil {
+		if _, err := g.Chore(ctx); err != nil && ctx.Err() == nil {
+			t.Errorf("chore: %v", err)
+		}
+		sleep(ctx, choreInterval)
+	}
+}
+
+// wait blocks until all tasks have been completed, and returns the number of
+// completed tasks along with the error of the context if it is done first.
+func wait(ctx context.Context, g engine.Engine) (int, error) {
+	var n int
+	for {
+		n = 0
+		err := g.StreamTasks(ctx, topic, func(v *ratus.Task) error {
+			if v.State == ratus.TaskStateCompleted {
+				n++
+			}
+			return nil
+		})
+		if err == nil && n == taskCount {
+			return n, nil
+		}
+		sleep(ctx, checkInterval)
+		if err := ctx.Err(); err != nil {
+			return n, err
+		}
+	}
+}
+
+// fault returns a canceled context derived from the context if the fault is
+// to be injected, otherwise the context is returned as is.
+func fault(ctx context.Context, inject bool) context.Context {
+	if !inject {
+		return ctx
+	}
+	c, cancel := context.WithCancel(ctx)
+	cancel()
+	return c
+}
+
+// sleep pauses for the duration or until the context is done.
+func sleep(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+	case <-t.C:
+	}
+}
+
+// taskID returns the ID of the i-th task.
+func taskID(i int) string {
+	return fmt.Sprintf("%04d", i)
+}
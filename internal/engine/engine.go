@@ -3,6 +3,9 @@ package engine
 
 import (
 	"context"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/hyperonym/ratus"
 )
@@ -20,31 +23,53 @@ type Engine interface {
 	Ready(ctx context.Context) error
 
 	// Chore recovers timed out tasks and deletes expired tasks.
-	Chore(ctx context.Context) error
+	Chore(ctx context.Context) (*ratus.Chore, error)
 	// Poll makes a promise to claim and execute the next available task in a topic.
 	Poll(ctx context.Context, topic string, p *ratus.Promise) (*ratus.Task, error)
+	// NextScheduled returns the scheduled time of the next pending task in a topic that is not yet available.
+	NextScheduled(ctx context.Context, topic string) (*time.Time, error)
 	// Commit applies a set of updates to a task and returns the updated task.
 	Commit(ctx context.Context, id string, m *ratus.Commit) (*ratus.Task, error)
+	// UpdateProgress records the progress of an active task without changing its state, nonce or version.
+	UpdateProgress(ctx context.Context, id string, p *ratus.Progress) (*ratus.Updated, error)
 
 	// ListTopics lists all topics.
-	ListTopics(ctx context.Context, limit, offset int) ([]*ratus.Topic, error)
+	ListTopics(ctx context.Context, p *Page) ([]*ratus.Topic, error)
 	// DeleteTopics deletes all topics and tasks.
 	DeleteTopics(ctx context.Context) (*ratus.Deleted, error)
 	// GetTopic gets information about a topic.
 	GetTopic(ctx context.Context, topic string) (*ratus.Topic, error)
+	// GetTopicSettings gets the settings of a topic without counting its tasks, which are empty if not specified.
+	GetTopicSettings(ctx context.Context, topic string) (*ratus.Topic, error)
+	// UpsertTopic inserts or updates the settings of a topic.
+	UpsertTopic(ctx context.Context, t *ratus.Topic) (*ratus.Updated, error)
 	// DeleteTopic deletes a topic and its tasks.
 	DeleteTopic(ctx context.Context, topic string) (*ratus.Deleted, error)
+	// Stats returns statistics of tasks across all topics.
+	Stats(ctx context.Context) (*ratus.Stats, error)
 
-	// ListTasks lists all tasks in a topic.
-	ListTasks(ctx context.Context, topic string, limit, offset int) ([]*ratus.Task, error)
+	// ListTasks lists all tasks in a topic that match the label selector.
+	ListTasks(ctx context.Context, topic string, labels map[string]string, p *Page) ([]*ratus.Task, error)
+	// ListArchive lists archived tasks in a topic consumed within the time range, in the order of their consumed time.
+	ListArchive(ctx context.Context, topic string, from, to *time.Time, p *Page) ([]*ratus.Task, error)
+	// StreamTasks calls the function with each task in a topic in the order of their IDs, stopping at the first error.
+	StreamTasks(ctx context.Context, topic string, f func(*ratus.Task) error) error
+	// CountPending counts pending tasks of a producer in a topic, stopping at the limit if it is positive.
+	CountPending(ctx context.Context, topic, producer string, limit int64) (int64, error)
+	// CountPendingTasks counts pending tasks in a topic, or in all topics if the topic is empty, stopping at the limit if it is positive.
+	CountPendingTasks(ctx context.Context, topic string, limit int64) (int64, error)
 	// InsertTasks inserts a batch of tasks while ignoring existing ones.
 	InsertTasks(ctx context.Context, ts []*ratus.Task) (*ratus.Updated, error)
 	// UpsertTasks inserts or updates a batch of tasks.
 	UpsertTasks(ctx context.Context, ts []*ratus.Task) (*ratus.Updated, error)
-	// DeleteTasks deletes all tasks in a topic.
-	DeleteTasks(ctx context.Context, topic string) (*ratus.Deleted, error)
+	// DeleteTasks deletes all tasks in a topic that match the label selector.
+	DeleteTasks(ctx context.Context, topic string, labels map[string]string) (*ratus.Deleted, error)
+	// MoveTasks moves tasks in a topic that match the filters to another topic.
+	MoveTasks(ctx context.Context, topic string, m *ratus.Move) (*ratus.Updated, error)
 	// GetTask gets a task by its unique ID.
 	GetTask(ctx context.Context, id string) (*ratus.Task, error)
+	// GetTasks gets tasks by their unique IDs in the order of the IDs, skipping missing ones.
+	GetTasks(ctx context.Context, ids []string) ([]*ratus.Task, error)
 	// InsertTask inserts a new task.
 	InsertTask(ctx context.Context, t *ratus.Task) (*ratus.Updated, error)
 	// UpsertTask inserts or updates a task.
@@ -53,7 +78,7 @@ type Engine interface {
 	DeleteTask(ctx context.Context, id string) (*ratus.Deleted, error)
 
 	// ListPromises lists all promises in a topic.
-	ListPromises(ctx context.Context, topic string, limit, offset int) ([]*ratus.Promise, error)
+	ListPromises(ctx context.Context, topic string, p *Page) ([]*ratus.Promise, error)
 	// DeletePromises deletes all promises in a topic.
 	DeletePromises(ctx context.Context, topic string) (*ratus.Deleted, error)
 	// GetPromise gets a promise by the unique ID of its target task.
@@ -62,6 +87,257 @@ type Engine interface {
 	InsertPromise(ctx context.Context, p *ratus.Promise) (*ratus.Task, error)
 	// UpsertPromise makes a promise to claim and execute a task regardless of its current state.
 	UpsertPromise(ctx context.Context, p *ratus.Promise) (*ratus.Task, error)
+	// StealPromise transfers the promise of an active task to another consumer, invalidating the previous one.
+	StealPromise(ctx context.Context, p *ratus.Promise) (*ratus.Task, error)
 	// DeletePromise deletes a promise by the unique ID of its target task.
 	DeletePromise(ctx context.Context, id string) (*ratus.Deleted, error)
+
+	// ListConsumers lists the consumers of active tasks in all topics along with their promises.
+	ListConsumers(ctx context.Context) ([]*ratus.Consumer, error)
+}
+
+// Exporter defines the interface for exporting expired tasks before storage
+// engines delete them, allowing them to be retained outside of the storage.
+type Exporter interface {
+
+	// Export exports a batch of tasks. Tasks are only deleted if the export
+	// succeeds, and may be exported again if the deletion fails.
+	Export(ctx context.Context, ts []*ratus.Task) error
+}
+
+// Page specifies the range of resources to list. By default, resources are
+// listed in the ascending order of their keys, which are names of topics and
+// IDs of tasks and promises, so that they can be paginated either by skipping
+// a number of resources or by seeking past the position of the last resource
+// seen. Seeking remains efficient at large offsets while skipping does not.
+type Page struct {
+
+	// Maximum number of resources to return.
+	Limit int
+	// Number of resources to skip.
+	Offset int
+	// Time field to sort tasks by, ties are broken by the keys of the tasks.
+	// Resources are sorted by their keys if the field is empty or unknown.
+	Sort string
+	// Whether to list resources in descending order.
+	Desc bool
+	// If not empty, only resources positioned after the resource with the key
+	// are listed, which is applied before skipping.
+	After string
+	// Value of the sort field of the resource with the key of After, which is
+	// nil if the resource does not have the field. Resources missing the field
+	// are positioned before the others in ascending order.
+	Time *time.Time
+}
+
+// GroupConsumers groups active tasks by their consumers, which are ordered by
+// their names along with the promises ordered by the IDs of the tasks. The
+// time a consumer was last seen is the latest time it consumed a task.
+func GroupConsumers(ts []*ratus.Task) []*ratus.Consumer {
+	m := make(map[string]*ratus.Consumer)
+	for _, t := range ts {
+		c, ok := m[t.Consumer]
+		if !ok {
+			c = &ratus.Consumer{Name: t.Consumer}
+			m[t.Consumer] = c
+		}
+		if t.Consumed != nil && (c.Seen == nil || t.Consumed.After(*c.Seen)) {
+			c.Seen = t.Consumed
+		}
+		c.Promises = append(c.Promises, &ratus.Promise{
+			ID:       t.ID,
+			Consumer: t.Consumer,
+			Deadline: t.Deadline,
+		})
+	}
+	v := make([]*ratus.Consumer, 0, len(m))
+	for _, c := range m {
+		slices.SortFunc(c.Promises, func(a, b *ratus.Promise) int {
+			return strings.Compare(a.ID, b.ID)
+		})
+		v = append(v, c)
+	}
+	slices.SortFunc(v, func(a, b *ratus.Consumer) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return v
+}
+
+// SumStats returns statistics across all topics by summing up the statistics
+// of each topic, which are ordered by their names.
+func SumStats(ts []*ratus.TopicStats) *ratus.Stats {
+	v := ratus.Stats{Topics: ts}
+	for _, t := range ts {
+		v.Count += t.Count
+		v.Pending += t.Pending
+		v.Active += t.Active
+		v.Completed += t.Completed
+		v.Archived += t.Archived
+		v.Failed += t.Failed
+	}
+	slices.SortFunc(v.Topics, func(a, b *ratus.TopicStats) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return &v
+}
+
+// Time fields that tasks can be sorted by.
+const (
+	SortScheduled = "scheduled"
+	SortProduced  = "produced"
+	SortConsumed  = "consumed"
+)
+
+// ByTime returns whether tasks are sorted by a time field.
+func (p *Page) ByTime() bool {
+	switch p.Sort {
+	case SortScheduled, SortProduced, SortConsumed:
+		return true
+	}
+	return false
+}
+
+// SortTime returns the value of the sort field of the task, which is nil if
+// the task does not have the field or the page is not sorted by time.
+func (p *Page) SortTime(t *ratus.Task) *time.Time {
+	switch p.Sort {
+	case SortScheduled:
+		return t.Scheduled
+	case SortProduced:
+		return t.Produced
+	case SortConsumed:
+		return t.Consumed
+	}
+	return nil
+}
+
+// BatchPoller defines the optional interface for storage engines that are
+// able to claim multiple tasks at once, allowing consumers executing tasks in
+// bulk to save round trips.
+type BatchPoller interface {
+
+	// PollTasks makes promises to claim and execute up to the limit of the
+	// next available tasks in a topic, which must be positive. It returns
+	// ErrNotFound if no task is available.
+	PollTasks(ctx context.Context, topic string, p *ratus.Promise, limit int) ([]*ratus.Task, error)
+}
+
+// Heartbeater defines the optional interface for storage engines that are
+// able to extend the deadlines of active tasks, allowing consumers executing
+// long-running tasks to keep their promises without claiming the tasks again.
+type Heartbeater interface {
+
+	// Heartbeat extends the deadline of an active task without changing its
+	// state, nonce or version. The nonce of the task is checked if the nonce
+	// is not empty.
+	Heartbeat(ctx context.Context, id, nonce string, deadline time.Time) (*ratus.Updated, error)
+}
+
+// Watcher defines the optional interface for storage engines that are able to
+// push notifications when tasks become available, allowing callers to avoid
+// polling the storage engine in tight loops.
+type Watcher interface {
+
+	// Watch blocks and calls the handler function with the name of the topic
+	// whenever a task in the topic may have become available for polling. An
+	// empty topic name indicates that tasks in any topic may be available.
+	Watch(ctx context.Context, f func(topic string)) error
+}
+
+// TaskWatcher defines the optional interface for storage engines that are
+// able to wait for changes of individual tasks, allowing callers awaiting the
+// completion of tasks to avoid checking them repeatedly.
+type TaskWatcher interface {
+
+	// WatchTask blocks until the version of the task differs from the version
+	// and returns the task, or returns ErrNotFound once the task is deleted.
+	WatchTask(ctx context.Context, id string, version int64) (*ratus.Task, error)
+}
+
+// Leaser defines the optional interface for storage engines that are able to
+// grant exclusive leases, allowing multiple instances sharing the same storage
+// to elect a leader for running jobs that should not run concurrently.
+type Leaser interface {
+
+	// Acquire acquires or renews the named lease for the holder for the
+	// duration, and returns whether the lease is held by the holder.
+	Acquire(ctx context.Context, name, holder string, d time.Duration) (bool, error)
+	// Release releases the named lease if it is held by the holder.
+	Release(ctx context.Context, name, holder string) error
+}
+
+// Announcer defines the optional interface for storage engines that are able
+// to keep track of the instances sharing the same storage, allowing instances
+// in different roles to be aware of each other.
+type Announcer interface {
+
+	// Announce records that the holder is alive in the role for the duration.
+	Announce(ctx context.Context, role, holder string, d time.Duration) error
+	// Announced lists the holders that are alive in the role.
+	Announced(ctx context.Context, role string) ([]string, error)
+}
+
+// Counter defines the optional interface for storage engines that are able to
+// count the resources in lists regardless of pagination, allowing total counts
+// to be returned along with pages of resources.
+type Counter interface {
+
+	// CountTopics counts all topics.
+	CountTopics(ctx context.Context) (int64, error)
+	// CountTasks counts all tasks in a topic that match the labels.
+	CountTasks(ctx context.Context, topic string, labels map[string]string) (int64, error)
+	// CountPromises counts all promises in a topic.
+	CountPromises(ctx context.Context, topic string) (int64, error)
+}
+
+// Capability is the name of an optional feature of storage engines.
+type Capability string
+
+// Optional features that storage engines may declare support for.
+const (
+
+	// CapabilityTTL indicates that completed tasks are deleted by Chore once
+	// they have been retained for longer than the retention period.
+	CapabilityTTL Capability = "ttl"
+
+	// CapabilityTransactions indicates that operations spanning multiple tasks
+	// are performed atomically.
+	CapabilityTransactions Capability = "transactions"
+
+	// CapabilityChangeStreams indicates that changes of tasks are pushed by the
+	// storage engine as they happen instead of being checked periodically.
+	CapabilityChangeStreams Capability = "change_streams"
+
+	// CapabilityFilteredList indicates that label selectors are applied when
+	// listing, counting and deleting tasks.
+	CapabilityFilteredList Capability = "filtered_list"
+
+	// CapabilityPriorities indicates that available tasks are polled in the
+	// order of their priorities in topics with priority polling enabled.
+	CapabilityPriorities Capability = "priorities"
+
+	// CapabilityBatchPoll indicates that multiple tasks can be claimed at once
+	// through the BatchPoller interface.
+	CapabilityBatchPoll Capability = "batch_poll"
+
+	// CapabilityHeartbeat indicates that the deadlines of active tasks can be
+	// extended through the Heartbeater interface.
+	CapabilityHeartbeat Capability = "heartbeat"
+)
+
+// Capabilities defines the optional interface for storage engines to declare
+// which optional features are supported, allowing callers and test suites to
+// probe for them.
+type Capabilities interface {
+
+	// Supports returns whether the storage engine supports the feature.
+	Supports(c Capability) bool
+}
+
+// Supports returns whether the storage engine declares support for the
+// feature. Storage engines that do not implement the Capabilities interface
+// are considered to support none of the optional features.
+func Supports(g Engine, c Capability) bool {
+	v, ok := g.(Capabilities)
+	return ok && v.Supports(c)
 }
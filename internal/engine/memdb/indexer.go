@@ -73,6 +73,11 @@ func (i *StateFieldIndex) FromArgs(args ...any) ([]byte, error) {
 // TimeFieldIndex encodes time fields for index building.
 type TimeFieldIndex struct {
 	Field string
+
+	// Index missing values as the zero time rather than treating them as
+	// missing, so that objects without the field can still be found through
+	// compound indexes and are ordered before the others.
+	Zero bool
 }
 
 // FromObject implements the memdb.SingleIndexer interface.
@@ -84,6 +89,9 @@ func (i *TimeFieldIndex) FromObject(obj any) (bool, []byte, error) {
 	v = v.FieldByName(i.Field)
 	v = reflect.Indirect(v)
 	if !v.IsValid() {
+		if i.Zero {
+			return true, i.encodeInt64(time.Time{}.UnixMilli()), nil
+		}
 		return false, nil, nil
 	}
 
@@ -106,6 +114,9 @@ func (i *TimeFieldIndex) FromArgs(args ...any) ([]byte, error) {
 	v := reflect.ValueOf(args[0])
 	v = reflect.Indirect(v)
 	if !v.IsValid() {
+		if i.Zero {
+			return i.encodeInt64(time.Time{}.UnixMilli()), nil
+		}
 		return nil, fmt.Errorf("%#v is invalid", args[0])
 	}
 
@@ -130,3 +141,126 @@ func (i *TimeFieldIndex) encodeInt64(v int64) []byte {
 	binary.BigEndian.PutUint64(b, uint64(v))
 	return b
 }
+
+// StringFieldIndex encodes string fields for index building. Unlike the
+// indexer provided by go-memdb, empty strings are indexed rather than being
+// treated as missing values, so that objects with empty fields can still be
+// found through compound indexes.
+type StringFieldIndex struct {
+	Field string
+}
+
+// FromObject implements the memdb.SingleIndexer interface.
+func (i *StringFieldIndex) FromObject(obj any) (bool, []byte, error) {
+
+	// Extract and validate the value.
+	v := reflect.ValueOf(obj)
+	v = reflect.Indirect(v)
+	v = v.FieldByName(i.Field)
+	v = reflect.Indirect(v)
+	if !v.IsValid() {
+		return false, nil, nil
+	}
+
+	// Check the type of the value.
+	if v.Kind() != reflect.String {
+		return false, nil, fmt.Errorf("field %q is of type %v; want a string", i.Field, v.Kind())
+	}
+
+	return true, i.encodeString(v.String()), nil
+}
+
+// FromArgs implements the memdb.Indexer interface.
+func (i *StringFieldIndex) FromArgs(args ...any) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("must provide only a single argument")
+	}
+
+	// Check the type of the value.
+	s, ok := args[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("arg is of type %T; want a string", args[0])
+	}
+
+	return i.encodeString(s), nil
+}
+
+// PrefixFromArgs implements the memdb.PrefixIndexer interface. Unlike the
+// indexer provided by go-memdb, the terminator is kept so that only values
+// equal to the argument are matched, which allows scanning compound indexes
+// by the leading field.
+func (i *StringFieldIndex) PrefixFromArgs(args ...any) ([]byte, error) {
+	return i.FromArgs(args...)
+}
+
+func (i *StringFieldIndex) encodeString(s string) []byte {
+
+	// Add the null character as a terminator so that a string is never a
+	// prefix of another string in compound indexes.
+	return append([]byte(s), 0)
+}
+
+// IntFieldIndex encodes signed integer fields for index building. Unlike the
+// indexer provided by go-memdb, values are encoded in a fixed length so that
+// the byte order of the keys follows the numeric order of the values.
+type IntFieldIndex struct {
+	Field string
+
+	// Order larger values before smaller ones.
+	Desc bool
+}
+
+// FromObject implements the memdb.SingleIndexer interface.
+func (i *IntFieldIndex) FromObject(obj any) (bool, []byte, error) {
+
+	// Extract and validate the value.
+	v := reflect.ValueOf(obj)
+	v = reflect.Indirect(v)
+	v = v.FieldByName(i.Field)
+	v = reflect.Indirect(v)
+	if !v.IsValid() {
+		return false, nil, nil
+	}
+
+	// Check the type of the value.
+	if !v.CanInt() {
+		return false, nil, fmt.Errorf("field %q is of type %v; want an int", i.Field, v.Kind())
+	}
+
+	return true, i.encodeInt64(v.Int()), nil
+}
+
+// FromArgs implements the memdb.Indexer interface.
+func (i *IntFieldIndex) FromArgs(args ...any) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("must provide only a single argument")
+	}
+
+	// Extract and validate the value.
+	v := reflect.ValueOf(args[0])
+	v = reflect.Indirect(v)
+	if !v.IsValid() {
+		return nil, fmt.Errorf("%#v is invalid", args[0])
+	}
+
+	// Check the type of the value.
+	if !v.CanInt() {
+		return nil, fmt.Errorf("arg is of type %v; want an int", v.Kind())
+	}
+
+	return i.encodeInt64(v.Int()), nil
+}
+
+func (i *IntFieldIndex) encodeInt64(v int64) []byte {
+
+	// Flip the sign bit in the same way as TimeFieldIndex, and invert all the
+	// bits to reverse the order if larger values should come first.
+	v = v ^ int64(-1<<63)
+	if i.Desc {
+		v = ^v
+	}
+
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(v))
+	return b
+}
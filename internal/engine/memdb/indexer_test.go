@@ -127,3 +127,158 @@ func TestIndexer(t *testing.T) {
 		})
 	}
 }
+
+func TestStringFieldIndex(t *testing.T) {
+	i := &memdb.StringFieldIndex{Field: "Producer"}
+
+	t.Run("object", func(t *testing.T) {
+		t.Run("normal", func(t *testing.T) {
+			ok, b, err := i.FromObject(&ratus.Task{Producer: "foo"})
+			if !ok || string(b) != "foo\x00" {
+				t.Fail()
+			}
+			if err != nil {
+				t.Error(err)
+			}
+		})
+
+		t.Run("empty", func(t *testing.T) {
+			ok, b, err := i.FromObject(&ratus.Task{})
+			if !ok || string(b) != "\x00" {
+				t.Fail()
+			}
+			if err != nil {
+				t.Error(err)
+			}
+		})
+
+		t.Run("invalid", func(t *testing.T) {
+			ok, _, err := i.FromObject(&struct{}{})
+			if ok {
+				t.Fail()
+			}
+			if err != nil {
+				t.Error(err)
+			}
+		})
+
+		t.Run("type", func(t *testing.T) {
+			ok, _, err := i.FromObject(&struct{ Producer int }{})
+			if ok {
+				t.Fail()
+			}
+			if err == nil {
+				t.Fail()
+			}
+		})
+	})
+
+	t.Run("args", func(t *testing.T) {
+		t.Run("normal", func(t *testing.T) {
+			b, err := i.FromArgs("")
+			if string(b) != "\x00" {
+				t.Fail()
+			}
+			if err != nil {
+				t.Error(err)
+			}
+		})
+
+		t.Run("count", func(t *testing.T) {
+			if _, err := i.FromArgs("a", "b"); err == nil {
+				t.Fail()
+			}
+		})
+
+		t.Run("type", func(t *testing.T) {
+			if _, err := i.FromArgs(1); err == nil {
+				t.Fail()
+			}
+		})
+
+		t.Run("prefix", func(t *testing.T) {
+			b, err := i.PrefixFromArgs("foo")
+			if string(b) != "foo\x00" {
+				t.Fail()
+			}
+			if err != nil {
+				t.Error(err)
+			}
+		})
+	})
+}
+
+func TestTimeFieldIndex(t *testing.T) {
+	i := &memdb.TimeFieldIndex{Field: "Consumed", Zero: true}
+	z, err := i.FromArgs(time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("object", func(t *testing.T) {
+		ok, b, err := i.FromObject(&ratus.Task{})
+		if !ok || string(b) != string(z) {
+			t.Fail()
+		}
+		if err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("args", func(t *testing.T) {
+		b, err := i.FromArgs((*time.Time)(nil))
+		if string(b) != string(z) {
+			t.Fail()
+		}
+		if err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestIntFieldIndex(t *testing.T) {
+	for _, x := range []struct {
+		name string
+		desc bool
+		want []int
+	}{
+		{"asc", false, []int{-2, -1, 0, 1, 2}},
+		{"desc", true, []int{2, 1, 0, -1, -2}},
+	} {
+		p := x
+		t.Run(p.name, func(t *testing.T) {
+			i := &memdb.IntFieldIndex{Field: "Priority", Desc: p.desc}
+			var l []byte
+			for _, v := range p.want {
+				ok, b, err := i.FromObject(&ratus.Task{Priority: v})
+				if !ok {
+					t.Fail()
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if l != nil && string(b) <= string(l) {
+					t.Errorf("incorrect order of %d", v)
+				}
+				l = b
+			}
+		})
+	}
+
+	t.Run("args", func(t *testing.T) {
+		i := &memdb.IntFieldIndex{Field: "Priority"}
+		b, err := i.FromArgs(1)
+		if err != nil {
+			t.Error(err)
+		}
+		if _, c, _ := i.FromObject(&ratus.Task{Priority: 1}); string(b) != string(c) {
+			t.Fail()
+		}
+		if _, err := i.FromArgs("1"); err == nil {
+			t.Fail()
+		}
+		if _, err := i.FromArgs(1, 2); err == nil {
+			t.Fail()
+		}
+	})
+}
@@ -2,65 +2,147 @@
 package memdb
 
 import (
+	"bufio"
+	"compress/gzip"
 	"context"
 	"encoding/gob"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
+	"log"
+	"net/http"
 	"os"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/hashicorp/go-memdb"
 
 	"github.com/hyperonym/ratus"
+	"github.com/hyperonym/ratus/clock"
+	"github.com/hyperonym/ratus/internal/engine"
 	"github.com/hyperonym/ratus/internal/nonce"
 )
 
 // Name constants for tables.
-const tableTask = "task"
+const (
+	tableTask   = "task"
+	tableTopic  = "topic"
+	tableSchema = "schema"
+)
 
 // Name constants for fields.
 const (
 	keyID        = "ID"
+	keyName      = "Name"
 	keyTopic     = "Topic"
+	keyProducer  = "Producer"
 	keyState     = "State"
+	keyProduced  = "Produced"
 	keyScheduled = "Scheduled"
 	keyConsumed  = "Consumed"
 	keyDeadline  = "Deadline"
+	keyDedup     = "Dedup"
+	keyLabels    = "Labels"
+	keyPriority  = "Priority"
 )
 
 // Name constants for index creation and selection.
 const (
-	indexID                    = "id"
-	indexTopic                 = "topic"
-	indexPendingTopicScheduled = "pending-topic-scheduled"
-	indexActiveDeadline        = "active-deadline"
-	indexActiveTopic           = "active-topic"
-	indexCompletedConsumed     = "completed-consumed "
+	indexID                            = "id"
+	indexTopic                         = "topic"
+	indexTopicID                       = "topic-id"
+	indexTopicScheduledID              = "topic-scheduled-id"
+	indexTopicProducedID               = "topic-produced-id"
+	indexTopicConsumedID               = "topic-consumed-id"
+	indexTopicDedup                    = "topic-dedup"
+	indexLabels                        = "labels"
+	indexPendingTopicScheduled         = "pending-topic-scheduled"
+	indexPendingTopicProducerScheduled = "pending-topic-producer-scheduled"
+	indexPendingTopicPriorityScheduled = "pending-topic-priority-scheduled"
+	indexPendingBlocked                = "pending-blocked"
+	indexActiveDeadline                = "active-deadline"
+	indexActiveTopicID                 = "active-topic-id"
+	indexCompletedConsumed             = "completed-consumed "
+	indexArchivedTopicConsumedID       = "archived-topic-consumed-id"
 )
 
+// snapshotFormat is the gzip header comment of snapshots consisting of
+// entries for both tasks and topics.
+const snapshotFormat = "ratus-entries"
+
 // Config contains configurations for the MemDB storage engine.
 type Config struct {
 	SnapshotPath     string        `arg:"--memdb-snapshot-path,env:MEMDB_SNAPSHOT_PATH" placeholder:"PATH" help:"path to the snapshot file" default:""`
 	SnapshotInterval time.Duration `arg:"--memdb-snapshot-interval,env:MEMDB_SNAPSHOT_INTERVAL" placeholder:"DURATION" help:"interval for writing snapshots to disk" default:"5m"`
 
+	EnableWAL       bool          `arg:"--memdb-enable-wal,env:MEMDB_ENABLE_WAL" help:"enable the write-ahead log to prevent losing tasks between snapshots"`
+	WALSyncInterval time.Duration `arg:"--memdb-wal-sync-interval,env:MEMDB_WAL_SYNC_INTERVAL" placeholder:"DURATION" help:"minimum interval for flushing the write-ahead log to disk, zero to flush on every write" default:"0s"`
+
+	ReplicationBind            string        `arg:"--memdb-replication-bind,env:MEMDB_REPLICATION_BIND" placeholder:"ADDR" help:"address on which to serve the replication stream to standby instances, empty to disable" default:""`
+	ReplicationPrimary         string        `arg:"--memdb-replication-primary,env:MEMDB_REPLICATION_PRIMARY" placeholder:"URL" help:"URL of the replication stream of the primary instance, runs as a read-only standby if specified" default:""`
+	ReplicationFailoverTimeout time.Duration `arg:"--memdb-replication-failover-timeout,env:MEMDB_REPLICATION_FAILOVER_TIMEOUT" placeholder:"DURATION" help:"duration of losing contact with the primary instance before promoting the standby instance to primary, zero to disable" default:"0s"`
+	ReplicationSecret          string        `arg:"--memdb-replication-secret,env:MEMDB_REPLICATION_SECRET" placeholder:"SECRET" help:"shared secret for authenticating the replication stream, required if replication is enabled" default:"" secret:"true"`
+
 	RetentionPeriod time.Duration `arg:"--memdb-retention-period,env:MEMDB_RETENTION_PERIOD" placeholder:"DURATION" help:"retention period for completed tasks" default:"72h"`
+	HistoryLimit    int           `arg:"--memdb-history-limit,env:MEMDB_HISTORY_LIMIT" placeholder:"N" help:"maximum number of state transitions recorded in the history of each task, zero to disable"`
+
+	// Handling of expired tasks inherited from the expiry configuration.
+	ExpiryTopic    string          `arg:"-"`
+	ExpiryExporter engine.Exporter `arg:"-"`
+
+	// Clock for telling the current time, which defaults to the system clock.
+	Clock clock.Clock `arg:"-"`
 }
 
 // Engine implements the storage engine interface for MemDB.
 type Engine struct {
 	config   *Config
+	clock    clock.Clock
 	schema   *memdb.DBSchema
 	database *memdb.MemDB
-
-	mux   sync.Mutex
-	saved time.Time
+	topics   *registry
+	log      *wal
+	feed     *feed
+	server   *http.Server
+	standby  atomic.Bool
+	deposed  atomic.Bool
+	term     atomic.Uint64
+
+	// Producers served last in topics with fair polling enabled, and lock for
+	// accessing them. Cursors are advanced after committing, when the write
+	// transaction no longer serializes access to them.
+	cursors map[string]string
+	cmux    sync.Mutex
+
+	// Watchers notified of topics with pending tasks after commits, and lock
+	// for accessing them.
+	watchers map[*watcher]struct{}
+	nmux     sync.Mutex
+
+	// Lock for serializing commits with writes to the write-ahead log and the
+	// replication feed, and lock for serializing snapshots.
+	wmux sync.Mutex
+	mux  sync.Mutex
+
+	// Lifecycle of the background goroutines.
+	wg     sync.WaitGroup
+	cancel context.CancelFunc
 }
 
 // New creates a new MemDB storage engine instance.
 func New(c *Config) (*Engine, error) {
+	if c.EnableWAL && c.SnapshotPath == "" {
+		return nil, errors.New("write-ahead log requires a snapshot path")
+	}
+	if c.HistoryLimit < 0 {
+		return nil, fmt.Errorf("invalid history limit %d", c.HistoryLimit)
+	}
+	if (c.ReplicationBind != "" || c.ReplicationPrimary != "") && c.ReplicationSecret == "" {
+		return nil, errors.New("replication requires a shared secret")
+	}
 
 	// Create the database schema.
 	s := memdb.DBSchema{
@@ -80,6 +162,70 @@ func New(c *Config) (*Engine, error) {
 						Unique:       false,
 						Indexer:      &memdb.StringFieldIndex{Field: keyTopic},
 					},
+					indexTopicID: {
+						Name:         indexTopicID,
+						AllowMissing: false,
+						Unique:       true,
+						Indexer: &memdb.CompoundIndex{
+							Indexes: []memdb.Indexer{
+								&StringFieldIndex{Field: keyTopic},
+								&memdb.StringFieldIndex{Field: keyID},
+							},
+						},
+					},
+					indexTopicScheduledID: {
+						Name:         indexTopicScheduledID,
+						AllowMissing: false,
+						Unique:       true,
+						Indexer: &memdb.CompoundIndex{
+							Indexes: []memdb.Indexer{
+								&StringFieldIndex{Field: keyTopic},
+								&TimeFieldIndex{Field: keyScheduled, Zero: true},
+								&memdb.StringFieldIndex{Field: keyID},
+							},
+						},
+					},
+					indexTopicProducedID: {
+						Name:         indexTopicProducedID,
+						AllowMissing: false,
+						Unique:       true,
+						Indexer: &memdb.CompoundIndex{
+							Indexes: []memdb.Indexer{
+								&StringFieldIndex{Field: keyTopic},
+								&TimeFieldIndex{Field: keyProduced, Zero: true},
+								&memdb.StringFieldIndex{Field: keyID},
+							},
+						},
+					},
+					indexTopicConsumedID: {
+						Name:         indexTopicConsumedID,
+						AllowMissing: false,
+						Unique:       true,
+						Indexer: &memdb.CompoundIndex{
+							Indexes: []memdb.Indexer{
+								&StringFieldIndex{Field: keyTopic},
+								&TimeFieldIndex{Field: keyConsumed, Zero: true},
+								&memdb.StringFieldIndex{Field: keyID},
+							},
+						},
+					},
+					indexTopicDedup: {
+						Name:         indexTopicDedup,
+						AllowMissing: true,
+						Unique:       false,
+						Indexer: &memdb.CompoundIndex{
+							Indexes: []memdb.Indexer{
+								&memdb.StringFieldIndex{Field: keyTopic},
+								&memdb.StringFieldIndex{Field: keyDedup},
+							},
+						},
+					},
+					indexLabels: {
+						Name:         indexLabels,
+						AllowMissing: true,
+						Unique:       false,
+						Indexer:      &memdb.StringMapFieldIndex{Field: keyLabels},
+					},
 					indexPendingTopicScheduled: {
 						Name:         indexPendingTopicScheduled,
 						AllowMissing: true,
@@ -92,6 +238,43 @@ func New(c *Config) (*Engine, error) {
 							},
 						},
 					},
+					indexPendingTopicProducerScheduled: {
+						Name:         indexPendingTopicProducerScheduled,
+						AllowMissing: true,
+						Unique:       false,
+						Indexer: &memdb.CompoundIndex{
+							Indexes: []memdb.Indexer{
+								&StateFieldIndex{Field: keyState, Filter: ratus.TaskStatePending},
+								&memdb.StringFieldIndex{Field: keyTopic},
+								&StringFieldIndex{Field: keyProducer},
+								&TimeFieldIndex{Field: keyScheduled},
+							},
+						},
+					},
+					indexPendingTopicPriorityScheduled: {
+						Name:         indexPendingTopicPriorityScheduled,
+						AllowMissing: true,
+						Unique:       false,
+						Indexer: &memdb.CompoundIndex{
+							Indexes: []memdb.Indexer{
+								&StateFieldIndex{Field: keyState, Filter: ratus.TaskStatePending},
+								&memdb.StringFieldIndex{Field: keyTopic},
+								&IntFieldIndex{Field: keyPriority, Desc: true},
+								&TimeFieldIndex{Field: keyScheduled},
+							},
+						},
+					},
+					indexPendingBlocked: {
+						Name:         indexPendingBlocked,
+						AllowMissing: true,
+						Unique:       false,
+						Indexer: &memdb.CompoundIndex{
+							Indexes: []memdb.Indexer{
+								&StateFieldIndex{Field: keyState, Filter: ratus.TaskStatePending},
+								&memdb.ConditionalIndex{Conditional: blocked},
+							},
+						},
+					},
 					indexActiveDeadline: {
 						Name:         indexActiveDeadline,
 						AllowMissing: true,
@@ -103,14 +286,15 @@ func New(c *Config) (*Engine, error) {
 							},
 						},
 					},
-					indexActiveTopic: {
-						Name:         indexActiveTopic,
+					indexActiveTopicID: {
+						Name:         indexActiveTopicID,
 						AllowMissing: true,
-						Unique:       false,
+						Unique:       true,
 						Indexer: &memdb.CompoundIndex{
 							Indexes: []memdb.Indexer{
 								&StateFieldIndex{Field: keyState, Filter: ratus.TaskStateActive},
-								&memdb.StringFieldIndex{Field: keyTopic},
+								&StringFieldIndex{Field: keyTopic},
+								&memdb.StringFieldIndex{Field: keyID},
 							},
 						},
 					},
@@ -125,14 +309,57 @@ func New(c *Config) (*Engine, error) {
 							},
 						},
 					},
+					indexArchivedTopicConsumedID: {
+						Name:         indexArchivedTopicConsumedID,
+						AllowMissing: true,
+						Unique:       false,
+						Indexer: &memdb.CompoundIndex{
+							Indexes: []memdb.Indexer{
+								&StateFieldIndex{Field: keyState, Filter: ratus.TaskStateArchived},
+								&StringFieldIndex{Field: keyTopic},
+								&TimeFieldIndex{Field: keyConsumed, Zero: true},
+								&memdb.StringFieldIndex{Field: keyID},
+							},
+						},
+					},
+				},
+			},
+			tableTopic: {
+				Name: tableTopic,
+				Indexes: map[string]*memdb.IndexSchema{
+					indexID: {
+						Name:         indexID,
+						AllowMissing: false,
+						Unique:       true,
+						Indexer:      &memdb.StringFieldIndex{Field: keyName},
+					},
+				},
+			},
+			tableSchema: {
+				Name: tableSchema,
+				Indexes: map[string]*memdb.IndexSchema{
+					indexID: {
+						Name:         indexID,
+						AllowMissing: false,
+						Unique:       true,
+						Indexer:      &memdb.StringFieldIndex{Field: keyName},
+					},
 				},
 			},
 		},
 	}
 
+	k := c.Clock
+	if k == nil {
+		k = clock.System
+	}
+
 	return &Engine{
-		config: c,
-		schema: &s,
+		config:   c,
+		clock:    k,
+		schema:   &s,
+		cursors:  make(map[string]string),
+		watchers: make(map[*watcher]struct{}),
 	}, nil
 }
 
@@ -150,14 +377,88 @@ func (g *Engine) Open(ctx context.Context) error {
 		}
 	}
 
+	// Replay changes made after the last snapshot and start a new segment of
+	// the write-ahead log if required.
+	if g.config.EnableWAL {
+		p := walPath(g.config.SnapshotPath)
+		if err := replay(db, p); err != nil {
+			return err
+		}
+		w, err := newWAL(p, g.config.WALSyncInterval)
+		if err != nil {
+			return err
+		}
+		g.log = w
+	}
+
+	// Count tasks by topics and states to initialize the topic registry.
+	r, err := newRegistry(db)
+	if err != nil {
+		return err
+	}
+	g.topics = r
+
 	g.database = db
+
+	// Migrate the loaded data to the latest schema unless the instance is a
+	// standby, which receives migrated data from the primary instance.
+	if g.config.ReplicationPrimary == "" {
+		if err := engine.Migrate(ctx, g, g.schemaMigrations()); err != nil {
+			return err
+		}
+	}
+
+	// Serve the replication stream to standby instances if required.
+	if g.config.ReplicationBind != "" {
+		if err := g.listen(); err != nil {
+			return err
+		}
+	}
+
+	// Start background goroutines for writing snapshots and replicating from
+	// the primary instance if required.
+	c, cancel := context.WithCancel(context.Background())
+	g.cancel = cancel
+	if g.config.SnapshotPath != "" && g.config.SnapshotInterval > 0 {
+		g.wg.Add(1)
+		go g.snapshot(c)
+	}
+	if g.config.ReplicationPrimary != "" {
+		g.standby.Store(true)
+		g.wg.Add(1)
+		go g.follow(c)
+	}
+
 	return nil
 }
 
 // Close or disconnect from the storage engine.
 func (g *Engine) Close(ctx context.Context) error {
-	if g.config.SnapshotPath != "" {
-		return save(g.database, g.config.SnapshotPath)
+
+	// Stop background goroutines before writing the final snapshot.
+	if g.feed != nil {
+		g.feed.close()
+	}
+	if g.server != nil {
+		if err := g.server.Close(); err != nil {
+			return err
+		}
+		g.server = nil
+	}
+	if g.cancel != nil {
+		g.cancel()
+		g.wg.Wait()
+		g.cancel = nil
+	}
+
+	if g.config.SnapshotPath == "" {
+		return nil
+	}
+	if err := g.save(); err != nil {
+		return err
+	}
+	if g.log != nil {
+		return g.log.close()
 	}
 	return nil
 }
@@ -184,20 +485,133 @@ func (g *Engine) Ready(ctx context.Context) error {
 	if g.database == nil {
 		return ratus.ErrServiceUnavailable
 	}
+	if g.standby.Load() {
+		return errStandby
+	}
+	return nil
+}
+
+// Supports returns whether the storage engine supports the optional feature.
+func (g *Engine) Supports(c engine.Capability) bool {
+	switch c {
+	case engine.CapabilityTTL, engine.CapabilityTransactions, engine.CapabilityChangeStreams, engine.CapabilityFilteredList, engine.CapabilityBatchPoll, engine.CapabilityHeartbeat, engine.CapabilityPriorities:
+		return true
+	}
+	return false
+}
+
+// begin starts a write transaction with changes tracked.
+func (g *Engine) begin() *memdb.Txn {
+	txn := g.database.Txn(true)
+	txn.TrackChanges()
+	return txn
+}
+
+// commit commits a write transaction started by begin. Writes are rejected
+// if the instance is a standby.
+func (g *Engine) commit(txn *memdb.Txn) error {
+	if g.standby.Load() {
+		return errStandby
+	}
+	return g.write(txn)
+}
+
+// write commits a write transaction started by begin. Changes made in the
+// transaction are written to the write-ahead log before committing if the
+// write-ahead log is enabled, published to standby instances after committing
+// if replication is enabled, and are applied to the topic registry and
+// notified to watchers at last.
+func (g *Engine) write(txn *memdb.Txn) error {
+	cs := txn.Changes()
+	if g.log == nil && g.feed == nil {
+		txn.Commit()
+		g.topics.apply(cs)
+		g.notify(cs)
+		return nil
+	}
+
+	es := entries(cs)
+	g.wmux.Lock()
+	if g.log != nil {
+		if err := g.log.write(es); err != nil {
+			g.wmux.Unlock()
+			return err
+		}
+	}
+	txn.Commit()
+	if g.feed != nil {
+		g.feed.publish(es)
+	}
+	g.wmux.Unlock()
+
+	g.topics.apply(cs)
+	g.notify(cs)
 	return nil
 }
 
+// snapshot writes snapshots at the configured interval until the context is
+// canceled. Errors are logged rather than returned to keep the goroutine
+// running.
+func (g *Engine) snapshot(ctx context.Context) {
+	defer g.wg.Done()
+	t := time.NewTicker(g.config.SnapshotInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := g.save(); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+// save writes a snapshot of the database to the snapshot file. If the
+// write-ahead log is enabled, segments covered by the snapshot are removed
+// after the snapshot has been written.
+func (g *Engine) save() error {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	if g.log == nil {
+		return save(g.database, g.config.SnapshotPath)
+	}
+
+	// Take a snapshot and start a new segment without allowing any commits in
+	// between.
+	g.wmux.Lock()
+	s := g.database.Snapshot()
+	done, err := g.log.rotate()
+	g.wmux.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := save(s, g.config.SnapshotPath); err != nil {
+		return err
+	}
+	return done()
+}
+
+// walPath returns the path prefix of the write-ahead log segments.
+func walPath(snapshotPath string) string {
+	return snapshotPath + ".wal"
+}
+
 // updateOpsRecover returns a copy of the task with the state set back to
 // "pending" and the nonce field cleared to invalidate subsequent commits.
+// Like other update operations, the version of the task is incremented.
 func updateOpsRecover(v *ratus.Task) *ratus.Task {
 	u := clone(v)
 	u.State = ratus.TaskStatePending
 	u.Nonce = ""
+	u.Version++
 	return u
 }
 
-// updateOpsConsume returns a copy of the task with the state set to "active"
-// and other fields populated with data from the promise.
+// updateOpsConsume returns a copy of the task with the state set to "active",
+// or "completed" if the promise is delivered at most once, and other fields
+// populated with data from the promise.
 func updateOpsConsume(v *ratus.Task, p *ratus.Promise, t time.Time) *ratus.Task {
 	u := clone(v)
 	u.State = ratus.TaskStateActive
@@ -205,6 +619,13 @@ func updateOpsConsume(v *ratus.Task, p *ratus.Promise, t time.Time) *ratus.Task
 	u.Consumer = p.Consumer
 	u.Consumed = &t
 	u.Deadline = p.Deadline
+	u.Progress = nil
+	u.Version++
+	if p.AtMostOnce {
+		u.State = ratus.TaskStateCompleted
+		u.Nonce = ""
+		u.Deadline = nil
+	}
 	return u
 }
 
@@ -213,6 +634,7 @@ func updateOpsConsume(v *ratus.Task, p *ratus.Promise, t time.Time) *ratus.Task
 func updateOpsCommit(v *ratus.Task, m *ratus.Commit) *ratus.Task {
 	u := clone(v)
 	u.Nonce = ""
+	u.Version++
 	if m.Topic != "" {
 		u.Topic = m.Topic
 	}
@@ -225,6 +647,27 @@ func updateOpsCommit(v *ratus.Task, m *ratus.Commit) *ratus.Task {
 	if m.Payload != nil {
 		u.Payload = m.Payload
 	}
+	if m.Result != nil {
+		u.Result = m.Result
+	}
+	if m.Error != "" {
+		u.LastError = m.Error
+	}
+	return u
+}
+
+// record appends the transition to the history of the task, keeping at most
+// the specified number of the latest transitions. The history is copied to
+// avoid modifying the one shared with the original task.
+func record(u *ratus.Task, e *ratus.Transition, limit int) *ratus.Task {
+	if limit <= 0 {
+		return u
+	}
+	h := u.History
+	if len(h) >= limit {
+		h = h[len(h)-limit+1:]
+	}
+	u.History = append(append(make([]*ratus.Transition, 0, len(h)+1), h...), e)
 	return u
 }
 
@@ -235,7 +678,9 @@ func clone[T any](v *T) *T {
 	return &u
 }
 
-// save writes a snapshot of the database to a file.
+// save writes a gzip compressed snapshot of the database to a file. The
+// snapshot is written to a temporary file first, which is then flushed to disk
+// and renamed to replace the previous snapshot atomically.
 func save(db *memdb.MemDB, path string) error {
 
 	// Create a temporary file for writing the snapshot.
@@ -245,36 +690,62 @@ func save(db *memdb.MemDB, path string) error {
 		return err
 	}
 
-	// Rename or delete the temporary file before returning.
+	// Delete the temporary file before returning if the operation failed.
 	var ok bool
 	defer func() {
-		f.Close()
 		if !ok {
+			f.Close()
 			os.Remove(p)
-		} else {
-			os.Rename(p, path)
 		}
 	}()
 
-	// Create a snapshot of the database and encode all records.
-	enc := gob.NewEncoder(f)
-	txn := db.Snapshot().Txn(false)
-	defer txn.Abort()
-	it, err := txn.Get(tableTask, indexID)
+	// Encode entries for all records in the database. The gzip format includes
+	// a CRC-32 checksum of the uncompressed data, which will be verified when
+	// loading the snapshot. The header comment marks the format of the records
+	// to distinguish it from snapshots consisting of tasks only.
+	es, err := dump(db)
 	if err != nil {
 		return err
 	}
-	for r := it.Next(); r != nil; r = it.Next() {
-		if err := enc.Encode(r); err != nil {
+	z := gzip.NewWriter(f)
+	z.Comment = snapshotFormat
+	enc := gob.NewEncoder(z)
+	for i := range es {
+		if err := enc.Encode(&es[i]); err != nil {
 			return err
 		}
 	}
-	txn.Commit()
+	if err := z.Close(); err != nil {
+		return err
+	}
+
+	// Flush the file to disk before renaming to make sure that the snapshot
+	// file is always complete.
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(p, path); err != nil {
+		return err
+	}
 
 	// Mark the operation as successful.
 	ok = true
 
-	return nil
+	// Flush the directory to persist the rename.
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir flushes the directory entries to disk.
+func syncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
 }
 
 // load recovers data from a snapshot file.
@@ -290,22 +761,52 @@ func load(db *memdb.MemDB, path string) error {
 	}
 	defer f.Close()
 
+	// Snapshots written by previous versions are not compressed, which can be
+	// distinguished by the absence of the gzip magic number.
+	var r io.Reader = bufio.NewReader(f)
+	var format string
+	if b, err := r.(*bufio.Reader).Peek(2); err == nil && b[0] == 0x1f && b[1] == 0x8b {
+		z, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer z.Close()
+		r = z
+		format = z.Comment
+	}
+
 	// Decode records in the snapshot file and insert them into the database.
-	dec := gob.NewDecoder(f)
+	// Records are decoded until the end of the file, at which point the gzip
+	// reader verifies the checksum and reports corrupted snapshots. Snapshots
+	// written by previous versions consist of tasks rather than entries.
+	dec := gob.NewDecoder(r)
 	txn := db.Txn(true)
 	defer txn.Abort()
 	for {
-		var t ratus.Task
-		if err := dec.Decode(&t); err != nil {
+		var e entry
+		var err error
+		if format == snapshotFormat {
+			err = dec.Decode(&e)
+		} else {
+			e.Task = new(ratus.Task)
+			err = dec.Decode(e.Task)
+		}
+		if err != nil {
 			if errors.Is(err, io.EOF) {
 				break
 			}
-			return err
+			return fmt.Errorf("failed to load snapshot %q: %w", path, err)
 		}
-		if err := txn.Insert(tableTask, &t); err != nil {
+		if err := applyEntry(txn, &e); err != nil {
 			return err
 		}
 	}
+
+	// Corrupted data may end the decoding early, drain the rest of the file
+	// to make sure that the checksum is always verified.
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return fmt.Errorf("failed to load snapshot %q: %w", path, err)
+	}
 	txn.Commit()
 
 	return nil
@@ -2,10 +2,14 @@ package memdb_test
 
 import (
 	"context"
+	"encoding/gob"
 	"encoding/json"
 	"errors"
 	"io/fs"
+	"net"
+	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -13,11 +17,14 @@ import (
 	"github.com/alexflint/go-arg"
 
 	"github.com/hyperonym/ratus"
+	"github.com/hyperonym/ratus/clock"
 	"github.com/hyperonym/ratus/internal/engine"
+	"github.com/hyperonym/ratus/internal/engine/benchsuite"
+	"github.com/hyperonym/ratus/internal/engine/chaossuite"
 	"github.com/hyperonym/ratus/internal/engine/memdb"
 )
 
-func skipShort(t *testing.T) {
+func skipShort(t testing.TB) {
 	if testing.Short() {
 		t.Skip("skipping testing in short mode")
 	}
@@ -57,6 +64,15 @@ func TestConfig(t *testing.T) {
 	if c.RetentionPeriod != 24*time.Hour {
 		t.Fail()
 	}
+	if c.EnableWAL || c.WALSyncInterval != 0 {
+		t.Fail()
+	}
+	if _, err := memdb.New(&memdb.Config{EnableWAL: true}); err == nil {
+		t.Error("expected error for enabling write-ahead log without snapshot path")
+	}
+	if _, err := memdb.New(&memdb.Config{HistoryLimit: -1}); err == nil {
+		t.Error("expected error for negative history limit")
+	}
 }
 
 func TestSuite(t *testing.T) {
@@ -70,6 +86,28 @@ func TestSuite(t *testing.T) {
 	engine.Test(t, g)
 }
 
+func TestChaos(t *testing.T) {
+	skipShort(t)
+	g, err := memdb.New(&memdb.Config{
+		RetentionPeriod: 10 * time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chaossuite.Test(t, g)
+}
+
+func BenchmarkSuite(b *testing.B) {
+	skipShort(b)
+	g, err := memdb.New(&memdb.Config{
+		RetentionPeriod: 10 * time.Minute,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchsuite.Benchmark(b, g)
+}
+
 func TestSnapshot(t *testing.T) {
 	skipShort(t)
 	ctx := context.Background()
@@ -77,7 +115,7 @@ func TestSnapshot(t *testing.T) {
 	os.Remove(p)
 	g, err := memdb.New(&memdb.Config{
 		SnapshotPath:     p,
-		SnapshotInterval: 5 * time.Minute,
+		SnapshotInterval: 100 * time.Millisecond,
 		RetentionPeriod:  10 * time.Minute,
 	})
 	if err != nil {
@@ -109,14 +147,14 @@ func TestSnapshot(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	t.Run("chore", func(t *testing.T) {
-		if err := g.Chore(ctx); err != nil {
-			t.Error(err)
+	t.Run("background", func(t *testing.T) {
+		for i := 0; i < 20 && !exists(t, p); i++ {
+			time.Sleep(50 * time.Millisecond)
 		}
 		if !exists(t, p) {
 			t.Fail()
 		}
-		if err := g.Chore(ctx); err != nil {
+		if _, err := g.Chore(ctx); err != nil {
 			t.Error(err)
 		}
 	})
@@ -139,6 +177,9 @@ func TestSnapshot(t *testing.T) {
 		}); err != nil {
 			t.Error(err)
 		}
+		if _, err := g.UpsertTopic(ctx, &ratus.Topic{Name: "test", Retention: "1h"}); err != nil {
+			t.Error(err)
+		}
 		if err := g.Close(ctx); err != nil {
 			t.Error(err)
 		}
@@ -159,7 +200,7 @@ func TestSnapshot(t *testing.T) {
 		if err := u.Open(ctx); err != nil {
 			t.Fatal(err)
 		}
-		v, err := u.ListTasks(ctx, "test", 10, 0)
+		v, err := u.ListTasks(ctx, "test", nil, &engine.Page{Limit: 10})
 		if err != nil {
 			t.Error(err)
 		}
@@ -206,6 +247,11 @@ func TestSnapshot(t *testing.T) {
 		} else {
 			t.Error(err)
 		}
+		if c, err := u.GetTopic(ctx, "test"); err != nil {
+			t.Error(err)
+		} else if c.Count != 3 || c.Retention != "1h" {
+			t.Errorf("incorrect topic, expected 3 tasks with retention period, got %+v", c)
+		}
 		if err := u.Destroy(ctx); err != nil {
 			t.Error(err)
 		}
@@ -215,11 +261,514 @@ func TestSnapshot(t *testing.T) {
 	})
 }
 
-func TestExpire(t *testing.T) {
+func TestCorruptedSnapshot(t *testing.T) {
+	skipShort(t)
+	ctx := context.Background()
+	p := filepath.Join(t.TempDir(), "test.db")
+	c := memdb.Config{
+		SnapshotPath:     p,
+		SnapshotInterval: 5 * time.Minute,
+		RetentionPeriod:  10 * time.Minute,
+	}
+	g, err := memdb.New(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	n := time.Now()
+	if _, err := g.InsertTask(ctx, &ratus.Task{ID: "1", Topic: "test", State: ratus.TaskStatePending, Scheduled: &n, Payload: strings.Repeat("hello", 100)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Flip a byte in the compressed data to fail checksum verification.
+	b, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[len(b)/2] ^= 0xff
+	if err := os.WriteFile(p, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	u, err := memdb.New(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := u.Open(ctx); err == nil {
+		t.Error("expected error for corrupted snapshot")
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	skipShort(t)
+	ctx := context.Background()
+	p := filepath.Join(t.TempDir(), "test.db")
+	c := memdb.Config{
+		SnapshotPath:     p,
+		SnapshotInterval: 5 * time.Minute,
+		RetentionPeriod:  10 * time.Minute,
+	}
+
+	// Write a snapshot in the format of previous versions, which consists of
+	// uncompressed tasks created before versions were tracked.
+	f, err := os.Create(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := time.Now()
+	if err := gob.NewEncoder(f).Encode(&ratus.Task{ID: "1", Topic: "test", State: ratus.TaskStatePending, Scheduled: &n}); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Tasks are backfilled and the latest schema version is recorded once the
+	// engine has been opened.
+	g, err := memdb.New(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if x, err := g.GetTask(ctx, "1"); err != nil {
+		t.Error(err)
+	} else if x.Version != 1 {
+		t.Errorf("incorrect version, expected 1, got %d", x.Version)
+	}
+	v, err := g.SchemaVersion(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v < 1 {
+		t.Errorf("incorrect schema version, expected at least 1, got %d", v)
+	}
+
+	// Recorded versions never decrease.
+	if err := g.SetSchemaVersion(ctx, 0); err != nil {
+		t.Error(err)
+	}
+	if u, err := g.SchemaVersion(ctx); err != nil || u != v {
+		t.Errorf("incorrect schema version, expected %d, got %d (%v)", v, u, err)
+	}
+
+	// The schema version is kept in snapshots, and data migrated by newer
+	// releases is refused.
+	if err := g.SetSchemaVersion(ctx, v+1); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	u, err := memdb.New(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := u.Open(ctx); err == nil {
+		t.Error("expected error, got nil")
+	}
+}
+
+func TestWAL(t *testing.T) {
+	skipShort(t)
+	ctx := context.Background()
+	p := filepath.Join(t.TempDir(), "test.db")
+	c := memdb.Config{
+		SnapshotPath:     p,
+		SnapshotInterval: 5 * time.Minute,
+		RetentionPeriod:  10 * time.Minute,
+		EnableWAL:        true,
+	}
+	g, err := memdb.New(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Make changes without closing the engine to simulate a crash.
+	n := time.Now()
+	if _, err := g.InsertTasks(ctx, []*ratus.Task{
+		{ID: "1", Topic: "test", State: ratus.TaskStatePending, Scheduled: &n, Payload: "hello"},
+		{ID: "2", Topic: "test", State: ratus.TaskStatePending, Scheduled: &n},
+		{ID: "3", Topic: "test", State: ratus.TaskStatePending, Scheduled: &n},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.Poll(ctx, "test", &ratus.Promise{Consumer: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.DeleteTask(ctx, "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("interrupted", func(t *testing.T) {
+
+		// Copy the log with the last transaction cut short to simulate a
+		// crash in the middle of writing it.
+		m, err := filepath.Glob(p + ".wal.*")
+		if err != nil || len(m) != 1 {
+			t.Fatalf("incorrect segments, expected 1, got %v", m)
+		}
+		a, err := os.ReadFile(m[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := g.InsertTasks(ctx, []*ratus.Task{
+			{ID: "4", Topic: "test", State: ratus.TaskStatePending, Scheduled: &n},
+			{ID: "5", Topic: "test", State: ratus.TaskStatePending, Scheduled: &n},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.ReadFile(m[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := filepath.Join(t.TempDir(), "test.db")
+		if err := os.WriteFile(q+".wal.1", b[:len(b)-(len(b)-len(a))/2], 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		// The interrupted transaction should be discarded as a whole.
+		d := c
+		d.SnapshotPath = q
+		u, err := memdb.New(&d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := u.Open(ctx); err != nil {
+			t.Fatal(err)
+		}
+		v, err := u.ListTasks(ctx, "test", nil, &engine.Page{Limit: 10})
+		if err != nil {
+			t.Error(err)
+		}
+		if len(v) != 2 {
+			t.Errorf("incorrect number of results, expected %d, got %d", 2, len(v))
+		}
+		if err := u.Destroy(ctx); err != nil {
+			t.Error(err)
+		}
+
+		for _, id := range []string{"4", "5"} {
+			if _, err := g.DeleteTask(ctx, id); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+
+	t.Run("replay", func(t *testing.T) {
+		u, err := memdb.New(&c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := u.Open(ctx); err != nil {
+			t.Fatal(err)
+		}
+		v, err := u.ListTasks(ctx, "test", nil, &engine.Page{Limit: 10})
+		if err != nil {
+			t.Error(err)
+		}
+		if len(v) != 2 {
+			t.Errorf("incorrect number of results, expected %d, got %d", 2, len(v))
+		}
+		if v, err := u.GetTask(ctx, "1"); err != nil {
+			t.Error(err)
+		} else if v.State != ratus.TaskStateActive || v.Payload != "hello" {
+			t.Errorf("incorrect task after replay: %+v", v)
+		}
+
+		// Segments should be removed after writing the snapshot on close.
+		if err := u.Close(ctx); err != nil {
+			t.Error(err)
+		}
+		if m, _ := filepath.Glob(p + ".wal.*"); len(m) != 0 {
+			t.Errorf("incorrect number of segments, expected 0, got %d", len(m))
+		}
+	})
+
+	t.Run("snapshot", func(t *testing.T) {
+		u, err := memdb.New(&c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := u.Open(ctx); err != nil {
+			t.Fatal(err)
+		}
+		v, err := u.ListTasks(ctx, "test", nil, &engine.Page{Limit: 10})
+		if err != nil {
+			t.Error(err)
+		}
+		if len(v) != 2 {
+			t.Errorf("incorrect number of results, expected %d, got %d", 2, len(v))
+		}
+		if err := u.Destroy(ctx); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestTopicRegistry(t *testing.T) {
+	skipShort(t)
+	ctx := context.Background()
+	p := filepath.Join(t.TempDir(), "test.db")
+	c := memdb.Config{
+		SnapshotPath:     p,
+		SnapshotInterval: 5 * time.Minute,
+		RetentionPeriod:  10 * time.Minute,
+	}
+	g, err := memdb.New(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Move a task to another topic and complete it.
+	n := time.Now()
+	if _, err := g.InsertTasks(ctx, []*ratus.Task{
+		{ID: "1", Topic: "b", State: ratus.TaskStatePending, Scheduled: &n},
+		{ID: "2", Topic: "b", State: ratus.TaskStatePending, Scheduled: &n},
+		{ID: "3", Topic: "c", State: ratus.TaskStatePending, Scheduled: &n},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	s := ratus.TaskStateCompleted
+	if _, err := g.Commit(ctx, "3", &ratus.Commit{Topic: "a", State: &s}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.DeleteTask(ctx, "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(t *testing.T, g *memdb.Engine) {
+		t.Helper()
+		v, err := g.ListTopics(ctx, &engine.Page{Limit: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(v) != 2 || v[0].Name != "a" || v[1].Name != "b" {
+			t.Errorf("incorrect topics, expected [a b], got %v", v)
+		}
+		if x, err := g.GetTopic(ctx, "a"); err != nil || x.Count != 1 || x.Completed != 1 {
+			t.Errorf("incorrect topic statistics: %+v (%v)", x, err)
+		}
+		if x, err := g.GetTopic(ctx, "b"); err != nil || x.Count != 1 || x.Pending != 1 {
+			t.Errorf("incorrect topic statistics: %+v (%v)", x, err)
+		}
+		if _, err := g.GetTopic(ctx, "c"); !errors.Is(err, ratus.ErrNotFound) {
+			t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrNotFound, err)
+		}
+	}
+	check(t, g)
+
+	// The registry should be rebuilt from the snapshot on open.
+	if err := g.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	u, err := memdb.New(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := u.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	check(t, u)
+	if err := u.Destroy(ctx); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReplication(t *testing.T) {
 	skipShort(t)
 	ctx := context.Background()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := l.Addr().String()
+	l.Close()
+	if _, err := memdb.New(&memdb.Config{ReplicationBind: a}); err == nil {
+		t.Error("expected error, got nil")
+	}
+	primary := &memdb.Config{
+		RetentionPeriod:   10 * time.Minute,
+		ReplicationBind:   a,
+		ReplicationSecret: "secret",
+	}
+	g, err := memdb.New(primary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	n := time.Now()
+	if _, err := g.InsertTasks(ctx, []*ratus.Task{
+		{ID: "1", Topic: "test", State: ratus.TaskStatePending, Scheduled: &n, Payload: "hello"},
+		{ID: "2", Topic: "test", State: ratus.TaskStatePending, Scheduled: &n},
+		{ID: "a", Topic: "fair", Producer: "a", State: ratus.TaskStatePending, Scheduled: &n},
+		{ID: "b", Topic: "fair", Producer: "b", State: ratus.TaskStatePending, Scheduled: &n},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.UpsertTopic(ctx, &ratus.Topic{Name: "fair", Fair: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Start a standby instance after inserting tasks into the primary.
+	u, err := memdb.New(&memdb.Config{
+		RetentionPeriod:            10 * time.Minute,
+		ReplicationPrimary:         "http://" + a,
+		ReplicationFailoverTimeout: time.Second,
+		ReplicationSecret:          "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := u.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	wait := func(t *testing.T, f func() bool) {
+		t.Helper()
+		d := time.Now().Add(10 * time.Second)
+		for !f() {
+			if time.Now().After(d) {
+				t.Fatal("timed out waiting for replication")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	t.Run("standby", func(t *testing.T) {
+		wait(t, func() bool {
+			v, err := u.GetTopic(ctx, "test")
+			return err == nil && v.Count == 2
+		})
+		if _, err := g.Poll(ctx, "test", &ratus.Promise{Consumer: "test"}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := g.DeleteTask(ctx, "2"); err != nil {
+			t.Fatal(err)
+		}
+		wait(t, func() bool {
+			v, err := u.GetTopic(ctx, "test")
+			return err == nil && v.Count == 1 && v.Active == 1
+		})
+		if v, err := u.GetTask(ctx, "1"); err != nil {
+			t.Error(err)
+		} else if v.State != ratus.TaskStateActive || v.Payload != "hello" {
+			t.Errorf("incorrect replicated task: %+v", v)
+		}
+
+		// Standby instances should reject writes.
+		if err := u.Ready(ctx); !errors.Is(err, ratus.ErrServiceUnavailable) {
+			t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrServiceUnavailable, err)
+		}
+		if _, err := u.DeleteTask(ctx, "1"); !errors.Is(err, ratus.ErrServiceUnavailable) {
+			t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrServiceUnavailable, err)
+		}
+		if _, err := u.Poll(ctx, "fair", &ratus.Promise{Consumer: "test"}); !errors.Is(err, ratus.ErrServiceUnavailable) {
+			t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrServiceUnavailable, err)
+		}
+	})
+
+	t.Run("unauthenticated", func(t *testing.T) {
+		for _, k := range []string{"", "wrong"} {
+			req, err := http.NewRequest(http.MethodGet, "http://"+a, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", "Bearer "+k)
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.StatusCode != http.StatusUnauthorized {
+				t.Errorf("incorrect status code, expected %d, got %d", http.StatusUnauthorized, res.StatusCode)
+			}
+		}
+
+		// Standby instances that have never synchronized with the primary
+		// must not promote themselves.
+		v, err := memdb.New(&memdb.Config{
+			RetentionPeriod:            10 * time.Minute,
+			ReplicationPrimary:         "http://" + a,
+			ReplicationFailoverTimeout: time.Millisecond,
+			ReplicationSecret:          "wrong",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := v.Open(ctx); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(1500 * time.Millisecond)
+		if err := v.Ready(ctx); !errors.Is(err, ratus.ErrServiceUnavailable) {
+			t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrServiceUnavailable, err)
+		}
+		if err := v.Close(ctx); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("failover", func(t *testing.T) {
+		if err := g.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+		wait(t, func() bool {
+			return u.Ready(ctx) == nil
+		})
+		if _, err := u.DeleteTask(ctx, "1"); err != nil {
+			t.Error(err)
+		}
+
+		// Rejected polls should not advance the cursors of fair polling.
+		if v, err := u.Poll(ctx, "fair", &ratus.Promise{Consumer: "test"}); err != nil {
+			t.Error(err)
+		} else if v.Producer != "a" {
+			t.Errorf("incorrect producer, expected %q, got %q", "a", v.Producer)
+		}
+
+		// The former primary steps down once the promoted instance reaches
+		// it, even after being restarted.
+		g, err := memdb.New(primary)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := g.Open(ctx); err != nil {
+			t.Fatal(err)
+		}
+		wait(t, func() bool {
+			return g.Ready(ctx) != nil
+		})
+		if _, err := g.InsertTask(ctx, &ratus.Task{ID: "3", Topic: "test"}); !errors.Is(err, ratus.ErrServiceUnavailable) {
+			t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrServiceUnavailable, err)
+		}
+		if err := g.Close(ctx); err != nil {
+			t.Error(err)
+		}
+	})
+
+	if err := u.Destroy(ctx); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	ctx := context.Background()
+	k := clock.NewFake(time.Now())
 	g, err := memdb.New(&memdb.Config{
-		RetentionPeriod: 100 * time.Millisecond,
+		RetentionPeriod: time.Minute,
+		Clock:           k,
 	})
 	if err != nil {
 		t.Fatal(err)
@@ -231,9 +780,9 @@ func TestExpire(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	n := time.Now()
-	n1 := n.Add(100 * time.Millisecond)
-	n2 := n.Add(200 * time.Millisecond)
+	n := k.Now()
+	n1 := n.Add(time.Minute)
+	n2 := n.Add(2 * time.Minute)
 	if _, err := g.InsertTasks(ctx, []*ratus.Task{
 		{
 			ID:        "1",
@@ -263,12 +812,12 @@ func TestExpire(t *testing.T) {
 
 	for i := 0; i < 3; i++ {
 		if i > 0 {
-			time.Sleep(100 * time.Millisecond)
+			k.Advance(time.Minute + time.Second)
 		}
-		if err := g.Chore(ctx); err != nil {
+		if _, err := g.Chore(ctx); err != nil {
 			t.Error(err)
 		}
-		v, err := g.ListTasks(ctx, "test", 10, 0)
+		v, err := g.ListTasks(ctx, "test", nil, &engine.Page{Limit: 10})
 		if err != nil {
 			t.Error(err)
 		}
@@ -277,3 +826,210 @@ func TestExpire(t *testing.T) {
 		}
 	}
 }
+
+// exporter records exported tasks and fails with the error if set.
+type exporter struct {
+	tasks []*ratus.Task
+	err   error
+}
+
+func (x *exporter) Export(ctx context.Context, ts []*ratus.Task) error {
+	if x.err != nil {
+		return x.err
+	}
+	x.tasks = append(x.tasks, ts...)
+	return nil
+}
+
+func TestExpiry(t *testing.T) {
+	ctx := context.Background()
+	e := time.Unix(0, 0)
+	n := time.Now()
+	ts := []*ratus.Task{
+		{ID: "1", Topic: "test", State: ratus.TaskStateCompleted, Dedup: "a", Scheduled: &e, Consumed: &e},
+		{ID: "2", Topic: "test", State: ratus.TaskStateCompleted, Scheduled: &n, Consumed: &n},
+	}
+
+	t.Run("export", func(t *testing.T) {
+		x := exporter{err: errors.New("unavailable")}
+		g, err := memdb.New(&memdb.Config{RetentionPeriod: time.Hour, ExpiryExporter: &x})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := g.Open(ctx); err != nil {
+			t.Fatal(err)
+		}
+		defer g.Destroy(ctx)
+		if _, err := g.InsertTasks(ctx, ts); err != nil {
+			t.Fatal(err)
+		}
+
+		// Tasks are kept if they failed to be exported.
+		if _, err := g.Chore(ctx); err == nil {
+			t.Error("expected error when the export fails")
+		}
+		if _, err := g.GetTask(ctx, "1"); err != nil {
+			t.Error(err)
+		}
+
+		x.err = nil
+		v, err := g.Chore(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.Expired != 1 || len(x.tasks) != 1 || x.tasks[0].ID != "1" {
+			t.Errorf("incorrect expired tasks, expected task 1 to be exported, got %d and %+v", v.Expired, x.tasks)
+		}
+		if _, err := g.GetTask(ctx, "1"); !errors.Is(err, ratus.ErrNotFound) {
+			t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrNotFound, err)
+		}
+	})
+
+	t.Run("topic", func(t *testing.T) {
+		g, err := memdb.New(&memdb.Config{RetentionPeriod: time.Hour, HistoryLimit: 1, ExpiryTopic: "archive"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := g.Open(ctx); err != nil {
+			t.Fatal(err)
+		}
+		defer g.Destroy(ctx)
+		if _, err := g.InsertTasks(ctx, ts); err != nil {
+			t.Fatal(err)
+		}
+
+		v, err := g.Chore(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.Expired != 1 {
+			t.Errorf("incorrect number of expired tasks, expected 1, got %d", v.Expired)
+		}
+		u, err := g.GetTask(ctx, "1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.Topic != "archive" || u.State != ratus.TaskStateArchived || u.Dedup != "" || len(u.History) != 1 {
+			t.Errorf("incorrect task, expected archived in the expiry topic, got %+v", u)
+		}
+
+		// Archived tasks are not expired again.
+		if v, err := g.Chore(ctx); err != nil {
+			t.Error(err)
+		} else if v.Expired != 0 {
+			t.Errorf("incorrect number of expired tasks, expected 0, got %d", v.Expired)
+		}
+	})
+}
+
+func TestHistory(t *testing.T) {
+	ctx := context.Background()
+	g, err := memdb.New(&memdb.Config{HistoryLimit: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer g.Destroy(ctx)
+
+	n := time.Now()
+	if _, err := g.InsertTask(ctx, &ratus.Task{ID: "1", Topic: "test", Scheduled: &n}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Timed out tasks should be recorded with the reason.
+	d := n.Add(-time.Minute)
+	if _, err := g.Poll(ctx, "test", &ratus.Promise{Consumer: "a", Deadline: &d}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.Chore(ctx); err != nil {
+		t.Fatal(err)
+	}
+	v, err := g.Poll(ctx, "test", &ratus.Promise{Consumer: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := ratus.TaskStateCompleted
+	if _, err := g.Commit(ctx, v.ID, &ratus.Commit{Nonce: v.Nonce, State: &s}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the latest transitions should be kept.
+	v, err = g.GetTask(ctx, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v.History) != 3 {
+		t.Fatalf("incorrect length of history, expected 3, got %d", len(v.History))
+	}
+	if h := v.History[0]; h.State != ratus.TaskStatePending || h.Error == "" {
+		t.Errorf("incorrect transition, expected timed out, got %+v", h)
+	}
+	if h := v.History[1]; h.State != ratus.TaskStateActive || h.Consumer != "b" {
+		t.Errorf("incorrect transition, expected consumed by %q, got %+v", "b", h)
+	}
+	if h := v.History[2]; h.State != ratus.TaskStateCompleted || h.Time == nil {
+		t.Errorf("incorrect transition, expected completed, got %+v", h)
+	}
+}
+
+func TestWatchTask(t *testing.T) {
+	ctx := context.Background()
+	g, err := memdb.New(&memdb.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer g.Destroy(ctx)
+
+	n := time.Now()
+	if _, err := g.InsertTask(ctx, &ratus.Task{ID: "1", Topic: "test", Scheduled: &n}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Tasks whose versions differ are returned immediately.
+	if v, err := g.WatchTask(ctx, "1", 0); err != nil || v.Version != 1 {
+		t.Errorf("incorrect task, expected version 1, got %v (%v)", v, err)
+	}
+
+	// Watches should return once the task is changed.
+	ch := make(chan *ratus.Task, 1)
+	go func() {
+		v, err := g.WatchTask(ctx, "1", 1)
+		if err != nil {
+			t.Error(err)
+		}
+		ch <- v
+	}()
+	time.Sleep(50 * time.Millisecond)
+	s := ratus.TaskStateCompleted
+	if _, err := g.Commit(ctx, "1", &ratus.Commit{State: &s}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-time.After(time.Second):
+		t.Error("watch did not return after the task was changed")
+	case v := <-ch:
+		if v == nil || v.State != ratus.TaskStateCompleted || v.Version != 2 {
+			t.Errorf("incorrect task, expected completed task of version 2, got %v", v)
+		}
+	}
+
+	// Watches should time out while the task is unchanged, and report
+	// deleted tasks as not found.
+	c, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := g.WatchTask(c, "1", 2); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("incorrect error type, expected %q, got %q", context.DeadlineExceeded, err)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		g.DeleteTask(ctx, "1")
+	}()
+	if _, err := g.WatchTask(ctx, "1", 2); !errors.Is(err, ratus.ErrNotFound) {
+		t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrNotFound, err)
+	}
+}
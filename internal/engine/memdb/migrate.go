@@ -0,0 +1,86 @@
+package memdb
+
+import (
+	"context"
+
+	"github.com/hyperonym/ratus"
+	"github.com/hyperonym/ratus/internal/engine"
+)
+
+// schemaName is the name of the record of the schema version.
+const schemaName = "schema"
+
+// schemaVersion is the record of the schema version of the data. It is stored
+// in a table of its own, so that it is written to snapshots, the write-ahead
+// log and the replication stream along with the data it describes.
+type schemaVersion struct {
+	Name    string
+	Version int
+}
+
+// schemaMigrations returns the migrations of the database in the order of
+// their versions. Migrations must only be appended, since their versions are
+// recorded in snapshots.
+func (g *Engine) schemaMigrations() []engine.Migration {
+	return []engine.Migration{
+		{Version: 1, Description: "backfill versions of tasks", Apply: g.backfillVersions},
+	}
+}
+
+// SchemaVersion returns the recorded schema version of the database.
+func (g *Engine) SchemaVersion(ctx context.Context) (int, error) {
+	txn := g.database.Txn(false)
+	defer txn.Abort()
+	r, err := txn.First(tableSchema, indexID, schemaName)
+	if err != nil || r == nil {
+		return 0, err
+	}
+	return r.(*schemaVersion).Version, nil
+}
+
+// SetSchemaVersion records the schema version of the database. Versions older
+// than the recorded one are ignored.
+func (g *Engine) SetSchemaVersion(ctx context.Context, v int) error {
+	txn := g.begin()
+	defer txn.Abort()
+	r, err := txn.First(tableSchema, indexID, schemaName)
+	if err != nil {
+		return err
+	}
+	if r != nil && r.(*schemaVersion).Version >= v {
+		return nil
+	}
+	if err := txn.Insert(tableSchema, &schemaVersion{Name: schemaName, Version: v}); err != nil {
+		return err
+	}
+	return g.commit(txn)
+}
+
+// backfillVersions sets the version of tasks loaded from snapshots written
+// before versions were tracked to 1, so that they can be updated
+// conditionally like other tasks.
+func (g *Engine) backfillVersions(ctx context.Context) error {
+	txn := g.begin()
+	defer txn.Abort()
+	it, err := txn.Get(tableTask, indexID)
+	if err != nil {
+		return err
+	}
+	var v []*ratus.Task
+	for r := it.Next(); r != nil; r = it.Next() {
+		if t := r.(*ratus.Task); t.Version == 0 {
+			u := clone(t)
+			u.Version = 1
+			v = append(v, u)
+		}
+	}
+	if len(v) == 0 {
+		return nil
+	}
+	for _, u := range v {
+		if err := txn.Insert(tableTask, u); err != nil {
+			return err
+		}
+	}
+	return g.commit(txn)
+}
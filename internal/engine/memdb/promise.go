@@ -4,22 +4,36 @@ import (
 	"context"
 	"time"
 
+	"github.com/hashicorp/go-memdb"
+
 	"github.com/hyperonym/ratus"
+	"github.com/hyperonym/ratus/internal/engine"
 )
 
 // ListPromises lists all promises in a topic.
-func (g *Engine) ListPromises(ctx context.Context, topic string, limit, offset int) ([]*ratus.Promise, error) {
+func (g *Engine) ListPromises(ctx context.Context, topic string, p *engine.Page) ([]*ratus.Promise, error) {
 	txn := g.database.Txn(false)
 	defer txn.Abort()
 
 	// Iterate through the index to return the specified number of results.
-	it, err := txn.Get(tableTask, indexActiveTopic, ratus.TaskStateActive, topic)
+	// Active tasks are ordered by their IDs within the topic in the index, so
+	// pages after the last resource seen are found by seeking to its position.
+	var it memdb.ResultIterator
+	var err error
+	if p.After == "" {
+		it, err = txn.Get(tableTask, indexActiveTopicID+"_prefix", ratus.TaskStateActive, topic)
+	} else {
+		it, err = txn.LowerBound(tableTask, indexActiveTopicID, ratus.TaskStateActive, topic, p.After)
+	}
 	if err != nil {
 		return nil, err
 	}
+	if p.After != "" {
+		it = &bounded{ResultIterator: it, topic: topic, page: &engine.Page{After: p.After}}
+	}
 	v := make([]*ratus.Promise, 0)
-	for i, r := 0, it.Next(); i < offset+limit && r != nil; i, r = i+1, it.Next() {
-		if i < offset {
+	for i, r := 0, it.Next(); i < p.Offset+p.Limit && r != nil; i, r = i+1, it.Next() {
+		if i < p.Offset {
 			continue
 		}
 		t := r.(*ratus.Task)
@@ -34,27 +48,41 @@ func (g *Engine) ListPromises(ctx context.Context, topic string, limit, offset i
 	return v, nil
 }
 
+// CountPromises counts all promises in a topic.
+func (g *Engine) CountPromises(ctx context.Context, topic string) (int64, error) {
+
+	// Promises in effect are represented by active tasks.
+	if c := g.topics.get(topic); c != nil {
+		return c.Active, nil
+	}
+	return 0, nil
+}
+
 // DeletePromises deletes all promises in a topic.
 func (g *Engine) DeletePromises(ctx context.Context, topic string) (*ratus.Deleted, error) {
-	txn := g.database.Txn(true)
+	txn := g.begin()
 	defer txn.Abort()
 
 	// Deleting promises is equivalent to setting the states of the active
 	// tasks back to "pending" and clearing the nonce fields.
 	var d int64
-	it, err := txn.Get(tableTask, indexActiveTopic, ratus.TaskStateActive, topic)
+	it, err := txn.Get(tableTask, indexActiveTopicID+"_prefix", ratus.TaskStateActive, topic)
 	if err != nil {
 		return nil, err
 	}
+	n := g.clock.Now()
 	for r := it.Next(); r != nil; r = it.Next() {
 		t := r.(*ratus.Task)
-		if err := txn.Insert(tableTask, updateOpsRecover(t)); err != nil {
+		u := record(updateOpsRecover(t), &ratus.Transition{State: ratus.TaskStatePending, Time: &n}, g.config.HistoryLimit)
+		if err := txn.Insert(tableTask, u); err != nil {
 			return nil, err
 		}
 		d++
 	}
 
-	txn.Commit()
+	if err := g.commit(txn); err != nil {
+		return nil, err
+	}
 	return &ratus.Deleted{
 		Deleted: d,
 	}, nil
@@ -88,7 +116,7 @@ func (g *Engine) GetPromise(ctx context.Context, id string) (*ratus.Promise, err
 
 // InsertPromise makes a promise to claim and execute a task if it is in pending state.
 func (g *Engine) InsertPromise(ctx context.Context, p *ratus.Promise) (*ratus.Task, error) {
-	txn := g.database.Txn(true)
+	txn := g.begin()
 	defer txn.Abort()
 
 	// Check if the target task is in pending state.
@@ -103,18 +131,22 @@ func (g *Engine) InsertPromise(ctx context.Context, p *ratus.Promise) (*ratus.Ta
 	if t.State != ratus.TaskStatePending {
 		return nil, ratus.ErrConflict
 	}
-	u := updateOpsConsume(t, p, time.Now())
+	n := g.clock.Now()
+	u := updateOpsConsume(t, p, n)
+	u = record(u, &ratus.Transition{State: u.State, Time: &n, Consumer: p.Consumer}, g.config.HistoryLimit)
 	if err := txn.Insert(tableTask, u); err != nil {
 		return nil, err
 	}
 
-	txn.Commit()
+	if err := g.commit(txn); err != nil {
+		return nil, err
+	}
 	return clone(u), nil
 }
 
 // UpsertPromise makes a promise to claim and execute a task regardless of its current state.
 func (g *Engine) UpsertPromise(ctx context.Context, p *ratus.Promise) (*ratus.Task, error) {
-	txn := g.database.Txn(true)
+	txn := g.begin()
 	defer txn.Abort()
 
 	// Check if the target task exists.
@@ -126,18 +158,54 @@ func (g *Engine) UpsertPromise(ctx context.Context, p *ratus.Promise) (*ratus.Ta
 		return nil, ratus.ErrNotFound
 	}
 	t := r.(*ratus.Task)
-	u := updateOpsConsume(t, p, time.Now())
+	n := g.clock.Now()
+	u := updateOpsConsume(t, p, n)
+	u = record(u, &ratus.Transition{State: u.State, Time: &n, Consumer: p.Consumer}, g.config.HistoryLimit)
 	if err := txn.Insert(tableTask, u); err != nil {
 		return nil, err
 	}
 
-	txn.Commit()
+	if err := g.commit(txn); err != nil {
+		return nil, err
+	}
+	return clone(u), nil
+}
+
+// StealPromise transfers the promise of an active task to another consumer, invalidating the previous one.
+func (g *Engine) StealPromise(ctx context.Context, p *ratus.Promise) (*ratus.Task, error) {
+	txn := g.begin()
+	defer txn.Abort()
+
+	// Check if the target task is in active state. Consuming it again
+	// replaces the nonce, so that commits of the previous consumer are
+	// rejected.
+	r, err := txn.First(tableTask, indexID, p.ID)
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		return nil, ratus.ErrNotFound
+	}
+	t := r.(*ratus.Task)
+	if t.State != ratus.TaskStateActive {
+		return nil, ratus.ErrConflict
+	}
+	n := g.clock.Now()
+	u := updateOpsConsume(t, p, n)
+	u = record(u, &ratus.Transition{State: u.State, Time: &n, Consumer: p.Consumer}, g.config.HistoryLimit)
+	if err := txn.Insert(tableTask, u); err != nil {
+		return nil, err
+	}
+
+	if err := g.commit(txn); err != nil {
+		return nil, err
+	}
 	return clone(u), nil
 }
 
 // DeletePromise deletes a promise by the unique ID of its target task.
 func (g *Engine) DeletePromise(ctx context.Context, id string) (*ratus.Deleted, error) {
-	txn := g.database.Txn(true)
+	txn := g.begin()
 	defer txn.Abort()
 
 	// Deleting a promise is equivalent to setting the state of the target task
@@ -149,15 +217,38 @@ func (g *Engine) DeletePromise(ctx context.Context, id string) (*ratus.Deleted,
 	}
 	if r != nil {
 		if t := r.(*ratus.Task); t.State == ratus.TaskStateActive {
-			if err := txn.Insert(tableTask, updateOpsRecover(t)); err != nil {
+			n := g.clock.Now()
+			u := record(updateOpsRecover(t), &ratus.Transition{State: ratus.TaskStatePending, Time: &n}, g.config.HistoryLimit)
+			if err := txn.Insert(tableTask, u); err != nil {
 				return nil, err
 			}
 			d++
 		}
 	}
 
-	txn.Commit()
+	if err := g.commit(txn); err != nil {
+		return nil, err
+	}
 	return &ratus.Deleted{
 		Deleted: d,
 	}, nil
 }
+
+// ListConsumers lists the consumers of active tasks in all topics along with their promises.
+func (g *Engine) ListConsumers(ctx context.Context) ([]*ratus.Consumer, error) {
+	txn := g.database.Txn(false)
+	defer txn.Abort()
+
+	// Collect all active tasks through the index on deadlines.
+	it, err := txn.LowerBound(tableTask, indexActiveDeadline, ratus.TaskStateActive, time.UnixMilli(0))
+	if err != nil {
+		return nil, err
+	}
+	var ts []*ratus.Task
+	for r := it.Next(); r != nil; r = it.Next() {
+		ts = append(ts, r.(*ratus.Task))
+	}
+
+	txn.Commit()
+	return engine.GroupConsumers(ts), nil
+}
@@ -2,104 +2,367 @@ package memdb
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
 	"time"
 
+	"github.com/hashicorp/go-memdb"
+
 	"github.com/hyperonym/ratus"
 )
 
 // Chore recovers timed out tasks and deletes expired tasks.
-func (g *Engine) Chore(ctx context.Context) error {
-	txn := g.database.Txn(true)
+func (g *Engine) Chore(ctx context.Context) (*ratus.Chore, error) {
+
+	// Background jobs are left to the primary instance, whose changes are
+	// replicated to standby instances.
+	if g.standby.Load() {
+		return &ratus.Chore{}, nil
+	}
+
+	txn := g.begin()
 	defer txn.Abort()
 
 	// Recover tasks that have timed out.
-	n := time.Now()
+	var v ratus.Chore
+	n := g.clock.Now()
 	it, err := txn.LowerBound(tableTask, indexActiveDeadline, ratus.TaskStateActive, time.UnixMilli(0))
 	if err != nil {
-		return err
+		return nil, err
 	}
 	for r := it.Next(); r != nil; r = it.Next() {
 		t := r.(*ratus.Task)
 		if t.Deadline != nil && t.Deadline.After(n) {
 			break
 		}
-		u := updateOpsRecover(t)
+		u := record(updateOpsRecover(t), &ratus.Transition{State: ratus.TaskStatePending, Time: &n, Error: "deadline exceeded"}, g.config.HistoryLimit)
+		if err := txn.Insert(tableTask, u); err != nil {
+			return nil, err
+		}
+		v.Recovered++
+		v.Recoveries = append(v.Recoveries, &ratus.Recovery{
+			ID:       t.ID,
+			Topic:    t.Topic,
+			Producer: t.Producer,
+			Consumer: t.Consumer,
+			Deadline: t.Deadline,
+		})
+	}
+
+	// Remove completed dependencies from pending tasks. Blocked tasks are
+	// collected before updating to avoid modifying the index being iterated.
+	it, err = txn.Get(tableTask, indexPendingBlocked, ratus.TaskStatePending, true)
+	if err != nil {
+		return nil, err
+	}
+	var bs []*ratus.Task
+	for r := it.Next(); r != nil; r = it.Next() {
+		bs = append(bs, r.(*ratus.Task))
+	}
+	for _, t := range bs {
+		u, err := resolve(txn, t)
+		if err != nil {
+			return nil, err
+		}
+		if u == nil {
+			continue
+		}
 		if err := txn.Insert(tableTask, u); err != nil {
-			return err
+			return nil, err
 		}
 	}
 
-	// Delete completed tasks that have exceeded their retention period.
+	// Release deduplication keys of tasks produced before the deduplication
+	// windows of their topics.
+	ws, err := dedupWindows(txn)
+	if err != nil {
+		return nil, err
+	}
+	if len(ws) > 0 {
+		it, err = txn.Get(tableTask, indexTopicDedup)
+		if err != nil {
+			return nil, err
+		}
+		var ds []*ratus.Task
+		for r := it.Next(); r != nil; r = it.Next() {
+			t := r.(*ratus.Task)
+			w, ok := ws[t.Topic]
+			if ok && t.Produced != nil && t.Produced.Add(w).Before(n) {
+				ds = append(ds, t)
+			}
+		}
+		for _, t := range ds {
+			u := clone(t)
+			u.Dedup = ""
+			if err := txn.Insert(tableTask, u); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Collect completed tasks that have exceeded their retention period. Tasks
+	// are scanned in the order of completion until reaching the shortest
+	// retention period among all topics.
+	ps, m, err := retentionPeriods(txn, g.config.RetentionPeriod)
+	if err != nil {
+		return nil, err
+	}
 	it, err = txn.LowerBound(tableTask, indexCompletedConsumed, ratus.TaskStateCompleted, time.UnixMilli(0))
 	if err != nil {
-		return err
+		return nil, err
 	}
+	var es []*ratus.Task
 	for r := it.Next(); r != nil; r = it.Next() {
 		t := r.(*ratus.Task)
-		if t.Consumed != nil && t.Consumed.Add(g.config.RetentionPeriod).After(n) {
+		if t.Consumed != nil && t.Consumed.Add(m).After(n) {
 			break
 		}
-
-		// No need to clone the task before passing into delete.
-		if err := txn.Delete(tableTask, t); err != nil {
-			return err
+		p, ok := ps[t.Topic]
+		if !ok {
+			p = g.config.RetentionPeriod
+		}
+		if t.Consumed != nil && t.Consumed.Add(p).After(n) {
+			continue
 		}
+		es = append(es, t)
 	}
 
-	// Commit the transaction before writing snapshot.
-	txn.Commit()
-
-	// Write a snapshot if the time since the last save exceeded the interval.
-	if g.config.SnapshotPath == "" {
-		return nil
-	}
-	g.mux.Lock()
-	defer g.mux.Unlock()
-	n = time.Now()
-	if g.saved.Add(g.config.SnapshotInterval).After(n) {
-		return nil
+	// Export expired tasks before deleting them, or move them to the expiry
+	// topic in the "archived" state instead if configured. Deduplication keys
+	// are released to avoid conflicts in the expiry topic.
+	if g.config.ExpiryExporter != nil && len(es) > 0 {
+		if err := g.config.ExpiryExporter.Export(ctx, es); err != nil {
+			return nil, err
+		}
 	}
-	if err := save(g.database, g.config.SnapshotPath); err != nil {
-		return err
+	for _, t := range es {
+		if g.config.ExpiryTopic != "" {
+			u := record(versioned(t, t), &ratus.Transition{State: ratus.TaskStateArchived, Time: &n}, g.config.HistoryLimit)
+			u.Topic, u.State, u.Dedup = g.config.ExpiryTopic, ratus.TaskStateArchived, ""
+			if err := txn.Insert(tableTask, u); err != nil {
+				return nil, err
+			}
+		} else if err := txn.Delete(tableTask, t); err != nil {
+			return nil, err
+		}
+		v.Expired++
 	}
-	g.saved = n
 
-	return nil
+	if err := g.commit(txn); err != nil {
+		return nil, err
+	}
+	return &v, nil
 }
 
 // Poll makes a promise to claim and execute the next available task in a topic.
 func (g *Engine) Poll(ctx context.Context, topic string, p *ratus.Promise) (*ratus.Task, error) {
-	txn := g.database.Txn(true)
+	v, err := g.PollTasks(ctx, topic, p, 1)
+	if err != nil {
+		return nil, err
+	}
+	return v[0], nil
+}
+
+// PollTasks makes promises to claim and execute up to the limit of the next
+// available tasks in a topic in a single transaction.
+func (g *Engine) PollTasks(ctx context.Context, topic string, p *ratus.Promise, limit int) ([]*ratus.Task, error) {
+	if limit < 1 {
+		return nil, fmt.Errorf("%w: limit must be positive", ratus.ErrBadRequest)
+	}
+	txn := g.begin()
 	defer txn.Abort()
 
-	// Peek into the topic to get the next candidate task.
-	n := time.Now()
-	it, err := txn.LowerBound(tableTask, indexPendingTopicScheduled, ratus.TaskStatePending, topic, time.UnixMilli(0))
-	if err != nil {
+	// Get the settings of the topic to determine how to poll the topic.
+	var c ratus.Topic
+	if r, err := txn.First(tableTopic, indexID, topic); err != nil {
 		return nil, err
+	} else if r != nil {
+		c = *r.(*ratus.Topic)
 	}
-	r := it.Next()
-	if r == nil {
-		return nil, ratus.ErrNotFound
+
+	// Tasks in topics delivering at most once are always completed when
+	// polled.
+	if c.AtMostOnce && !p.AtMostOnce {
+		q := *p
+		q.AtMostOnce = true
+		p = &q
 	}
 
-	// Do not consume the task until the scheduled time.
-	t := r.(*ratus.Task)
-	if t.Scheduled != nil && t.Scheduled.After(n) {
+	// Claim tasks one after another until the limit is reached or no more
+	// tasks can be claimed. Errors preventing further claims are returned
+	// only if no task has been claimed.
+	n := g.clock.Now()
+	g.cmux.Lock()
+	k := g.cursors[topic]
+	g.cmux.Unlock()
+	var vs []*ratus.Task
+	for len(vs) < limit {
+		t, err := claim(txn, &c, topic, k, p.Labels, n)
+		if err != nil {
+			if len(vs) > 0 && (errors.Is(err, ratus.ErrNotFound) || errors.Is(err, ratus.ErrTooManyRequests)) {
+				break
+			}
+			return nil, err
+		}
+		u := updateOpsConsume(t, p, n)
+		u = record(u, &ratus.Transition{State: u.State, Time: &n, Consumer: p.Consumer}, g.config.HistoryLimit)
+		if err := txn.Insert(tableTask, u); err != nil {
+			return nil, err
+		}
+		vs = append(vs, clone(u))
+		k = t.Producer
+	}
+	if err := g.commit(txn); err != nil {
+		return nil, err
+	}
+
+	// Only advance the cursor once the tasks have been claimed, so that the
+	// producers are not skipped if the commit is rejected.
+	if c.Fair {
+		g.cmux.Lock()
+		g.cursors[topic] = k
+		g.cmux.Unlock()
+	}
+	return vs, nil
+}
+
+// claim returns the next task to be claimed in the topic according to its
+// settings, starting after the producer of the cursor if fair polling is
+// enabled. It returns ErrTooManyRequests if the concurrency limit of the topic
+// has been reached, and ErrNotFound if no task is available. Active tasks are
+// counted within the transaction to enforce the limit strictly.
+func claim(txn *memdb.Txn, c *ratus.Topic, topic, cursor string, labels map[string]string, n time.Time) (*ratus.Task, error) {
+	if c.Concurrency > 0 {
+		it, err := txn.Get(tableTask, indexActiveTopicID+"_prefix", ratus.TaskStateActive, topic)
+		if err != nil {
+			return nil, err
+		}
+		var k int64
+		for r := it.Next(); r != nil && k < c.Concurrency; r = it.Next() {
+			k++
+		}
+		if k >= c.Concurrency {
+			return nil, fmt.Errorf("%w: topic %q has reached its concurrency limit of %d", ratus.ErrTooManyRequests, topic, c.Concurrency)
+		}
+	}
+	var t *ratus.Task
+	var err error
+	if c.Fair {
+		t, err = nextFair(txn, topic, cursor, labels, n)
+	} else if c.Prioritized {
+		t, err = nextPriority(txn, topic, labels, n)
+	} else {
+		t, err = next(txn, topic, labels, n)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if t == nil {
 		return nil, ratus.ErrNotFound
 	}
-	u := updateOpsConsume(t, p, n)
-	if err := txn.Insert(tableTask, u); err != nil {
+	return t, nil
+}
+
+// NextScheduled returns the scheduled time of the next pending task in a topic that is not yet available.
+func (g *Engine) NextScheduled(ctx context.Context, topic string) (*time.Time, error) {
+	txn := g.database.Txn(false)
+	defer txn.Abort()
+
+	// Tasks scheduled within the current millisecond are included by the
+	// lower bound, but are already available.
+	n := g.clock.Now()
+	it, err := txn.LowerBound(tableTask, indexPendingTopicScheduled, ratus.TaskStatePending, topic, n)
+	if err != nil {
 		return nil, err
 	}
+	for r := it.Next(); r != nil; r = it.Next() {
+		t := r.(*ratus.Task)
+		if t.Topic != topic {
+			break
+		}
+		if t.Scheduled != nil && t.Scheduled.After(n) {
+			s := *t.Scheduled
+			return &s, nil
+		}
+	}
+	return nil, ratus.ErrNotFound
+}
 
-	txn.Commit()
-	return clone(u), nil
+// watcher collects the topics with pending tasks changed since the watcher
+// last handled them.
+type watcher struct {
+	mux    sync.Mutex
+	topics map[string]struct{}
+	ch     chan struct{}
+}
+
+// Watch blocks and calls the handler function with the name of the topic
+// whenever a task in the topic may have become available for polling.
+func (g *Engine) Watch(ctx context.Context, f func(topic string)) error {
+	w := &watcher{topics: make(map[string]struct{}), ch: make(chan struct{}, 1)}
+	g.nmux.Lock()
+	g.watchers[w] = struct{}{}
+	g.nmux.Unlock()
+	defer func() {
+		g.nmux.Lock()
+		delete(g.watchers, w)
+		g.nmux.Unlock()
+	}()
+
+	// Notifications may arrive before the scheduled time of the tasks, thus
+	// the callers should not assume that polling will always succeed.
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-w.ch:
+		}
+		w.mux.Lock()
+		ts := w.topics
+		w.topics = make(map[string]struct{})
+		w.mux.Unlock()
+		for t := range ts {
+			f(t)
+		}
+	}
+}
+
+// notify marks the topics of tasks that are pending after the changes for all
+// watchers. Watchers handle the marked topics in their own goroutines, so
+// that slow handlers do not hold up commits.
+func (g *Engine) notify(cs memdb.Changes) {
+	ts := make(map[string]struct{})
+	for _, c := range cs {
+		if c.Table != tableTask || c.After == nil {
+			continue
+		}
+		if t := c.After.(*ratus.Task); t.State == ratus.TaskStatePending {
+			ts[t.Topic] = struct{}{}
+		}
+	}
+	if len(ts) == 0 {
+		return
+	}
+	g.nmux.Lock()
+	defer g.nmux.Unlock()
+	for w := range g.watchers {
+		w.mux.Lock()
+		for t := range ts {
+			w.topics[t] = struct{}{}
+		}
+		w.mux.Unlock()
+		select {
+		case w.ch <- struct{}{}:
+		default:
+		}
+	}
 }
 
 // Commit applies a set of updates to a task and returns the updated task.
 func (g *Engine) Commit(ctx context.Context, id string, m *ratus.Commit) (*ratus.Task, error) {
-	txn := g.database.Txn(true)
+	txn := g.begin()
 	defer txn.Abort()
 
 	// Get current information of the target task.
@@ -111,16 +374,261 @@ func (g *Engine) Commit(ctx context.Context, id string, m *ratus.Commit) (*ratus
 		return nil, ratus.ErrNotFound
 	}
 
-	// Verify the nonce if provided to invalidate unintended commits.
+	// Verify the nonce, consumer and version if provided to invalidate
+	// unintended commits.
 	t := r.(*ratus.Task)
 	if m.Nonce != "" && m.Nonce != t.Nonce {
 		return nil, ratus.ErrConflict
 	}
+	if m.Consumer != "" && m.Consumer != t.Consumer {
+		return nil, ratus.ErrConflict
+	}
+	if m.Version != 0 && m.Version != t.Version {
+		return nil, ratus.ErrConflict
+	}
 	u := updateOpsCommit(t, m)
+	if m.State != nil {
+		n := g.clock.Now()
+		u = record(u, &ratus.Transition{State: u.State, Time: &n, Error: m.Error}, g.config.HistoryLimit)
+	}
+	if err := checkDuplicated(txn, u); err != nil {
+		return nil, err
+	}
 	if err := txn.Insert(tableTask, u); err != nil {
 		return nil, err
 	}
 
-	txn.Commit()
+	if err := g.commit(txn); err != nil {
+		return nil, err
+	}
 	return clone(u), nil
 }
+
+// UpdateProgress records the progress of an active task without changing its state, nonce or version.
+func (g *Engine) UpdateProgress(ctx context.Context, id string, p *ratus.Progress) (*ratus.Updated, error) {
+	txn := g.begin()
+	defer txn.Abort()
+
+	// Only the consumer holding the promise of an active task may report its
+	// progress.
+	r, err := txn.First(tableTask, indexID, id)
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		return nil, ratus.ErrNotFound
+	}
+	t := r.(*ratus.Task)
+	if t.State != ratus.TaskStateActive || p.Nonce != "" && p.Nonce != t.Nonce {
+		return nil, ratus.ErrConflict
+	}
+	u := clone(t)
+	u.Progress = &ratus.Progress{Percent: p.Percent, Message: p.Message, Time: p.Time}
+	if err := txn.Insert(tableTask, u); err != nil {
+		return nil, err
+	}
+
+	if err := g.commit(txn); err != nil {
+		return nil, err
+	}
+	return &ratus.Updated{Updated: 1}, nil
+}
+
+// Heartbeat extends the deadline of an active task without changing its state, nonce or version.
+func (g *Engine) Heartbeat(ctx context.Context, id, nonce string, deadline time.Time) (*ratus.Updated, error) {
+	txn := g.begin()
+	defer txn.Abort()
+
+	// Only the consumer holding the promise of an active task may extend its
+	// deadline.
+	r, err := txn.First(tableTask, indexID, id)
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		return nil, ratus.ErrNotFound
+	}
+	t := r.(*ratus.Task)
+	if t.State != ratus.TaskStateActive || nonce != "" && nonce != t.Nonce {
+		return nil, ratus.ErrConflict
+	}
+	u := clone(t)
+	u.Deadline = &deadline
+	if err := txn.Insert(tableTask, u); err != nil {
+		return nil, err
+	}
+
+	if err := g.commit(txn); err != nil {
+		return nil, err
+	}
+	return &ratus.Updated{Updated: 1}, nil
+}
+
+// retentionPeriods returns the retention periods of topics that override the
+// default, along with the shortest retention period among all topics.
+// Invalid retention periods are ignored.
+func retentionPeriods(txn *memdb.Txn, d time.Duration) (map[string]time.Duration, time.Duration, error) {
+	it, err := txn.Get(tableTopic, indexID)
+	if err != nil {
+		return nil, 0, err
+	}
+	v := make(map[string]time.Duration)
+	m := d
+	for r := it.Next(); r != nil; r = it.Next() {
+		t := r.(*ratus.Topic)
+		if t.Retention == "" {
+			continue
+		}
+		p, err := time.ParseDuration(t.Retention)
+		if err != nil {
+			continue
+		}
+		v[t.Name] = p
+		m = min(m, p)
+	}
+	return v, m, nil
+}
+
+// dedupWindows returns the deduplication windows of topics that have one.
+// Invalid windows are ignored.
+func dedupWindows(txn *memdb.Txn) (map[string]time.Duration, error) {
+	it, err := txn.Get(tableTopic, indexID)
+	if err != nil {
+		return nil, err
+	}
+	v := make(map[string]time.Duration)
+	for r := it.Next(); r != nil; r = it.Next() {
+		t := r.(*ratus.Topic)
+		if t.DedupWindow == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(t.DedupWindow); err == nil {
+			v[t.Name] = d
+		}
+	}
+	return v, nil
+}
+
+// blocked returns whether the task has dependencies that have not yet been
+// resolved.
+func blocked(obj any) (bool, error) {
+	t, ok := obj.(*ratus.Task)
+	if !ok {
+		return false, fmt.Errorf("object is of type %T; want a *ratus.Task", obj)
+	}
+	return len(t.DependsOn) > 0, nil
+}
+
+// resolve returns a copy of the task with completed dependencies removed, or
+// nil if none of its dependencies has been completed.
+func resolve(txn *memdb.Txn, t *ratus.Task) (*ratus.Task, error) {
+	var ds []string
+	for _, id := range t.DependsOn {
+		r, err := txn.First(tableTask, indexID, id)
+		if err != nil {
+			return nil, err
+		}
+		if r == nil || r.(*ratus.Task).State != ratus.TaskStateCompleted {
+			ds = append(ds, id)
+		}
+	}
+	if len(ds) == len(t.DependsOn) {
+		return nil, nil
+	}
+	u := clone(t)
+	u.DependsOn = ds
+	return u, nil
+}
+
+// next returns the pending task in the topic with the earliest scheduled time
+// whose dependencies have been resolved and whose labels match the selector,
+// or nil if there is no task available at the specified time.
+func next(txn *memdb.Txn, topic string, labels map[string]string, n time.Time) (*ratus.Task, error) {
+	it, err := txn.LowerBound(tableTask, indexPendingTopicScheduled, ratus.TaskStatePending, topic, time.UnixMilli(0))
+	if err != nil {
+		return nil, err
+	}
+
+	// The lower bound may belong to the next topic if there is no pending
+	// task in the topic. Do not consume the task until the scheduled time.
+	for r := it.Next(); r != nil; r = it.Next() {
+		t := r.(*ratus.Task)
+		if t.Topic != topic || (t.Scheduled != nil && t.Scheduled.After(n)) {
+			return nil, nil
+		}
+		if len(t.DependsOn) == 0 && matches(t, labels) {
+			return t, nil
+		}
+	}
+	return nil, nil
+}
+
+// nextFair returns the available task with the earliest scheduled time from
+// the first producer after the cursor that has available tasks in the topic,
+// wrapping around to the first producer if necessary. Tasks whose dependencies
+// have not been resolved or whose labels do not match the selector are
+// skipped. It returns nil if there is no task available at the specified time.
+func nextFair(txn *memdb.Txn, topic, cursor string, labels map[string]string, n time.Time) (*ratus.Task, error) {
+
+	// Pending tasks of each producer are ordered by the scheduled time, so
+	// producers can be skipped by seeking past their latest possible entry.
+	end := time.UnixMilli(math.MaxInt64)
+	for _, wrap := range []bool{false, true} {
+		p, s := cursor, end
+		if wrap {
+			p, s = "", time.UnixMilli(0)
+		}
+		it, err := txn.LowerBound(tableTask, indexPendingTopicProducerScheduled, ratus.TaskStatePending, topic, p, s)
+		if err != nil {
+			return nil, err
+		}
+		for r := it.Next(); r != nil; r = it.Next() {
+			t := r.(*ratus.Task)
+			if t.Topic != topic || (wrap && t.Producer > cursor) {
+				break
+			}
+			if t.Scheduled != nil && t.Scheduled.After(n) {
+				if it, err = txn.LowerBound(tableTask, indexPendingTopicProducerScheduled, ratus.TaskStatePending, topic, t.Producer, end); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if len(t.DependsOn) == 0 && matches(t, labels) {
+				return t, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// nextPriority returns the available task with the highest priority in the
+// topic, preferring the earliest scheduled time among tasks with the same
+// priority. Tasks whose dependencies have not been resolved or whose labels do
+// not match the selector are skipped. It returns nil if there is no task
+// available at the specified time.
+func nextPriority(txn *memdb.Txn, topic string, labels map[string]string, n time.Time) (*ratus.Task, error) {
+	it, err := txn.LowerBound(tableTask, indexPendingTopicPriorityScheduled, ratus.TaskStatePending, topic, math.MaxInt, time.UnixMilli(0))
+	if err != nil {
+		return nil, err
+	}
+
+	// Pending tasks of each priority are ordered by the scheduled time, so
+	// priorities can be skipped by seeking past their latest possible entry.
+	end := time.UnixMilli(math.MaxInt64)
+	for r := it.Next(); r != nil; r = it.Next() {
+		t := r.(*ratus.Task)
+		if t.Topic != topic {
+			break
+		}
+		if t.Scheduled != nil && t.Scheduled.After(n) {
+			if it, err = txn.LowerBound(tableTask, indexPendingTopicPriorityScheduled, ratus.TaskStatePending, topic, t.Priority, end); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if len(t.DependsOn) == 0 && matches(t, labels) {
+			return t, nil
+		}
+	}
+	return nil, nil
+}
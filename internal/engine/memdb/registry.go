@@ -0,0 +1,148 @@
+package memdb
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/hashicorp/go-memdb"
+
+	"github.com/hyperonym/ratus"
+	"github.com/hyperonym/ratus/internal/engine"
+)
+
+// registry maintains the number of tasks in each state for every topic, so
+// that topics can be listed and counted without scanning the whole database.
+type registry struct {
+	mux    sync.RWMutex
+	names  []string
+	topics map[string]*ratus.Topic
+}
+
+// newRegistry creates a registry from all existing tasks in the database.
+func newRegistry(db *memdb.MemDB) (*registry, error) {
+	r := registry{topics: make(map[string]*ratus.Topic)}
+	txn := db.Txn(false)
+	defer txn.Abort()
+	it, err := txn.Get(tableTask, indexID)
+	if err != nil {
+		return nil, err
+	}
+	for v := it.Next(); v != nil; v = it.Next() {
+		r.add(v.(*ratus.Task), 1)
+	}
+	return &r, nil
+}
+
+// apply updates the counters with changes made in a committed transaction.
+// Updates are commutative so that changes from concurrent transactions can be
+// applied in any order.
+func (r *registry) apply(cs memdb.Changes) {
+	if len(cs) == 0 {
+		return
+	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	for _, c := range cs {
+		if c.Table != tableTask {
+			continue
+		}
+		if c.Before != nil {
+			r.add(c.Before.(*ratus.Task), -1)
+		}
+		if c.After != nil {
+			r.add(c.After.(*ratus.Task), 1)
+		}
+	}
+}
+
+// add adds the delta to the counters of the topic and state of the task, and
+// keeps the sorted list of names in sync with topics that have tasks. The
+// caller must hold the lock if the registry is in use.
+func (r *registry) add(t *ratus.Task, delta int64) {
+	c, ok := r.topics[t.Topic]
+	if !ok {
+		c = &ratus.Topic{Name: t.Topic}
+		r.topics[t.Topic] = c
+	}
+	p := c.Count > 0
+	c.Count += delta
+	switch t.State {
+	case ratus.TaskStatePending:
+		c.Pending += delta
+	case ratus.TaskStateActive:
+		c.Active += delta
+	case ratus.TaskStateCompleted:
+		c.Completed += delta
+	case ratus.TaskStateArchived:
+		c.Archived += delta
+	case ratus.TaskStateFailed:
+		c.Failed += delta
+	}
+
+	// Insert or remove the name when the topic appears or disappears.
+	i := sort.SearchStrings(r.names, t.Topic)
+	switch {
+	case !p && c.Count > 0:
+		r.names = append(r.names, "")
+		copy(r.names[i+1:], r.names[i:])
+		r.names[i] = t.Topic
+	case p && c.Count <= 0:
+		r.names = append(r.names[:i], r.names[i+1:]...)
+	}
+	if c.Count == 0 {
+		delete(r.topics, t.Topic)
+	}
+}
+
+// list returns the names of topics in the order of the page with pagination.
+func (r *registry) list(p *engine.Page) []*ratus.Topic {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	v := make([]*ratus.Topic, 0)
+	if p.Desc {
+		i := len(r.names)
+		if p.After != "" {
+			i = sort.SearchStrings(r.names, p.After)
+		}
+		for i -= 1 + p.Offset; i >= 0 && len(v) < p.Limit; i-- {
+			v = append(v, &ratus.Topic{Name: r.names[i]})
+		}
+		return v
+	}
+	i := sort.Search(len(r.names), func(i int) bool { return r.names[i] > p.After })
+	for i += p.Offset; i < len(r.names) && len(v) < p.Limit; i++ {
+		v = append(v, &ratus.Topic{Name: r.names[i]})
+	}
+	return v
+}
+
+// get returns a copy of the counters of the topic, or nil if the topic does
+// not have any task.
+func (r *registry) get(topic string) *ratus.Topic {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	c, ok := r.topics[topic]
+	if !ok || c.Count <= 0 {
+		return nil
+	}
+	return clone(c)
+}
+
+// all returns copies of the counters of all topics that have tasks, ordered by
+// the names of the topics.
+func (r *registry) all() []*ratus.Topic {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	v := make([]*ratus.Topic, 0, len(r.names))
+	for _, n := range r.names {
+		v = append(v, clone(r.topics[n]))
+	}
+	return v
+}
+
+// len returns the number of topics that have tasks.
+func (r *registry) len() int {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	return len(r.names)
+}
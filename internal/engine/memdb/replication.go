@@ -0,0 +1,389 @@
+package memdb
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-memdb"
+
+	"github.com/hyperonym/ratus"
+)
+
+// Parameters of the replication stream.
+const (
+	replicationBuffer     = 1024
+	replicationHeartbeat  = time.Second
+	replicationTimeout    = 3 * replicationHeartbeat
+	replicationRetryDelay = time.Second
+)
+
+// headerTerm is the header carrying the replication term in both requests
+// from standby instances and responses from the primary instance.
+const headerTerm = "Ratus-Replication-Term"
+
+// errStandby is returned when writing to a standby instance.
+var errStandby = fmt.Errorf("%w: instance is a read-only standby", ratus.ErrServiceUnavailable)
+
+// errSuperseded is returned by standby instances connecting to a primary
+// instance that has been superseded by a standby promoted in a later term.
+var errSuperseded = errors.New("primary instance has been superseded")
+
+// message is a unit of the replication stream. The stream starts with a
+// message containing all tasks and topics in the database with the reset flag set,
+// followed by messages containing the changes made in each transaction.
+// Messages without entries are sent periodically as heartbeats.
+type message struct {
+	Reset   bool
+	Entries []entry
+}
+
+// feed broadcasts committed changes to the subscribed standby instances.
+type feed struct {
+	mux    sync.Mutex
+	closed bool
+	subs   map[chan []entry]struct{}
+}
+
+// newFeed creates a feed without subscribers.
+func newFeed() *feed {
+	return &feed{subs: make(map[chan []entry]struct{})}
+}
+
+// subscribe returns a channel that receives changes committed after the
+// subscription. The channel is closed if the subscriber falls too far behind,
+// in which case the subscriber should resubscribe to start over.
+func (f *feed) subscribe() chan []entry {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	ch := make(chan []entry, replicationBuffer)
+	if f.closed {
+		close(ch)
+		return ch
+	}
+	f.subs[ch] = struct{}{}
+	return ch
+}
+
+// unsubscribe removes the subscription and closes its channel.
+func (f *feed) unsubscribe(ch chan []entry) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if _, ok := f.subs[ch]; ok {
+		delete(f.subs, ch)
+		close(ch)
+	}
+}
+
+// publish sends the entries to all subscribers without blocking. Calls must
+// be serialized in the order of commits.
+func (f *feed) publish(es []entry) {
+	if len(es) == 0 {
+		return
+	}
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	for ch := range f.subs {
+		select {
+		case ch <- es:
+		default:
+			delete(f.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// close closes all subscriptions and rejects subsequent ones.
+func (f *feed) close() {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.closed = true
+	for ch := range f.subs {
+		delete(f.subs, ch)
+		close(ch)
+	}
+}
+
+// listen starts serving the replication stream on the configured address.
+func (g *Engine) listen() error {
+	l, err := net.Listen("tcp", g.config.ReplicationBind)
+	if err != nil {
+		return err
+	}
+	g.feed = newFeed()
+	g.server = &http.Server{
+		Handler:           http.HandlerFunc(g.serveReplication),
+		ReadHeaderTimeout: replicationTimeout,
+	}
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		if err := g.server.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Println(err)
+		}
+	}()
+	return nil
+}
+
+// serveReplication streams a full copy of the database followed by subsequent
+// changes to a standby instance until the connection is closed. Requests must
+// be authenticated with the shared secret. A request from an instance in a
+// later term means that a standby has been promoted, in which case this
+// instance steps down to prevent accepting writes on both instances.
+func (g *Engine) serveReplication(w http.ResponseWriter, r *http.Request) {
+	p, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(p), []byte(g.config.ReplicationSecret)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "invalid replication secret", http.StatusUnauthorized)
+		return
+	}
+	n, err := strconv.ParseUint(r.Header.Get(headerTerm), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid replication term", http.StatusBadRequest)
+		return
+	}
+	if g.supersede(n) {
+		http.Error(w, errSuperseded.Error(), http.StatusConflict)
+		return
+	}
+
+	// Take a snapshot and subscribe to subsequent changes without allowing
+	// any commits in between.
+	g.wmux.Lock()
+	s := g.database.Snapshot()
+	ch := g.feed.subscribe()
+	g.wmux.Unlock()
+	defer g.feed.unsubscribe(ch)
+
+	es, err := dump(s)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set(headerTerm, strconv.FormatUint(g.term.Load(), 10))
+	rc := http.NewResponseController(w)
+	enc := gob.NewEncoder(w)
+	send := func(m *message) error {
+		if err := enc.Encode(m); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+	if err := send(&message{Reset: true, Entries: es}); err != nil {
+		return
+	}
+
+	t := time.NewTicker(replicationHeartbeat)
+	defer t.Stop()
+	for {
+		var m message
+		select {
+		case <-r.Context().Done():
+			return
+		case es, ok := <-ch:
+			if !ok {
+				return
+			}
+			m.Entries = es
+		case <-t.C:
+		}
+		if err := send(&m); err != nil {
+			return
+		}
+	}
+}
+
+// dump returns entries for all tasks and topics in the database, along with
+// the recorded schema version.
+func dump(db *memdb.MemDB) ([]entry, error) {
+	txn := db.Txn(false)
+	defer txn.Abort()
+	v := make([]entry, 0)
+	it, err := txn.Get(tableTask, indexID)
+	if err != nil {
+		return nil, err
+	}
+	for r := it.Next(); r != nil; r = it.Next() {
+		v = append(v, entry{Task: r.(*ratus.Task)})
+	}
+	it, err = txn.Get(tableTopic, indexID)
+	if err != nil {
+		return nil, err
+	}
+	for r := it.Next(); r != nil; r = it.Next() {
+		v = append(v, entry{Topic: r.(*ratus.Topic)})
+	}
+	r, err := txn.First(tableSchema, indexID, schemaName)
+	if err != nil {
+		return nil, err
+	}
+	if r != nil {
+		v = append(v, entry{Schema: r.(*schemaVersion)})
+	}
+	return v, nil
+}
+
+// supersede steps down to a read-only standby if the term is later than the
+// current term of the instance, and returns whether the instance has been
+// superseded. Superseded instances stay read-only until restarted.
+func (g *Engine) supersede(n uint64) bool {
+	g.wmux.Lock()
+	defer g.wmux.Unlock()
+	if n > g.term.Load() {
+		g.term.Store(n)
+		g.standby.Store(true)
+		if !g.deposed.Swap(true) {
+			log.Printf("superseded by a primary instance in term %d, stepped down to standby\n", n)
+		}
+	}
+	return g.deposed.Load()
+}
+
+// follow replicates changes from the primary instance until the context is
+// canceled. The instance is promoted to primary if the failover timeout is
+// set and the primary has been unreachable for longer than the timeout since
+// the last contact. Instances that have never synchronized with the primary
+// are never promoted, so that a partitioned or misconfigured standby does not
+// start accepting writes on its own.
+func (g *Engine) follow(ctx context.Context) {
+	defer g.wg.Done()
+	var t time.Time
+	for {
+		err := g.replicate(ctx, &t)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Println(fmt.Errorf("replication interrupted: %w", err))
+
+		if d := g.config.ReplicationFailoverTimeout; d > 0 && !t.IsZero() && time.Since(t) >= d && !errors.Is(err, errSuperseded) {
+			g.promote()
+			log.Printf("primary unreachable for %s, promoted to primary in term %d\n", d, g.term.Load())
+			g.fence(ctx)
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(replicationRetryDelay):
+		}
+	}
+}
+
+// promote starts a new term and starts accepting writes.
+func (g *Engine) promote() {
+	g.wmux.Lock()
+	defer g.wmux.Unlock()
+	g.term.Add(1)
+	g.standby.Store(false)
+}
+
+// fence keeps connecting to the former primary instance with the new term
+// until the context is canceled, so that it steps down as soon as it becomes
+// reachable again, including after being restarted.
+func (g *Engine) fence(ctx context.Context) {
+	for {
+		if res, err := g.connect(ctx); err == nil {
+			res.Body.Close()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(replicationRetryDelay):
+		}
+	}
+}
+
+// connect sends an authenticated request with the current term to the
+// replication stream of the primary instance.
+func (g *Engine) connect(ctx context.Context) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, g.config.ReplicationPrimary, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+g.config.ReplicationSecret)
+	req.Header.Set(headerTerm, strconv.FormatUint(g.term.Load(), 10))
+	return http.DefaultClient.Do(req)
+}
+
+// replicate connects to the primary instance and applies messages from the
+// replication stream until an error occurs. The term of the instance follows
+// the term of the primary, and the time of the last contact with the primary
+// is updated whenever a message is received.
+func (g *Engine) replicate(ctx context.Context, last *time.Time) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	res, err := g.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusConflict {
+		return errSuperseded
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %q", res.Status)
+	}
+	n, err := strconv.ParseUint(res.Header.Get(headerTerm), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid replication term: %w", err)
+	}
+	if n < g.term.Load() {
+		return errSuperseded
+	}
+	g.term.Store(n)
+
+	// Abort the connection if the primary stops sending heartbeats.
+	w := time.AfterFunc(replicationTimeout, cancel)
+	defer w.Stop()
+
+	dec := gob.NewDecoder(bufio.NewReader(res.Body))
+	for {
+		var m message
+		if err := dec.Decode(&m); err != nil {
+			return err
+		}
+		w.Reset(replicationTimeout)
+		*last = time.Now()
+		if err := g.apply(&m); err != nil {
+			return err
+		}
+	}
+}
+
+// apply applies the changes in the message to the database in a single
+// transaction.
+func (g *Engine) apply(m *message) error {
+	if !m.Reset && len(m.Entries) == 0 {
+		return nil
+	}
+	txn := g.begin()
+	defer txn.Abort()
+	if m.Reset {
+		if _, err := txn.DeleteAll(tableTask, indexID); err != nil {
+			return err
+		}
+		if _, err := txn.DeleteAll(tableTopic, indexID); err != nil {
+			return err
+		}
+	}
+	for i := range m.Entries {
+		if err := applyEntry(txn, &m.Entries[i]); err != nil {
+			return err
+		}
+	}
+	return g.write(txn)
+}
@@ -1,24 +1,32 @@
 package memdb
 
 import (
+	"cmp"
 	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-memdb"
 
 	"github.com/hyperonym/ratus"
+	"github.com/hyperonym/ratus/internal/engine"
 )
 
-// ListTasks lists all tasks in a topic.
-func (g *Engine) ListTasks(ctx context.Context, topic string, limit, offset int) ([]*ratus.Task, error) {
+// ListTasks lists all tasks in a topic that match the label selector.
+func (g *Engine) ListTasks(ctx context.Context, topic string, labels map[string]string, p *engine.Page) ([]*ratus.Task, error) {
 	txn := g.database.Txn(false)
 	defer txn.Abort()
 
 	// Iterate through the index to return the specified number of results.
-	it, err := txn.Get(tableTask, indexTopic, topic)
+	it, err := find(txn, topic, labels, p)
 	if err != nil {
 		return nil, err
 	}
 	v := make([]*ratus.Task, 0)
-	for i, r := 0, it.Next(); i < offset+limit && r != nil; i, r = i+1, it.Next() {
-		if i < offset {
+	for i, r := 0, it.Next(); i < p.Offset+p.Limit && r != nil; i, r = i+1, it.Next() {
+		if i < p.Offset {
 			continue
 		}
 		v = append(v, clone(r.(*ratus.Task)))
@@ -28,12 +36,166 @@ func (g *Engine) ListTasks(ctx context.Context, topic string, limit, offset int)
 	return v, nil
 }
 
+// ListArchive lists archived tasks in a topic consumed within the time range, in the order of their consumed time.
+func (g *Engine) ListArchive(ctx context.Context, topic string, from, to *time.Time, p *engine.Page) ([]*ratus.Task, error) {
+	txn := g.database.Txn(false)
+	defer txn.Abort()
+
+	// Seek the index on archived tasks to the position of the last task seen,
+	// or to the bound of the time range where the iteration starts. Tasks
+	// without consumed times are positioned before the others.
+	q := *p
+	q.Sort = engine.SortConsumed
+	x := indexArchivedTopicConsumedID
+	var it memdb.ResultIterator
+	var err error
+	switch {
+	case q.After != "" && q.Desc:
+		it, err = txn.ReverseLowerBound(tableTask, x, ratus.TaskStateArchived, topic, q.Time, q.After)
+	case q.After != "":
+		it, err = txn.LowerBound(tableTask, x, ratus.TaskStateArchived, topic, q.Time, q.After)
+	case q.Desc && to != nil:
+		it, err = txn.ReverseLowerBound(tableTask, x, ratus.TaskStateArchived, topic, to, "")
+	case q.Desc:
+		it, err = txn.GetReverse(tableTask, x+"_prefix", ratus.TaskStateArchived, topic)
+	default:
+		it, err = txn.LowerBound(tableTask, x, ratus.TaskStateArchived, topic, from, "")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Stop once the end of the topic or the time range is reached. Tasks
+	// without consumed times are only listed if the range is unbounded.
+	v := make([]*ratus.Task, 0)
+	for i, r := 0, it.Next(); i < q.Offset+q.Limit && r != nil; r = it.Next() {
+		t := r.(*ratus.Task)
+		if t.State != ratus.TaskStateArchived || t.Topic != topic {
+			break
+		}
+		n := millis(t.Consumed)
+		if (from != nil || to != nil) && t.Consumed == nil || from != nil && n < from.UnixMilli() {
+			if q.Desc {
+				break
+			}
+			continue
+		}
+		if to != nil && n >= to.UnixMilli() {
+			if q.Desc {
+				continue
+			}
+			break
+		}
+		if q.After != "" && !past(&q, t) {
+			continue
+		}
+		if i >= q.Offset {
+			v = append(v, clone(t))
+		}
+		i++
+	}
+
+	txn.Commit()
+	return v, nil
+}
+
+// StreamTasks calls the function with each task in a topic in the order of their IDs, stopping at the first error.
+func (g *Engine) StreamTasks(ctx context.Context, topic string, f func(*ratus.Task) error) error {
+	txn := g.database.Txn(false)
+	defer txn.Abort()
+
+	// Read transactions iterate over a snapshot of the database, which is not
+	// affected by writes made while the function is being called.
+	it, err := txn.Get(tableTask, indexTopicID+"_prefix", topic)
+	if err != nil {
+		return err
+	}
+	for r := it.Next(); r != nil; r = it.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := f(clone(r.(*ratus.Task))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CountTasks counts all tasks in a topic that match the labels.
+func (g *Engine) CountTasks(ctx context.Context, topic string, labels map[string]string) (int64, error) {
+
+	// Tasks without label selectors are counted by the registry.
+	if len(labels) == 0 {
+		if c := g.topics.get(topic); c != nil {
+			return c.Count, nil
+		}
+		return 0, nil
+	}
+
+	txn := g.database.Txn(false)
+	defer txn.Abort()
+	it, err := find(txn, topic, labels, &engine.Page{})
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	for r := it.Next(); r != nil; r = it.Next() {
+		n++
+	}
+
+	txn.Commit()
+	return n, nil
+}
+
+// CountPending counts pending tasks of a producer in a topic, stopping at the limit if it is positive.
+func (g *Engine) CountPending(ctx context.Context, topic, producer string, limit int64) (int64, error) {
+	txn := g.database.Txn(false)
+	defer txn.Abort()
+
+	// Pending tasks of each producer are adjacent in the index used for fair
+	// polling, ordered by the scheduled time.
+	it, err := txn.LowerBound(tableTask, indexPendingTopicProducerScheduled, ratus.TaskStatePending, topic, producer, time.UnixMilli(0))
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	for r := it.Next(); r != nil && (limit <= 0 || n < limit); r = it.Next() {
+		t := r.(*ratus.Task)
+		if t.Topic != topic || t.Producer != producer {
+			break
+		}
+		n++
+	}
+
+	txn.Commit()
+	return n, nil
+}
+
+// CountPendingTasks counts pending tasks in a topic, or in all topics if the topic is empty, stopping at the limit if it is positive.
+func (g *Engine) CountPendingTasks(ctx context.Context, topic string, limit int64) (int64, error) {
+
+	// Counters are taken from the registry rather than scanning the database.
+	var n int64
+	if topic == "" {
+		for _, c := range g.topics.all() {
+			n += c.Pending
+		}
+	} else if c := g.topics.get(topic); c != nil {
+		n = c.Pending
+	}
+	if limit > 0 {
+		n = min(n, limit)
+	}
+	return n, nil
+}
+
 // InsertTasks inserts a batch of tasks while ignoring existing ones.
 func (g *Engine) InsertTasks(ctx context.Context, ts []*ratus.Task) (*ratus.Updated, error) {
-	txn := g.database.Txn(true)
+	txn := g.begin()
 	defer txn.Abort()
 
-	// Skip the task if a task with the same ID already exists.
+	// Skip the task if a task with the same ID or deduplication key already
+	// exists.
 	var c int64
 	for _, t := range ts {
 		r, err := txn.First(tableTask, indexID, t.ID)
@@ -43,13 +205,20 @@ func (g *Engine) InsertTasks(ctx context.Context, ts []*ratus.Task) (*ratus.Upda
 		if r != nil {
 			continue
 		}
-		if err := txn.Insert(tableTask, clone(t)); err != nil {
+		if d, err := duplicated(txn, t); err != nil {
+			return nil, err
+		} else if d {
+			continue
+		}
+		if err := txn.Insert(tableTask, versioned(t, nil)); err != nil {
 			return nil, err
 		}
 		c++
 	}
 
-	txn.Commit()
+	if err := g.commit(txn); err != nil {
+		return nil, err
+	}
 	return &ratus.Updated{
 		Created: c,
 		Updated: 0,
@@ -58,45 +227,111 @@ func (g *Engine) InsertTasks(ctx context.Context, ts []*ratus.Task) (*ratus.Upda
 
 // UpsertTasks inserts or updates a batch of tasks.
 func (g *Engine) UpsertTasks(ctx context.Context, ts []*ratus.Task) (*ratus.Updated, error) {
-	txn := g.database.Txn(true)
+	txn := g.begin()
 	defer txn.Abort()
 
 	// Check if a task with the same ID already exists before updating to count
-	// the number of creations and modifications separately.
-	var c int64
+	// the number of creations and modifications separately. Tasks holding
+	// deduplication keys of other tasks are skipped.
+	var c, u int64
 	for _, t := range ts {
+		if d, err := duplicated(txn, t); err != nil {
+			return nil, err
+		} else if d {
+			continue
+		}
 		r, err := txn.First(tableTask, indexID, t.ID)
 		if err != nil {
 			return nil, err
 		}
-		if err := txn.Insert(tableTask, clone(t)); err != nil {
+		if err := txn.Insert(tableTask, versioned(t, r)); err != nil {
 			return nil, err
 		}
 		if r == nil {
 			c++
+		} else {
+			u++
 		}
 	}
 
-	txn.Commit()
+	if err := g.commit(txn); err != nil {
+		return nil, err
+	}
 	return &ratus.Updated{
 		Created: c,
-		Updated: int64(len(ts)) - c,
+		Updated: u,
 	}, nil
 }
 
-// DeleteTasks deletes all tasks in a topic.
-func (g *Engine) DeleteTasks(ctx context.Context, topic string) (*ratus.Deleted, error) {
-	txn := g.database.Txn(true)
+// DeleteTasks deletes all tasks in a topic that match the label selector.
+func (g *Engine) DeleteTasks(ctx context.Context, topic string, labels map[string]string) (*ratus.Deleted, error) {
+	txn := g.begin()
 	defer txn.Abort()
 
-	n, err := txn.DeleteAll(tableTask, indexTopic, topic)
+	// Collect matching tasks before deleting them to avoid modifying the
+	// index being iterated.
+	it, err := find(txn, topic, labels, &engine.Page{})
 	if err != nil {
 		return nil, err
 	}
+	var ts []*ratus.Task
+	for r := it.Next(); r != nil; r = it.Next() {
+		ts = append(ts, r.(*ratus.Task))
+	}
+	for _, t := range ts {
+		if err := txn.Delete(tableTask, t); err != nil {
+			return nil, err
+		}
+	}
 
-	txn.Commit()
+	if err := g.commit(txn); err != nil {
+		return nil, err
+	}
 	return &ratus.Deleted{
-		Deleted: int64(n),
+		Deleted: int64(len(ts)),
+	}, nil
+}
+
+// MoveTasks moves tasks in a topic that match the filters to another topic.
+func (g *Engine) MoveTasks(ctx context.Context, topic string, m *ratus.Move) (*ratus.Updated, error) {
+	txn := g.begin()
+	defer txn.Abort()
+
+	// Collect matching tasks before moving them to avoid modifying the index
+	// being iterated.
+	it, err := find(txn, topic, m.Labels, &engine.Page{})
+	if err != nil {
+		return nil, err
+	}
+	var ts []*ratus.Task
+	for r := it.Next(); r != nil; r = it.Next() {
+		if t := r.(*ratus.Task); m.State == nil || t.State == *m.State {
+			ts = append(ts, t)
+		}
+	}
+
+	// Skip tasks whose deduplication keys are held by other tasks in the
+	// destination topic.
+	var n int64
+	for _, t := range ts {
+		u := versioned(t, t)
+		u.Topic = m.Topic
+		if d, err := duplicated(txn, u); err != nil {
+			return nil, err
+		} else if d {
+			continue
+		}
+		if err := txn.Insert(tableTask, u); err != nil {
+			return nil, err
+		}
+		n++
+	}
+
+	if err := g.commit(txn); err != nil {
+		return nil, err
+	}
+	return &ratus.Updated{
+		Updated: n,
 	}, nil
 }
 
@@ -117,9 +352,61 @@ func (g *Engine) GetTask(ctx context.Context, id string) (*ratus.Task, error) {
 	return clone(r.(*ratus.Task)), nil
 }
 
+// GetTasks gets tasks by their unique IDs in the order of the IDs, skipping missing ones.
+func (g *Engine) GetTasks(ctx context.Context, ids []string) ([]*ratus.Task, error) {
+	txn := g.database.Txn(false)
+	defer txn.Abort()
+
+	v := make([]*ratus.Task, 0, len(ids))
+	seen := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		r, err := txn.First(tableTask, indexID, id)
+		if err != nil {
+			return nil, err
+		}
+		if r != nil {
+			v = append(v, clone(r.(*ratus.Task)))
+		}
+	}
+
+	txn.Commit()
+	return v, nil
+}
+
+// WatchTask blocks until the version of the task differs from the version
+// and returns the task, or returns ErrNotFound once the task is deleted.
+func (g *Engine) WatchTask(ctx context.Context, id string, version int64) (*ratus.Task, error) {
+	for {
+		txn := g.database.Txn(false)
+		ch, r, err := txn.FirstWatch(tableTask, indexID, id)
+		txn.Abort()
+		if err != nil {
+			return nil, err
+		}
+		if r == nil {
+			return nil, ratus.ErrNotFound
+		}
+		if t := r.(*ratus.Task); t.Version != version {
+			return clone(t), nil
+		}
+
+		// The channel is closed when the task or its neighbors in the index
+		// are modified, so the task is looked up again to check its version.
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ch:
+		}
+	}
+}
+
 // InsertTask inserts a new task.
 func (g *Engine) InsertTask(ctx context.Context, t *ratus.Task) (*ratus.Updated, error) {
-	txn := g.database.Txn(true)
+	txn := g.begin()
 	defer txn.Abort()
 
 	// Check if a task with the same ID already exists.
@@ -130,11 +417,16 @@ func (g *Engine) InsertTask(ctx context.Context, t *ratus.Task) (*ratus.Updated,
 	if r != nil {
 		return nil, ratus.ErrConflict
 	}
-	if err := txn.Insert(tableTask, clone(t)); err != nil {
+	if err := checkDuplicated(txn, t); err != nil {
+		return nil, err
+	}
+	if err := txn.Insert(tableTask, versioned(t, nil)); err != nil {
 		return nil, err
 	}
 
-	txn.Commit()
+	if err := g.commit(txn); err != nil {
+		return nil, err
+	}
 	return &ratus.Updated{
 		Created: 1,
 		Updated: 0,
@@ -143,7 +435,7 @@ func (g *Engine) InsertTask(ctx context.Context, t *ratus.Task) (*ratus.Updated,
 
 // UpsertTask inserts or updates a task.
 func (g *Engine) UpsertTask(ctx context.Context, t *ratus.Task) (*ratus.Updated, error) {
-	txn := g.database.Txn(true)
+	txn := g.begin()
 	defer txn.Abort()
 
 	// Check if a task with the same ID already exists before updating to count
@@ -156,11 +448,26 @@ func (g *Engine) UpsertTask(ctx context.Context, t *ratus.Task) (*ratus.Updated,
 	if r != nil {
 		u = 1
 	}
-	if err := txn.Insert(tableTask, clone(t)); err != nil {
+
+	// Verify the version if provided to avoid overwriting concurrent updates.
+	if t.Version != 0 {
+		if r == nil {
+			return nil, ratus.ErrNotFound
+		}
+		if r.(*ratus.Task).Version != t.Version {
+			return nil, ratus.ErrConflict
+		}
+	}
+	if err := checkDuplicated(txn, t); err != nil {
+		return nil, err
+	}
+	if err := txn.Insert(tableTask, versioned(t, r)); err != nil {
 		return nil, err
 	}
 
-	txn.Commit()
+	if err := g.commit(txn); err != nil {
+		return nil, err
+	}
 	return &ratus.Updated{
 		Created: 1 - u,
 		Updated: u,
@@ -169,7 +476,7 @@ func (g *Engine) UpsertTask(ctx context.Context, t *ratus.Task) (*ratus.Updated,
 
 // DeleteTask deletes a task by its unique ID.
 func (g *Engine) DeleteTask(ctx context.Context, id string) (*ratus.Deleted, error) {
-	txn := g.database.Txn(true)
+	txn := g.begin()
 	defer txn.Abort()
 
 	n, err := txn.DeleteAll(tableTask, indexID, id)
@@ -177,8 +484,202 @@ func (g *Engine) DeleteTask(ctx context.Context, id string) (*ratus.Deleted, err
 		return nil, err
 	}
 
-	txn.Commit()
+	if err := g.commit(txn); err != nil {
+		return nil, err
+	}
 	return &ratus.Deleted{
 		Deleted: int64(n),
 	}, nil
 }
+
+// versioned returns a copy of the task to be stored in place of the existing
+// record, with the version incremented from that of the existing record.
+func versioned(t *ratus.Task, r any) *ratus.Task {
+	u := clone(t)
+	u.Version = 1
+	if r != nil {
+		u.Version = r.(*ratus.Task).Version + 1
+	}
+	return u
+}
+
+// duplicated returns whether another task in the same topic holds the
+// deduplication key of the task.
+func duplicated(txn *memdb.Txn, t *ratus.Task) (bool, error) {
+	if t.Dedup == "" {
+		return false, nil
+	}
+	r, err := txn.First(tableTask, indexTopicDedup, t.Topic, t.Dedup)
+	if err != nil {
+		return false, err
+	}
+	return r != nil && r.(*ratus.Task).ID != t.ID, nil
+}
+
+// checkDuplicated returns an error wrapping ErrConflict if another task in
+// the same topic holds the deduplication key of the task.
+func checkDuplicated(txn *memdb.Txn, t *ratus.Task) error {
+	d, err := duplicated(txn, t)
+	if err != nil {
+		return err
+	}
+	if d {
+		return fmt.Errorf("%w: deduplication key %q is held by another task in topic %q", ratus.ErrConflict, t.Dedup, t.Topic)
+	}
+	return nil
+}
+
+// find returns an iterator over the tasks in the topic that match the label
+// selector in the order of the page, starting after the position of the last
+// resource seen if any.
+func find(txn *memdb.Txn, topic string, labels map[string]string, p *engine.Page) (memdb.ResultIterator, error) {
+	if len(labels) > 0 {
+		return search(txn, topic, labels, p)
+	}
+
+	// Select the index matching the sort order, all of which are prefixed by
+	// topics and suffixed by IDs.
+	x, args := indexTopicID, []any{topic}
+	switch p.Sort {
+	case engine.SortScheduled:
+		x, args = indexTopicScheduledID, append(args, p.Time)
+	case engine.SortProduced:
+		x, args = indexTopicProducedID, append(args, p.Time)
+	case engine.SortConsumed:
+		x, args = indexTopicConsumedID, append(args, p.Time)
+	}
+
+	// Scan the whole topic if no resource has been seen, otherwise seek to
+	// the position of the last resource seen.
+	if p.After == "" {
+		if p.Desc {
+			return txn.GetReverse(tableTask, x+"_prefix", topic)
+		}
+		return txn.Get(tableTask, x+"_prefix", topic)
+	}
+	args = append(args, p.After)
+	var it memdb.ResultIterator
+	var err error
+	if p.Desc {
+		it, err = txn.ReverseLowerBound(tableTask, x, args...)
+	} else {
+		it, err = txn.LowerBound(tableTask, x, args...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &bounded{ResultIterator: it, topic: topic, page: p}, nil
+}
+
+// search returns an iterator over the tasks in the topic that match the label
+// selector in the order of the page. The first label in the selector is used
+// to narrow down the range of the iteration, which returns tasks in the order
+// of their IDs, so tasks are sorted in memory when listed in other orders.
+func search(txn *memdb.Txn, topic string, labels map[string]string, p *engine.Page) (memdb.ResultIterator, error) {
+	ks := make([]string, 0, len(labels))
+	for k := range labels {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+	it, err := txn.Get(tableTask, indexLabels, ks[0], labels[ks[0]])
+	if err != nil {
+		return nil, err
+	}
+	it = memdb.NewFilterIterator(it, func(r any) bool {
+		t := r.(*ratus.Task)
+		return t.Topic != topic || !matches(t, labels) || (p.After != "" && !past(p, t))
+	})
+	if !p.ByTime() && !p.Desc {
+		return it, nil
+	}
+	var ts sorted
+	for r := it.Next(); r != nil; r = it.Next() {
+		ts = append(ts, r.(*ratus.Task))
+	}
+	sort.SliceStable(ts, func(i, j int) bool {
+		c := compare(p, ts[i], p.SortTime(ts[j]), ts[j].ID)
+		return (c < 0) != p.Desc
+	})
+	return &ts, nil
+}
+
+// bounded iterates over the tasks in the topic starting from a bound of an
+// index prefixed by topics, skipping the tasks up to the position of the last
+// resource seen and stopping once the end of the topic is reached.
+type bounded struct {
+	memdb.ResultIterator
+	topic string
+	page  *engine.Page
+	done  bool
+}
+
+// Next implements the memdb.ResultIterator interface.
+func (b *bounded) Next() any {
+	for r := b.ResultIterator.Next(); r != nil && !b.done; r = b.ResultIterator.Next() {
+		t := r.(*ratus.Task)
+		if t.Topic != b.topic {
+			break
+		}
+		if past(b.page, t) {
+			return r
+		}
+	}
+	b.done = true
+	return nil
+}
+
+// sorted iterates over tasks that have been sorted in memory.
+type sorted []*ratus.Task
+
+// WatchCh implements the memdb.ResultIterator interface.
+func (s *sorted) WatchCh() <-chan struct{} {
+	return nil
+}
+
+// Next implements the memdb.ResultIterator interface.
+func (s *sorted) Next() any {
+	if len(*s) == 0 {
+		return nil
+	}
+	t := (*s)[0]
+	*s = (*s)[1:]
+	return t
+}
+
+// past returns whether the task is positioned after the last resource seen in
+// the order of the page.
+func past(p *engine.Page, t *ratus.Task) bool {
+	c := compare(p, t, p.Time, p.After)
+	return (c > 0 && !p.Desc) || (c < 0 && p.Desc)
+}
+
+// compare compares the position of the task in ascending order with the
+// position of the time and ID. Times are compared in milliseconds as in the
+// indexes, and missing times are treated as the zero time.
+func compare(p *engine.Page, t *ratus.Task, at *time.Time, id string) int {
+	if p.ByTime() {
+		if c := cmp.Compare(millis(p.SortTime(t)), millis(at)); c != 0 {
+			return c
+		}
+	}
+	return strings.Compare(t.ID, id)
+}
+
+// millis returns the time in milliseconds, or the zero time if it is nil.
+func millis(t *time.Time) int64 {
+	if t == nil {
+		return time.Time{}.UnixMilli()
+	}
+	return t.UnixMilli()
+}
+
+// matches returns whether the labels of the task contain all of the key-value
+// pairs in the label selector.
+func matches(t *ratus.Task, labels map[string]string) bool {
+	for k, v := range labels {
+		if x, ok := t.Labels[k]; !ok || x != v {
+			return false
+		}
+	}
+	return true
+}
@@ -2,43 +2,29 @@ package memdb
 
 import (
 	"context"
+	"time"
 
 	"github.com/hyperonym/ratus"
+	"github.com/hyperonym/ratus/internal/engine"
 )
 
 // ListTopics lists all topics.
-func (g *Engine) ListTopics(ctx context.Context, limit, offset int) ([]*ratus.Topic, error) {
-	txn := g.database.Txn(false)
-	defer txn.Abort()
+func (g *Engine) ListTopics(ctx context.Context, p *engine.Page) ([]*ratus.Topic, error) {
 
-	// Listing topics is a very expensive operation as it requires scanning the
-	// entire database until the required number of results are collected.
-	var (
-		p string
-		n int
-	)
-	it, err := txn.Get(tableTask, indexTopic)
-	if err != nil {
-		return nil, err
-	}
-	v := make([]*ratus.Topic, 0)
-	for r := it.Next(); r != nil && len(v) < limit; r = it.Next() {
-		if t := r.(*ratus.Task); t.Topic != p {
-			p = t.Topic
-			if n >= offset {
-				v = append(v, &ratus.Topic{Name: t.Topic})
-			}
-			n++
-		}
-	}
+	// Topics are listed from the registry rather than scanning the database.
+	// Similar to other engines, the results do not include the number of tasks
+	// under each topic.
+	return g.topics.list(p), nil
+}
 
-	txn.Commit()
-	return v, nil
+// CountTopics counts all topics.
+func (g *Engine) CountTopics(ctx context.Context) (int64, error) {
+	return int64(g.topics.len()), nil
 }
 
 // DeleteTopics deletes all topics and tasks.
 func (g *Engine) DeleteTopics(ctx context.Context) (*ratus.Deleted, error) {
-	txn := g.database.Txn(true)
+	txn := g.begin()
 	defer txn.Abort()
 
 	// Return the number of deleted tasks, not the number of deleted topics.
@@ -46,8 +32,13 @@ func (g *Engine) DeleteTopics(ctx context.Context) (*ratus.Deleted, error) {
 	if err != nil {
 		return nil, err
 	}
+	if _, err := txn.DeleteAll(tableTopic, indexID); err != nil {
+		return nil, err
+	}
 
-	txn.Commit()
+	if err := g.commit(txn); err != nil {
+		return nil, err
+	}
 	return &ratus.Deleted{
 		Deleted: int64(n),
 	}, nil
@@ -57,33 +48,88 @@ func (g *Engine) DeleteTopics(ctx context.Context) (*ratus.Deleted, error) {
 func (g *Engine) GetTopic(ctx context.Context, topic string) (*ratus.Topic, error) {
 	txn := g.database.Txn(false)
 	defer txn.Abort()
+	r, err := txn.First(tableTopic, indexID, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	// Topics are not created manually, their existence depends entirely on
+	// whether there are tasks with the corresponding topic properties, or
+	// whether the settings of the topic have been specified.
+	c := g.topics.get(topic)
+	if r == nil {
+		if c == nil {
+			return nil, ratus.ErrNotFound
+		}
+		return c, nil
+	}
+
+	// Merge the counters from the registry into the settings.
+	v := clone(r.(*ratus.Topic))
+	if c != nil {
+		v.Count = c.Count
+		v.Pending = c.Pending
+		v.Active = c.Active
+		v.Completed = c.Completed
+		v.Archived = c.Archived
+		v.Failed = c.Failed
+	}
+	return v, nil
+}
 
-	// Count records by introspecting the underlying radix tree. Reference:
-	// https://github.com/hashicorp/go-memdb/issues/83#issuecomment-1168332874
-	var n int64
-	it, err := txn.Get(tableTask, indexTopic, topic)
+// GetTopicSettings gets the settings of a topic without counting its tasks, which are empty if not specified.
+func (g *Engine) GetTopicSettings(ctx context.Context, topic string) (*ratus.Topic, error) {
+	txn := g.database.Txn(false)
+	defer txn.Abort()
+	r, err := txn.First(tableTopic, indexID, topic)
 	if err != nil {
 		return nil, err
 	}
-	for r := it.Next(); r != nil; r = it.Next() {
-		n++
+	if r == nil {
+		return &ratus.Topic{Name: topic}, nil
 	}
-	if n == 0 {
-		return nil, ratus.ErrNotFound
+	return clone(r.(*ratus.Topic)), nil
+}
+
+// UpsertTopic inserts or updates the settings of a topic.
+func (g *Engine) UpsertTopic(ctx context.Context, t *ratus.Topic) (*ratus.Updated, error) {
+	txn := g.begin()
+	defer txn.Abort()
+	r, err := txn.First(tableTopic, indexID, t.Name)
+	if err != nil {
+		return nil, err
 	}
 
-	// Currently the information of a topic only contains the name and count.
-	// Information such as progress and states could be added in the future.
-	txn.Commit()
-	return &ratus.Topic{
-		Name:  topic,
-		Count: n,
-	}, nil
+	// Only the settings are stored, the counters are maintained by the
+	// registry.
+	if err := txn.Insert(tableTopic, settings(t)); err != nil {
+		return nil, err
+	}
+
+	if err := g.commit(txn); err != nil {
+		return nil, err
+	}
+	if r == nil {
+		return &ratus.Updated{Created: 1}, nil
+	}
+	return &ratus.Updated{Updated: 1}, nil
+}
+
+// settings returns a copy of the topic with the counters cleared.
+func settings(t *ratus.Topic) *ratus.Topic {
+	u := clone(t)
+	u.Count = 0
+	u.Pending = 0
+	u.Active = 0
+	u.Completed = 0
+	u.Archived = 0
+	u.Failed = 0
+	return u
 }
 
 // DeleteTopic deletes a topic and its tasks.
 func (g *Engine) DeleteTopic(ctx context.Context, topic string) (*ratus.Deleted, error) {
-	txn := g.database.Txn(true)
+	txn := g.begin()
 	defer txn.Abort()
 
 	// Return the number of deleted tasks, not the number of deleted topics.
@@ -91,9 +137,49 @@ func (g *Engine) DeleteTopic(ctx context.Context, topic string) (*ratus.Deleted,
 	if err != nil {
 		return nil, err
 	}
+	if _, err := txn.DeleteAll(tableTopic, indexID, topic); err != nil {
+		return nil, err
+	}
 
-	txn.Commit()
+	if err := g.commit(txn); err != nil {
+		return nil, err
+	}
 	return &ratus.Deleted{
 		Deleted: int64(n),
 	}, nil
 }
+
+// Stats returns statistics of tasks across all topics.
+func (g *Engine) Stats(ctx context.Context) (*ratus.Stats, error) {
+	txn := g.database.Txn(false)
+	defer txn.Abort()
+
+	// Counters are taken from the registry, while the oldest pending task of
+	// each topic is the first one in the pending index.
+	n := g.clock.Now()
+	cs := g.topics.all()
+	ts := make([]*ratus.TopicStats, 0, len(cs))
+	for _, c := range cs {
+		s := ratus.TopicStats{
+			Name:      c.Name,
+			Count:     c.Count,
+			Pending:   c.Pending,
+			Active:    c.Active,
+			Completed: c.Completed,
+			Archived:  c.Archived,
+			Failed:    c.Failed,
+		}
+		it, err := txn.LowerBound(tableTask, indexPendingTopicScheduled, ratus.TaskStatePending, c.Name, time.UnixMilli(0))
+		if err != nil {
+			return nil, err
+		}
+		if r := it.Next(); r != nil {
+			if t := r.(*ratus.Task); t.Topic == c.Name && t.Scheduled != nil && !t.Scheduled.After(n) {
+				s.Oldest = t.Scheduled
+			}
+		}
+		ts = append(ts, &s)
+	}
+
+	return engine.SumStats(ts), nil
+}
@@ -0,0 +1,299 @@
+package memdb
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-memdb"
+
+	"github.com/hyperonym/ratus"
+)
+
+// entry is a change in the write-ahead log. Each entry contains either the
+// full content of an inserted or updated task or topic, the ID of a deleted
+// task or the name of a deleted topic, or the recorded schema version, so that
+// replaying entries multiple times is idempotent.
+type entry struct {
+	Task        *ratus.Task
+	Delete      string
+	Topic       *ratus.Topic
+	DeleteTopic string
+	Schema      *schemaVersion
+}
+
+// frame is a transaction in the write-ahead log. All entries of a transaction
+// are encoded as a single gob message, so that a transaction interrupted while
+// being written is discarded as a whole when replaying the log.
+type frame struct {
+	Entries []entry
+}
+
+// entries converts the changes made in a transaction to entries.
+func entries(cs memdb.Changes) []entry {
+	v := make([]entry, 0, len(cs))
+	for _, c := range cs {
+		switch c.Table {
+		case tableTask:
+			if c.After != nil {
+				v = append(v, entry{Task: c.After.(*ratus.Task)})
+			} else {
+				v = append(v, entry{Delete: c.Before.(*ratus.Task).ID})
+			}
+		case tableTopic:
+			if c.After != nil {
+				v = append(v, entry{Topic: c.After.(*ratus.Topic)})
+			} else {
+				v = append(v, entry{DeleteTopic: c.Before.(*ratus.Topic).Name})
+			}
+		case tableSchema:
+			if c.After != nil {
+				v = append(v, entry{Schema: c.After.(*schemaVersion)})
+			}
+		}
+	}
+	return v
+}
+
+// applyEntry applies the change recorded in the entry to the transaction.
+func applyEntry(txn *memdb.Txn, e *entry) error {
+	switch {
+	case e.Task != nil:
+		return txn.Insert(tableTask, e.Task)
+	case e.Topic != nil:
+		return txn.Insert(tableTopic, e.Topic)
+	case e.Schema != nil:
+		return txn.Insert(tableSchema, e.Schema)
+	case e.DeleteTopic != "":
+		_, err := txn.DeleteAll(tableTopic, indexID, e.DeleteTopic)
+		return err
+	}
+	_, err := txn.DeleteAll(tableTask, indexID, e.Delete)
+	return err
+}
+
+// wal is an append-only log of changes made to the database since the last
+// snapshot. The log is split into segments, each of which is an independent
+// gob stream, so that segments covered by a snapshot can be removed safely
+// after the snapshot has been written. The log is not safe for concurrent use,
+// callers are responsible for serializing writes along with commits.
+type wal struct {
+	path     string
+	interval time.Duration
+
+	seq    int
+	count  int
+	file   *os.File
+	enc    *gob.Encoder
+	synced time.Time
+	err    error
+}
+
+// segmentPath returns the path to the segment with the sequence number.
+func segmentPath(path string, seq int) string {
+	return fmt.Sprintf("%s.%d", path, seq)
+}
+
+// segments returns the sequence numbers of existing segments in ascending
+// order.
+func segments(path string) ([]int, error) {
+	m, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	v := make([]int, 0, len(m))
+	for _, p := range m {
+		n, err := strconv.Atoi(strings.TrimPrefix(p, path+"."))
+		if err != nil || n < 0 {
+			continue
+		}
+		v = append(v, n)
+	}
+	sort.Ints(v)
+	return v, nil
+}
+
+// replay applies the changes recorded in all existing segments to the
+// database in order.
+func replay(db *memdb.MemDB, path string) error {
+	s, err := segments(path)
+	if err != nil {
+		return err
+	}
+	for _, n := range s {
+		if err := replaySegment(db, segmentPath(path, n)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replaySegment applies the changes recorded in a segment to the database.
+func replaySegment(db *memdb.MemDB, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Frames are applied until the end of the segment. A truncated frame
+	// at the end of the segment is the result of an interrupted write and its
+	// transaction has never been committed, so it is safe to discard.
+	dec := gob.NewDecoder(f)
+	txn := db.Txn(true)
+	defer txn.Abort()
+	for {
+		var r frame
+		if err := dec.Decode(&r); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				break
+			}
+			return err
+		}
+		for i := range r.Entries {
+			if err := applyEntry(txn, &r.Entries[i]); err != nil {
+				return err
+			}
+		}
+	}
+	txn.Commit()
+
+	return nil
+}
+
+// newWAL creates a write-ahead log with a new segment after all existing
+// segments.
+func newWAL(path string, interval time.Duration) (*wal, error) {
+	s, err := segments(path)
+	if err != nil {
+		return nil, err
+	}
+	w := wal{path: path, interval: interval}
+	if len(s) > 0 {
+		w.seq = s[len(s)-1]
+	}
+	if err := w.open(w.seq + 1); err != nil {
+		return nil, err
+	}
+	return &w, nil
+}
+
+// open creates the segment with the sequence number and starts writing to it.
+func (w *wal) open(seq int) error {
+	f, err := os.OpenFile(segmentPath(w.path, seq), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	w.seq = seq
+	w.count = 0
+	w.file = f
+	w.enc = gob.NewEncoder(f)
+	return nil
+}
+
+// write appends the entries of a transaction to the log as a single frame.
+// Entries must be written before committing the transaction that made the
+// changes, and the transaction must not be committed if writing fails.
+func (w *wal) write(es []entry) error {
+	if len(es) == 0 {
+		return nil
+	}
+	if w.err != nil {
+		return w.err
+	}
+
+	// Remove the partially written frame of a failed write, so that it will
+	// not be replayed after the transaction has been aborted.
+	off, err := w.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if err := w.append(es); err != nil {
+		if derr := w.discard(off); derr != nil {
+			w.err = fmt.Errorf("write-ahead log is broken: %w", derr)
+			return errors.Join(err, w.err)
+		}
+		return err
+	}
+	w.count++
+
+	return nil
+}
+
+// append encodes the entries as a frame at the end of the current segment.
+func (w *wal) append(es []entry) error {
+	if err := w.enc.Encode(&frame{Entries: es}); err != nil {
+		return err
+	}
+
+	// Flush the log to disk on every write unless an interval is specified.
+	if n := time.Now(); w.interval <= 0 || n.Sub(w.synced) >= w.interval {
+		if err := w.file.Sync(); err != nil {
+			return err
+		}
+		w.synced = n
+	}
+
+	return nil
+}
+
+// discard truncates the current segment back to the offset, and continues
+// writing in a new segment since the state of the encoder can not be rolled
+// back along with the segment.
+func (w *wal) discard(off int64) error {
+	if err := w.file.Truncate(off); err != nil {
+		return err
+	}
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	_, err := w.rotate()
+	return err
+}
+
+// rotate starts a new segment. It returns a function for removing the
+// previous segments, which should be called once the changes in them are
+// persisted.
+func (w *wal) rotate() (func() error, error) {
+	if err := w.file.Close(); err != nil {
+		return nil, err
+	}
+	s := w.seq
+	if err := w.open(s + 1); err != nil {
+		return nil, err
+	}
+
+	return func() error {
+		v, err := segments(w.path)
+		if err != nil {
+			return err
+		}
+		for _, n := range v {
+			if n > s {
+				break
+			}
+			if err := os.Remove(segmentPath(w.path, n)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, nil
+}
+
+// close closes the current segment, and removes it if it is empty.
+func (w *wal) close() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	if w.count == 0 {
+		return os.Remove(segmentPath(w.path, w.seq))
+	}
+	return nil
+}
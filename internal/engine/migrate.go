@@ -0,0 +1,73 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+)
+
+// Migration is a versioned change of the data kept by a storage engine, such
+// as adding indexes or backfilling fields of existing tasks, which is applied
+// once on startup instead of being checked on every operation.
+type Migration struct {
+
+	// Version of the schema after the migration has been applied, starting
+	// from 1 for the first migration of a storage engine.
+	Version int
+
+	// Description of the change for logging.
+	Description string
+
+	// Apply applies the change. Migrations must be idempotent, since they may
+	// be interrupted before the version is recorded, or be applied by multiple
+	// instances starting at the same time.
+	Apply func(ctx context.Context) error
+}
+
+// Schema defines the interface for storage engines to record the version of
+// the schema of their data, which determines the migrations to be applied.
+type Schema interface {
+
+	// SchemaVersion returns the recorded version of the schema, which is zero
+	// if no migration has ever been applied.
+	SchemaVersion(ctx context.Context) (int, error)
+	// SetSchemaVersion records the version of the schema. Recorded versions
+	// must never decrease.
+	SetSchemaVersion(ctx context.Context, v int) error
+}
+
+// Migrate applies the migrations newer than the recorded version of the schema
+// in the order of their versions, and records the version after each of them
+// so that interrupted migrations are resumed on the next startup. Data with a
+// schema newer than the latest migration is refused, since it has been
+// migrated by a newer release that may have made breaking changes.
+func Migrate(ctx context.Context, s Schema, ms []Migration) error {
+	var latest int
+	for _, m := range ms {
+		if m.Version <= latest {
+			return fmt.Errorf("migration %d is out of order", m.Version)
+		}
+		latest = m.Version
+	}
+
+	v, err := s.SchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if v > latest {
+		return fmt.Errorf("schema version %d is newer than the latest supported version %d", v, latest)
+	}
+
+	for _, m := range ms {
+		if m.Version <= v {
+			continue
+		}
+		if err := m.Apply(ctx); err != nil {
+			return fmt.Errorf("failed to apply migration %d (%s): %w", m.Version, m.Description, err)
+		}
+		if err := s.SetSchemaVersion(ctx, m.Version); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,84 @@
+package engine_test
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/hyperonym/ratus/internal/engine"
+)
+
+// schema records the version of the schema in memory.
+type schema struct {
+	version int
+}
+
+func (s *schema) SchemaVersion(ctx context.Context) (int, error) {
+	return s.version, nil
+}
+
+func (s *schema) SetSchemaVersion(ctx context.Context, v int) error {
+	s.version = v
+	return nil
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	var applied []int
+	step := func(v int) engine.Migration {
+		return engine.Migration{Version: v, Description: "test", Apply: func(ctx context.Context) error {
+			applied = append(applied, v)
+			return nil
+		}}
+	}
+
+	t.Run("normal", func(t *testing.T) {
+		applied = nil
+		s := &schema{version: 1}
+		if err := engine.Migrate(ctx, s, []engine.Migration{step(1), step(2), step(3)}); err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(applied, []int{2, 3}) || s.version != 3 {
+			t.Errorf("incorrect migrations, expected [2 3] up to 3, got %v up to %d", applied, s.version)
+		}
+
+		// Migrations that have been applied are not applied again.
+		applied = nil
+		if err := engine.Migrate(ctx, s, []engine.Migration{step(1), step(2), step(3)}); err != nil {
+			t.Fatal(err)
+		}
+		if len(applied) != 0 {
+			t.Errorf("incorrect migrations, expected none, got %v", applied)
+		}
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		s := &schema{}
+		e := errors.New("failed")
+		f := engine.Migration{Version: 2, Apply: func(ctx context.Context) error { return e }}
+		if err := engine.Migrate(ctx, s, []engine.Migration{step(1), f, step(3)}); !errors.Is(err, e) {
+			t.Errorf("incorrect error, expected %q, got %v", e, err)
+		}
+		if s.version != 1 {
+			t.Errorf("incorrect schema version, expected 1, got %d", s.version)
+		}
+	})
+
+	t.Run("newer", func(t *testing.T) {
+		s := &schema{version: 3}
+		if err := engine.Migrate(ctx, s, []engine.Migration{step(1), step(2)}); err == nil {
+			t.Error("expected error, got nil")
+		}
+	})
+
+	t.Run("order", func(t *testing.T) {
+		s := &schema{}
+		if err := engine.Migrate(ctx, s, []engine.Migration{step(2), step(1)}); err == nil {
+			t.Error("expected error, got nil")
+		}
+		if err := engine.Migrate(ctx, s, []engine.Migration{step(1), step(1)}); err == nil {
+			t.Error("expected error, got nil")
+		}
+	})
+}
@@ -0,0 +1,235 @@
+package mongodb
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/bsonrw"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/hyperonym/ratus"
+)
+
+// Names of the supported payload compression algorithms.
+const (
+	compressionGzip = "gzip"
+	compressionZstd = "zstd"
+)
+
+// Compressed payloads are stored as binary data with user defined subtypes as
+// markers of the compression algorithms.
+const (
+	binarySubtypeGzip byte = 0x80
+	binarySubtypeZstd byte = 0x81
+)
+
+// keyValue is the key for wrapping payloads in documents before compression,
+// since payloads are not necessarily documents themselves.
+const keyValue = "v"
+
+// Shared zstd encoder and decoder instances, which are safe for concurrent
+// use and are only created when needed.
+var (
+	zstdEncoder = sync.OnceValues(func() (*zstd.Encoder, error) { return zstd.NewWriter(nil) })
+	zstdDecoder = sync.OnceValues(func() (*zstd.Decoder, error) { return zstd.NewReader(nil) })
+)
+
+// validateCompressionOptions checks whether the payload compression algorithm
+// is supported.
+func validateCompressionOptions(c *Config) error {
+	switch c.PayloadCompression {
+	case "", compressionGzip, compressionZstd:
+		return nil
+	}
+	return fmt.Errorf("unsupported payload compression %q, expected %q or %q", c.PayloadCompression, compressionGzip, compressionZstd)
+}
+
+// compressTask returns a shallow copy of the task with its payload compressed
+// if required, the original task is left unmodified.
+func (g *Engine) compressTask(t *ratus.Task) (*ratus.Task, error) {
+	p, err := g.compressPayload(t.Payload)
+	if err != nil {
+		return nil, err
+	}
+	if !isCompressed(p) {
+		return t, nil
+	}
+	v := *t
+	v.Payload = p
+	return &v, nil
+}
+
+// compressTasks returns the tasks with their payloads compressed if required.
+func (g *Engine) compressTasks(ts []*ratus.Task) ([]*ratus.Task, error) {
+	if g.config.PayloadCompression == "" {
+		return ts, nil
+	}
+	v := make([]*ratus.Task, len(ts))
+	for i, t := range ts {
+		c, err := g.compressTask(t)
+		if err != nil {
+			return nil, err
+		}
+		v[i] = c
+	}
+	return v, nil
+}
+
+// compressCommit returns a shallow copy of the commit with its payload and
+// result compressed if required, the original commit is left unmodified.
+func (g *Engine) compressCommit(m *ratus.Commit) (*ratus.Commit, error) {
+	p, err := g.compressPayload(m.Payload)
+	if err != nil {
+		return nil, err
+	}
+	r, err := g.compressPayload(m.Result)
+	if err != nil {
+		return nil, err
+	}
+	if !isCompressed(p) && !isCompressed(r) {
+		return m, nil
+	}
+	v := *m
+	v.Payload = p
+	v.Result = r
+	return &v, nil
+}
+
+// compressPayload compresses the payload using the configured algorithm if
+// the size of its BSON representation is not less than the threshold. The
+// payload is returned as is if compression does not reduce its size.
+func (g *Engine) compressPayload(p any) (any, error) {
+	if g.config.PayloadCompression == "" || p == nil || isCompressed(p) {
+		return p, nil
+	}
+	b, err := bson.Marshal(bson.D{{Key: keyValue, Value: p}})
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < g.config.PayloadCompressionThreshold {
+		return p, nil
+	}
+
+	var v primitive.Binary
+	switch g.config.PayloadCompression {
+	case compressionGzip:
+		var w bytes.Buffer
+		z := gzip.NewWriter(&w)
+		if _, err := z.Write(b); err != nil {
+			return nil, err
+		}
+		if err := z.Close(); err != nil {
+			return nil, err
+		}
+		v = primitive.Binary{Subtype: binarySubtypeGzip, Data: w.Bytes()}
+	case compressionZstd:
+		z, err := zstdEncoder()
+		if err != nil {
+			return nil, err
+		}
+		v = primitive.Binary{Subtype: binarySubtypeZstd, Data: z.EncodeAll(b, nil)}
+	}
+	if len(v.Data) >= len(b) {
+		return p, nil
+	}
+
+	return v, nil
+}
+
+// isCompressed returns whether the payload has already been compressed.
+func isCompressed(p any) bool {
+	b, ok := p.(primitive.Binary)
+	return ok && (b.Subtype == binarySubtypeGzip || b.Subtype == binarySubtypeZstd)
+}
+
+// decompressPayload decompresses the data and decodes the wrapped payload
+// using the registry.
+func decompressPayload(r *bsoncodec.Registry, subtype byte, data []byte) (any, error) {
+	var b []byte
+	switch subtype {
+	case binarySubtypeGzip:
+		z, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if b, err = io.ReadAll(z); err != nil {
+			return nil, err
+		}
+	case binarySubtypeZstd:
+		z, err := zstdDecoder()
+		if err != nil {
+			return nil, err
+		}
+		if b, err = z.DecodeAll(data, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	d, err := bson.NewDecoder(bsonrw.NewBSONDocumentReader(b))
+	if err != nil {
+		return nil, err
+	}
+	if err := d.SetRegistry(r); err != nil {
+		return nil, err
+	}
+	var v struct {
+		Value any `bson:"v"`
+	}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	return v.Value, nil
+}
+
+// payloadDecoder decodes compressed payloads transparently when decoding into
+// empty interfaces, and delegates the decoding of other values to the default
+// decoder. Payloads are always decoded into empty interfaces since their types
+// are not known in advance.
+type payloadDecoder struct {
+	bsoncodec.ValueDecoder
+}
+
+// DecodeValue implements the bsoncodec.ValueDecoder interface.
+func (d payloadDecoder) DecodeValue(dc bsoncodec.DecodeContext, vr bsonrw.ValueReader, v reflect.Value) error {
+	if vr.Type() != bsontype.Binary {
+		return d.ValueDecoder.DecodeValue(dc, vr, v)
+	}
+	b, s, err := vr.ReadBinary()
+	if err != nil {
+		return err
+	}
+	var x any = primitive.Binary{Subtype: s, Data: b}
+	if s == binarySubtypeGzip || s == binarySubtypeZstd {
+		if x, err = decompressPayload(dc.Registry, s, b); err != nil {
+			return err
+		}
+	}
+	if x == nil {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	v.Set(reflect.ValueOf(x))
+	return nil
+}
+
+// registerPayloadDecoder registers the payload decoder for empty interfaces in
+// the registry. Compressed payloads can always be decoded regardless of the
+// current compression settings.
+func registerPayloadDecoder(r *bsoncodec.Registry) error {
+	t := reflect.TypeOf((*any)(nil)).Elem()
+	d, err := r.LookupDecoder(t)
+	if err != nil {
+		return err
+	}
+	r.RegisterTypeDecoder(t, payloadDecoder{d})
+	return nil
+}
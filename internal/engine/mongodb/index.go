@@ -0,0 +1,111 @@
+package mongodb
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// defaultIndexes contains the names of the indexes created on the task
+// collection by default, except for the index on the ID field which always
+// exists.
+var defaultIndexes = []string{
+	indexTopic,
+	indexTopicID,
+	indexTopicScheduledID,
+	indexTopicProducedID,
+	indexTopicConsumedID,
+	indexTopicDedup,
+	indexLabels,
+	indexPendingTopicScheduled,
+	indexPendingTopicProducerScheduled,
+	indexPendingTopicPriorityScheduled,
+	indexPendingTopicDeferredScheduled,
+	indexDeferredScheduled,
+	indexBlockedProduced,
+	indexActiveDeadline,
+	indexActiveTopic,
+	indexCompletedConsumed,
+	indexArchivedTopicConsumed,
+}
+
+// customIndex is the definition of an index in the configuration. Keys and
+// partial filter expressions are decoded as ordered documents, since the order
+// of the keys of compound indexes is significant.
+type customIndex struct {
+	Name          string `bson:"name"`
+	Keys          bson.D `bson:"keys"`
+	Unique        bool   `bson:"unique"`
+	PartialFilter bson.D `bson:"partial_filter"`
+}
+
+// parseIndexOptions parses the names of default indexes to be skipped and the
+// definitions of custom indexes. Custom indexes replace the default indexes
+// with the same names, which are skipped as well.
+func parseIndexOptions(c *Config) (map[string]bool, []mongo.IndexModel, error) {
+	skip := make(map[string]bool)
+	for _, s := range strings.Split(c.SkipIndexes, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		if !slices.Contains(defaultIndexes, s) {
+			return nil, nil, fmt.Errorf("unknown default index %q", s)
+		}
+		skip[s] = true
+	}
+
+	if strings.TrimSpace(c.CustomIndexes) == "" {
+		return skip, nil, nil
+	}
+	var v struct {
+		Indexes []customIndex `bson:"indexes"`
+	}
+	if err := bson.UnmarshalExtJSON([]byte(`{"indexes":`+c.CustomIndexes+`}`), false, &v); err != nil {
+		return nil, nil, fmt.Errorf("invalid custom indexes: %w", err)
+	}
+	ms := make([]mongo.IndexModel, 0, len(v.Indexes))
+	names := make(map[string]bool)
+	for i, x := range v.Indexes {
+		if x.Name == "" || len(x.Keys) == 0 {
+			return nil, nil, fmt.Errorf("custom index %d must have a name and keys", i)
+		}
+		if x.Name == indexID || names[x.Name] {
+			return nil, nil, fmt.Errorf("duplicate index name %q", x.Name)
+		}
+		names[x.Name] = true
+		o := options.Index().SetName(x.Name)
+		if x.Unique {
+			o.SetUnique(true)
+		}
+		if x.PartialFilter != nil {
+			o.SetPartialFilterExpression(x.PartialFilter)
+		}
+		ms = append(ms, mongo.IndexModel{Keys: x.Keys, Options: o})
+		if slices.Contains(defaultIndexes, x.Name) {
+			skip[x.Name] = true
+		}
+	}
+
+	return skip, ms, nil
+}
+
+// createMany creates the indexes on the task collection except for the ones
+// configured to be skipped.
+func (g *Engine) createMany(ctx context.Context, ms []mongo.IndexModel) error {
+	v := make([]mongo.IndexModel, 0, len(ms))
+	for _, m := range ms {
+		if !g.skipIndexes[*m.Options.Name] {
+			v = append(v, m)
+		}
+	}
+	if len(v) == 0 {
+		return nil
+	}
+	_, err := g.collection.Indexes().CreateMany(ctx, v)
+	return err
+}
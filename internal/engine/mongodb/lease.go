@@ -0,0 +1,122 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// errLeaseDisabled is returned when leases are used without a lease collection.
+var errLeaseDisabled = errors.New("lease collection is not configured")
+
+// Acquire acquires or renews the named lease for the holder for the duration,
+// and returns whether the lease is held by the holder. Leases are stored as
+// documents keyed by their names, and expiration times are based on the
+// clocks of the instances, which are expected to be reasonably synchronized.
+func (g *Engine) Acquire(ctx context.Context, name, holder string, d time.Duration) (bool, error) {
+	if g.leases == nil {
+		return false, errLeaseDisabled
+	}
+	return retry(ctx, g, func() (bool, error) {
+
+		// Take over the lease if it is held by the holder or has expired. If
+		// the lease is held by another holder, the filter will not match and
+		// the upsert will fail due to the duplicate key.
+		n := g.clock.Now()
+		filter := bson.D{
+			{Key: keyID, Value: name},
+			{Key: "$or", Value: bson.A{
+				bson.D{{Key: keyHolder, Value: holder}},
+				bson.D{{Key: keyExpires, Value: bson.D{{Key: "$lte", Value: n}}}},
+			}},
+		}
+		update := bson.D{{Key: "$set", Value: bson.D{
+			{Key: keyHolder, Value: holder},
+			{Key: keyExpires, Value: n.Add(d)},
+		}}}
+		if _, err := g.leases.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true)); err != nil {
+			if mongo.IsDuplicateKeyError(err) {
+				return false, nil
+			}
+			return false, err
+		}
+		return true, nil
+	})
+}
+
+// Release releases the named lease if it is held by the holder.
+func (g *Engine) Release(ctx context.Context, name, holder string) error {
+	if g.leases == nil {
+		return errLeaseDisabled
+	}
+	_, err := retry(ctx, g, func() (*mongo.DeleteResult, error) {
+		return g.leases.DeleteOne(ctx, bson.D{
+			{Key: keyID, Value: name},
+			{Key: keyHolder, Value: holder},
+		})
+	})
+	return err
+}
+
+// Announce records that the holder is alive in the role for the duration.
+// Announcements are stored along with leases as documents keyed by the roles
+// and holders, and expired announcements of the role are deleted on the way.
+func (g *Engine) Announce(ctx context.Context, role, holder string, d time.Duration) error {
+	if g.leases == nil {
+		return errLeaseDisabled
+	}
+	_, err := retry(ctx, g, func() (*mongo.UpdateResult, error) {
+		n := g.clock.Now()
+		if _, err := g.leases.DeleteMany(ctx, bson.D{
+			{Key: keyID, Value: announcements(role)},
+			{Key: keyExpires, Value: bson.D{{Key: "$lte", Value: n}}},
+		}); err != nil {
+			return nil, err
+		}
+		return g.leases.UpdateOne(ctx, bson.D{
+			{Key: keyID, Value: role + ":" + holder},
+		}, bson.D{{Key: "$set", Value: bson.D{
+			{Key: keyHolder, Value: holder},
+			{Key: keyExpires, Value: n.Add(d)},
+		}}}, options.Update().SetUpsert(true))
+	})
+	return err
+}
+
+// Announced lists the holders that are alive in the role in ascending order.
+func (g *Engine) Announced(ctx context.Context, role string) ([]string, error) {
+	if g.leases == nil {
+		return nil, errLeaseDisabled
+	}
+	return retry(ctx, g, func() ([]string, error) {
+		cursor, err := g.leases.Find(ctx, bson.D{
+			{Key: keyID, Value: announcements(role)},
+			{Key: keyExpires, Value: bson.D{{Key: "$gt", Value: g.clock.Now()}}},
+		}, options.Find().SetSort(bson.D{{Key: keyHolder, Value: 1}}))
+		if err != nil {
+			return nil, err
+		}
+		var v []struct {
+			Holder string `bson:"holder"`
+		}
+		if err := cursor.All(ctx, &v); err != nil {
+			return nil, err
+		}
+		hs := make([]string, len(v))
+		for i, x := range v {
+			hs[i] = x.Holder
+		}
+		return hs, nil
+	})
+}
+
+// announcements returns the filter that matches the keys of announcements of
+// the role, which are prefixed by the name of the role.
+func announcements(role string) bson.D {
+	return bson.D{{Key: "$regex", Value: "^" + regexp.QuoteMeta(role+":")}}
+}
@@ -0,0 +1,57 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/hyperonym/ratus/internal/engine"
+)
+
+// schemaMigrations returns the migrations of the task collection in the order
+// of their versions. Migrations must only be appended, since their versions
+// are recorded in the migration collection.
+func (g *Engine) schemaMigrations() []engine.Migration {
+	return []engine.Migration{
+		{Version: 1, Description: "backfill versions of tasks", Apply: g.backfillVersions},
+		{Version: 2, Description: "create default indexes", Apply: g.createDefaultIndexes},
+		{Version: 3, Description: "create priority index", Apply: g.createPriorityIndex},
+	}
+}
+
+// SchemaVersion returns the recorded schema version of the task collection.
+// The version is stored as a document keyed by the name of the collection.
+func (g *Engine) SchemaVersion(ctx context.Context) (int, error) {
+	var v struct {
+		Version int `bson:"version"`
+	}
+	err := g.migrations.FindOne(ctx, bson.D{{Key: keyID, Value: g.collection.Name()}}).Decode(&v)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return 0, nil
+	}
+	return v.Version, err
+}
+
+// SetSchemaVersion records the schema version of the task collection. Older
+// versions recorded by instances that finished migrating later are ignored.
+func (g *Engine) SetSchemaVersion(ctx context.Context, v int) error {
+	_, err := g.migrations.UpdateOne(ctx, bson.D{{Key: keyID, Value: g.collection.Name()}}, bson.D{
+		{Key: "$max", Value: bson.D{{Key: keyVersion, Value: v}}},
+		{Key: "$currentDate", Value: bson.D{{Key: keyMigrated, Value: true}}},
+	}, options.Update().SetUpsert(true))
+	return err
+}
+
+// backfillVersions sets the version of tasks created before versions were
+// tracked to 1, so that they can be updated conditionally like other tasks.
+func (g *Engine) backfillVersions(ctx context.Context) error {
+	_, err := g.collection.UpdateMany(ctx, bson.D{
+		{Key: keyVersion, Value: bson.D{{Key: "$exists", Value: false}}},
+	}, bson.D{
+		{Key: "$set", Value: bson.D{{Key: keyVersion, Value: int64(1)}}},
+	})
+	return err
+}
@@ -3,7 +3,15 @@ package mongodb
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
 	"reflect"
+	"sort"
+	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -11,10 +19,14 @@ import (
 	"go.mongodb.org/mongo-driver/bson/bsontype"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
 	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
 	"golang.org/x/sync/errgroup"
 
 	"github.com/hyperonym/ratus"
+	"github.com/hyperonym/ratus/clock"
+	"github.com/hyperonym/ratus/internal/engine"
 	"github.com/hyperonym/ratus/internal/nonce"
 )
 
@@ -24,28 +36,83 @@ const (
 	keyTopic     = "topic"
 	keyState     = "state"
 	keyNonce     = "nonce"
+	keyVersion   = "version"
+	keyProducer  = "producer"
 	keyConsumer  = "consumer"
 	keyScheduled = "scheduled"
+	keyProduced  = "produced"
 	keyConsumed  = "consumed"
 	keyDeadline  = "deadline"
 	keyPayload   = "payload"
+	keyResult    = "result"
+	keyHolder    = "holder"
+	keyExpires   = "expires"
+	keyRetention = "retention"
+	keyDeferred  = "deferred"
+	keyDependsOn = "depends_on"
+	keyDedup     = "dedup"
+	keyWindow    = "dedup_window"
+	keyLabels    = "labels"
+	keyPriority  = "priority"
+	keyHistory   = "history"
+	keyLastError = "last_error"
+	keyProgress  = "progress"
+	keyMigrated  = "migrated"
+	keyClaims    = "claims"
 )
 
 // Name constants for index creation and selection.
 const (
-	indexID                    = "_id_"
-	indexTopic                 = "topic_hashed"
-	indexPendingTopicScheduled = "topic_1_scheduled_1"
-	indexActiveDeadline        = "deadline_1"
-	indexActiveTopic           = "topic_1"
-	indexCompletedConsumed     = "consumed_1"
+	indexID                            = "_id_"
+	indexTopic                         = "topic_hashed"
+	indexTopicID                       = "topic_1__id_1"
+	indexTopicScheduledID              = "topic_1_scheduled_1__id_1"
+	indexTopicProducedID               = "topic_1_produced_1__id_1"
+	indexTopicConsumedID               = "topic_1_consumed_1__id_1"
+	indexTopicDedup                    = "topic_1_dedup_1"
+	indexLabels                        = "labels.$**_1"
+	indexPendingTopicScheduled         = "topic_1_scheduled_1"
+	indexPendingTopicProducerScheduled = "topic_1_producer_1_scheduled_1"
+	indexPendingTopicPriorityScheduled = "topic_1_priority_-1_scheduled_1"
+	indexPendingTopicDeferredScheduled = "topic_1_deferred_1_scheduled_1"
+	indexDeferredScheduled             = "scheduled_1"
+	indexBlockedProduced               = "produced_1"
+	indexActiveDeadline                = "deadline_1"
+	indexActiveTopic                   = "topic_1"
+	indexCompletedConsumed             = "consumed_1"
+	indexArchivedTopicConsumed         = "topic_1_consumed_1"
 )
 
+// topicCacheTTL is the duration for caching settings of topics when polling.
+const topicCacheTTL = 1 * time.Second
+
+// defaultArchiveBatchSize is the maximum number of tasks to move into the
+// archive collection in a single batch if the batch size is not configured.
+const defaultArchiveBatchSize = 1000
+
+// Bounds of the backoff duration between retries.
+const (
+	minRetryBackoff = 10 * time.Millisecond
+	maxRetryBackoff = 5 * time.Second
+)
+
+// defaultWatchInterval is the interval for sending periodic notifications if
+// the watch interval is not configured.
+const defaultWatchInterval = 1 * time.Second
+
+// probeTimeout is the maximum duration of probing the topology of the
+// deployment when opening the storage engine.
+const probeTimeout = 5 * time.Second
+
 // Partial filter expressions for index creation.
 var (
 	filterStatePending   = bson.D{{Key: keyState, Value: ratus.TaskStatePending}}
 	filterStateActive    = bson.D{{Key: keyState, Value: ratus.TaskStateActive}}
 	filterStateCompleted = bson.D{{Key: keyState, Value: ratus.TaskStateCompleted}}
+	filterStateArchived  = bson.D{{Key: keyState, Value: ratus.TaskStateArchived}}
+	filterStateDeferred  = bson.D{{Key: keyState, Value: ratus.TaskStatePending}, {Key: keyDeferred, Value: true}}
+	filterStateBlocked   = bson.D{{Key: keyState, Value: ratus.TaskStatePending}, {Key: keyDependsOn, Value: bson.D{{Key: "$exists", Value: true}}}}
+	filterDedup          = bson.D{{Key: keyDedup, Value: bson.D{{Key: "$exists", Value: true}}}}
 )
 
 // List of MongoDB server error codes that should trigger a fallback.
@@ -54,25 +121,128 @@ var fallbackErrorCodes = []int{
 	31025, // Shard key update is not allowed without specifying the full shard key in the query.
 }
 
+// List of MongoDB server error codes indicating that change streams are not
+// supported by the deployment.
+var fallbackWatchErrorCodes = []int{
+	40573, // The $changeStream stage is only supported on replica sets.
+	40324, // Unrecognized pipeline stage name: '$changeStream'.
+}
+
+// List of MongoDB server error codes indicating that multi-document
+// transactions are not supported by the deployment.
+var fallbackTransactionErrorCodes = []int{
+	20, // Transaction numbers are only allowed on a replica set member or mongos.
+}
+
+// List of MongoDB server error codes indicating transient failures, such as
+// network errors and primary elections, that are likely to succeed on retry.
+var retryErrorCodes = []int{
+	6,     // HostUnreachable
+	7,     // HostNotFound
+	89,    // NetworkTimeout
+	91,    // ShutdownInProgress
+	112,   // WriteConflict
+	189,   // PrimarySteppedDown
+	9001,  // SocketException
+	10107, // NotWritablePrimary
+	11600, // InterruptedAtShutdown
+	11602, // InterruptedDueToReplStateChange
+	13435, // NotPrimaryNoSecondaryOk
+	13436, // NotPrimaryOrSecondary
+}
+
 // Config contains configurations for the MongoDB storage engine.
 type Config struct {
 	URI        string `arg:"--mongodb-uri,env:MONGODB_URI" placeholder:"URI" help:"connection URI of the MongoDB deployment to connect to" default:"mongodb://127.0.0.1:27017"`
 	Database   string `arg:"--mongodb-database,env:MONGODB_DATABASE" placeholder:"NAME" help:"name of the MongoDB database to use" default:"ratus"`
 	Collection string `arg:"--mongodb-collection,env:MONGODB_COLLECTION" placeholder:"NAME" help:"name of the MongoDB collection to store tasks" default:"tasks"`
 
+	TopicCollection string `arg:"--mongodb-topic-collection,env:MONGODB_TOPIC_COLLECTION" placeholder:"NAME" help:"name of the MongoDB collection to store topic settings, empty to use the name of the task collection with a _topics suffix"`
+
+	MigrationCollection string `arg:"--mongodb-migration-collection,env:MONGODB_MIGRATION_COLLECTION" placeholder:"NAME" help:"name of the MongoDB collection to record the schema version of the task collection, empty to use the name of the task collection with a _migrations suffix"`
+
+	MaxPoolSize            uint64        `arg:"--mongodb-max-pool-size,env:MONGODB_MAX_POOL_SIZE" placeholder:"SIZE" help:"maximum number of connections in the connection pool, zero to use the value from the URI or driver default"`
+	MinPoolSize            uint64        `arg:"--mongodb-min-pool-size,env:MONGODB_MIN_POOL_SIZE" placeholder:"SIZE" help:"minimum number of connections in the connection pool, zero to use the value from the URI or driver default"`
+	ServerSelectionTimeout time.Duration `arg:"--mongodb-server-selection-timeout,env:MONGODB_SERVER_SELECTION_TIMEOUT" placeholder:"DURATION" help:"timeout for selecting a suitable server to execute an operation, zero to use the value from the URI or driver default"`
+	SocketTimeout          time.Duration `arg:"--mongodb-socket-timeout,env:MONGODB_SOCKET_TIMEOUT" placeholder:"DURATION" help:"timeout for socket reads and writes, zero to use the value from the URI or driver default"`
+	ReadPreference         string        `arg:"--mongodb-read-preference,env:MONGODB_READ_PREFERENCE" placeholder:"MODE" help:"read preference mode such as primary, primaryPreferred, secondary, secondaryPreferred or nearest"`
+	ReadConcern            string        `arg:"--mongodb-read-concern,env:MONGODB_READ_CONCERN" placeholder:"LEVEL" help:"read concern level such as local, available, majority, linearizable or snapshot"`
+	WriteConcern           string        `arg:"--mongodb-write-concern,env:MONGODB_WRITE_CONCERN" placeholder:"W" help:"write concern acknowledgment, either majority, a number of instances or a tag set name"`
+
+	TLSCAFile             string `arg:"--mongodb-tls-ca-file,env:MONGODB_TLS_CA_FILE" placeholder:"PATH" help:"path to the PEM encoded certificate authority file for verifying server certificates"`
+	TLSCertificateKeyFile string `arg:"--mongodb-tls-certificate-key-file,env:MONGODB_TLS_CERTIFICATE_KEY_FILE" placeholder:"PATH" help:"path to the PEM encoded file containing both the client certificate and private key"`
+	TLSInsecure           bool   `arg:"--mongodb-tls-insecure,env:MONGODB_TLS_INSECURE" help:"disable verification of server certificates and hostnames"`
+
+	AuthMechanism   string `arg:"--mongodb-auth-mechanism,env:MONGODB_AUTH_MECHANISM" placeholder:"NAME" help:"authentication mechanism such as SCRAM-SHA-256, MONGODB-X509 or MONGODB-AWS"`
+	AuthSource      string `arg:"--mongodb-auth-source,env:MONGODB_AUTH_SOURCE" placeholder:"NAME" help:"name of the database to authenticate against"`
+	Username        string `arg:"--mongodb-username,env:MONGODB_USERNAME" placeholder:"NAME" help:"username for authentication, or the access key ID when using MONGODB-AWS" secret:"true"`
+	Password        string `arg:"--mongodb-password,env:MONGODB_PASSWORD" placeholder:"PASSWORD" help:"password for authentication, or the secret access key when using MONGODB-AWS" secret:"true"`
+	AWSSessionToken string `arg:"--mongodb-aws-session-token,env:MONGODB_AWS_SESSION_TOKEN" placeholder:"TOKEN" help:"session token for temporary credentials when using MONGODB-AWS" secret:"true"`
+
+	MaxRetries   int           `arg:"--mongodb-max-retries,env:MONGODB_MAX_RETRIES" placeholder:"N" help:"maximum number of retries for operations that failed with transient errors, zero to disable" default:"3"`
+	RetryBackoff time.Duration `arg:"--mongodb-retry-backoff,env:MONGODB_RETRY_BACKOFF" placeholder:"DURATION" help:"initial backoff duration between retries, doubled after each retry" default:"100ms"`
+
 	RetentionPeriod time.Duration `arg:"--mongodb-retention-period,env:MONGODB_RETENTION_PERIOD" placeholder:"DURATION" help:"retention period for completed tasks" default:"72h"`
+	HistoryLimit    int           `arg:"--mongodb-history-limit,env:MONGODB_HISTORY_LIMIT" placeholder:"N" help:"maximum number of state transitions recorded in the history of each task, zero to disable"`
+	DeferralHorizon time.Duration `arg:"--mongodb-deferral-horizon,env:MONGODB_DEFERRAL_HORIZON" placeholder:"DURATION" help:"keep tasks scheduled further into the future than this duration out of the polling range of the pending index until background jobs promote them, should be longer than the chore interval, zero to disable"`
+
+	ArchiveCollection string `arg:"--mongodb-archive-collection,env:MONGODB_ARCHIVE_COLLECTION" placeholder:"NAME" help:"name of the MongoDB collection to move completed and archived tasks into during chores, empty to disable archiving"`
+	ArchiveCappedSize int64  `arg:"--mongodb-archive-capped-size,env:MONGODB_ARCHIVE_CAPPED_SIZE" placeholder:"BYTES" help:"create the archive collection as a capped collection with the given maximum size in bytes"`
+	ArchiveTimeSeries bool   `arg:"--mongodb-archive-time-series,env:MONGODB_ARCHIVE_TIME_SERIES" help:"create the archive collection as a time series collection using the produced time"`
+
+	LeaseCollection string `arg:"--mongodb-lease-collection,env:MONGODB_LEASE_COLLECTION" placeholder:"NAME" help:"name of the MongoDB collection to store leases for electing the instance that runs background jobs, empty to disable leader election" default:"leases"`
+
+	EnableSharding bool   `arg:"--mongodb-enable-sharding,env:MONGODB_ENABLE_SHARDING" help:"enable sharding on the database and shard the task collection on startup"`
+	ShardKey       string `arg:"--mongodb-shard-key,env:MONGODB_SHARD_KEY" placeholder:"KEY" help:"field to use as the hashed shard key of the task collection, either topic or _id" default:"topic"`
+
+	SkipIndexes   string `arg:"--mongodb-skip-indexes,env:MONGODB_SKIP_INDEXES" placeholder:"NAMES" help:"comma-separated list of names of default indexes not to be created on startup, such as topic_1_dedup_1, which must be managed manually under the same names since queries select indexes by name"`
+	CustomIndexes string `arg:"--mongodb-custom-indexes,env:MONGODB_CUSTOM_INDEXES" placeholder:"JSON" help:"JSON array of additional indexes to be created on startup, each with a name, keys, and optionally unique and partial_filter, replacing the default indexes with the same names"`
 
 	DisableIndexCreation bool `arg:"--mongodb-disable-index-creation,env:MONGODB_DISABLE_INDEX_CREATION" help:"disable automatic index creation on startup"`
+	DisableMigrations    bool `arg:"--mongodb-disable-migrations,env:MONGODB_DISABLE_MIGRATIONS" help:"disable automatic schema migrations on startup"`
 	DisableAutoFallback  bool `arg:"--mongodb-disable-auto-fallback,env:MONGODB_DISABLE_AUTO_FALLBACK" help:"disable transparent fallbacks for unsupported operations"`
 	DisableAtomicPoll    bool `arg:"--mongodb-disable-atomic-poll,env:MONGODB_DISABLE_ATOMIC_POLL" help:"disable atomic polling and fallback to optimistic locking"`
+	DisableChangeStreams bool `arg:"--mongodb-disable-change-streams,env:MONGODB_DISABLE_CHANGE_STREAMS" help:"disable change streams and fallback to periodic notifications"`
+	DisableTransactions  bool `arg:"--mongodb-disable-transactions,env:MONGODB_DISABLE_TRANSACTIONS" help:"disable multi-document transactions for non-atomic fallback operations"`
+
+	PayloadCompression          string `arg:"--mongodb-payload-compression,env:MONGODB_PAYLOAD_COMPRESSION" placeholder:"NAME" help:"algorithm for compressing large payloads at rest, either gzip or zstd, empty to disable"`
+	PayloadCompressionThreshold int    `arg:"--mongodb-payload-compression-threshold,env:MONGODB_PAYLOAD_COMPRESSION_THRESHOLD" placeholder:"BYTES" help:"minimum size in bytes of payloads to be compressed" default:"1024"`
+
+	WatchInterval time.Duration `arg:"--mongodb-watch-interval,env:MONGODB_WATCH_INTERVAL" placeholder:"DURATION" help:"interval for sending notifications when change streams are not available" default:"1s"`
+
+	// Limits of background jobs inherited from the chore configuration.
+	ChoreBatchSize  int           `arg:"-"`
+	ChoreTimeBudget time.Duration `arg:"-"`
+
+	// Handling of expired tasks inherited from the expiry configuration.
+	ExpiryTopic    string          `arg:"-"`
+	ExpiryExporter engine.Exporter `arg:"-"`
+
+	// Clock for telling the current time, which defaults to the system clock.
+	Clock clock.Clock `arg:"-"`
 }
 
 // Engine implements the storage engine interface for MongoDB.
 type Engine struct {
 	config     *Config
+	clock      clock.Clock
 	client     *mongo.Client
 	database   *mongo.Database
 	collection *mongo.Collection
+	archive    *mongo.Collection
+	leases     *mongo.Collection
+	topics     *mongo.Collection
+	migrations *mongo.Collection
+
+	// Names of default indexes not to be created, and custom indexes to be
+	// created in addition to the remaining ones.
+	skipIndexes   map[string]bool
+	customIndexes []mongo.IndexModel
+
+	// Cached settings of topics and producers served last in topics with fair
+	// polling enabled, both keyed by the name of the topic.
+	cache   sync.Map
+	cursors sync.Map
 
 	// Atomic fallback flags: -1 = disabled, 0 = auto, 1 = enabled.
 	fallbackPoll          *atomic.Int32
@@ -81,29 +251,78 @@ type Engine struct {
 	fallbackUpsertTask    *atomic.Int32
 	fallbackInsertPromise *atomic.Int32
 	fallbackUpsertPromise *atomic.Int32
+	fallbackStealPromise  *atomic.Int32
+	fallbackWatch         *atomic.Int32
+	fallbackTransaction   *atomic.Int32
+
+	// Whether the deployment has been found to be a standalone server.
+	standalone *atomic.Bool
 }
 
 // New creates a new MongoDB storage engine instance.
 func New(c *Config) (*Engine, error) {
+	if err := validateArchiveOptions(c); err != nil {
+		return nil, err
+	}
+	if err := validateShardingOptions(c); err != nil {
+		return nil, err
+	}
+	if err := validateCompressionOptions(c); err != nil {
+		return nil, err
+	}
+	if c.DeferralHorizon < 0 {
+		return nil, fmt.Errorf("invalid deferral horizon %s", c.DeferralHorizon)
+	}
+	if c.HistoryLimit < 0 {
+		return nil, fmt.Errorf("invalid history limit %d", c.HistoryLimit)
+	}
+	skip, custom, err := parseIndexOptions(c)
+	if err != nil {
+		return nil, err
+	}
+
+	k := c.Clock
+	if k == nil {
+		k = clock.System
+	}
+
 	g := Engine{
 		config:                c,
+		clock:                 k,
 		fallbackPoll:          &atomic.Int32{},
 		fallbackCommit:        &atomic.Int32{},
 		fallbackUpsertTasks:   &atomic.Int32{},
 		fallbackUpsertTask:    &atomic.Int32{},
 		fallbackInsertPromise: &atomic.Int32{},
 		fallbackUpsertPromise: &atomic.Int32{},
+		fallbackStealPromise:  &atomic.Int32{},
+		fallbackWatch:         &atomic.Int32{},
+		fallbackTransaction:   &atomic.Int32{},
+		standalone:            &atomic.Bool{},
+		skipIndexes:           skip,
+		customIndexes:         custom,
 	}
 
 	// By default, BSON documents will decode into interface values as bson.D.
 	// This custom registry maps bsontype.EmbeddedDocument entry to bson.M,
-	// which is more in line with the JSON marshaler/unmarshaler.
-	r := bson.NewRegistryBuilder().RegisterTypeMapEntry(bsontype.EmbeddedDocument, reflect.TypeOf(bson.M{})).Build()
+	// which is more in line with the JSON marshaler/unmarshaler. Compressed
+	// payloads are also decoded transparently using this registry.
+	r := bson.NewRegistry()
+	r.RegisterTypeMapEntry(bsontype.EmbeddedDocument, reflect.TypeOf(bson.M{}))
+	if err := registerPayloadDecoder(r); err != nil {
+		return nil, err
+	}
+
+	// Options specified in the configuration take precedence over the ones
+	// specified in the connection URI.
+	o := options.Client().ApplyURI(c.URI).SetRegistry(r)
+	if err := applyClientOptions(o, c); err != nil {
+		return nil, err
+	}
 
 	// Create a new client without actually connecting to the deployment.
 	// Initialization processes that requires I/O should happen in Open.
-	var err error
-	g.client, err = mongo.NewClient(options.Client().ApplyURI(c.URI).SetRegistry(r))
+	g.client, err = mongo.NewClient(o)
 	if err != nil {
 		return nil, err
 	}
@@ -111,6 +330,22 @@ func New(c *Config) (*Engine, error) {
 	// Get handles for the database and the collection.
 	g.database = g.client.Database(c.Database)
 	g.collection = g.database.Collection(c.Collection)
+	if c.TopicCollection != "" {
+		g.topics = g.database.Collection(c.TopicCollection)
+	} else {
+		g.topics = g.database.Collection(c.Collection + "_topics")
+	}
+	if c.MigrationCollection != "" {
+		g.migrations = g.database.Collection(c.MigrationCollection)
+	} else {
+		g.migrations = g.database.Collection(c.Collection + "_migrations")
+	}
+	if c.ArchiveCollection != "" {
+		g.archive = g.database.Collection(c.ArchiveCollection)
+	}
+	if c.LeaseCollection != "" {
+		g.leases = g.database.Collection(c.LeaseCollection)
+	}
 
 	// Disable transparent fallbacks if required.
 	if c.DisableAutoFallback {
@@ -122,14 +357,245 @@ func New(c *Config) (*Engine, error) {
 		g.fallbackPoll.Store(1)
 	}
 
+	// Disable change streams if required.
+	if c.DisableChangeStreams {
+		g.fallbackWatch.Store(1)
+	}
+
+	// Disable multi-document transactions if required.
+	if c.DisableTransactions {
+		g.fallbackTransaction.Store(1)
+	}
+
 	return &g, nil
 }
 
+// validateArchiveOptions checks whether the archive collection options are
+// compatible with each other.
+func validateArchiveOptions(c *Config) error {
+	if c.ArchiveCollection == "" {
+		if c.ArchiveCappedSize > 0 || c.ArchiveTimeSeries {
+			return fmt.Errorf("archive collection options require an archive collection name")
+		}
+		return nil
+	}
+	if c.ArchiveCollection == c.Collection {
+		return fmt.Errorf("archive collection %q must be different from the task collection", c.ArchiveCollection)
+	}
+	if c.ArchiveCappedSize < 0 {
+		return fmt.Errorf("invalid archive capped size %d", c.ArchiveCappedSize)
+	}
+	if c.ArchiveCappedSize > 0 && c.ArchiveTimeSeries {
+		return fmt.Errorf("archive collection can not be both capped and time series")
+	}
+	return nil
+}
+
+// validateShardingOptions checks whether the shard key is supported and is
+// compatible with the atomic or fallback modes of operations.
+func validateShardingOptions(c *Config) error {
+	if !c.EnableSharding {
+		return nil
+	}
+	switch c.ShardKey {
+	case keyTopic:
+		// Operations that locate tasks by their IDs, such as commits and
+		// upserts, can only be performed by the fallback implementations.
+		if c.DisableAutoFallback {
+			return fmt.Errorf("shard key %q requires auto fallback to be enabled", c.ShardKey)
+		}
+	case keyID:
+		// Polling locates tasks by their topics, which requires the atomic
+		// polling to either fallback automatically or be disabled.
+		if c.DisableAutoFallback && !c.DisableAtomicPoll {
+			return fmt.Errorf("shard key %q requires either auto fallback to be enabled or atomic poll to be disabled", c.ShardKey)
+		}
+	default:
+		return fmt.Errorf("unsupported shard key %q, expected %q or %q", c.ShardKey, keyTopic, keyID)
+	}
+	return nil
+}
+
+// applyClientOptions applies connection pool, timeout, read preference, read
+// concern, write concern, TLS and authentication settings from the
+// configuration to the options. Zero values are ignored to preserve the
+// settings from the connection URI.
+func applyClientOptions(o *options.ClientOptions, c *Config) error {
+	if c.MaxPoolSize > 0 {
+		o.SetMaxPoolSize(c.MaxPoolSize)
+	}
+	if c.MinPoolSize > 0 {
+		o.SetMinPoolSize(c.MinPoolSize)
+	}
+	if c.ServerSelectionTimeout > 0 {
+		o.SetServerSelectionTimeout(c.ServerSelectionTimeout)
+	}
+	if c.SocketTimeout > 0 {
+		o.SetSocketTimeout(c.SocketTimeout)
+	}
+
+	// Parse read preference mode from its string representation.
+	if c.ReadPreference != "" {
+		m, err := readpref.ModeFromString(c.ReadPreference)
+		if err != nil {
+			return err
+		}
+		p, err := readpref.New(m)
+		if err != nil {
+			return err
+		}
+		o.SetReadPreference(p)
+	}
+
+	// Read concern levels are validated by the server.
+	if c.ReadConcern != "" {
+		o.SetReadConcern(&readconcern.ReadConcern{Level: c.ReadConcern})
+	}
+
+	// The write concern can either be "majority", a non-negative number of
+	// instances, or the name of a custom write concern tag set.
+	if c.WriteConcern != "" {
+		w := writeconcern.Custom(c.WriteConcern)
+		if c.WriteConcern == "majority" {
+			w = writeconcern.Majority()
+		} else if n, err := strconv.Atoi(c.WriteConcern); err == nil {
+			if n < 0 {
+				return fmt.Errorf("invalid write concern %q", c.WriteConcern)
+			}
+			w = &writeconcern.WriteConcern{W: n}
+		}
+		o.SetWriteConcern(w)
+	}
+
+	// Enable TLS if any of the TLS options is specified.
+	if c.TLSCAFile != "" || c.TLSCertificateKeyFile != "" || c.TLSInsecure {
+		t, err := newTLSConfig(c)
+		if err != nil {
+			return err
+		}
+		o.SetTLSConfig(t)
+	}
+
+	// Credentials specified in the configuration replace the ones specified
+	// in the connection URI. When using MONGODB-AWS without credentials, the
+	// driver will obtain credentials from the environment variables or the
+	// instance metadata, allowing authentication with IAM roles.
+	if c.AuthMechanism != "" || c.Username != "" {
+		a := options.Credential{
+			AuthMechanism: c.AuthMechanism,
+			AuthSource:    c.AuthSource,
+			Username:      c.Username,
+			Password:      c.Password,
+			PasswordSet:   c.Password != "",
+		}
+		if c.AWSSessionToken != "" {
+			a.AuthMechanismProperties = map[string]string{"AWS_SESSION_TOKEN": c.AWSSessionToken}
+		}
+		o.SetAuth(a)
+	}
+
+	return nil
+}
+
+// newTLSConfig creates a TLS configuration from the certificate authority file
+// and the client certificate key file specified in the configuration.
+func newTLSConfig(c *Config) (*tls.Config, error) {
+	t := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: c.TLSInsecure,
+	}
+
+	// Load certificate authorities for verifying server certificates.
+	if c.TLSCAFile != "" {
+		b, err := os.ReadFile(c.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		p := x509.NewCertPool()
+		if !p.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no valid certificates found in %q", c.TLSCAFile)
+		}
+		t.RootCAs = p
+	}
+
+	// Load the client certificate and private key for X.509 authentication.
+	// Following the convention of MongoDB, both of them are stored in the same
+	// PEM encoded file.
+	if c.TLSCertificateKeyFile != "" {
+		b, err := os.ReadFile(c.TLSCertificateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		k, err := tls.X509KeyPair(b, b)
+		if err != nil {
+			return nil, err
+		}
+		t.Certificates = []tls.Certificate{k}
+	}
+
+	return t, nil
+}
+
 // Collection returns the handle for the task collection.
 func (g *Engine) Collection() *mongo.Collection {
 	return g.collection
 }
 
+// Topics returns the handle for the collection of topic settings.
+func (g *Engine) Topics() *mongo.Collection {
+	return g.topics
+}
+
+// Migrations returns the handle for the collection recording the schema version.
+func (g *Engine) Migrations() *mongo.Collection {
+	return g.migrations
+}
+
+// Archive returns the handle for the archive collection, or nil if archiving
+// is disabled.
+func (g *Engine) Archive() *mongo.Collection {
+	return g.archive
+}
+
+// Supports returns whether the storage engine supports the optional feature.
+// Features that depend on the deployment are considered supported until they
+// are found to be unavailable or are disabled, or the deployment is found to
+// be a standalone server when opening the storage engine.
+func (g *Engine) Supports(c engine.Capability) bool {
+	switch c {
+	case engine.CapabilityTTL, engine.CapabilityFilteredList, engine.CapabilityBatchPoll, engine.CapabilityHeartbeat, engine.CapabilityPriorities:
+		return true
+	case engine.CapabilityTransactions:
+		return !g.standalone.Load() && g.fallbackTransaction.Load() <= 0
+	case engine.CapabilityChangeStreams:
+		return !g.standalone.Load() && g.fallbackWatch.Load() <= 0
+	}
+	return false
+}
+
+// probe runs the hello command to find out whether the deployment is a
+// standalone server, which supports neither transactions nor change streams.
+// Servers that do not support the hello command are probed with isMaster.
+// Errors are ignored so that the features are assumed to be supported. The
+// features fall back automatically on standalone servers unless disabled.
+func (g *Engine) probe(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	var r struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	err := g.database.RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&r)
+	if err != nil {
+		err = g.database.RunCommand(ctx, bson.D{{Key: "isMaster", Value: 1}}).Decode(&r)
+	}
+	if err == nil && r.SetName == "" && r.Msg != "isdbgrid" {
+		g.standalone.Store(true)
+		g.fallbackTransaction.CompareAndSwap(0, 1)
+		g.fallbackWatch.CompareAndSwap(0, 1)
+	}
+}
+
 // Fallback sets all fallback flags to the given value.
 func (g *Engine) Fallback(v int32) *Engine {
 	g.fallbackPoll.Store(v)
@@ -138,6 +604,9 @@ func (g *Engine) Fallback(v int32) *Engine {
 	g.fallbackUpsertTask.Store(v)
 	g.fallbackInsertPromise.Store(v)
 	g.fallbackUpsertPromise.Store(v)
+	g.fallbackStealPromise.Store(v)
+	g.fallbackWatch.Store(v)
+	g.fallbackTransaction.Store(v)
 	return g
 }
 
@@ -151,13 +620,40 @@ func (g *Engine) Open(ctx context.Context) error {
 		return err
 	}
 
-	// Create indexes on the collection if required.
+	// Probe the topology of the deployment for reporting the optional
+	// features that depend on it.
+	g.probe(ctx)
+
+	// Migrate existing data to the latest schema if required, which also
+	// creates the default indexes on the collection.
+	if !g.config.DisableMigrations {
+		if err := engine.Migrate(ctx, g, g.schemaMigrations()); err != nil {
+			return err
+		}
+	}
+
+	// Create indexes that depend on the configuration if required.
 	if !g.config.DisableIndexCreation {
 		if err := g.createIndexes(ctx); err != nil {
 			return err
 		}
 	}
 
+	// Shard the collection if required. This must happen after the creation
+	// of indexes so that non-empty collections can be sharded.
+	if g.config.EnableSharding {
+		if err := g.shardCollection(ctx); err != nil {
+			return err
+		}
+	}
+
+	// Create the archive collection if archiving is enabled.
+	if g.archive != nil {
+		if err := g.createArchive(ctx); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -171,6 +667,22 @@ func (g *Engine) Destroy(ctx context.Context) error {
 	if err := g.collection.Drop(ctx); err != nil {
 		return err
 	}
+	if err := g.topics.Drop(ctx); err != nil {
+		return err
+	}
+	if err := g.migrations.Drop(ctx); err != nil {
+		return err
+	}
+	if g.archive != nil {
+		if err := g.archive.Drop(ctx); err != nil {
+			return err
+		}
+	}
+	if g.leases != nil {
+		if err := g.leases.Drop(ctx); err != nil {
+			return err
+		}
+	}
 	return g.Close(ctx)
 }
 
@@ -182,22 +694,55 @@ func (g *Engine) Ready(ctx context.Context) error {
 	return nil
 }
 
-// createIndexes creates all indexes required for queue operations.
-func (g *Engine) createIndexes(ctx context.Context) error {
-	v := g.collection.Indexes()
+// createDefaultIndexes creates the default indexes required for queue
+// operations, except for the ones configured to be skipped. It is applied as a
+// schema migration, so changes to the definitions of these indexes must be
+// made by appending migrations rather than by editing them in place.
+func (g *Engine) createDefaultIndexes(ctx context.Context) error {
+	if g.config.DisableIndexCreation {
+		return nil
+	}
 	e, ctx := errgroup.WithContext(ctx)
 
 	// Create indexes that do not require TTL settings.
 	e.Go(func() error {
-		_, err := v.CreateMany(ctx, []mongo.IndexModel{
+		return g.createMany(ctx, []mongo.IndexModel{
 			{
 				Keys:    bson.D{{Key: keyTopic, Value: "hashed"}},
 				Options: options.Index().SetName(indexTopic),
 			},
+			{
+				Keys:    bson.D{{Key: keyTopic, Value: 1}, {Key: keyID, Value: 1}},
+				Options: options.Index().SetName(indexTopicID),
+			},
+			{
+				Keys:    bson.D{{Key: keyTopic, Value: 1}, {Key: keyScheduled, Value: 1}, {Key: keyID, Value: 1}},
+				Options: options.Index().SetName(indexTopicScheduledID),
+			},
+			{
+				Keys:    bson.D{{Key: keyTopic, Value: 1}, {Key: keyProduced, Value: 1}, {Key: keyID, Value: 1}},
+				Options: options.Index().SetName(indexTopicProducedID),
+			},
+			{
+				Keys:    bson.D{{Key: keyTopic, Value: 1}, {Key: keyConsumed, Value: 1}, {Key: keyID, Value: 1}},
+				Options: options.Index().SetName(indexTopicConsumedID),
+			},
 			{
 				Keys:    bson.D{{Key: keyTopic, Value: 1}, {Key: keyScheduled, Value: 1}},
 				Options: options.Index().SetName(indexPendingTopicScheduled).SetPartialFilterExpression(filterStatePending),
 			},
+			{
+				Keys:    bson.D{{Key: keyTopic, Value: 1}, {Key: keyProducer, Value: 1}, {Key: keyScheduled, Value: 1}},
+				Options: options.Index().SetName(indexPendingTopicProducerScheduled).SetPartialFilterExpression(filterStatePending),
+			},
+			{
+				Keys:    bson.D{{Key: keyLabels + ".$**", Value: 1}},
+				Options: options.Index().SetName(indexLabels),
+			},
+			{
+				Keys:    bson.D{{Key: keyProduced, Value: 1}},
+				Options: options.Index().SetName(indexBlockedProduced).SetPartialFilterExpression(filterStateBlocked),
+			},
 			{
 				Keys:    bson.D{{Key: keyDeadline, Value: 1}},
 				Options: options.Index().SetName(indexActiveDeadline).SetPartialFilterExpression(filterStateActive),
@@ -206,45 +751,198 @@ func (g *Engine) createIndexes(ctx context.Context) error {
 				Keys:    bson.D{{Key: keyTopic, Value: 1}},
 				Options: options.Index().SetName(indexActiveTopic).SetPartialFilterExpression(filterStateActive),
 			},
+			{
+				Keys:    bson.D{{Key: keyTopic, Value: 1}, {Key: keyConsumed, Value: 1}},
+				Options: options.Index().SetName(indexArchivedTopicConsumed).SetPartialFilterExpression(filterStateArchived),
+			},
 		})
-		return err
 	})
 
+	// Create the unique index for deduplicating tasks. Unique indexes must be
+	// prefixed by the shard key, so deduplication is not enforced on
+	// collections sharded on the ID field.
+	if (!g.config.EnableSharding || g.config.ShardKey != keyID) && !g.skipIndexes[indexTopicDedup] {
+		e.Go(func() error {
+			_, err := g.collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+				Keys:    bson.D{{Key: keyTopic, Value: 1}, {Key: keyDedup, Value: 1}},
+				Options: options.Index().SetName(indexTopicDedup).SetUnique(true).SetPartialFilterExpression(filterDedup),
+			})
+			return err
+		})
+	}
+
+	return e.Wait()
+}
+
+// createPriorityIndex creates the default index for polling tasks by their
+// priorities, unless it is configured to be skipped. It is applied as a schema
+// migration following the creation of the other default indexes.
+func (g *Engine) createPriorityIndex(ctx context.Context) error {
+	if g.config.DisableIndexCreation {
+		return nil
+	}
+	return g.createMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: keyTopic, Value: 1}, {Key: keyPriority, Value: -1}, {Key: keyScheduled, Value: 1}},
+			Options: options.Index().SetName(indexPendingTopicPriorityScheduled).SetPartialFilterExpression(filterStatePending),
+		},
+	})
+}
+
+// createIndexes creates the indexes that depend on the configuration, along
+// with the custom indexes. Unlike the default indexes, these are created on
+// every startup to follow changes of the configuration.
+func (g *Engine) createIndexes(ctx context.Context) error {
+	e, ctx := errgroup.WithContext(ctx)
+
+	// Create indexes for partitioning pending tasks by whether they have been
+	// deferred if the deferral horizon is set.
+	if g.config.DeferralHorizon > 0 {
+		e.Go(func() error {
+			return g.createMany(ctx, []mongo.IndexModel{
+				{
+					Keys:    bson.D{{Key: keyTopic, Value: 1}, {Key: keyDeferred, Value: 1}, {Key: keyScheduled, Value: 1}},
+					Options: options.Index().SetName(indexPendingTopicDeferredScheduled).SetPartialFilterExpression(filterStatePending),
+				},
+				{
+					Keys:    bson.D{{Key: keyScheduled, Value: 1}},
+					Options: options.Index().SetName(indexDeferredScheduled).SetPartialFilterExpression(filterStateDeferred),
+				},
+			})
+		})
+	}
+
 	// Create TTL index to automatically delete completed tasks that have
-	// exceeded their retention period.
-	e.Go(func() error {
-		k := bson.D{{Key: keyConsumed, Value: 1}}
-		s := int32(g.config.RetentionPeriod.Seconds())
-
-		// Attempt to create a new TTL index. This operation will fail if the
-		// specified TTL value does not match the value in the existing index.
-		_, err := v.CreateOne(ctx, mongo.IndexModel{
-			Keys:    k,
-			Options: options.Index().SetName(indexCompletedConsumed).SetPartialFilterExpression(filterStateCompleted).SetExpireAfterSeconds(s),
+	// exceeded their retention period. The expiry is left to the background
+	// jobs if expired tasks are exported or moved, so that none are missed.
+	if !g.skipIndexes[indexCompletedConsumed] {
+		e.Go(func() error {
+			return g.createTTLIndex(ctx, g.collection, !g.exporting())
 		})
-		if err == nil {
-			return nil
-		}
-		if c, ok := err.(mongo.CommandError); !ok || c.Name != "IndexOptionsConflict" {
+	}
+
+	// Create custom indexes, which may replace some of the default ones.
+	if len(g.customIndexes) > 0 {
+		e.Go(func() error {
+			_, err := g.collection.Indexes().CreateMany(ctx, g.customIndexes)
 			return err
-		}
+		})
+	}
+
+	return e.Wait()
+}
+
+// shardCollection enables sharding on the database and shards the collection
+// using the hashed shard key. Databases and collections that have already been
+// sharded are left as is.
+func (g *Engine) shardCollection(ctx context.Context) error {
+	a := g.client.Database("admin")
+	if err := a.RunCommand(ctx, bson.D{
+		{Key: "enableSharding", Value: g.database.Name()},
+	}).Err(); err != nil && !isAlreadyInitialized(err) {
+		return err
+	}
+	if err := a.RunCommand(ctx, bson.D{
+		{Key: "shardCollection", Value: g.database.Name() + "." + g.collection.Name()},
+		{Key: "key", Value: bson.D{{Key: g.config.ShardKey, Value: "hashed"}}},
+	}).Err(); err != nil && !isAlreadyInitialized(err) {
+		return err
+	}
+	return nil
+}
+
+// isAlreadyInitialized returns whether the error indicates that sharding has
+// already been enabled on the database or collection.
+func isAlreadyInitialized(err error) bool {
+	e, ok := err.(mongo.CommandError)
+	return ok && e.Name == "AlreadyInitialized"
+}
+
+// exporting returns whether expired tasks are exported or moved to the expiry
+// topic instead of being deleted.
+func (g *Engine) exporting() bool {
+	return g.config.ExpiryTopic != "" || g.config.ExpiryExporter != nil
+}
+
+// expiring returns whether the TTL index deletes completed tasks that have
+// exceeded the retention period of the storage engine.
+func (g *Engine) expiring() bool {
+	return !g.exporting() && !g.skipIndexes[indexCompletedConsumed]
+}
+
+// createTTLIndex creates or updates the TTL index on the collection to delete
+// completed tasks that have exceeded their retention period. If ttl is false,
+// the index is created without expiry and an existing TTL is removed, leaving
+// the expiration of tasks to the background jobs.
+func (g *Engine) createTTLIndex(ctx context.Context, c *mongo.Collection, ttl bool) error {
+	k := bson.D{{Key: keyConsumed, Value: 1}}
+	s := int32(g.config.RetentionPeriod.Seconds())
+	o := options.Index().SetName(indexCompletedConsumed).SetPartialFilterExpression(filterStateCompleted)
+	if ttl {
+		o.SetExpireAfterSeconds(s)
+	}
+
+	// Attempt to create a new TTL index. This operation will fail if the
+	// specified TTL value does not match the value in the existing index.
+	m := mongo.IndexModel{Keys: k, Options: o}
+	_, err := c.Indexes().CreateOne(ctx, m)
+	if err == nil {
+		return nil
+	}
+	if e, ok := err.(mongo.CommandError); !ok || e.Name != "IndexOptionsConflict" {
+		return err
+	}
 
-		// Use the collMod command in conjunction with the index collection
-		// flag to change the value of expireAfterSeconds of an existing index.
-		if err := g.database.RunCommand(ctx, bson.D{
-			{Key: "collMod", Value: g.collection.Name()},
+	// Use the collMod command in conjunction with the index collection
+	// flag to change the value of expireAfterSeconds of an existing index.
+	if ttl {
+		err := g.database.RunCommand(ctx, bson.D{
+			{Key: "collMod", Value: c.Name()},
 			{Key: "index", Value: bson.D{
 				{Key: "keyPattern", Value: k},
 				{Key: "expireAfterSeconds", Value: s},
 			}},
-		}).Err(); err != nil && err != mongo.ErrNoDocuments {
+		}).Err()
+		if err == nil || err == mongo.ErrNoDocuments {
+			return nil
+		}
+	}
+
+	// The expiry of an existing index can not be removed in place, so the
+	// index is dropped and created again.
+	if _, err := c.Indexes().DropOne(ctx, indexCompletedConsumed); err != nil {
+		return err
+	}
+	_, err = c.Indexes().CreateOne(ctx, m)
+	return err
+}
+
+// createArchive creates the archive collection with the configured options.
+// Existing collections are used as is.
+func (g *Engine) createArchive(ctx context.Context) error {
+	s := int64(g.config.RetentionPeriod.Seconds())
+	o := options.CreateCollection()
+	switch {
+	case g.config.ArchiveCappedSize > 0:
+		o.SetCapped(true).SetSizeInBytes(g.config.ArchiveCappedSize)
+	case g.config.ArchiveTimeSeries:
+		// Time series collections do not support partial TTL indexes, the
+		// expiration applies to all archived tasks based on the produced time.
+		o.SetTimeSeriesOptions(options.TimeSeries().SetTimeField(keyProduced).SetMetaField(keyTopic)).SetExpireAfterSeconds(s)
+	}
+	err := g.database.CreateCollection(ctx, g.archive.Name(), o)
+	if err != nil {
+		if e, ok := err.(mongo.CommandError); !ok || e.Name != "NamespaceExists" {
 			return err
 		}
+	}
 
+	// Capped collections do not support TTL indexes and are bounded by their
+	// sizes instead. Time series collections expire documents by themselves.
+	if g.config.DisableIndexCreation || g.config.ArchiveCappedSize > 0 || g.config.ArchiveTimeSeries {
 		return nil
-	})
-
-	return e.Wait()
+	}
+	return g.createTTLIndex(ctx, g.archive, true)
 }
 
 // peek returns the unique ID, topic, current state, and nonce of the first
@@ -270,47 +968,190 @@ func (g *Engine) exists(ctx context.Context, filter any, hint string) bool {
 	return err == nil
 }
 
+// document is the representation of a task in the task collection when the
+// deferral horizon is set. Tasks scheduled beyond the horizon at the time of
+// writing are flagged as deferred, which moves them out of the polling range
+// of the pending index. The flag is omitted otherwise, so tasks written
+// without it remain visible to polling.
+type document struct {
+	ratus.Task `bson:",inline"`
+	Deferred   bool `bson:"deferred,omitempty"`
+}
+
+// deferred returns whether the scheduled time is beyond the horizon from now.
+func deferred(scheduled *time.Time, horizon time.Duration, now time.Time) bool {
+	return horizon > 0 && scheduled != nil && scheduled.After(now.Add(horizon))
+}
+
+// document returns the representation of the task to be written into the task
+// collection. Tasks are written as is if the deferral horizon is not set.
+func (g *Engine) document(t *ratus.Task) any {
+	h := g.config.DeferralHorizon
+	if h <= 0 {
+		return t
+	}
+	return &document{Task: *t, Deferred: deferred(t.Scheduled, h, g.clock.Now())}
+}
+
 // queryOpsPoll returns a document containing query operators to peek into the
-// topic to find the next available task based on the scheduled time.
-func queryOpsPoll(topic string, t time.Time) bson.D {
-	return bson.D{
+// topic to find the next available task based on the scheduled time. Tasks
+// with unresolved dependencies or labels not matching the selector are
+// excluded.
+func queryOpsPoll(topic string, labels map[string]string, t time.Time) bson.D {
+	return queryOpsLabels(bson.D{
 		{Key: keyState, Value: ratus.TaskStatePending},
 		{Key: keyTopic, Value: topic},
 		{Key: keyScheduled, Value: bson.D{
 			{Key: "$lte", Value: t},
 		}},
+		{Key: keyDependsOn, Value: nil},
+	}, labels)
+}
+
+// queryOpsLabels appends query operators to the document to match tasks with
+// all of the labels in the selector. Labels are sorted by key so that queries
+// with the same selector have the same shape.
+func queryOpsLabels(f bson.D, labels map[string]string) bson.D {
+	ks := make([]string, 0, len(labels))
+	for k := range labels {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+	for _, k := range ks {
+		f = append(f, bson.E{Key: keyLabels + "." + k, Value: labels[k]})
 	}
+	return f
+}
+
+// queryOpsPage appends query operators to the document to match tasks
+// positioned after the last task seen in the order of the page. Tasks missing
+// the sort field are positioned before the others in ascending order, which
+// is consistent with the comparison order of BSON types.
+func queryOpsPage(f bson.D, p *engine.Page) bson.D {
+	if p.After == "" {
+		return f
+	}
+	op := "$gt"
+	if p.Desc {
+		op = "$lt"
+	}
+	id := bson.D{{Key: op, Value: p.After}}
+	k, _ := sortField(p)
+	if k == "" {
+		return append(f, bson.E{Key: keyID, Value: id})
+	}
+
+	// Comparison operators only match values of the same BSON type, missing
+	// values are matched separately.
+	var c bson.A
+	switch {
+	case p.Time == nil && p.Desc:
+		return append(f, bson.E{Key: k, Value: nil}, bson.E{Key: keyID, Value: id})
+	case p.Time == nil:
+		c = bson.A{bson.D{{Key: k, Value: bson.D{{Key: "$type", Value: "date"}}}}}
+	case p.Desc:
+		c = bson.A{bson.D{{Key: k, Value: bson.D{{Key: op, Value: p.Time}}}}, bson.D{{Key: k, Value: nil}}}
+	default:
+		c = bson.A{bson.D{{Key: k, Value: bson.D{{Key: op, Value: p.Time}}}}}
+	}
+	c = append(c, bson.D{{Key: k, Value: p.Time}, {Key: keyID, Value: id}})
+	return append(f, bson.E{Key: "$or", Value: c})
+}
+
+// sortOpsPage returns the sort document and the name of the index for listing
+// tasks in a topic in the order of the page.
+func sortOpsPage(p *engine.Page) (bson.D, string) {
+	d := 1
+	if p.Desc {
+		d = -1
+	}
+	k, x := sortField(p)
+	if k == "" {
+		return bson.D{{Key: keyID, Value: d}}, x
+	}
+	return bson.D{{Key: k, Value: d}, {Key: keyID, Value: d}}, x
+}
+
+// sortField returns the key of the field to sort tasks by and the name of the
+// index on topics, the field and IDs. The key is empty if tasks are sorted by
+// their IDs.
+func sortField(p *engine.Page) (string, string) {
+	switch p.Sort {
+	case engine.SortScheduled:
+		return keyScheduled, indexTopicScheduledID
+	case engine.SortProduced:
+		return keyProduced, indexTopicProducedID
+	case engine.SortConsumed:
+		return keyConsumed, indexTopicConsumedID
+	}
+	return "", indexTopicID
 }
 
 // updateOpsRecover returns a document containing update operators to set the
 // state of the tasks back to "pending" and clear the nonce field to invalidate
-// subsequent commits.
-func updateOpsRecover() bson.D {
-	return bson.D{
+// subsequent commits. The reason is recorded in the history of the tasks along with the time.
+func updateOpsRecover(reason string, limit int, n time.Time) bson.D {
+	return updateOpsRecord(bson.D{
 		{Key: "$set", Value: bson.D{
 			{Key: keyState, Value: ratus.TaskStatePending},
 			{Key: keyNonce, Value: ""},
 		}},
-	}
+		updateOpsVersion,
+	}, &ratus.Transition{State: ratus.TaskStatePending, Time: &n, Error: reason}, limit)
 }
 
 // updateOpsConsume returns a document containing update operators to set the
-// tasks to the "active" state and populate fields with data from the promise.
-func updateOpsConsume(p *ratus.Promise, t time.Time) bson.D {
-	return bson.D{
+// tasks to the "active" state, or the "completed" state if the promise is
+// delivered at most once, and populate fields with data from the promise.
+func updateOpsConsume(p *ratus.Promise, t time.Time, limit int) bson.D {
+	s, n, d := ratus.TaskStateActive, nonce.Generate(ratus.NonceLength), p.Deadline
+	if p.AtMostOnce {
+		s, n, d = ratus.TaskStateCompleted, "", nil
+	}
+	return updateOpsRecord(bson.D{
 		{Key: "$set", Value: bson.D{
-			{Key: keyState, Value: ratus.TaskStateActive},
-			{Key: keyNonce, Value: nonce.Generate(ratus.NonceLength)},
+			{Key: keyState, Value: s},
+			{Key: keyNonce, Value: n},
 			{Key: keyConsumer, Value: p.Consumer},
 			{Key: keyConsumed, Value: t},
-			{Key: keyDeadline, Value: p.Deadline},
+			{Key: keyDeadline, Value: d},
 		}},
+		{Key: "$unset", Value: bson.D{{Key: keyProgress, Value: ""}}},
+		updateOpsVersion,
+	}, &ratus.Transition{State: s, Time: &t, Consumer: p.Consumer}, limit)
+}
+
+// updateOpsRecord appends an update operator to the document to record the
+// transition in the history of the task, keeping at most the specified number
+// of the latest transitions. The document is returned as is if the limit is
+// not positive.
+func updateOpsRecord(u bson.D, e *ratus.Transition, limit int) bson.D {
+	if limit <= 0 {
+		return u
 	}
+	return append(u, bson.E{Key: "$push", Value: bson.D{
+		{Key: keyHistory, Value: bson.D{
+			{Key: "$each", Value: bson.A{e}},
+			{Key: "$slice", Value: -limit},
+		}},
+	}})
 }
 
 // updateOpsCommit returns a document containing update operators to apply a
-// commit to a task.
-func updateOpsCommit(m *ratus.Commit) bson.D {
+// commit to a task. The deferral flag is updated along with the scheduled time
+// if the deferral horizon is set, and commits that set the state of the task
+// are recorded in its history.
+func updateOpsCommit(m *ratus.Commit, horizon time.Duration, limit int, n time.Time) bson.D {
+	u := updateOpsCommitFields(m, horizon, n)
+	if m.State == nil {
+		return u
+	}
+	return updateOpsRecord(u, &ratus.Transition{State: *m.State, Time: &n, Error: m.Error}, limit)
+}
+
+// updateOpsCommitFields returns a document containing update operators to set
+// the fields specified in the commit.
+func updateOpsCommitFields(m *ratus.Commit, horizon time.Duration, n time.Time) bson.D {
 	s := bson.D{{Key: keyNonce, Value: ""}}
 	if m.Topic != "" {
 		s = append(s, bson.E{Key: keyTopic, Value: m.Topic})
@@ -324,7 +1165,44 @@ func updateOpsCommit(m *ratus.Commit) bson.D {
 	if m.Payload != nil {
 		s = append(s, bson.E{Key: keyPayload, Value: m.Payload})
 	}
-	return bson.D{{Key: "$set", Value: s}}
+	if m.Result != nil {
+		s = append(s, bson.E{Key: keyResult, Value: m.Result})
+	}
+	if m.Error != "" {
+		s = append(s, bson.E{Key: keyLastError, Value: m.Error})
+	}
+	if horizon <= 0 || m.Scheduled == nil {
+		return bson.D{{Key: "$set", Value: s}, updateOpsVersion}
+	}
+	if deferred(m.Scheduled, horizon, n) {
+		s = append(s, bson.E{Key: keyDeferred, Value: true})
+		return bson.D{{Key: "$set", Value: s}, updateOpsVersion}
+	}
+	return bson.D{
+		{Key: "$set", Value: s},
+		{Key: "$unset", Value: bson.D{{Key: keyDeferred, Value: ""}}},
+		updateOpsVersion,
+	}
+}
+
+// updateOpsVersion is an update operator to increment the version of tasks.
+// Tasks created before versioning was introduced start from 1.
+var updateOpsVersion = bson.E{Key: "$inc", Value: bson.D{{Key: keyVersion, Value: int64(1)}}}
+
+// updateOpsReplace returns an aggregation pipeline to replace a task with the
+// document while incrementing its version, which is not possible with plain
+// replacements. The document is wrapped in a literal to avoid interpreting
+// strings in the payload as field paths.
+func updateOpsReplace(doc any) bson.A {
+	return bson.A{bson.D{{Key: "$replaceWith", Value: bson.D{
+		{Key: "$mergeObjects", Value: bson.A{
+			bson.D{{Key: "$literal", Value: doc}},
+			bson.D{{Key: keyVersion, Value: bson.D{{Key: "$add", Value: bson.A{
+				bson.D{{Key: "$ifNull", Value: bson.A{"$" + keyVersion, int64(0)}}},
+				int64(1),
+			}}}}},
+		}},
+	}}}}
 }
 
 // A generic function that decides whether to execute the preferred or fallback
@@ -347,8 +1225,8 @@ func branch[T *ratus.Task | *ratus.Updated | *ratus.Deleted](preferred, fallback
 	}
 
 	// Only MongoDB server errors can trigger a fallback.
-	e, ok := err.(mongo.ServerError)
-	if !ok {
+	var e mongo.ServerError
+	if !errors.As(err, &e) {
 		return nil, err
 	}
 
@@ -363,3 +1241,90 @@ func branch[T *ratus.Task | *ratus.Updated | *ratus.Deleted](preferred, fallback
 
 	return nil, err
 }
+
+// isRetryable returns whether the error is a transient error that is likely to
+// succeed if the operation is retried.
+func isRetryable(err error) bool {
+	if mongo.IsNetworkError(err) {
+		return true
+	}
+	var e mongo.ServerError
+	if !errors.As(err, &e) {
+		return false
+	}
+	if e.HasErrorLabel("RetryableWriteError") || e.HasErrorLabel("TransientTransactionError") {
+		return true
+	}
+	for _, c := range retryErrorCodes {
+		if e.HasErrorCode(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// A generic function that retries the function on transient errors with
+// exponential backoff, up to the maximum number of retries in the config.
+// The last error is returned if the context is done while waiting to retry.
+// Only reads and idempotent writes may be retried, since a write may have
+// been applied even if its response is lost. Writes that are not idempotent,
+// such as claiming and committing tasks, are called directly and rely on the
+// retryable writes of the driver instead, which are applied at most once.
+func retry[T any](ctx context.Context, g *Engine, fn func() (T, error)) (T, error) {
+	d := max(g.config.RetryBackoff, minRetryBackoff)
+	for i := 0; ; i++ {
+		v, err := fn()
+		if err == nil || i >= g.config.MaxRetries || !isRetryable(err) {
+			return v, err
+		}
+		t := time.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return v, err
+		case <-t.C:
+		}
+		d = min(d*2, maxRetryBackoff)
+	}
+}
+
+// transaction executes the function in a multi-document transaction if it is
+// supported by the deployment, otherwise the function is executed directly.
+// The function may be called multiple times if the transaction is retried.
+func (g *Engine) transaction(ctx context.Context, fn func(ctx context.Context) error) error {
+
+	// Execute the function directly if the value of the flag is greater than
+	// zero, which indicates that transactions are either disabled or not
+	// supported by the deployment.
+	if g.fallbackTransaction.Load() > 0 {
+		return fn(ctx)
+	}
+
+	// Start a session and execute the function in a transaction. The driver
+	// will automatically retry on transient transaction errors.
+	s, err := g.client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer s.EndSession(context.Background())
+	_, err = s.WithTransaction(ctx, func(sc mongo.SessionContext) (any, error) {
+		return nil, fn(sc)
+	})
+	if err == nil || g.fallbackTransaction.Load() < 0 {
+		return err
+	}
+
+	// Update the flag and execute the function directly if the deployment
+	// does not support transactions, e.g. standalone servers.
+	var e mongo.ServerError
+	if errors.As(err, &e) {
+		for _, c := range fallbackTransactionErrorCodes {
+			if e.HasErrorCode(c) {
+				g.fallbackTransaction.Store(1)
+				return fn(ctx)
+			}
+		}
+	}
+
+	return err
+}
@@ -2,38 +2,58 @@ package mongodb
 
 import (
 	"context"
-	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 
 	"github.com/hyperonym/ratus"
+	"github.com/hyperonym/ratus/internal/engine"
 )
 
 // ListPromises lists all promises in a topic.
-func (g *Engine) ListPromises(ctx context.Context, topic string, limit, offset int) ([]*ratus.Promise, error) {
-	f := bson.D{
-		{Key: keyState, Value: ratus.TaskStateActive},
-		{Key: keyTopic, Value: topic},
-	}
+func (g *Engine) ListPromises(ctx context.Context, topic string, p *engine.Page) ([]*ratus.Promise, error) {
+	return retry(ctx, g, func() ([]*ratus.Promise, error) {
+		f := bson.D{
+			{Key: keyState, Value: ratus.TaskStateActive},
+			{Key: keyTopic, Value: topic},
+		}
+		if p.After != "" {
+			f = append(f, bson.E{Key: keyID, Value: bson.D{{Key: "$gt", Value: p.After}}})
+		}
 
-	// Promises in effect are represented in MongoDB as fields of the active tasks.
-	o := options.Find().SetLimit(int64(limit)).SetSkip(int64(offset)).SetHint(indexActiveTopic)
-	r, err := g.collection.Find(ctx, f, o)
-	if err != nil {
-		return nil, err
-	}
-	v := make([]*ratus.Promise, 0)
-	if err := r.All(ctx, &v); err != nil {
-		return nil, err
-	}
+		// Promises in effect are represented in MongoDB as fields of the active tasks.
+		// The number of active tasks is limited, so they are sorted in memory.
+		o := options.Find().SetSort(bson.D{{Key: keyID, Value: 1}}).SetLimit(int64(p.Limit)).SetSkip(int64(p.Offset)).SetHint(indexActiveTopic)
+		r, err := g.collection.Find(ctx, f, o)
+		if err != nil {
+			return nil, err
+		}
+		v := make([]*ratus.Promise, 0)
+		if err := r.All(ctx, &v); err != nil {
+			return nil, err
+		}
+
+		return v, nil
+	})
+}
 
-	return v, nil
+// CountPromises counts all promises in a topic.
+func (g *Engine) CountPromises(ctx context.Context, topic string) (int64, error) {
+	return retry(ctx, g, func() (int64, error) {
+		f := bson.D{
+			{Key: keyState, Value: ratus.TaskStateActive},
+			{Key: keyTopic, Value: topic},
+		}
+		o := options.Count().SetHint(indexActiveTopic)
+		return g.collection.CountDocuments(ctx, f, o)
+	})
 }
 
 // DeletePromises deletes all promises in a topic.
 func (g *Engine) DeletePromises(ctx context.Context, topic string) (*ratus.Deleted, error) {
+	// Deletions are not retried, since promises deleted by a partially
+	// applied attempt would be missing from the count of the next one.
 	f := bson.D{
 		{Key: keyState, Value: ratus.TaskStateActive},
 		{Key: keyTopic, Value: topic},
@@ -42,7 +62,7 @@ func (g *Engine) DeletePromises(ctx context.Context, topic string) (*ratus.Delet
 	// Deleting promises is equivalent to setting the states of the active
 	// tasks back to "pending" and clearing the nonce fields.
 	o := options.Update().SetUpsert(false).SetHint(indexActiveTopic)
-	r, err := g.collection.UpdateMany(ctx, f, updateOpsRecover(), o)
+	r, err := g.collection.UpdateMany(ctx, f, updateOpsRecover("", g.config.HistoryLimit, g.clock.Now()), o)
 	if err != nil {
 		return nil, err
 	}
@@ -54,22 +74,24 @@ func (g *Engine) DeletePromises(ctx context.Context, topic string) (*ratus.Delet
 
 // GetPromise gets a promise by the unique ID of its target task.
 func (g *Engine) GetPromise(ctx context.Context, id string) (*ratus.Promise, error) {
-	var v ratus.Promise
-	f := bson.D{
-		{Key: keyID, Value: id},
-		{Key: keyState, Value: ratus.TaskStateActive},
-	}
+	return retry(ctx, g, func() (*ratus.Promise, error) {
+		var v ratus.Promise
+		f := bson.D{
+			{Key: keyID, Value: id},
+			{Key: keyState, Value: ratus.TaskStateActive},
+		}
 
-	// A promise in effect is represented in MongoDB as fields of an active task.
-	o := options.FindOne().SetHint(indexID)
-	if err := g.collection.FindOne(ctx, f, o).Decode(&v); err != nil {
-		if err == mongo.ErrNoDocuments {
-			err = ratus.ErrNotFound
+		// A promise in effect is represented in MongoDB as fields of an active task.
+		o := options.FindOne().SetHint(indexID)
+		if err := g.collection.FindOne(ctx, f, o).Decode(&v); err != nil {
+			if err == mongo.ErrNoDocuments {
+				err = ratus.ErrNotFound
+			}
+			return nil, err
 		}
-		return nil, err
-	}
 
-	return &v, nil
+		return &v, nil
+	})
 }
 
 // InsertPromise makes a promise to claim and execute a task if it is in pending state.
@@ -88,12 +110,12 @@ func (g *Engine) insertPromiseAtomic(ctx context.Context, p *ratus.Promise) (*ra
 	// This operation is expected to work only on unsharded collections and
 	// sharded collections using the ID field as the shard key.
 	var v ratus.Task
-	t := time.Now()
+	t := g.clock.Now()
 	f := bson.D{
 		{Key: keyID, Value: p.ID},
 		{Key: keyState, Value: ratus.TaskStatePending},
 	}
-	u := updateOpsConsume(p, t)
+	u := updateOpsConsume(p, t, g.config.HistoryLimit)
 	o := options.FindOneAndUpdate().SetUpsert(false).SetReturnDocument(options.After).SetHint(indexID)
 	if err := g.collection.FindOneAndUpdate(ctx, f, u, o).Decode(&v); err != nil {
 
@@ -134,11 +156,11 @@ func (g *Engine) insertPromiseOptimistic(ctx context.Context, p *ratus.Promise)
 	// This operation is expected to work on sharded collections using various
 	// sharding strategies.
 	var v ratus.Task
-	t := time.Now()
+	t := g.clock.Now()
 	f = append(f, bson.E{Key: keyTopic, Value: c.Topic})
 	f = append(f, bson.E{Key: keyState, Value: ratus.TaskStatePending})
 	f = append(f, bson.E{Key: keyNonce, Value: c.Nonce})
-	u := updateOpsConsume(p, t)
+	u := updateOpsConsume(p, t, g.config.HistoryLimit)
 	n := options.FindOneAndUpdate().SetUpsert(false).SetReturnDocument(options.After).SetHint(indexID)
 	if err := g.collection.FindOneAndUpdate(ctx, f, u, n).Decode(&v); err != nil {
 
@@ -169,9 +191,9 @@ func (g *Engine) upsertPromiseAtomic(ctx context.Context, p *ratus.Promise) (*ra
 	// This operation is expected to work only on unsharded collections and
 	// sharded collections using the ID field as the shard key.
 	var v ratus.Task
-	t := time.Now()
+	t := g.clock.Now()
 	f := bson.D{{Key: keyID, Value: p.ID}}
-	u := updateOpsConsume(p, t)
+	u := updateOpsConsume(p, t, g.config.HistoryLimit)
 	o := options.FindOneAndUpdate().SetUpsert(false).SetReturnDocument(options.After).SetHint(indexID)
 	if err := g.collection.FindOneAndUpdate(ctx, f, u, o).Decode(&v); err != nil {
 		if err == mongo.ErrNoDocuments {
@@ -200,11 +222,11 @@ func (g *Engine) upsertPromiseOptimistic(ctx context.Context, p *ratus.Promise)
 	// This operation is expected to work on sharded collections using various
 	// sharding strategies.
 	var v ratus.Task
-	t := time.Now()
+	t := g.clock.Now()
 	f = append(f, bson.E{Key: keyTopic, Value: c.Topic})
 	f = append(f, bson.E{Key: keyState, Value: c.State})
 	f = append(f, bson.E{Key: keyNonce, Value: c.Nonce})
-	u := updateOpsConsume(p, t)
+	u := updateOpsConsume(p, t, g.config.HistoryLimit)
 	n := options.FindOneAndUpdate().SetUpsert(false).SetReturnDocument(options.After).SetHint(indexID)
 	if err := g.collection.FindOneAndUpdate(ctx, f, u, n).Decode(&v); err != nil {
 
@@ -219,22 +241,132 @@ func (g *Engine) upsertPromiseOptimistic(ctx context.Context, p *ratus.Promise)
 	return &v, nil
 }
 
-// DeletePromise deletes a promise by the unique ID of its target task.
-func (g *Engine) DeletePromise(ctx context.Context, id string) (*ratus.Deleted, error) {
+// StealPromise transfers the promise of an active task to another consumer, invalidating the previous one.
+func (g *Engine) StealPromise(ctx context.Context, p *ratus.Promise) (*ratus.Task, error) {
+	return branch(func() (*ratus.Task, error) {
+		return g.stealPromiseAtomic(ctx, p)
+	}, func() (*ratus.Task, error) {
+		return g.stealPromiseOptimistic(ctx, p)
+	}, g.fallbackStealPromise)
+}
+
+// stealPromiseAtomic is the preferred implementation of StealPromise.
+func (g *Engine) stealPromiseAtomic(ctx context.Context, p *ratus.Promise) (*ratus.Task, error) {
+
+	// Use an atomic findAndModify command to claim and return the task.
+	// Consuming the task again replaces the nonce, so that commits of the
+	// previous consumer are rejected. This operation is expected to work only
+	// on unsharded collections and sharded collections using the ID field as
+	// the shard key.
+	var v ratus.Task
+	t := g.clock.Now()
 	f := bson.D{
-		{Key: keyID, Value: id},
+		{Key: keyID, Value: p.ID},
 		{Key: keyState, Value: ratus.TaskStateActive},
 	}
+	u := updateOpsConsume(p, t, g.config.HistoryLimit)
+	o := options.FindOneAndUpdate().SetUpsert(false).SetReturnDocument(options.After).SetHint(indexID)
+	if err := g.collection.FindOneAndUpdate(ctx, f, u, o).Decode(&v); err != nil {
 
-	// Deleting a promise is equivalent to setting the state of the target task
-	// back to "pending" and clearing the nonce field.
-	o := options.Update().SetUpsert(false).SetHint(indexID)
-	r, err := g.collection.UpdateOne(ctx, f, updateOpsRecover(), o)
+		// Check if the failure is due to a mismatch of state or the target
+		// task does not exist.
+		if err == mongo.ErrNoDocuments {
+			if g.exists(ctx, bson.D{{Key: keyID, Value: p.ID}}, indexID) {
+				err = ratus.ErrConflict
+			} else {
+				err = ratus.ErrNotFound
+			}
+		}
+		return nil, err
+	}
+
+	return &v, nil
+}
+
+// stealPromiseOptimistic is the fallback implementation of StealPromise.
+func (g *Engine) stealPromiseOptimistic(ctx context.Context, p *ratus.Promise) (*ratus.Task, error) {
+
+	// Get current information of the target task.
+	f := bson.D{{Key: keyID, Value: p.ID}}
+	c, err := g.peek(ctx, f, nil, indexID)
 	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			err = ratus.ErrNotFound
+		}
 		return nil, err
 	}
 
-	return &ratus.Deleted{
-		Deleted: r.ModifiedCount,
-	}, nil
+	// Check if the target task is in active state.
+	if c.State != ratus.TaskStateActive {
+		return nil, ratus.ErrConflict
+	}
+
+	// Add all known fields to the filter criteria to perform findAndModify.
+	// This operation is expected to work on sharded collections using various
+	// sharding strategies.
+	var v ratus.Task
+	t := g.clock.Now()
+	f = append(f, bson.E{Key: keyTopic, Value: c.Topic})
+	f = append(f, bson.E{Key: keyState, Value: ratus.TaskStateActive})
+	f = append(f, bson.E{Key: keyNonce, Value: c.Nonce})
+	u := updateOpsConsume(p, t, g.config.HistoryLimit)
+	n := options.FindOneAndUpdate().SetUpsert(false).SetReturnDocument(options.After).SetHint(indexID)
+	if err := g.collection.FindOneAndUpdate(ctx, f, u, n).Decode(&v); err != nil {
+
+		// The only reason that could lead to no match is that the task has
+		// been committed or stolen by another consumer.
+		if err == mongo.ErrNoDocuments {
+			err = ratus.ErrConflict
+		}
+		return nil, err
+	}
+
+	return &v, nil
+}
+
+// DeletePromise deletes a promise by the unique ID of its target task.
+func (g *Engine) DeletePromise(ctx context.Context, id string) (*ratus.Deleted, error) {
+	return retry(ctx, g, func() (*ratus.Deleted, error) {
+		f := bson.D{
+			{Key: keyID, Value: id},
+			{Key: keyState, Value: ratus.TaskStateActive},
+		}
+
+		// Deleting a promise is equivalent to setting the state of the target task
+		// back to "pending" and clearing the nonce field.
+		o := options.Update().SetUpsert(false).SetHint(indexID)
+		r, err := g.collection.UpdateOne(ctx, f, updateOpsRecover("", g.config.HistoryLimit, g.clock.Now()), o)
+		if err != nil {
+			return nil, err
+		}
+
+		return &ratus.Deleted{
+			Deleted: r.ModifiedCount,
+		}, nil
+	})
+}
+
+// ListConsumers lists the consumers of active tasks in all topics along with their promises.
+func (g *Engine) ListConsumers(ctx context.Context) ([]*ratus.Consumer, error) {
+	return retry(ctx, g, func() ([]*ratus.Consumer, error) {
+
+		// Only fetch the fields of the promises to avoid transferring the
+		// payloads of all active tasks.
+		f := bson.D{{Key: keyState, Value: ratus.TaskStateActive}}
+		o := options.Find().SetProjection(bson.D{
+			{Key: keyID, Value: 1},
+			{Key: keyConsumer, Value: 1},
+			{Key: keyConsumed, Value: 1},
+			{Key: keyDeadline, Value: 1},
+		}).SetHint(indexActiveDeadline)
+		r, err := g.collection.Find(ctx, f, o)
+		if err != nil {
+			return nil, err
+		}
+		var ts []*ratus.Task
+		if err := r.All(ctx, &ts); err != nil {
+			return nil, err
+		}
+		return engine.GroupConsumers(ts), nil
+	})
 }
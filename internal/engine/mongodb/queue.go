@@ -2,6 +2,8 @@ package mongodb
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -12,49 +14,686 @@ import (
 )
 
 // Chore recovers timed out tasks and deletes expired tasks.
-func (g *Engine) Chore(ctx context.Context) error {
+func (g *Engine) Chore(ctx context.Context) (*ratus.Chore, error) {
+	// Chores are not retried, since tasks recovered, expired or archived by a
+	// partially applied attempt would be missing from the counts of the next
+	// one. The remaining work is picked up by the next execution.
+	return g.chore(ctx)
+}
+
+// chore is the implementation of Chore.
+func (g *Engine) chore(ctx context.Context) (*ratus.Chore, error) {
+
+	// Stop processing further batches once the time budget is exhausted, the
+	// remaining work will be picked up by the next execution.
+	var d time.Time
+	if g.config.ChoreTimeBudget > 0 {
+		d = g.clock.Now().Add(g.config.ChoreTimeBudget)
+	}
+
+	// Recover tasks that have timed out.
+	var v ratus.Chore
+	var err error
+	if v.Recovered, v.Recoveries, err = g.recoverTasks(ctx, d); err != nil {
+		return nil, err
+	}
+
+	// Release deduplication keys of tasks produced before the deduplication
+	// windows of their topics.
+	if err := g.releaseDedupKeys(ctx); err != nil {
+		return nil, err
+	}
+
+	// Promote deferred tasks that are about to become due into the polling
+	// range of the pending index.
+	if g.config.DeferralHorizon > 0 {
+		if err := g.promoteTasks(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	// Remove completed dependencies from pending tasks, so that tasks whose
+	// dependencies have all been completed become available for polling.
+	if err := g.resolveDependencies(ctx, d); err != nil {
+		return nil, err
+	}
+
+	// Delete completed tasks that have exceeded the retention periods of their
+	// topics or of the storage engine. The TTL index keeps deleting expired
+	// tasks in case background jobs are not running, which are not counted.
+	if v.Expired, err = g.expireTasks(ctx); err != nil {
+		return nil, err
+	}
+
+	// Move completed and archived tasks into the archive collection to keep
+	// the task collection small if archiving is enabled.
+	if g.archive != nil {
+		if v.Archived, err = g.moveToArchive(ctx, d); err != nil {
+			return nil, err
+		}
+	}
+
+	return &v, nil
+}
+
+// releaseDedupKeys removes deduplication keys from tasks that were produced
+// before the deduplication windows of their topics. Invalid windows are
+// ignored.
+func (g *Engine) releaseDedupKeys(ctx context.Context) error {
+	f := bson.D{{Key: keyWindow, Value: bson.D{{Key: "$nin", Value: bson.A{nil, ""}}}}}
+	r, err := g.topics.Find(ctx, f)
+	if err != nil {
+		return err
+	}
+	var ts []*ratus.Topic
+	if err := r.All(ctx, &ts); err != nil {
+		return err
+	}
+
+	n := g.clock.Now()
+	u := bson.D{{Key: "$unset", Value: bson.D{{Key: keyDedup, Value: ""}}}}
+	o := options.Update().SetUpsert(false).SetHint(indexTopicDedup)
+	for _, t := range ts {
+		w, err := time.ParseDuration(t.DedupWindow)
+		if err != nil {
+			continue
+		}
+		f := bson.D{
+			{Key: keyTopic, Value: t.Name},
+			{Key: keyDedup, Value: bson.D{{Key: "$exists", Value: true}}},
+			{Key: keyProduced, Value: bson.D{{Key: "$lt", Value: n.Add(-w)}}},
+		}
+		if _, err := g.collection.UpdateMany(ctx, f, u, o); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// promoteTasks clears the deferral flag of pending tasks whose scheduled time
+// is within the deferral horizon, so that they become visible to polling.
+func (g *Engine) promoteTasks(ctx context.Context) error {
+	f := bson.D{
+		{Key: keyState, Value: ratus.TaskStatePending},
+		{Key: keyDeferred, Value: true},
+		{Key: keyScheduled, Value: bson.D{
+			{Key: "$lte", Value: g.clock.Now().Add(g.config.DeferralHorizon)},
+		}},
+	}
+	u := bson.D{{Key: "$unset", Value: bson.D{{Key: keyDeferred, Value: ""}}}}
+	o := options.Update().SetUpsert(false).SetHint(indexDeferredScheduled)
+	_, err := g.collection.UpdateMany(ctx, f, u, o)
+	return err
+}
+
+// resolveDependencies removes completed dependencies from pending tasks in
+// batches until all blocked tasks have been checked or the deadline is
+// exceeded. Completed dependencies are looked up in the archive collection as
+// well if archiving is enabled.
+func (g *Engine) resolveDependencies(ctx context.Context, deadline time.Time) error {
+	f := bson.D{
+		{Key: keyState, Value: ratus.TaskStatePending},
+		{Key: keyDependsOn, Value: bson.D{{Key: "$exists", Value: true}}},
+	}
+	n := g.config.ChoreBatchSize
+	if n <= 0 {
+		n = defaultArchiveBatchSize
+	}
+	o := options.Find().SetBatchSize(int32(n)).SetProjection(bson.D{{Key: keyDependsOn, Value: 1}}).SetHint(indexBlockedProduced)
+	r, err := g.collection.Find(ctx, f, o)
+	if err != nil {
+		return err
+	}
+	defer r.Close(ctx)
+
+	var ts []*ratus.Task
+	for r.Next(ctx) {
+		var t ratus.Task
+		if err := r.Decode(&t); err != nil {
+			return err
+		}
+		ts = append(ts, &t)
+		if len(ts) < n {
+			continue
+		}
+		if err := g.resolveBatch(ctx, ts); err != nil {
+			return err
+		}
+		ts = ts[:0]
+		if g.exceeded(deadline) {
+			return nil
+		}
+	}
+	if err := r.Err(); err != nil {
+		return err
+	}
+	return g.resolveBatch(ctx, ts)
+}
+
+// resolveBatch removes completed dependencies from a batch of blocked tasks.
+// Tasks whose dependencies have been modified since they were read are left
+// to the next execution.
+func (g *Engine) resolveBatch(ctx context.Context, ts []*ratus.Task) error {
+	if len(ts) == 0 {
+		return nil
+	}
+	var ids bson.A
+	for _, t := range ts {
+		for _, id := range t.DependsOn {
+			ids = append(ids, id)
+		}
+	}
+	c, err := g.completed(ctx, g.collection, ids, indexID)
+	if err != nil {
+		return err
+	}
+	if g.archive != nil {
+		a, err := g.completed(ctx, g.archive, ids, "")
+		if err != nil {
+			return err
+		}
+		for id := range a {
+			c[id] = struct{}{}
+		}
+	}
+
+	w := make([]mongo.WriteModel, 0)
+	for _, t := range ts {
+		var ds []string
+		for _, id := range t.DependsOn {
+			if _, ok := c[id]; !ok {
+				ds = append(ds, id)
+			}
+		}
+		if len(ds) == len(t.DependsOn) {
+			continue
+		}
+		u := bson.D{{Key: "$set", Value: bson.D{{Key: keyDependsOn, Value: ds}}}}
+		if len(ds) == 0 {
+			u = bson.D{{Key: "$unset", Value: bson.D{{Key: keyDependsOn, Value: ""}}}}
+		}
+		m := mongo.NewUpdateOneModel()
+		m = m.SetFilter(bson.D{
+			{Key: keyID, Value: t.ID},
+			{Key: keyState, Value: ratus.TaskStatePending},
+			{Key: keyDependsOn, Value: t.DependsOn},
+		})
+		m = m.SetUpdate(u)
+		m = m.SetHint(indexID)
+		w = append(w, m)
+	}
+	if len(w) == 0 {
+		return nil
+	}
+	_, err = g.collection.BulkWrite(ctx, w, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+// completed returns the set of IDs of completed tasks in the collection among
+// the given IDs.
+func (g *Engine) completed(ctx context.Context, c *mongo.Collection, ids bson.A, hint string) (map[string]struct{}, error) {
+	f := bson.D{
+		{Key: keyID, Value: bson.D{{Key: "$in", Value: ids}}},
+		{Key: keyState, Value: ratus.TaskStateCompleted},
+	}
+	o := options.Find().SetProjection(bson.D{{Key: keyID, Value: 1}})
+	if hint != "" {
+		o = o.SetHint(hint)
+	}
+	r, err := c.Find(ctx, f, o)
+	if err != nil {
+		return nil, err
+	}
+	var v []ratus.Task
+	if err := r.All(ctx, &v); err != nil {
+		return nil, err
+	}
+	s := make(map[string]struct{}, len(v))
+	for _, t := range v {
+		s[t.ID] = struct{}{}
+	}
+	return s, nil
+}
+
+// expireTasks deletes completed tasks that have exceeded the retention periods
+// specified in the settings of their topics, exporting them beforehand or
+// moving them to the expiry topic instead if configured. Invalid retention
+// periods are ignored. Tasks in other topics are expired by the retention
+// period of the storage engine, rather than waiting for the TTL index, which
+// is not created when exporting.
+func (g *Engine) expireTasks(ctx context.Context) (int64, error) {
+	f := bson.D{{Key: keyRetention, Value: bson.D{{Key: "$nin", Value: bson.A{nil, ""}}}}}
+	r, err := g.topics.Find(ctx, f)
+	if err != nil {
+		return 0, err
+	}
+	var ts []*ratus.Topic
+	if err := r.All(ctx, &ts); err != nil {
+		return 0, err
+	}
+
+	var fs []bson.D
+	ns := bson.A{}
+	n := g.clock.Now()
+	for _, t := range ts {
+		p, err := time.ParseDuration(t.Retention)
+		if err != nil {
+			continue
+		}
+		fs = append(fs, bson.D{
+			{Key: keyState, Value: ratus.TaskStateCompleted},
+			{Key: keyConsumed, Value: bson.D{{Key: "$lt", Value: n.Add(-p)}}},
+			{Key: keyTopic, Value: t.Name},
+		})
+		ns = append(ns, t.Name)
+	}
+	fs = append(fs, bson.D{
+		{Key: keyState, Value: ratus.TaskStateCompleted},
+		{Key: keyConsumed, Value: bson.D{{Key: "$lt", Value: n.Add(-g.config.RetentionPeriod)}}},
+		{Key: keyTopic, Value: bson.D{{Key: "$nin", Value: ns}}},
+	})
+
+	var c int64
+	o := options.Delete().SetHint(indexCompletedConsumed)
+	for _, f := range fs {
+		switch {
+		case g.config.ExpiryTopic != "":
+			u := updateOpsRecord(bson.D{
+				{Key: "$set", Value: bson.D{
+					{Key: keyTopic, Value: g.config.ExpiryTopic},
+					{Key: keyState, Value: ratus.TaskStateArchived},
+				}},
+				{Key: "$unset", Value: bson.D{{Key: keyDedup, Value: ""}}},
+				updateOpsVersion,
+			}, &ratus.Transition{State: ratus.TaskStateArchived, Time: &n}, g.config.HistoryLimit)
+			r, err := g.collection.UpdateMany(ctx, f, u, options.Update().SetHint(indexCompletedConsumed))
+			if err != nil {
+				return c, err
+			}
+			c += r.ModifiedCount
+		case g.config.ExpiryExporter != nil:
+			k, err := g.exportTasks(ctx, f)
+			c += k
+			if err != nil {
+				return c, err
+			}
+		default:
+			r, err := g.collection.DeleteMany(ctx, f, o)
+			if err != nil {
+				return c, err
+			}
+			c += r.DeletedCount
+		}
+	}
+	return c, nil
+}
+
+// exportTasks exports the tasks matching the filter in batches and deletes
+// them after each successful export, and returns the number of deleted tasks.
+// If the batch size is not configured, all tasks are exported in one batch.
+func (g *Engine) exportTasks(ctx context.Context, filter bson.D) (int64, error) {
+	var c int64
+	n := g.config.ChoreBatchSize
+	for {
+		o := options.Find().SetHint(indexCompletedConsumed)
+		if n > 0 {
+			o.SetLimit(int64(n))
+		}
+		r, err := g.collection.Find(ctx, filter, o)
+		if err != nil {
+			return c, err
+		}
+		var ts []*ratus.Task
+		if err := r.All(ctx, &ts); err != nil {
+			return c, err
+		}
+		if len(ts) == 0 {
+			return c, nil
+		}
+		if err := g.config.ExpiryExporter.Export(ctx, ts); err != nil {
+			return c, err
+		}
+
+		// Delete the exported tasks by their IDs. The filter is applied again
+		// to skip tasks that have been updated since they were found.
+		ids := make(bson.A, len(ts))
+		for i, t := range ts {
+			ids[i] = t.ID
+		}
+		f := append(bson.D{{Key: keyID, Value: bson.D{{Key: "$in", Value: ids}}}}, filter...)
+		d, err := g.collection.DeleteMany(ctx, f)
+		if err != nil {
+			return c, err
+		}
+		c += d.DeletedCount
+		if n <= 0 || len(ts) < n {
+			return c, nil
+		}
+	}
+}
+
+// recoverTasks sets timed out tasks back to the "pending" state in batches
+// until all of them have been recovered or the deadline is exceeded, and
+// returns the number of recovered tasks along with their descriptions. If the
+// batch size is not configured, all tasks are recovered in a single update.
+func (g *Engine) recoverTasks(ctx context.Context, deadline time.Time) (int64, []*ratus.Recovery, error) {
 
 	// Find all active tasks whose deadline is before the current time.
 	f := bson.D{
 		{Key: keyState, Value: ratus.TaskStateActive},
 		{Key: keyDeadline, Value: bson.D{
-			{Key: "$lt", Value: time.Now()},
+			{Key: "$lt", Value: g.clock.Now()},
 		}},
 	}
 
-	// Recover tasks that have timed out.
-	o := options.Update().SetUpsert(false).SetHint(indexActiveDeadline)
-	if _, err := g.collection.UpdateMany(ctx, f, updateOpsRecover(), o); err != nil {
-		return err
+	// Find the next batch of timed out tasks and recover them by their IDs.
+	// The filter is applied again to skip tasks that have been committed
+	// since they were found, which are not counted but may still be
+	// described.
+	n := g.config.ChoreBatchSize
+	var c int64
+	var rs []*ratus.Recovery
+	for {
+		p := options.Find().SetProjection(bson.D{
+			{Key: keyID, Value: 1},
+			{Key: keyTopic, Value: 1},
+			{Key: keyProducer, Value: 1},
+			{Key: keyConsumer, Value: 1},
+			{Key: keyDeadline, Value: 1},
+		}).SetHint(indexActiveDeadline)
+		if n > 0 {
+			p.SetLimit(int64(n))
+		}
+		r, err := g.collection.Find(ctx, f, p)
+		if err != nil {
+			return c, rs, err
+		}
+		var v []*ratus.Recovery
+		if err := r.All(ctx, &v); err != nil {
+			return c, rs, err
+		}
+		if len(v) == 0 {
+			return c, rs, nil
+		}
+		ids := make(bson.A, len(v))
+		for i, d := range v {
+			ids[i] = d.ID
+		}
+		q := append(bson.D{{Key: keyID, Value: bson.D{{Key: "$in", Value: ids}}}}, f...)
+		u, err := g.collection.UpdateMany(ctx, q, updateOpsRecover("deadline exceeded", g.config.HistoryLimit, g.clock.Now()), options.Update().SetUpsert(false).SetHint(indexID))
+		if err != nil {
+			return c, rs, err
+		}
+		c += u.ModifiedCount
+		rs = append(rs, v...)
+		if n <= 0 || len(v) < n || g.exceeded(deadline) {
+			return c, rs, nil
+		}
 	}
+}
 
-	// Deletion of expired tasks is handled by the TTL index automatically.
-	return nil
+// exceeded returns whether the deadline is set and has been exceeded.
+func (g *Engine) exceeded(deadline time.Time) bool {
+	return !deadline.IsZero() && g.clock.Now().After(deadline)
+}
+
+// moveToArchive moves completed and archived tasks from the task collection
+// into the archive collection in batches until all of them have been moved or
+// the deadline is exceeded. Tasks are inserted into the archive
+// collection before being deleted from the task collection, so that they will
+// not be lost if the operation is interrupted. Transactions are not used since
+// capped and time series collections can not be written in transactions.
+func (g *Engine) moveToArchive(ctx context.Context, deadline time.Time) (int64, error) {
+	f := bson.D{{Key: keyState, Value: bson.D{
+		{Key: "$in", Value: bson.A{ratus.TaskStateCompleted, ratus.TaskStateArchived}},
+	}}}
+	n := g.config.ChoreBatchSize
+	if n <= 0 {
+		n = defaultArchiveBatchSize
+	}
+	var c int64
+	for {
+		o := options.Find().SetLimit(int64(n))
+		r, err := g.collection.Find(ctx, f, o)
+		if err != nil {
+			return c, err
+		}
+		var v []bson.Raw
+		if err := r.All(ctx, &v); err != nil {
+			return c, err
+		}
+		if len(v) == 0 {
+			return c, nil
+		}
+
+		// Duplicate key errors are ignored because the tasks may have already
+		// been archived by an interrupted or concurrent chore.
+		ds := make([]any, len(v))
+		ids := make(bson.A, len(v))
+		for i, d := range v {
+			ds[i] = d
+			ids[i] = d.Lookup(keyID)
+		}
+		if _, err := g.archive.InsertMany(ctx, ds, options.InsertMany().SetOrdered(false)); err != nil && !isDuplicateKeyErrorOnly(err) {
+			return c, err
+		}
+
+		// Only delete tasks that have not been modified back to other states
+		// since they were read.
+		q := bson.D{
+			{Key: keyID, Value: bson.D{{Key: "$in", Value: ids}}},
+			{Key: keyState, Value: f[0].Value},
+		}
+		x, err := g.collection.DeleteMany(ctx, q, options.Delete().SetHint(indexID))
+		if err != nil {
+			return c, err
+		}
+		c += x.DeletedCount
+
+		if len(v) < n || g.exceeded(deadline) {
+			return c, nil
+		}
+	}
+}
+
+// isDuplicateKeyErrorOnly returns whether all write errors in a bulk write
+// exception are duplicate key errors.
+func isDuplicateKeyErrorOnly(err error) bool {
+	var e mongo.BulkWriteException
+	if !errors.As(err, &e) || e.WriteConcernError != nil || len(e.WriteErrors) == 0 {
+		return false
+	}
+	for _, w := range e.WriteErrors {
+		if w.Code != 11000 {
+			return false
+		}
+	}
+	return true
 }
 
 // Poll makes a promise to claim and execute the next available task in a topic.
 func (g *Engine) Poll(ctx context.Context, topic string, p *ratus.Promise) (*ratus.Task, error) {
+	c, err := g.settings(ctx, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	// Tasks in topics delivering at most once are always completed when polled.
+	if c.AtMostOnce && !p.AtMostOnce {
+		q := *p
+		q.AtMostOnce = true
+		p = &q
+	}
+
+	// Tasks in topics with concurrency limits are claimed in the same
+	// transaction in which active tasks are counted.
+	var v *ratus.Task
+	if c.Concurrency > 0 {
+		err = g.transaction(ctx, func(ctx context.Context) error {
+			if err := g.checkConcurrency(ctx, topic, c.Concurrency); err != nil {
+				return err
+			}
+			var err error
+			v, err = g.claim(ctx, topic, c, p)
+			return err
+		})
+	} else {
+		v, err = g.claim(ctx, topic, c, p)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Only advance the cursor once the task has been claimed, so that the
+	// producer is not skipped if the transaction is aborted.
+	if c.Fair {
+		g.cursors.Store(topic, v.Producer)
+	}
+	return v, nil
+}
+
+// PollTasks makes promises to claim and execute up to the limit of the next
+// available tasks in a topic. Tasks are claimed one after another rather than
+// in a single transaction, and errors preventing further claims are returned
+// only if no task has been claimed, so that claimed tasks are not left to time
+// out without being executed.
+func (g *Engine) PollTasks(ctx context.Context, topic string, p *ratus.Promise, limit int) ([]*ratus.Task, error) {
+	if limit < 1 {
+		return nil, fmt.Errorf("%w: limit must be positive", ratus.ErrBadRequest)
+	}
+	var vs []*ratus.Task
+	for len(vs) < limit {
+		v, err := g.Poll(ctx, topic, p)
+		if err != nil {
+			if len(vs) > 0 {
+				break
+			}
+			return nil, err
+		}
+		vs = append(vs, v)
+	}
+	return vs, nil
+}
+
+// claim claims the next available task in the topic according to its
+// settings.
+func (g *Engine) claim(ctx context.Context, topic string, c *ratus.Topic, p *ratus.Promise) (*ratus.Task, error) {
+	t := g.clock.Now()
+	if c.Fair {
+		return g.pollFair(ctx, topic, p, t)
+	}
+	if c.Prioritized {
+		s := bson.D{{Key: keyPriority, Value: -1}, {Key: keyScheduled, Value: 1}}
+		f := queryOpsPoll(topic, p.Labels, t)
+		if g.config.DeferralHorizon > 0 {
+			f = append(f, bson.E{Key: keyDeferred, Value: nil})
+		}
+		return g.poll(ctx, f, s, indexPendingTopicPriorityScheduled, p, t)
+	}
+	s := bson.D{{Key: keyScheduled, Value: 1}}
+	if g.config.DeferralHorizon > 0 {
+		f := append(queryOpsPoll(topic, p.Labels, t), bson.E{Key: keyDeferred, Value: nil})
+		return g.poll(ctx, f, s, indexPendingTopicDeferredScheduled, p, t)
+	}
+	return g.poll(ctx, queryOpsPoll(topic, p.Labels, t), s, indexPendingTopicScheduled, p, t)
+}
+
+// NextScheduled returns the scheduled time of the next pending task in a topic that is not yet available.
+func (g *Engine) NextScheduled(ctx context.Context, topic string) (*time.Time, error) {
+	return retry(ctx, g, func() (*time.Time, error) {
+
+		// Deferred tasks are included, since they are only kept out of the
+		// polling range until background jobs promote them.
+		f := bson.D{
+			{Key: keyState, Value: ratus.TaskStatePending},
+			{Key: keyTopic, Value: topic},
+			{Key: keyScheduled, Value: bson.D{
+				{Key: "$gt", Value: g.clock.Now()},
+			}},
+		}
+		var v ratus.Task
+		s := bson.D{{Key: keyScheduled, Value: 1}}
+		j := bson.D{{Key: keyScheduled, Value: 1}}
+		o := options.FindOne().SetSort(s).SetProjection(j).SetHint(indexPendingTopicScheduled)
+		if err := g.collection.FindOne(ctx, f, o).Decode(&v); err != nil {
+			if err == mongo.ErrNoDocuments {
+				err = ratus.ErrNotFound
+			}
+			return nil, err
+		}
+		return v.Scheduled, nil
+	})
+}
+
+// checkConcurrency returns an error if the number of active tasks in the topic
+// has reached the limit. In transactions, the counter of claims in the
+// settings of the topic is incremented first, so that concurrent transactions
+// polling the same topic conflict with each other and are retried one after
+// another, each counting the tasks claimed by the previous ones. Deployments
+// without transactions only count active tasks before polling rather than
+// atomically, so the limit may be exceeded slightly by concurrent polls.
+func (g *Engine) checkConcurrency(ctx context.Context, topic string, limit int64) error {
+	if mongo.SessionFromContext(ctx) != nil {
+		if _, err := g.topics.UpdateOne(ctx, bson.D{{Key: keyID, Value: topic}}, bson.D{
+			{Key: "$inc", Value: bson.D{{Key: keyClaims, Value: int64(1)}}},
+		}); err != nil {
+			return err
+		}
+	}
+	f := bson.D{
+		{Key: keyState, Value: ratus.TaskStateActive},
+		{Key: keyTopic, Value: topic},
+	}
+	o := options.Count().SetLimit(limit).SetHint(indexActiveTopic)
+	n, err := g.collection.CountDocuments(ctx, f, o)
+	if err != nil {
+		return err
+	}
+	if n >= limit {
+		return fmt.Errorf("%w: topic %q has reached its concurrency limit of %d", ratus.ErrTooManyRequests, topic, limit)
+	}
+	return nil
+}
+
+// pollFair polls the available task with the earliest scheduled time from the
+// first producer after the one served last by this instance, wrapping around
+// to the first producer if necessary. Each instance keeps track of its own
+// position, so the round-robin order is only maintained per instance. The
+// position is advanced by the caller once the poll has been committed.
+func (g *Engine) pollFair(ctx context.Context, topic string, p *ratus.Promise, t time.Time) (*ratus.Task, error) {
+	s := bson.D{{Key: keyProducer, Value: 1}, {Key: keyScheduled, Value: 1}}
+	f := queryOpsPoll(topic, p.Labels, t)
+	if c, ok := g.cursors.Load(topic); ok {
+		q := append(append(bson.D{}, f...), bson.E{Key: keyProducer, Value: bson.D{{Key: "$gt", Value: c}}})
+		v, err := g.poll(ctx, q, s, indexPendingTopicProducerScheduled, p, t)
+		if !errors.Is(err, ratus.ErrNotFound) {
+			return v, err
+		}
+	}
+	return g.poll(ctx, f, s, indexPendingTopicProducerScheduled, p, t)
+}
+
+// poll secures the first task that matches the filter in the order of the
+// sort specification.
+func (g *Engine) poll(ctx context.Context, filter, sort bson.D, hint string, p *ratus.Promise, t time.Time) (*ratus.Task, error) {
 	return branch(func() (*ratus.Task, error) {
-		return g.pollAtomic(ctx, topic, p)
+		return g.pollAtomic(ctx, filter, sort, hint, p, t)
 	}, func() (*ratus.Task, error) {
-		return g.pollOptimistic(ctx, topic, p)
+		return g.pollOptimistic(ctx, filter, sort, hint, p, t)
 	}, g.fallbackPoll)
 }
 
-// pollAtomic is the preferred implementation of Poll.
-func (g *Engine) pollAtomic(ctx context.Context, topic string, p *ratus.Promise) (*ratus.Task, error) {
+// pollAtomic is the preferred implementation of poll.
+func (g *Engine) pollAtomic(ctx context.Context, filter, sort bson.D, hint string, p *ratus.Promise, t time.Time) (*ratus.Task, error) {
 
 	// Use an atomic findAndModify command to secure the next task in topic if
 	// available, and return the updated task. This operation is expected to
 	// work only on unsharded collections and sharded collections using the
 	// topic field as the shard key.
 	var v ratus.Task
-	t := time.Now()
-	f := queryOpsPoll(topic, t)
-	u := updateOpsConsume(p, t)
-	s := bson.D{{Key: keyScheduled, Value: 1}}
-	o := options.FindOneAndUpdate().SetUpsert(false).SetSort(s).SetReturnDocument(options.After).SetHint(indexPendingTopicScheduled)
-	if err := g.collection.FindOneAndUpdate(ctx, f, u, o).Decode(&v); err != nil {
+	u := updateOpsConsume(p, t, g.config.HistoryLimit)
+	o := options.FindOneAndUpdate().SetUpsert(false).SetSort(sort).SetReturnDocument(options.After).SetHint(hint)
+	if err := g.collection.FindOneAndUpdate(ctx, filter, u, o).Decode(&v); err != nil {
 		if err == mongo.ErrNoDocuments {
 			err = ratus.ErrNotFound
 		}
@@ -64,14 +703,11 @@ func (g *Engine) pollAtomic(ctx context.Context, topic string, p *ratus.Promise)
 	return &v, nil
 }
 
-// pollOptimistic is the fallback implementation of Poll.
-func (g *Engine) pollOptimistic(ctx context.Context, topic string, p *ratus.Promise) (*ratus.Task, error) {
+// pollOptimistic is the fallback implementation of poll.
+func (g *Engine) pollOptimistic(ctx context.Context, filter, sort bson.D, hint string, p *ratus.Promise, t time.Time) (*ratus.Task, error) {
 
 	// Peek into the topic to get the ID and nonce of the next candidate task.
-	t := time.Now()
-	f := queryOpsPoll(topic, t)
-	s := bson.D{{Key: keyScheduled, Value: 1}}
-	c, err := g.peek(ctx, f, s, indexPendingTopicScheduled)
+	c, err := g.peek(ctx, filter, sort, hint)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			err = ratus.ErrNotFound
@@ -83,9 +719,10 @@ func (g *Engine) pollOptimistic(ctx context.Context, topic string, p *ratus.Prom
 	// This operation is expected to work on sharded collections using various
 	// sharding strategies.
 	var v ratus.Task
+	f := append(bson.D{}, filter...)
 	f = append(f, bson.E{Key: keyID, Value: c.ID})
 	f = append(f, bson.E{Key: keyNonce, Value: c.Nonce})
-	u := updateOpsConsume(p, t)
+	u := updateOpsConsume(p, t, g.config.HistoryLimit)
 	n := options.FindOneAndUpdate().SetUpsert(false).SetReturnDocument(options.After).SetHint(indexID)
 	if err := g.collection.FindOneAndUpdate(ctx, f, u, n).Decode(&v); err != nil {
 
@@ -93,7 +730,7 @@ func (g *Engine) pollOptimistic(ctx context.Context, topic string, p *ratus.Prom
 		// been obtained by another consumer. Retry immediately to secure the
 		// next task!
 		if err == mongo.ErrNoDocuments {
-			return g.pollOptimistic(ctx, topic, p)
+			return g.pollOptimistic(ctx, filter, sort, hint, p, t)
 		}
 		return nil, err
 	}
@@ -103,23 +740,41 @@ func (g *Engine) pollOptimistic(ctx context.Context, topic string, p *ratus.Prom
 
 // Commit applies a set of updates to a task and returns the updated task.
 func (g *Engine) Commit(ctx context.Context, id string, m *ratus.Commit) (*ratus.Task, error) {
-	return branch(func() (*ratus.Task, error) {
+	m, err := g.compressCommit(m)
+	if err != nil {
+		return nil, err
+	}
+	v, err := branch(func() (*ratus.Task, error) {
 		return g.commitAtomic(ctx, id, m)
 	}, func() (*ratus.Task, error) {
 		return g.commitOptimistic(ctx, id, m)
 	}, g.fallbackCommit)
+
+	// Moving a task into a topic where its deduplication key is held by
+	// another task violates the unique index.
+	if mongo.IsDuplicateKeyError(err) {
+		err = fmt.Errorf("%w: deduplication key is held by another task in topic %q", ratus.ErrConflict, m.Topic)
+	}
+	return v, err
 }
 
 // commitAtomic is the preferred implementation of Commit.
 func (g *Engine) commitAtomic(ctx context.Context, id string, m *ratus.Commit) (*ratus.Task, error) {
 
-	// Verify the nonce if provided to invalidate unintended commits.
+	// Verify the nonce, consumer and version if provided to invalidate
+	// unintended commits.
 	var v ratus.Task
 	f := bson.D{{Key: keyID, Value: id}}
 	if m.Nonce != "" {
 		f = append(f, bson.E{Key: keyNonce, Value: m.Nonce})
 	}
-	u := updateOpsCommit(m)
+	if m.Consumer != "" {
+		f = append(f, bson.E{Key: keyConsumer, Value: m.Consumer})
+	}
+	if m.Version != 0 {
+		f = append(f, bson.E{Key: keyVersion, Value: m.Version})
+	}
+	u := updateOpsCommit(m, g.config.DeferralHorizon, g.config.HistoryLimit, g.clock.Now())
 	o := options.FindOneAndUpdate().SetUpsert(false).SetReturnDocument(options.After).SetHint(indexID)
 
 	// Use an atomic findAndModify command to apply the updates and return the
@@ -127,10 +782,10 @@ func (g *Engine) commitAtomic(ctx context.Context, id string, m *ratus.Commit) (
 	// collections and sharded collections using the ID field as the shard key.
 	if err := g.collection.FindOneAndUpdate(ctx, f, u, o).Decode(&v); err != nil {
 
-		// Check if the failure is due to a mismatch of nonce or the target
-		// task does not exist.
+		// Check if the failure is due to a mismatch of nonce, consumer or
+		// version, or the target task does not exist.
 		if err == mongo.ErrNoDocuments {
-			if m.Nonce != "" && g.exists(ctx, bson.D{{Key: keyID, Value: id}}, indexID) {
+			if (m.Nonce != "" || m.Consumer != "" || m.Version != 0) && g.exists(ctx, bson.D{{Key: keyID, Value: id}}, indexID) {
 				err = ratus.ErrConflict
 			} else {
 				err = ratus.ErrNotFound
@@ -155,10 +810,17 @@ func (g *Engine) commitOptimistic(ctx context.Context, id string, m *ratus.Commi
 		return nil, err
 	}
 
-	// Verify the nonce if provided to invalidate unintended commits.
+	// Verify the nonce, consumer and version if provided to invalidate
+	// unintended commits.
 	if m.Nonce != "" && m.Nonce != c.Nonce {
 		return nil, ratus.ErrConflict
 	}
+	if m.Consumer != "" && m.Consumer != c.Consumer {
+		return nil, ratus.ErrConflict
+	}
+	if m.Version != 0 && m.Version != c.Version {
+		return nil, ratus.ErrConflict
+	}
 
 	// Add all known fields to the filter criteria to perform findAndModify.
 	// This operation is expected to work on sharded collections using various
@@ -167,7 +829,10 @@ func (g *Engine) commitOptimistic(ctx context.Context, id string, m *ratus.Commi
 	f = append(f, bson.E{Key: keyTopic, Value: c.Topic})
 	f = append(f, bson.E{Key: keyState, Value: c.State})
 	f = append(f, bson.E{Key: keyNonce, Value: c.Nonce})
-	u := updateOpsCommit(m)
+	if c.Version != 0 {
+		f = append(f, bson.E{Key: keyVersion, Value: c.Version})
+	}
+	u := updateOpsCommit(m, g.config.DeferralHorizon, g.config.HistoryLimit, g.clock.Now())
 	n := options.FindOneAndUpdate().SetUpsert(false).SetReturnDocument(options.After).SetHint(indexID)
 	if err := g.collection.FindOneAndUpdate(ctx, f, u, n).Decode(&v); err != nil {
 
@@ -182,3 +847,241 @@ func (g *Engine) commitOptimistic(ctx context.Context, id string, m *ratus.Commi
 
 	return &v, nil
 }
+
+// UpdateProgress records the progress of an active task without changing its state, nonce or version.
+func (g *Engine) UpdateProgress(ctx context.Context, id string, p *ratus.Progress) (*ratus.Updated, error) {
+	return retry(ctx, g, func() (*ratus.Updated, error) {
+
+		// Only the consumer holding the promise of an active task may report
+		// its progress. The nonce is excluded when marshaling the progress.
+		f := bson.D{{Key: keyID, Value: id}, {Key: keyState, Value: ratus.TaskStateActive}}
+		if p.Nonce != "" {
+			f = append(f, bson.E{Key: keyNonce, Value: p.Nonce})
+		}
+		u := bson.D{{Key: "$set", Value: bson.D{{Key: keyProgress, Value: p}}}}
+		o := options.Update().SetUpsert(false).SetHint(indexID)
+		r, err := g.collection.UpdateOne(ctx, f, u, o)
+		if err != nil {
+			return nil, err
+		}
+
+		// Check if the failure is due to the state or nonce of the task, or
+		// the target task does not exist.
+		if r.MatchedCount == 0 {
+			if g.exists(ctx, bson.D{{Key: keyID, Value: id}}, indexID) {
+				return nil, ratus.ErrConflict
+			}
+			return nil, ratus.ErrNotFound
+		}
+		return &ratus.Updated{
+			Updated: r.MatchedCount,
+		}, nil
+	})
+}
+
+// Heartbeat extends the deadline of an active task without changing its state, nonce or version.
+func (g *Engine) Heartbeat(ctx context.Context, id, nonce string, deadline time.Time) (*ratus.Updated, error) {
+	return retry(ctx, g, func() (*ratus.Updated, error) {
+
+		// Only the consumer holding the promise of an active task may extend
+		// its deadline.
+		f := bson.D{{Key: keyID, Value: id}, {Key: keyState, Value: ratus.TaskStateActive}}
+		if nonce != "" {
+			f = append(f, bson.E{Key: keyNonce, Value: nonce})
+		}
+		u := bson.D{{Key: "$set", Value: bson.D{{Key: keyDeadline, Value: deadline}}}}
+		o := options.Update().SetUpsert(false).SetHint(indexID)
+		r, err := g.collection.UpdateOne(ctx, f, u, o)
+		if err != nil {
+			return nil, err
+		}
+
+		// Check if the failure is due to the state or nonce of the task, or
+		// the target task does not exist.
+		if r.MatchedCount == 0 {
+			if g.exists(ctx, bson.D{{Key: keyID, Value: id}}, indexID) {
+				return nil, ratus.ErrConflict
+			}
+			return nil, ratus.ErrNotFound
+		}
+		return &ratus.Updated{
+			Updated: r.MatchedCount,
+		}, nil
+	})
+}
+
+// Watch blocks and calls the handler function with the name of the topic
+// whenever a task in the topic may have become available for polling.
+func (g *Engine) Watch(ctx context.Context, f func(topic string)) error {
+
+	// Use the fallback branch if the value of the flag is greater than zero.
+	if g.fallbackWatch.Load() > 0 {
+		return g.watchPeriodic(ctx, f)
+	}
+
+	// Attempt to open a change stream and fallback to periodic notifications
+	// if change streams are not supported by the deployment. Setting the flag
+	// value to a negative number will disable auto fallback.
+	err := g.watchChangeStream(ctx, f)
+	if err != nil && g.fallback(err) {
+		return g.watchPeriodic(ctx, f)
+	}
+
+	return err
+}
+
+// fallback returns whether the error indicates that change streams are not
+// supported by the deployment, in which case watching falls back to periodic
+// checks from then on. It always returns false if auto fallback is disabled.
+func (g *Engine) fallback(err error) bool {
+	if g.fallbackWatch.Load() < 0 {
+		return false
+	}
+	var e mongo.ServerError
+	if !errors.As(err, &e) {
+		return false
+	}
+	for _, c := range fallbackWatchErrorCodes {
+		if e.HasErrorCode(c) {
+			g.fallbackWatch.Store(1)
+			return true
+		}
+	}
+	return false
+}
+
+// watchChangeStream is the preferred implementation of Watch.
+func (g *Engine) watchChangeStream(ctx context.Context, f func(topic string)) error {
+
+	// Only listen for insertions, replacements and updates that result in
+	// tasks in the "pending" state. Updates include tasks being recovered by
+	// background jobs and tasks being committed back to the queue.
+	p := mongo.Pipeline{
+		bson.D{{Key: "$match", Value: bson.D{
+			{Key: "operationType", Value: bson.D{{Key: "$in", Value: bson.A{"insert", "replace", "update"}}}},
+			{Key: "fullDocument." + keyState, Value: ratus.TaskStatePending},
+		}}},
+		bson.D{{Key: "$project", Value: bson.D{
+			{Key: "fullDocument." + keyTopic, Value: 1},
+		}}},
+	}
+	o := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	s, err := g.collection.Watch(ctx, p, o)
+	if err != nil {
+		return err
+	}
+	defer s.Close(context.Background())
+
+	// Notifications may arrive before the scheduled time of the tasks, thus
+	// the callers should not assume that polling will always succeed.
+	for s.Next(ctx) {
+		var v struct {
+			FullDocument struct {
+				Topic string `bson:"topic"`
+			} `bson:"fullDocument"`
+		}
+		if err := s.Decode(&v); err != nil {
+			return err
+		}
+		f(v.FullDocument.Topic)
+	}
+	if err := s.Err(); err != nil && ctx.Err() == nil {
+		return err
+	}
+
+	return ctx.Err()
+}
+
+// watchPeriodic is the fallback implementation of Watch.
+func (g *Engine) watchPeriodic(ctx context.Context, f func(topic string)) error {
+
+	// Without change streams there is no way to tell which topic has changed,
+	// so notify the callers to check all topics at the configured interval.
+	d := g.config.WatchInterval
+	if d <= 0 {
+		d = defaultWatchInterval
+	}
+	r := time.NewTicker(d)
+	defer r.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-r.C:
+			f("")
+		}
+	}
+}
+
+// WatchTask blocks until the version of the task differs from the version
+// and returns the task, or returns ErrNotFound once the task is deleted.
+func (g *Engine) WatchTask(ctx context.Context, id string, version int64) (*ratus.Task, error) {
+
+	// Use the fallback branch if the value of the flag is greater than zero.
+	if g.fallbackWatch.Load() > 0 {
+		return g.watchTaskPeriodic(ctx, id, version)
+	}
+
+	v, err := g.watchTaskChangeStream(ctx, id, version)
+	if err != nil && g.fallback(err) {
+		return g.watchTaskPeriodic(ctx, id, version)
+	}
+
+	return v, err
+}
+
+// watchTaskChangeStream is the preferred implementation of WatchTask.
+func (g *Engine) watchTaskChangeStream(ctx context.Context, id string, version int64) (*ratus.Task, error) {
+
+	// Open the change stream before looking up the task, so that changes made
+	// in between are not missed. Events only signal that the task may have
+	// changed, and the task is looked up again to check its version, which
+	// also finds tasks that have been moved to the archive collection.
+	p := mongo.Pipeline{
+		bson.D{{Key: "$match", Value: bson.D{
+			{Key: "documentKey." + keyID, Value: id},
+		}}},
+	}
+	s, err := g.collection.Watch(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close(context.Background())
+
+	for {
+		v, err := g.GetTask(ctx, id)
+		if err != nil || v.Version != version {
+			return v, err
+		}
+		if !s.Next(ctx) {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			if err := s.Err(); err != nil {
+				return nil, err
+			}
+			return nil, errors.New("change stream closed unexpectedly")
+		}
+	}
+}
+
+// watchTaskPeriodic is the fallback implementation of WatchTask.
+func (g *Engine) watchTaskPeriodic(ctx context.Context, id string, version int64) (*ratus.Task, error) {
+	d := g.config.WatchInterval
+	if d <= 0 {
+		d = defaultWatchInterval
+	}
+	r := time.NewTicker(d)
+	defer r.Stop()
+	for {
+		v, err := g.GetTask(ctx, id)
+		if err != nil || v.Version != version {
+			return v, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-r.C:
+		}
+	}
+}
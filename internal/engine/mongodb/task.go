@@ -2,44 +2,181 @@ package mongodb
 
 import (
 	"context"
+	"fmt"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 
 	"github.com/hyperonym/ratus"
+	"github.com/hyperonym/ratus/internal/engine"
 )
 
-// ListTasks lists all tasks in a topic.
-func (g *Engine) ListTasks(ctx context.Context, topic string, limit, offset int) ([]*ratus.Task, error) {
-	f := bson.D{{Key: keyTopic, Value: topic}}
-	o := options.Find().SetLimit(int64(limit)).SetSkip(int64(offset)).SetHint(indexTopic)
-	r, err := g.collection.Find(ctx, f, o)
+// ListTasks lists all tasks in a topic that match the label selector.
+func (g *Engine) ListTasks(ctx context.Context, topic string, labels map[string]string, p *engine.Page) ([]*ratus.Task, error) {
+	return retry(ctx, g, func() ([]*ratus.Task, error) {
+
+		// Ties are broken by IDs to support seeking past the last task seen,
+		// which uses the index on topics, the sort field and IDs to avoid
+		// sorting in memory unless filtering by labels.
+		f := queryOpsPage(bson.D{{Key: keyTopic, Value: topic}}, p)
+		f = queryOpsLabels(f, labels)
+		d, x := sortOpsPage(p)
+		o := options.Find().SetSort(d).SetLimit(int64(p.Limit)).SetSkip(int64(p.Offset))
+		if len(labels) == 0 {
+			o.SetHint(x)
+		}
+		r, err := g.collection.Find(ctx, f, o)
+		if err != nil {
+			return nil, err
+		}
+		v := make([]*ratus.Task, 0)
+		if err := r.All(ctx, &v); err != nil {
+			return nil, err
+		}
+		return v, nil
+	})
+}
+
+// ListArchive lists archived tasks in a topic consumed within the time range, in the order of their consumed time.
+func (g *Engine) ListArchive(ctx context.Context, topic string, from, to *time.Time, p *engine.Page) ([]*ratus.Task, error) {
+	return retry(ctx, g, func() ([]*ratus.Task, error) {
+
+		// Archived tasks are listed through the partial index on their
+		// consumed times, which only covers the task collection. Tasks
+		// without consumed times only match if the range is unbounded.
+		q := *p
+		q.Sort = engine.SortConsumed
+		f := bson.D{
+			{Key: keyState, Value: ratus.TaskStateArchived},
+			{Key: keyTopic, Value: topic},
+		}
+		if from != nil || to != nil {
+			r := bson.D{{Key: "$type", Value: "date"}}
+			if from != nil {
+				r = append(r, bson.E{Key: "$gte", Value: *from})
+			}
+			if to != nil {
+				r = append(r, bson.E{Key: "$lt", Value: *to})
+			}
+			f = append(f, bson.E{Key: keyConsumed, Value: r})
+		}
+		f = queryOpsPage(f, &q)
+		d, _ := sortOpsPage(&q)
+		o := options.Find().SetSort(d).SetLimit(int64(q.Limit)).SetSkip(int64(q.Offset)).SetHint(indexArchivedTopicConsumed)
+		r, err := g.collection.Find(ctx, f, o)
+		if err != nil {
+			return nil, err
+		}
+		v := make([]*ratus.Task, 0)
+		if err := r.All(ctx, &v); err != nil {
+			return nil, err
+		}
+		return v, nil
+	})
+}
+
+// StreamTasks calls the function with each task in a topic in the order of their IDs, stopping at the first error.
+func (g *Engine) StreamTasks(ctx context.Context, topic string, f func(*ratus.Task) error) error {
+
+	// Only opening the cursor is retried, since tasks that have already been
+	// passed to the function must not be passed again.
+	r, err := retry(ctx, g, func() (*mongo.Cursor, error) {
+		o := options.Find().SetSort(bson.D{{Key: keyID, Value: 1}}).SetHint(indexTopicID)
+		return g.collection.Find(ctx, bson.D{{Key: keyTopic, Value: topic}}, o)
+	})
 	if err != nil {
-		return nil, err
+		return err
 	}
-	v := make([]*ratus.Task, 0)
-	if err := r.All(ctx, &v); err != nil {
-		return nil, err
+	defer r.Close(context.WithoutCancel(ctx))
+	for r.Next(ctx) {
+		var v ratus.Task
+		if err := r.Decode(&v); err != nil {
+			return err
+		}
+		if err := f(&v); err != nil {
+			return err
+		}
 	}
-	return v, nil
+	return r.Err()
+}
+
+// CountTasks counts all tasks in a topic that match the labels.
+func (g *Engine) CountTasks(ctx context.Context, topic string, labels map[string]string) (int64, error) {
+	return retry(ctx, g, func() (int64, error) {
+		f := queryOpsLabels(bson.D{{Key: keyTopic, Value: topic}}, labels)
+		o := options.Count()
+		if len(labels) == 0 {
+			o.SetHint(indexTopicID)
+		}
+		return g.collection.CountDocuments(ctx, f, o)
+	})
+}
+
+// CountPending counts pending tasks of a producer in a topic, stopping at the limit if it is positive.
+func (g *Engine) CountPending(ctx context.Context, topic, producer string, limit int64) (int64, error) {
+	return retry(ctx, g, func() (int64, error) {
+		f := bson.D{
+			{Key: keyState, Value: ratus.TaskStatePending},
+			{Key: keyTopic, Value: topic},
+			{Key: keyProducer, Value: producer},
+		}
+		o := options.Count().SetHint(indexPendingTopicProducerScheduled)
+		if limit > 0 {
+			o.SetLimit(limit)
+		}
+		return g.collection.CountDocuments(ctx, f, o)
+	})
+}
+
+// CountPendingTasks counts pending tasks in a topic, or in all topics if the topic is empty, stopping at the limit if it is positive.
+func (g *Engine) CountPendingTasks(ctx context.Context, topic string, limit int64) (int64, error) {
+	return retry(ctx, g, func() (int64, error) {
+		// Count with the partial index on pending tasks rather than grouping
+		// all tasks by their states.
+		f := bson.D{{Key: keyState, Value: ratus.TaskStatePending}}
+		if topic != "" {
+			f = append(f, bson.E{Key: keyTopic, Value: topic})
+		}
+		o := options.Count().SetHint(indexPendingTopicScheduled)
+		if limit > 0 {
+			o.SetLimit(limit)
+		}
+		return g.collection.CountDocuments(ctx, f, o)
+	})
 }
 
 // InsertTasks inserts a batch of tasks while ignoring existing ones.
 func (g *Engine) InsertTasks(ctx context.Context, ts []*ratus.Task) (*ratus.Updated, error) {
+	ts, err := g.compressTasks(ts)
+	if err != nil {
+		return nil, err
+	}
+	ts = versioned(ts, nil)
+
+	// Batches are not retried, since tasks inserted by a partially applied
+	// attempt would be ignored as duplicates and not counted by the next one.
+	return g.insertTasks(ctx, ts)
+}
+
+// insertTasks inserts the tasks as is while ignoring existing ones.
+func (g *Engine) insertTasks(ctx context.Context, ts []*ratus.Task) (*ratus.Updated, error) {
 	w := make([]mongo.WriteModel, len(ts))
 	for i, t := range ts {
 		m := mongo.NewInsertOneModel()
-		m = m.SetDocument(t)
+		m = m.SetDocument(g.document(t))
 		w[i] = m
 	}
 
 	// Execute an unordered bulk write to insert tasks and ignore duplicates.
 	// If an error occurs during the processing of one of the write operations,
 	// MongoDB will continue to process remaining write operations in the list.
+	// Write errors abort transactions though, so duplicates are reported when
+	// inserting in a transaction.
 	o := options.BulkWrite().SetOrdered(false)
 	r, err := g.collection.BulkWrite(ctx, w, o)
-	if err != nil && !mongo.IsDuplicateKeyError(err) {
+	if err != nil && (!mongo.IsDuplicateKeyError(err) || mongo.SessionFromContext(ctx) != nil) {
 		return nil, err
 	}
 
@@ -51,10 +188,17 @@ func (g *Engine) InsertTasks(ctx context.Context, ts []*ratus.Task) (*ratus.Upda
 
 // UpsertTasks inserts or updates a batch of tasks.
 func (g *Engine) UpsertTasks(ctx context.Context, ts []*ratus.Task) (*ratus.Updated, error) {
+	ts, err := g.compressTasks(ts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Batches are not retried, since tasks created by a partially applied
+	// attempt would be counted as updated by the next one.
 	return branch(func() (*ratus.Updated, error) {
 		return g.upsertTasksReplace(ctx, ts)
 	}, func() (*ratus.Updated, error) {
-		return g.upsertTasksDeleteAndInsert(ctx, ts)
+		return g.upsertTasksDeleteAndInsert(ctx, ts, false)
 	}, g.fallbackUpsertTasks)
 }
 
@@ -66,16 +210,17 @@ func (g *Engine) upsertTasksReplace(ctx context.Context, ts []*ratus.Task) (*rat
 	// sharded collections using the ID field as the shard key.
 	w := make([]mongo.WriteModel, len(ts))
 	for i, t := range ts {
-		m := mongo.NewReplaceOneModel()
+		m := mongo.NewUpdateOneModel()
 		m = m.SetFilter(bson.D{{Key: keyID, Value: t.ID}})
-		m = m.SetReplacement(t)
+		m = m.SetUpdate(updateOpsReplace(g.document(t)))
 		m = m.SetUpsert(true)
 		m = m.SetHint(indexID)
 		w[i] = m
 	}
+	// Tasks holding deduplication keys of other tasks are skipped.
 	o := options.BulkWrite().SetOrdered(false)
 	r, err := g.collection.BulkWrite(ctx, w, o)
-	if err != nil {
+	if err != nil && !isDuplicateKeyErrorOnly(err) {
 		return nil, err
 	}
 
@@ -86,44 +231,185 @@ func (g *Engine) upsertTasksReplace(ctx context.Context, ts []*ratus.Task) (*rat
 }
 
 // upsertTasksDeleteAndInsert is the fallback implementation of UpsertTasks.
-func (g *Engine) upsertTasksDeleteAndInsert(ctx context.Context, ts []*ratus.Task) (*ratus.Updated, error) {
+// If match is true, tasks with non-zero versions are only replaced if the
+// versions match the current ones.
+func (g *Engine) upsertTasksDeleteAndInsert(ctx context.Context, ts []*ratus.Task, match bool) (*ratus.Updated, error) {
 
-	// Delete tasks with the same IDs before inserting to avoid modification of
-	// shard key values. It's ugly, but as far as I know it's the only way to
-	// circumvent MongoDB's own limitations on sharded collections:
-	// https://www.mongodb.com/docs/v4.4/reference/method/db.collection.replaceOne/#shard-key-modification
-	w := make([]mongo.WriteModel, len(ts))
+	// Later tasks in the batch replace the earlier ones with the same IDs, as
+	// if the tasks were upserted one by one, since inserting all of them would
+	// fail with duplicate key errors.
+	ts, n := collapse(ts)
+	ids := make(bson.A, len(ts))
 	for i, t := range ts {
-		m := mongo.NewDeleteOneModel()
-		m = m.SetFilter(bson.D{{Key: keyID, Value: t.ID}})
-		m = m.SetHint(indexID)
-		w[i] = m
+		ids[i] = t.ID
 	}
 
-	// The number of deleted tasks is the number of tasks that should be updated.
-	o := options.BulkWrite().SetOrdered(false)
-	r, err := g.collection.BulkWrite(ctx, w, o)
-	if err != nil {
-		return nil, err
-	}
+	// Wrap the deletion and insertion in a multi-document transaction when
+	// connected to a replica set or a sharded cluster, so that tasks will not
+	// be lost if the instance crashes between the two operations.
+	var c, d int64
+	if err := g.transaction(ctx, func(ctx context.Context) error {
+
+		// Look up the current versions of the tasks, which are incremented
+		// when inserting the tasks again.
+		o := options.Find().SetProjection(bson.D{{Key: keyVersion, Value: 1}}).SetHint(indexID)
+		r, err := g.collection.Find(ctx, bson.D{{Key: keyID, Value: bson.D{{Key: "$in", Value: ids}}}}, o)
+		if err != nil {
+			return err
+		}
+		var vs []*ratus.Task
+		if err := r.All(ctx, &vs); err != nil {
+			return err
+		}
+		m := make(map[string]int64, len(vs))
+		for _, v := range vs {
+			m[v.ID] = v.Version
+		}
+		for _, t := range ts {
+			if v, ok := m[t.ID]; !match || t.Version == 0 {
+				continue
+			} else if !ok {
+				return ratus.ErrNotFound
+			} else if t.Version != v {
+				return ratus.ErrConflict
+			}
+		}
 
-	// Insert the tasks and ignore duplicate key errors in race conditions.
-	// This operation is expected to work on sharded collections using various
-	// sharding strategies.
-	if _, err := g.InsertTasks(ctx, ts); err != nil {
+		// Tasks holding deduplication keys of other tasks are skipped before
+		// writing, since duplicate key errors abort transactions.
+		v, err := g.deduplicate(ctx, ts, ids)
+		if err != nil {
+			return err
+		}
+		c, d = int64(len(v)), 0
+		if len(v) == 0 {
+			return nil
+		}
+
+		// Delete tasks with the same IDs before inserting to avoid
+		// modification of shard key values. It's ugly, but as far as I know
+		// it's the only way to circumvent MongoDB's own limitations on sharded
+		// collections:
+		// https://www.mongodb.com/docs/v4.4/reference/method/db.collection.replaceOne/#shard-key-modification
+		var e, k int64
+		w := make([]mongo.WriteModel, len(v))
+		for i, t := range v {
+			f := bson.D{{Key: keyID, Value: t.ID}}
+			if match && t.Version != 0 {
+				f = append(f, bson.E{Key: keyVersion, Value: t.Version})
+				k++
+			}
+			if _, ok := m[t.ID]; ok {
+				e++
+			}
+			x := mongo.NewDeleteOneModel()
+			x = x.SetFilter(f)
+			x = x.SetHint(indexID)
+			w[i] = x
+		}
+
+		// The number of deleted tasks is the number of tasks that should be
+		// updated. Tasks with mismatched versions are not deleted in race
+		// conditions.
+		b, err := g.collection.BulkWrite(ctx, w, options.BulkWrite().SetOrdered(false))
+		if err != nil {
+			return err
+		}
+		if k > 0 && b.DeletedCount < e {
+			return ratus.ErrConflict
+		}
+		d = b.DeletedCount
+
+		// Insert the tasks. Duplicate key errors are only ignored in race
+		// conditions outside of transactions. This operation is expected to
+		// work on sharded collections using various sharding strategies.
+		_, err = g.insertTasks(ctx, versioned(v, m))
+		return err
+	}); err != nil {
 		return nil, err
 	}
 
 	return &ratus.Updated{
-		Created: int64(len(ts)) - r.DeletedCount,
-		Updated: r.DeletedCount,
+		Created: c - d,
+		Updated: d + n,
 	}, nil
 }
 
-// DeleteTasks deletes all tasks in a topic.
-func (g *Engine) DeleteTasks(ctx context.Context, topic string) (*ratus.Deleted, error) {
-	f := bson.D{{Key: keyTopic, Value: topic}}
-	o := options.Delete().SetHint(indexTopic)
+// deduplicate returns the tasks except for the ones whose deduplication keys
+// are held by existing tasks not in the batch, or by earlier tasks in the
+// batch. All tasks are returned if deduplication is not enforced.
+func (g *Engine) deduplicate(ctx context.Context, ts []*ratus.Task, ids bson.A) ([]*ratus.Task, error) {
+	if g.config.EnableSharding && g.config.ShardKey == keyID || g.skipIndexes[indexTopicDedup] {
+		return ts, nil
+	}
+	var q bson.A
+	for _, t := range ts {
+		if t.Dedup != "" {
+			q = append(q, bson.D{{Key: keyTopic, Value: t.Topic}, {Key: keyDedup, Value: t.Dedup}})
+		}
+	}
+	if len(q) == 0 {
+		return ts, nil
+	}
+
+	// Look up the existing tasks holding the deduplication keys.
+	f := bson.D{{Key: "$or", Value: q}, {Key: keyID, Value: bson.D{{Key: "$nin", Value: ids}}}}
+	o := options.Find().SetProjection(bson.D{{Key: keyTopic, Value: 1}, {Key: keyDedup, Value: 1}})
+	r, err := g.collection.Find(ctx, f, o)
+	if err != nil {
+		return nil, err
+	}
+	var hs []*ratus.Task
+	if err := r.All(ctx, &hs); err != nil {
+		return nil, err
+	}
+	held := make(map[[2]string]bool, len(hs))
+	for _, h := range hs {
+		held[[2]string{h.Topic, h.Dedup}] = true
+	}
+
+	v := make([]*ratus.Task, 0, len(ts))
+	for _, t := range ts {
+		if t.Dedup != "" {
+			k := [2]string{t.Topic, t.Dedup}
+			if held[k] {
+				continue
+			}
+			held[k] = true
+		}
+		v = append(v, t)
+	}
+	return v, nil
+}
+
+// collapse removes the tasks that are followed by tasks with the same IDs in
+// the batch, and returns the number of tasks removed.
+func collapse(ts []*ratus.Task) ([]*ratus.Task, int64) {
+	last := make(map[string]int, len(ts))
+	for i, t := range ts {
+		last[t.ID] = i
+	}
+	if len(last) == len(ts) {
+		return ts, 0
+	}
+	v := make([]*ratus.Task, 0, len(last))
+	for i, t := range ts {
+		if last[t.ID] == i {
+			v = append(v, t)
+		}
+	}
+	return v, int64(len(ts) - len(v))
+}
+
+// DeleteTasks deletes all tasks in a topic that match the label selector.
+func (g *Engine) DeleteTasks(ctx context.Context, topic string, labels map[string]string) (*ratus.Deleted, error) {
+	// Deletions are not retried, since tasks deleted by a partially applied
+	// attempt would be missing from the count of the next one.
+	f := queryOpsLabels(bson.D{{Key: keyTopic, Value: topic}}, labels)
+	o := options.Delete()
+	if len(labels) == 0 {
+		o.SetHint(indexTopic)
+	}
 	r, err := g.collection.DeleteMany(ctx, f, o)
 	if err != nil {
 		return nil, err
@@ -133,25 +419,144 @@ func (g *Engine) DeleteTasks(ctx context.Context, topic string) (*ratus.Deleted,
 	}, nil
 }
 
+// MoveTasks moves tasks in a topic that match the filters to another topic.
+func (g *Engine) MoveTasks(ctx context.Context, topic string, m *ratus.Move) (*ratus.Updated, error) {
+	// Moves are not retried, since the number of moved tasks would be lost
+	// along with the response of an applied attempt.
+	f := queryOpsLabels(bson.D{{Key: keyTopic, Value: topic}}, m.Labels)
+	if m.State != nil {
+		f = append(f, bson.E{Key: keyState, Value: *m.State})
+	}
+	u := bson.D{{Key: "$set", Value: bson.D{{Key: keyTopic, Value: m.Topic}}}, updateOpsVersion}
+
+	// Tasks without deduplication keys are moved in bulk.
+	q := append(append(bson.D{}, f...), bson.E{Key: keyDedup, Value: bson.D{{Key: "$exists", Value: false}}})
+	r, err := g.collection.UpdateMany(ctx, q, u)
+	if err != nil {
+		return nil, err
+	}
+	n := r.ModifiedCount
+
+	// Tasks with deduplication keys are moved one at a time, skipping the
+	// ones whose keys are held by other tasks in the destination topic. The
+	// filters are applied again in case the tasks have changed since they
+	// were found.
+	q = append(append(bson.D{}, f...), filterDedup...)
+	o := options.Find().SetProjection(bson.D{{Key: keyID, Value: 1}})
+	c, err := g.collection.Find(ctx, q, o)
+	if err != nil {
+		return nil, err
+	}
+	var ts []*ratus.Task
+	if err := c.All(ctx, &ts); err != nil {
+		return nil, err
+	}
+	for _, t := range ts {
+		r, err := g.collection.UpdateOne(ctx, append(bson.D{{Key: keyID, Value: t.ID}}, f...), u)
+		if mongo.IsDuplicateKeyError(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		n += r.ModifiedCount
+	}
+
+	return &ratus.Updated{
+		Updated: n,
+	}, nil
+}
+
 // GetTask gets a task by its unique ID.
 func (g *Engine) GetTask(ctx context.Context, id string) (*ratus.Task, error) {
-	var v ratus.Task
-	f := bson.D{{Key: keyID, Value: id}}
-	o := options.FindOne().SetAllowPartialResults(true).SetHint(indexID)
-	if err := g.collection.FindOne(ctx, f, o).Decode(&v); err != nil {
-		if err == mongo.ErrNoDocuments {
-			err = ratus.ErrNotFound
+	return retry(ctx, g, func() (*ratus.Task, error) {
+		var v ratus.Task
+		f := bson.D{{Key: keyID, Value: id}}
+		o := options.FindOne().SetAllowPartialResults(true).SetHint(indexID)
+		err := g.collection.FindOne(ctx, f, o).Decode(&v)
+
+		// Look up the task in the archive collection if it has been moved there.
+		// Time series collections do not have indexes on the ID field.
+		if err == mongo.ErrNoDocuments && g.archive != nil {
+			o := options.FindOne().SetAllowPartialResults(true)
+			err = g.archive.FindOne(ctx, f, o).Decode(&v)
 		}
-		return nil, err
-	}
-	return &v, nil
+		if err != nil {
+			if err == mongo.ErrNoDocuments {
+				err = ratus.ErrNotFound
+			}
+			return nil, err
+		}
+
+		return &v, nil
+	})
+}
+
+// GetTasks gets tasks by their unique IDs in the order of the IDs, skipping missing ones.
+func (g *Engine) GetTasks(ctx context.Context, ids []string) ([]*ratus.Task, error) {
+	return retry(ctx, g, func() ([]*ratus.Task, error) {
+		var vs []*ratus.Task
+		o := options.Find().SetAllowPartialResults(true).SetHint(indexID)
+		c, err := g.collection.Find(ctx, bson.D{{Key: keyID, Value: bson.D{{Key: "$in", Value: ids}}}}, o)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.All(ctx, &vs); err != nil {
+			return nil, err
+		}
+		m := make(map[string]*ratus.Task, len(vs))
+		for _, v := range vs {
+			m[v.ID] = v
+		}
+
+		// Look up the missing tasks in the archive collection in case they
+		// have been moved there.
+		if g.archive != nil && len(m) < len(ids) {
+			var missing []string
+			for _, id := range ids {
+				if _, ok := m[id]; !ok {
+					missing = append(missing, id)
+				}
+			}
+			o := options.Find().SetAllowPartialResults(true)
+			c, err := g.archive.Find(ctx, bson.D{{Key: keyID, Value: bson.D{{Key: "$in", Value: missing}}}}, o)
+			if err != nil {
+				return nil, err
+			}
+			var as []*ratus.Task
+			if err := c.All(ctx, &as); err != nil {
+				return nil, err
+			}
+			for _, v := range as {
+				m[v.ID] = v
+			}
+		}
+
+		// Restore the order of the IDs, which is not preserved by $in.
+		v := make([]*ratus.Task, 0, len(m))
+		for _, id := range ids {
+			if t, ok := m[id]; ok {
+				v = append(v, t)
+				delete(m, id)
+			}
+		}
+		return v, nil
+	})
 }
 
 // InsertTask inserts a new task.
 func (g *Engine) InsertTask(ctx context.Context, t *ratus.Task) (*ratus.Updated, error) {
-	if _, err := g.collection.InsertOne(ctx, t); err != nil {
+	t, err := g.compressTask(t)
+	if err != nil {
+		return nil, err
+	}
+	t = versioned([]*ratus.Task{t}, nil)[0]
+	if _, err := g.collection.InsertOne(ctx, g.document(t)); err != nil {
 		if mongo.IsDuplicateKeyError(err) {
 			err = ratus.ErrConflict
+			if t.Dedup != "" && !g.exists(ctx, bson.D{{Key: keyID, Value: t.ID}}, indexID) {
+				err = errDuplicated(t)
+			}
 		}
 		return nil, err
 	}
@@ -161,28 +566,50 @@ func (g *Engine) InsertTask(ctx context.Context, t *ratus.Task) (*ratus.Updated,
 	}, nil
 }
 
-// UpsertTask inserts or updates a task.
+// UpsertTask inserts or updates a task. If the version of the task is not
+// zero, the task is only updated if the version matches the current one.
 func (g *Engine) UpsertTask(ctx context.Context, t *ratus.Task) (*ratus.Updated, error) {
+	t, err := g.compressTask(t)
+	if err != nil {
+		return nil, err
+	}
 	return branch(func() (*ratus.Updated, error) {
 		return g.upsertTaskReplace(ctx, t)
 	}, func() (*ratus.Updated, error) {
-		return g.upsertTasksDeleteAndInsert(ctx, []*ratus.Task{t})
+		return g.upsertTasksDeleteAndInsert(ctx, []*ratus.Task{t}, true)
 	}, g.fallbackUpsertTask)
 }
 
 // upsertTaskReplace is the preferred implementation of UpsertTask.
 func (g *Engine) upsertTaskReplace(ctx context.Context, t *ratus.Task) (*ratus.Updated, error) {
 
-	// Perform replace operation with upsert enabled.
+	// Perform replace operation with upsert enabled, unless the update is
+	// conditional on the version of the task.
 	// This operation is expected to work only on unsharded collections and
 	// sharded collections using the ID field as the shard key.
 	f := bson.D{{Key: keyID, Value: t.ID}}
-	o := options.Replace().SetUpsert(true).SetHint(indexID)
-	r, err := g.collection.ReplaceOne(ctx, f, t, o)
+	o := options.Update().SetUpsert(true).SetHint(indexID)
+	if t.Version != 0 {
+		f = append(f, bson.E{Key: keyVersion, Value: t.Version})
+		o.SetUpsert(false)
+	}
+	r, err := g.collection.UpdateOne(ctx, f, updateOpsReplace(g.document(t)), o)
 	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			err = errDuplicated(t)
+		}
 		return nil, err
 	}
 
+	// Check if the failure is due to a mismatch of version or the target task
+	// does not exist.
+	if t.Version != 0 && r.MatchedCount == 0 {
+		if g.exists(ctx, bson.D{{Key: keyID, Value: t.ID}}, indexID) {
+			return nil, ratus.ErrConflict
+		}
+		return nil, ratus.ErrNotFound
+	}
+
 	return &ratus.Updated{
 		Created: r.UpsertedCount,
 		Updated: r.ModifiedCount,
@@ -191,13 +618,33 @@ func (g *Engine) upsertTaskReplace(ctx context.Context, t *ratus.Task) (*ratus.U
 
 // DeleteTask deletes a task by its unique ID.
 func (g *Engine) DeleteTask(ctx context.Context, id string) (*ratus.Deleted, error) {
-	f := bson.D{{Key: keyID, Value: id}}
-	o := options.Delete().SetHint(indexID)
-	r, err := g.collection.DeleteOne(ctx, f, o)
-	if err != nil {
-		return nil, err
+	return retry(ctx, g, func() (*ratus.Deleted, error) {
+		f := bson.D{{Key: keyID, Value: id}}
+		o := options.Delete().SetHint(indexID)
+		r, err := g.collection.DeleteOne(ctx, f, o)
+		if err != nil {
+			return nil, err
+		}
+		return &ratus.Deleted{
+			Deleted: r.DeletedCount,
+		}, nil
+	})
+}
+
+// versioned returns copies of the tasks with their versions incremented from
+// the current versions in the map. Tasks not in the map start from 1.
+func versioned(ts []*ratus.Task, m map[string]int64) []*ratus.Task {
+	v := make([]*ratus.Task, len(ts))
+	for i, t := range ts {
+		u := *t
+		u.Version = m[t.ID] + 1
+		v[i] = &u
 	}
-	return &ratus.Deleted{
-		Deleted: r.DeletedCount,
-	}, nil
+	return v
+}
+
+// errDuplicated returns an error wrapping ErrConflict indicating that the
+// deduplication key of the task is held by another task.
+func errDuplicated(t *ratus.Task) error {
+	return fmt.Errorf("%w: deduplication key %q is held by another task in topic %q", ratus.ErrConflict, t.Dedup, t.Topic)
 }
@@ -2,51 +2,104 @@ package mongodb
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 
 	"github.com/hyperonym/ratus"
+	"github.com/hyperonym/ratus/internal/engine"
 )
 
 // ListTopics lists all topics.
-func (g *Engine) ListTopics(ctx context.Context, limit, offset int) ([]*ratus.Topic, error) {
-
-	// Use aggregation rather than the distinct command to support pagination.
-	// This pipeline can use a DISTINCT_SCAN index plan that returns one
-	// document per index key value.
-	// https://www.mongodb.com/docs/v4.4/core/aggregation-pipeline-optimization/#indexes
-	// https://www.mongodb.com/docs/v4.4/reference/operator/aggregation/group/#optimization-to-return-the-first-document-of-each-group
-	p := mongo.Pipeline{
-		bson.D{{Key: "$group", Value: bson.D{{Key: keyID, Value: "$" + keyTopic}}}},
-		bson.D{{Key: "$skip", Value: offset}},
-		bson.D{{Key: "$limit", Value: limit}},
-	}
-	o := options.Aggregate().SetHint(indexTopic)
-	r, err := g.collection.Aggregate(ctx, p, o)
-	if err != nil {
-		return nil, err
-	}
+func (g *Engine) ListTopics(ctx context.Context, p *engine.Page) ([]*ratus.Topic, error) {
+	return retry(ctx, g, func() ([]*ratus.Topic, error) {
+		// Use aggregation rather than the distinct command to support pagination.
+		// This pipeline can use a DISTINCT_SCAN index plan on the index on
+		// topics and IDs that returns one document per topic, starting after
+		// the last topic seen.
+		// https://www.mongodb.com/docs/v4.4/core/aggregation-pipeline-optimization/#indexes
+		// https://www.mongodb.com/docs/v4.4/reference/operator/aggregation/group/#optimization-to-return-the-first-document-of-each-group
+		d, op := 1, "$gt"
+		if p.Desc {
+			d, op = -1, "$lt"
+		}
+		f := bson.D{}
+		if p.After != "" {
+			f = bson.D{{Key: keyTopic, Value: bson.D{{Key: op, Value: p.After}}}}
+		}
+		q := mongo.Pipeline{
+			bson.D{{Key: "$match", Value: f}},
+			bson.D{{Key: "$sort", Value: bson.D{{Key: keyTopic, Value: d}}}},
+			bson.D{{Key: "$group", Value: bson.D{{Key: keyID, Value: "$" + keyTopic}}}},
+			bson.D{{Key: "$sort", Value: bson.D{{Key: keyID, Value: d}}}},
+			bson.D{{Key: "$skip", Value: p.Offset}},
+			bson.D{{Key: "$limit", Value: p.Limit}},
+		}
+		o := options.Aggregate().SetHint(indexTopicID)
+		r, err := g.collection.Aggregate(ctx, q, o)
+		if err != nil {
+			return nil, err
+		}
 
-	// For performance reasons, the aggregated results do not include the
-	// number of tasks under each topic.
-	v := make([]*ratus.Topic, 0)
-	if err := r.All(ctx, &v); err != nil {
-		return nil, err
-	}
+		// For performance reasons, the aggregated results do not include the
+		// number of tasks under each topic.
+		v := make([]*ratus.Topic, 0)
+		if err := r.All(ctx, &v); err != nil {
+			return nil, err
+		}
+
+		return v, nil
+	})
+}
 
-	return v, nil
+// CountTopics counts all topics.
+func (g *Engine) CountTopics(ctx context.Context) (int64, error) {
+	return retry(ctx, g, func() (int64, error) {
+		// Count the groups of the same DISTINCT_SCAN plan used for listing.
+		q := mongo.Pipeline{
+			bson.D{{Key: "$sort", Value: bson.D{{Key: keyTopic, Value: 1}}}},
+			bson.D{{Key: "$group", Value: bson.D{{Key: keyID, Value: "$" + keyTopic}}}},
+			bson.D{{Key: "$count", Value: "count"}},
+		}
+		o := options.Aggregate().SetHint(indexTopicID)
+		r, err := g.collection.Aggregate(ctx, q, o)
+		if err != nil {
+			return 0, err
+		}
+		var v []struct {
+			Count int64 `bson:"count"`
+		}
+		if err := r.All(ctx, &v); err != nil {
+			return 0, err
+		}
+		if len(v) == 0 {
+			return 0, nil
+		}
+		return v[0].Count, nil
+	})
 }
 
 // DeleteTopics deletes all topics and tasks.
 func (g *Engine) DeleteTopics(ctx context.Context) (*ratus.Deleted, error) {
+	// Deletions are not retried, since tasks deleted by a partially applied
+	// attempt would be missing from the count of the next one.
 	f := bson.D{}
 	o := options.Delete().SetHint(indexID)
 	r, err := g.collection.DeleteMany(ctx, f, o)
 	if err != nil {
 		return nil, err
 	}
+	if _, err := g.topics.DeleteMany(ctx, f); err != nil {
+		return nil, err
+	}
+	g.cache.Range(func(k, _ any) bool {
+		g.cache.Delete(k)
+		return true
+	})
 
 	// Return the number of deleted tasks, not the number of deleted topics.
 	return &ratus.Deleted{
@@ -56,40 +109,243 @@ func (g *Engine) DeleteTopics(ctx context.Context) (*ratus.Deleted, error) {
 
 // GetTopic gets information about a topic.
 func (g *Engine) GetTopic(ctx context.Context, topic string) (*ratus.Topic, error) {
+	return retry(ctx, g, func() (*ratus.Topic, error) {
+		// Count the number of tasks in each state under the topic with a single
+		// aggregation pipeline rather than issuing multiple count queries.
+		p := mongo.Pipeline{
+			bson.D{{Key: "$match", Value: bson.D{{Key: keyTopic, Value: topic}}}},
+			bson.D{{Key: "$group", Value: bson.D{
+				{Key: keyID, Value: "$" + keyState},
+				{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+			}}},
+		}
+		o := options.Aggregate().SetHint(indexTopic)
+		r, err := g.collection.Aggregate(ctx, p, o)
+		if err != nil {
+			return nil, err
+		}
+		var v []struct {
+			State ratus.TaskState `bson:"_id"`
+			Count int64           `bson:"count"`
+		}
+		if err := r.All(ctx, &v); err != nil {
+			return nil, err
+		}
 
-	// Get the number of tasks under the topic.
-	f := bson.D{{Key: keyTopic, Value: topic}}
-	o := options.Count().SetHint(indexTopic)
-	n, err := g.collection.CountDocuments(ctx, f, o)
+		// Get the settings of the topic, if any, to be populated with the
+		// number of tasks.
+		var c ratus.Topic
+		err = g.topics.FindOne(ctx, bson.D{{Key: keyID, Value: topic}}).Decode(&c)
+		s := err == nil
+		if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, err
+		}
+		c.Name = topic
 
-	// Topics are not created manually, their existence depends entirely on
-	// whether there are tasks with the corresponding topic properties.
-	if err == nil && n == 0 {
-		err = ratus.ErrNotFound
-	}
-	if err != nil {
-		return nil, err
+		// Populate the total number of tasks and the number of tasks by state.
+		for _, x := range v {
+			c.Count += x.Count
+			switch x.State {
+			case ratus.TaskStatePending:
+				c.Pending = x.Count
+			case ratus.TaskStateActive:
+				c.Active = x.Count
+			case ratus.TaskStateCompleted:
+				c.Completed = x.Count
+			case ratus.TaskStateArchived:
+				c.Archived = x.Count
+			case ratus.TaskStateFailed:
+				c.Failed = x.Count
+			}
+		}
+
+		// Topics are not created manually, their existence depends entirely on
+		// whether there are tasks with the corresponding topic properties, or
+		// whether the settings of the topic have been specified.
+		if c.Count == 0 && !s {
+			return nil, ratus.ErrNotFound
+		}
+
+		return &c, nil
+	})
+}
+
+// GetTopicSettings gets the settings of a topic without counting its tasks, which are empty if not specified.
+func (g *Engine) GetTopicSettings(ctx context.Context, topic string) (*ratus.Topic, error) {
+	return retry(ctx, g, func() (*ratus.Topic, error) {
+		// Copy the cached settings so that callers can not modify the cache.
+		s, err := g.settings(ctx, topic)
+		if err != nil {
+			return nil, err
+		}
+		v := *s
+		v.Name = topic
+		return &v, nil
+	})
+}
+
+// UpsertTopic inserts or updates the settings of a topic.
+func (g *Engine) UpsertTopic(ctx context.Context, t *ratus.Topic) (*ratus.Updated, error) {
+	// The TTL index deletes tasks regardless of the settings of their topics,
+	// so longer retention periods would silently be ignored.
+	if g.expiring() && t.Retention != "" {
+		if p, err := time.ParseDuration(t.Retention); err == nil && p > g.config.RetentionPeriod {
+			return nil, fmt.Errorf("%w: retention period %s of topic exceeds the retention period %s of the storage engine", ratus.ErrBadRequest, p, g.config.RetentionPeriod)
+		}
 	}
+	return retry(ctx, g, func() (*ratus.Updated, error) {
+		// Only the settings are stored, the counters are computed on demand.
+		u := *t
+		u.Count = 0
+		u.Pending = 0
+		u.Active = 0
+		u.Completed = 0
+		u.Archived = 0
+		u.Failed = 0
 
-	// Currently the information of a topic only contains the name and count.
-	// Information such as progress and states could be added in the future.
-	return &ratus.Topic{
-		Name:  topic,
-		Count: n,
-	}, nil
+		f := bson.D{{Key: keyID, Value: t.Name}}
+		o := options.Replace().SetUpsert(true)
+		r, err := g.topics.ReplaceOne(ctx, f, &u, o)
+		if err != nil {
+			return nil, err
+		}
+		g.cache.Delete(t.Name)
+
+		return &ratus.Updated{
+			Created: r.UpsertedCount,
+			Updated: r.MatchedCount,
+		}, nil
+	})
 }
 
 // DeleteTopic deletes a topic and its tasks.
 func (g *Engine) DeleteTopic(ctx context.Context, topic string) (*ratus.Deleted, error) {
+	// Deletions are not retried, since tasks deleted by a partially applied
+	// attempt would be missing from the count of the next one.
 	f := bson.D{{Key: keyTopic, Value: topic}}
 	o := options.Delete().SetHint(indexTopic)
 	r, err := g.collection.DeleteMany(ctx, f, o)
 	if err != nil {
 		return nil, err
 	}
+	if _, err := g.topics.DeleteOne(ctx, bson.D{{Key: keyID, Value: topic}}); err != nil {
+		return nil, err
+	}
+	g.cache.Delete(topic)
 
 	// Return the number of deleted tasks, not the number of deleted topics.
 	return &ratus.Deleted{
 		Deleted: r.DeletedCount,
 	}, nil
 }
+
+// Stats returns statistics of tasks across all topics.
+func (g *Engine) Stats(ctx context.Context) (*ratus.Stats, error) {
+	return retry(ctx, g, func() (*ratus.Stats, error) {
+		// Count the number of tasks in each state under each topic with a
+		// single aggregation pipeline.
+		p := mongo.Pipeline{
+			bson.D{{Key: "$group", Value: bson.D{
+				{Key: keyID, Value: bson.D{{Key: keyTopic, Value: "$" + keyTopic}, {Key: keyState, Value: "$" + keyState}}},
+				{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+			}}},
+		}
+		r, err := g.collection.Aggregate(ctx, p)
+		if err != nil {
+			return nil, err
+		}
+		var v []struct {
+			ID struct {
+				Topic string          `bson:"topic"`
+				State ratus.TaskState `bson:"state"`
+			} `bson:"_id"`
+			Count int64 `bson:"count"`
+		}
+		if err := r.All(ctx, &v); err != nil {
+			return nil, err
+		}
+		m := make(map[string]*ratus.TopicStats)
+		for _, x := range v {
+			s, ok := m[x.ID.Topic]
+			if !ok {
+				s = &ratus.TopicStats{Name: x.ID.Topic}
+				m[x.ID.Topic] = s
+			}
+			s.Count += x.Count
+			switch x.ID.State {
+			case ratus.TaskStatePending:
+				s.Pending = x.Count
+			case ratus.TaskStateActive:
+				s.Active = x.Count
+			case ratus.TaskStateCompleted:
+				s.Completed = x.Count
+			case ratus.TaskStateArchived:
+				s.Archived = x.Count
+			case ratus.TaskStateFailed:
+				s.Failed = x.Count
+			}
+		}
+
+		// Find the oldest available pending task of each topic with the
+		// partial index on pending tasks.
+		p = mongo.Pipeline{
+			bson.D{{Key: "$match", Value: bson.D{
+				{Key: keyState, Value: ratus.TaskStatePending},
+				{Key: keyScheduled, Value: bson.D{{Key: "$lte", Value: g.clock.Now()}}},
+			}}},
+			bson.D{{Key: "$group", Value: bson.D{
+				{Key: keyID, Value: "$" + keyTopic},
+				{Key: "oldest", Value: bson.D{{Key: "$min", Value: "$" + keyScheduled}}},
+			}}},
+		}
+		o := options.Aggregate().SetHint(indexPendingTopicScheduled)
+		r, err = g.collection.Aggregate(ctx, p, o)
+		if err != nil {
+			return nil, err
+		}
+		var u []struct {
+			Topic  string    `bson:"_id"`
+			Oldest time.Time `bson:"oldest"`
+		}
+		if err := r.All(ctx, &u); err != nil {
+			return nil, err
+		}
+		for _, x := range u {
+			if s, ok := m[x.Topic]; ok {
+				s.Oldest = &x.Oldest
+			}
+		}
+
+		ts := make([]*ratus.TopicStats, 0, len(m))
+		for _, s := range m {
+			ts = append(ts, s)
+		}
+		return engine.SumStats(ts), nil
+	})
+}
+
+// cachedTopic is an entry in the cache of topic settings.
+type cachedTopic struct {
+	topic   *ratus.Topic
+	expires time.Time
+}
+
+// settings returns the settings of the topic, or an empty topic if the
+// settings have not been specified. Settings are cached for a short period to
+// avoid an extra round trip on every poll, so changes made through other
+// instances may take up to topicCacheTTL to take effect.
+func (g *Engine) settings(ctx context.Context, topic string) (*ratus.Topic, error) {
+	n := g.clock.Now()
+	if v, ok := g.cache.Load(topic); ok {
+		if c := v.(*cachedTopic); n.Before(c.expires) {
+			return c.topic, nil
+		}
+	}
+	var v ratus.Topic
+	err := g.topics.FindOne(ctx, bson.D{{Key: keyID, Value: topic}}).Decode(&v)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, err
+	}
+	g.cache.Store(topic, &cachedTopic{topic: &v, expires: n.Add(topicCacheTTL)})
+	return &v, nil
+}
@@ -3,53 +3,126 @@ package stub
 
 import (
 	"context"
+	"sync"
 	"time"
 
 	"github.com/hyperonym/ratus"
+	"github.com/hyperonym/ratus/internal/engine"
 	"github.com/hyperonym/ratus/internal/nonce"
 )
 
 // Canned data for testing.
 var (
-	cannedID      = "id"
-	cannedTopic   = "topic"
-	cannedDate    = time.Date(2022, time.July, 29, 20, 0, 0, 0, time.UTC)
-	cannedPayload = "payload"
+	cannedID       = "id"
+	cannedTopic    = "topic"
+	cannedConsumer = "consumer"
+	cannedDate     = time.Date(2022, time.July, 29, 20, 0, 0, 0, time.UTC)
+	cannedPayload  = "payload"
 )
 
 // Engine is a stub engine that returns canned data for testing.
 type Engine struct {
+
+	// Error returned by all methods without scripted responses.
 	Err error
+
+	mu        sync.Mutex
+	calls     []Call
+	responses map[string][]Response
+}
+
+// Call is a call to a method of the stub engine, with the arguments other than
+// the context in the order they were passed.
+type Call struct {
+	Method string
+	Args   []any
+}
+
+// Response is a scripted response of a method. The canned data is returned if
+// Value is nil, otherwise it must be of the result type of the method.
+type Response struct {
+	Value any
+	Err   error
+}
+
+// Script queues responses of the method, which are returned by its subsequent
+// calls in order before falling back to the canned data and Err. This allows
+// testing sequences such as a conflict followed by a success.
+func (g *Engine) Script(method string, rs ...Response) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.responses == nil {
+		g.responses = make(map[string][]Response)
+	}
+	g.responses[method] = append(g.responses[method], rs...)
+}
+
+// Calls returns the recorded calls to the method in the order they were made,
+// or the calls to all methods if the method is empty.
+func (g *Engine) Calls(method string) []Call {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var cs []Call
+	for _, c := range g.calls {
+		if method == "" || c.Method == method {
+			cs = append(cs, c)
+		}
+	}
+	return cs
+}
+
+// respond records a call to the method and returns the next scripted response
+// of the method, or a response with Err if none is left.
+func (g *Engine) respond(method string, args ...any) Response {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.calls = append(g.calls, Call{method, args})
+	rs := g.responses[method]
+	if len(rs) == 0 {
+		return Response{Err: g.Err}
+	}
+	g.responses[method] = rs[1:]
+	return rs[0]
+}
+
+// reply records a call to the method and returns the scripted value and error,
+// or the canned value if no value is scripted.
+func reply[T any](g *Engine, method string, v T, args ...any) (T, error) {
+	r := g.respond(method, args...)
+	if r.Value != nil {
+		v = r.Value.(T)
+	}
+	return v, r.Err
 }
 
 // Open or connect to the storage engine.
 func (g *Engine) Open(ctx context.Context) error {
-	return g.Err
+	return g.respond("Open").Err
 }
 
 // Close or disconnect from the storage engine.
 func (g *Engine) Close(ctx context.Context) error {
-	return g.Err
+	return g.respond("Close").Err
 }
 
 // Destroy clears all data and closes the storage engine.
 func (g *Engine) Destroy(ctx context.Context) error {
-	return g.Err
+	return g.respond("Destroy").Err
 }
 
 // Ready probes the storage engine and returns an error if it is not ready.
 func (g *Engine) Ready(ctx context.Context) error {
-	return g.Err
+	return g.respond("Ready").Err
 }
 
 // Chore recovers timed out tasks and deletes expired tasks.
-func (g *Engine) Chore(ctx context.Context) error {
-	return g.Err
+func (g *Engine) Chore(ctx context.Context) (*ratus.Chore, error) {
+	return reply(g, "Chore", &ratus.Chore{Recovered: 1, Recoveries: []*ratus.Recovery{{ID: "1", Topic: "topic"}}})
 }
 
 // Poll makes a promise to claim and execute the next available task in a topic.
 func (g *Engine) Poll(ctx context.Context, topic string, p *ratus.Promise) (*ratus.Task, error) {
-	return &ratus.Task{
+	return reply(g, "Poll", &ratus.Task{
 		ID:        cannedID,
 		Topic:     topic,
 		State:     ratus.TaskStateActive,
@@ -59,12 +132,17 @@ func (g *Engine) Poll(ctx context.Context, topic string, p *ratus.Promise) (*rat
 		Consumed:  &cannedDate,
 		Deadline:  p.Deadline,
 		Payload:   cannedPayload,
-	}, g.Err
+	}, topic, p)
+}
+
+// NextScheduled returns the scheduled time of the next pending task in a topic that is not yet available.
+func (g *Engine) NextScheduled(ctx context.Context, topic string) (*time.Time, error) {
+	return reply(g, "NextScheduled", &cannedDate, topic)
 }
 
 // Commit applies a set of updates to a task and returns the updated task.
 func (g *Engine) Commit(ctx context.Context, id string, m *ratus.Commit) (*ratus.Task, error) {
-	return &ratus.Task{
+	return reply(g, "Commit", &ratus.Task{
 		ID:        id,
 		Topic:     cannedTopic,
 		State:     ratus.TaskStateCompleted,
@@ -73,32 +151,96 @@ func (g *Engine) Commit(ctx context.Context, id string, m *ratus.Commit) (*ratus
 		Consumed:  &cannedDate,
 		Deadline:  &cannedDate,
 		Payload:   cannedPayload,
-	}, g.Err
+	}, id, m)
+}
+
+// UpdateProgress records the progress of an active task without changing its state, nonce or version.
+func (g *Engine) UpdateProgress(ctx context.Context, id string, p *ratus.Progress) (*ratus.Updated, error) {
+	return reply(g, "UpdateProgress", &ratus.Updated{Updated: 1}, id, p)
 }
 
 // ListTopics lists all topics.
-func (g *Engine) ListTopics(ctx context.Context, limit, offset int) ([]*ratus.Topic, error) {
-	return []*ratus.Topic{{Name: cannedTopic}}, g.Err
+func (g *Engine) ListTopics(ctx context.Context, p *engine.Page) ([]*ratus.Topic, error) {
+	return reply(g, "ListTopics", []*ratus.Topic{{Name: cannedTopic}}, p)
+}
+
+// CountTopics counts all topics.
+func (g *Engine) CountTopics(ctx context.Context) (int64, error) {
+	return reply(g, "CountTopics", int64(1))
 }
 
 // DeleteTopics deletes all topics and tasks.
 func (g *Engine) DeleteTopics(ctx context.Context) (*ratus.Deleted, error) {
-	return &ratus.Deleted{Deleted: 1}, g.Err
+	return reply(g, "DeleteTopics", &ratus.Deleted{Deleted: 1})
 }
 
 // GetTopic gets information about a topic.
 func (g *Engine) GetTopic(ctx context.Context, topic string) (*ratus.Topic, error) {
-	return &ratus.Topic{Name: cannedTopic, Count: 1}, g.Err
+	return reply(g, "GetTopic", &ratus.Topic{Name: cannedTopic, Count: 1, Pending: 1}, topic)
+}
+
+// GetTopicSettings gets the settings of a topic without counting its tasks, which are empty if not specified.
+func (g *Engine) GetTopicSettings(ctx context.Context, topic string) (*ratus.Topic, error) {
+	return reply(g, "GetTopicSettings", &ratus.Topic{Name: cannedTopic}, topic)
+}
+
+// UpsertTopic inserts or updates the settings of a topic.
+func (g *Engine) UpsertTopic(ctx context.Context, t *ratus.Topic) (*ratus.Updated, error) {
+	return reply(g, "UpsertTopic", &ratus.Updated{Updated: 1}, t)
 }
 
 // DeleteTopic deletes a topic and its tasks.
 func (g *Engine) DeleteTopic(ctx context.Context, topic string) (*ratus.Deleted, error) {
-	return &ratus.Deleted{Deleted: 1}, g.Err
+	return reply(g, "DeleteTopic", &ratus.Deleted{Deleted: 1}, topic)
+}
+
+// Stats returns statistics of tasks across all topics.
+func (g *Engine) Stats(ctx context.Context) (*ratus.Stats, error) {
+	return reply(g, "Stats", &ratus.Stats{Count: 1, Pending: 1, Topics: []*ratus.TopicStats{{Name: cannedTopic, Count: 1, Pending: 1, Oldest: &cannedDate}}})
+}
+
+// ListTasks lists all tasks in a topic that match the label selector.
+func (g *Engine) ListTasks(ctx context.Context, topic string, labels map[string]string, p *engine.Page) ([]*ratus.Task, error) {
+	return reply(g, "ListTasks", []*ratus.Task{{
+		ID:        cannedID,
+		Topic:     topic,
+		State:     ratus.TaskStatePending,
+		Produced:  &cannedDate,
+		Scheduled: &cannedDate,
+		Consumed:  &cannedDate,
+		Deadline:  &cannedDate,
+		Payload:   cannedPayload,
+	}}, topic, labels, p)
+}
+
+// ListArchive lists archived tasks in a topic consumed within the time range, in the order of their consumed time.
+func (g *Engine) ListArchive(ctx context.Context, topic string, from, to *time.Time, p *engine.Page) ([]*ratus.Task, error) {
+	return reply(g, "ListArchive", []*ratus.Task{{
+		ID:        cannedID,
+		Topic:     topic,
+		State:     ratus.TaskStateArchived,
+		Produced:  &cannedDate,
+		Scheduled: &cannedDate,
+		Consumed:  &cannedDate,
+		Payload:   cannedPayload,
+	}}, topic, from, to, p)
 }
 
-// ListTasks lists all tasks in a topic.
-func (g *Engine) ListTasks(ctx context.Context, topic string, limit, offset int) ([]*ratus.Task, error) {
-	return []*ratus.Task{{
+// StreamTasks calls the function with each task in a topic in the order of their IDs, stopping at the first error.
+func (g *Engine) StreamTasks(ctx context.Context, topic string, f func(*ratus.Task) error) error {
+	r := g.respond("StreamTasks", topic)
+	if r.Err != nil {
+		return r.Err
+	}
+	if ts, ok := r.Value.([]*ratus.Task); ok {
+		for _, t := range ts {
+			if err := f(t); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return f(&ratus.Task{
 		ID:        cannedID,
 		Topic:     topic,
 		State:     ratus.TaskStatePending,
@@ -107,77 +249,122 @@ func (g *Engine) ListTasks(ctx context.Context, topic string, limit, offset int)
 		Consumed:  &cannedDate,
 		Deadline:  &cannedDate,
 		Payload:   cannedPayload,
-	}}, g.Err
+	})
+}
+
+// CountTasks counts all tasks in a topic that match the labels.
+func (g *Engine) CountTasks(ctx context.Context, topic string, labels map[string]string) (int64, error) {
+	return reply(g, "CountTasks", int64(1), topic, labels)
+}
+
+// CountPending counts pending tasks of a producer in a topic, stopping at the limit if it is positive.
+func (g *Engine) CountPending(ctx context.Context, topic, producer string, limit int64) (int64, error) {
+	return reply(g, "CountPending", int64(1), topic, producer, limit)
+}
+
+// CountPendingTasks counts pending tasks in a topic, or in all topics if the topic is empty, stopping at the limit if it is positive.
+func (g *Engine) CountPendingTasks(ctx context.Context, topic string, limit int64) (int64, error) {
+	return reply(g, "CountPendingTasks", int64(1), topic, limit)
 }
 
 // InsertTasks inserts a batch of tasks while ignoring existing ones.
 func (g *Engine) InsertTasks(ctx context.Context, ts []*ratus.Task) (*ratus.Updated, error) {
-	return &ratus.Updated{Created: 1, Updated: 0}, g.Err
+	return reply(g, "InsertTasks", &ratus.Updated{Created: 1, Updated: 0}, ts)
 }
 
 // UpsertTasks inserts or updates a batch of tasks.
 func (g *Engine) UpsertTasks(ctx context.Context, ts []*ratus.Task) (*ratus.Updated, error) {
-	return &ratus.Updated{Created: 1, Updated: 1}, g.Err
+	return reply(g, "UpsertTasks", &ratus.Updated{Created: 1, Updated: 1}, ts)
+}
+
+// DeleteTasks deletes all tasks in a topic that match the label selector.
+func (g *Engine) DeleteTasks(ctx context.Context, topic string, labels map[string]string) (*ratus.Deleted, error) {
+	return reply(g, "DeleteTasks", &ratus.Deleted{Deleted: 1}, topic, labels)
 }
 
-// DeleteTasks deletes all tasks in a topic.
-func (g *Engine) DeleteTasks(ctx context.Context, topic string) (*ratus.Deleted, error) {
-	return &ratus.Deleted{Deleted: 1}, g.Err
+// MoveTasks moves tasks in a topic that match the filters to another topic.
+func (g *Engine) MoveTasks(ctx context.Context, topic string, m *ratus.Move) (*ratus.Updated, error) {
+	return reply(g, "MoveTasks", &ratus.Updated{Created: 0, Updated: 1}, topic, m)
 }
 
 // GetTask gets a task by its unique ID.
 func (g *Engine) GetTask(ctx context.Context, id string) (*ratus.Task, error) {
-	return &ratus.Task{
+	return reply(g, "GetTask", &ratus.Task{
 		ID:        id,
 		Topic:     cannedTopic,
 		State:     ratus.TaskStatePending,
+		Nonce:     nonce.Generate(ratus.NonceLength),
+		Version:   1,
 		Produced:  &cannedDate,
 		Scheduled: &cannedDate,
 		Consumed:  &cannedDate,
 		Deadline:  &cannedDate,
 		Payload:   cannedPayload,
-	}, g.Err
+		History:   []*ratus.Transition{{State: ratus.TaskStatePending, Time: &cannedDate}},
+	}, id)
+}
+
+// GetTasks gets tasks by their unique IDs in the order of the IDs, skipping missing ones.
+func (g *Engine) GetTasks(ctx context.Context, ids []string) ([]*ratus.Task, error) {
+	v := make([]*ratus.Task, len(ids))
+	for i, id := range ids {
+		v[i] = &ratus.Task{
+			ID:        id,
+			Topic:     cannedTopic,
+			State:     ratus.TaskStatePending,
+			Version:   1,
+			Produced:  &cannedDate,
+			Scheduled: &cannedDate,
+			Payload:   cannedPayload,
+		}
+	}
+	return reply(g, "GetTasks", v, ids)
 }
 
 // InsertTask inserts a new task.
 func (g *Engine) InsertTask(ctx context.Context, t *ratus.Task) (*ratus.Updated, error) {
-	return &ratus.Updated{Created: 1, Updated: 0}, g.Err
+	return reply(g, "InsertTask", &ratus.Updated{Created: 1, Updated: 0}, t)
 }
 
 // UpsertTask inserts or updates a task.
 func (g *Engine) UpsertTask(ctx context.Context, t *ratus.Task) (*ratus.Updated, error) {
-	return &ratus.Updated{Created: 0, Updated: 1}, g.Err
+	return reply(g, "UpsertTask", &ratus.Updated{Created: 0, Updated: 1}, t)
 }
 
 // DeleteTask deletes a task by its unique ID.
 func (g *Engine) DeleteTask(ctx context.Context, id string) (*ratus.Deleted, error) {
-	return &ratus.Deleted{Deleted: 1}, g.Err
+	return reply(g, "DeleteTask", &ratus.Deleted{Deleted: 1}, id)
 }
 
 // ListPromises lists all promises in a topic.
-func (g *Engine) ListPromises(ctx context.Context, topic string, limit, offset int) ([]*ratus.Promise, error) {
-	return []*ratus.Promise{{
+func (g *Engine) ListPromises(ctx context.Context, topic string, p *engine.Page) ([]*ratus.Promise, error) {
+	return reply(g, "ListPromises", []*ratus.Promise{{
 		ID:       cannedID,
 		Deadline: &cannedDate,
-	}}, g.Err
+	}}, topic, p)
+}
+
+// CountPromises counts all promises in a topic.
+func (g *Engine) CountPromises(ctx context.Context, topic string) (int64, error) {
+	return reply(g, "CountPromises", int64(1), topic)
 }
 
 // DeletePromises deletes all promises in a topic.
 func (g *Engine) DeletePromises(ctx context.Context, topic string) (*ratus.Deleted, error) {
-	return &ratus.Deleted{Deleted: 1}, g.Err
+	return reply(g, "DeletePromises", &ratus.Deleted{Deleted: 1}, topic)
 }
 
 // GetPromise gets a promise by the unique ID of its target task.
 func (g *Engine) GetPromise(ctx context.Context, id string) (*ratus.Promise, error) {
-	return &ratus.Promise{
+	return reply(g, "GetPromise", &ratus.Promise{
 		ID:       id,
 		Deadline: &cannedDate,
-	}, g.Err
+	}, id)
 }
 
 // InsertPromise makes a promise to claim and execute a task if it is in pending state.
 func (g *Engine) InsertPromise(ctx context.Context, p *ratus.Promise) (*ratus.Task, error) {
-	return &ratus.Task{
+	return reply(g, "InsertPromise", &ratus.Task{
 		ID:        cannedID,
 		Topic:     cannedTopic,
 		State:     ratus.TaskStateActive,
@@ -187,12 +374,12 @@ func (g *Engine) InsertPromise(ctx context.Context, p *ratus.Promise) (*ratus.Ta
 		Consumed:  &cannedDate,
 		Deadline:  &cannedDate,
 		Payload:   cannedPayload,
-	}, g.Err
+	}, p)
 }
 
 // UpsertPromise makes a promise to claim and execute a task regardless of its current state.
 func (g *Engine) UpsertPromise(ctx context.Context, p *ratus.Promise) (*ratus.Task, error) {
-	return &ratus.Task{
+	return reply(g, "UpsertPromise", &ratus.Task{
 		ID:        cannedID,
 		Topic:     cannedTopic,
 		State:     ratus.TaskStateActive,
@@ -202,10 +389,38 @@ func (g *Engine) UpsertPromise(ctx context.Context, p *ratus.Promise) (*ratus.Ta
 		Consumed:  &cannedDate,
 		Deadline:  &cannedDate,
 		Payload:   cannedPayload,
-	}, g.Err
+	}, p)
+}
+
+// StealPromise transfers the promise of an active task to another consumer, invalidating the previous one.
+func (g *Engine) StealPromise(ctx context.Context, p *ratus.Promise) (*ratus.Task, error) {
+	return reply(g, "StealPromise", &ratus.Task{
+		ID:        cannedID,
+		Topic:     cannedTopic,
+		State:     ratus.TaskStateActive,
+		Nonce:     nonce.Generate(ratus.NonceLength),
+		Produced:  &cannedDate,
+		Scheduled: &cannedDate,
+		Consumed:  &cannedDate,
+		Deadline:  &cannedDate,
+		Payload:   cannedPayload,
+	}, p)
 }
 
 // DeletePromise deletes a promise by the unique ID of its target task.
 func (g *Engine) DeletePromise(ctx context.Context, id string) (*ratus.Deleted, error) {
-	return &ratus.Deleted{Deleted: 1}, g.Err
+	return reply(g, "DeletePromise", &ratus.Deleted{Deleted: 1}, id)
+}
+
+// ListConsumers lists the consumers of active tasks in all topics along with their promises.
+func (g *Engine) ListConsumers(ctx context.Context) ([]*ratus.Consumer, error) {
+	return reply(g, "ListConsumers", []*ratus.Consumer{{
+		Name: cannedConsumer,
+		Seen: &cannedDate,
+		Promises: []*ratus.Promise{{
+			ID:       cannedID,
+			Consumer: cannedConsumer,
+			Deadline: &cannedDate,
+		}},
+	}})
 }
@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	"github.com/hyperonym/ratus"
+	"github.com/hyperonym/ratus/internal/engine"
 	"github.com/hyperonym/ratus/internal/engine/stub"
 )
 
@@ -20,34 +21,41 @@ func TestStub(t *testing.T) {
 		p := x
 		t.Run(p.name, func(t *testing.T) {
 			t.Parallel()
-			g := stub.Engine{p.err}
+			g := stub.Engine{Err: p.err}
 			ctx := context.Background()
 			for _, f := range []func() (any, error){
 				func() (any, error) { return nil, g.Open(ctx) },
 				func() (any, error) { return nil, g.Close(ctx) },
 				func() (any, error) { return nil, g.Destroy(ctx) },
 				func() (any, error) { return nil, g.Ready(ctx) },
-				func() (any, error) { return nil, g.Chore(ctx) },
+				func() (any, error) { return g.Chore(ctx) },
 				func() (any, error) { return g.Poll(ctx, "id", &ratus.Promise{}) },
 				func() (any, error) { return g.Commit(ctx, "id", &ratus.Commit{}) },
-				func() (any, error) { return g.ListTopics(ctx, 10, 0) },
+				func() (any, error) { return g.ListTopics(ctx, &engine.Page{Limit: 10}) },
+				func() (any, error) { return g.CountTopics(ctx) },
 				func() (any, error) { return g.DeleteTopics(ctx) },
 				func() (any, error) { return g.GetTopic(ctx, "topic") },
+				func() (any, error) { return g.UpsertTopic(ctx, &ratus.Topic{Name: "topic"}) },
 				func() (any, error) { return g.DeleteTopic(ctx, "topic") },
-				func() (any, error) { return g.ListTasks(ctx, "topic", 10, 0) },
+				func() (any, error) { return g.ListTasks(ctx, "topic", nil, &engine.Page{Limit: 10}) },
+				func() (any, error) { return g.CountTasks(ctx, "topic", nil) },
+				func() (any, error) { return g.CountPending(ctx, "topic", "producer", 0) },
+				func() (any, error) { return g.MoveTasks(ctx, "topic", &ratus.Move{Topic: "other"}) },
 				func() (any, error) { return g.InsertTasks(ctx, make([]*ratus.Task, 0)) },
 				func() (any, error) { return g.UpsertTasks(ctx, make([]*ratus.Task, 0)) },
-				func() (any, error) { return g.DeleteTasks(ctx, "topic") },
+				func() (any, error) { return g.DeleteTasks(ctx, "topic", nil) },
 				func() (any, error) { return g.GetTask(ctx, "id") },
 				func() (any, error) { return g.InsertTask(ctx, &ratus.Task{}) },
 				func() (any, error) { return g.UpsertTask(ctx, &ratus.Task{}) },
 				func() (any, error) { return g.DeleteTask(ctx, "id") },
-				func() (any, error) { return g.ListPromises(ctx, "topic", 10, 0) },
+				func() (any, error) { return g.ListPromises(ctx, "topic", &engine.Page{Limit: 10}) },
+				func() (any, error) { return g.CountPromises(ctx, "topic") },
 				func() (any, error) { return g.DeletePromises(ctx, "topic") },
 				func() (any, error) { return g.GetPromise(ctx, "id") },
 				func() (any, error) { return g.InsertPromise(ctx, &ratus.Promise{}) },
 				func() (any, error) { return g.UpsertPromise(ctx, &ratus.Promise{}) },
 				func() (any, error) { return g.DeletePromise(ctx, "id") },
+				func() (any, error) { return g.ListConsumers(ctx) },
 			} {
 				if _, err := f(); !errors.Is(err, p.err) {
 					t.Fail()
@@ -56,3 +64,57 @@ func TestStub(t *testing.T) {
 		})
 	}
 }
+
+func TestScript(t *testing.T) {
+	ctx := context.Background()
+	g := stub.Engine{Err: ratus.ErrServiceUnavailable}
+	g.Script("Commit",
+		stub.Response{Err: ratus.ErrConflict},
+		stub.Response{Value: &ratus.Task{ID: "scripted"}},
+	)
+
+	// Scripted responses are returned in order before falling back to Err.
+	if _, err := g.Commit(ctx, "1", &ratus.Commit{}); !errors.Is(err, ratus.ErrConflict) {
+		t.Errorf("incorrect error, expected %v, got %v", ratus.ErrConflict, err)
+	}
+	v, err := g.Commit(ctx, "2", &ratus.Commit{})
+	if err != nil {
+		t.Error(err)
+	}
+	if v.ID != "scripted" {
+		t.Errorf("incorrect task ID, expected scripted, got %q", v.ID)
+	}
+	if _, err := g.Commit(ctx, "3", &ratus.Commit{}); !errors.Is(err, ratus.ErrServiceUnavailable) {
+		t.Errorf("incorrect error, expected %v, got %v", ratus.ErrServiceUnavailable, err)
+	}
+
+	// Scripted errors without values are returned along with the canned data.
+	g.Script("CountTasks", stub.Response{})
+	if n, err := g.CountTasks(ctx, "topic", nil); err != nil || n != 1 {
+		t.Errorf("incorrect count, expected 1, got %d (%v)", n, err)
+	}
+
+	g.Script("StreamTasks", stub.Response{Value: []*ratus.Task{{ID: "1"}, {ID: "2"}}})
+	var ids []string
+	if err := g.StreamTasks(ctx, "topic", func(v *ratus.Task) error {
+		ids = append(ids, v.ID)
+		return nil
+	}); err != nil {
+		t.Error(err)
+	}
+	if len(ids) != 2 {
+		t.Errorf("incorrect number of streamed tasks, expected 2, got %d", len(ids))
+	}
+
+	// Calls are recorded with their arguments other than the context.
+	cs := g.Calls("Commit")
+	if len(cs) != 3 {
+		t.Fatalf("incorrect number of calls, expected 3, got %d", len(cs))
+	}
+	if id := cs[1].Args[0]; id != "2" {
+		t.Errorf("incorrect argument, expected 2, got %v", id)
+	}
+	if n := len(g.Calls("")); n != 5 {
+		t.Errorf("incorrect number of calls, expected 5, got %d", n)
+	}
+}
@@ -6,6 +6,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -19,9 +22,9 @@ import (
 // Test runs a collection of test cases that are grouped for testing storage
 // engine implementations. The test suite handles the initialization of the
 // provided engine instance, and clears all data when the test is completed.
-// This test suite only covers the core functionality of a storage engine
-// implementation. Test cases for optional features like TTL should be included
-// in the package of the specific engine.
+// Test cases for optional features are only run if the storage engine declares
+// support for them through the Capabilities interface, other engine-specific
+// features should be tested in the package of the specific engine.
 func Test(t *testing.T, g Engine) {
 	ctx := context.Background()
 	if err := g.Ready(ctx); !errors.Is(err, ratus.ErrServiceUnavailable) {
@@ -43,7 +46,7 @@ func Test(t *testing.T, g Engine) {
 	t.Run("blank", func(t *testing.T) {
 		t.Run("chore", func(t *testing.T) {
 			t.Parallel()
-			if err := g.Chore(ctx); err != nil {
+			if _, err := g.Chore(ctx); err != nil {
 				t.Error()
 			}
 		})
@@ -64,7 +67,7 @@ func Test(t *testing.T, g Engine) {
 
 		t.Run("topic", func(t *testing.T) {
 			t.Parallel()
-			v, err := g.ListTopics(ctx, 10, 0)
+			v, err := g.ListTopics(ctx, &Page{Limit: 10})
 			if err != nil {
 				t.Error(err)
 			}
@@ -92,7 +95,7 @@ func Test(t *testing.T, g Engine) {
 
 		t.Run("task", func(t *testing.T) {
 			t.Parallel()
-			v, err := g.ListTasks(ctx, "test", 10, 0)
+			v, err := g.ListTasks(ctx, "test", nil, &Page{Limit: 10})
 			if err != nil {
 				t.Error(err)
 			}
@@ -102,6 +105,9 @@ func Test(t *testing.T, g Engine) {
 			if _, err := g.GetTask(ctx, "foo"); !errors.Is(err, ratus.ErrNotFound) {
 				t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrNotFound, err)
 			}
+			if vs, err := g.GetTasks(ctx, []string{"foo"}); err != nil || len(vs) != 0 {
+				t.Errorf("expected no tasks, got %v (%v)", vs, err)
+			}
 			d, err := g.DeleteTask(ctx, "foo")
 			if err != nil {
 				t.Error(err)
@@ -109,7 +115,7 @@ func Test(t *testing.T, g Engine) {
 			if d.Deleted != 0 {
 				t.Errorf("incorrect number of deletions, expected 0, got %d", d.Deleted)
 			}
-			d, err = g.DeleteTasks(ctx, "test")
+			d, err = g.DeleteTasks(ctx, "test", nil)
 			if err != nil {
 				t.Error(err)
 			}
@@ -120,7 +126,7 @@ func Test(t *testing.T, g Engine) {
 
 		t.Run("promise", func(t *testing.T) {
 			t.Parallel()
-			v, err := g.ListPromises(ctx, "test", 10, 0)
+			v, err := g.ListPromises(ctx, "test", &Page{Limit: 10})
 			if err != nil {
 				t.Error(err)
 			}
@@ -204,6 +210,15 @@ func Test(t *testing.T, g Engine) {
 			if fmt.Sprint(v.Payload) != "a" {
 				t.Errorf("incorrect payload in task, expected %q, got %q", "a", v.Payload)
 			}
+			vs, err := g.GetTasks(ctx, []string{"2", "foo", "1"})
+			if err != nil {
+				t.Error(err)
+			}
+			if len(vs) != 2 || vs[0].ID != "2" || vs[1].ID != "1" {
+				t.Errorf("incorrect tasks, expected IDs 2 and 1 in order, got %v", vs)
+			} else if fmt.Sprint(vs[1].Payload) != "a" {
+				t.Errorf("incorrect payload in task, expected %q, got %q", "a", vs[1].Payload)
+			}
 			c, err := g.GetTopic(ctx, "test")
 			if err != nil {
 				t.Error(err)
@@ -211,9 +226,18 @@ func Test(t *testing.T, g Engine) {
 			if c.Count != 2 {
 				t.Errorf("incorrect number of results, expected 2, got %d", c.Count)
 			}
+			if c.Pending != 2 {
+				t.Errorf("incorrect number of pending tasks, expected 2, got %d", c.Pending)
+			}
 		})
 
 		t.Run("promise", func(t *testing.T) {
+			if _, err := g.StealPromise(ctx, &ratus.Promise{
+				ID:       "1",
+				Deadline: &n,
+			}); !errors.Is(err, ratus.ErrConflict) {
+				t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrConflict, err)
+			}
 			v, err := g.InsertPromise(ctx, &ratus.Promise{
 				ID:       "1",
 				Deadline: &n,
@@ -266,11 +290,40 @@ func Test(t *testing.T, g Engine) {
 			if n.Unix() != p.Deadline.Unix() {
 				t.Errorf("incorrect promise deadline, expected %v, got %v", n.Unix(), p.Deadline.Unix())
 			}
+			s, err := g.StealPromise(ctx, &ratus.Promise{
+				ID:       "2",
+				Consumer: "thief",
+				Deadline: &n,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.State != ratus.TaskStateActive || s.Consumer != "thief" || s.Nonce == "" || s.Nonce == v.Nonce {
+				t.Errorf("incorrect stolen task, expected a new nonce for %q, got %+v", "thief", s)
+			}
+			if _, err := g.Commit(ctx, "2", &ratus.Commit{Nonce: v.Nonce}); !errors.Is(err, ratus.ErrConflict) {
+				t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrConflict, err)
+			}
+			if _, err := g.StealPromise(ctx, &ratus.Promise{
+				ID:       "xxx",
+				Deadline: &n,
+			}); !errors.Is(err, ratus.ErrNotFound) {
+				t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrNotFound, err)
+			}
 		})
 
 		t.Run("chore", func(t *testing.T) {
-			if err := g.Chore(ctx); err != nil {
-				t.Error(err)
+			v, err := g.Chore(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v.Recovered != 2 || len(v.Recoveries) != 2 {
+				t.Errorf("incorrect number of recovered tasks, expected 2, got %d and %d", v.Recovered, len(v.Recoveries))
+			}
+			for _, r := range v.Recoveries {
+				if r.Topic != "test" || r.Deadline == nil || r.Deadline.Unix() != n.Unix() {
+					t.Errorf("incorrect recovery, expected topic %q with deadline %v, got %+v", "test", n.Unix(), r)
+				}
 			}
 			if _, err := g.GetPromise(ctx, "1"); !errors.Is(err, ratus.ErrNotFound) {
 				t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrNotFound, err)
@@ -284,7 +337,7 @@ func Test(t *testing.T, g Engine) {
 			if _, err := g.Poll(ctx, "test", &ratus.Promise{Deadline: &n}); err != nil {
 				t.Error(err)
 			}
-			v, err := g.ListPromises(ctx, "test", 10, 0)
+			v, err := g.ListPromises(ctx, "test", &Page{Limit: 10})
 			if err != nil {
 				t.Error(err)
 			}
@@ -293,6 +346,32 @@ func Test(t *testing.T, g Engine) {
 			}
 		})
 
+		t.Run("progress", func(t *testing.T) {
+			if _, err := g.UpdateProgress(ctx, "1", &ratus.Progress{Nonce: "xxx", Percent: 50}); !errors.Is(err, ratus.ErrConflict) {
+				t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrConflict, err)
+			}
+			if _, err := g.UpdateProgress(ctx, "xxx", &ratus.Progress{Percent: 50}); !errors.Is(err, ratus.ErrNotFound) {
+				t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrNotFound, err)
+			}
+			v, err := g.GetTask(ctx, "1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := g.UpdateProgress(ctx, "1", &ratus.Progress{Nonce: v.Nonce, Percent: 50, Message: "halfway", Time: &n}); err != nil {
+				t.Error(err)
+			}
+			u, err := g.GetTask(ctx, "1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if u.Progress == nil || u.Progress.Percent != 50 || u.Progress.Message != "halfway" || u.Progress.Nonce != "" {
+				t.Errorf("incorrect progress, expected 50 percent, got %+v", u.Progress)
+			}
+			if u.State != v.State || u.Nonce != v.Nonce || u.Version != v.Version {
+				t.Errorf("incorrect task after reporting progress, expected %+v, got %+v", v, u)
+			}
+		})
+
 		t.Run("commit", func(t *testing.T) {
 			if _, err := g.Commit(ctx, "1", &ratus.Commit{Nonce: "xxx"}); !errors.Is(err, ratus.ErrConflict) {
 				t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrConflict, err)
@@ -304,13 +383,18 @@ func Test(t *testing.T, g Engine) {
 			if err != nil {
 				t.Error(err)
 			}
+			if _, err := g.Commit(ctx, "1", &ratus.Commit{Nonce: v.Nonce, Consumer: v.Consumer + "x"}); !errors.Is(err, ratus.ErrConflict) {
+				t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrConflict, err)
+			}
 			s := ratus.TaskStateCompleted
 			m := &ratus.Commit{
 				Nonce:     v.Nonce,
+				Consumer:  v.Consumer,
 				Topic:     "completed",
 				State:     &s,
 				Scheduled: &n,
 				Payload:   "completed",
+				Result:    "result",
 			}
 			v, err = g.Commit(ctx, "1", m)
 			if err != nil {
@@ -319,19 +403,39 @@ func Test(t *testing.T, g Engine) {
 			if fmt.Sprint(v.Payload) != "completed" {
 				t.Errorf("incorrect payload in task, expected %q, got %q", "completed", v.Payload)
 			}
+			if fmt.Sprint(v.Result) != "result" {
+				t.Errorf("incorrect result in task, expected %q, got %q", "result", v.Result)
+			}
 			if _, err := g.Commit(ctx, "1", m); err == nil {
 				t.Error("failed to invalidate duplicated commits")
 			}
+			if _, err := g.UpdateProgress(ctx, "1", &ratus.Progress{Percent: 100}); !errors.Is(err, ratus.ErrConflict) {
+				t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrConflict, err)
+			}
 		})
 
 		t.Run("topic", func(t *testing.T) {
-			v, err := g.ListTopics(ctx, 10, 0)
+			v, err := g.ListTopics(ctx, &Page{Limit: 10})
 			if err != nil {
 				t.Error(err)
 			}
 			if len(v) != 2 {
 				t.Errorf("incorrect number of results, expected 2, got %d", len(v))
 			}
+			c, err := g.GetTopic(ctx, "test")
+			if err != nil {
+				t.Error(err)
+			}
+			if c.Count != 1 || c.Active != 1 || c.Pending+c.Completed+c.Archived != 0 {
+				t.Errorf("incorrect topic statistics, expected 1 active task, got %+v", c)
+			}
+			c, err = g.GetTopic(ctx, "completed")
+			if err != nil {
+				t.Error(err)
+			}
+			if c.Count != 1 || c.Completed != 1 || c.Pending+c.Active+c.Archived != 0 {
+				t.Errorf("incorrect topic statistics, expected 1 completed task, got %+v", c)
+			}
 			d, err := g.DeleteTopic(ctx, "completed")
 			if err != nil {
 				t.Error(err)
@@ -382,7 +486,7 @@ func Test(t *testing.T, g Engine) {
 				if err := eg.Wait(); !errors.Is(err, ratus.ErrConflict) {
 					t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrConflict, err)
 				}
-				v, err := g.ListTasks(ctx, "test", 10, 0)
+				v, err := g.ListTasks(ctx, "test", nil, &Page{Limit: 10})
 				if err != nil {
 					t.Error(err)
 				}
@@ -416,14 +520,14 @@ func Test(t *testing.T, g Engine) {
 				if err := eg.Wait(); err != nil {
 					t.Error(err)
 				}
-				v, err := g.ListTasks(ctx, "test", 10, 0)
+				v, err := g.ListTasks(ctx, "test", nil, &Page{Limit: 10})
 				if err != nil {
 					t.Error(err)
 				}
 				if len(v) != 1 {
 					t.Errorf("incorrect number of results, expected 1, got %d", len(v))
 				}
-				d, err := g.DeleteTasks(ctx, "test")
+				d, err := g.DeleteTasks(ctx, "test", nil)
 				if err != nil {
 					t.Error(err)
 				}
@@ -469,7 +573,7 @@ func Test(t *testing.T, g Engine) {
 				if a.Load() != 2 {
 					t.Errorf("incorrect number of creations, expected 2, got %d", a.Load())
 				}
-				v, err := g.ListTasks(ctx, "test", 10, 0)
+				v, err := g.ListTasks(ctx, "test", nil, &Page{Limit: 10})
 				if err != nil {
 					t.Error(err)
 				}
@@ -513,7 +617,7 @@ func Test(t *testing.T, g Engine) {
 				if err := eg.Wait(); err != nil {
 					t.Error(err)
 				}
-				v, err := g.ListTasks(ctx, "test", 10, 0)
+				v, err := g.ListTasks(ctx, "test", nil, &Page{Limit: 10})
 				if err != nil {
 					t.Error(err)
 				}
@@ -644,7 +748,7 @@ func Test(t *testing.T, g Engine) {
 				if v.State != ratus.TaskStatePending {
 					t.Errorf("incorrect task state, expected %d, got %d", ratus.TaskStatePending, v.State)
 				}
-				d, err = g.DeleteTasks(ctx, "test")
+				d, err = g.DeleteTasks(ctx, "test", nil)
 				if err != nil {
 					t.Error(err)
 				}
@@ -686,17 +790,17 @@ func Test(t *testing.T, g Engine) {
 			if err := eg.Wait(); !errors.Is(err, ratus.ErrNotFound) {
 				t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrNotFound, err)
 			}
-			v, err := g.ListPromises(ctx, "test", 10, 0)
+			v, err := g.ListPromises(ctx, "test", &Page{Limit: 10})
 			if err != nil {
 				t.Error(err)
 			}
 			if len(v) != 2 {
 				t.Errorf("incorrect number of results, expected 2, got %d", len(v))
 			}
-			if err := g.Chore(ctx); err != nil {
+			if _, err := g.Chore(ctx); err != nil {
 				t.Error(err)
 			}
-			v, err = g.ListPromises(ctx, "test", 10, 0)
+			v, err = g.ListPromises(ctx, "test", &Page{Limit: 10})
 			if err != nil {
 				t.Error(err)
 			}
@@ -753,7 +857,7 @@ func Test(t *testing.T, g Engine) {
 			if fmt.Sprint(v.Payload) != "archived" {
 				t.Errorf("incorrect payload in task, expected %q, got %q", "archived", v.Payload)
 			}
-			d, err := g.DeleteTasks(ctx, "archived")
+			d, err := g.DeleteTasks(ctx, "archived", nil)
 			if err != nil {
 				t.Error(err)
 			}
@@ -800,6 +904,9 @@ func Test(t *testing.T, g Engine) {
 		}
 
 		t.Run("poll", func(t *testing.T) {
+			if _, err := g.Poll(ctx, "a", &ratus.Promise{Deadline: &n1}); !errors.Is(err, ratus.ErrNotFound) {
+				t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrNotFound, err)
+			}
 			v, err := g.Poll(ctx, "test", &ratus.Promise{Deadline: &n1})
 			if err != nil {
 				t.Error(err)
@@ -810,6 +917,16 @@ func Test(t *testing.T, g Engine) {
 			if _, err := g.Poll(ctx, "test", &ratus.Promise{Deadline: &n1}); !errors.Is(err, ratus.ErrNotFound) {
 				t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrNotFound, err)
 			}
+			s, err := g.NextScheduled(ctx, "test")
+			if err != nil {
+				t.Error(err)
+			}
+			if s == nil || s.UnixMilli() != n1.UnixMilli() {
+				t.Errorf("incorrect next scheduled time, expected %v, got %v", n1, s)
+			}
+			if _, err := g.NextScheduled(ctx, "xxx"); !errors.Is(err, ratus.ErrNotFound) {
+				t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrNotFound, err)
+			}
 			time.Sleep(100 * time.Millisecond)
 			v, err = g.Poll(ctx, "test", &ratus.Promise{Deadline: &n2})
 			if err != nil {
@@ -818,6 +935,9 @@ func Test(t *testing.T, g Engine) {
 			if v.ID != "2" {
 				t.Errorf("incorrect task order, expected %q, got %q", "2", v.ID)
 			}
+			if _, err := g.NextScheduled(ctx, "test"); !errors.Is(err, ratus.ErrNotFound) {
+				t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrNotFound, err)
+			}
 		})
 
 		t.Run("clean", func(t *testing.T) {
@@ -872,14 +992,14 @@ func Test(t *testing.T, g Engine) {
 		}
 
 		t.Run("topic", func(t *testing.T) {
-			v, err := g.ListTopics(ctx, 1, 1)
+			v, err := g.ListTopics(ctx, &Page{Limit: 1, Offset: 1})
 			if err != nil {
 				t.Error(err)
 			}
 			if len(v) != 1 {
 				t.Errorf("incorrect number of results, expected 1, got %d", len(v))
 			}
-			v, err = g.ListTopics(ctx, 10, 10)
+			v, err = g.ListTopics(ctx, &Page{Limit: 10, Offset: 10})
 			if err != nil {
 				t.Error(err)
 			}
@@ -889,14 +1009,14 @@ func Test(t *testing.T, g Engine) {
 		})
 
 		t.Run("task", func(t *testing.T) {
-			v, err := g.ListTasks(ctx, "c", 1, 1)
+			v, err := g.ListTasks(ctx, "c", nil, &Page{Limit: 1, Offset: 1})
 			if err != nil {
 				t.Error(err)
 			}
 			if len(v) != 1 {
 				t.Errorf("incorrect number of results, expected 1, got %d", len(v))
 			}
-			v, err = g.ListTasks(ctx, "c", 10, 10)
+			v, err = g.ListTasks(ctx, "c", nil, &Page{Limit: 10, Offset: 10})
 			if err != nil {
 				t.Error(err)
 			}
@@ -905,21 +1025,85 @@ func Test(t *testing.T, g Engine) {
 			}
 		})
 
+		t.Run("stream", func(t *testing.T) {
+			var ids []string
+			if err := g.StreamTasks(ctx, "c", func(t *ratus.Task) error {
+				ids = append(ids, t.ID)
+				return nil
+			}); err != nil {
+				t.Error(err)
+			}
+			if len(ids) != 2 || ids[0] != "3" || ids[1] != "4" {
+				t.Errorf("incorrect streamed tasks, got %v", ids)
+			}
+
+			// Streaming stops at the first error returned by the function.
+			e := errors.New("stop")
+			ids = nil
+			if err := g.StreamTasks(ctx, "c", func(t *ratus.Task) error {
+				ids = append(ids, t.ID)
+				return e
+			}); !errors.Is(err, e) {
+				t.Errorf("incorrect error, expected %q, got %v", e, err)
+			}
+			if len(ids) != 1 {
+				t.Errorf("incorrect number of streamed tasks, expected 1, got %d", len(ids))
+			}
+		})
+
 		t.Run("promise", func(t *testing.T) {
-			v, err := g.ListPromises(ctx, "c", 1, 1)
+			v, err := g.ListPromises(ctx, "c", &Page{Limit: 1, Offset: 1})
 			if err != nil {
 				t.Error(err)
 			}
 			if len(v) != 1 {
 				t.Errorf("incorrect number of results, expected 1, got %d", len(v))
 			}
-			v, err = g.ListPromises(ctx, "c", 10, 10)
+			v, err = g.ListPromises(ctx, "c", &Page{Limit: 10, Offset: 10})
+			if err != nil {
+				t.Error(err)
+			}
+			if len(v) != 0 {
+				t.Errorf("incorrect number of results, expected 0, got %d", len(v))
+			}
+		})
+
+		t.Run("cursor", func(t *testing.T) {
+			p, err := g.ListTopics(ctx, &Page{Limit: 10, After: "a"})
+			if err != nil {
+				t.Error(err)
+			}
+			if len(p) != 2 || p[0].Name != "b" || p[1].Name != "c" {
+				t.Errorf("incorrect topics after cursor, got %v", p)
+			}
+			v, err := g.ListTasks(ctx, "c", nil, &Page{Limit: 10, After: "3"})
+			if err != nil {
+				t.Error(err)
+			}
+			if len(v) != 1 || v[0].ID != "4" {
+				t.Errorf("incorrect tasks after cursor, got %v", v)
+			}
+			v, err = g.ListTasks(ctx, "c", nil, &Page{Limit: 10, After: "4"})
 			if err != nil {
 				t.Error(err)
 			}
 			if len(v) != 0 {
 				t.Errorf("incorrect number of results, expected 0, got %d", len(v))
 			}
+			r, err := g.ListPromises(ctx, "c", &Page{Limit: 10, After: "3"})
+			if err != nil {
+				t.Error(err)
+			}
+			if len(r) != 1 || r[0].ID != "4" {
+				t.Errorf("incorrect promises after cursor, got %v", r)
+			}
+			r, err = g.ListPromises(ctx, "a", &Page{Limit: 10, After: "1"})
+			if err != nil {
+				t.Error(err)
+			}
+			if len(r) != 0 {
+				t.Errorf("incorrect number of results, expected 0, got %d", len(r))
+			}
 		})
 
 		t.Run("clean", func(t *testing.T) {
@@ -933,6 +1117,104 @@ func Test(t *testing.T, g Engine) {
 		})
 	})
 
+	// Test listing tasks and topics in different orders.
+	t.Run("sort", func(t *testing.T) {
+		n := time.Now().Truncate(time.Second)
+		at := func(d time.Duration) *time.Time {
+			x := n.Add(d)
+			return &x
+		}
+		l := map[string]string{"k": "v"}
+		if _, err := g.InsertTasks(ctx, []*ratus.Task{
+			{ID: "a", Topic: "sort", State: ratus.TaskStateCompleted, Produced: at(0), Scheduled: at(3 * time.Second), Consumed: at(0), Labels: l},
+			{ID: "b", Topic: "sort", State: ratus.TaskStatePending, Produced: at(2 * time.Second), Scheduled: at(time.Second), Labels: l},
+			{ID: "c", Topic: "sort", State: ratus.TaskStateCompleted, Produced: at(time.Second), Scheduled: at(2 * time.Second), Consumed: at(time.Second), Labels: l},
+			{ID: "d", Topic: "sort", State: ratus.TaskStatePending, Produced: at(3 * time.Second), Scheduled: at(time.Second), Labels: l},
+			{ID: "e", Topic: "sorted", State: ratus.TaskStatePending, Produced: at(0), Scheduled: at(0), Labels: l},
+			{ID: "f", Topic: "sore", State: ratus.TaskStatePending, Produced: at(0), Scheduled: at(0), Labels: l},
+		}); err != nil {
+			t.Error(err)
+		}
+
+		// Walk through the tasks one page at a time by seeking past the last
+		// task seen, and compare the order with listing them all at once.
+		walk := func(labels map[string]string, p Page) string {
+			var s string
+			for i := 0; i < 10; i++ {
+				v, err := g.ListTasks(ctx, "sort", labels, &p)
+				if err != nil {
+					t.Error(err)
+				}
+				if len(v) == 0 {
+					break
+				}
+				s += v[0].ID
+				p.After, p.Time = v[0].ID, p.SortTime(v[0])
+			}
+			return s
+		}
+		for _, x := range []struct {
+			sort     string
+			desc     bool
+			expected string
+		}{
+			{"", false, "abcd"},
+			{"", true, "dcba"},
+			{SortScheduled, false, "bdca"},
+			{SortScheduled, true, "acdb"},
+			{SortProduced, false, "acbd"},
+			{SortProduced, true, "dbca"},
+			{SortConsumed, false, "bdac"},
+			{SortConsumed, true, "cadb"},
+		} {
+			for _, labels := range []map[string]string{nil, l} {
+				p := Page{Limit: 10, Sort: x.sort, Desc: x.desc}
+				v, err := g.ListTasks(ctx, "sort", labels, &p)
+				if err != nil {
+					t.Error(err)
+				}
+				var s string
+				for _, r := range v {
+					s += r.ID
+				}
+				if s != x.expected {
+					t.Errorf("incorrect order of tasks sorted by %q (desc: %v), expected %q, got %q", x.sort, x.desc, x.expected, s)
+				}
+				p.Limit = 1
+				if s := walk(labels, p); s != x.expected {
+					t.Errorf("incorrect order of tasks paginated by %q (desc: %v), expected %q, got %q", x.sort, x.desc, x.expected, s)
+				}
+			}
+		}
+
+		t.Run("topic", func(t *testing.T) {
+			v, err := g.ListTopics(ctx, &Page{Limit: 10, Desc: true})
+			if err != nil {
+				t.Error(err)
+			}
+			if len(v) != 3 || v[0].Name != "sorted" || v[1].Name != "sort" || v[2].Name != "sore" {
+				t.Errorf("incorrect topics in descending order, got %v", v)
+			}
+			v, err = g.ListTopics(ctx, &Page{Limit: 10, Desc: true, After: "sort"})
+			if err != nil {
+				t.Error(err)
+			}
+			if len(v) != 1 || v[0].Name != "sore" {
+				t.Errorf("incorrect topics after cursor in descending order, got %v", v)
+			}
+		})
+
+		t.Run("clean", func(t *testing.T) {
+			d, err := g.DeleteTopics(ctx)
+			if err != nil {
+				t.Error(err)
+			}
+			if d.Deleted != 6 {
+				t.Errorf("incorrect number of deletions, expected 6, got %d", d.Deleted)
+			}
+		})
+	})
+
 	// Test operations that encode and decode payloads.
 	t.Run("payload", func(t *testing.T) {
 		n := time.Now()
@@ -1000,4 +1282,1318 @@ func Test(t *testing.T, g Engine) {
 			}
 		})
 	})
+
+	t.Run("settings", func(t *testing.T) {
+		n := time.Now()
+		o := n.Add(-2 * time.Minute)
+
+		t.Run("upsert", func(t *testing.T) {
+			v, err := g.UpsertTopic(ctx, &ratus.Topic{Name: "test", Retention: "1h"})
+			if err != nil {
+				t.Error(err)
+			}
+			if v.Created != 1 || v.Updated != 0 {
+				t.Errorf("incorrect number of creations and updates, expected 1 and 0, got %d and %d", v.Created, v.Updated)
+			}
+			// Counters of topics sent back from reads should not be stored.
+			v, err = g.UpsertTopic(ctx, &ratus.Topic{Name: "test", Count: 2, Pending: 1, Failed: 1, Retention: "1m", Defaults: &ratus.TaskDefaults{Defer: "1h"}, Config: &ratus.TopicConfig{Concurrency: 4, PollInterval: "1s"}})
+			if err != nil {
+				t.Error(err)
+			}
+			if v.Created != 0 || v.Updated != 1 {
+				t.Errorf("incorrect number of creations and updates, expected 0 and 1, got %d and %d", v.Created, v.Updated)
+			}
+		})
+
+		t.Run("get", func(t *testing.T) {
+			c, err := g.GetTopic(ctx, "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.Name != "test" || c.Retention != "1m" || c.Count != 0 || c.Pending != 0 || c.Failed != 0 {
+				t.Errorf("incorrect topic, expected empty topic with retention period, got %+v", c)
+			}
+			if c.Defaults == nil || c.Defaults.Defer != "1h" {
+				t.Errorf("incorrect task defaults, expected defer of %q, got %+v", "1h", c.Defaults)
+			}
+			if c.Config == nil || c.Config.Concurrency != 4 || c.Config.PollInterval != "1s" {
+				t.Errorf("incorrect topic config, expected concurrency of 4 and poll interval of %q, got %+v", "1s", c.Config)
+			}
+			s, err := g.GetTopicSettings(ctx, "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.Name != "test" || s.Failed != 0 || s.Retention != "1m" || s.Defaults == nil || s.Defaults.Defer != "1h" || s.Config == nil || s.Config.Concurrency != 4 {
+				t.Errorf("incorrect topic settings, got %+v", s)
+			}
+		})
+
+		t.Run("retention", func(t *testing.T) {
+			if _, err := g.InsertTasks(ctx, []*ratus.Task{
+				{ID: "1", Topic: "test", State: ratus.TaskStateCompleted, Scheduled: &o, Consumed: &o},
+				{ID: "2", Topic: "test", State: ratus.TaskStateCompleted, Scheduled: &n, Consumed: &n},
+				{ID: "3", Topic: "other", State: ratus.TaskStateCompleted, Scheduled: &o, Consumed: &o},
+			}); err != nil {
+				t.Fatal(err)
+			}
+			c, err := g.GetTopic(ctx, "test")
+			if err != nil {
+				t.Error(err)
+			}
+			if c.Count != 2 || c.Completed != 2 || c.Retention != "1m" {
+				t.Errorf("incorrect topic, expected 2 completed tasks with retention period, got %+v", c)
+			}
+			if s, err := g.GetTopicSettings(ctx, "test"); err != nil {
+				t.Error(err)
+			} else if s.Count != 0 || s.Completed != 0 || s.Retention != "1m" {
+				t.Errorf("incorrect topic settings, expected retention period without counters, got %+v", s)
+			}
+			if v, err := g.Chore(ctx); err != nil {
+				t.Error(err)
+			} else if v.Expired != 1 {
+				t.Errorf("incorrect number of expired tasks, expected 1, got %d", v.Expired)
+			}
+			if _, err := g.GetTask(ctx, "1"); !errors.Is(err, ratus.ErrNotFound) {
+				t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrNotFound, err)
+			}
+			for _, id := range []string{"2", "3"} {
+				if _, err := g.GetTask(ctx, id); err != nil {
+					t.Error(err)
+				}
+			}
+		})
+
+		t.Run("delete", func(t *testing.T) {
+			d, err := g.DeleteTopic(ctx, "test")
+			if err != nil {
+				t.Error(err)
+			}
+			if d.Deleted != 1 {
+				t.Errorf("incorrect number of deletions, expected 1, got %d", d.Deleted)
+			}
+			if _, err := g.GetTopic(ctx, "test"); !errors.Is(err, ratus.ErrNotFound) {
+				t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrNotFound, err)
+			}
+			if s, err := g.GetTopicSettings(ctx, "test"); err != nil {
+				t.Error(err)
+			} else if s.Name != "test" || s.Retention != "" || s.Defaults != nil || s.Config != nil {
+				t.Errorf("incorrect topic settings, expected empty settings, got %+v", s)
+			}
+		})
+
+		t.Run("clean", func(t *testing.T) {
+			if _, err := g.UpsertTopic(ctx, &ratus.Topic{Name: "test"}); err != nil {
+				t.Error(err)
+			}
+			d, err := g.DeleteTopics(ctx)
+			if err != nil {
+				t.Error(err)
+			}
+			if d.Deleted != 1 {
+				t.Errorf("incorrect number of deletions, expected 1, got %d", d.Deleted)
+			}
+			if _, err := g.GetTopic(ctx, "test"); !errors.Is(err, ratus.ErrNotFound) {
+				t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrNotFound, err)
+			}
+		})
+	})
+
+	t.Run("fairness", func(t *testing.T) {
+		n := time.Now()
+		s := func(d time.Duration) *time.Time {
+			v := n.Add(-d)
+			return &v
+		}
+		if _, err := g.UpsertTopic(ctx, &ratus.Topic{Name: "test", Fair: true}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := g.InsertTasks(ctx, []*ratus.Task{
+			{ID: "1", Topic: "test", Producer: "a", Scheduled: s(5 * time.Second)},
+			{ID: "2", Topic: "test", Producer: "a", Scheduled: s(4 * time.Second)},
+			{ID: "3", Topic: "test", Producer: "a", Scheduled: s(3 * time.Second)},
+			{ID: "4", Topic: "test", Producer: "b", Scheduled: s(2 * time.Second)},
+			{ID: "5", Topic: "test", Producer: "c", Scheduled: s(time.Second)},
+			{ID: "6", Topic: "test", Producer: "c", Scheduled: s(-time.Hour)},
+			{ID: "7", Topic: "other", Producer: "a", Scheduled: s(time.Second)},
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Tasks are interleaved across producers, while tasks of the same
+		// producer are still polled in the order of the scheduled time.
+		for _, id := range []string{"1", "4", "5", "2", "3"} {
+			v, err := g.Poll(ctx, "test", &ratus.Promise{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v.ID != id {
+				t.Errorf("incorrect task, expected %q, got %q", id, v.ID)
+			}
+		}
+		if _, err := g.Poll(ctx, "test", &ratus.Promise{}); !errors.Is(err, ratus.ErrNotFound) {
+			t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrNotFound, err)
+		}
+		if _, err := g.Poll(ctx, "empty", &ratus.Promise{}); !errors.Is(err, ratus.ErrNotFound) {
+			t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrNotFound, err)
+		}
+
+		if _, err := g.DeleteTopics(ctx); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("concurrency", func(t *testing.T) {
+		n := time.Now()
+		if _, err := g.UpsertTopic(ctx, &ratus.Topic{Name: "test", Concurrency: 2}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := g.InsertTasks(ctx, []*ratus.Task{
+			{ID: "1", Topic: "test", Scheduled: &n},
+			{ID: "2", Topic: "test", Scheduled: &n},
+			{ID: "3", Topic: "test", Scheduled: &n},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		var v *ratus.Task
+		for i := 0; i < 2; i++ {
+			var err error
+			if v, err = g.Poll(ctx, "test", &ratus.Promise{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := g.Poll(ctx, "test", &ratus.Promise{}); !errors.Is(err, ratus.ErrTooManyRequests) {
+			t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrTooManyRequests, err)
+		}
+		if _, err := g.Poll(ctx, "other", &ratus.Promise{}); !errors.Is(err, ratus.ErrNotFound) {
+			t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrNotFound, err)
+		}
+		s := ratus.TaskStateCompleted
+		if _, err := g.Commit(ctx, v.ID, &ratus.Commit{Nonce: v.Nonce, State: &s}); err != nil {
+			t.Error(err)
+		}
+		if _, err := g.Poll(ctx, "test", &ratus.Promise{}); err != nil {
+			t.Error(err)
+		}
+
+		if _, err := g.DeleteTopics(ctx); err != nil {
+			t.Error(err)
+		}
+
+		// Concurrent polls should never exceed the limit if the storage
+		// engine supports transactions.
+		if !Supports(g, CapabilityTransactions) {
+			return
+		}
+		if _, err := g.UpsertTopic(ctx, &ratus.Topic{Name: "test", Concurrency: 2}); err != nil {
+			t.Fatal(err)
+		}
+		ts := make([]*ratus.Task, 8)
+		for i := range ts {
+			ts[i] = &ratus.Task{ID: fmt.Sprint(i), Topic: "test", Scheduled: &n}
+		}
+		if _, err := g.InsertTasks(ctx, ts); err != nil {
+			t.Fatal(err)
+		}
+		var c atomic.Int64
+		var eg errgroup.Group
+		for range ts {
+			eg.Go(func() error {
+				_, err := g.Poll(ctx, "test", &ratus.Promise{})
+				if err == nil {
+					c.Add(1)
+				} else if !errors.Is(err, ratus.ErrTooManyRequests) {
+					return err
+				}
+				return nil
+			})
+		}
+		if err := eg.Wait(); err != nil {
+			t.Error(err)
+		}
+		if v := c.Load(); v != 2 {
+			t.Errorf("incorrect number of polled tasks, expected 2, got %d", v)
+		}
+
+		if _, err := g.DeleteTopics(ctx); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("once", func(t *testing.T) {
+		n := time.Now()
+		if _, err := g.UpsertTopic(ctx, &ratus.Topic{Name: "once", AtMostOnce: true}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := g.InsertTasks(ctx, []*ratus.Task{
+			{ID: "1", Topic: "test", Scheduled: &n},
+			{ID: "2", Topic: "test", Scheduled: &n},
+			{ID: "3", Topic: "once", Scheduled: &n},
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Tasks polled with promises delivering at most once should be
+		// completed immediately.
+		v, err := g.Poll(ctx, "test", &ratus.Promise{Consumer: "c", AtMostOnce: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.State != ratus.TaskStateCompleted || v.Nonce != "" || v.Consumer != "c" {
+			t.Errorf("incorrect task, expected completed task without nonce, got %+v", v)
+		}
+		if v, err = g.Poll(ctx, "test", &ratus.Promise{}); err != nil {
+			t.Fatal(err)
+		}
+		if v.State != ratus.TaskStateActive {
+			t.Errorf("incorrect state, expected %q, got %q", ratus.TaskStateActive, v.State)
+		}
+
+		// Tasks in topics delivering at most once should always be completed
+		// when polled.
+		if v, err = g.Poll(ctx, "once", &ratus.Promise{}); err != nil {
+			t.Fatal(err)
+		}
+		if v.State != ratus.TaskStateCompleted {
+			t.Errorf("incorrect state, expected %q, got %q", ratus.TaskStateCompleted, v.State)
+		}
+		if _, err := g.Poll(ctx, "once", &ratus.Promise{}); !errors.Is(err, ratus.ErrNotFound) {
+			t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrNotFound, err)
+		}
+		c, err := g.GetTopic(ctx, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Active != 1 || c.Completed != 1 {
+			t.Errorf("incorrect counts, expected 1 active and 1 completed, got %+v", c)
+		}
+
+		if _, err := g.DeleteTopics(ctx); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("stats", func(t *testing.T) {
+		n := time.Now()
+		o := n.Add(-time.Minute)
+		f := n.Add(time.Hour)
+		if _, err := g.InsertTasks(ctx, []*ratus.Task{
+			{ID: "1", Topic: "a", Scheduled: &o},
+			{ID: "2", Topic: "a", Scheduled: &n},
+			{ID: "3", Topic: "a", State: ratus.TaskStateCompleted, Scheduled: &o},
+			{ID: "4", Topic: "b", Scheduled: &f},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := g.Poll(ctx, "a", &ratus.Promise{}); err != nil {
+			t.Fatal(err)
+		}
+		v, err := g.Stats(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.Count != 4 || v.Pending != 2 || v.Active != 1 || v.Completed != 1 {
+			t.Errorf("incorrect counts, expected 4 tasks with 2 pending, 1 active and 1 completed, got %+v", v)
+		}
+		if len(v.Topics) != 2 || v.Topics[0].Name != "a" || v.Topics[1].Name != "b" {
+			t.Fatalf("incorrect topics, expected a and b, got %+v", v.Topics)
+		}
+		if a := v.Topics[0]; a.Count != 3 || a.Active != 1 || a.Oldest == nil || a.Oldest.Sub(n).Abs() > time.Second {
+			t.Errorf("incorrect stats of topic, expected oldest pending task scheduled at %v, got %+v", n, a)
+		}
+		if b := v.Topics[1]; b.Pending != 1 || b.Oldest != nil {
+			t.Errorf("incorrect stats of topic, expected no available pending task, got %+v", b)
+		}
+
+		if _, err := g.DeleteTopics(ctx); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("count", func(t *testing.T) {
+		x, ok := g.(Counter)
+		if !ok {
+			t.Skip("counting not supported")
+		}
+		n := time.Now()
+		if _, err := g.InsertTasks(ctx, []*ratus.Task{
+			{ID: "1", Topic: "a", Scheduled: &n, Labels: map[string]string{"k": "v"}},
+			{ID: "2", Topic: "a", Scheduled: &n, Labels: map[string]string{"k": "w"}},
+			{ID: "3", Topic: "a", Scheduled: &n},
+			{ID: "4", Topic: "b", Scheduled: &n, Labels: map[string]string{"k": "v"}},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := g.Poll(ctx, "a", &ratus.Promise{}); err != nil {
+			t.Fatal(err)
+		}
+		if v, err := x.CountTopics(ctx); err != nil {
+			t.Error(err)
+		} else if v != 2 {
+			t.Errorf("incorrect number of topics, expected 2, got %d", v)
+		}
+		if v, err := x.CountTasks(ctx, "a", nil); err != nil {
+			t.Error(err)
+		} else if v != 3 {
+			t.Errorf("incorrect number of tasks, expected 3, got %d", v)
+		}
+		if v, err := x.CountTasks(ctx, "a", map[string]string{"k": "v"}); err != nil {
+			t.Error(err)
+		} else if v != 1 {
+			t.Errorf("incorrect number of labeled tasks, expected 1, got %d", v)
+		}
+		if v, err := x.CountPromises(ctx, "a"); err != nil {
+			t.Error(err)
+		} else if v != 1 {
+			t.Errorf("incorrect number of promises, expected 1, got %d", v)
+		}
+		if v, err := x.CountTasks(ctx, "c", nil); err != nil {
+			t.Error(err)
+		} else if v != 0 {
+			t.Errorf("incorrect number of tasks in empty topic, expected 0, got %d", v)
+		}
+
+		if _, err := g.DeleteTopics(ctx); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("dependencies", func(t *testing.T) {
+		n := time.Now()
+		e := n.Add(-time.Minute)
+		if _, err := g.InsertTasks(ctx, []*ratus.Task{
+			{ID: "1", Topic: "test", Scheduled: &n},
+			{ID: "2", Topic: "test", Scheduled: &e, DependsOn: []string{"1"}},
+			{ID: "3", Topic: "test", Scheduled: &e, DependsOn: []string{"1", "4"}},
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Tasks with unresolved dependencies should be skipped when polling.
+		v, err := g.Poll(ctx, "test", &ratus.Promise{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.ID != "1" {
+			t.Errorf("incorrect task ID, expected %q, got %q", "1", v.ID)
+		}
+		if _, err := g.Chore(ctx); err != nil {
+			t.Error(err)
+		}
+		if _, err := g.Poll(ctx, "test", &ratus.Promise{}); !errors.Is(err, ratus.ErrNotFound) {
+			t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrNotFound, err)
+		}
+
+		// Completed dependencies should be removed by background jobs.
+		s := ratus.TaskStateCompleted
+		if _, err := g.Commit(ctx, v.ID, &ratus.Commit{Nonce: v.Nonce, State: &s}); err != nil {
+			t.Error(err)
+		}
+		if _, err := g.Chore(ctx); err != nil {
+			t.Error(err)
+		}
+		if v, err := g.GetTask(ctx, "3"); err != nil {
+			t.Error(err)
+		} else if len(v.DependsOn) != 1 || v.DependsOn[0] != "4" {
+			t.Errorf("incorrect dependencies, expected %v, got %v", []string{"4"}, v.DependsOn)
+		}
+		if v, err := g.Poll(ctx, "test", &ratus.Promise{}); err != nil {
+			t.Error(err)
+		} else if v.ID != "2" {
+			t.Errorf("incorrect task ID, expected %q, got %q", "2", v.ID)
+		}
+		if _, err := g.Poll(ctx, "test", &ratus.Promise{}); !errors.Is(err, ratus.ErrNotFound) {
+			t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrNotFound, err)
+		}
+
+		if _, err := g.DeleteTopics(ctx); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("deduplication", func(t *testing.T) {
+		n := time.Now()
+		if _, err := g.UpsertTopic(ctx, &ratus.Topic{Name: "test", DedupWindow: "1m"}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := g.InsertTask(ctx, &ratus.Task{ID: "1", Topic: "test", Produced: &n, Scheduled: &n, Dedup: "a"}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Duplicates should be rejected individually and ignored in batches.
+		if _, err := g.InsertTask(ctx, &ratus.Task{ID: "2", Topic: "test", Produced: &n, Scheduled: &n, Dedup: "a"}); !errors.Is(err, ratus.ErrConflict) {
+			t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrConflict, err)
+		}
+		if _, err := g.UpsertTask(ctx, &ratus.Task{ID: "2", Topic: "test", Produced: &n, Scheduled: &n, Dedup: "a"}); !errors.Is(err, ratus.ErrConflict) {
+			t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrConflict, err)
+		}
+		if v, err := g.InsertTasks(ctx, []*ratus.Task{
+			{ID: "2", Topic: "test", Produced: &n, Scheduled: &n, Dedup: "a"},
+			{ID: "3", Topic: "test", Produced: &n, Scheduled: &n, Dedup: "b"},
+			{ID: "4", Topic: "other", Produced: &n, Scheduled: &n, Dedup: "a"},
+		}); err != nil {
+			t.Error(err)
+		} else if v.Created != 2 {
+			t.Errorf("incorrect number of created tasks, expected 2, got %d", v.Created)
+		}
+		if _, err := g.UpsertTask(ctx, &ratus.Task{ID: "1", Topic: "test", Produced: &n, Scheduled: &n, Dedup: "a"}); err != nil {
+			t.Error(err)
+		}
+
+		// Keys should be released after the deduplication window has passed.
+		p := n.Add(-2 * time.Minute)
+		if _, err := g.UpsertTask(ctx, &ratus.Task{ID: "1", Topic: "test", Produced: &p, Scheduled: &n, Dedup: "a"}); err != nil {
+			t.Error(err)
+		}
+		if _, err := g.Chore(ctx); err != nil {
+			t.Error(err)
+		}
+		if v, err := g.GetTask(ctx, "1"); err != nil {
+			t.Error(err)
+		} else if v.Dedup != "" {
+			t.Errorf("incorrect deduplication key, expected empty, got %q", v.Dedup)
+		}
+		if _, err := g.InsertTask(ctx, &ratus.Task{ID: "2", Topic: "test", Produced: &n, Scheduled: &n, Dedup: "a"}); err != nil {
+			t.Error(err)
+		}
+
+		if _, err := g.DeleteTopics(ctx); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("labels", func(t *testing.T) {
+		n := time.Now()
+		if _, err := g.InsertTasks(ctx, []*ratus.Task{
+			{ID: "1", Topic: "test", Scheduled: &n, Labels: map[string]string{"tenant": "a", "region": "x"}},
+			{ID: "2", Topic: "test", Scheduled: &n, Labels: map[string]string{"tenant": "b", "region": "x"}},
+			{ID: "3", Topic: "test", Scheduled: &n},
+			{ID: "4", Topic: "other", Scheduled: &n, Labels: map[string]string{"tenant": "a", "region": "x"}},
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Tasks should be listed only if all of the labels match.
+		for _, c := range []struct {
+			labels map[string]string
+			ids    []string
+		}{
+			{nil, []string{"1", "2", "3"}},
+			{map[string]string{"region": "x"}, []string{"1", "2"}},
+			{map[string]string{"tenant": "a", "region": "x"}, []string{"1"}},
+			{map[string]string{"tenant": "a", "region": "y"}, []string{}},
+		} {
+			v, err := g.ListTasks(ctx, "test", c.labels, &Page{Limit: 10})
+			if err != nil {
+				t.Error(err)
+				continue
+			}
+			ids := make([]string, len(v))
+			for i, x := range v {
+				ids[i] = x.ID
+			}
+			sort.Strings(ids)
+			if !reflect.DeepEqual(ids, c.ids) {
+				t.Errorf("incorrect task IDs for labels %v, expected %v, got %v", c.labels, c.ids, ids)
+			}
+		}
+
+		// Polling should only claim tasks matching the selector.
+		if v, err := g.Poll(ctx, "test", &ratus.Promise{Labels: map[string]string{"tenant": "b"}}); err != nil {
+			t.Error(err)
+		} else if v.ID != "2" {
+			t.Errorf("incorrect task ID, expected %q, got %q", "2", v.ID)
+		}
+		if _, err := g.Poll(ctx, "test", &ratus.Promise{Labels: map[string]string{"tenant": "b"}}); !errors.Is(err, ratus.ErrNotFound) {
+			t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrNotFound, err)
+		}
+
+		// Deleting by labels should leave other tasks intact.
+		if v, err := g.DeleteTasks(ctx, "test", map[string]string{"tenant": "a"}); err != nil {
+			t.Error(err)
+		} else if v.Deleted != 1 {
+			t.Errorf("incorrect number of deleted tasks, expected 1, got %d", v.Deleted)
+		}
+		if _, err := g.GetTask(ctx, "1"); !errors.Is(err, ratus.ErrNotFound) {
+			t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrNotFound, err)
+		}
+		for _, id := range []string{"2", "3", "4"} {
+			if _, err := g.GetTask(ctx, id); err != nil {
+				t.Error(err)
+			}
+		}
+
+		if _, err := g.DeleteTopics(ctx); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("failure", func(t *testing.T) {
+		n := time.Now()
+		if _, err := g.InsertTask(ctx, &ratus.Task{ID: "1", Topic: "test", Scheduled: &n}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Failed tasks should keep the error until it is replaced.
+		s := ratus.TaskStateFailed
+		if _, err := g.Commit(ctx, "1", &ratus.Commit{State: &s, Error: "foo"}); err != nil {
+			t.Error(err)
+		}
+		s = ratus.TaskStatePending
+		if _, err := g.Commit(ctx, "1", &ratus.Commit{State: &s}); err != nil {
+			t.Error(err)
+		}
+		if v, err := g.GetTask(ctx, "1"); err != nil {
+			t.Error(err)
+		} else if v.LastError != "foo" {
+			t.Errorf("incorrect last error, expected %q, got %q", "foo", v.LastError)
+		}
+		s = ratus.TaskStateFailed
+		if _, err := g.Commit(ctx, "1", &ratus.Commit{State: &s, Error: "bar"}); err != nil {
+			t.Error(err)
+		}
+		if v, err := g.GetTask(ctx, "1"); err != nil {
+			t.Error(err)
+		} else if v.State != ratus.TaskStateFailed || v.LastError != "bar" {
+			t.Errorf("incorrect task, expected failed with %q, got %+v", "bar", v)
+		}
+
+		// Failed tasks should be counted separately from archived ones.
+		if v, err := g.GetTopic(ctx, "test"); err != nil {
+			t.Error(err)
+		} else if v.Failed != 1 || v.Archived != 0 {
+			t.Errorf("incorrect number of failed tasks, expected 1, got %d", v.Failed)
+		}
+
+		if _, err := g.DeleteTopics(ctx); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("version", func(t *testing.T) {
+		n := time.Now()
+		if _, err := g.InsertTask(ctx, &ratus.Task{ID: "1", Topic: "test", Scheduled: &n}); err != nil {
+			t.Fatal(err)
+		}
+		version := func(expected int64) {
+			t.Helper()
+			if v, err := g.GetTask(ctx, "1"); err != nil {
+				t.Error(err)
+			} else if v.Version != expected {
+				t.Errorf("incorrect version, expected %d, got %d", expected, v.Version)
+			}
+		}
+		version(1)
+
+		// Versions should be incremented by consumptions and commits.
+		if _, err := g.Poll(ctx, "test", &ratus.Promise{Deadline: &n}); err != nil {
+			t.Error(err)
+		}
+		version(2)
+		if _, err := g.Commit(ctx, "1", &ratus.Commit{Version: 1}); !errors.Is(err, ratus.ErrConflict) {
+			t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrConflict, err)
+		}
+		if v, err := g.Commit(ctx, "1", &ratus.Commit{Version: 2}); err != nil {
+			t.Error(err)
+		} else if v.Version != 3 {
+			t.Errorf("incorrect version, expected 3, got %d", v.Version)
+		}
+
+		// Conditional upserts should not overwrite concurrent updates.
+		if _, err := g.UpsertTask(ctx, &ratus.Task{ID: "1", Topic: "test", Scheduled: &n, Version: 2}); !errors.Is(err, ratus.ErrConflict) {
+			t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrConflict, err)
+		}
+		if _, err := g.UpsertTask(ctx, &ratus.Task{ID: "2", Topic: "test", Scheduled: &n, Version: 1}); !errors.Is(err, ratus.ErrNotFound) {
+			t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrNotFound, err)
+		}
+		if v, err := g.UpsertTask(ctx, &ratus.Task{ID: "1", Topic: "test", Scheduled: &n, Version: 3}); err != nil {
+			t.Error(err)
+		} else if v.Updated != 1 {
+			t.Errorf("incorrect number of updated tasks, expected 1, got %d", v.Updated)
+		}
+		version(4)
+
+		// Unconditional upserts should increment versions as well.
+		if _, err := g.UpsertTasks(ctx, []*ratus.Task{
+			{ID: "1", Topic: "test", Scheduled: &n, Version: 1},
+			{ID: "2", Topic: "test", Scheduled: &n},
+		}); err != nil {
+			t.Error(err)
+		}
+		version(5)
+		if v, err := g.GetTask(ctx, "2"); err != nil {
+			t.Error(err)
+		} else if v.Version != 1 {
+			t.Errorf("incorrect version, expected 1, got %d", v.Version)
+		}
+
+		if _, err := g.DeleteTopics(ctx); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("duplicates", func(t *testing.T) {
+		n := time.Now()
+		if _, err := g.InsertTask(ctx, &ratus.Task{ID: "0", Topic: "test", Scheduled: &n, Dedup: "x"}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Later tasks with the same IDs should replace the earlier ones, and
+		// tasks holding deduplication keys of other tasks should be skipped
+		// without failing the rest of the batch.
+		v, err := g.UpsertTasks(ctx, []*ratus.Task{
+			{ID: "1", Topic: "test", Scheduled: &n, Payload: "a"},
+			{ID: "1", Topic: "test", Scheduled: &n, Payload: "b"},
+			{ID: "2", Topic: "test", Scheduled: &n, Dedup: "x"},
+			{ID: "3", Topic: "test", Scheduled: &n, Dedup: "y"},
+			{ID: "4", Topic: "test", Scheduled: &n, Dedup: "y"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.Created != 2 || v.Updated != 1 {
+			t.Errorf("incorrect number of upserts, expected 2 created and 1 updated, got %d and %d", v.Created, v.Updated)
+		}
+		if x, err := g.GetTask(ctx, "1"); err != nil {
+			t.Error(err)
+		} else if x.Payload != "b" {
+			t.Errorf("incorrect payload, expected %q, got %v", "b", x.Payload)
+		}
+		for _, x := range []struct {
+			id     string
+			exists bool
+		}{
+			{"2", false},
+			{"3", true},
+			{"4", false},
+		} {
+			if _, err := g.GetTask(ctx, x.id); x.exists && err != nil {
+				t.Error(err)
+			} else if !x.exists && !errors.Is(err, ratus.ErrNotFound) {
+				t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrNotFound, err)
+			}
+		}
+
+		if _, err := g.DeleteTopics(ctx); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("consumers", func(t *testing.T) {
+		n := time.Now()
+		d := n.Add(time.Minute)
+		if _, err := g.InsertTasks(ctx, []*ratus.Task{
+			{ID: "1", Topic: "test", Produced: &n, Scheduled: &n},
+			{ID: "2", Topic: "test", Produced: &n, Scheduled: &n},
+			{ID: "3", Topic: "other", Produced: &n, Scheduled: &n},
+			{ID: "4", Topic: "other", Produced: &n, Scheduled: &n},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		for _, x := range []struct {
+			topic    string
+			consumer string
+		}{
+			{"test", "b"},
+			{"other", "b"},
+			{"test", "a"},
+		} {
+			if _, err := g.Poll(ctx, x.topic, &ratus.Promise{Consumer: x.consumer, Deadline: &d}); err != nil {
+				t.Error(err)
+			}
+		}
+
+		// Only consumers of active tasks should be listed.
+		v, err := g.ListConsumers(ctx)
+		if err != nil {
+			t.Error(err)
+		}
+		if len(v) != 2 || v[0].Name != "a" || v[1].Name != "b" {
+			t.Fatalf("incorrect consumers, got %v", v)
+		}
+		if len(v[0].Promises) != 1 || v[0].Promises[0].ID != "2" || v[0].Promises[0].Consumer != "a" {
+			t.Errorf("incorrect promises of consumer %q, got %v", v[0].Name, v[0].Promises)
+		}
+		if len(v[1].Promises) != 2 || v[1].Promises[0].ID != "1" || v[1].Promises[1].ID != "3" {
+			t.Errorf("incorrect promises of consumer %q, got %v", v[1].Name, v[1].Promises)
+		}
+		if v[1].Seen == nil || v[1].Promises[0].Deadline == nil {
+			t.Errorf("incorrect time fields of consumer %q, got %v", v[1].Name, v[1])
+		}
+
+		// Consumers should no longer be listed once their tasks are committed.
+		s := ratus.TaskStateCompleted
+		if _, err := g.Commit(ctx, "2", &ratus.Commit{State: &s}); err != nil {
+			t.Error(err)
+		}
+		if v, err := g.ListConsumers(ctx); err != nil {
+			t.Error(err)
+		} else if len(v) != 1 || v[0].Name != "b" {
+			t.Errorf("incorrect consumers, got %v", v)
+		}
+
+		if _, err := g.DeleteTopics(ctx); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("move", func(t *testing.T) {
+		n := time.Now()
+		if _, err := g.InsertTasks(ctx, []*ratus.Task{
+			{ID: "1", Topic: "test", Produced: &n, Scheduled: &n},
+			{ID: "2", Topic: "test", Labels: map[string]string{"tenant": "a"}, Produced: &n, Scheduled: &n},
+			{ID: "3", Topic: "test", Labels: map[string]string{"tenant": "a"}, Dedup: "x", Produced: &n, Scheduled: &n},
+			{ID: "4", Topic: "test", Labels: map[string]string{"tenant": "a"}, Dedup: "y", Produced: &n, Scheduled: &n},
+			{ID: "5", Topic: "other", Dedup: "x", Produced: &n, Scheduled: &n},
+			{ID: "6", Topic: "test", State: ratus.TaskStateCompleted, Produced: &n, Scheduled: &n},
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Tasks whose deduplication keys are held in the destination topic
+		// should be skipped.
+		v, err := g.MoveTasks(ctx, "test", &ratus.Move{Topic: "other", Labels: map[string]string{"tenant": "a"}})
+		if err != nil {
+			t.Error(err)
+		}
+		if v == nil || v.Updated != 2 {
+			t.Errorf("incorrect number of moved tasks, got %v", v)
+		}
+		for id, topic := range map[string]string{"1": "test", "2": "other", "3": "test", "4": "other"} {
+			x, err := g.GetTask(ctx, id)
+			if err != nil {
+				t.Error(err)
+				continue
+			}
+			if x.Topic != topic {
+				t.Errorf("incorrect topic of task %q, expected %q, got %q", id, topic, x.Topic)
+			}
+		}
+		if x, err := g.GetTask(ctx, "2"); err != nil {
+			t.Error(err)
+		} else if x.Version != 2 {
+			t.Errorf("incorrect version of moved task, expected 2, got %d", x.Version)
+		}
+
+		// Only tasks in the specified state should be moved.
+		s := ratus.TaskStateCompleted
+		if v, err := g.MoveTasks(ctx, "test", &ratus.Move{Topic: "done", State: &s}); err != nil {
+			t.Error(err)
+		} else if v.Updated != 1 {
+			t.Errorf("incorrect number of moved tasks, got %v", v)
+		}
+		if x, err := g.GetTopic(ctx, "test"); err != nil {
+			t.Error(err)
+		} else if x.Count != 2 {
+			t.Errorf("incorrect number of tasks in topic, expected 2, got %d", x.Count)
+		}
+		if x, err := g.GetTopic(ctx, "other"); err != nil {
+			t.Error(err)
+		} else if x.Count != 3 {
+			t.Errorf("incorrect number of tasks in topic, expected 3, got %d", x.Count)
+		}
+
+		if _, err := g.DeleteTopics(ctx); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("pending", func(t *testing.T) {
+		n := time.Now()
+		d := n.Add(time.Minute)
+		if _, err := g.InsertTasks(ctx, []*ratus.Task{
+			{ID: "1", Topic: "test", Producer: "a", Produced: &n, Scheduled: &n},
+			{ID: "2", Topic: "test", Producer: "a", Produced: &n, Scheduled: &d},
+			{ID: "3", Topic: "test", Producer: "a", Produced: &n, Scheduled: &n},
+			{ID: "4", Topic: "test", Producer: "b", Produced: &n, Scheduled: &n},
+			{ID: "5", Topic: "other", Producer: "a", Produced: &n, Scheduled: &n},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := g.InsertPromise(ctx, &ratus.Promise{ID: "3", Deadline: &d}); err != nil {
+			t.Error(err)
+		}
+
+		// Only pending tasks of the producer in the topic should be counted,
+		// including the ones scheduled in the future.
+		for _, x := range []struct {
+			topic    string
+			producer string
+			limit    int64
+			count    int64
+		}{
+			{"test", "a", 0, 2},
+			{"test", "a", 1, 1},
+			{"test", "b", 0, 1},
+			{"test", "c", 0, 0},
+			{"other", "a", 0, 1},
+		} {
+			v, err := g.CountPending(ctx, x.topic, x.producer, x.limit)
+			if err != nil {
+				t.Error(err)
+			}
+			if v != x.count {
+				t.Errorf("incorrect number of pending tasks of producer %q in topic %q, expected %d, got %d", x.producer, x.topic, x.count, v)
+			}
+		}
+
+		// Pending tasks of all producers in the topic, or in all topics,
+		// should be counted.
+		for _, x := range []struct {
+			topic string
+			limit int64
+			count int64
+		}{
+			{"test", 0, 3},
+			{"test", 2, 2},
+			{"other", 0, 1},
+			{"none", 0, 0},
+			{"", 0, 4},
+			{"", 2, 2},
+		} {
+			v, err := g.CountPendingTasks(ctx, x.topic, x.limit)
+			if err != nil {
+				t.Error(err)
+			}
+			if v != x.count {
+				t.Errorf("incorrect number of pending tasks in topic %q, expected %d, got %d", x.topic, x.count, v)
+			}
+		}
+
+		if _, err := g.DeleteTopics(ctx); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("archive", func(t *testing.T) {
+		n := time.Now().Truncate(time.Millisecond)
+		ts := make([]*ratus.Task, 0)
+		for i := range 5 {
+			c := n.Add(time.Duration(i) * time.Minute)
+			ts = append(ts, &ratus.Task{ID: fmt.Sprint(i), Topic: "test", State: ratus.TaskStateArchived, Produced: &n, Scheduled: &n, Consumed: &c})
+		}
+		ts = append(ts,
+			&ratus.Task{ID: "5", Topic: "test", State: ratus.TaskStateArchived, Produced: &n, Scheduled: &n},
+			&ratus.Task{ID: "6", Topic: "test", State: ratus.TaskStateCompleted, Produced: &n, Scheduled: &n, Consumed: &n},
+			&ratus.Task{ID: "7", Topic: "other", State: ratus.TaskStateArchived, Produced: &n, Scheduled: &n, Consumed: &n},
+		)
+		if _, err := g.InsertTasks(ctx, ts); err != nil {
+			t.Fatal(err)
+		}
+
+		// Only archived tasks in the topic consumed within the time range
+		// should be listed in the order of their consumed times.
+		from, to := n.Add(time.Minute), n.Add(4*time.Minute)
+		a := n.Add(2 * time.Minute)
+		for _, x := range []struct {
+			from *time.Time
+			to   *time.Time
+			page Page
+			ids  string
+		}{
+			{nil, nil, Page{Limit: 10}, "[5 0 1 2 3 4]"},
+			{nil, nil, Page{Limit: 10, Desc: true}, "[4 3 2 1 0 5]"},
+			{&from, &to, Page{Limit: 10}, "[1 2 3]"},
+			{&from, &to, Page{Limit: 10, Desc: true}, "[3 2 1]"},
+			{&from, nil, Page{Limit: 2, Offset: 1}, "[2 3]"},
+			{nil, &to, Page{Limit: 10}, "[0 1 2 3]"},
+			{&from, &to, Page{Limit: 10, After: "2", Time: &a}, "[3]"},
+			{&from, &to, Page{Limit: 10, Desc: true, After: "2", Time: &a}, "[1]"},
+		} {
+			v, err := g.ListArchive(ctx, "test", x.from, x.to, &x.page)
+			if err != nil {
+				t.Error(err)
+				continue
+			}
+			ids := make([]string, len(v))
+			for i, t := range v {
+				ids[i] = t.ID
+			}
+			if fmt.Sprint(ids) != x.ids {
+				t.Errorf("incorrect archived tasks in range %v to %v with %+v, expected %s, got %v", x.from, x.to, x.page, x.ids, ids)
+			}
+		}
+
+		if _, err := g.DeleteTopics(ctx); err != nil {
+			t.Error(err)
+		}
+	})
+
+	// Test optional features declared by the storage engine.
+	t.Run("capability", func(t *testing.T) {
+		t.Run("ttl", func(t *testing.T) {
+			if !Supports(g, CapabilityTTL) {
+				t.Skip("capability not supported")
+			}
+			n := time.Now()
+			e := time.Unix(0, 0)
+			if _, err := g.InsertTasks(ctx, []*ratus.Task{
+				{ID: "1", Topic: "test", State: ratus.TaskStateCompleted, Scheduled: &e, Consumed: &e},
+				{ID: "2", Topic: "test", State: ratus.TaskStateCompleted, Scheduled: &n, Consumed: &n},
+				{ID: "3", Topic: "test", State: ratus.TaskStateArchived, Scheduled: &e, Consumed: &e},
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if v, err := g.Chore(ctx); err != nil {
+				t.Error(err)
+			} else if v.Expired != 1 {
+				t.Errorf("incorrect number of expired tasks, expected 1, got %d", v.Expired)
+			}
+			if _, err := g.GetTask(ctx, "1"); !errors.Is(err, ratus.ErrNotFound) {
+				t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrNotFound, err)
+			}
+			for _, id := range []string{"2", "3"} {
+				if _, err := g.GetTask(ctx, id); err != nil {
+					t.Error(err)
+				}
+			}
+			if _, err := g.DeleteTopics(ctx); err != nil {
+				t.Error(err)
+			}
+		})
+
+		t.Run("change_streams", func(t *testing.T) {
+			if !Supports(g, CapabilityChangeStreams) {
+				t.Skip("capability not supported")
+			}
+			w, ok := g.(TaskWatcher)
+			if !ok {
+				t.Fatal("engines supporting change streams must implement TaskWatcher")
+			}
+			x, ok := g.(Watcher)
+			if !ok {
+				t.Fatal("engines supporting change streams must implement Watcher")
+			}
+
+			// Topics with new pending tasks should be pushed to watchers.
+			wctx, cancel := context.WithCancel(ctx)
+			topics := make(chan string, 16)
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				x.Watch(wctx, func(topic string) {
+					select {
+					case topics <- topic:
+					default:
+					}
+				})
+			}()
+			time.Sleep(100 * time.Millisecond)
+			n := time.Now()
+			if _, err := g.InsertTask(ctx, &ratus.Task{ID: "1", Topic: "test", Scheduled: &n}); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case <-time.After(5 * time.Second):
+				t.Error("watch did not notify the topic of the inserted task")
+			case v := <-topics:
+				if v != "test" {
+					t.Errorf("incorrect topic, expected %q, got %q", "test", v)
+				}
+			}
+			cancel()
+			<-done
+
+			// Changes should be pushed to watches without waiting for the
+			// next periodic check.
+			ch := make(chan *ratus.Task, 1)
+			go func() {
+				v, err := w.WatchTask(ctx, "1", 1)
+				if err != nil {
+					t.Error(err)
+				}
+				ch <- v
+			}()
+			time.Sleep(100 * time.Millisecond)
+			s := ratus.TaskStateCompleted
+			if _, err := g.Commit(ctx, "1", &ratus.Commit{State: &s}); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case <-time.After(5 * time.Second):
+				t.Error("watch did not return after the task was changed")
+			case v := <-ch:
+				if v == nil || v.State != ratus.TaskStateCompleted {
+					t.Errorf("incorrect task, expected completed task, got %v", v)
+				}
+			}
+
+			if _, err := g.DeleteTopics(ctx); err != nil {
+				t.Error(err)
+			}
+		})
+
+		t.Run("filtered_list", func(t *testing.T) {
+			if !Supports(g, CapabilityFilteredList) {
+				t.Skip("capability not supported")
+			}
+			n := time.Now()
+			a := map[string]string{"tenant": "a"}
+			if _, err := g.InsertTasks(ctx, []*ratus.Task{
+				{ID: "1", Topic: "test", Labels: a, Scheduled: &n},
+				{ID: "2", Topic: "test", Labels: map[string]string{"tenant": "a", "region": "x"}, Scheduled: &n},
+				{ID: "3", Topic: "test", Labels: a, Scheduled: &n},
+				{ID: "4", Topic: "test", Labels: map[string]string{"tenant": "b"}, Scheduled: &n},
+				{ID: "5", Topic: "test", Scheduled: &n},
+				{ID: "6", Topic: "other", Labels: a, Scheduled: &n},
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			// Filtered lists should be paginated in the same way as lists
+			// without selectors.
+			for _, x := range []struct {
+				page Page
+				ids  string
+			}{
+				{Page{Limit: 2}, "[1 2]"},
+				{Page{Limit: 2, Offset: 2}, "[3]"},
+				{Page{Limit: 10, After: "1"}, "[2 3]"},
+				{Page{Limit: 10, Desc: true}, "[3 2 1]"},
+			} {
+				v, err := g.ListTasks(ctx, "test", a, &x.page)
+				if err != nil {
+					t.Error(err)
+					continue
+				}
+				ids := make([]string, len(v))
+				for i, t := range v {
+					ids[i] = t.ID
+				}
+				if fmt.Sprint(ids) != x.ids {
+					t.Errorf("incorrect tasks with labels %v and %+v, expected %s, got %v", a, x.page, x.ids, ids)
+				}
+			}
+
+			// Counts should only include tasks in the topic that match all
+			// of the labels.
+			if c, ok := g.(Counter); ok {
+				for _, x := range []struct {
+					labels map[string]string
+					count  int64
+				}{
+					{nil, 5},
+					{a, 3},
+					{map[string]string{"tenant": "a", "region": "x"}, 1},
+					{map[string]string{"tenant": "c"}, 0},
+				} {
+					v, err := c.CountTasks(ctx, "test", x.labels)
+					if err != nil {
+						t.Error(err)
+					}
+					if v != x.count {
+						t.Errorf("incorrect number of tasks with labels %v, expected %d, got %d", x.labels, x.count, v)
+					}
+				}
+			}
+
+			// Deleting by labels should be scoped to the topic.
+			if v, err := g.DeleteTasks(ctx, "test", a); err != nil {
+				t.Error(err)
+			} else if v.Deleted != 3 {
+				t.Errorf("incorrect number of deleted tasks, expected 3, got %d", v.Deleted)
+			}
+			for _, id := range []string{"4", "5", "6"} {
+				if _, err := g.GetTask(ctx, id); err != nil {
+					t.Error(err)
+				}
+			}
+
+			if _, err := g.DeleteTopics(ctx); err != nil {
+				t.Error(err)
+			}
+		})
+
+		t.Run("batch_poll", func(t *testing.T) {
+			if !Supports(g, CapabilityBatchPoll) {
+				t.Skip("capability not supported")
+			}
+			b, ok := g.(BatchPoller)
+			if !ok {
+				t.Fatal("engines supporting batch polls must implement BatchPoller")
+			}
+			n := time.Now()
+			f := n.Add(time.Hour)
+			ts := []*ratus.Task{{ID: "4", Topic: "test", Scheduled: &f}}
+			for i := 1; i <= 3; i++ {
+				s := n.Add(time.Duration(i-4) * time.Second)
+				ts = append(ts, &ratus.Task{ID: strconv.Itoa(i), Topic: "test", Scheduled: &s})
+				ts = append(ts, &ratus.Task{ID: "limited" + strconv.Itoa(i), Topic: "limited", Scheduled: &s})
+			}
+			if _, err := g.InsertTasks(ctx, ts); err != nil {
+				t.Fatal(err)
+			}
+			d := n.Add(time.Minute)
+			if _, err := b.PollTasks(ctx, "test", &ratus.Promise{Deadline: &d}, 0); !errors.Is(err, ratus.ErrBadRequest) {
+				t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrBadRequest, err)
+			}
+
+			// Available tasks should be claimed in the order of the scheduled
+			// time, each with its own nonce, and tasks scheduled in the future
+			// should be left pending.
+			for _, x := range []struct {
+				limit int
+				ids   string
+			}{
+				{2, "[1 2]"},
+				{5, "[3]"},
+			} {
+				v, err := b.PollTasks(ctx, "test", &ratus.Promise{Consumer: "test", Deadline: &d}, x.limit)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var ids []string
+				nonces := make(map[string]bool)
+				for _, u := range v {
+					ids = append(ids, u.ID)
+					nonces[u.Nonce] = true
+					if u.State != ratus.TaskStateActive || u.Consumer != "test" {
+						t.Errorf("incorrect claimed task: %+v", u)
+					}
+				}
+				if s := fmt.Sprint(ids); s != x.ids {
+					t.Errorf("incorrect claimed tasks with limit %d, expected %s, got %s", x.limit, x.ids, s)
+				}
+				if len(nonces) != len(v) {
+					t.Errorf("expected claimed tasks to have distinct nonces, got %d for %d tasks", len(nonces), len(v))
+				}
+			}
+			if _, err := b.PollTasks(ctx, "test", &ratus.Promise{Deadline: &d}, 5); !errors.Is(err, ratus.ErrNotFound) {
+				t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrNotFound, err)
+			}
+
+			// Batches should stop at the concurrency limit of the topic.
+			if _, err := g.UpsertTopic(ctx, &ratus.Topic{Name: "limited", Concurrency: 2}); err != nil {
+				t.Fatal(err)
+			}
+			if v, err := b.PollTasks(ctx, "limited", &ratus.Promise{Deadline: &d}, 5); err != nil {
+				t.Error(err)
+			} else if len(v) != 2 {
+				t.Errorf("incorrect number of claimed tasks, expected 2, got %d", len(v))
+			}
+			if _, err := b.PollTasks(ctx, "limited", &ratus.Promise{Deadline: &d}, 5); !errors.Is(err, ratus.ErrTooManyRequests) {
+				t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrTooManyRequests, err)
+			}
+
+			if _, err := g.DeleteTopics(ctx); err != nil {
+				t.Error(err)
+			}
+		})
+
+		t.Run("priority", func(t *testing.T) {
+			if !Supports(g, CapabilityPriorities) {
+				t.Skip("capability not supported")
+			}
+			if _, err := g.UpsertTopic(ctx, &ratus.Topic{Name: "test", Prioritized: true}); err != nil {
+				t.Fatal(err)
+			}
+			n := time.Now()
+			var ts []*ratus.Task
+			for _, x := range []struct {
+				id       string
+				priority int
+				offset   time.Duration
+			}{
+				{"1", 0, -3 * time.Second},
+				{"2", 1, -1 * time.Second},
+				{"3", 1, -2 * time.Second},
+				{"4", 2, time.Hour},
+				{"5", -1, -4 * time.Second},
+			} {
+				s := n.Add(x.offset)
+				ts = append(ts, &ratus.Task{ID: x.id, Topic: "test", Priority: x.priority, Scheduled: &s})
+			}
+			if _, err := g.InsertTasks(ctx, ts); err != nil {
+				t.Fatal(err)
+			}
+
+			// Available tasks with higher priorities should be claimed first,
+			// tasks with the same priority in the order of the scheduled time,
+			// and tasks scheduled in the future should be left pending
+			// regardless of their priorities.
+			d := n.Add(time.Minute)
+			var ids []string
+			for {
+				v, err := g.Poll(ctx, "test", &ratus.Promise{Deadline: &d})
+				if errors.Is(err, ratus.ErrNotFound) {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				ids = append(ids, v.ID)
+			}
+			if s := fmt.Sprint(ids); s != "[3 2 1 5]" {
+				t.Errorf("incorrect order of claimed tasks, expected [3 2 1 5], got %s", s)
+			}
+
+			if _, err := g.DeleteTopics(ctx); err != nil {
+				t.Error(err)
+			}
+		})
+
+		t.Run("heartbeat", func(t *testing.T) {
+			if !Supports(g, CapabilityHeartbeat) {
+				t.Skip("capability not supported")
+			}
+			h, ok := g.(Heartbeater)
+			if !ok {
+				t.Fatal("engines supporting heartbeats must implement Heartbeater")
+			}
+			n := time.Now()
+			if _, err := g.InsertTask(ctx, &ratus.Task{ID: "1", Topic: "test", Scheduled: &n}); err != nil {
+				t.Fatal(err)
+			}
+
+			// Claim the task with a deadline that has already passed, so that
+			// it would be recovered by the next background job if the deadline
+			// were not extended.
+			p := n.Add(-time.Second)
+			v, err := g.Poll(ctx, "test", &ratus.Promise{Consumer: "test", Deadline: &p})
+			if err != nil {
+				t.Fatal(err)
+			}
+			d := n.Add(time.Hour).Truncate(time.Millisecond)
+			if _, err := h.Heartbeat(ctx, "1", "wrong", d); !errors.Is(err, ratus.ErrConflict) {
+				t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrConflict, err)
+			}
+			if _, err := h.Heartbeat(ctx, "0", "", d); !errors.Is(err, ratus.ErrNotFound) {
+				t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrNotFound, err)
+			}
+			if u, err := h.Heartbeat(ctx, "1", v.Nonce, d); err != nil {
+				t.Fatal(err)
+			} else if u.Updated != 1 {
+				t.Errorf("incorrect number of updated tasks, expected 1, got %d", u.Updated)
+			}
+			if c, err := g.Chore(ctx); err != nil {
+				t.Error(err)
+			} else if c.Recovered != 0 {
+				t.Errorf("incorrect number of recovered tasks, expected 0, got %d", c.Recovered)
+			}
+
+			// Heartbeats should not change the state, nonce or version.
+			if u, err := g.GetTask(ctx, "1"); err != nil {
+				t.Error(err)
+			} else {
+				if u.Deadline == nil || !u.Deadline.Equal(d) {
+					t.Errorf("incorrect deadline, expected %v, got %v", d, u.Deadline)
+				}
+				if u.State != ratus.TaskStateActive || u.Nonce != v.Nonce || u.Version != v.Version {
+					t.Errorf("incorrect task after heartbeat: %+v", u)
+				}
+			}
+
+			// Tasks that are no longer active can not be kept alive.
+			s := ratus.TaskStateCompleted
+			if _, err := g.Commit(ctx, "1", &ratus.Commit{Nonce: v.Nonce, State: &s}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := h.Heartbeat(ctx, "1", "", d); !errors.Is(err, ratus.ErrConflict) {
+				t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrConflict, err)
+			}
+
+			if _, err := g.DeleteTopics(ctx); err != nil {
+				t.Error(err)
+			}
+		})
+	})
 }
@@ -0,0 +1,55 @@
+// Package export exports expired tasks before they are deleted by storage
+// engines, for retaining them beyond the storage for compliance.
+package export
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+
+	"github.com/hyperonym/ratus"
+)
+
+// File exports tasks by appending them to a file as newline-delimited JSON,
+// one task per line, which can be shipped to object storage by log collectors
+// or rotated by external tools.
+type File struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewFile opens the file for appending, creating it if it does not exist.
+func NewFile(path string) (*File, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &File{file: f}, nil
+}
+
+// Export appends the tasks to the file and flushes it to disk, so that the
+// tasks are durable before being deleted.
+func (x *File) Export(ctx context.Context, ts []*ratus.Task) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	w := bufio.NewWriter(x.file)
+	e := json.NewEncoder(w)
+	for _, t := range ts {
+		if err := e.Encode(t); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return x.file.Sync()
+}
+
+// Close closes the file.
+func (x *File) Close() error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.file.Close()
+}
@@ -0,0 +1,57 @@
+package export_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hyperonym/ratus"
+	"github.com/hyperonym/ratus/internal/export"
+)
+
+func TestFile(t *testing.T) {
+	ctx := context.Background()
+	p := filepath.Join(t.TempDir(), "expired.ndjson")
+
+	// Tasks exported across reopenings are appended to the same file.
+	for _, ts := range [][]*ratus.Task{
+		{{ID: "1", Topic: "test", Payload: "a"}, {ID: "2", Topic: "test"}},
+		{{ID: "3", Topic: "other"}},
+	} {
+		x, err := export.NewFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := x.Export(ctx, ts); err != nil {
+			t.Error(err)
+		}
+		if err := x.Close(); err != nil {
+			t.Error(err)
+		}
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var ids []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var v ratus.Task
+		if err := json.Unmarshal(s.Bytes(), &v); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, v.ID)
+	}
+	if len(ids) != 3 || ids[0] != "1" || ids[2] != "3" {
+		t.Errorf("incorrect exported tasks, expected [1 2 3], got %v", ids)
+	}
+
+	if _, err := export.NewFile(filepath.Join(p, "invalid")); err == nil {
+		t.Error("expected error when the file can not be opened")
+	}
+}
@@ -0,0 +1,299 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/hyperonym/ratus"
+	"github.com/hyperonym/ratus/internal/engine"
+)
+
+// Name constant for the label of engine operations.
+const labelOperation = "op"
+
+var (
+	// Storage engine operation time in seconds.
+	EngineHistogram = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ratus_engine_operation_duration_seconds",
+		Help:    "Storage engine operation time in seconds",
+		Buckets: []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5},
+	}, []string{labelOperation})
+
+	// Total number of failed storage engine operations.
+	EngineErrorCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ratus_engine_operation_errors_total",
+		Help: "Total number of failed storage engine operations",
+	}, []string{labelOperation})
+)
+
+// Instrument wraps the storage engine to record the duration and the errors
+// of its operations, which tells the time spent in the storage engine apart
+// from the response time of requests. The optional Counter interface is kept
+// if the storage engine implements it, while other optional interfaces are
+// expected to be asserted on the unwrapped storage engine.
+func Instrument(g engine.Engine) engine.Engine {
+	v := &instrumented{g}
+	if c, ok := g.(engine.Counter); ok {
+		return &instrumentedCounter{v, c}
+	}
+	return v
+}
+
+// observe records the duration of the operation since the start time. Errors
+// indicating missing resources, conflicts and exhausted concurrency limits are
+// expected outcomes of operations, and are not counted as failures.
+func observe(op string, start time.Time, err *error) {
+	EngineHistogram.WithLabelValues(op).Observe(time.Since(start).Seconds())
+	if e := *err; e != nil && !errors.Is(e, ratus.ErrNotFound) && !errors.Is(e, ratus.ErrConflict) && !errors.Is(e, ratus.ErrTooManyRequests) {
+		EngineErrorCounter.WithLabelValues(op).Inc()
+	}
+}
+
+// instrumented is a storage engine recording metrics of its operations.
+type instrumented struct {
+	engine.Engine
+}
+
+// Supports returns whether the storage engine declares support for the feature.
+func (g *instrumented) Supports(c engine.Capability) bool {
+	return engine.Supports(g.Engine, c)
+}
+
+// Ready probes the storage engine and returns an error if it is not ready.
+func (g *instrumented) Ready(ctx context.Context) (err error) {
+	defer observe("Ready", time.Now(), &err)
+	return g.Engine.Ready(ctx)
+}
+
+// Chore recovers timed out tasks and deletes expired tasks.
+func (g *instrumented) Chore(ctx context.Context) (v *ratus.Chore, err error) {
+	defer observe("Chore", time.Now(), &err)
+	return g.Engine.Chore(ctx)
+}
+
+// Poll makes a promise to claim and execute the next available task in a topic.
+func (g *instrumented) Poll(ctx context.Context, topic string, p *ratus.Promise) (v *ratus.Task, err error) {
+	defer observe("Poll", time.Now(), &err)
+	return g.Engine.Poll(ctx, topic, p)
+}
+
+// NextScheduled returns the scheduled time of the next pending task in a topic that is not yet available.
+func (g *instrumented) NextScheduled(ctx context.Context, topic string) (v *time.Time, err error) {
+	defer observe("NextScheduled", time.Now(), &err)
+	return g.Engine.NextScheduled(ctx, topic)
+}
+
+// Commit applies a set of updates to a task and returns the updated task.
+func (g *instrumented) Commit(ctx context.Context, id string, m *ratus.Commit) (v *ratus.Task, err error) {
+	defer observe("Commit", time.Now(), &err)
+	return g.Engine.Commit(ctx, id, m)
+}
+
+// UpdateProgress records the progress of an active task without changing its state, nonce or version.
+func (g *instrumented) UpdateProgress(ctx context.Context, id string, p *ratus.Progress) (v *ratus.Updated, err error) {
+	defer observe("UpdateProgress", time.Now(), &err)
+	return g.Engine.UpdateProgress(ctx, id, p)
+}
+
+// ListTopics lists all topics.
+func (g *instrumented) ListTopics(ctx context.Context, p *engine.Page) (v []*ratus.Topic, err error) {
+	defer observe("ListTopics", time.Now(), &err)
+	return g.Engine.ListTopics(ctx, p)
+}
+
+// DeleteTopics deletes all topics and tasks.
+func (g *instrumented) DeleteTopics(ctx context.Context) (v *ratus.Deleted, err error) {
+	defer observe("DeleteTopics", time.Now(), &err)
+	return g.Engine.DeleteTopics(ctx)
+}
+
+// GetTopic gets information about a topic.
+func (g *instrumented) GetTopic(ctx context.Context, topic string) (v *ratus.Topic, err error) {
+	defer observe("GetTopic", time.Now(), &err)
+	return g.Engine.GetTopic(ctx, topic)
+}
+
+// GetTopicSettings gets the settings of a topic without counting its tasks, which are empty if not specified.
+func (g *instrumented) GetTopicSettings(ctx context.Context, topic string) (v *ratus.Topic, err error) {
+	defer observe("GetTopicSettings", time.Now(), &err)
+	return g.Engine.GetTopicSettings(ctx, topic)
+}
+
+// UpsertTopic inserts or updates the settings of a topic.
+func (g *instrumented) UpsertTopic(ctx context.Context, t *ratus.Topic) (v *ratus.Updated, err error) {
+	defer observe("UpsertTopic", time.Now(), &err)
+	return g.Engine.UpsertTopic(ctx, t)
+}
+
+// DeleteTopic deletes a topic and its tasks.
+func (g *instrumented) DeleteTopic(ctx context.Context, topic string) (v *ratus.Deleted, err error) {
+	defer observe("DeleteTopic", time.Now(), &err)
+	return g.Engine.DeleteTopic(ctx, topic)
+}
+
+// Stats returns statistics of tasks across all topics.
+func (g *instrumented) Stats(ctx context.Context) (v *ratus.Stats, err error) {
+	defer observe("Stats", time.Now(), &err)
+	return g.Engine.Stats(ctx)
+}
+
+// ListTasks lists all tasks in a topic that match the label selector.
+func (g *instrumented) ListTasks(ctx context.Context, topic string, labels map[string]string, p *engine.Page) (v []*ratus.Task, err error) {
+	defer observe("ListTasks", time.Now(), &err)
+	return g.Engine.ListTasks(ctx, topic, labels, p)
+}
+
+// ListArchive lists archived tasks in a topic consumed within the time range, in the order of their consumed time.
+func (g *instrumented) ListArchive(ctx context.Context, topic string, from, to *time.Time, p *engine.Page) (v []*ratus.Task, err error) {
+	defer observe("ListArchive", time.Now(), &err)
+	return g.Engine.ListArchive(ctx, topic, from, to, p)
+}
+
+// StreamTasks calls the function with each task in a topic in the order of their IDs, stopping at the first error.
+func (g *instrumented) StreamTasks(ctx context.Context, topic string, f func(*ratus.Task) error) (err error) {
+	defer observe("StreamTasks", time.Now(), &err)
+	return g.Engine.StreamTasks(ctx, topic, f)
+}
+
+// CountPending counts pending tasks of a producer in a topic, stopping at the limit if it is positive.
+func (g *instrumented) CountPending(ctx context.Context, topic, producer string, limit int64) (v int64, err error) {
+	defer observe("CountPending", time.Now(), &err)
+	return g.Engine.CountPending(ctx, topic, producer, limit)
+}
+
+// CountPendingTasks counts pending tasks in a topic, or in all topics if the topic is empty, stopping at the limit if it is positive.
+func (g *instrumented) CountPendingTasks(ctx context.Context, topic string, limit int64) (v int64, err error) {
+	defer observe("CountPendingTasks", time.Now(), &err)
+	return g.Engine.CountPendingTasks(ctx, topic, limit)
+}
+
+// InsertTasks inserts a batch of tasks while ignoring existing ones.
+func (g *instrumented) InsertTasks(ctx context.Context, ts []*ratus.Task) (v *ratus.Updated, err error) {
+	defer observe("InsertTasks", time.Now(), &err)
+	return g.Engine.InsertTasks(ctx, ts)
+}
+
+// UpsertTasks inserts or updates a batch of tasks.
+func (g *instrumented) UpsertTasks(ctx context.Context, ts []*ratus.Task) (v *ratus.Updated, err error) {
+	defer observe("UpsertTasks", time.Now(), &err)
+	return g.Engine.UpsertTasks(ctx, ts)
+}
+
+// DeleteTasks deletes all tasks in a topic that match the label selector.
+func (g *instrumented) DeleteTasks(ctx context.Context, topic string, labels map[string]string) (v *ratus.Deleted, err error) {
+	defer observe("DeleteTasks", time.Now(), &err)
+	return g.Engine.DeleteTasks(ctx, topic, labels)
+}
+
+// MoveTasks moves tasks in a topic that match the filters to another topic.
+func (g *instrumented) MoveTasks(ctx context.Context, topic string, m *ratus.Move) (v *ratus.Updated, err error) {
+	defer observe("MoveTasks", time.Now(), &err)
+	return g.Engine.MoveTasks(ctx, topic, m)
+}
+
+// GetTask gets a task by its unique ID.
+func (g *instrumented) GetTask(ctx context.Context, id string) (v *ratus.Task, err error) {
+	defer observe("GetTask", time.Now(), &err)
+	return g.Engine.GetTask(ctx, id)
+}
+
+// GetTasks gets tasks by their unique IDs in the order of the IDs, skipping missing ones.
+func (g *instrumented) GetTasks(ctx context.Context, ids []string) (v []*ratus.Task, err error) {
+	defer observe("GetTasks", time.Now(), &err)
+	return g.Engine.GetTasks(ctx, ids)
+}
+
+// InsertTask inserts a new task.
+func (g *instrumented) InsertTask(ctx context.Context, t *ratus.Task) (v *ratus.Updated, err error) {
+	defer observe("InsertTask", time.Now(), &err)
+	return g.Engine.InsertTask(ctx, t)
+}
+
+// UpsertTask inserts or updates a task.
+func (g *instrumented) UpsertTask(ctx context.Context, t *ratus.Task) (v *ratus.Updated, err error) {
+	defer observe("UpsertTask", time.Now(), &err)
+	return g.Engine.UpsertTask(ctx, t)
+}
+
+// DeleteTask deletes a task by its unique ID.
+func (g *instrumented) DeleteTask(ctx context.Context, id string) (v *ratus.Deleted, err error) {
+	defer observe("DeleteTask", time.Now(), &err)
+	return g.Engine.DeleteTask(ctx, id)
+}
+
+// ListPromises lists all promises in a topic.
+func (g *instrumented) ListPromises(ctx context.Context, topic string, p *engine.Page) (v []*ratus.Promise, err error) {
+	defer observe("ListPromises", time.Now(), &err)
+	return g.Engine.ListPromises(ctx, topic, p)
+}
+
+// DeletePromises deletes all promises in a topic.
+func (g *instrumented) DeletePromises(ctx context.Context, topic string) (v *ratus.Deleted, err error) {
+	defer observe("DeletePromises", time.Now(), &err)
+	return g.Engine.DeletePromises(ctx, topic)
+}
+
+// GetPromise gets a promise by the unique ID of its target task.
+func (g *instrumented) GetPromise(ctx context.Context, id string) (v *ratus.Promise, err error) {
+	defer observe("GetPromise", time.Now(), &err)
+	return g.Engine.GetPromise(ctx, id)
+}
+
+// InsertPromise makes a promise to claim and execute a task if it is in pending state.
+func (g *instrumented) InsertPromise(ctx context.Context, p *ratus.Promise) (v *ratus.Task, err error) {
+	defer observe("InsertPromise", time.Now(), &err)
+	return g.Engine.InsertPromise(ctx, p)
+}
+
+// UpsertPromise makes a promise to claim and execute a task regardless of its current state.
+func (g *instrumented) UpsertPromise(ctx context.Context, p *ratus.Promise) (v *ratus.Task, err error) {
+	defer observe("UpsertPromise", time.Now(), &err)
+	return g.Engine.UpsertPromise(ctx, p)
+}
+
+// StealPromise transfers the promise of an active task to another consumer, invalidating the previous one.
+func (g *instrumented) StealPromise(ctx context.Context, p *ratus.Promise) (v *ratus.Task, err error) {
+	defer observe("StealPromise", time.Now(), &err)
+	return g.Engine.StealPromise(ctx, p)
+}
+
+// DeletePromise deletes a promise by the unique ID of its target task.
+func (g *instrumented) DeletePromise(ctx context.Context, id string) (v *ratus.Deleted, err error) {
+	defer observe("DeletePromise", time.Now(), &err)
+	return g.Engine.DeletePromise(ctx, id)
+}
+
+// ListConsumers lists the consumers of active tasks in all topics along with their promises.
+func (g *instrumented) ListConsumers(ctx context.Context) (v []*ratus.Consumer, err error) {
+	defer observe("ListConsumers", time.Now(), &err)
+	return g.Engine.ListConsumers(ctx)
+}
+
+// instrumentedCounter is an instrumented storage engine that is able to count
+// resources.
+type instrumentedCounter struct {
+	*instrumented
+	counter engine.Counter
+}
+
+// CountTopics counts all topics.
+func (g *instrumentedCounter) CountTopics(ctx context.Context) (v int64, err error) {
+	defer observe("CountTopics", time.Now(), &err)
+	return g.counter.CountTopics(ctx)
+}
+
+// CountTasks counts all tasks in a topic that match the labels.
+func (g *instrumentedCounter) CountTasks(ctx context.Context, topic string, labels map[string]string) (v int64, err error) {
+	defer observe("CountTasks", time.Now(), &err)
+	return g.counter.CountTasks(ctx, topic, labels)
+}
+
+// CountPromises counts all promises in a topic.
+func (g *instrumentedCounter) CountPromises(ctx context.Context, topic string) (v int64, err error) {
+	defer observe("CountPromises", time.Now(), &err)
+	return g.counter.CountPromises(ctx, topic)
+}
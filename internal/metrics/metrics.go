@@ -2,8 +2,13 @@
 package metrics
 
 import (
+	"context"
+	"time"
+
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/hyperonym/ratus"
 )
 
 // Name constants for metrics labels.
@@ -14,6 +19,7 @@ const (
 	labelMethod     = "method"
 	labelEndpoint   = "endpoint"
 	labelStatusCode = "status_code"
+	labelState      = "state"
 )
 
 var (
@@ -31,6 +37,13 @@ var (
 		Buckets: []float64{0.01, 0.1, 0.5, 1, 2, 5},
 	})
 
+	// Number of instances running background jobs, as seen by instances that
+	// only serve API requests.
+	WorkersGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ratus_workers",
+		Help: "Number of instances running background jobs",
+	})
+
 	// Task schedule delay in seconds.
 	DelayGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "ratus_task_schedule_delay_seconds",
@@ -60,4 +73,91 @@ var (
 		Name: "ratus_task_committed_count_total",
 		Help: "Total number of tasks committed",
 	}, []string{labelTopic, labelProducer, labelConsumer})
+
+	// Total number of timed out tasks recovered.
+	RecoveredCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ratus_task_recovered_count_total",
+		Help: "Total number of timed out tasks recovered",
+	}, []string{labelTopic, labelProducer, labelConsumer})
+
+	// Total number of committed tasks dropped by the AMQP bridge.
+	DroppedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ratus_bridge_dropped_count_total",
+		Help: "Total number of committed tasks dropped by the AMQP bridge",
+	}, []string{labelTopic})
 )
+
+// ObserveChore updates the metrics with the results of background jobs.
+func ObserveChore(v *ratus.Chore) {
+	for _, r := range v.Recoveries {
+		RecoveredCounter.WithLabelValues(r.Topic, r.Producer, r.Consumer).Add(1)
+	}
+}
+
+// statsTimeout is the time limit for retrieving statistics when gathering
+// metrics.
+const statsTimeout = 5 * time.Second
+
+var (
+	// Number of tasks in each state.
+	tasksDesc = prometheus.NewDesc(
+		"ratus_topic_tasks",
+		"Number of tasks in each state",
+		[]string{labelTopic, labelState}, nil,
+	)
+
+	// Age of the oldest available pending task in seconds.
+	oldestDesc = prometheus.NewDesc(
+		"ratus_topic_oldest_pending_age_seconds",
+		"Age of the oldest available pending task in seconds",
+		[]string{labelTopic}, nil,
+	)
+)
+
+// StatsCollector is a Prometheus collector that retrieves statistics of tasks
+// whenever metrics are gathered, so that the metrics reflect the storage
+// engine rather than the requests handled by the instance.
+type StatsCollector struct {
+	stats func(ctx context.Context) (*ratus.Stats, error)
+}
+
+// NewStatsCollector creates a StatsCollector retrieving statistics with the
+// function, which is typically the Stats method of a storage engine.
+func NewStatsCollector(f func(ctx context.Context) (*ratus.Stats, error)) *StatsCollector {
+	return &StatsCollector{f}
+}
+
+// Describe sends the descriptors of the metrics to the channel.
+func (c *StatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- tasksDesc
+	ch <- oldestDesc
+}
+
+// Collect retrieves statistics and sends them as metrics to the channel.
+func (c *StatsCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), statsTimeout)
+	defer cancel()
+	v, err := c.stats(ctx)
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(tasksDesc, err)
+		return
+	}
+	n := time.Now()
+	for _, t := range v.Topics {
+		for _, x := range []struct {
+			state string
+			count int64
+		}{
+			{"pending", t.Pending},
+			{"active", t.Active},
+			{"completed", t.Completed},
+			{"archived", t.Archived},
+			{"failed", t.Failed},
+		} {
+			ch <- prometheus.MustNewConstMetric(tasksDesc, prometheus.GaugeValue, float64(x.count), t.Name, x.state)
+		}
+		if t.Oldest != nil {
+			ch <- prometheus.MustNewConstMetric(oldestDesc, prometheus.GaugeValue, n.Sub(*t.Oldest).Seconds(), t.Name)
+		}
+	}
+}
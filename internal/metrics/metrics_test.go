@@ -1,12 +1,19 @@
 package metrics_test
 
 import (
+	"context"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
+	"github.com/hyperonym/ratus"
+	"github.com/hyperonym/ratus/internal/engine"
+	"github.com/hyperonym/ratus/internal/engine/stub"
 	"github.com/hyperonym/ratus/internal/metrics"
 	"github.com/hyperonym/ratus/internal/reqtest"
 )
@@ -16,11 +23,13 @@ func TestMetrics(t *testing.T) {
 
 	metrics.RequestHistogram.WithLabelValues("test", "GET", "/foo", "404").Observe(0.42)
 	metrics.ChoreHistogram.Observe(0.42)
+	metrics.WorkersGauge.Set(2)
 	metrics.DelayGauge.WithLabelValues("test", "foo", "bar").Set(42)
 	metrics.ExecutionGauge.WithLabelValues("test", "foo", "bar").Set(42)
 	metrics.ProducedCounter.WithLabelValues("test", "foo").Add(42)
 	metrics.ConsumedCounter.WithLabelValues("test", "foo", "bar").Add(42)
 	metrics.CommittedCounter.WithLabelValues("test", "foo", "bar").Add(42)
+	metrics.ObserveChore(&ratus.Chore{Recovered: 1, Recoveries: []*ratus.Recovery{{ID: "1", Topic: "test", Producer: "foo", Consumer: "bar"}}})
 
 	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
 	r := reqtest.Record(t, h, req)
@@ -28,11 +37,13 @@ func TestMetrics(t *testing.T) {
 	r.AssertBodyContains("ratus_request_duration_seconds")
 	r.AssertBodyContains(`ratus_chore_duration_seconds_bucket{le="0.1"} 0`)
 	r.AssertBodyContains(`ratus_chore_duration_seconds_bucket{le="0.5"} 1`)
+	r.AssertBodyContains("ratus_workers 2")
 	r.AssertBodyContains("ratus_task_schedule_delay_seconds")
 	r.AssertBodyContains("ratus_task_execution_duration_seconds")
 	r.AssertBodyContains("ratus_task_produced_count_total")
 	r.AssertBodyContains("ratus_task_consumed_count_total")
 	r.AssertBodyContains("ratus_task_committed_count_total")
+	r.AssertBodyContains(`ratus_task_recovered_count_total{consumer="bar",producer="foo",topic="test"} 1`)
 	r.AssertBodyContains(`topic="test"`)
 	r.AssertBodyContains(`method="GET"`)
 	r.AssertBodyContains(`endpoint="/foo"`)
@@ -41,3 +52,52 @@ func TestMetrics(t *testing.T) {
 	r.AssertBodyContains(`consumer="bar"`)
 	r.AssertBodyContains("} 42")
 }
+
+func TestStatsCollector(t *testing.T) {
+	d := time.Now().Add(-time.Minute)
+	c := metrics.NewStatsCollector(func(ctx context.Context) (*ratus.Stats, error) {
+		return &ratus.Stats{Topics: []*ratus.TopicStats{{Name: "test", Count: 1, Pending: 1, Oldest: &d}}}, nil
+	})
+	g := prometheus.NewRegistry()
+	g.MustRegister(c)
+	h := promhttp.HandlerFor(g, promhttp.HandlerOpts{})
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	r := reqtest.Record(t, h, req)
+	r.AssertStatusCode(http.StatusOK)
+	r.AssertBodyContains(`ratus_topic_tasks{state="pending",topic="test"} 1`)
+	r.AssertBodyContains(`ratus_topic_tasks{state="active",topic="test"} 0`)
+	r.AssertBodyContains(`ratus_topic_oldest_pending_age_seconds{topic="test"} 6`)
+}
+
+func TestInstrument(t *testing.T) {
+	ctx := context.Background()
+	s := &stub.Engine{}
+	g := metrics.Instrument(s)
+	if _, ok := g.(engine.Counter); !ok {
+		t.Error("expected the counter interface to be kept")
+	}
+
+	// Expected errors are not counted as failures.
+	if _, err := g.GetTask(ctx, "1"); err != nil {
+		t.Error(err)
+	}
+	s.Err = ratus.ErrNotFound
+	if _, err := g.Poll(ctx, "test", &ratus.Promise{}); !errors.Is(err, ratus.ErrNotFound) {
+		t.Errorf("incorrect error, expected %q, got %v", ratus.ErrNotFound, err)
+	}
+	s.Err = errors.New("unavailable")
+	if _, err := g.(engine.Counter).CountTasks(ctx, "test", nil); err == nil {
+		t.Error("expected error from the storage engine")
+	}
+
+	h := promhttp.Handler()
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	r := reqtest.Record(t, h, req)
+	r.AssertStatusCode(http.StatusOK)
+	r.AssertBodyContains(`ratus_engine_operation_duration_seconds_count{op="GetTask"} 1`)
+	r.AssertBodyContains(`ratus_engine_operation_duration_seconds_count{op="Poll"} 1`)
+	r.AssertBodyContains(`ratus_engine_operation_duration_seconds_count{op="CountTasks"} 1`)
+	r.AssertBodyContains(`ratus_engine_operation_errors_total{op="CountTasks"} 1`)
+	r.AssertBodyNotContains(`ratus_engine_operation_errors_total{op="Poll"}`)
+}
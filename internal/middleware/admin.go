@@ -0,0 +1,27 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/hyperonym/ratus"
+	"github.com/hyperonym/ratus/internal/config"
+)
+
+// Admin returns a middleware that authenticates requests to admin endpoints
+// with the bearer token in the Authorization header. All requests are
+// rejected if the token is not configured.
+func Admin(ac *config.AdminConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h := c.GetHeader("Authorization")
+		p, ok := strings.CutPrefix(h, "Bearer ")
+		if !ok || ac.Token == "" || subtle.ConstantTimeCompare([]byte(p), []byte(ac.Token)) != 1 {
+			c.Header("WWW-Authenticate", "Bearer")
+			fail(c, ratus.ErrUnauthorized)
+			return
+		}
+		c.Next()
+	}
+}
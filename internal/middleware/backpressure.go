@@ -0,0 +1,153 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/hyperonym/ratus"
+	"github.com/hyperonym/ratus/internal/config"
+	"github.com/hyperonym/ratus/internal/engine"
+)
+
+// HeaderRetryAfter is the header field advising clients how many seconds to
+// wait before retrying rejected requests.
+const HeaderRetryAfter = "Retry-After"
+
+// HeaderWarning is the header field warning clients about the state of the
+// server without rejecting their requests.
+const HeaderWarning = "Warning"
+
+// Backpressure returns a middleware that rejects requests inserting tasks
+// with ErrTooManyRequests and a Retry-After header once the number of pending
+// tasks in the topic reaches the threshold, and adds a Warning header to the
+// responses once it reaches the warning level, so that producers can slow
+// down before the storage engine is overloaded. Numbers of pending tasks are
+// cached for a short time and increased by the tasks accepted in the meantime,
+// so the threshold may only be exceeded slightly by concurrent requests. A nil
+// middleware is returned if both levels are disabled.
+func Backpressure(bc *config.BackpressureConfig, g engine.Engine) gin.HandlerFunc {
+	if bc.Threshold <= 0 && bc.Warning <= 0 {
+		return nil
+	}
+	p := pending{engine: g, ttl: bc.CacheTTL, counts: make(map[string]count)}
+	retry := strconv.Itoa(int(math.Ceil(bc.RetryAfter.Seconds())))
+
+	return func(c *gin.Context) {
+		topic := c.Param(ParamTopic)
+		n, err := p.get(c.Request.Context(), topic, Now(c))
+		if err != nil {
+			fail(c, err)
+			return
+		}
+		if bc.Threshold > 0 && n >= bc.Threshold {
+			c.Header(HeaderRetryAfter, retry)
+			fail(c, fmt.Errorf("%w: topic %q has %d pending tasks, reaching the backpressure threshold of %d", ratus.ErrTooManyRequests, topic, n, bc.Threshold))
+			return
+		}
+		if bc.Warning > 0 && n >= bc.Warning {
+			c.Header(HeaderWarning, fmt.Sprintf("199 ratus %q", fmt.Sprintf("topic %s has %d pending tasks", topic, n)))
+		}
+
+		c.Next()
+
+		var k int64
+		for _, t := range accepted(c) {
+			if t.Topic == topic {
+				k++
+			}
+		}
+		p.add(topic, k, Now(c))
+	}
+}
+
+// accepted returns the tasks bound to the request if it has been handled
+// successfully, which are counted as pending regardless of whether they were
+// inserted or updated.
+func accepted(c *gin.Context) []*ratus.Task {
+	if c.IsAborted() || c.Writer.Status() >= http.StatusMultipleChoices {
+		return nil
+	}
+	if v, ok := c.Get(ParamTasks); ok {
+		return v.(*ratus.Tasks).Data
+	}
+	if v, ok := c.Get(ParamTask); ok {
+		return []*ratus.Task{v.(*ratus.Task)}
+	}
+	return nil
+}
+
+// pending caches the numbers of pending tasks in topics, which are expensive
+// to count on every request for some storage engines.
+type pending struct {
+	engine engine.Engine
+	ttl    time.Duration
+
+	// Number at which pending tasks across all topics stop being counted,
+	// since larger numbers make no difference to the checks. Zero means
+	// there is no limit.
+	limit int64
+
+	mu     sync.Mutex
+	counts map[string]count
+	pruned time.Time
+}
+
+// count is a cached number of pending tasks.
+type count struct {
+	n       int64
+	expires time.Time
+}
+
+// get returns the number of pending tasks in the topic, or in all topics if
+// the topic is empty, which is counted by the storage engine if the cached one
+// has expired. Expired counts of other topics are forgotten from time to time.
+func (p *pending) get(ctx context.Context, topic string, now time.Time) (int64, error) {
+	p.mu.Lock()
+	v, ok := p.counts[topic]
+	p.mu.Unlock()
+	if ok && now.Before(v.expires) {
+		return v.n, nil
+	}
+
+	var limit int64
+	if topic == "" {
+		limit = p.limit
+	}
+	n, err := p.engine.CountPendingTasks(ctx, topic, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.counts[topic] = count{n, now.Add(p.ttl)}
+	if now.Sub(p.pruned) >= time.Minute {
+		for k, x := range p.counts {
+			if !now.Before(x.expires) {
+				delete(p.counts, k)
+			}
+		}
+		p.pruned = now
+	}
+	return n, nil
+}
+
+// add increases the cached number of pending tasks in the topic by the number
+// of accepted tasks, so that the cache does not lag behind until it expires.
+func (p *pending) add(topic string, n int64, now time.Time) {
+	if n == 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if v, ok := p.counts[topic]; ok && now.Before(v.expires) {
+		p.counts[topic] = count{v.n + n, v.expires}
+	}
+}
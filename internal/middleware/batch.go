@@ -0,0 +1,65 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/hyperonym/ratus"
+)
+
+// BatchGet returns a middleware that normalizes lists of task IDs to be
+// retrieved in bulk in request bodies.
+func BatchGet() gin.HandlerFunc {
+	return func(c *gin.Context) {
+
+		// The request body must not be empty and contains a valid list.
+		var b ratus.BatchGet
+		if err := bind(c, &b); err != nil {
+			if err == io.EOF {
+				fail(c, fmt.Errorf("%w: missing request body", ratus.ErrBadRequest))
+				return
+			}
+			fail(c, fmt.Errorf("%w: %v", ratus.ErrBadRequest, err))
+			return
+		}
+
+		// Validate and normalize the list.
+		if err := normalizeBatchGet(&b); err != nil {
+			fail(c, fmt.Errorf("%w: %v", ratus.ErrBadRequest, err))
+			return
+		}
+
+		// Store the normalized list in the request context.
+		c.Set(ParamBatch, &b)
+
+		c.Next()
+	}
+}
+
+func normalizeBatchGet(b *ratus.BatchGet) error {
+
+	// Validate IDs.
+	if len(b.IDs) == 0 {
+		return errors.New("ids must not be empty")
+	}
+
+	// Remove duplicated IDs while keeping the order of their first
+	// occurrences.
+	ids := make([]string, 0, len(b.IDs))
+	seen := make(map[string]bool, len(b.IDs))
+	for _, id := range b.IDs {
+		if id == "" {
+			return errors.New("ids must not contain empty IDs")
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	b.IDs = ids
+
+	return nil
+}
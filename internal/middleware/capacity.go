@@ -0,0 +1,81 @@
+package middleware
+
+import (
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/hyperonym/ratus"
+	"github.com/hyperonym/ratus/internal/config"
+	"github.com/hyperonym/ratus/internal/engine"
+)
+
+// Capacity returns a middleware that rejects requests inserting tasks with
+// ErrTooManyRequests if the tasks would make the number of pending tasks
+// exceed the maximum in their topics or across all topics, which bounds the
+// usage of storage in multi-tenant deployments. It must be used after the
+// task or tasks middleware. Pending tasks are counted before inserting rather
+// than atomically, and the numbers are cached for a short time and increased
+// by the tasks accepted in the meantime, so the maximums may be exceeded
+// slightly by concurrent requests. A nil middleware is returned if both
+// maximums are disabled.
+func Capacity(cc *config.CapacityConfig, g engine.Engine) gin.HandlerFunc {
+	if cc.Pending <= 0 && cc.TopicPending <= 0 {
+		return nil
+	}
+	p := pending{engine: g, ttl: cc.CacheTTL, limit: cc.Pending, counts: make(map[string]count)}
+
+	return func(c *gin.Context) {
+		var ts []*ratus.Task
+		if v, ok := c.Get(ParamTasks); ok {
+			ts = v.(*ratus.Tasks).Data
+		} else {
+			ts = []*ratus.Task{c.MustGet(ParamTask).(*ratus.Task)}
+		}
+		ctx := c.Request.Context()
+		now := Now(c)
+
+		// Count the tasks to be inserted into each topic in the order they
+		// appear, tasks in batches may belong to different topics.
+		var topics []string
+		m := make(map[string]int64)
+		for _, t := range ts {
+			if m[t.Topic] == 0 {
+				topics = append(topics, t.Topic)
+			}
+			m[t.Topic]++
+		}
+
+		if cc.TopicPending > 0 {
+			for _, topic := range topics {
+				n, err := p.get(ctx, topic, now)
+				if err == nil && n+m[topic] > cc.TopicPending {
+					err = fmt.Errorf("%w: topic %q has reached the maximum of %d pending tasks", ratus.ErrTooManyRequests, topic, cc.TopicPending)
+				}
+				if err != nil {
+					fail(c, err)
+					return
+				}
+			}
+		}
+		if cc.Pending > 0 {
+			n, err := p.get(ctx, "", now)
+			if err == nil && n+int64(len(ts)) > cc.Pending {
+				err = fmt.Errorf("%w: the maximum of %d pending tasks across all topics has been reached", ratus.ErrTooManyRequests, cc.Pending)
+			}
+			if err != nil {
+				fail(c, err)
+				return
+			}
+		}
+
+		c.Next()
+
+		if ts := accepted(c); len(ts) > 0 {
+			for _, topic := range topics {
+				p.add(topic, m[topic], now)
+			}
+			p.add("", int64(len(ts)), now)
+		}
+	}
+}
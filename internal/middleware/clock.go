@@ -0,0 +1,26 @@
+package middleware
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/hyperonym/ratus/clock"
+)
+
+// Clock returns a middleware that stores the clock in the request context,
+// which is used to tell the current time when normalizing requests. The
+// system clock is used if no clock has been stored.
+func Clock(k clock.Clock) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(ParamClock, k)
+	}
+}
+
+// Now returns the current time of the clock stored in the request context.
+func Now(c *gin.Context) time.Time {
+	if k, ok := c.Value(ParamClock).(clock.Clock); ok {
+		return k.Now()
+	}
+	return time.Now()
+}
@@ -1,12 +1,15 @@
 package middleware
 
 import (
+	"context"
 	"fmt"
 	"time"
 
 	"github.com/gin-gonic/gin"
 
 	"github.com/hyperonym/ratus"
+	"github.com/hyperonym/ratus/internal/config"
+	"github.com/hyperonym/ratus/internal/engine"
 )
 
 // Commit returns a middleware that normalizes commits in request bodies.
@@ -16,13 +19,31 @@ func Commit() gin.HandlerFunc {
 		// All fields are optional in a commit.
 		// An empty commit sets the state of the task to "completed".
 		var m ratus.Commit
-		c.ShouldBindJSON(&m)
+		bind(c, &m)
+
+		// The If-Match header takes precedence over the version in the body.
+		if v, err := version(c); err != nil {
+			fail(c, fmt.Errorf("%w: %v", ratus.ErrBadRequest, err))
+			return
+		} else if v != 0 {
+			m.Version = v
+		}
 
 		// Validate and normalize the commit.
-		if err := normalizeCommit(&m); err != nil {
+		if err := checkTime(c, "scheduled time", "defer", m.Scheduled); err != nil {
+			fail(c, fmt.Errorf("%w: %v", ratus.ErrBadRequest, err))
+			return
+		}
+		if err := normalizeCommit(&m, Now(c)); err != nil {
 			fail(c, fmt.Errorf("%w: %v", ratus.ErrBadRequest, err))
 			return
 		}
+		if m.Topic != "" {
+			if err := validateNames(c, "topic", m.Topic); err != nil {
+				fail(c, fmt.Errorf("%w: %v", ratus.ErrBadRequest, err))
+				return
+			}
+		}
 
 		// Store the normalized commit in the request context.
 		c.Set(ParamCommit, &m)
@@ -31,14 +52,59 @@ func Commit() gin.HandlerFunc {
 	}
 }
 
-func normalizeCommit(m *ratus.Commit) error {
+// CommitValidator validates commits that are not submitted through the API,
+// such as the ones of pushed tasks, against the same rules as the commit,
+// names and transitions middlewares.
+type CommitValidator struct {
+	engine      engine.Engine
+	names       *names
+	transitions map[transition]bool
+}
+
+// NewCommitValidator creates a CommitValidator with the configurations of the
+// names and transitions middlewares.
+func NewCommitValidator(nc *config.NameConfig, tc *config.TransitionConfig, g engine.Engine) (*CommitValidator, error) {
+	n, err := parseNames(nc)
+	if err != nil {
+		return nil, err
+	}
+	f, err := parseTransitions(tc.Forbidden)
+	if err != nil {
+		return nil, err
+	}
+	return &CommitValidator{engine: g, names: n, transitions: f}, nil
+}
+
+// Validate normalizes the commit to the task and validates it, returning
+// errors wrapping ErrBadRequest or ErrConflict like the middlewares.
+func (v *CommitValidator) Validate(ctx context.Context, id string, m *ratus.Commit) error {
+	if err := normalizeCommit(m, time.Now()); err != nil {
+		return fmt.Errorf("%w: %v", ratus.ErrBadRequest, err)
+	}
+	if m.Topic != "" {
+		if err := v.names.validate("topic", m.Topic); err != nil {
+			return fmt.Errorf("%w: %v", ratus.ErrBadRequest, err)
+		}
+	}
+	if len(v.transitions) > 0 {
+		return checkTransition(ctx, v.engine, v.transitions, id, m)
+	}
+	return nil
+}
+
+func normalizeCommit(m *ratus.Commit, now time.Time) error {
+
+	// Validate version.
+	if m.Version < 0 {
+		return fmt.Errorf("invalid version %d", m.Version)
+	}
 
 	// Normalize and validate state.
 	if m.State == nil {
 		s := ratus.TaskStateCompleted
 		m.State = &s
 	}
-	if *m.State < ratus.TaskStatePending || *m.State > ratus.TaskStateArchived {
+	if *m.State < ratus.TaskStatePending || *m.State > ratus.TaskStateFailed {
 		return fmt.Errorf("invalid target state %d", *m.State)
 	}
 
@@ -48,7 +114,7 @@ func normalizeCommit(m *ratus.Commit) error {
 		if err != nil {
 			return err
 		}
-		n := time.Now().Add(d)
+		n := now.Add(d)
 		m.Scheduled = &n
 	}
 
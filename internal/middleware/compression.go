@@ -0,0 +1,210 @@
+package middleware
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/hyperonym/ratus/internal/config"
+)
+
+// Names of the supported response compression algorithms.
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// encoder is the common interface of gzip and zstd writers.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// Compression returns a middleware that compresses responses with the
+// configured algorithm if it is accepted by the client, falling back to gzip
+// for clients that do not accept zstd. Responses smaller than the minimum size
+// are sent uncompressed, as well as responses of routes whose paths end with
+// any of the excluded suffixes. A nil middleware is returned if compression is
+// disabled.
+func Compression(cc *config.CompressionConfig, excluded ...string) (gin.HandlerFunc, error) {
+	var pools []*encoderPool
+	a := strings.ToLower(cc.Algorithm)
+	switch a {
+	case CompressionNone, "":
+		return nil, nil
+	case CompressionZstd:
+		l := zstd.EncoderLevelFromZstd(cc.Level)
+		pools = append(pools, &encoderPool{name: CompressionZstd, pool: sync.Pool{New: func() any {
+			z, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(l), zstd.WithEncoderConcurrency(1))
+			return z
+		}}})
+		fallthrough
+	case CompressionGzip:
+		l := cc.Level
+		if l < gzip.BestSpeed || l > gzip.BestCompression {
+			l = gzip.BestSpeed
+			if a == CompressionGzip {
+				return nil, fmt.Errorf("invalid gzip compression level %d", cc.Level)
+			}
+		}
+		pools = append(pools, &encoderPool{name: CompressionGzip, pool: sync.Pool{New: func() any {
+			z, _ := gzip.NewWriterLevel(nil, l)
+			return z
+		}}})
+	default:
+		return nil, fmt.Errorf("unknown compression algorithm: %s", cc.Algorithm)
+	}
+
+	return func(c *gin.Context) {
+		for _, s := range excluded {
+			if strings.HasSuffix(c.FullPath(), s) {
+				return
+			}
+		}
+		c.Writer.Header().Add("Vary", "Accept-Encoding")
+
+		// Select the first algorithm accepted by the client.
+		var p *encoderPool
+		h := c.GetHeader("Accept-Encoding")
+		for _, x := range pools {
+			if accepts(h, x.name) {
+				p = x
+				break
+			}
+		}
+		if p == nil {
+			return
+		}
+
+		w := &compressWriter{ResponseWriter: c.Writer, pool: p, min: cc.MinSize, size: -1}
+		c.Writer = w
+		defer w.close()
+		c.Next()
+	}, nil
+}
+
+// encoderPool reuses encoders of a compression algorithm.
+type encoderPool struct {
+	name string
+	pool sync.Pool
+}
+
+// compressWriter buffers the beginning of a response until it reaches the
+// minimum size for compression, after which the response is compressed.
+type compressWriter struct {
+	gin.ResponseWriter
+	pool    *encoderPool
+	min     int
+	buf     []byte
+	size    int
+	decided bool
+	encoder encoder
+}
+
+// Write compresses the data if the response has been decided to compress, or
+// buffers it until the decision can be made.
+func (w *compressWriter) Write(b []byte) (int, error) {
+	w.size = max(w.size, 0) + len(b)
+	if !w.decided {
+		w.buf = append(w.buf, b...)
+		if len(w.buf) < w.min {
+			return len(b), nil
+		}
+		if err := w.decide(true); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if w.encoder != nil {
+		return w.encoder.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// WriteString writes the string like Write.
+func (w *compressWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Written returns whether the handler has written any data, including data
+// that is still buffered.
+func (w *compressWriter) Written() bool {
+	return w.size >= 0 || w.ResponseWriter.Written()
+}
+
+// Size returns the number of uncompressed bytes written by the handler.
+func (w *compressWriter) Size() int {
+	return w.size
+}
+
+// Flush sends the buffered data to the client. Responses that are flushed
+// before reaching the minimum size are streamed uncompressed.
+func (w *compressWriter) Flush() {
+	if !w.decided {
+		w.decide(false)
+	}
+	if w.encoder != nil {
+		w.encoder.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+// decide determines whether to compress the response, and writes the buffered
+// data accordingly. Responses that have been encoded by the handler are never
+// compressed again.
+func (w *compressWriter) decide(compress bool) error {
+	w.decided = true
+	h := w.Header()
+	if compress && h.Get("Content-Encoding") == "" && h.Get("Content-Range") == "" {
+		h.Set("Content-Encoding", w.pool.name)
+		h.Del("Content-Length")
+		w.encoder = w.pool.pool.Get().(encoder)
+		w.encoder.Reset(w.ResponseWriter)
+	}
+	b := w.buf
+	w.buf = nil
+	if len(b) == 0 {
+		return nil
+	}
+	var err error
+	if w.encoder != nil {
+		_, err = w.encoder.Write(b)
+	} else {
+		_, err = w.ResponseWriter.Write(b)
+	}
+	return err
+}
+
+// close writes the remaining data and returns the encoder to the pool.
+func (w *compressWriter) close() {
+	if !w.decided {
+		w.decide(false)
+	}
+	if w.encoder != nil {
+		w.encoder.Close()
+		w.encoder.Reset(nil)
+		w.pool.pool.Put(w.encoder)
+		w.encoder = nil
+	}
+}
+
+// accepts returns whether the Accept-Encoding header field contains the
+// encoding with a non-zero quality value.
+func accepts(header, encoding string) bool {
+	for _, e := range strings.Split(header, ",") {
+		n, q, _ := strings.Cut(e, ";")
+		if !strings.EqualFold(strings.TrimSpace(n), encoding) {
+			continue
+		}
+		q = strings.ReplaceAll(strings.TrimSpace(q), " ", "")
+		return !strings.HasPrefix(q, "q=0") || strings.Trim(q[3:], ".0") != ""
+	}
+	return false
+}
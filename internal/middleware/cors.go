@@ -0,0 +1,61 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gin-contrib/cors"
+	"github.com/gin-gonic/gin"
+
+	"github.com/hyperonym/ratus/internal/config"
+)
+
+// CORS returns a middleware that handles cross-origin resource sharing with
+// the configured policy. A nil middleware is returned if no origin is
+// allowed, in which case cross-origin requests are left to browsers to block.
+func CORS(cc *config.CORSConfig) (gin.HandlerFunc, error) {
+	o := split(cc.AllowOrigins)
+	if len(o) == 0 {
+		return nil, nil
+	}
+	c := cors.Config{
+		AllowMethods:     split(cc.AllowMethods),
+		AllowHeaders:     split(cc.AllowHeaders),
+		ExposeHeaders:    []string{"ETag", "X-Total-Count", HeaderServerTime},
+		AllowCredentials: cc.AllowCredentials,
+		MaxAge:           cc.MaxAge,
+		AllowWildcard:    true,
+	}
+	if len(o) == 1 && o[0] == "*" {
+		c.AllowAllOrigins = true
+	} else {
+		c.AllowOrigins = o
+	}
+
+	// Browsers reject credentialed responses that allow all origins.
+	if c.AllowAllOrigins && c.AllowCredentials {
+		return nil, errors.New("allowing credentials requires specific origins")
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	for _, e := range c.AllowOrigins {
+		if strings.Count(e, "*") > 1 {
+			return nil, fmt.Errorf("invalid origin %q: only one wildcard is allowed", e)
+		}
+	}
+
+	return cors.New(c), nil
+}
+
+// split returns the non-empty elements of a comma-separated list.
+func split(s string) []string {
+	var v []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			v = append(v, e)
+		}
+	}
+	return v
+}
@@ -0,0 +1,175 @@
+package middleware
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/hyperonym/ratus"
+	"github.com/hyperonym/ratus/internal/config"
+)
+
+// Header fields of idempotent requests and replayed responses.
+const (
+	HeaderIdempotencyKey     = "Idempotency-Key"
+	HeaderIdempotentReplayed = "Idempotent-Replayed"
+)
+
+// response is a cached response to an idempotent request. Responses without
+// a status code are still in progress.
+type response struct {
+	key     string
+	digest  [sha256.Size]byte
+	expires time.Time
+
+	status      int
+	contentType string
+	body        []byte
+}
+
+// responses is a cache of responses to idempotent requests. Since all entries
+// share the same window, the list of entries is ordered by expiration time.
+type responses struct {
+	mu       sync.Mutex
+	window   time.Duration
+	capacity int
+	entries  map[string]*list.Element
+	order    *list.List
+}
+
+// get returns the cached response of the key, or reserves the key for a new
+// request if there is none. Expired and excessive entries are evicted.
+func (s *responses) get(key string, digest [sha256.Size]byte) (*response, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := time.Now()
+	for e := s.order.Front(); e != nil; e = s.order.Front() {
+		if r := e.Value.(*response); n.Before(r.expires) && (s.capacity <= 0 || s.order.Len() < s.capacity) {
+			break
+		}
+		s.remove(e)
+	}
+	if e, ok := s.entries[key]; ok {
+		return e.Value.(*response), true
+	}
+	r := &response{key: key, digest: digest, expires: n.Add(s.window)}
+	s.entries[key] = s.order.PushBack(r)
+	return r, false
+}
+
+// put stores the result of a request in the reserved response.
+func (s *responses) put(r *response, status int, contentType string, body []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r.status, r.contentType, r.body = status, contentType, body
+}
+
+// release removes the reserved response to allow the request to be retried.
+func (s *responses) release(r *response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.entries[r.key]; ok && e.Value == r {
+		s.remove(e)
+	}
+}
+
+// remove removes the entry from the cache. The caller must hold the lock.
+func (s *responses) remove(e *list.Element) {
+	delete(s.entries, e.Value.(*response).key)
+	s.order.Remove(e)
+}
+
+// recorder captures the response body while writing it to the client.
+type recorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+// Write implements the io.Writer interface.
+func (w *recorder) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// WriteString implements the io.StringWriter interface.
+func (w *recorder) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// Idempotency returns a middleware that caches responses to POST and PATCH
+// requests with an Idempotency-Key header, and replays them to subsequent
+// requests with the same key within the window, so that retries after network
+// failures are not applied twice. Responses to server errors and rate limited
+// requests are not cached to allow retrying. Responses are cached in memory
+// and are not shared across instances.
+func Idempotency(ic *config.IdempotencyConfig) gin.HandlerFunc {
+	s := responses{
+		window:   ic.Window,
+		capacity: ic.Capacity,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+	return func(c *gin.Context) {
+		k := c.GetHeader(HeaderIdempotencyKey)
+		if s.window <= 0 || k == "" || (c.Request.Method != http.MethodPost && c.Request.Method != http.MethodPatch) {
+			c.Next()
+			return
+		}
+
+		// Read the request body to detect reuses of keys for different
+		// requests, and restore it for subsequent handlers.
+		b, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			fail(c, fmt.Errorf("%w: %v", ratus.ErrBadRequest, err))
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(b))
+		d := sha256.Sum256(b)
+
+		// Keys are scoped to the method and path of the request.
+		r, ok := s.get(c.Request.Method+" "+c.Request.URL.Path+" "+k, d)
+		if ok {
+			s.mu.Lock()
+			status, contentType, body := r.status, r.contentType, r.body
+			s.mu.Unlock()
+			switch {
+			case r.digest != d:
+				fail(c, fmt.Errorf("%w: idempotency key has been used for a different request", ratus.ErrConflict))
+			case status == 0:
+				fail(c, fmt.Errorf("%w: request with the same idempotency key is in progress", ratus.ErrConflict))
+			default:
+				c.Header(HeaderIdempotentReplayed, "true")
+				c.Data(status, contentType, body)
+				c.Abort()
+			}
+			return
+		}
+
+		// Capture the response and cache it unless the request can be
+		// retried.
+		w := recorder{ResponseWriter: c.Writer}
+		c.Writer = &w
+		defer func() {
+			c.Writer = w.ResponseWriter
+			if p := recover(); p != nil {
+				s.release(r)
+				panic(p)
+			}
+			if v := w.Status(); v >= http.StatusInternalServerError || v == http.StatusTooManyRequests || v == ratus.StatusClientClosedRequest {
+				s.release(r)
+				return
+			}
+			s.put(r, w.Status(), w.Header().Get("Content-Type"), w.body.Bytes())
+		}()
+
+		c.Next()
+	}
+}
@@ -0,0 +1,67 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/hyperonym/ratus"
+)
+
+// Labels returns a middleware that normalizes label selectors in query
+// parameters. A selector consists of comma-separated key-value pairs, such as
+// "tenant=foo,region=bar", and matches tasks with all of the labels.
+func Labels() gin.HandlerFunc {
+	return func(c *gin.Context) {
+
+		// Parse and validate the label selector.
+		v, err := parseLabels(c.Query(ParamLabels))
+		if err != nil {
+			fail(c, fmt.Errorf("%w: %v", ratus.ErrBadRequest, err))
+			return
+		}
+
+		// Store the normalized label selector in the request context.
+		c.Set(ParamLabels, v)
+
+		c.Next()
+	}
+}
+
+func parseLabels(s string) (map[string]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	v := make(map[string]string)
+	for _, p := range strings.Split(s, ",") {
+		k, x, ok := strings.Cut(p, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid label selector %q", s)
+		}
+		if y, ok := v[k]; ok && y != x {
+			return nil, fmt.Errorf("conflicting values for label %q", k)
+		}
+		v[k] = x
+	}
+	if err := validateLabels(v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func validateLabels(m map[string]string) error {
+
+	// Label keys are used as field names by storage engines, so they must
+	// not be empty or contain characters with special meanings.
+	for k := range m {
+		if k == "" {
+			return errors.New("label key must not be empty")
+		}
+		if strings.ContainsAny(k, ".$,=") {
+			return fmt.Errorf("invalid label key %q", k)
+		}
+	}
+	return nil
+}
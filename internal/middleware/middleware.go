@@ -2,23 +2,84 @@
 package middleware
 
 import (
+	"fmt"
+	"strconv"
+	"strings"
+
 	"github.com/gin-gonic/gin"
 
 	"github.com/hyperonym/ratus"
+	"github.com/hyperonym/ratus/internal/wire"
 )
 
 // Name constants for parameter keys.
 const (
-	ParamID      = "id"
-	ParamTopic   = "topic"
-	ParamLimit   = "limit"
-	ParamOffset  = "offset"
-	ParamTask    = "task"
-	ParamTasks   = "tasks"
-	ParamCommit  = "commit"
-	ParamPromise = "promise"
+	ParamID       = "id"
+	ParamTopic    = "topic"
+	ParamConsumer = "consumer"
+	ParamProducer = "producer"
+	ParamAction   = "action"
+	ParamLimit    = "limit"
+	ParamOffset   = "offset"
+	ParamTask     = "task"
+	ParamTasks    = "tasks"
+	ParamCommit   = "commit"
+	ParamPromise  = "promise"
+	ParamQuota    = "quota"
+	ParamMove     = "move"
+	ParamLabels   = "labels"
+	ParamInclude  = "include"
+	ParamAfter    = "after"
+	ParamCursor   = "cursor"
+	ParamCount    = "count"
+	ParamSort     = "sort"
+	ParamTime     = "time"
+	ParamConfirm  = "confirm"
+	ParamDefaults = "defaults"
+	ParamNames    = "names"
+	ParamClock    = "clock"
+	ParamFrom     = "from"
+	ParamTo       = "to"
+	ParamProgress = "progress"
+	ParamNext     = "next"
+	ParamTimeouts = "timeouts"
+	ParamSkew     = "skew"
+	ParamBatch    = "batch"
+	ParamAdmin    = "admin"
+	ParamVersion  = "version"
+	ParamTimeout  = "timeout"
+	ParamInterval = "interval"
 )
 
+// HeaderIfMatch is the header field for making updates conditional on the
+// version of the task, which is exposed as the entity tag of the task.
+const HeaderIfMatch = "If-Match"
+
+// bind decodes the request body in the wire format specified in the
+// Content-Type header. Bodies in unknown formats are decoded as JSON.
+func bind(c *gin.Context, v any) error {
+	f := wire.Parse(c.ContentType())
+	if f == "" || f == wire.JSON {
+		return c.ShouldBindJSON(v)
+	}
+	return wire.Decode(c.Request.Body, f, v)
+}
+
+// version parses the version of the task in the If-Match header. Entity tags
+// are accepted with or without quotes, and zero is returned if the header is
+// not present.
+func version(c *gin.Context) (int64, error) {
+	h := c.GetHeader(HeaderIfMatch)
+	if h == "" {
+		return 0, nil
+	}
+	v, err := strconv.ParseInt(strings.Trim(strings.TrimSpace(h), `"`), 10, 64)
+	if err != nil || v <= 0 {
+		return 0, fmt.Errorf("invalid %s header %q", HeaderIfMatch, h)
+	}
+	return v, nil
+}
+
 func fail(c *gin.Context, err error) {
 	e := ratus.NewError(err)
 	c.AbortWithStatusJSON(e.Error.Code, e)
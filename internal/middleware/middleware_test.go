@@ -1,21 +1,37 @@
 package middleware_test
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/zstd"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"github.com/hyperonym/ratus"
+	"github.com/hyperonym/ratus/clock"
 	"github.com/hyperonym/ratus/internal/config"
+	"github.com/hyperonym/ratus/internal/engine/memdb"
+	"github.com/hyperonym/ratus/internal/engine/stub"
 	"github.com/hyperonym/ratus/internal/middleware"
 	"github.com/hyperonym/ratus/internal/reqtest"
 )
 
 type group struct{}
 
+// calls counts the requests handled by the idempotency endpoints.
+var calls atomic.Int32
+
 func (g *group) Prefixes() []string {
 	return []string{"/"}
 }
@@ -34,6 +50,7 @@ func (g *group) Mount(r *gin.RouterGroup) {
 		c.JSON(http.StatusOK, gin.H{
 			"limit":  c.GetInt(middleware.ParamLimit),
 			"offset": c.GetInt(middleware.ParamOffset),
+			"count":  c.GetBool(middleware.ParamCount),
 		})
 	})
 
@@ -47,6 +64,78 @@ func (g *group) Mount(r *gin.RouterGroup) {
 		})
 	})
 
+	r.GET("/cursor", middleware.Cursor(&config.PaginationConfig{
+		MaxLimit:  20,
+		MaxOffset: 20,
+	}), func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"limit": c.GetInt(middleware.ParamLimit),
+			"after": c.GetString(middleware.ParamAfter),
+			"count": c.GetBool(middleware.ParamCount),
+		})
+	})
+
+	r.GET("/sort", middleware.Cursor(&config.PaginationConfig{
+		MaxLimit:  20,
+		MaxOffset: 20,
+	}), middleware.Sort("id", "scheduled"), func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"sort": c.GetString(middleware.ParamSort),
+			"time": c.Value(middleware.ParamTime),
+		})
+	})
+
+	r.GET("/admin/enabled", middleware.Admin(&config.AdminConfig{Token: "secret"}), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	r.GET("/admin/disabled", middleware.Admin(&config.AdminConfig{}), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	idempotency := middleware.Idempotency(&config.IdempotencyConfig{Window: time.Minute, Capacity: 2})
+	r.POST("/idempotency", idempotency, func(c *gin.Context) {
+		c.JSON(http.StatusCreated, gin.H{"calls": calls.Add(1)})
+	})
+	r.POST("/idempotency/limited", idempotency, func(c *gin.Context) {
+		c.JSON(http.StatusTooManyRequests, gin.H{"calls": calls.Add(1)})
+	})
+
+	r.GET("/labels", middleware.Labels(), func(c *gin.Context) {
+		c.JSON(http.StatusOK, c.GetStringMapString(middleware.ParamLabels))
+	})
+
+	r.GET("/range", middleware.Range(), func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"from": c.Value(middleware.ParamFrom),
+			"to":   c.Value(middleware.ParamTo),
+		})
+	})
+
+	r.PUT("/topics/:topic", middleware.Topic(), func(c *gin.Context) {
+		c.JSON(http.StatusOK, c.MustGet(middleware.ParamTopic))
+	})
+
+	r.POST("/topics/:topic/move", middleware.Move(), func(c *gin.Context) {
+		c.JSON(http.StatusOK, c.MustGet(middleware.ParamMove))
+	})
+
+	r.POST("/batch", middleware.BatchGet(), func(c *gin.Context) {
+		c.JSON(http.StatusOK, c.MustGet(middleware.ParamBatch))
+	})
+
+	r.PATCH("/topics/:topic/tasks/:id/progress", middleware.Progress(), func(c *gin.Context) {
+		c.JSON(http.StatusOK, c.MustGet(middleware.ParamProgress))
+	})
+
+	r.PATCH("/next/topics/:topic/tasks/:id", middleware.Next(), func(c *gin.Context) {
+		c.JSON(http.StatusOK, c.Value(middleware.ParamNext))
+	})
+
+	r.PUT("/quotas/:producer", middleware.Quota(), func(c *gin.Context) {
+		c.JSON(http.StatusOK, c.MustGet(middleware.ParamQuota))
+	})
+
 	r.POST("/topics/:topic/tasks/:id", middleware.Task(), func(c *gin.Context) {
 		c.JSON(http.StatusOK, c.MustGet(middleware.ParamTask))
 	})
@@ -55,6 +144,21 @@ func (g *group) Mount(r *gin.RouterGroup) {
 		c.JSON(http.StatusOK, c.MustGet(middleware.ParamTasks))
 	})
 
+	defaults := func(c *gin.Context) {
+		c.Set(middleware.ParamDefaults, &ratus.TaskDefaults{Defer: "1h", Labels: map[string]string{"tenant": "foo", "region": "bar"}})
+	}
+	r.POST("/defaults/topics/:topic/tasks", defaults, middleware.Tasks(), func(c *gin.Context) {
+		c.JSON(http.StatusOK, c.MustGet(middleware.ParamTasks))
+	})
+
+	k := middleware.Clock(clock.NewFake(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)))
+	r.POST("/clock/topics/:topic/tasks/:id", k, middleware.Task(), func(c *gin.Context) {
+		c.JSON(http.StatusOK, c.MustGet(middleware.ParamTask))
+	})
+	r.POST("/clock/topics/:topic/promises/:id", k, middleware.Promise(), func(c *gin.Context) {
+		c.JSON(http.StatusOK, c.MustGet(middleware.ParamPromise))
+	})
+
 	r.POST("/topics/:topic/promises/:id", middleware.Promise(), func(c *gin.Context) {
 		c.JSON(http.StatusOK, c.MustGet(middleware.ParamPromise))
 	})
@@ -79,6 +183,92 @@ func TestMiddleware(t *testing.T) {
 		r2.AssertBodyContains(`endpoint="/prometheus"`)
 	})
 
+	t.Run("clock", func(t *testing.T) {
+		t.Parallel()
+
+		// Relative times are converted based on the clock in the context.
+		req := httptest.NewRequest(http.MethodPost, "/clock/topics/test/tasks/1", strings.NewReader(`{"defer":"1h"}`))
+		r1 := reqtest.Record(t, h, req)
+		r1.AssertStatusCode(http.StatusOK)
+		r1.AssertBodyContains(`"produced":"2022-01-01T00:00:00Z"`)
+		r1.AssertBodyContains(`"scheduled":"2022-01-01T01:00:00Z"`)
+		req = httptest.NewRequest(http.MethodPost, "/clock/topics/test/promises/1", strings.NewReader(`{"timeout":"30s"}`))
+		r2 := reqtest.Record(t, h, req)
+		r2.AssertStatusCode(http.StatusOK)
+		r2.AssertBodyContains(`"deadline":"2022-01-01T00:00:30Z"`)
+	})
+
+	t.Run("admin", func(t *testing.T) {
+		t.Parallel()
+		for _, x := range []struct {
+			path   string
+			header string
+			status int
+		}{
+			{"/admin/enabled", "Bearer secret", http.StatusOK},
+			{"/admin/enabled", "Bearer wrong", http.StatusUnauthorized},
+			{"/admin/enabled", "secret", http.StatusUnauthorized},
+			{"/admin/enabled", "", http.StatusUnauthorized},
+			{"/admin/disabled", "Bearer ", http.StatusUnauthorized},
+		} {
+			req := httptest.NewRequest(http.MethodGet, x.path, nil)
+			if x.header != "" {
+				req.Header.Set("Authorization", x.header)
+			}
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(x.status)
+		}
+	})
+
+	t.Run("idempotency", func(t *testing.T) {
+		t.Parallel()
+		post := func(path, key, body string) *reqtest.ResponseRecord {
+			req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+			if key != "" {
+				req.Header.Set(middleware.HeaderIdempotencyKey, key)
+			}
+			return reqtest.Record(t, h, req)
+		}
+
+		// Retries with the same key and body should be replayed.
+		r1 := post("/idempotency", "a", "foo")
+		r1.AssertStatusCode(http.StatusCreated)
+		r2 := post("/idempotency", "a", "foo")
+		r2.AssertStatusCode(http.StatusCreated)
+		r2.AssertHeaderContains("Content-Type", "application/json")
+		r2.AssertHeaderContains(middleware.HeaderIdempotentReplayed, "true")
+		r2.AssertBodyContains(string(r1.Body))
+
+		// Reusing the key for a different request should be rejected.
+		r3 := post("/idempotency", "a", "bar")
+		r3.AssertStatusCode(http.StatusConflict)
+		r3.AssertBodyContains("different request")
+
+		// Requests without keys should always be handled.
+		r4 := post("/idempotency", "", "foo")
+		r5 := post("/idempotency", "", "foo")
+		if string(r4.Body) == string(r5.Body) {
+			t.Errorf("requests without keys should not be replayed, got %s", r5.Body)
+		}
+
+		// Rate limited requests should not be cached to allow retrying.
+		r6 := post("/idempotency/limited", "a", "foo")
+		r6.AssertStatusCode(http.StatusTooManyRequests)
+		r7 := post("/idempotency/limited", "a", "foo")
+		if string(r6.Body) == string(r7.Body) {
+			t.Errorf("rate limited requests should not be replayed, got %s", r7.Body)
+		}
+
+		// The oldest responses should be evicted once the capacity is
+		// exceeded.
+		post("/idempotency", "b", "foo")
+		post("/idempotency", "c", "foo")
+		r8 := post("/idempotency", "a", "foo")
+		if string(r8.Body) == string(r1.Body) {
+			t.Errorf("evicted responses should not be replayed, got %s", r8.Body)
+		}
+	})
+
 	t.Run("pagination", func(t *testing.T) {
 		t.Parallel()
 
@@ -92,6 +282,15 @@ func TestMiddleware(t *testing.T) {
 				r.AssertStatusCode(http.StatusOK)
 				r.AssertBodyContains(`"limit":10`)
 				r.AssertBodyContains(`"offset":5`)
+				r.AssertBodyContains(`"count":false`)
+			})
+
+			t.Run("count", func(t *testing.T) {
+				t.Parallel()
+				req := httptest.NewRequest(http.MethodGet, "/pagination/20?count=true", nil)
+				r := reqtest.Record(t, h, req)
+				r.AssertStatusCode(http.StatusOK)
+				r.AssertBodyContains(`"count":true`)
 			})
 
 			t.Run("bind", func(t *testing.T) {
@@ -149,192 +348,1745 @@ func TestMiddleware(t *testing.T) {
 		})
 	})
 
-	t.Run("task", func(t *testing.T) {
+	t.Run("cursor", func(t *testing.T) {
 		t.Parallel()
 
+		t.Run("default", func(t *testing.T) {
+			t.Parallel()
+			req := httptest.NewRequest(http.MethodGet, "/cursor", nil)
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusOK)
+			r.AssertBodyContains(`"limit":10`)
+			r.AssertBodyContains(`"after":""`)
+		})
+
 		t.Run("normal", func(t *testing.T) {
 			t.Parallel()
-			req := reqtest.NewRequestJSON(http.MethodPost, "/topics/test/tasks/1", &ratus.Task{})
+			req := httptest.NewRequest(http.MethodGet, "/cursor?limit=5&cursor="+middleware.EncodeCursor("", "foo", nil), nil)
 			r := reqtest.Record(t, h, req)
 			r.AssertStatusCode(http.StatusOK)
-			r.AssertHeaderContains("Content-Type", "application/json")
-			r.AssertBodyContains(`"_id":"1"`)
-			r.AssertBodyContains(`"topic":"test"`)
-			r.AssertBodyContains(`"state":0`)
-			r.AssertBodyContains(`"produced":"`)
-			r.AssertBodyContains(`"scheduled":`)
+			r.AssertBodyContains(`"limit":5`)
+			r.AssertBodyContains(`"after":"foo"`)
 		})
 
-		t.Run("bind", func(t *testing.T) {
+		t.Run("count", func(t *testing.T) {
 			t.Parallel()
-			req := reqtest.NewRequestJSON(http.MethodPost, "/topics/test/tasks/1", gin.H{"_id": 1})
+			req := httptest.NewRequest(http.MethodGet, "/cursor?count=1", nil)
 			r := reqtest.Record(t, h, req)
-			r.AssertStatusCode(http.StatusBadRequest)
-			r.AssertBodyContains("cannot unmarshal number")
+			r.AssertStatusCode(http.StatusOK)
+			r.AssertBodyContains(`"count":true`)
 		})
 
-		t.Run("eof", func(t *testing.T) {
+		t.Run("invalid", func(t *testing.T) {
 			t.Parallel()
-			req := httptest.NewRequest(http.MethodPost, "/topics/test/tasks/1", nil)
+			req := httptest.NewRequest(http.MethodGet, "/cursor?cursor=foo", nil)
 			r := reqtest.Record(t, h, req)
 			r.AssertStatusCode(http.StatusBadRequest)
-			r.AssertBodyContains("missing request body")
+			r.AssertBodyContains("invalid cursor")
 		})
 
-		t.Run("id", func(t *testing.T) {
+		t.Run("limit", func(t *testing.T) {
 			t.Parallel()
-			req := reqtest.NewRequestJSON(http.MethodPost, "/topics/test/tasks/1", &ratus.Task{ID: "2"})
+			req := httptest.NewRequest(http.MethodGet, "/cursor?limit=21", nil)
 			r := reqtest.Record(t, h, req)
 			r.AssertStatusCode(http.StatusBadRequest)
-			r.AssertBodyContains("inconsistent with the path parameter")
+			r.AssertBodyContains("exceeded maximum allowed limit of 20")
 		})
+	})
 
-		t.Run("topic", func(t *testing.T) {
+	t.Run("sort", func(t *testing.T) {
+		t.Parallel()
+
+		t.Run("default", func(t *testing.T) {
 			t.Parallel()
-			req := reqtest.NewRequestJSON(http.MethodPost, "/topics//tasks/1", &ratus.Task{})
+			req := httptest.NewRequest(http.MethodGet, "/sort", nil)
 			r := reqtest.Record(t, h, req)
-			r.AssertStatusCode(http.StatusBadRequest)
-			r.AssertBodyContains("topic must not be empty")
+			r.AssertStatusCode(http.StatusOK)
+			r.AssertBodyContains(`"sort":"id"`)
 		})
 
-		t.Run("state", func(t *testing.T) {
+		t.Run("desc", func(t *testing.T) {
 			t.Parallel()
-			req := reqtest.NewRequestJSON(http.MethodPost, "/topics/test/tasks/1", &ratus.Task{State: 9})
+			req := httptest.NewRequest(http.MethodGet, "/sort?sort=-scheduled", nil)
 			r := reqtest.Record(t, h, req)
-			r.AssertStatusCode(http.StatusBadRequest)
-			r.AssertBodyContains("invalid state")
+			r.AssertStatusCode(http.StatusOK)
+			r.AssertBodyContains(`"sort":"-scheduled"`)
 		})
 
-		t.Run("defer", func(t *testing.T) {
+		t.Run("cursor", func(t *testing.T) {
 			t.Parallel()
+			n := time.Date(2022, 7, 29, 20, 0, 0, 0, time.UTC)
+			req := httptest.NewRequest(http.MethodGet, "/sort?cursor="+middleware.EncodeCursor("-scheduled", "foo", &n), nil)
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusOK)
+			r.AssertBodyContains(`"sort":"-scheduled"`)
+			r.AssertBodyContains(`"time":"2022-07-29T20:00:00Z"`)
+		})
 
-			t.Run("normal", func(t *testing.T) {
-				t.Parallel()
-				req := reqtest.NewRequestJSON(http.MethodPost, "/topics/test/tasks/1", &ratus.Task{Defer: "10m"})
-				r := reqtest.Record(t, h, req)
-				r.AssertStatusCode(http.StatusOK)
-			})
+		t.Run("invalid", func(t *testing.T) {
+			t.Parallel()
+			req := httptest.NewRequest(http.MethodGet, "/sort?sort=consumed", nil)
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusBadRequest)
+			r.AssertBodyContains(`invalid sort order \"consumed\"`)
+		})
 
-			t.Run("invalid", func(t *testing.T) {
-				t.Parallel()
-				req := reqtest.NewRequestJSON(http.MethodPost, "/topics/test/tasks/1", &ratus.Task{Defer: "foo"})
-				r := reqtest.Record(t, h, req)
-				r.AssertStatusCode(http.StatusBadRequest)
-				r.AssertBodyContains("invalid duration")
-			})
+		t.Run("mismatch", func(t *testing.T) {
+			t.Parallel()
+			req := httptest.NewRequest(http.MethodGet, "/sort?sort=id&cursor="+middleware.EncodeCursor("-scheduled", "foo", nil), nil)
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusBadRequest)
+			r.AssertBodyContains("sort order does not match the cursor")
 		})
 	})
 
-	t.Run("tasks", func(t *testing.T) {
+	t.Run("labels", func(t *testing.T) {
 		t.Parallel()
 
 		t.Run("normal", func(t *testing.T) {
 			t.Parallel()
-			req := reqtest.NewRequestJSON(http.MethodPost, "/topics/test/tasks", &ratus.Tasks{
-				Data: []*ratus.Task{{ID: "1"}},
-			})
+			req := httptest.NewRequest(http.MethodGet, "/labels?labels=tenant=foo,region=", nil)
 			r := reqtest.Record(t, h, req)
 			r.AssertStatusCode(http.StatusOK)
-			r.AssertHeaderContains("Content-Type", "application/json")
-			r.AssertBodyContains(`"_id":"1"`)
-			r.AssertBodyContains(`"topic":"test"`)
-			r.AssertBodyContains(`"data":[`)
+			r.AssertBodyContains(`"tenant":"foo"`)
+			r.AssertBodyContains(`"region":""`)
 		})
 
-		t.Run("bind", func(t *testing.T) {
+		t.Run("empty", func(t *testing.T) {
 			t.Parallel()
-			req := reqtest.NewRequestJSON(http.MethodPost, "/topics/test/tasks", gin.H{"data": 1})
+			req := httptest.NewRequest(http.MethodGet, "/labels", nil)
 			r := reqtest.Record(t, h, req)
-			r.AssertStatusCode(http.StatusBadRequest)
-			r.AssertBodyContains("cannot unmarshal number")
+			r.AssertStatusCode(http.StatusOK)
+			r.AssertBodyContains("null")
 		})
 
-		t.Run("eof", func(t *testing.T) {
+		t.Run("invalid", func(t *testing.T) {
 			t.Parallel()
-			req := httptest.NewRequest(http.MethodPost, "/topics/test/tasks", nil)
+			req := httptest.NewRequest(http.MethodGet, "/labels?labels=tenant", nil)
 			r := reqtest.Record(t, h, req)
 			r.AssertStatusCode(http.StatusBadRequest)
-			r.AssertBodyContains("missing request body")
+			r.AssertBodyContains("invalid label selector")
 		})
 
-		t.Run("empty", func(t *testing.T) {
+		t.Run("conflict", func(t *testing.T) {
 			t.Parallel()
-			req := reqtest.NewRequestJSON(http.MethodPost, "/topics/test/tasks", &ratus.Tasks{})
+			req := httptest.NewRequest(http.MethodGet, "/labels?labels=tenant=foo,tenant=bar", nil)
 			r := reqtest.Record(t, h, req)
-			r.AssertStatusCode(http.StatusOK)
-			r.AssertBodyContains(`{"data":[]}`)
+			r.AssertStatusCode(http.StatusBadRequest)
+			r.AssertBodyContains("conflicting values")
 		})
 
-		t.Run("id", func(t *testing.T) {
+		t.Run("key", func(t *testing.T) {
 			t.Parallel()
-			req := reqtest.NewRequestJSON(http.MethodPost, "/topics/test/tasks", &ratus.Tasks{
-				Data: []*ratus.Task{{Producer: "foo"}},
-			})
+			req := httptest.NewRequest(http.MethodGet, "/labels?labels=a.b=foo", nil)
 			r := reqtest.Record(t, h, req)
 			r.AssertStatusCode(http.StatusBadRequest)
-			r.AssertBodyContains("ID must not be empty")
+			r.AssertBodyContains("invalid label key")
 		})
 	})
 
-	t.Run("promise", func(t *testing.T) {
+	t.Run("range", func(t *testing.T) {
 		t.Parallel()
 
 		t.Run("normal", func(t *testing.T) {
 			t.Parallel()
-			req := reqtest.NewRequestJSON(http.MethodPost, "/topics/test/promises/1?consumer=foo", &ratus.Promise{})
+			req := httptest.NewRequest(http.MethodGet, "/range?from=2022-01-01T00:00:00Z&to=2022-01-02T00:00:00%2B08:00", nil)
 			r := reqtest.Record(t, h, req)
 			r.AssertStatusCode(http.StatusOK)
-			r.AssertHeaderContains("Content-Type", "application/json")
-			r.AssertBodyContains(`"_id":"1"`)
-			r.AssertBodyContains(`"consumer":"foo"`)
-			r.AssertBodyContains(`"deadline":`)
+			r.AssertBodyContains(`"from":"2022-01-01T00:00:00Z"`)
+			r.AssertBodyContains(`"to":"2022-01-02T00:00:00+08:00"`)
 		})
 
-		t.Run("id", func(t *testing.T) {
+		t.Run("empty", func(t *testing.T) {
 			t.Parallel()
-			req := reqtest.NewRequestJSON(http.MethodPost, "/topics/test/promises/1", &ratus.Promise{ID: "2"})
+			req := httptest.NewRequest(http.MethodGet, "/range", nil)
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusOK)
+			r.AssertBodyContains(`"from":null`)
+			r.AssertBodyContains(`"to":null`)
+		})
+
+		t.Run("invalid", func(t *testing.T) {
+			t.Parallel()
+			req := httptest.NewRequest(http.MethodGet, "/range?to=yesterday", nil)
 			r := reqtest.Record(t, h, req)
 			r.AssertStatusCode(http.StatusBadRequest)
-			r.AssertBodyContains("inconsistent with the path parameter")
+			r.AssertBodyContains("invalid time")
 		})
 
-		t.Run("timeout", func(t *testing.T) {
+		t.Run("reversed", func(t *testing.T) {
 			t.Parallel()
-			req := reqtest.NewRequestJSON(http.MethodPost, "/topics/test/promises/1", &ratus.Promise{Timeout: "foo"})
+			req := httptest.NewRequest(http.MethodGet, "/range?from=2022-01-02T00:00:00Z&to=2022-01-01T00:00:00Z", nil)
 			r := reqtest.Record(t, h, req)
 			r.AssertStatusCode(http.StatusBadRequest)
-			r.AssertBodyContains("invalid duration")
+			r.AssertBodyContains("must not be before its start")
 		})
 	})
 
-	t.Run("commit", func(t *testing.T) {
+	t.Run("topic", func(t *testing.T) {
 		t.Parallel()
 
 		t.Run("normal", func(t *testing.T) {
 			t.Parallel()
-			req := reqtest.NewRequestJSON(http.MethodPatch, "/topics/test/tasks/1", &ratus.Commit{Defer: "10m"})
+			req := reqtest.NewRequestJSON(http.MethodPut, "/topics/test", &ratus.Topic{Count: 1, Retention: "1h", Fair: true})
 			r := reqtest.Record(t, h, req)
 			r.AssertStatusCode(http.StatusOK)
 			r.AssertHeaderContains("Content-Type", "application/json")
-			r.AssertBodyContains(`"state":2`)
-			r.AssertBodyContains(`"scheduled":`)
+			r.AssertBodyContains(`"name":"test"`)
+			r.AssertBodyContains(`"retention":"1h"`)
+			r.AssertBodyContains(`"fair":true`)
 		})
 
-		t.Run("state", func(t *testing.T) {
+		t.Run("bind", func(t *testing.T) {
 			t.Parallel()
-			var s ratus.TaskState = 9
-			req := reqtest.NewRequestJSON(http.MethodPatch, "/topics/test/tasks/1", &ratus.Commit{State: &s})
+			req := reqtest.NewRequestJSON(http.MethodPut, "/topics/test", gin.H{"name": 1})
 			r := reqtest.Record(t, h, req)
 			r.AssertStatusCode(http.StatusBadRequest)
-			r.AssertBodyContains("invalid target state")
+			r.AssertBodyContains("cannot unmarshal number")
 		})
 
-		t.Run("defer", func(t *testing.T) {
+		t.Run("eof", func(t *testing.T) {
 			t.Parallel()
-			req := reqtest.NewRequestJSON(http.MethodPatch, "/topics/test/tasks/1", &ratus.Commit{Defer: "foo"})
+			req := httptest.NewRequest(http.MethodPut, "/topics/test", nil)
 			r := reqtest.Record(t, h, req)
 			r.AssertStatusCode(http.StatusBadRequest)
-			r.AssertBodyContains("invalid duration")
+			r.AssertBodyContains("missing request body")
+		})
+
+		t.Run("name", func(t *testing.T) {
+			t.Parallel()
+			req := reqtest.NewRequestJSON(http.MethodPut, "/topics/test", &ratus.Topic{Name: "foo"})
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusBadRequest)
+			r.AssertBodyContains("inconsistent with the path parameter")
+		})
+
+		t.Run("concurrency", func(t *testing.T) {
+			t.Parallel()
+			req := reqtest.NewRequestJSON(http.MethodPut, "/topics/test", &ratus.Topic{Concurrency: -1})
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusBadRequest)
+			r.AssertBodyContains("invalid concurrency limit")
+		})
+
+		t.Run("order", func(t *testing.T) {
+			t.Parallel()
+			req := reqtest.NewRequestJSON(http.MethodPut, "/topics/test", &ratus.Topic{Fair: true, Prioritized: true})
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusBadRequest)
+			r.AssertBodyContains("can not be combined")
+		})
+
+		t.Run("retention", func(t *testing.T) {
+			t.Parallel()
+
+			t.Run("invalid", func(t *testing.T) {
+				t.Parallel()
+				req := reqtest.NewRequestJSON(http.MethodPut, "/topics/test", &ratus.Topic{Retention: "foo"})
+				r := reqtest.Record(t, h, req)
+				r.AssertStatusCode(http.StatusBadRequest)
+				r.AssertBodyContains("invalid duration")
+			})
+
+			t.Run("negative", func(t *testing.T) {
+				t.Parallel()
+				req := reqtest.NewRequestJSON(http.MethodPut, "/topics/test", &ratus.Topic{Retention: "-1h"})
+				r := reqtest.Record(t, h, req)
+				r.AssertStatusCode(http.StatusBadRequest)
+				r.AssertBodyContains("invalid retention period")
+			})
 		})
+
+		t.Run("dedup", func(t *testing.T) {
+			t.Parallel()
+
+			t.Run("invalid", func(t *testing.T) {
+				t.Parallel()
+				req := reqtest.NewRequestJSON(http.MethodPut, "/topics/test", &ratus.Topic{DedupWindow: "foo"})
+				r := reqtest.Record(t, h, req)
+				r.AssertStatusCode(http.StatusBadRequest)
+				r.AssertBodyContains("invalid duration")
+			})
+
+			t.Run("negative", func(t *testing.T) {
+				t.Parallel()
+				req := reqtest.NewRequestJSON(http.MethodPut, "/topics/test", &ratus.Topic{DedupWindow: "-1h"})
+				r := reqtest.Record(t, h, req)
+				r.AssertStatusCode(http.StatusBadRequest)
+				r.AssertBodyContains("invalid deduplication window")
+			})
+		})
+
+		t.Run("config", func(t *testing.T) {
+			t.Parallel()
+			for _, x := range []*ratus.TopicConfig{
+				{Concurrency: -1},
+				{PollInterval: "foo"},
+				{DrainInterval: "-1s"},
+				{RateLimit: -1},
+			} {
+				req := reqtest.NewRequestJSON(http.MethodPut, "/topics/test", &ratus.Topic{Config: x})
+				r := reqtest.Record(t, h, req)
+				r.AssertStatusCode(http.StatusBadRequest)
+			}
+		})
+
+		t.Run("defaults", func(t *testing.T) {
+			t.Parallel()
+			for _, d := range []*ratus.TaskDefaults{
+				{Defer: "foo"},
+				{Jitter: "-1m"},
+				{Labels: map[string]string{"": "foo"}},
+			} {
+				req := reqtest.NewRequestJSON(http.MethodPut, "/topics/test", &ratus.Topic{Defaults: d})
+				r := reqtest.Record(t, h, req)
+				r.AssertStatusCode(http.StatusBadRequest)
+			}
+		})
+	})
+
+	t.Run("quota", func(t *testing.T) {
+		t.Parallel()
+
+		t.Run("normal", func(t *testing.T) {
+			t.Parallel()
+			req := reqtest.NewRequestJSON(http.MethodPut, "/quotas/test", &ratus.Quota{Rate: 60, Pending: 1000})
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusOK)
+			r.AssertBodyContains(`"producer":"test"`)
+			r.AssertBodyContains(`"rate":60`)
+			r.AssertBodyContains(`"pending":1000`)
+		})
+
+		t.Run("bind", func(t *testing.T) {
+			t.Parallel()
+			req := reqtest.NewRequestJSON(http.MethodPut, "/quotas/test", gin.H{"rate": "foo"})
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusBadRequest)
+			r.AssertBodyContains("cannot unmarshal string")
+		})
+
+		t.Run("eof", func(t *testing.T) {
+			t.Parallel()
+			req := httptest.NewRequest(http.MethodPut, "/quotas/test", nil)
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusBadRequest)
+			r.AssertBodyContains("missing request body")
+		})
+
+		t.Run("producer", func(t *testing.T) {
+			t.Parallel()
+			req := reqtest.NewRequestJSON(http.MethodPut, "/quotas/test", &ratus.Quota{Producer: "foo"})
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusBadRequest)
+			r.AssertBodyContains("inconsistent with the path parameter")
+		})
+
+		t.Run("rate", func(t *testing.T) {
+			t.Parallel()
+			req := reqtest.NewRequestJSON(http.MethodPut, "/quotas/test", &ratus.Quota{Rate: -1})
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusBadRequest)
+			r.AssertBodyContains("invalid rate limit")
+		})
+
+		t.Run("pending", func(t *testing.T) {
+			t.Parallel()
+			req := reqtest.NewRequestJSON(http.MethodPut, "/quotas/test", &ratus.Quota{Pending: -1})
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusBadRequest)
+			r.AssertBodyContains("invalid pending limit")
+		})
+	})
+
+	t.Run("progress", func(t *testing.T) {
+		t.Parallel()
+
+		t.Run("normal", func(t *testing.T) {
+			t.Parallel()
+			req := reqtest.NewRequestJSON(http.MethodPatch, "/topics/test/tasks/1/progress", gin.H{"nonce": "xyz", "percent": 50, "message": "halfway"})
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusOK)
+			r.AssertBodyContains(`"nonce":"xyz"`)
+			r.AssertBodyContains(`"percent":50`)
+			r.AssertBodyContains(`"message":"halfway"`)
+			r.AssertBodyContains(`"time":`)
+		})
+
+		t.Run("eof", func(t *testing.T) {
+			t.Parallel()
+			req := httptest.NewRequest(http.MethodPatch, "/topics/test/tasks/1/progress", nil)
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusBadRequest)
+			r.AssertBodyContains("missing request body")
+		})
+
+		t.Run("percent", func(t *testing.T) {
+			t.Parallel()
+			req := reqtest.NewRequestJSON(http.MethodPatch, "/topics/test/tasks/1/progress", &ratus.Progress{Percent: 101})
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusBadRequest)
+			r.AssertBodyContains("percent must be between 0 and 100")
+		})
+	})
+
+	t.Run("next", func(t *testing.T) {
+		t.Parallel()
+
+		t.Run("normal", func(t *testing.T) {
+			t.Parallel()
+			req := httptest.NewRequest(http.MethodPatch, "/next/topics/test/tasks/1?next=true&_id=2&consumer=foo&timeout=1m&labels=tenant=foo", nil)
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusOK)
+			r.AssertBodyContains(`"consumer":"foo"`)
+			r.AssertBodyContains(`"deadline":`)
+			r.AssertBodyContains(`"labels":{"tenant":"foo"}`)
+			r.AssertBodyNotContains(`"_id"`)
+			r.AssertBodyNotContains(`"timeout"`)
+		})
+
+		t.Run("absent", func(t *testing.T) {
+			t.Parallel()
+			for _, q := range []string{"", "?next=false"} {
+				req := httptest.NewRequest(http.MethodPatch, "/next/topics/test/tasks/1"+q, nil)
+				r := reqtest.Record(t, h, req)
+				r.AssertStatusCode(http.StatusOK)
+				r.AssertBodyContains("null")
+			}
+		})
+
+		t.Run("invalid", func(t *testing.T) {
+			t.Parallel()
+			req := httptest.NewRequest(http.MethodPatch, "/next/topics/test/tasks/1?next=foo", nil)
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusBadRequest)
+			r.AssertBodyContains("invalid value of next")
+		})
+
+		t.Run("topic", func(t *testing.T) {
+			t.Parallel()
+			req := httptest.NewRequest(http.MethodPatch, "/next/topics//tasks/1?next=true", nil)
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusBadRequest)
+			r.AssertBodyContains("topic must be specified")
+		})
+
+		t.Run("timeout", func(t *testing.T) {
+			t.Parallel()
+			req := httptest.NewRequest(http.MethodPatch, "/next/topics/test/tasks/1?next=true&timeout=foo", nil)
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusBadRequest)
+			r.AssertBodyContains("invalid duration")
+		})
+	})
+
+	t.Run("move", func(t *testing.T) {
+		t.Parallel()
+
+		t.Run("normal", func(t *testing.T) {
+			t.Parallel()
+			req := reqtest.NewRequestJSON(http.MethodPost, "/topics/test/move", gin.H{"topic": "other", "labels": gin.H{"tenant": "foo"}, "state": 2})
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusOK)
+			r.AssertBodyContains(`"topic":"other"`)
+			r.AssertBodyContains(`"labels":{"tenant":"foo"}`)
+			r.AssertBodyContains(`"state":2`)
+		})
+
+		t.Run("bind", func(t *testing.T) {
+			t.Parallel()
+			req := reqtest.NewRequestJSON(http.MethodPost, "/topics/test/move", gin.H{"topic": 1})
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusBadRequest)
+			r.AssertBodyContains("cannot unmarshal number")
+		})
+
+		t.Run("eof", func(t *testing.T) {
+			t.Parallel()
+			req := httptest.NewRequest(http.MethodPost, "/topics/test/move", nil)
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusBadRequest)
+			r.AssertBodyContains("missing request body")
+		})
+
+		t.Run("empty", func(t *testing.T) {
+			t.Parallel()
+			req := reqtest.NewRequestJSON(http.MethodPost, "/topics/test/move", &ratus.Move{})
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusBadRequest)
+			r.AssertBodyContains("destination topic must not be empty")
+		})
+
+		t.Run("same", func(t *testing.T) {
+			t.Parallel()
+			req := reqtest.NewRequestJSON(http.MethodPost, "/topics/test/move", &ratus.Move{Topic: "test"})
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusBadRequest)
+			r.AssertBodyContains("must be different from the source topic")
+		})
+
+		t.Run("labels", func(t *testing.T) {
+			t.Parallel()
+			req := reqtest.NewRequestJSON(http.MethodPost, "/topics/test/move", &ratus.Move{Topic: "other", Labels: map[string]string{"$foo": "bar"}})
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusBadRequest)
+			r.AssertBodyContains("invalid label key")
+		})
+
+		t.Run("state", func(t *testing.T) {
+			t.Parallel()
+			req := reqtest.NewRequestJSON(http.MethodPost, "/topics/test/move", gin.H{"topic": "other", "state": 9})
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusBadRequest)
+			r.AssertBodyContains("invalid state")
+		})
+	})
+
+	t.Run("batch", func(t *testing.T) {
+		t.Parallel()
+
+		t.Run("normal", func(t *testing.T) {
+			t.Parallel()
+			req := reqtest.NewRequestJSON(http.MethodPost, "/batch", &ratus.BatchGet{IDs: []string{"b", "a", "b"}})
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusOK)
+			r.AssertBodyContains(`"ids":["b","a"]`)
+		})
+
+		t.Run("eof", func(t *testing.T) {
+			t.Parallel()
+			req := httptest.NewRequest(http.MethodPost, "/batch", nil)
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusBadRequest)
+			r.AssertBodyContains("missing request body")
+		})
+
+		t.Run("empty", func(t *testing.T) {
+			t.Parallel()
+			req := reqtest.NewRequestJSON(http.MethodPost, "/batch", &ratus.BatchGet{})
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusBadRequest)
+			r.AssertBodyContains("ids must not be empty")
+		})
+
+		t.Run("id", func(t *testing.T) {
+			t.Parallel()
+			req := reqtest.NewRequestJSON(http.MethodPost, "/batch", &ratus.BatchGet{IDs: []string{"a", ""}})
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusBadRequest)
+			r.AssertBodyContains("must not contain empty IDs")
+		})
+	})
+	t.Run("task", func(t *testing.T) {
+		t.Parallel()
+
+		t.Run("normal", func(t *testing.T) {
+			t.Parallel()
+			req := reqtest.NewRequestJSON(http.MethodPost, "/topics/test/tasks/1", &ratus.Task{})
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusOK)
+			r.AssertHeaderContains("Content-Type", "application/json")
+			r.AssertBodyContains(`"_id":"1"`)
+			r.AssertBodyContains(`"topic":"test"`)
+			r.AssertBodyContains(`"state":0`)
+			r.AssertBodyContains(`"produced":"`)
+			r.AssertBodyContains(`"scheduled":`)
+		})
+
+		t.Run("version", func(t *testing.T) {
+			t.Parallel()
+
+			t.Run("header", func(t *testing.T) {
+				t.Parallel()
+				req := reqtest.NewRequestJSON(http.MethodPost, "/topics/test/tasks/1", &ratus.Task{Version: 1})
+				req.Header.Set(middleware.HeaderIfMatch, `"2"`)
+				r := reqtest.Record(t, h, req)
+				r.AssertStatusCode(http.StatusOK)
+				r.AssertBodyContains(`"version":2`)
+			})
+
+			t.Run("body", func(t *testing.T) {
+				t.Parallel()
+				req := reqtest.NewRequestJSON(http.MethodPost, "/topics/test/tasks/1", &ratus.Task{Version: 1})
+				r := reqtest.Record(t, h, req)
+				r.AssertStatusCode(http.StatusOK)
+				r.AssertBodyNotContains(`"version"`)
+			})
+
+			t.Run("invalid", func(t *testing.T) {
+				t.Parallel()
+				req := reqtest.NewRequestJSON(http.MethodPost, "/topics/test/tasks/1", &ratus.Task{})
+				req.Header.Set(middleware.HeaderIfMatch, "*")
+				r := reqtest.Record(t, h, req)
+				r.AssertStatusCode(http.StatusBadRequest)
+				r.AssertBodyContains("invalid If-Match header")
+			})
+		})
+
+		t.Run("bind", func(t *testing.T) {
+			t.Parallel()
+			req := reqtest.NewRequestJSON(http.MethodPost, "/topics/test/tasks/1", gin.H{"_id": 1})
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusBadRequest)
+			r.AssertBodyContains("cannot unmarshal number")
+		})
+
+		t.Run("eof", func(t *testing.T) {
+			t.Parallel()
+			req := httptest.NewRequest(http.MethodPost, "/topics/test/tasks/1", nil)
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusBadRequest)
+			r.AssertBodyContains("missing request body")
+		})
+
+		t.Run("id", func(t *testing.T) {
+			t.Parallel()
+			req := reqtest.NewRequestJSON(http.MethodPost, "/topics/test/tasks/1", &ratus.Task{ID: "2"})
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusBadRequest)
+			r.AssertBodyContains("inconsistent with the path parameter")
+		})
+
+		t.Run("topic", func(t *testing.T) {
+			t.Parallel()
+			req := reqtest.NewRequestJSON(http.MethodPost, "/topics//tasks/1", &ratus.Task{})
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusBadRequest)
+			r.AssertBodyContains("topic must not be empty")
+		})
+
+		t.Run("state", func(t *testing.T) {
+			t.Parallel()
+			req := reqtest.NewRequestJSON(http.MethodPost, "/topics/test/tasks/1", &ratus.Task{State: 9})
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusBadRequest)
+			r.AssertBodyContains("invalid state")
+		})
+
+		t.Run("dependency", func(t *testing.T) {
+			t.Parallel()
+
+			t.Run("normal", func(t *testing.T) {
+				t.Parallel()
+				req := reqtest.NewRequestJSON(http.MethodPost, "/topics/test/tasks/1", &ratus.Task{DependsOn: []string{"2"}})
+				r := reqtest.Record(t, h, req)
+				r.AssertStatusCode(http.StatusOK)
+				r.AssertBodyContains(`"depends_on":["2"]`)
+			})
+
+			t.Run("empty", func(t *testing.T) {
+				t.Parallel()
+				req := reqtest.NewRequestJSON(http.MethodPost, "/topics/test/tasks/1", &ratus.Task{DependsOn: []string{""}})
+				r := reqtest.Record(t, h, req)
+				r.AssertStatusCode(http.StatusBadRequest)
+				r.AssertBodyContains("dependency ID must not be empty")
+			})
+
+			t.Run("self", func(t *testing.T) {
+				t.Parallel()
+				req := reqtest.NewRequestJSON(http.MethodPost, "/topics/test/tasks/1", &ratus.Task{DependsOn: []string{"1"}})
+				r := reqtest.Record(t, h, req)
+				r.AssertStatusCode(http.StatusBadRequest)
+				r.AssertBodyContains("must not depend on itself")
+			})
+		})
+
+		t.Run("labels", func(t *testing.T) {
+			t.Parallel()
+
+			t.Run("normal", func(t *testing.T) {
+				t.Parallel()
+				req := reqtest.NewRequestJSON(http.MethodPost, "/topics/test/tasks/1", &ratus.Task{Labels: map[string]string{"tenant": "foo"}})
+				r := reqtest.Record(t, h, req)
+				r.AssertStatusCode(http.StatusOK)
+				r.AssertBodyContains(`"labels":{"tenant":"foo"}`)
+			})
+
+			t.Run("empty", func(t *testing.T) {
+				t.Parallel()
+				req := reqtest.NewRequestJSON(http.MethodPost, "/topics/test/tasks/1", &ratus.Task{Labels: map[string]string{"": "foo"}})
+				r := reqtest.Record(t, h, req)
+				r.AssertStatusCode(http.StatusBadRequest)
+				r.AssertBodyContains("label key must not be empty")
+			})
+
+			t.Run("key", func(t *testing.T) {
+				t.Parallel()
+				req := reqtest.NewRequestJSON(http.MethodPost, "/topics/test/tasks/1", &ratus.Task{Labels: map[string]string{"$foo": "bar"}})
+				r := reqtest.Record(t, h, req)
+				r.AssertStatusCode(http.StatusBadRequest)
+				r.AssertBodyContains("invalid label key")
+			})
+		})
+
+		t.Run("defer", func(t *testing.T) {
+			t.Parallel()
+
+			t.Run("normal", func(t *testing.T) {
+				t.Parallel()
+				req := reqtest.NewRequestJSON(http.MethodPost, "/topics/test/tasks/1", &ratus.Task{Defer: "10m"})
+				r := reqtest.Record(t, h, req)
+				r.AssertStatusCode(http.StatusOK)
+			})
+
+			t.Run("invalid", func(t *testing.T) {
+				t.Parallel()
+				req := reqtest.NewRequestJSON(http.MethodPost, "/topics/test/tasks/1", &ratus.Task{Defer: "foo"})
+				r := reqtest.Record(t, h, req)
+				r.AssertStatusCode(http.StatusBadRequest)
+				r.AssertBodyContains("invalid duration")
+			})
+		})
+
+		t.Run("jitter", func(t *testing.T) {
+			t.Parallel()
+
+			t.Run("normal", func(t *testing.T) {
+				t.Parallel()
+				n := time.Now().Add(time.Hour)
+				req := reqtest.NewRequestJSON(http.MethodPost, "/topics/test/tasks/1", &ratus.Task{Scheduled: &n, Jitter: "10m"})
+				r := reqtest.Record(t, h, req)
+				r.AssertStatusCode(http.StatusOK)
+				r.AssertBodyNotContains(`"jitter"`)
+				var v ratus.Task
+				if err := json.Unmarshal(r.Body, &v); err != nil {
+					t.Fatal(err)
+				}
+				if d := v.Scheduled.Sub(n); d < -10*time.Minute || d > 10*time.Minute {
+					t.Errorf("scheduled time should be within the jitter, got offset %v", d)
+				}
+			})
+
+			t.Run("invalid", func(t *testing.T) {
+				t.Parallel()
+				req := reqtest.NewRequestJSON(http.MethodPost, "/topics/test/tasks/1", &ratus.Task{Jitter: "foo"})
+				r := reqtest.Record(t, h, req)
+				r.AssertStatusCode(http.StatusBadRequest)
+				r.AssertBodyContains("invalid duration")
+			})
+
+			t.Run("negative", func(t *testing.T) {
+				t.Parallel()
+				req := reqtest.NewRequestJSON(http.MethodPost, "/topics/test/tasks/1", &ratus.Task{Jitter: "-1m"})
+				r := reqtest.Record(t, h, req)
+				r.AssertStatusCode(http.StatusBadRequest)
+				r.AssertBodyContains("invalid jitter")
+			})
+		})
+	})
+
+	t.Run("tasks", func(t *testing.T) {
+		t.Parallel()
+
+		t.Run("defaults", func(t *testing.T) {
+			t.Parallel()
+			n := time.Now()
+			req := reqtest.NewRequestJSON(http.MethodPost, "/defaults/topics/test/tasks", &ratus.Tasks{
+				Data: []*ratus.Task{
+					{ID: "1"},
+					{ID: "2", Scheduled: &n, Labels: map[string]string{"tenant": "baz"}},
+					{ID: "3", Topic: "other"},
+				},
+			})
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusOK)
+			var v ratus.Tasks
+			if err := json.Unmarshal(r.Body, &v); err != nil {
+				t.Fatal(err)
+			}
+			if d := v.Data[0].Scheduled.Sub(n); d < 59*time.Minute || v.Data[0].Labels["tenant"] != "foo" {
+				t.Errorf("defaults should be applied to unspecified fields, got %+v", v.Data[0])
+			}
+			if !v.Data[1].Scheduled.Equal(n) || v.Data[1].Labels["tenant"] != "baz" || v.Data[1].Labels["region"] != "bar" {
+				t.Errorf("defaults should not override specified fields, got %+v", v.Data[1])
+			}
+			if v.Data[2].Labels != nil {
+				t.Errorf("defaults should not be applied to other topics, got %+v", v.Data[2])
+			}
+		})
+
+		t.Run("normal", func(t *testing.T) {
+			t.Parallel()
+			req := reqtest.NewRequestJSON(http.MethodPost, "/topics/test/tasks", &ratus.Tasks{
+				Data: []*ratus.Task{{ID: "1"}},
+			})
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusOK)
+			r.AssertHeaderContains("Content-Type", "application/json")
+			r.AssertBodyContains(`"_id":"1"`)
+			r.AssertBodyContains(`"topic":"test"`)
+			r.AssertBodyContains(`"data":[`)
+		})
+
+		t.Run("bind", func(t *testing.T) {
+			t.Parallel()
+			req := reqtest.NewRequestJSON(http.MethodPost, "/topics/test/tasks", gin.H{"data": 1})
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusBadRequest)
+			r.AssertBodyContains("cannot unmarshal number")
+		})
+
+		t.Run("eof", func(t *testing.T) {
+			t.Parallel()
+			req := httptest.NewRequest(http.MethodPost, "/topics/test/tasks", nil)
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusBadRequest)
+			r.AssertBodyContains("missing request body")
+		})
+
+		t.Run("empty", func(t *testing.T) {
+			t.Parallel()
+			req := reqtest.NewRequestJSON(http.MethodPost, "/topics/test/tasks", &ratus.Tasks{})
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusOK)
+			r.AssertBodyContains(`{"data":[]}`)
+		})
+
+		t.Run("id", func(t *testing.T) {
+			t.Parallel()
+			req := reqtest.NewRequestJSON(http.MethodPost, "/topics/test/tasks", &ratus.Tasks{
+				Data: []*ratus.Task{{Producer: "foo"}},
+			})
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusBadRequest)
+			r.AssertBodyContains("ID must not be empty")
+		})
+	})
+
+	t.Run("promise", func(t *testing.T) {
+		t.Parallel()
+
+		t.Run("normal", func(t *testing.T) {
+			t.Parallel()
+			req := reqtest.NewRequestJSON(http.MethodPost, "/topics/test/promises/1?consumer=foo", &ratus.Promise{})
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusOK)
+			r.AssertHeaderContains("Content-Type", "application/json")
+			r.AssertBodyContains(`"_id":"1"`)
+			r.AssertBodyContains(`"consumer":"foo"`)
+			r.AssertBodyContains(`"deadline":`)
+		})
+
+		t.Run("id", func(t *testing.T) {
+			t.Parallel()
+			req := reqtest.NewRequestJSON(http.MethodPost, "/topics/test/promises/1", &ratus.Promise{ID: "2"})
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusBadRequest)
+			r.AssertBodyContains("inconsistent with the path parameter")
+		})
+
+		t.Run("timeout", func(t *testing.T) {
+			t.Parallel()
+			req := reqtest.NewRequestJSON(http.MethodPost, "/topics/test/promises/1", &ratus.Promise{Timeout: "foo"})
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusBadRequest)
+			r.AssertBodyContains("invalid duration")
+		})
+
+		t.Run("labels", func(t *testing.T) {
+			t.Parallel()
+
+			t.Run("query", func(t *testing.T) {
+				t.Parallel()
+				req := reqtest.NewRequestJSON(http.MethodPost, "/topics/test/promises/1?labels=tenant=foo", &ratus.Promise{Labels: map[string]string{"tenant": "bar"}})
+				r := reqtest.Record(t, h, req)
+				r.AssertStatusCode(http.StatusOK)
+				r.AssertBodyContains(`"labels":{"tenant":"foo"}`)
+			})
+
+			t.Run("body", func(t *testing.T) {
+				t.Parallel()
+				req := reqtest.NewRequestJSON(http.MethodPost, "/topics/test/promises/1", &ratus.Promise{Labels: map[string]string{"tenant": "bar"}})
+				r := reqtest.Record(t, h, req)
+				r.AssertStatusCode(http.StatusOK)
+				r.AssertBodyContains(`"labels":{"tenant":"bar"}`)
+			})
+
+			t.Run("invalid", func(t *testing.T) {
+				t.Parallel()
+				req := reqtest.NewRequestJSON(http.MethodPost, "/topics/test/promises/1?labels=foo", &ratus.Promise{})
+				r := reqtest.Record(t, h, req)
+				r.AssertStatusCode(http.StatusBadRequest)
+				r.AssertBodyContains("invalid label selector")
+			})
+		})
+	})
+
+	t.Run("commit", func(t *testing.T) {
+		t.Parallel()
+
+		t.Run("normal", func(t *testing.T) {
+			t.Parallel()
+			req := reqtest.NewRequestJSON(http.MethodPatch, "/topics/test/tasks/1", &ratus.Commit{Defer: "10m"})
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusOK)
+			r.AssertHeaderContains("Content-Type", "application/json")
+			r.AssertBodyContains(`"state":2`)
+			r.AssertBodyContains(`"scheduled":`)
+		})
+
+		t.Run("state", func(t *testing.T) {
+			t.Parallel()
+			var s ratus.TaskState = 9
+			req := reqtest.NewRequestJSON(http.MethodPatch, "/topics/test/tasks/1", &ratus.Commit{State: &s})
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusBadRequest)
+			r.AssertBodyContains("invalid target state")
+		})
+
+		t.Run("failed", func(t *testing.T) {
+			t.Parallel()
+			s := ratus.TaskStateFailed
+			req := reqtest.NewRequestJSON(http.MethodPatch, "/topics/test/tasks/1", &ratus.Commit{State: &s, Error: "foo"})
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusOK)
+			r.AssertBodyContains(`"state":4`)
+			r.AssertBodyContains(`"error":"foo"`)
+		})
+
+		t.Run("version", func(t *testing.T) {
+			t.Parallel()
+			req := reqtest.NewRequestJSON(http.MethodPatch, "/topics/test/tasks/1", &ratus.Commit{Version: 1})
+			req.Header.Set(middleware.HeaderIfMatch, `"3"`)
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusOK)
+			r.AssertBodyContains(`"version":3`)
+		})
+
+		t.Run("defer", func(t *testing.T) {
+			t.Parallel()
+			req := reqtest.NewRequestJSON(http.MethodPatch, "/topics/test/tasks/1", &ratus.Commit{Defer: "foo"})
+			r := reqtest.Record(t, h, req)
+			r.AssertStatusCode(http.StatusBadRequest)
+			r.AssertBodyContains("invalid duration")
+		})
+	})
+}
+
+func TestCORS(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+
+	t.Run("invalid", func(t *testing.T) {
+		t.Parallel()
+		for _, c := range []config.CORSConfig{
+			{AllowOrigins: "*", AllowCredentials: true},
+			{AllowOrigins: "example.com"},
+			{AllowOrigins: "https://*.*.example.com"},
+		} {
+			if _, err := middleware.CORS(&c); err == nil {
+				t.Errorf("expected error for %+v", c)
+			}
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		t.Parallel()
+		m, err := middleware.CORS(&config.CORSConfig{AllowOrigins: " , "})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m != nil {
+			t.Error("expected nil middleware")
+		}
+	})
+
+	t.Run("origins", func(t *testing.T) {
+		t.Parallel()
+		m, err := middleware.CORS(&config.CORSConfig{
+			AllowOrigins:     "https://app.test, https://*.app.org",
+			AllowMethods:     "GET,PATCH",
+			AllowHeaders:     "Content-Type,If-Match",
+			AllowCredentials: true,
+			MaxAge:           time.Hour,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := gin.New()
+		r.Use(m)
+		r.GET("/", func(c *gin.Context) {
+			c.Status(http.StatusOK)
+		})
+		for _, x := range []struct {
+			origin string
+			status int
+		}{
+			{"https://app.test", http.StatusOK},
+			{"https://dashboard.app.org", http.StatusOK},
+			{"https://app.net", http.StatusForbidden},
+		} {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Origin", x.origin)
+			res := reqtest.Record(t, r, req)
+			res.AssertStatusCode(x.status)
+			if x.status == http.StatusOK {
+				res.AssertHeaderContains("Access-Control-Allow-Origin", x.origin)
+				res.AssertHeaderContains("Access-Control-Allow-Credentials", "true")
+				res.AssertHeaderContains("Access-Control-Expose-Headers", "X-Total-Count")
+				res.AssertHeaderContains("Access-Control-Expose-Headers", "X-Server-Time")
+			}
+		}
+		req := httptest.NewRequest(http.MethodOptions, "/", nil)
+		req.Header.Set("Origin", "https://app.test")
+		req.Header.Set("Access-Control-Request-Method", http.MethodPatch)
+		res := reqtest.Record(t, r, req)
+		res.AssertStatusCode(http.StatusNoContent)
+		res.AssertHeaderContains("Access-Control-Allow-Methods", "PATCH")
+		res.AssertHeaderContains("Access-Control-Allow-Headers", "If-Match")
+		res.AssertHeaderContains("Access-Control-Max-Age", "3600")
+	})
+}
+
+func TestCompression(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+
+	t.Run("invalid", func(t *testing.T) {
+		t.Parallel()
+		for _, c := range []config.CompressionConfig{
+			{Algorithm: "brotli"},
+			{Algorithm: "gzip", Level: 10},
+		} {
+			if _, err := middleware.Compression(&c); err == nil {
+				t.Errorf("expected error for %+v", c)
+			}
+		}
+	})
+
+	t.Run("none", func(t *testing.T) {
+		t.Parallel()
+		m, err := middleware.Compression(&config.CompressionConfig{Algorithm: "none"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m != nil {
+			t.Error("expected nil middleware")
+		}
+	})
+
+	large := strings.Repeat("ratus", 1000)
+	handler := func(algorithm string) http.Handler {
+		m, err := middleware.Compression(&config.CompressionConfig{Algorithm: algorithm, Level: 1, MinSize: 1024}, "/metrics")
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := gin.New()
+		r.Use(m)
+		r.GET("/small", func(c *gin.Context) {
+			c.String(http.StatusOK, "ratus")
+		})
+		r.GET("/large", func(c *gin.Context) {
+			c.String(http.StatusOK, large)
+		})
+		r.GET("/metrics", func(c *gin.Context) {
+			c.String(http.StatusOK, large)
+		})
+		r.GET("/stream", func(c *gin.Context) {
+			c.String(http.StatusOK, "ratus")
+			c.Writer.Flush()
+			c.String(http.StatusOK, large)
+		})
+		return r
+	}
+
+	for _, x := range []struct {
+		algorithm string
+		path      string
+		accept    string
+		encoding  string
+	}{
+		{"gzip", "/large", "gzip, deflate", "gzip"},
+		{"gzip", "/large", "zstd", ""},
+		{"gzip", "/large", "gzip;q=0", ""},
+		{"gzip", "/small", "gzip", ""},
+		{"gzip", "/metrics", "gzip", ""},
+		{"gzip", "/stream", "gzip", ""},
+		{"zstd", "/large", "gzip, zstd", "zstd"},
+		{"zstd", "/large", "gzip", "gzip"},
+		{"zstd", "/large", "", ""},
+	} {
+		t.Run(x.algorithm+x.path+"/"+x.accept, func(t *testing.T) {
+			t.Parallel()
+			req := httptest.NewRequest(http.MethodGet, x.path, nil)
+			req.Header.Set("Accept-Encoding", x.accept)
+			r := reqtest.Record(t, handler(x.algorithm), req)
+			r.AssertStatusCode(http.StatusOK)
+			if e := r.Header.Get("Content-Encoding"); e != x.encoding {
+				t.Fatalf("expected encoding %q, got %q", x.encoding, e)
+			}
+			var b []byte
+			switch x.encoding {
+			case "gzip":
+				z, err := gzip.NewReader(bytes.NewReader(r.Body))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if b, err = io.ReadAll(z); err != nil {
+					t.Fatal(err)
+				}
+			case "zstd":
+				z, err := zstd.NewReader(bytes.NewReader(r.Body))
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer z.Close()
+				if b, err = io.ReadAll(z); err != nil {
+					t.Fatal(err)
+				}
+			default:
+				b = r.Body
+			}
+			if !strings.HasSuffix(string(b), "ratus") || len(b) < 5 {
+				t.Errorf("unexpected body of length %d", len(b))
+			}
+		})
+	}
+}
+
+func TestNames(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+
+	t.Run("invalid", func(t *testing.T) {
+		t.Parallel()
+		for _, c := range []config.NameConfig{
+			{MaxLength: -1},
+			{Charset: `\`},
+			{Charset: "z-a"},
+		} {
+			if _, err := middleware.Names(&c); err == nil {
+				t.Errorf("expected error for %+v", c)
+			}
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		t.Parallel()
+		m, err := middleware.Names(&config.NameConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m != nil {
+			t.Error("expected nil middleware")
+		}
+	})
+
+	t.Run("constrained", func(t *testing.T) {
+		t.Parallel()
+		m, err := middleware.Names(&config.NameConfig{MaxLength: 8, Charset: "a-z0-9._-"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := gin.New()
+		r.Use(m)
+		ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+		r.PUT("/topics/:topic", middleware.Topic(), ok)
+		r.POST("/topics/:topic/tasks", middleware.Tasks(), ok)
+		r.PUT("/topics/:topic/tasks/:id", middleware.Task(), ok)
+		r.POST("/topics/:topic/move", middleware.Move(), ok)
+		r.PATCH("/topics/:topic/tasks/:id", middleware.Commit(), ok)
+		for _, x := range []struct {
+			method string
+			path   string
+			body   string
+			status int
+			err    string
+		}{
+			{http.MethodPut, "/topics/test", `{}`, http.StatusOK, ""},
+			{http.MethodPut, "/topics/Test", `{}`, http.StatusBadRequest, "contains characters that are not allowed"},
+			{http.MethodPut, "/topics/test.topic", `{}`, http.StatusBadRequest, "exceeds the maximum length of 8 bytes"},
+			{http.MethodPost, "/topics/test/tasks", `{"data":[{"_id":"1"},{"_id":"2","topic":"other"}]}`, http.StatusOK, ""},
+			{http.MethodPost, "/topics/test/tasks", `{"data":[{"_id":"1"},{"_id":"2","topic":"té"}]}`, http.StatusBadRequest, "contains characters that are not allowed"},
+			{http.MethodPut, "/topics/test/tasks/a%20b", `{}`, http.StatusBadRequest, "task ID"},
+			{http.MethodPut, "/topics/test/tasks/ab", `{}`, http.StatusOK, ""},
+			{http.MethodPost, "/topics/test/move", `{"topic":"a b"}`, http.StatusBadRequest, "destination topic"},
+			{http.MethodPatch, "/topics/test/tasks/ab", `{"topic":"other"}`, http.StatusOK, ""},
+			{http.MethodPatch, "/topics/test/tasks/ab", `{"topic":"Other"}`, http.StatusBadRequest, "contains characters that are not allowed"},
+		} {
+			req := httptest.NewRequest(x.method, x.path, strings.NewReader(x.body))
+			req.Header.Set("Content-Type", "application/json")
+			res := reqtest.Record(t, r, req)
+			res.AssertStatusCode(x.status)
+			if x.err != "" {
+				res.AssertBodyContains(x.err)
+			}
+		}
+	})
+}
+
+func TestPromiseTimeouts(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+
+	t.Run("invalid", func(t *testing.T) {
+		t.Parallel()
+		for _, c := range []config.PromiseConfig{
+			{DefaultTimeout: -time.Minute},
+			{MaxTimeout: -time.Minute},
+			{DefaultTimeout: time.Hour, MaxTimeout: time.Minute},
+		} {
+			if _, err := middleware.PromiseTimeouts(&c); err == nil {
+				t.Errorf("expected error for %+v", c)
+			}
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		t.Parallel()
+		m, err := middleware.PromiseTimeouts(&config.PromiseConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m != nil {
+			t.Error("expected nil middleware")
+		}
+	})
+
+	t.Run("constrained", func(t *testing.T) {
+		t.Parallel()
+		m, err := middleware.PromiseTimeouts(&config.PromiseConfig{DefaultTimeout: time.Minute, MaxTimeout: time.Hour})
+		if err != nil {
+			t.Fatal(err)
+		}
+		now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+		r := gin.New()
+		r.Use(middleware.Clock(clock.NewFake(now)), m)
+		r.POST("/topics/:topic/promises", middleware.Promise(), func(c *gin.Context) {
+			c.JSON(http.StatusOK, c.MustGet(middleware.ParamPromise))
+		})
+		r.PATCH("/topics/:topic/tasks/:id", middleware.Next(), func(c *gin.Context) {
+			c.JSON(http.StatusOK, c.MustGet(middleware.ParamNext))
+		})
+		for _, x := range []struct {
+			method string
+			path   string
+			body   string
+			status int
+			want   string
+		}{
+			{http.MethodPost, "/topics/test/promises", `{}`, http.StatusOK, `"deadline":"2022-01-01T00:01:00Z"`},
+			{http.MethodPost, "/topics/test/promises", `{"timeout":"30m"}`, http.StatusOK, `"deadline":"2022-01-01T00:30:00Z"`},
+			{http.MethodPost, "/topics/test/promises", `{"timeout":"72h"}`, http.StatusBadRequest, "exceeds the maximum of 1h0m0s"},
+			{http.MethodPost, "/topics/test/promises", `{"deadline":"2022-01-03T00:00:00Z"}`, http.StatusBadRequest, "exceeds the maximum of 1h0m0s"},
+			{http.MethodPatch, "/topics/test/tasks/1?next=true", `{}`, http.StatusOK, `"deadline":"2022-01-01T00:01:00Z"`},
+			{http.MethodPatch, "/topics/test/tasks/1?next=true&timeout=2h", `{}`, http.StatusBadRequest, "exceeds the maximum of 1h0m0s"},
+		} {
+			req := httptest.NewRequest(x.method, x.path, strings.NewReader(x.body))
+			req.Header.Set("Content-Type", "application/json")
+			res := reqtest.Record(t, r, req)
+			res.AssertStatusCode(x.status)
+			res.AssertBodyContains(x.want)
+		}
+	})
+}
+
+func TestWatch(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+
+	t.Run("invalid", func(t *testing.T) {
+		t.Parallel()
+		for _, c := range []config.WatchConfig{
+			{Timeout: -time.Minute},
+			{Timeout: time.Minute},
+		} {
+			if _, err := middleware.Watch(&c); err == nil {
+				t.Errorf("expected error for %+v", c)
+			}
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		t.Parallel()
+		m, err := middleware.Watch(&config.WatchConfig{CheckInterval: time.Second})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m != nil {
+			t.Error("expected nil middleware")
+		}
+	})
+
+	t.Run("normal", func(t *testing.T) {
+		t.Parallel()
+		m, err := middleware.Watch(&config.WatchConfig{Timeout: time.Minute, CheckInterval: time.Second})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := gin.New()
+		r.GET("/watch", m, func(c *gin.Context) {
+			v, ok := c.Get(middleware.ParamVersion)
+			c.String(http.StatusOK, "%v %t %s %s", v, ok, c.GetDuration(middleware.ParamTimeout), c.GetDuration(middleware.ParamInterval))
+		})
+		for _, x := range []struct {
+			query  string
+			status int
+			want   string
+		}{
+			{"", http.StatusOK, "<nil> false 1m0s 1s"},
+			{"?version=3&timeout=10s", http.StatusOK, "3 true 10s 1s"},
+			{"?timeout=1h", http.StatusOK, "<nil> false 1m0s 1s"},
+			{"?version=-1", http.StatusBadRequest, "invalid value of version"},
+			{"?version=x", http.StatusBadRequest, "invalid value of version"},
+			{"?timeout=0s", http.StatusBadRequest, "invalid value of timeout"},
+			{"?timeout=x", http.StatusBadRequest, "invalid value of timeout"},
+		} {
+			res := reqtest.Record(t, r, httptest.NewRequest(http.MethodGet, "/watch"+x.query, nil))
+			res.AssertStatusCode(x.status)
+			res.AssertBodyContains(x.want)
+		}
+	})
+}
+
+func TestSkew(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	t.Run("invalid", func(t *testing.T) {
+		t.Parallel()
+		for _, c := range []config.SkewConfig{
+			{Threshold: -time.Second},
+			{Absolute: "ignore"},
+		} {
+			if _, err := middleware.Skew(&c); err == nil {
+				t.Errorf("expected error for %+v", c)
+			}
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		t.Parallel()
+		m, err := middleware.Skew(&config.SkewConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m != nil {
+			t.Error("expected nil middleware")
+		}
+	})
+
+	t.Run("absolute", func(t *testing.T) {
+		t.Parallel()
+		for _, x := range []struct {
+			policy string
+			status int
+			want   string
+		}{
+			{"accept", http.StatusOK, `"deadline":"2022-01-01T01:00:00Z"`},
+			{"adjust", http.StatusOK, `"deadline":"2022-01-01T00:50:00Z"`},
+			{"reject", http.StatusBadRequest, "absolute deadline is not allowed, use timeout instead"},
+		} {
+			m, err := middleware.Skew(&config.SkewConfig{Absolute: x.policy})
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := gin.New()
+			if m != nil {
+				r.Use(middleware.Clock(clock.NewFake(now)), m)
+			}
+			r.POST("/topics/:topic/promises", middleware.Promise(), func(c *gin.Context) {
+				c.JSON(http.StatusOK, c.MustGet(middleware.ParamPromise))
+			})
+
+			// The clock of the client is 10 minutes ahead of the server.
+			req := reqtest.NewRequestJSON(http.MethodPost, "/topics/test/promises", gin.H{"deadline": "2022-01-01T01:00:00Z"})
+			req.Header.Set("Date", "Sat, 01 Jan 2022 00:10:00 GMT")
+			res := reqtest.Record(t, r, req)
+			res.AssertStatusCode(x.status)
+			res.AssertBodyContains(x.want)
+
+			// Relative durations are always accepted.
+			req = reqtest.NewRequestJSON(http.MethodPost, "/topics/test/promises", gin.H{"timeout": "1m"})
+			res = reqtest.Record(t, r, req)
+			res.AssertStatusCode(http.StatusOK)
+		}
+	})
+
+	t.Run("time", func(t *testing.T) {
+		t.Parallel()
+		r := gin.New()
+		r.Use(middleware.Clock(clock.NewFake(now)), middleware.ServerTime())
+		r.GET("/", func(c *gin.Context) { c.Status(http.StatusOK) })
+		res := reqtest.Record(t, r, httptest.NewRequest(http.MethodGet, "/", nil))
+		res.AssertHeaderContains(middleware.HeaderServerTime, "2022-01-01T00:00:00Z")
+	})
+
+	for _, reject := range []bool{false, true} {
+		t.Run(fmt.Sprintf("reject=%t", reject), func(t *testing.T) {
+			t.Parallel()
+			m, err := middleware.Skew(&config.SkewConfig{Threshold: 5 * time.Second, Reject: reject})
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := gin.New()
+			r.Use(middleware.Clock(clock.NewFake(now)), m)
+			ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+			r.POST("/topics/:topic/tasks/:id", middleware.Task(), ok)
+			r.POST("/topics/:topic/tasks", middleware.Tasks(), ok)
+			r.PATCH("/topics/:topic/tasks/:id", middleware.Commit(), middleware.Next(), ok)
+			r.POST("/topics/:topic/promises", middleware.Promise(), ok)
+			for _, x := range []struct {
+				method string
+				path   string
+				body   string
+				date   string
+				skewed bool
+			}{
+				{http.MethodPost, "/topics/test/tasks/1", `{"scheduled":"2021-12-31T23:59:58Z"}`, "", false},
+				{http.MethodPost, "/topics/test/tasks/1", `{"scheduled":"2022-01-02T00:00:00Z"}`, "", false},
+				{http.MethodPost, "/topics/test/tasks/1", `{"scheduled":"2021-12-31T23:59:00Z"}`, "", true},
+				{http.MethodPost, "/topics/test/tasks", `{"data":[{"_id":"1"},{"_id":"2","scheduled":"2021-12-31T23:00:00Z"}]}`, "", true},
+				{http.MethodPatch, "/topics/test/tasks/1", `{"scheduled":"2021-12-31T23:00:00Z"}`, "", true},
+				{http.MethodPatch, "/topics/test/tasks/1?next=true&deadline=2021-12-31T23:00:00Z", `{}`, "", true},
+				{http.MethodPost, "/topics/test/promises", `{"deadline":"2021-12-31T23:00:00Z"}`, "", true},
+				{http.MethodPost, "/topics/test/promises", `{"timeout":"1m"}`, "Sat, 01 Jan 2022 00:00:03 GMT", false},
+				{http.MethodPost, "/topics/test/promises", `{"timeout":"1m"}`, "Sat, 01 Jan 2022 00:01:00 GMT", true},
+				{http.MethodPost, "/topics/test/promises", `{"timeout":"1m"}`, "Fri, 31 Dec 2021 23:59:00 GMT", true},
+			} {
+				req := httptest.NewRequest(x.method, x.path, strings.NewReader(x.body))
+				req.Header.Set("Content-Type", "application/json")
+				if x.date != "" {
+					req.Header.Set("Date", x.date)
+				}
+				res := reqtest.Record(t, r, req)
+				switch {
+				case !x.skewed:
+					res.AssertStatusCode(http.StatusOK)
+					if v := res.Header.Get(middleware.HeaderWarning); v != "" {
+						t.Errorf("unexpected warning %q for %s %s", v, x.method, x.path)
+					}
+				case reject:
+					res.AssertStatusCode(http.StatusBadRequest)
+					res.AssertBodyContains("may be skewed")
+				default:
+					res.AssertStatusCode(http.StatusOK)
+					res.AssertHeaderContains(middleware.HeaderWarning, "may be skewed")
+				}
+			}
+		})
+	}
+}
+
+func TestTransitions(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+
+	t.Run("invalid", func(t *testing.T) {
+		t.Parallel()
+		for _, s := range []string{"completed", "completed>", "done>pending"} {
+			if _, err := middleware.Transitions(&config.TransitionConfig{Forbidden: s}, nil); err == nil {
+				t.Errorf("expected error for %q", s)
+			}
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		t.Parallel()
+		m, err := middleware.Transitions(&config.TransitionConfig{Forbidden: " , "}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m != nil {
+			t.Error("expected nil middleware")
+		}
+	})
+
+	t.Run("forbidden", func(t *testing.T) {
+		t.Parallel()
+		ctx := context.Background()
+		g, err := memdb.New(&memdb.Config{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := g.Open(ctx); err != nil {
+			t.Fatal(err)
+		}
+		defer g.Destroy(ctx)
+		if _, err := g.InsertTasks(ctx, []*ratus.Task{
+			{ID: "completed", Topic: "test", State: ratus.TaskStateCompleted},
+			{ID: "failed", Topic: "test", State: ratus.TaskStateFailed},
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		m, err := middleware.Transitions(&config.TransitionConfig{Forbidden: "completed>pending, failed>*"}, g)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := gin.New()
+		r.PATCH("/topics/:topic/tasks/:id", middleware.Commit(), m, func(c *gin.Context) {
+			c.JSON(http.StatusOK, c.MustGet(middleware.ParamCommit))
+		})
+		for _, x := range []struct {
+			id       string
+			body     string
+			status   int
+			contains string
+		}{
+			{"completed", `{"state":0}`, http.StatusConflict, "transition from completed to pending is not allowed"},
+			{"completed", `{"state":3}`, http.StatusOK, `"version":1`},
+			{"completed", `{"state":3,"nonce":"x"}`, http.StatusOK, `"nonce":"x"`},
+			{"failed", `{}`, http.StatusConflict, "transition from failed to completed is not allowed"},
+			{"missing", `{}`, http.StatusNotFound, ""},
+		} {
+			req := httptest.NewRequest(http.MethodPatch, "/topics/test/tasks/"+x.id, strings.NewReader(x.body))
+			req.Header.Set("Content-Type", "application/json")
+			res := reqtest.Record(t, r, req)
+			res.AssertStatusCode(x.status)
+			if x.contains != "" {
+				res.AssertBodyContains(x.contains)
+			}
+		}
+	})
+}
+
+func TestTimeout(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+
+	t.Run("disabled", func(t *testing.T) {
+		t.Parallel()
+		if middleware.Timeout(&config.TimeoutConfig{}) != nil {
+			t.Error("expected nil middleware")
+		}
+	})
+
+	t.Run("classes", func(t *testing.T) {
+		t.Parallel()
+		r := gin.New()
+		a := r.Group("", middleware.AdminRoute())
+		m := middleware.Timeout(&config.TimeoutConfig{
+			Read:  time.Minute,
+			Write: time.Hour,
+		})
+		r.Use(m)
+		a.Use(m)
+
+		// Respond with the remaining time until the deadline in minutes.
+		remaining := func(c *gin.Context) {
+			d, ok := c.Request.Context().Deadline()
+			if !ok {
+				c.String(http.StatusOK, "none")
+				return
+			}
+			c.String(http.StatusOK, "%.0f", time.Until(d).Minutes())
+		}
+		r.GET("/topics", remaining)
+		r.POST("/topics", remaining)
+		a.GET("/admin/backup", remaining)
+		for _, x := range []struct {
+			method string
+			path   string
+			body   string
+		}{
+			{http.MethodGet, "/topics", "1"},
+			{http.MethodPost, "/topics", "60"},
+			{http.MethodGet, "/admin/backup", "none"},
+		} {
+			req := httptest.NewRequest(x.method, x.path, nil)
+			res := reqtest.Record(t, r, req)
+			res.AssertStatusCode(http.StatusOK)
+			if string(res.Body) != x.body {
+				t.Errorf("incorrect timeout of %s %s, expected %q, got %q", x.method, x.path, x.body, res.Body)
+			}
+		}
+	})
+
+	t.Run("exceeded", func(t *testing.T) {
+		t.Parallel()
+		r := gin.New()
+		r.Use(middleware.Timeout(&config.TimeoutConfig{Read: time.Millisecond}))
+		r.GET("/slow", func(c *gin.Context) {
+			<-c.Request.Context().Done()
+			e := ratus.NewError(c.Request.Context().Err())
+			c.JSON(e.Error.Code, e)
+		})
+		req := httptest.NewRequest(http.MethodGet, "/slow", nil)
+		res := reqtest.Record(t, r, req)
+		res.AssertStatusCode(http.StatusServiceUnavailable)
+		res.AssertBodyContains("deadline exceeded")
+	})
+}
+
+func TestBackpressure(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+
+	t.Run("disabled", func(t *testing.T) {
+		t.Parallel()
+		if middleware.Backpressure(&config.BackpressureConfig{RetryAfter: time.Second}, nil) != nil {
+			t.Error("expected nil middleware")
+		}
+	})
+
+	t.Run("threshold", func(t *testing.T) {
+		t.Parallel()
+		ctx := context.Background()
+		g, err := memdb.New(&memdb.Config{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := g.Open(ctx); err != nil {
+			t.Fatal(err)
+		}
+		defer g.Destroy(ctx)
+
+		k := clock.NewFake(time.Now())
+		r := gin.New()
+		r.Use(middleware.Clock(k))
+		r.POST("/topics/:topic/tasks", middleware.Backpressure(&config.BackpressureConfig{
+			Threshold:  3,
+			Warning:    2,
+			RetryAfter: 1500 * time.Millisecond,
+			CacheTTL:   time.Second,
+		}, g), func(c *gin.Context) {
+			c.Status(http.StatusCreated)
+		})
+		insert := func(n int) {
+			t.Helper()
+			ts := make([]*ratus.Task, n)
+			for i := range ts {
+				ts[i] = &ratus.Task{ID: fmt.Sprintf("%d-%d", n, i), Topic: "test", State: ratus.TaskStatePending}
+			}
+			if _, err := g.InsertTasks(ctx, ts); err != nil {
+				t.Fatal(err)
+			}
+		}
+		post := func(topic string) *reqtest.ResponseRecord {
+			t.Helper()
+			return reqtest.Record(t, r, httptest.NewRequest(http.MethodPost, "/topics/"+topic+"/tasks", nil))
+		}
+
+		// Topics that do not exist have no pending tasks.
+		res := post("test")
+		res.AssertStatusCode(http.StatusCreated)
+		if v := res.Header.Get(middleware.HeaderWarning); v != "" {
+			t.Errorf("unexpected warning %q", v)
+		}
+
+		// Cached numbers of pending tasks are used until they expire.
+		insert(2)
+		post("test").AssertStatusCode(http.StatusCreated)
+		k.Advance(time.Second)
+		res = post("test")
+		res.AssertStatusCode(http.StatusCreated)
+		res.AssertHeaderContains(middleware.HeaderWarning, "topic test has 2 pending tasks")
+
+		insert(1)
+		k.Advance(time.Second)
+		res = post("test")
+		res.AssertStatusCode(http.StatusTooManyRequests)
+		res.AssertBodyContains("reaching the backpressure threshold of 3")
+		res.AssertHeaderContains(middleware.HeaderRetryAfter, "2")
+		post("other").AssertStatusCode(http.StatusCreated)
+	})
+
+	t.Run("accepted", func(t *testing.T) {
+		t.Parallel()
+		ctx := context.Background()
+		g, err := memdb.New(&memdb.Config{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := g.Open(ctx); err != nil {
+			t.Fatal(err)
+		}
+		defer g.Destroy(ctx)
+
+		// Accepted tasks are added to the cached numbers of pending tasks,
+		// even though the handler does not insert them.
+		r := gin.New()
+		r.POST("/topics/:topic/tasks/:id", middleware.Task(), middleware.Backpressure(&config.BackpressureConfig{
+			Threshold:  2,
+			RetryAfter: time.Second,
+			CacheTTL:   time.Hour,
+		}, g), func(c *gin.Context) {
+			if c.Param(middleware.ParamID) == "invalid" {
+				c.Status(http.StatusBadRequest)
+				return
+			}
+			c.Status(http.StatusCreated)
+		})
+		post := func(id string) *reqtest.ResponseRecord {
+			t.Helper()
+			req := httptest.NewRequest(http.MethodPost, "/topics/test/tasks/"+id, strings.NewReader(`{}`))
+			req.Header.Set("Content-Type", "application/json")
+			return reqtest.Record(t, r, req)
+		}
+		post("invalid").AssertStatusCode(http.StatusBadRequest)
+		post("1").AssertStatusCode(http.StatusCreated)
+		post("2").AssertStatusCode(http.StatusCreated)
+		post("3").AssertStatusCode(http.StatusTooManyRequests)
+	})
+}
+
+func TestCapacity(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+
+	t.Run("disabled", func(t *testing.T) {
+		t.Parallel()
+		if middleware.Capacity(&config.CapacityConfig{CacheTTL: time.Second}, nil) != nil {
+			t.Error("expected nil middleware")
+		}
+	})
+
+	t.Run("maximum", func(t *testing.T) {
+		t.Parallel()
+		ctx := context.Background()
+		g, err := memdb.New(&memdb.Config{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := g.Open(ctx); err != nil {
+			t.Fatal(err)
+		}
+		defer g.Destroy(ctx)
+		if _, err := g.InsertTasks(ctx, []*ratus.Task{
+			{ID: "1", Topic: "a", State: ratus.TaskStatePending},
+			{ID: "2", Topic: "a", State: ratus.TaskStatePending},
+			{ID: "3", Topic: "b", State: ratus.TaskStatePending},
+			{ID: "4", Topic: "b", State: ratus.TaskStateCompleted},
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		r := gin.New()
+		m := middleware.Capacity(&config.CapacityConfig{Pending: 5, TopicPending: 3}, g)
+		created := func(c *gin.Context) {
+			c.Status(http.StatusCreated)
+		}
+		r.POST("/topics/:topic/tasks", middleware.Tasks(), m, created)
+		r.POST("/topics/:topic/tasks/:id", middleware.Task(), m, created)
+		for _, x := range []struct {
+			path     string
+			body     string
+			status   int
+			contains string
+		}{
+			{"/topics/a/tasks/5", `{}`, http.StatusCreated, ""},
+			{"/topics/a/tasks", `{"data":[{"_id":"5"},{"_id":"6"}]}`, http.StatusTooManyRequests, `topic \"a\" has reached the maximum of 3 pending tasks`},
+			{"/topics/b/tasks", `{"data":[{"_id":"5"},{"_id":"6"}]}`, http.StatusCreated, ""},
+			{"/topics/c/tasks", `{"data":[{"_id":"5"},{"_id":"6"},{"_id":"7"}]}`, http.StatusTooManyRequests, "maximum of 5 pending tasks across all topics"},
+		} {
+			req := httptest.NewRequest(http.MethodPost, x.path, strings.NewReader(x.body))
+			req.Header.Set("Content-Type", "application/json")
+			res := reqtest.Record(t, r, req)
+			res.AssertStatusCode(x.status)
+			if x.contains != "" {
+				res.AssertBodyContains(x.contains)
+			}
+		}
+	})
+
+	t.Run("bounded", func(t *testing.T) {
+		t.Parallel()
+		var g stub.Engine
+		r := gin.New()
+		r.POST("/topics/:topic/tasks/:id", middleware.Task(), middleware.Capacity(&config.CapacityConfig{Pending: 5}, &g), func(c *gin.Context) {
+			c.Status(http.StatusCreated)
+		})
+		req := httptest.NewRequest(http.MethodPost, "/topics/test/tasks/1", strings.NewReader(`{}`))
+		req.Header.Set("Content-Type", "application/json")
+		reqtest.Record(t, r, req).AssertStatusCode(http.StatusCreated)
+
+		// Pending tasks across all topics should only be counted up to the
+		// maximum.
+		cs := g.Calls("CountPendingTasks")
+		if len(cs) != 1 || cs[0].Args[0] != "" || cs[0].Args[1] != int64(5) {
+			t.Errorf("incorrect calls to count pending tasks, got %+v", cs)
+		}
 	})
 }
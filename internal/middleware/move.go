@@ -0,0 +1,65 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/hyperonym/ratus"
+)
+
+// Move returns a middleware that normalizes bulk moves of tasks in request
+// bodies.
+func Move() gin.HandlerFunc {
+	return func(c *gin.Context) {
+
+		// The request body must not be empty and contains a valid move.
+		var m ratus.Move
+		if err := bind(c, &m); err != nil {
+			if err == io.EOF {
+				fail(c, fmt.Errorf("%w: missing request body", ratus.ErrBadRequest))
+				return
+			}
+			fail(c, fmt.Errorf("%w: %v", ratus.ErrBadRequest, err))
+			return
+		}
+
+		// Validate and normalize the move.
+		if err := normalizeMove(&m, c.Param(ParamTopic)); err != nil {
+			fail(c, fmt.Errorf("%w: %v", ratus.ErrBadRequest, err))
+			return
+		}
+		if err := validateNames(c, "destination topic", m.Topic); err != nil {
+			fail(c, fmt.Errorf("%w: %v", ratus.ErrBadRequest, err))
+			return
+		}
+
+		// Store the normalized move in the request context.
+		c.Set(ParamMove, &m)
+
+		c.Next()
+	}
+}
+
+func normalizeMove(m *ratus.Move, topic string) error {
+
+	// Validate destination topic.
+	if m.Topic == "" {
+		return errors.New("destination topic must not be empty")
+	}
+	if m.Topic == topic {
+		return errors.New("destination topic must be different from the source topic")
+	}
+
+	// Validate filters.
+	if err := validateLabels(m.Labels); err != nil {
+		return err
+	}
+	if m.State != nil && (*m.State < ratus.TaskStatePending || *m.State > ratus.TaskStateFailed) {
+		return fmt.Errorf("invalid state %d", *m.State)
+	}
+
+	return nil
+}
@@ -0,0 +1,81 @@
+package middleware
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/hyperonym/ratus/internal/config"
+)
+
+// names contains the constraints on topic names and task IDs.
+type names struct {
+	max     int
+	charset *regexp.Regexp
+}
+
+// Names returns a middleware that constrains the length and characters of
+// topic names and task IDs introduced by requests, i.e. those of inserted or
+// updated tasks, topic settings and destinations of moves. Existing resources
+// are not validated, so that they remain accessible after the constraints are
+// tightened. A nil middleware is returned if there is no constraint.
+func Names(nc *config.NameConfig) (gin.HandlerFunc, error) {
+	n, err := parseNames(nc)
+	if n == nil {
+		return nil, err
+	}
+
+	return func(c *gin.Context) {
+
+		// Store the constraints in the request context for the middlewares
+		// that normalize request bodies.
+		c.Set(ParamNames, n)
+
+		c.Next()
+	}, nil
+}
+
+// parseNames returns the constraints in the configuration, or nil if there is
+// no constraint.
+func parseNames(nc *config.NameConfig) (*names, error) {
+	if nc.MaxLength < 0 {
+		return nil, fmt.Errorf("invalid maximum name length %d", nc.MaxLength)
+	}
+	if nc.MaxLength == 0 && nc.Charset == "" {
+		return nil, nil
+	}
+	n := names{max: nc.MaxLength}
+	if nc.Charset != "" {
+		r, err := regexp.Compile("^[" + nc.Charset + "]*$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid name character set %q: %w", nc.Charset, err)
+		}
+		n.charset = r
+	}
+	return &n, nil
+}
+
+// validateNames validates the names against the constraints stored in the
+// request context, if any. The kind describes the names in error messages.
+func validateNames(c *gin.Context, kind string, vs ...string) error {
+	n, _ := c.Value(ParamNames).(*names)
+	return n.validate(kind, vs...)
+}
+
+// validate validates the names against the constraints, which always succeeds
+// if there is no constraint.
+func (n *names) validate(kind string, vs ...string) error {
+	if n == nil {
+		return nil
+	}
+	for _, v := range vs {
+		if n.max > 0 && len(v) > n.max {
+			return fmt.Errorf("%s %q exceeds the maximum length of %d bytes", kind, v, n.max)
+		}
+		if n.charset != nil && !n.charset.MatchString(v) {
+			return fmt.Errorf("%s %q contains characters that are not allowed", kind, v)
+		}
+	}
+	return nil
+}
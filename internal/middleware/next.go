@@ -0,0 +1,66 @@
+package middleware
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/hyperonym/ratus"
+)
+
+// Next returns a middleware that normalizes the promise for claiming the next
+// task after a commit, which is only bound if requested with the next query
+// parameter. Since the request body contains the commit, the promise can only
+// be submitted through query parameters, and the topic must be specified in
+// the path as the next task is claimed from it.
+func Next() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		s := c.Query(ParamNext)
+		if s == "" {
+			c.Next()
+			return
+		}
+		ok, err := strconv.ParseBool(s)
+		if err != nil {
+			fail(c, fmt.Errorf("%w: invalid value of next %q", ratus.ErrBadRequest, s))
+			return
+		}
+		if !ok {
+			c.Next()
+			return
+		}
+		if c.Param(ParamTopic) == "" {
+			fail(c, fmt.Errorf("%w: topic must be specified in the path to claim the next task", ratus.ErrBadRequest))
+			return
+		}
+
+		var p ratus.Promise
+		if err := c.ShouldBindQuery(&p); err != nil {
+			fail(c, fmt.Errorf("%w: %v", ratus.ErrBadRequest, err))
+			return
+		}
+		v, err := parseLabels(c.Query(ParamLabels))
+		if err != nil {
+			fail(c, fmt.Errorf("%w: %v", ratus.ErrBadRequest, err))
+			return
+		}
+		p.Labels = v
+
+		// The next task is claimed with a wildcard promise.
+		p.ID = ""
+		if err := checkTime(c, "deadline", "timeout", p.Deadline); err != nil {
+			fail(c, fmt.Errorf("%w: %v", ratus.ErrBadRequest, err))
+			return
+		}
+		if err := normalizePromise(&p, "", timeouts(c), Now(c)); err != nil {
+			fail(c, fmt.Errorf("%w: %v", ratus.ErrBadRequest, err))
+			return
+		}
+
+		// Store the normalized promise in the request context.
+		c.Set(ParamNext, &p)
+
+		c.Next()
+	}
+}
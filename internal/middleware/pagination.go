@@ -1,7 +1,14 @@
 package middleware
 
 import (
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
@@ -9,52 +16,153 @@ import (
 	"github.com/hyperonym/ratus/internal/config"
 )
 
-// Pagination returns a middleware that normalizes pagination options.
+// cursor is the position of a page of resources, which is encoded into an
+// opaque string so that its format can be changed without breaking clients.
+type cursor struct {
+	After string     `json:"after"`
+	Sort  string     `json:"sort,omitempty"`
+	Time  *time.Time `json:"time,omitempty"`
+}
+
+// Pagination returns a middleware that normalizes pagination options. Total
+// counts of resources regardless of pagination are requested with the count
+// option for both offsets and cursors.
 func Pagination(pc *config.PaginationConfig) gin.HandlerFunc {
 	return func(c *gin.Context) {
 
 		// Bind query parameters.
 		var p struct {
-			Limit  int `form:"limit"`
-			Offset int `form:"offset"`
+			Limit  int  `form:"limit"`
+			Offset int  `form:"offset"`
+			Count  bool `form:"count"`
 		}
 		if err := c.ShouldBindQuery(&p); err != nil {
 			fail(c, fmt.Errorf("%w: invalid pagination parameters", ratus.ErrBadRequest))
 			return
 		}
 
-		// The hard-coded default might be greater than the maximum limit,
-		// always use the smaller of the two numbers as the default limit.
-		if p.Limit == 0 {
-			if ratus.DefaultLimit < pc.MaxLimit {
-				p.Limit = ratus.DefaultLimit
-			} else {
-				p.Limit = pc.MaxLimit
-			}
-		}
-
 		// Validate ranges of limit and offset.
-		if p.Limit < 0 {
-			fail(c, fmt.Errorf("%w: limit must not be negative", ratus.ErrBadRequest))
+		l, err := normalizeLimit(p.Limit, pc)
+		if err != nil {
+			fail(c, fmt.Errorf("%w: %v", ratus.ErrBadRequest, err))
 			return
 		}
 		if p.Offset < 0 {
 			fail(c, fmt.Errorf("%w: offset must not be negative", ratus.ErrBadRequest))
 			return
 		}
-		if p.Limit > pc.MaxLimit {
-			fail(c, fmt.Errorf("%w: exceeded maximum allowed limit of %d", ratus.ErrBadRequest, pc.MaxLimit))
-			return
-		}
 		if p.Offset > pc.MaxOffset {
 			fail(c, fmt.Errorf("%w: exceeded maximum allowed offset of %d", ratus.ErrBadRequest, pc.MaxOffset))
 			return
 		}
 
 		// Store normalized pagination options in the request context.
-		c.Set(ParamLimit, p.Limit)
+		c.Set(ParamLimit, l)
 		c.Set(ParamOffset, p.Offset)
+		c.Set(ParamCount, p.Count)
 
 		c.Next()
 	}
 }
+
+// Cursor returns a middleware that normalizes pagination options based on
+// opaque cursors, which are returned along with each page of resources to
+// retrieve the next page. Unlike offsets, the cost of retrieving a page does
+// not grow with the number of preceding resources.
+func Cursor(pc *config.PaginationConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+
+		// Bind query parameters.
+		var p struct {
+			Limit  int    `form:"limit"`
+			Cursor string `form:"cursor"`
+			Count  bool   `form:"count"`
+		}
+		if err := c.ShouldBindQuery(&p); err != nil {
+			fail(c, fmt.Errorf("%w: invalid pagination parameters", ratus.ErrBadRequest))
+			return
+		}
+
+		// Validate the limit and decode the cursor.
+		l, err := normalizeLimit(p.Limit, pc)
+		if err != nil {
+			fail(c, fmt.Errorf("%w: %v", ratus.ErrBadRequest, err))
+			return
+		}
+		var u cursor
+		if p.Cursor != "" {
+			b, err := base64.RawURLEncoding.DecodeString(p.Cursor)
+			if err != nil || json.Unmarshal(b, &u) != nil {
+				fail(c, fmt.Errorf("%w: invalid cursor", ratus.ErrBadRequest))
+				return
+			}
+		}
+
+		// Store normalized pagination options in the request context. The
+		// sort order of the cursor is validated by the Sort middleware.
+		c.Set(ParamLimit, l)
+		c.Set(ParamOffset, 0)
+		c.Set(ParamAfter, u.After)
+		c.Set(ParamCursor, true)
+		c.Set(ParamCount, p.Count)
+		if u.Sort != "" {
+			c.Set(ParamSort, u.Sort)
+		}
+		if u.Time != nil {
+			c.Set(ParamTime, u.Time)
+		}
+
+		c.Next()
+	}
+}
+
+// EncodeCursor returns the opaque cursor of the page of resources following
+// the resource with the key in the sort order. The time is the value of the
+// field that resources are sorted by, if any.
+func EncodeCursor(sort, after string, at *time.Time) string {
+	b, _ := json.Marshal(&cursor{After: after, Sort: sort, Time: at})
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Sort returns a middleware that normalizes the order of resources to list,
+// which is one of the keys with an optional "-" prefix for descending order.
+// The first key is used by default, or the sort order of the cursor if the
+// request is paginated with cursors.
+func Sort(keys ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+
+		// Cursors are only valid in the sort order they were created with.
+		x := c.GetString(ParamSort)
+		s := cmp.Or(c.Query(ParamSort), x, keys[0])
+		if !slices.Contains(keys, strings.TrimPrefix(s, "-")) {
+			fail(c, fmt.Errorf("%w: invalid sort order %q", ratus.ErrBadRequest, s))
+			return
+		}
+		if x != "" && x != s {
+			fail(c, fmt.Errorf("%w: sort order does not match the cursor", ratus.ErrBadRequest))
+			return
+		}
+
+		// Store the normalized sort order in the request context.
+		c.Set(ParamSort, s)
+
+		c.Next()
+	}
+}
+
+// normalizeLimit validates the limit and applies the default value.
+func normalizeLimit(limit int, pc *config.PaginationConfig) (int, error) {
+
+	// The hard-coded default might be greater than the maximum limit,
+	// always use the smaller of the two numbers as the default limit.
+	if limit == 0 {
+		return min(ratus.DefaultLimit, pc.MaxLimit), nil
+	}
+	if limit < 0 {
+		return 0, errors.New("limit must not be negative")
+	}
+	if limit > pc.MaxLimit {
+		return 0, fmt.Errorf("exceeded maximum allowed limit of %d", pc.MaxLimit)
+	}
+	return limit, nil
+}
@@ -0,0 +1,54 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/hyperonym/ratus"
+)
+
+// Progress returns a middleware that normalizes progress reports of tasks in
+// request bodies.
+func Progress() gin.HandlerFunc {
+	return func(c *gin.Context) {
+
+		// The request body must not be empty and contains a valid progress.
+		var p ratus.Progress
+		if err := bind(c, &p); err != nil {
+			if err == io.EOF {
+				fail(c, fmt.Errorf("%w: missing request body", ratus.ErrBadRequest))
+				return
+			}
+			fail(c, fmt.Errorf("%w: %v", ratus.ErrBadRequest, err))
+			return
+		}
+
+		// Validate and normalize the progress.
+		if err := normalizeProgress(&p, Now(c)); err != nil {
+			fail(c, fmt.Errorf("%w: %v", ratus.ErrBadRequest, err))
+			return
+		}
+
+		// Store the normalized progress in the request context.
+		c.Set(ParamProgress, &p)
+
+		c.Next()
+	}
+}
+
+func normalizeProgress(p *ratus.Progress, now time.Time) error {
+
+	// Validate percentage.
+	if p.Percent < 0 || p.Percent > 100 {
+		return errors.New("percent must be between 0 and 100")
+	}
+
+	// The time of the progress is always set by the server.
+	p.Time = &now
+
+	return nil
+}
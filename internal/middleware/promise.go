@@ -8,6 +8,7 @@ import (
 	"github.com/gin-gonic/gin"
 
 	"github.com/hyperonym/ratus"
+	"github.com/hyperonym/ratus/internal/config"
 )
 
 // Promise returns a middleware that normalizes promises in request bodies.
@@ -17,11 +18,26 @@ func Promise() gin.HandlerFunc {
 		// Promise is a relatively simple data structure that can be submitted
 		// either through the request body or query parameters.
 		var p ratus.Promise
-		c.ShouldBindJSON(&p)
+		bind(c, &p)
 		c.ShouldBindQuery(&p)
 
+		// Label selectors in query parameters take precedence over the ones
+		// in the request body.
+		v, err := parseLabels(c.Query(ParamLabels))
+		if err != nil {
+			fail(c, fmt.Errorf("%w: %v", ratus.ErrBadRequest, err))
+			return
+		}
+		if v != nil {
+			p.Labels = v
+		}
+
 		// Validate and normalize the promise.
-		if err := normalizePromise(&p, c.Param(ParamID)); err != nil {
+		if err := checkTime(c, "deadline", "timeout", p.Deadline); err != nil {
+			fail(c, fmt.Errorf("%w: %v", ratus.ErrBadRequest, err))
+			return
+		}
+		if err := normalizePromise(&p, c.Param(ParamID), timeouts(c), Now(c)); err != nil {
 			fail(c, fmt.Errorf("%w: %v", ratus.ErrBadRequest, err))
 			return
 		}
@@ -33,7 +49,50 @@ func Promise() gin.HandlerFunc {
 	}
 }
 
-func normalizePromise(p *ratus.Promise, id string) error {
+// promiseTimeouts contains the default and maximum timeouts of promises.
+type promiseTimeouts struct {
+	def time.Duration
+	max time.Duration
+}
+
+// PromiseTimeouts returns a middleware that overrides the default timeout of
+// promises that specify neither a timeout nor a deadline, and rejects promises
+// whose deadlines are further from now than the maximum, so that consumers can
+// not hold tasks for days by mistake. A nil middleware is returned if neither
+// is configured.
+func PromiseTimeouts(pc *config.PromiseConfig) (gin.HandlerFunc, error) {
+	if pc.DefaultTimeout < 0 {
+		return nil, fmt.Errorf("invalid default promise timeout %s", pc.DefaultTimeout)
+	}
+	if pc.MaxTimeout < 0 {
+		return nil, fmt.Errorf("invalid maximum promise timeout %s", pc.MaxTimeout)
+	}
+	if pc.MaxTimeout > 0 && pc.DefaultTimeout > pc.MaxTimeout {
+		return nil, fmt.Errorf("default promise timeout %s exceeds the maximum of %s", pc.DefaultTimeout, pc.MaxTimeout)
+	}
+	if pc.DefaultTimeout == 0 && pc.MaxTimeout == 0 {
+		return nil, nil
+	}
+	t := promiseTimeouts{def: pc.DefaultTimeout, max: pc.MaxTimeout}
+
+	return func(c *gin.Context) {
+
+		// Store the timeouts in the request context for the middlewares that
+		// normalize promises.
+		c.Set(ParamTimeouts, &t)
+
+		c.Next()
+	}, nil
+}
+
+// timeouts returns the timeouts of promises stored in the request context, or
+// nil if they have not been configured.
+func timeouts(c *gin.Context) *promiseTimeouts {
+	t, _ := c.Value(ParamTimeouts).(*promiseTimeouts)
+	return t
+}
+
+func normalizePromise(p *ratus.Promise, id string, t *promiseTimeouts, now time.Time) error {
 
 	// Normalize and validate ID.
 	if id != "" && p.ID == "" {
@@ -43,19 +102,33 @@ func normalizePromise(p *ratus.Promise, id string) error {
 		return errors.New("promise ID is inconsistent with the path parameter")
 	}
 
-	// Normalize deadline time.
+	// Validate label selector.
+	if err := validateLabels(p.Labels); err != nil {
+		return err
+	}
+
+	// Normalize deadline time, using the configured default timeout if
+	// neither the timeout nor the deadline is specified.
 	if p.Deadline == nil {
 		if p.Timeout == "" {
 			p.Timeout = ratus.DefaultTimeout
+			if t != nil && t.def > 0 {
+				p.Timeout = t.def.String()
+			}
 		}
 		d, err := time.ParseDuration(p.Timeout)
 		if err != nil {
 			return err
 		}
-		n := time.Now().Add(d)
+		n := now.Add(d)
 		p.Deadline = &n
 	}
 
+	// Validate deadline time against the maximum timeout.
+	if t != nil && t.max > 0 && p.Deadline.Sub(now) > t.max {
+		return fmt.Errorf("promise timeout exceeds the maximum of %s", t.max)
+	}
+
 	// Clear the timeout field after converting to an absolute timestamp.
 	p.Timeout = ""
 
@@ -0,0 +1,64 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/hyperonym/ratus"
+)
+
+// Quota returns a middleware that normalizes quotas of producers in request
+// bodies.
+func Quota() gin.HandlerFunc {
+	return func(c *gin.Context) {
+
+		// The request body must not be empty and contains a valid quota.
+		var q ratus.Quota
+		if err := bind(c, &q); err != nil {
+			if err == io.EOF {
+				fail(c, fmt.Errorf("%w: missing request body", ratus.ErrBadRequest))
+				return
+			}
+			fail(c, fmt.Errorf("%w: %v", ratus.ErrBadRequest, err))
+			return
+		}
+
+		// Validate and normalize the quota.
+		if err := normalizeQuota(&q, c.Param(ParamProducer)); err != nil {
+			fail(c, fmt.Errorf("%w: %v", ratus.ErrBadRequest, err))
+			return
+		}
+
+		// Store the normalized quota in the request context.
+		c.Set(ParamQuota, &q)
+
+		c.Next()
+	}
+}
+
+func normalizeQuota(q *ratus.Quota, producer string) error {
+
+	// Normalize and validate producer.
+	if q.Producer == "" {
+		q.Producer = producer
+	}
+	if q.Producer == "" {
+		return errors.New("producer must not be empty")
+	}
+	if producer != "" && q.Producer != producer {
+		return errors.New("producer is inconsistent with the path parameter")
+	}
+
+	// Validate limits.
+	if q.Rate < 0 {
+		return fmt.Errorf("invalid rate limit %d", q.Rate)
+	}
+	if q.Pending < 0 {
+		return fmt.Errorf("invalid pending limit %d", q.Pending)
+	}
+
+	return nil
+}
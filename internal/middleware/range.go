@@ -0,0 +1,56 @@
+package middleware
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/hyperonym/ratus"
+)
+
+// Range returns a middleware that normalizes the time range of resources to
+// list in the "from" and "to" query parameters, which are timestamps in RFC
+// 3339 format. The range includes its start and excludes its end, either of
+// which can be omitted to leave the range unbounded on that side.
+func Range() gin.HandlerFunc {
+	return func(c *gin.Context) {
+
+		// Parse and validate the bounds of the range.
+		from, err := parseTime(c.Query(ParamFrom))
+		if err != nil {
+			fail(c, fmt.Errorf("%w: %v", ratus.ErrBadRequest, err))
+			return
+		}
+		to, err := parseTime(c.Query(ParamTo))
+		if err != nil {
+			fail(c, fmt.Errorf("%w: %v", ratus.ErrBadRequest, err))
+			return
+		}
+		if from != nil && to != nil && to.Before(*from) {
+			fail(c, fmt.Errorf("%w: end of the time range must not be before its start", ratus.ErrBadRequest))
+			return
+		}
+
+		// Store the normalized bounds in the request context.
+		if from != nil {
+			c.Set(ParamFrom, from)
+		}
+		if to != nil {
+			c.Set(ParamTo, to)
+		}
+
+		c.Next()
+	}
+}
+
+func parseTime(s string) (*time.Time, error) {
+	if s == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time %q", s)
+	}
+	return &t, nil
+}
@@ -0,0 +1,133 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/hyperonym/ratus"
+	"github.com/hyperonym/ratus/internal/config"
+)
+
+// HeaderServerTime is the header field containing the current time of the
+// server, which lets clients measure the skew of their clocks.
+const HeaderServerTime = "X-Server-Time"
+
+// Policies of handling absolute times specified by clients.
+const (
+	absoluteAccept = "accept"
+	absoluteAdjust = "adjust"
+	absoluteReject = "reject"
+)
+
+// ServerTime returns a middleware that adds the current time of the server to
+// the responses, with a higher precision than the Date header.
+func ServerTime() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header(HeaderServerTime, Now(c).UTC().Format(time.RFC3339Nano))
+		c.Next()
+	}
+}
+
+// skew contains the constraints on clock skew of clients, and the offset of
+// the clock of the client in the current request.
+type skew struct {
+	threshold time.Duration
+	reject    bool
+	absolute  string
+	offset    time.Duration
+}
+
+// Skew returns a middleware that detects clients whose clocks are skewed,
+// either by the Date header of requests, or by absolute scheduled times and
+// deadlines that are further in the past than the threshold, which would
+// otherwise make tasks available or expire immediately without notice. Skewed
+// requests are rejected with ErrBadRequest if configured, or carry a Warning
+// header in their responses otherwise. Times in the future are not considered
+// skewed, since tasks may be scheduled far ahead.
+//
+// Absolute times can also be converted to the clock of the server by the
+// offset of the Date header, or rejected altogether so that all times are
+// derived from relative durations on the server. A nil middleware is returned
+// if neither the threshold nor the policy is configured.
+func Skew(sc *config.SkewConfig) (gin.HandlerFunc, error) {
+	if sc.Threshold < 0 {
+		return nil, fmt.Errorf("invalid clock skew threshold %s", sc.Threshold)
+	}
+	a := strings.ToLower(sc.Absolute)
+	switch a {
+	case "", absoluteAccept:
+		a = absoluteAccept
+	case absoluteAdjust, absoluteReject:
+	default:
+		return nil, fmt.Errorf("unknown policy of absolute times: %s", sc.Absolute)
+	}
+	if sc.Threshold == 0 && a == absoluteAccept {
+		return nil, nil
+	}
+	s := skew{threshold: sc.Threshold, reject: sc.Reject, absolute: a}
+
+	return func(c *gin.Context) {
+		r := s
+
+		// The Date header has a precision of one second, and is compared in
+		// both directions since it is supposed to be the current time.
+		// Offsets within the precision are ignored.
+		if h := c.GetHeader("Date"); h != "" {
+			if t, err := http.ParseTime(h); err == nil {
+				d := t.Sub(Now(c))
+				if d > 0 || -d > time.Second {
+					r.offset = -d
+				}
+				if r.threshold > 0 && (d > r.threshold || -d > r.threshold+time.Second) {
+					if err := r.report(c, fmt.Sprintf("the Date header is %s off the server time", d.Abs().Round(time.Second))); err != nil {
+						fail(c, fmt.Errorf("%w: %v", ratus.ErrBadRequest, err))
+						return
+					}
+				}
+			}
+		}
+
+		// Store the constraints in the request context for the middlewares
+		// that normalize request bodies.
+		c.Set(ParamSkew, &r)
+
+		c.Next()
+	}, nil
+}
+
+// report returns an error describing the skew if requests are rejected, or
+// adds it to the Warning header of the response otherwise.
+func (s *skew) report(c *gin.Context, msg string) error {
+	msg += ", the clock of the client may be skewed"
+	if s.reject {
+		return errors.New(msg)
+	}
+	c.Header(HeaderWarning, fmt.Sprintf("199 ratus %q", msg))
+	return nil
+}
+
+// checkTime applies the policy of absolute times stored in the request
+// context, if any, to the time specified by the client, and checks it against
+// the threshold of clock skew. The field and the relative alternative
+// describe the time in messages.
+func checkTime(c *gin.Context, field, relative string, t *time.Time) error {
+	s, _ := c.Value(ParamSkew).(*skew)
+	if s == nil || t == nil {
+		return nil
+	}
+	switch s.absolute {
+	case absoluteReject:
+		return fmt.Errorf("absolute %s is not allowed, use %s instead", field, relative)
+	case absoluteAdjust:
+		*t = t.Add(s.offset)
+	}
+	if d := Now(c).Sub(*t); s.threshold > 0 && d > s.threshold {
+		return s.report(c, fmt.Sprintf("%s is %s in the past", field, d.Round(time.Second)))
+	}
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -17,7 +18,7 @@ func Task() gin.HandlerFunc {
 
 		// The request body must not be empty and contains a valid task.
 		var t ratus.Task
-		if err := c.ShouldBindJSON(&t); err != nil {
+		if err := bind(c, &t); err != nil {
 			if err == io.EOF {
 				fail(c, fmt.Errorf("%w: missing request body", ratus.ErrBadRequest))
 				return
@@ -27,10 +28,27 @@ func Task() gin.HandlerFunc {
 		}
 
 		// Validate and normalize the task.
-		if err := normalizeTask(&t, c.Param(ParamID), c.Param(ParamTopic)); err != nil {
+		if err := checkTime(c, "scheduled time", "defer", t.Scheduled); err != nil {
 			fail(c, fmt.Errorf("%w: %v", ratus.ErrBadRequest, err))
 			return
 		}
+		if err := normalizeTask(&t, c.Param(ParamID), c.Param(ParamTopic), defaults(c), Now(c)); err != nil {
+			fail(c, fmt.Errorf("%w: %v", ratus.ErrBadRequest, err))
+			return
+		}
+		if err := validateTaskNames(c, &t); err != nil {
+			fail(c, fmt.Errorf("%w: %v", ratus.ErrBadRequest, err))
+			return
+		}
+
+		// Updates of a single task can be made conditional on its current
+		// version with the If-Match header.
+		v, err := version(c)
+		if err != nil {
+			fail(c, fmt.Errorf("%w: %v", ratus.ErrBadRequest, err))
+			return
+		}
+		t.Version = v
 
 		// Store the normalized task in the request context.
 		c.Set(ParamTask, &t)
@@ -45,7 +63,7 @@ func Tasks() gin.HandlerFunc {
 
 		// The request body must not be empty and contains a valid task list.
 		var ts ratus.Tasks
-		if err := c.ShouldBindJSON(&ts); err != nil {
+		if err := bind(c, &ts); err != nil {
 			if err == io.EOF {
 				fail(c, fmt.Errorf("%w: missing request body", ratus.ErrBadRequest))
 				return
@@ -55,9 +73,17 @@ func Tasks() gin.HandlerFunc {
 		}
 
 		// Validate and normalize all tasks in the list.
-		p := c.Param(ParamTopic)
+		p, d, n := c.Param(ParamTopic), defaults(c), Now(c)
 		for _, t := range ts.Data {
-			if err := normalizeTask(t, "", p); err != nil {
+			if err := checkTime(c, "scheduled time", "defer", t.Scheduled); err != nil {
+				fail(c, fmt.Errorf("%w: %v", ratus.ErrBadRequest, err))
+				return
+			}
+			if err := normalizeTask(t, "", p, d, n); err != nil {
+				fail(c, fmt.Errorf("%w: %v", ratus.ErrBadRequest, err))
+				return
+			}
+			if err := validateTaskNames(c, t); err != nil {
 				fail(c, fmt.Errorf("%w: %v", ratus.ErrBadRequest, err))
 				return
 			}
@@ -75,7 +101,26 @@ func Tasks() gin.HandlerFunc {
 	}
 }
 
-func normalizeTask(t *ratus.Task, id, topic string) error {
+// defaults returns the task defaults of the topic in the path parameter, if
+// they have been stored in the request context.
+func defaults(c *gin.Context) *ratus.TaskDefaults {
+	d, _ := c.Value(ParamDefaults).(*ratus.TaskDefaults)
+	return d
+}
+
+// validateTaskNames validates the ID and topic of the task against the
+// constraints on names.
+func validateTaskNames(c *gin.Context, t *ratus.Task) error {
+	if err := validateNames(c, "task ID", t.ID); err != nil {
+		return err
+	}
+	return validateNames(c, "topic", t.Topic)
+}
+
+// normalizeTask validates and normalizes the task. Defaults are only applied
+// to tasks in the topic they are specified for, and relative times are
+// converted to absolute ones based on the current time.
+func normalizeTask(t *ratus.Task, id, topic string, d *ratus.TaskDefaults, n time.Time) error {
 
 	// Normalize and validate ID.
 	if t.ID == "" {
@@ -96,13 +141,50 @@ func normalizeTask(t *ratus.Task, id, topic string) error {
 		return errors.New("topic must not be empty")
 	}
 
+	// Apply the defaults of the topic to unspecified fields.
+	if d != nil && t.Topic == topic {
+		if t.Defer == "" && t.Scheduled == nil {
+			t.Defer = d.Defer
+		}
+		if t.Jitter == "" {
+			t.Jitter = d.Jitter
+		}
+		for k, v := range d.Labels {
+			if _, ok := t.Labels[k]; !ok {
+				if t.Labels == nil {
+					t.Labels = make(map[string]string, len(d.Labels))
+				}
+				t.Labels[k] = v
+			}
+		}
+	}
+
 	// Validate task state.
-	if t.State < ratus.TaskStatePending || t.State > ratus.TaskStateArchived {
+	if t.State < ratus.TaskStatePending || t.State > ratus.TaskStateFailed {
 		return fmt.Errorf("invalid state %d", t.State)
 	}
 
+	// Validate dependencies.
+	for _, d := range t.DependsOn {
+		if d == "" {
+			return errors.New("dependency ID must not be empty")
+		}
+		if d == t.ID {
+			return errors.New("task must not depend on itself")
+		}
+	}
+
+	// History and version are maintained by storage engines and can not be
+	// set directly.
+	t.History = nil
+	t.Version = 0
+
+	// Validate labels.
+	if err := validateLabels(t.Labels); err != nil {
+		return err
+	}
+
 	// Normalize produced time.
-	n := time.Now()
 	if t.Produced == nil {
 		t.Produced = &n
 	}
@@ -120,8 +202,24 @@ func normalizeTask(t *ratus.Task, id, topic string) error {
 		t.Scheduled = &n
 	}
 
-	// Clear the defer field after converting to an absolute timestamp.
+	// Spread the scheduled time randomly within the jitter in either
+	// direction.
+	if t.Jitter != "" {
+		d, err := time.ParseDuration(t.Jitter)
+		if err != nil {
+			return err
+		}
+		if d < 0 {
+			return fmt.Errorf("invalid jitter %q", t.Jitter)
+		}
+		s := t.Scheduled.Add(time.Duration(rand.Int63n(int64(2*d)+1)) - d)
+		t.Scheduled = &s
+	}
+
+	// Clear the defer and jitter fields after converting to an absolute
+	// timestamp.
 	t.Defer = ""
+	t.Jitter = ""
 
 	return nil
 }
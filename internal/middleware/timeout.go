@@ -0,0 +1,56 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/hyperonym/ratus/internal/config"
+)
+
+// Timeout returns a middleware that limits the duration of handling requests
+// by setting deadlines on the request contexts, which are respected by storage
+// engines when querying databases, so that slow queries can not hold workers
+// and connections indefinitely. Requests to routes marked with AdminRoute are
+// limited by the admin timeout, safe requests such as GET are limited by the
+// read timeout, and the others are limited by the write timeout. A nil
+// middleware is returned if there is no timeout.
+func Timeout(tc *config.TimeoutConfig) gin.HandlerFunc {
+	if tc.Read <= 0 && tc.Write <= 0 && tc.Admin <= 0 {
+		return nil
+	}
+
+	return func(c *gin.Context) {
+
+		// Determine the timeout by the class of the route.
+		d := tc.Write
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			d = tc.Read
+		}
+		if c.GetBool(ParamAdmin) {
+			d = tc.Admin
+		}
+		if d <= 0 {
+			return
+		}
+
+		// Replace the request context with one that has a deadline. Errors
+		// caused by exceeding the deadline are reported as unavailable.
+		ctx, cancel := context.WithTimeout(c.Request.Context(), d)
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+
+		c.Next()
+	}
+}
+
+// AdminRoute returns a middleware that marks requests as requests to admin
+// endpoints, which must precede Timeout for the admin timeout to be applied.
+func AdminRoute() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(ParamAdmin, true)
+		c.Next()
+	}
+}
@@ -0,0 +1,143 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/hyperonym/ratus"
+)
+
+// Topic returns a middleware that normalizes topic settings in request bodies.
+func Topic() gin.HandlerFunc {
+	return func(c *gin.Context) {
+
+		// The request body must not be empty and contains valid settings.
+		var t ratus.Topic
+		if err := bind(c, &t); err != nil {
+			if err == io.EOF {
+				fail(c, fmt.Errorf("%w: missing request body", ratus.ErrBadRequest))
+				return
+			}
+			fail(c, fmt.Errorf("%w: %v", ratus.ErrBadRequest, err))
+			return
+		}
+
+		// Validate and normalize the topic.
+		if err := normalizeTopic(&t, c.Param(ParamTopic)); err != nil {
+			fail(c, fmt.Errorf("%w: %v", ratus.ErrBadRequest, err))
+			return
+		}
+		if err := validateNames(c, "topic", t.Name); err != nil {
+			fail(c, fmt.Errorf("%w: %v", ratus.ErrBadRequest, err))
+			return
+		}
+
+		// Store the normalized topic in the request context.
+		c.Set(ParamTopic, &t)
+
+		c.Next()
+	}
+}
+
+func normalizeTopic(t *ratus.Topic, name string) error {
+
+	// Normalize and validate name.
+	if t.Name == "" {
+		t.Name = name
+	}
+	if t.Name == "" {
+		return errors.New("topic must not be empty")
+	}
+	if name != "" && t.Name != name {
+		return errors.New("topic is inconsistent with the path parameter")
+	}
+
+	// Validate retention period.
+	if t.Retention != "" {
+		d, err := time.ParseDuration(t.Retention)
+		if err != nil {
+			return err
+		}
+		if d < 0 {
+			return fmt.Errorf("invalid retention period %q", t.Retention)
+		}
+	}
+
+	// Validate deduplication window.
+	if t.DedupWindow != "" {
+		d, err := time.ParseDuration(t.DedupWindow)
+		if err != nil {
+			return err
+		}
+		if d < 0 {
+			return fmt.Errorf("invalid deduplication window %q", t.DedupWindow)
+		}
+	}
+
+	// Validate concurrency limit.
+	if t.Concurrency < 0 {
+		return fmt.Errorf("invalid concurrency limit %d", t.Concurrency)
+	}
+
+	// Validate polling order.
+	if t.Fair && t.Prioritized {
+		return errors.New("fair polling can not be combined with priority polling")
+	}
+
+	// Validate task defaults.
+	if d := t.Defaults; d != nil {
+		if d.Defer != "" {
+			if _, err := time.ParseDuration(d.Defer); err != nil {
+				return err
+			}
+		}
+		if d.Jitter != "" {
+			j, err := time.ParseDuration(d.Jitter)
+			if err != nil {
+				return err
+			}
+			if j < 0 {
+				return fmt.Errorf("invalid jitter %q", d.Jitter)
+			}
+		}
+		if err := validateLabels(d.Labels); err != nil {
+			return err
+		}
+	}
+
+	// Validate consumer hints.
+	if h := t.Config; h != nil {
+		if h.Concurrency < 0 || h.MaxConcurrency < 0 {
+			return errors.New("invalid recommended concurrency")
+		}
+		for _, v := range []string{h.ConcurrencyDelay, h.PollInterval, h.DrainInterval, h.ErrorInterval, h.Timeout} {
+			if v == "" {
+				continue
+			}
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return err
+			}
+			if d < 0 {
+				return fmt.Errorf("invalid recommended duration %q", v)
+			}
+		}
+		if h.RateLimit < 0 {
+			return fmt.Errorf("invalid recommended rate limit %g", h.RateLimit)
+		}
+	}
+
+	// Counters are read-only and can not be specified.
+	t.Count = 0
+	t.Pending = 0
+	t.Active = 0
+	t.Completed = 0
+	t.Archived = 0
+	t.Failed = 0
+
+	return nil
+}
@@ -0,0 +1,113 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/hyperonym/ratus"
+	"github.com/hyperonym/ratus/internal/config"
+	"github.com/hyperonym/ratus/internal/engine"
+)
+
+// stateNames contains the names of the task states in transition rules,
+// indexed by the states.
+var stateNames = []string{"pending", "active", "completed", "archived", "failed"}
+
+// transition is a change from a state to another.
+type transition struct {
+	from ratus.TaskState
+	to   ratus.TaskState
+}
+
+// Transitions returns a middleware that rejects commits making forbidden
+// state transitions with ErrConflict, so that misbehaving consumers can not
+// break the lifecycle of tasks. It must be used after the commit middleware.
+// The current state of the task is fetched from the storage engine, and
+// commits without a nonce, a token or a version are made conditional on the
+// version of the fetched task, so that the state can not change between the
+// validation and the commit. Tasks can still be reset by upserting them. A
+// nil middleware is returned if there is no rule.
+func Transitions(tc *config.TransitionConfig, g engine.Engine) (gin.HandlerFunc, error) {
+	f, err := parseTransitions(tc.Forbidden)
+	if err != nil {
+		return nil, err
+	}
+	if len(f) == 0 {
+		return nil, nil
+	}
+
+	return func(c *gin.Context) {
+		m := c.MustGet(ParamCommit).(*ratus.Commit)
+		if err := checkTransition(c.Request.Context(), g, f, c.Param(ParamID), m); err != nil {
+			fail(c, err)
+			return
+		}
+
+		c.Next()
+	}, nil
+}
+
+// checkTransition fetches the task and rejects the commit if it makes a
+// forbidden state transition, otherwise the commit is made conditional on the
+// version of the fetched task unless it has a nonce, a token or a version.
+func checkTransition(ctx context.Context, g engine.Engine, f map[transition]bool, id string, m *ratus.Commit) error {
+	t, err := g.GetTask(ctx, id)
+	if err != nil {
+		return err
+	}
+	if f[transition{t.State, *m.State}] {
+		return fmt.Errorf("%w: transition from %s to %s is not allowed", ratus.ErrConflict, stateNames[t.State], stateNames[*m.State])
+	}
+	if m.Nonce == "" && m.Token == "" && m.Version == 0 {
+		m.Version = t.Version
+	}
+	return nil
+}
+
+// parseTransitions parses a comma-separated list of transitions in the form
+// of from>to, where either state can be * to match any state.
+func parseTransitions(s string) (map[transition]bool, error) {
+	f := make(map[transition]bool)
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		a, b, ok := strings.Cut(v, ">")
+		if !ok {
+			return nil, fmt.Errorf("invalid transition %q, expected from>to", v)
+		}
+		from, err := parseStates(a)
+		if err != nil {
+			return nil, err
+		}
+		to, err := parseStates(b)
+		if err != nil {
+			return nil, err
+		}
+		for _, x := range from {
+			for _, y := range to {
+				f[transition{x, y}] = true
+			}
+		}
+	}
+	return f, nil
+}
+
+// parseStates returns the state with the name, or all states for *.
+func parseStates(s string) ([]ratus.TaskState, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	var v []ratus.TaskState
+	for i, n := range stateNames {
+		if s == "*" || s == n {
+			v = append(v, ratus.TaskState(i))
+		}
+	}
+	if len(v) == 0 {
+		return nil, fmt.Errorf("unknown task state %q", s)
+	}
+	return v, nil
+}
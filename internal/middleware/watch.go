@@ -0,0 +1,57 @@
+package middleware
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/hyperonym/ratus"
+	"github.com/hyperonym/ratus/internal/config"
+)
+
+// Watch returns a middleware that normalizes the "version" and "timeout" query
+// parameters of requests watching tasks for changes. The version is only
+// stored if specified, the timeout defaults to and is capped by the configured
+// timeout, and the interval for checking tasks is stored along with them. A
+// nil middleware is returned if watching is disabled.
+func Watch(wc *config.WatchConfig) (gin.HandlerFunc, error) {
+	if wc.Timeout < 0 {
+		return nil, fmt.Errorf("invalid watch timeout %s", wc.Timeout)
+	}
+	if wc.Timeout == 0 {
+		return nil, nil
+	}
+	if wc.CheckInterval <= 0 {
+		return nil, fmt.Errorf("invalid watch interval %s", wc.CheckInterval)
+	}
+
+	return func(c *gin.Context) {
+
+		// Parse and validate the version known to the caller.
+		if s := c.Query(ParamVersion); s != "" {
+			v, err := strconv.ParseInt(s, 10, 64)
+			if err != nil || v < 0 {
+				fail(c, fmt.Errorf("%w: invalid value of version %q", ratus.ErrBadRequest, s))
+				return
+			}
+			c.Set(ParamVersion, v)
+		}
+
+		// Parse and validate the duration to wait for changes.
+		d := wc.Timeout
+		if s := c.Query(ParamTimeout); s != "" {
+			v, err := time.ParseDuration(s)
+			if err != nil || v <= 0 {
+				fail(c, fmt.Errorf("%w: invalid value of timeout %q", ratus.ErrBadRequest, s))
+				return
+			}
+			d = min(d, v)
+		}
+		c.Set(ParamTimeout, d)
+		c.Set(ParamInterval, wc.CheckInterval)
+
+		c.Next()
+	}, nil
+}
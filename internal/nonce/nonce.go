@@ -1,18 +1,20 @@
-// Package nonce generates random alphanumeric strings of fixed length.
+// Package nonce generates random alphanumeric strings of fixed length, and
+// binds them to the tasks and consumers they are issued for.
 package nonce
 
 import (
-	"math/rand"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"strings"
-	"time"
 )
 
-func init() {
-	// Do not use rand.NewSource to create a new Source. Unlike the default
-	// Source used by top-level rand functions, new sources are not safe for
-	// concurrent use by multiple goroutines.
-	rand.Seed(time.Now().UnixNano())
-}
+// ErrUnbound is returned when a nonce is not bound to the task and the
+// consumer, e.g. if it was issued for another task or has been tampered with.
+var ErrUnbound = errors.New("nonce is not bound to the task and its consumer")
 
 // alphanumericals contains 62 (A-Z, a-z and 0-9, case-sensitive) alphanumeric
 // characters in the POSIX/C locale. The charset is ordered by the Base 64
@@ -20,28 +22,59 @@ func init() {
 // https://datatracker.ietf.org/doc/html/rfc4648#section-4
 const alphanumericals = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
 
-const (
-	charIdxBits = 6                  // 6 bits to represent a char index.
-	charIdxMask = 1<<charIdxBits - 1 // All 1-bits, as many as charIdxBits.
-	charIdxMax  = 63 / charIdxBits   // # of char indices fitting in 63 bits.
-)
+// charIdxMask masks the 6 bits of random bytes used as character indices.
+// Indices beyond the charset are rejected to avoid modulo bias.
+const charIdxMask = 1<<6 - 1
 
-// Generate a random alphanumeric string of the given length.
-// The generate function is safe for concurrent use by multiple goroutines.
-// The original algorithm is taken from: https://stackoverflow.com/a/31832326
+// Generate a random alphanumeric string of the given length using a
+// cryptographically secure random number generator, so that nonces can not be
+// predicted from previous ones. The generate function is safe for concurrent
+// use by multiple goroutines.
 func Generate(n int) string {
-	var sb strings.Builder
-	sb.Grow(n)
-	for i, cache, remain := n-1, rand.Int63(), charIdxMax; i >= 0; {
-		if remain == 0 {
-			cache, remain = rand.Int63(), charIdxMax
+	s := make([]byte, 0, n)
+
+	// Read slightly more bytes than needed, since 2 in 64 are rejected.
+	b := make([]byte, n+n/16+1)
+	for len(s) < n {
+		if _, err := rand.Read(b); err != nil {
+			panic(fmt.Sprintf("nonce: failed to read random bytes: %v", err))
 		}
-		if idx := int(cache & charIdxMask); idx < len(alphanumericals) {
-			sb.WriteByte(alphanumericals[idx])
-			i--
+		for _, c := range b {
+			if idx := int(c & charIdxMask); idx < len(alphanumericals) && len(s) < n {
+				s = append(s, alphanumericals[idx])
+			}
 		}
-		cache >>= charIdxBits
-		remain--
 	}
-	return sb.String()
+	return string(s)
+}
+
+// Bind returns the nonce followed by its HMAC-SHA256 signature over the task
+// ID and the consumer, separated by a dot, so that the nonce can not be used
+// to commit to other tasks or be forged without the key.
+func Bind(key []byte, n, id, consumer string) string {
+	return n + "." + base64.RawURLEncoding.EncodeToString(signature(key, n, id, consumer))
+}
+
+// Unbind verifies the signature of a bound nonce against the task ID and the
+// consumer, and returns the original nonce if the signature matches.
+func Unbind(key []byte, s, id, consumer string) (string, error) {
+	n, q, ok := strings.Cut(s, ".")
+	if !ok {
+		return "", ErrUnbound
+	}
+	b, err := base64.RawURLEncoding.DecodeString(q)
+	if err != nil || !hmac.Equal(b, signature(key, n, id, consumer)) {
+		return "", ErrUnbound
+	}
+	return n, nil
+}
+
+// signature returns the HMAC-SHA256 of the nonce, the task ID and the
+// consumer, which are prefixed by their lengths to keep them apart.
+func signature(key []byte, n, id, consumer string) []byte {
+	h := hmac.New(sha256.New, key)
+	for _, v := range []string{n, id, consumer} {
+		fmt.Fprintf(h, "%d:%s", len(v), v)
+	}
+	return h.Sum(nil)
 }
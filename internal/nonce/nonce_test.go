@@ -1,6 +1,8 @@
 package nonce_test
 
 import (
+	"errors"
+	"strings"
 	"testing"
 
 	"github.com/hyperonym/ratus/internal/nonce"
@@ -29,6 +31,51 @@ func TestGenerate(t *testing.T) {
 	}
 }
 
+func TestCharset(t *testing.T) {
+	seen := make(map[rune]bool)
+	for i := 0; i < 1000; i++ {
+		for _, c := range nonce.Generate(16) {
+			if !strings.ContainsRune("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789", c) {
+				t.Fatalf("unexpected character %q in nonce", c)
+			}
+			seen[c] = true
+		}
+	}
+	if len(seen) != 62 {
+		t.Errorf("incorrect number of distinct characters, expected 62, got %d", len(seen))
+	}
+}
+
+func TestBind(t *testing.T) {
+	key := []byte("secret")
+	n := nonce.Generate(16)
+	s := nonce.Bind(key, n, "id", "consumer")
+	if !strings.HasPrefix(s, n+".") {
+		t.Errorf("bound nonce should start with the original nonce, got %q", s)
+	}
+	if v, err := nonce.Unbind(key, s, "id", "consumer"); err != nil || v != n {
+		t.Errorf("incorrect unbound nonce, expected %q, got %q and %v", n, v, err)
+	}
+	for _, x := range []struct {
+		key      string
+		s        string
+		id       string
+		consumer string
+	}{
+		{"secret", s, "other", "consumer"},
+		{"secret", s, "id", "other"},
+		{"secret", s, "i", "dconsumer"},
+		{"other", s, "id", "consumer"},
+		{"secret", n, "id", "consumer"},
+		{"secret", n + ".!", "id", "consumer"},
+		{"secret", nonce.Generate(16) + s[len(n):], "id", "consumer"},
+	} {
+		if _, err := nonce.Unbind([]byte(x.key), x.s, x.id, x.consumer); !errors.Is(err, nonce.ErrUnbound) {
+			t.Errorf("expected error for %+v, got %v", x, err)
+		}
+	}
+}
+
 func BenchmarkGenerate16(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		nonce.Generate(16)
@@ -0,0 +1,160 @@
+// Package notify publishes notifications of available tasks to external
+// messaging systems, so that consumers can wake up and poll as soon as tasks
+// become available instead of polling at short intervals.
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/hyperonym/ratus"
+	"github.com/hyperonym/ratus/internal/config"
+	"github.com/hyperonym/ratus/internal/engine"
+)
+
+// retryInterval is the duration to wait before watching the storage engine
+// again after the watch has failed.
+const retryInterval = 5 * time.Second
+
+// NATS publishes notifications of available tasks to NATS subjects in the form
+// of "<subject>.<topic>", with the topic in the JSON body such as
+// {"name":"topic"}. Notifications of the same topic are coalesced within the
+// throttle interval. When the storage engine is unable to tell which topic has
+// changed, the notification is published to the subject itself. The subjects
+// can be captured by JetStream streams configured on the server.
+//
+// Notifications are hints rather than deliveries: they may arrive before the
+// scheduled time of the tasks and may be lost while the server is unavailable,
+// so consumers should still poll at a lower frequency.
+type NATS struct {
+	url      string
+	subject  string
+	throttle time.Duration
+
+	// Topics with available tasks since the last flush.
+	mu     sync.Mutex
+	topics map[string]struct{}
+}
+
+// NewNATS creates a NATS notifier with the configuration. A nil notifier is
+// returned if no server is configured.
+func NewNATS(nc *config.NotifyConfig) (*NATS, error) {
+	if nc.URL == "" {
+		return nil, nil
+	}
+	if !valid(nc.Subject) {
+		return nil, fmt.Errorf("invalid NATS subject %q", nc.Subject)
+	}
+	if nc.Throttle <= 0 {
+		return nil, fmt.Errorf("invalid NATS throttle interval %s", nc.Throttle)
+	}
+	return &NATS{
+		url:      nc.URL,
+		subject:  nc.Subject,
+		throttle: nc.Throttle,
+		topics:   make(map[string]struct{}),
+	}, nil
+}
+
+// Notify marks the topic as having available tasks, which is published at the
+// next flush. An empty topic name indicates that tasks in any topic may be
+// available. Topics whose names can not be used in subjects are ignored.
+func (n *NATS) Notify(topic string) {
+	if topic != "" && !valid(topic) {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.topics[topic] = struct{}{}
+}
+
+// Run connects to the server and publishes notifications of the tasks reported
+// by the watcher until the context is canceled. The connection is retried in
+// the background if the server is unavailable.
+func (n *NATS) Run(ctx context.Context, w engine.Watcher) error {
+	c, err := nats.Connect(n.url, nats.Name("ratus"), nats.MaxReconnects(-1), nats.RetryOnFailedConnect(true))
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		n.watch(ctx, w)
+	}()
+
+	// Publish the notifications collected within each throttle interval, and
+	// the remaining ones before returning.
+	r := time.NewTicker(n.throttle)
+	defer r.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			<-done
+			n.flush(c)
+			c.FlushTimeout(n.throttle)
+			return nil
+		case <-r.C:
+			n.flush(c)
+		}
+	}
+}
+
+// watch keeps watching the storage engine until the context is canceled,
+// watching again after failures.
+func (n *NATS) watch(ctx context.Context, w engine.Watcher) {
+	for {
+		err := w.Watch(ctx, n.Notify)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("NATS notifications: %v, watching again in %v\n", err, retryInterval)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+// flush publishes the notifications of the topics marked since the last flush.
+func (n *NATS) flush(c *nats.Conn) {
+	n.mu.Lock()
+	ts := n.topics
+	n.topics = make(map[string]struct{})
+	n.mu.Unlock()
+
+	for t := range ts {
+		s := n.subject
+		if t != "" {
+			s += "." + t
+		}
+		b, err := json.Marshal(&ratus.Topic{Name: t})
+		if err != nil {
+			continue
+		}
+		if err := c.Publish(s, b); err != nil {
+			log.Printf("NATS notifications: %v\n", err)
+		}
+	}
+}
+
+// valid returns whether the string can be used as tokens of NATS subjects,
+// i.e. it consists of non-empty tokens separated by dots, without whitespace
+// and wildcards.
+func valid(s string) bool {
+	for _, t := range strings.Split(s, ".") {
+		if t == "" || strings.ContainsAny(t, " \t\r\n*>") {
+			return false
+		}
+	}
+	return true
+}
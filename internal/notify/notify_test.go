@@ -0,0 +1,73 @@
+package notify_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hyperonym/ratus/internal/config"
+	"github.com/hyperonym/ratus/internal/notify"
+)
+
+// watcher is a watcher that reports a topic and then fails.
+type watcher struct {
+	calls atomic.Int64
+}
+
+func (w *watcher) Watch(ctx context.Context, f func(topic string)) error {
+	w.calls.Add(1)
+	f("topic")
+	f("")
+	f("invalid topic")
+	return errors.New("unavailable")
+}
+
+func TestNATS(t *testing.T) {
+	t.Run("disabled", func(t *testing.T) {
+		n, err := notify.NewNATS(&config.NotifyConfig{})
+		if err != nil {
+			t.Error(err)
+		}
+		if n != nil {
+			t.Error("expected nil notifier without URL")
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, c := range []config.NotifyConfig{
+			{URL: "nats://localhost:4222", Subject: "", Throttle: time.Second},
+			{URL: "nats://localhost:4222", Subject: "ratus..available", Throttle: time.Second},
+			{URL: "nats://localhost:4222", Subject: "ratus.>", Throttle: time.Second},
+			{URL: "nats://localhost:4222", Subject: "ratus.available", Throttle: 0},
+		} {
+			if _, err := notify.NewNATS(&c); err == nil {
+				t.Errorf("expected error for configuration %+v", c)
+			}
+		}
+	})
+
+	t.Run("run", func(t *testing.T) {
+		n, err := notify.NewNATS(&config.NotifyConfig{
+			URL:      "nats://localhost:1",
+			Subject:  "ratus.available",
+			Throttle: 10 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Running against an unavailable server keeps watching until the
+		// context is canceled.
+		var w watcher
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		if err := n.Run(ctx, &w); err != nil {
+			t.Error(err)
+		}
+		if w.calls.Load() != 1 {
+			t.Errorf("incorrect number of watches, expected 1, got %d", w.calls.Load())
+		}
+	})
+}
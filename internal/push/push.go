@@ -0,0 +1,312 @@
+// Package push delivers tasks to consumers by posting them to HTTP endpoints,
+// for consumers such as serverless functions that are unable to run polling
+// loops.
+package push
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hyperonym/ratus"
+	"github.com/hyperonym/ratus/internal/config"
+	"github.com/hyperonym/ratus/internal/engine"
+	"github.com/hyperonym/ratus/internal/metrics"
+)
+
+// commitMargin is the time allowed for committing tasks after the endpoints
+// have responded, which is added to the deadlines of claimed tasks.
+const commitMargin = 10 * time.Second
+
+// maxErrorLength is the maximum number of bytes of the response bodies of
+// failed requests to be recorded as the last errors of tasks.
+const maxErrorLength = 1024
+
+// maxCommitLength is the maximum number of bytes of the response bodies of
+// successful requests to be decoded as commits.
+const maxCommitLength = 16 << 20
+
+// Endpoint is an HTTP endpoint to which tasks in a topic are posted.
+type Endpoint struct {
+	Topic string
+	URL   string
+}
+
+// ParseEndpoints parses a comma-separated list of topic=URL pairs.
+func ParseEndpoints(s string) ([]Endpoint, error) {
+	var es []Endpoint
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		t, u, ok := strings.Cut(v, "=")
+		if !ok || t == "" {
+			return nil, fmt.Errorf("invalid push endpoint %q", v)
+		}
+		if _, err := url.ParseRequestURI(u); err != nil {
+			return nil, fmt.Errorf("invalid push endpoint %q: %w", v, err)
+		}
+		es = append(es, Endpoint{Topic: t, URL: u})
+	}
+	return es, nil
+}
+
+// Pusher claims tasks on behalf of consumers and posts them as JSON to the
+// endpoints of their topics, committing the tasks according to the responses:
+//   - Successful responses complete the tasks, unless their bodies contain
+//     commits in JSON, which are applied instead.
+//   - Responses with status codes of 408, 429 or 5xx, as well as network
+//     errors and timeouts, reset the tasks to pending after the retry delay
+//     or the duration in the Retry-After header.
+//   - Other responses mark the tasks as failed.
+//
+// The last errors of tasks are set to the reasons of the failures. Tasks whose
+// commits fail are recovered by background jobs once their deadlines pass.
+type Pusher struct {
+
+	// Function called with tasks after they are committed, e.g. to republish
+	// them to external message brokers. It must not block.
+	Bridge func(*ratus.Task)
+
+	// Function validating commits before they are applied, so that commits in
+	// the responses of endpoints are subject to the same rules as the ones
+	// submitted through the API. Commits rejected with ErrBadRequest are
+	// replaced by commits marking the tasks as failed.
+	Validate func(ctx context.Context, id string, m *ratus.Commit) error
+
+	engine      engine.Engine
+	client      *http.Client
+	endpoints   []Endpoint
+	concurrency int
+	timeout     time.Duration
+	delay       time.Duration
+	interval    time.Duration
+}
+
+// New creates a Pusher with the configuration. A nil pusher is returned if no
+// endpoint is configured.
+func New(g engine.Engine, pc *config.PushConfig) (*Pusher, error) {
+	es, err := ParseEndpoints(pc.Endpoints)
+	if err != nil {
+		return nil, err
+	}
+	if len(es) == 0 {
+		return nil, nil
+	}
+	if pc.Concurrency <= 0 {
+		return nil, fmt.Errorf("invalid push concurrency %d", pc.Concurrency)
+	}
+	if pc.Timeout <= 0 {
+		return nil, fmt.Errorf("invalid push timeout %s", pc.Timeout)
+	}
+	return &Pusher{
+		engine:      g,
+		client:      &http.Client{Timeout: pc.Timeout},
+		endpoints:   es,
+		concurrency: pc.Concurrency,
+		timeout:     pc.Timeout,
+		delay:       pc.RetryDelay,
+		interval:    pc.PollInterval,
+	}, nil
+}
+
+// Run posts tasks to the endpoints until the context is canceled, with up to
+// the configured number of tasks in flight for each endpoint. Tasks being
+// posted when the context is canceled are still committed before returning.
+func (p *Pusher) Run(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for _, e := range p.endpoints {
+		for range p.concurrency {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				p.work(ctx, e)
+			}()
+		}
+	}
+	wg.Wait()
+	return nil
+}
+
+// work keeps posting tasks in the topic to the endpoint, and waits for the
+// interval whenever no task is available.
+func (p *Pusher) work(ctx context.Context, e Endpoint) {
+	for ctx.Err() == nil {
+		ok, err := p.push(ctx, e)
+		if err != nil {
+			log.Printf("push to %s: %v\n", e.URL, err)
+		}
+		if ok {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(p.interval):
+		}
+	}
+}
+
+// push claims a task in the topic, posts it to the endpoint and commits it,
+// returning whether a task has been claimed.
+func (p *Pusher) push(ctx context.Context, e Endpoint) (bool, error) {
+	d := time.Now().Add(p.timeout + commitMargin)
+	t, err := p.engine.Poll(ctx, e.Topic, &ratus.Promise{Consumer: e.URL, Deadline: &d})
+	if errors.Is(err, ratus.ErrNotFound) || errors.Is(err, ratus.ErrTooManyRequests) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	metrics.ConsumedCounter.WithLabelValues(t.Topic, t.Producer, t.Consumer).Add(1)
+
+	// Finish delivering the claimed task even if the context is canceled, so
+	// that it is not left active until the deadline.
+	ctx = context.WithoutCancel(ctx)
+	m := p.post(ctx, e, t)
+
+	// Tasks in topics delivering at most once are completed when polled, so
+	// there is nothing to commit.
+	if t.State != ratus.TaskStateActive {
+		return true, nil
+	}
+	m.Nonce = t.Nonce
+	m.Consumer = t.Consumer
+	if p.Validate != nil {
+		err := p.Validate(ctx, t.ID, m)
+		if errors.Is(err, ratus.ErrBadRequest) {
+			m = fail(fmt.Sprintf("invalid commit in response: %v", err))
+			m.Nonce = t.Nonce
+			m.Consumer = t.Consumer
+			err = p.Validate(ctx, t.ID, m)
+		}
+		if err != nil {
+			return true, err
+		}
+	}
+	v, err := p.engine.Commit(ctx, t.ID, m)
+	if err != nil {
+		return true, err
+	}
+	metrics.CommittedCounter.WithLabelValues(v.Topic, v.Producer, v.Consumer).Add(1)
+	if p.Bridge != nil {
+		p.Bridge(v)
+	}
+	return true, nil
+}
+
+// post posts the task to the endpoint and returns the commit to be applied
+// according to the response.
+func (p *Pusher) post(ctx context.Context, e Endpoint, t *ratus.Task) *ratus.Commit {
+	b, err := json.Marshal(t)
+	if err != nil {
+		return fail(err.Error())
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.URL, bytes.NewReader(b))
+	if err != nil {
+		return fail(err.Error())
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := p.client.Do(req)
+	if err != nil {
+		return retry(err.Error(), p.delay)
+	}
+	defer res.Body.Close()
+
+	// Apply the commit in the response body if any.
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		m, err := decode(res)
+		if err != nil {
+			return fail(fmt.Sprintf("invalid commit in response: %v", err))
+		}
+		return m
+	}
+
+	// Record the status and the beginning of the response body as the error.
+	r, _ := io.ReadAll(io.LimitReader(res.Body, maxErrorLength))
+	s := "endpoint responded with status " + res.Status
+	if v := strings.TrimSpace(string(r)); v != "" {
+		s += ": " + v
+	}
+	switch {
+	case res.StatusCode == http.StatusRequestTimeout,
+		res.StatusCode == http.StatusTooManyRequests,
+		res.StatusCode >= 500:
+		d := p.delay
+		if v, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil && v >= 0 {
+			d = time.Duration(v) * time.Second
+		}
+		return retry(s, d)
+	default:
+		return fail(s)
+	}
+}
+
+// decode decodes the commit in the body of a successful response. Responses
+// without JSON bodies complete the tasks.
+func decode(res *http.Response) (*ratus.Commit, error) {
+	var m ratus.Commit
+	t, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if t == "application/json" {
+		b, err := io.ReadAll(io.LimitReader(res.Body, maxCommitLength+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(b) > maxCommitLength {
+			return nil, fmt.Errorf("response body exceeds %d bytes", maxCommitLength)
+		}
+		if len(bytes.TrimSpace(b)) > 0 {
+			if err := json.Unmarshal(b, &m); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Normalize the commit like the ones submitted through the API, while
+	// leaving the nonce to be set by the pusher.
+	m.Nonce = ""
+	m.Token = ""
+	m.Version = 0
+	if m.State == nil {
+		s := ratus.TaskStateCompleted
+		m.State = &s
+	}
+	if *m.State < ratus.TaskStatePending || *m.State > ratus.TaskStateFailed {
+		return nil, fmt.Errorf("invalid target state %d", *m.State)
+	}
+	if m.Defer != "" && m.Scheduled == nil {
+		d, err := time.ParseDuration(m.Defer)
+		if err != nil {
+			return nil, err
+		}
+		n := time.Now().Add(d)
+		m.Scheduled = &n
+	}
+	m.Defer = ""
+
+	return &m, nil
+}
+
+// retry returns a commit that resets the task to pending after the duration.
+func retry(reason string, d time.Duration) *ratus.Commit {
+	s := ratus.TaskStatePending
+	n := time.Now().Add(d)
+	return &ratus.Commit{State: &s, Scheduled: &n, Error: reason}
+}
+
+// fail returns a commit that marks the task as failed.
+func fail(reason string) *ratus.Commit {
+	s := ratus.TaskStateFailed
+	return &ratus.Commit{State: &s, Error: reason}
+}
@@ -0,0 +1,173 @@
+package push_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hyperonym/ratus"
+	"github.com/hyperonym/ratus/internal/config"
+	"github.com/hyperonym/ratus/internal/engine/memdb"
+	"github.com/hyperonym/ratus/internal/middleware"
+	"github.com/hyperonym/ratus/internal/push"
+)
+
+func TestParseEndpoints(t *testing.T) {
+	es, err := push.ParseEndpoints(" a=http://localhost/a?k=v, ,b=https://example.com/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(es) != 2 || es[0].Topic != "a" || es[0].URL != "http://localhost/a?k=v" || es[1].Topic != "b" {
+		t.Errorf("incorrect endpoints, got %v", es)
+	}
+	for _, s := range []string{"a", "=http://localhost/", "a=localhost"} {
+		if _, err := push.ParseEndpoints(s); err == nil {
+			t.Errorf("expected error for endpoints %q", s)
+		}
+	}
+}
+
+func TestPusher(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("disabled", func(t *testing.T) {
+		p, err := push.New(nil, &config.PushConfig{})
+		if err != nil {
+			t.Error(err)
+		}
+		if p != nil {
+			t.Error("expected nil pusher without endpoints")
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, c := range []config.PushConfig{
+			{Endpoints: "a=http://localhost/", Concurrency: 0, Timeout: time.Second},
+			{Endpoints: "a=http://localhost/", Concurrency: 1, Timeout: 0},
+		} {
+			if _, err := push.New(nil, &c); err == nil {
+				t.Errorf("expected error for configuration %+v", c)
+			}
+		}
+	})
+
+	t.Run("run", func(t *testing.T) {
+		g, err := memdb.New(&memdb.Config{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := g.Open(ctx); err != nil {
+			t.Fatal(err)
+		}
+		defer g.Destroy(ctx)
+
+		// Respond according to the IDs of the tasks.
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var v ratus.Task
+			if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			switch v.ID {
+			case "completed":
+				w.WriteHeader(http.StatusNoContent)
+			case "committed":
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"payload":"result","nonce":"ignored"}`))
+			case "failed":
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				w.Write([]byte("invalid payload"))
+			case "renamed":
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"topic":"Other"}`))
+			case "retried":
+				w.Header().Set("Retry-After", "3600")
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		}))
+		defer s.Close()
+
+		n := time.Now()
+		var ts []*ratus.Task
+		for _, id := range []string{"completed", "committed", "failed", "renamed", "retried"} {
+			ts = append(ts, &ratus.Task{ID: id, Topic: "test", Producer: "producer", Scheduled: &n})
+		}
+		if _, err := g.InsertTasks(ctx, ts); err != nil {
+			t.Fatal(err)
+		}
+
+		p, err := push.New(g, &config.PushConfig{
+			Endpoints:    "test=" + s.URL,
+			Concurrency:  2,
+			Timeout:      time.Second,
+			RetryDelay:   time.Minute,
+			PollInterval: 10 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := middleware.NewCommitValidator(&config.NameConfig{Charset: "a-z"}, &config.TransitionConfig{Forbidden: "active>archived"}, g)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.Validate = v.Validate
+		var mu sync.Mutex
+		var bs []*ratus.Task
+		done := make(chan struct{})
+		p.Bridge = func(t *ratus.Task) {
+			mu.Lock()
+			defer mu.Unlock()
+			bs = append(bs, t)
+			if len(bs) == len(ts) {
+				close(done)
+			}
+		}
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		go func() {
+			select {
+			case <-done:
+			case <-ctx.Done():
+			}
+			cancel()
+		}()
+		if err := p.Run(ctx); err != nil {
+			t.Error(err)
+		}
+		if len(bs) != len(ts) {
+			t.Fatalf("incorrect number of committed tasks, expected %d, got %d", len(ts), len(bs))
+		}
+
+		ctx = context.Background()
+		for _, c := range []struct {
+			id      string
+			state   ratus.TaskState
+			payload any
+			err     string
+		}{
+			{"completed", ratus.TaskStateCompleted, nil, ""},
+			{"committed", ratus.TaskStateCompleted, "result", ""},
+			{"failed", ratus.TaskStateFailed, nil, "endpoint responded with status 422 Unprocessable Entity: invalid payload"},
+			{"renamed", ratus.TaskStateFailed, nil, `invalid commit in response: bad request: topic "Other" contains characters that are not allowed`},
+			{"retried", ratus.TaskStatePending, nil, "endpoint responded with status 503 Service Unavailable"},
+		} {
+			v, err := g.GetTask(ctx, c.id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v.State != c.state || v.Payload != c.payload || v.LastError != c.err {
+				t.Errorf("incorrect task %q, got state %d, payload %v and error %q", c.id, v.State, v.Payload, v.LastError)
+			}
+			if v.Consumer != s.URL {
+				t.Errorf("incorrect consumer, expected %q, got %q", s.URL, v.Consumer)
+			}
+			if c.id == "retried" && time.Until(*v.Scheduled) < 59*time.Minute {
+				t.Errorf("incorrect scheduled time, expected an hour later, got %v", v.Scheduled)
+			}
+		}
+	})
+}
@@ -0,0 +1,323 @@
+// Package record records anonymized API traffic into a replayable log, so that
+// race conditions reported in production can be reproduced against local
+// instances with the same sequence and timing of requests.
+package record
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/hyperonym/ratus"
+	"github.com/hyperonym/ratus/internal/config"
+	"github.com/hyperonym/ratus/internal/wire"
+)
+
+// Entry is a recorded request. Identifiers in the path, query and body are
+// replaced by their hashes, which preserves whether requests refer to the same
+// topics, tasks and consumers without revealing them. Only values known not to
+// identify anything are recorded as is, and other values in the body, such as
+// payloads and nonces, are removed.
+type Entry struct {
+
+	// Time elapsed since the start of recording when the request was received.
+	Offset time.Duration `json:"offset"`
+	// Time taken to handle the request.
+	Duration time.Duration `json:"duration"`
+
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	Query  string `json:"query,omitempty"`
+	Status int    `json:"status"`
+
+	// HMAC-SHA256 of the original body in hex, keyed by a random key generated
+	// for each recording, which tells whether requests in the same recording
+	// were sent with identical bodies without allowing the bodies to be
+	// recovered by guessing.
+	Hash string `json:"hash,omitempty"`
+	// Anonymized body in JSON, which is absent if the original body is empty
+	// or can not be decoded in its wire format.
+	Body json.RawMessage `json:"body,omitempty"`
+}
+
+// hashLength is the number of bytes of the HMAC kept in hashed identifiers,
+// which are encoded in hex and remain valid names of topics and tasks.
+const hashLength = 8
+
+// verbatim contains the names of path parameters that are not identifiers,
+// such as the custom methods of resources, which are recorded as is.
+var verbatim = map[string]bool{
+	"action":   true,
+	"filepath": true,
+}
+
+// identifiers contains the keys of fields in request bodies whose values are
+// identifiers, which are replaced by their hashes.
+var identifiers = map[string]bool{
+	"_id":        true,
+	"id":         true,
+	"ids":        true,
+	"name":       true,
+	"topic":      true,
+	"producer":   true,
+	"consumer":   true,
+	"depends_on": true,
+	"dedup":      true,
+}
+
+// retained contains the keys of fields in request bodies whose values do not
+// identify anything, which are recorded as is. Objects and arrays in these
+// fields are anonymized recursively. Fields that are neither identifiers nor
+// retained, including payloads, results, errors, nonces and unknown fields,
+// are left out of recorded bodies.
+var retained = map[string]bool{
+	"data":              true,
+	"defaults":          true,
+	"config":            true,
+	"progress":          true,
+	"state":             true,
+	"version":           true,
+	"timeout":           true,
+	"deadline":          true,
+	"defer":             true,
+	"jitter":            true,
+	"scheduled":         true,
+	"produced":          true,
+	"consumed":          true,
+	"time":              true,
+	"percent":           true,
+	"at_most_once":      true,
+	"retention":         true,
+	"fair":              true,
+	"prioritized":       true,
+	"priority":          true,
+	"concurrency":       true,
+	"max_concurrency":   true,
+	"concurrency_delay": true,
+	"poll_interval":     true,
+	"drain_interval":    true,
+	"error_interval":    true,
+	"rate_limit":        true,
+	"dedup_window":      true,
+	"rate":              true,
+	"pending":           true,
+}
+
+// parameters contains the names of query parameters whose values do not
+// identify anything, which are recorded as is. Values of other parameters are
+// replaced by their hashes, except for label selectors whose keys and values
+// are hashed separately, and cursors which are removed.
+var parameters = map[string]bool{
+	"limit":        true,
+	"offset":       true,
+	"sort":         true,
+	"count":        true,
+	"include":      true,
+	"next":         true,
+	"timeout":      true,
+	"deadline":     true,
+	"version":      true,
+	"from":         true,
+	"to":           true,
+	"at_most_once": true,
+}
+
+// Recorder appends anonymized requests to a file as newline-delimited JSON,
+// one entry per line in the order the requests were completed.
+type Recorder struct {
+	mu    sync.Mutex
+	file  *os.File
+	start time.Time
+	salt  []byte
+	key   []byte
+}
+
+// New creates a recorder with the configuration, which opens the file for
+// appending and creates it if it does not exist. A nil recorder is returned if
+// no file is configured. Bodies are hashed with a random key generated for
+// each recording, and so are identifiers if no salt is configured.
+func New(rc *config.RecordConfig) (*Recorder, error) {
+	if rc.Path == "" {
+		return nil, nil
+	}
+	k := make([]byte, sha256.Size)
+	if _, err := rand.Read(k); err != nil {
+		return nil, err
+	}
+	s := []byte(rc.Salt)
+	if len(s) == 0 {
+		s = k
+	}
+	f, err := os.OpenFile(rc.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{file: f, start: time.Now(), salt: s, key: k}, nil
+}
+
+// Handler returns a middleware that records the requests it handles. Requests
+// that do not match any route are not recorded.
+func (r *Recorder) Handler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		n := time.Now()
+
+		// Read the request body to be recorded, and restore it for subsequent
+		// handlers.
+		var b []byte
+		if c.Request.Body != nil {
+			var err error
+			if b, err = io.ReadAll(c.Request.Body); err != nil {
+				e := ratus.NewError(fmt.Errorf("%w: %v", ratus.ErrBadRequest, err))
+				c.AbortWithStatusJSON(e.Error.Code, e)
+				return
+			}
+			c.Request.Body = io.NopCloser(bytes.NewReader(b))
+		}
+
+		c.Next()
+
+		p := c.FullPath()
+		if p == "" {
+			return
+		}
+		e := Entry{
+			Offset:   n.Sub(r.start),
+			Duration: time.Since(n),
+			Method:   c.Request.Method,
+			Path:     r.path(p, c.Params),
+			Query:    r.query(c.Request.URL.Query()),
+			Status:   c.Writer.Status(),
+		}
+		if len(b) > 0 {
+			h := hmac.New(sha256.New, r.key)
+			h.Write(b)
+			e.Hash = hex.EncodeToString(h.Sum(nil))
+			var v any
+			if err := wire.Decode(bytes.NewReader(b), wire.Parse(c.ContentType()), &v); err == nil {
+				e.Body, _ = json.Marshal(r.anonymize("", v))
+			}
+		}
+		r.write(&e)
+	}
+}
+
+// Close closes the file.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.file.Close()
+}
+
+// write appends the entry to the file. Entries that can not be written are
+// dropped, since recording must not affect the handling of requests.
+func (r *Recorder) write(e *Entry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	json.NewEncoder(r.file).Encode(e)
+}
+
+// hash returns the hex-encoded HMAC of the identifier keyed by the salt.
+func (r *Recorder) hash(s string) string {
+	h := hmac.New(sha256.New, r.salt)
+	h.Write([]byte(s))
+	return hex.EncodeToString(h.Sum(nil)[:hashLength])
+}
+
+// path fills the parameters of the route with the hashes of their values.
+// Parameters missing from the route are custom methods split from the IDs of
+// resources, which are appended to the path.
+func (r *Recorder) path(route string, ps gin.Params) string {
+	for _, p := range ps {
+		v := p.Value
+		if !verbatim[p.Key] {
+			v = r.hash(v)
+		}
+		if !strings.Contains(route, ":"+p.Key) {
+			if strings.Contains(route, "*"+p.Key) {
+				route = strings.Replace(route, "*"+p.Key, v, 1)
+			} else {
+				route += v
+			}
+			continue
+		}
+		route = strings.Replace(route, ":"+p.Key, v, 1)
+	}
+	return route
+}
+
+// query anonymizes the values of query parameters that are not known to be
+// free of identifiers, and removes cursors that encode the identifiers of
+// tasks.
+func (r *Recorder) query(q url.Values) string {
+	q.Del("cursor")
+	for k, vs := range q {
+		if parameters[k] {
+			continue
+		}
+		for i, v := range vs {
+			if k != "labels" {
+				vs[i] = r.hash(v)
+				continue
+			}
+			ps := strings.Split(v, ",")
+			for j, p := range ps {
+				if l, x, ok := strings.Cut(p, "="); ok {
+					ps[j] = r.hash(l) + "=" + r.hash(x)
+				} else {
+					ps[j] = r.hash(p)
+				}
+			}
+			vs[i] = strings.Join(ps, ",")
+		}
+	}
+	return q.Encode()
+}
+
+// anonymize replaces identifiers in the decoded body with their hashes and
+// removes fields that are not known to be free of identifiers. The key is the
+// name of the field containing the value, or empty for the body itself.
+func (r *Recorder) anonymize(key string, v any) any {
+	switch x := v.(type) {
+	case map[string]any:
+		for k, y := range x {
+			switch {
+			case k == "labels":
+				m, ok := y.(map[string]any)
+				if !ok {
+					delete(x, k)
+					continue
+				}
+				u := make(map[string]any, len(m))
+				for l, z := range m {
+					u[r.hash(l)] = r.hash(fmt.Sprint(z))
+				}
+				x[k] = u
+			case identifiers[k] || retained[k]:
+				x[k] = r.anonymize(k, y)
+			default:
+				delete(x, k)
+			}
+		}
+	case []any:
+		for i, y := range x {
+			x[i] = r.anonymize(key, y)
+		}
+	case string:
+		if identifiers[key] {
+			return r.hash(x)
+		}
+	}
+	return v
+}
@@ -0,0 +1,159 @@
+package record_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/hyperonym/ratus/internal/config"
+	"github.com/hyperonym/ratus/internal/record"
+)
+
+func init() {
+	gin.SetMode(gin.ReleaseMode)
+}
+
+// router returns a router using the middleware if any, which responds with
+// conflicts to requests with the Conflict header set.
+func router(h gin.HandlerFunc) *gin.Engine {
+	r := gin.New()
+	if h != nil {
+		r.Use(h)
+	}
+	f := func(c *gin.Context) {
+		if c.GetHeader("Conflict") != "" {
+			c.Status(http.StatusConflict)
+			return
+		}
+		c.Status(http.StatusOK)
+	}
+	r.POST("/topics/:topic/tasks/:id", f)
+	r.PATCH("/topics/:topic/tasks/:id", f)
+	r.POST("/topics/:topic/tasks:action", f)
+	r.GET("/topics/:topic/tasks", f)
+	return r
+}
+
+func TestRecorder(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "traffic.ndjson")
+	if r, err := record.New(&config.RecordConfig{}); r != nil || err != nil {
+		t.Fatalf("expected nil recorder without path, got %v (%v)", r, err)
+	}
+	rec, err := record.New(&config.RecordConfig{Path: p, Salt: "salt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := router(rec.Handler())
+
+	for _, x := range []struct {
+		method   string
+		path     string
+		body     string
+		conflict bool
+	}{
+		{http.MethodPost, "/topics/secret/tasks/1", `{"id":"1","topic":"secret","payload":"private","labels":{"tenant":"acme"},"timeout":"30s"}`, false},
+		{http.MethodPatch, "/topics/secret/tasks/1", `{"nonce":"xyz","state":2,"result":"private"}`, true},
+		{http.MethodPost, "/topics/secret/tasks:move", `{"topic":"other"}`, false},
+		{http.MethodGet, "/topics/secret/tasks?limit=10&cursor=xyz&labels=tenant=acme&consumer=alice&confirm=secret", "", false},
+		{http.MethodGet, "/unknown", "", false},
+		{http.MethodPost, "/topics/secret/tasks/2", `{"id":"2","dedup":"invoice","unknown":"private","labels":{"tenant":"acme"},"timeout":"30s"}`, false},
+		{http.MethodPost, "/topics/secret/tasks/2", `{"id":"2","dedup":"invoice","unknown":"private","labels":{"tenant":"acme"},"timeout":"30s"}`, false},
+	} {
+		req := httptest.NewRequest(x.method, x.path, strings.NewReader(x.body))
+		req.Header.Set("Content-Type", "application/json")
+		if x.conflict {
+			req.Header.Set("Conflict", "1")
+		}
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var es []record.Entry
+	for _, l := range bytes.Split(bytes.TrimSpace(b), []byte("\n")) {
+		var e record.Entry
+		if err := json.Unmarshal(l, &e); err != nil {
+			t.Fatal(err)
+		}
+		es = append(es, e)
+	}
+	if len(es) != 6 {
+		t.Fatalf("incorrect number of entries, expected 6, got %d", len(es))
+	}
+
+	// Identifiers are hashed consistently, and values that are not known to
+	// be free of identifiers are removed.
+	for _, s := range []string{"secret", "private", "acme", "xyz", "tenant", "alice", "invoice", "unknown"} {
+		if bytes.Contains(b, []byte(s)) {
+			t.Errorf("expected %q to be anonymized, got %s", s, b)
+		}
+	}
+	topic := strings.Split(es[0].Path, "/")[2]
+	var v map[string]any
+	if err := json.Unmarshal(es[0].Body, &v); err != nil {
+		t.Fatal(err)
+	}
+	if v["topic"] != topic || v["timeout"] != "30s" || v["payload"] != nil {
+		t.Errorf("incorrect anonymized body, got %s", es[0].Body)
+	}
+	if es[0].Path != es[1].Path || es[0].Hash == "" || es[0].Hash == es[1].Hash {
+		t.Errorf("incorrect path or hash, got %v and %v", es[0], es[1])
+	}
+	if es[1].Status != http.StatusConflict {
+		t.Errorf("incorrect status, expected %d, got %d", http.StatusConflict, es[1].Status)
+	}
+	if es[2].Path != "/topics/"+topic+"/tasks:move" {
+		t.Errorf("incorrect path of custom method, got %q", es[2].Path)
+	}
+	if strings.Contains(es[3].Query, "cursor") || !strings.Contains(es[3].Query, "limit=10") || !strings.Contains(es[3].Query, "confirm="+topic) {
+		t.Errorf("incorrect query, got %q", es[3].Query)
+	}
+
+	// Bodies are hashed with a key, so identical bodies have the same hash
+	// within the recording, which is not the plain digest of the body.
+	if es[4].Hash == "" || es[4].Hash != es[5].Hash {
+		t.Errorf("expected identical bodies to have the same hash, got %q and %q", es[4].Hash, es[5].Hash)
+	}
+	d := sha256.Sum256([]byte(`{"id":"2","dedup":"invoice","unknown":"private","labels":{"tenant":"acme"},"timeout":"30s"}`))
+	if es[4].Hash == hex.EncodeToString(d[:]) {
+		t.Errorf("expected body hash to be keyed, got %q", es[4].Hash)
+	}
+
+	// Replaying against an instance whose responses differ is reported in the
+	// results.
+	ts := httptest.NewServer(router(nil))
+	defer ts.Close()
+	rs, err := record.Replay(context.Background(), ts.URL, bytes.NewReader(b), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rs) != len(es) {
+		t.Fatalf("incorrect number of results, expected %d, got %d", len(es), len(rs))
+	}
+	for i, x := range rs {
+		if x.Err != nil {
+			t.Error(x.Err)
+		}
+		if x.Status != http.StatusOK {
+			t.Errorf("incorrect status of request %d, expected %d, got %d", i, http.StatusOK, x.Status)
+		}
+	}
+	if _, err := record.Replay(context.Background(), ts.URL, bytes.NewReader(b), 0); err == nil {
+		t.Error("expected error for non-positive speed")
+	}
+}
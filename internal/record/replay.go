@@ -0,0 +1,104 @@
+package record
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hyperonym/ratus/internal/wire"
+)
+
+// Result is the outcome of replaying a recorded request.
+type Result struct {
+	Entry *Entry
+
+	// Status code of the response, or zero if no response was received.
+	Status int
+	// Time taken to receive the response.
+	Duration time.Duration
+	// Error that prevented the request from being sent or answered.
+	Err error
+}
+
+// Replay sends the requests recorded in the reader to the origin, each at its
+// recorded offset divided by the speed. Requests are sent without waiting for
+// the previous ones to complete, so that requests that were handled
+// concurrently overlap in the same way. The results are returned in the order
+// of the recorded entries once all requests have completed.
+func Replay(ctx context.Context, origin string, r io.Reader, speed float64) ([]*Result, error) {
+	if speed <= 0 {
+		return nil, errors.New("speed must be positive")
+	}
+
+	var (
+		rs []*Result
+		wg sync.WaitGroup
+		n  = time.Now()
+		d  = json.NewDecoder(r)
+	)
+
+	// Wait for the requests in flight before returning, including when the
+	// log can not be read to the end.
+	defer wg.Wait()
+	for {
+		var e Entry
+		if err := d.Decode(&e); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		// Wait until the scaled offset of the request.
+		t := time.NewTimer(time.Until(n.Add(time.Duration(float64(e.Offset) / speed))))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		case <-t.C:
+		}
+
+		x := &Result{Entry: &e}
+		rs = append(rs, x)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			send(ctx, origin, x)
+		}()
+	}
+	return rs, nil
+}
+
+// send sends the recorded request of the result and stores the outcome in it.
+func send(ctx context.Context, origin string, x *Result) {
+	u := origin + x.Entry.Path
+	if x.Entry.Query != "" {
+		u += "?" + x.Entry.Query
+	}
+	var b io.Reader
+	if len(x.Entry.Body) > 0 {
+		b = bytes.NewReader(x.Entry.Body)
+	}
+	req, err := http.NewRequestWithContext(ctx, x.Entry.Method, u, b)
+	if err != nil {
+		x.Err = err
+		return
+	}
+	if b != nil {
+		req.Header.Set("Content-Type", wire.JSON)
+	}
+	n := time.Now()
+	res, err := http.DefaultClient.Do(req)
+	x.Duration = time.Since(n)
+	if err != nil {
+		x.Err = err
+		return
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+	x.Status = res.StatusCode
+}
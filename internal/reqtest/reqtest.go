@@ -50,6 +50,15 @@ func (r *ResponseRecord) AssertBodyContains(v string) {
 	}
 }
 
+// AssertBodyNotContains marks the test as failed if the response body
+// contains the provided substring.
+func (r *ResponseRecord) AssertBodyNotContains(v string) {
+	r.test.Helper()
+	if bytes.Contains(r.Body, []byte(v)) {
+		r.test.Errorf("response body contains %q, got %q", v, string(r.Body))
+	}
+}
+
 // Record the response generated by the handler for testing.
 func Record(t *testing.T, h http.Handler, req *http.Request) *ResponseRecord {
 	t.Helper()
@@ -21,6 +21,7 @@ func TestRequest(t *testing.T) {
 		r.AssertStatusCode(http.StatusOK)
 		r.AssertHeaderContains("Content-Type", "text/plain")
 		r.AssertBodyContains("42")
+		r.AssertBodyNotContains("43")
 	})
 
 	t.Run("post", func(t *testing.T) {
@@ -4,8 +4,6 @@ package router
 import (
 	"net/http"
 
-	"github.com/gin-contrib/cors"
-	"github.com/gin-contrib/gzip"
 	"github.com/gin-contrib/pprof"
 	"github.com/gin-gonic/gin"
 
@@ -27,7 +25,9 @@ type Group interface {
 }
 
 // New creates a router engine with all the provided endpoint groups mounted.
-func New(groups ...Group) *gin.Engine {
+// Global middlewares are applied to all endpoints including the handler for
+// unmatched routes, and nil middlewares are skipped.
+func New(middlewares []gin.HandlerFunc, groups ...Group) *gin.Engine {
 
 	// Use raw path for matching parameters.
 	// Caveat: plus signs '+' in path parameters are unescaped to the space
@@ -44,11 +44,12 @@ func New(groups ...Group) *gin.Engine {
 		pprof.Register(r)
 	}
 
-	// Enable CORS for all origins.
-	r.Use(cors.Default())
-
-	// Enable gzip with compression level 1 (best speed).
-	r.Use(gzip.Gzip(gzip.BestSpeed))
+	// Apply global middlewares such as CORS and compression.
+	for _, m := range middlewares {
+		if m != nil {
+			r.Use(m)
+		}
+	}
 
 	// Mount endpoints from each group.
 	for _, g := range groups {
@@ -7,13 +7,23 @@ import (
 
 	"github.com/gin-gonic/gin"
 
+	"github.com/hyperonym/ratus/internal/config"
+	"github.com/hyperonym/ratus/internal/middleware"
 	"github.com/hyperonym/ratus/internal/reqtest"
 	"github.com/hyperonym/ratus/internal/router"
 )
 
 func TestRouter(t *testing.T) {
 	gin.SetMode(gin.TestMode)
-	h := router.New(&reqtest.StubGroup{}).Handler()
+	cors, err := middleware.CORS(&config.CORSConfig{AllowOrigins: "https://app.test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	compression, err := middleware.Compression(&config.CompressionConfig{Algorithm: "gzip", Level: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := router.New([]gin.HandlerFunc{cors, compression, nil}, &reqtest.StubGroup{}).Handler()
 
 	t.Run("root", func(t *testing.T) {
 		t.Parallel()
@@ -39,4 +49,17 @@ func TestRouter(t *testing.T) {
 		r.AssertStatusCode(http.StatusNotFound)
 		r.AssertHeaderContains("Content-Encoding", "gzip")
 	})
+
+	t.Run("cors", func(t *testing.T) {
+		t.Parallel()
+		req := httptest.NewRequest(http.MethodGet, "/version", nil)
+		req.Header.Set("Origin", "https://app.test")
+		r := reqtest.Record(t, h, req)
+		r.AssertStatusCode(http.StatusOK)
+		r.AssertHeaderContains("Access-Control-Allow-Origin", "https://app.test")
+		req = httptest.NewRequest(http.MethodGet, "/version", nil)
+		req.Header.Set("Origin", "https://app.net")
+		r = reqtest.Record(t, h, req)
+		r.AssertStatusCode(http.StatusForbidden)
+	})
 }
@@ -0,0 +1,114 @@
+// Package wire encodes and decodes request and response bodies in the wire
+// formats supported by the API.
+package wire
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/ugorji/go/codec"
+)
+
+// Media types of the supported wire formats.
+const (
+	JSON    = "application/json"
+	MsgPack = "application/msgpack"
+	CBOR    = "application/cbor"
+)
+
+// aliases maps unregistered but commonly used media types to the canonical
+// ones.
+var aliases = map[string]string{
+	"application/x-msgpack":   MsgPack,
+	"application/vnd.msgpack": MsgPack,
+}
+
+// Handles of the binary wire formats. Maps without static types are decoded
+// as map[string]any and integers as int64, so that decoded payloads can be
+// stored and encoded in JSON the same way as payloads decoded from JSON.
+var (
+	msgpackHandle = &codec.MsgpackHandle{WriteExt: true}
+	cborHandle    = &codec.CborHandle{}
+)
+
+func init() {
+	m := reflect.TypeOf(map[string]any(nil))
+	msgpackHandle.MapType = m
+	msgpackHandle.SignedInteger = true
+	msgpackHandle.RawToString = true
+	cborHandle.MapType = m
+	cborHandle.SignedInteger = true
+}
+
+// Parse returns the canonical media type of the wire format specified in a
+// Content-Type header, or an empty string if the format is not supported.
+func Parse(contentType string) string {
+	t, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	if a, ok := aliases[t]; ok {
+		return a
+	}
+	switch t {
+	case JSON, MsgPack, CBOR:
+		return t
+	}
+	return ""
+}
+
+// Negotiate returns the media type of the supported wire format with the
+// highest preference in an Accept header. Formats with equal preference are
+// chosen in the order they appear. JSON is returned if none of the supported
+// formats are acceptable.
+func Negotiate(accept string) string {
+	v, q := JSON, 0.0
+	for _, s := range strings.Split(accept, ",") {
+		t, p, err := mime.ParseMediaType(strings.TrimSpace(s))
+		if err != nil {
+			continue
+		}
+		w := 1.0
+		if x, ok := p["q"]; ok {
+			if w, err = strconv.ParseFloat(x, 64); err != nil {
+				continue
+			}
+		}
+		if t = Parse(t); t != "" && w > q {
+			v, q = t, w
+		}
+	}
+	return v
+}
+
+// Encode writes the value to the writer in the specified wire format.
+func Encode(w io.Writer, format string, v any) error {
+	if h := handle(format); h != nil {
+		return codec.NewEncoder(w, h).Encode(v)
+	}
+	return json.NewEncoder(w).Encode(v)
+}
+
+// Decode reads a value in the specified wire format from the reader and
+// stores it in the value pointed to by v.
+func Decode(r io.Reader, format string, v any) error {
+	if h := handle(format); h != nil {
+		return codec.NewDecoder(r, h).Decode(v)
+	}
+	return json.NewDecoder(r).Decode(v)
+}
+
+// handle returns the codec handle of a binary wire format, or nil for JSON.
+func handle(format string) codec.Handle {
+	switch format {
+	case MsgPack:
+		return msgpackHandle
+	case CBOR:
+		return cborHandle
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package wire_test
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hyperonym/ratus"
+	"github.com/hyperonym/ratus/internal/wire"
+)
+
+func TestParse(t *testing.T) {
+	for _, c := range []struct {
+		contentType string
+		expected    string
+	}{
+		{"", ""},
+		{"text/plain", ""},
+		{"application/json; charset=utf-8", wire.JSON},
+		{"application/msgpack", wire.MsgPack},
+		{"application/x-msgpack", wire.MsgPack},
+		{"application/cbor", wire.CBOR},
+	} {
+		if v := wire.Parse(c.contentType); v != c.expected {
+			t.Errorf("incorrect media type of %q, expected %q, got %q", c.contentType, c.expected, v)
+		}
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	for _, c := range []struct {
+		accept   string
+		expected string
+	}{
+		{"", wire.JSON},
+		{"*/*", wire.JSON},
+		{"text/html, application/cbor", wire.CBOR},
+		{"application/msgpack, application/cbor", wire.MsgPack},
+		{"application/msgpack;q=0.5, application/cbor", wire.CBOR},
+		{"application/msgpack;q=foo", wire.JSON},
+		{"application/json;q=0.1, application/x-msgpack;q=0.2", wire.MsgPack},
+	} {
+		if v := wire.Negotiate(c.accept); v != c.expected {
+			t.Errorf("incorrect media type of %q, expected %q, got %q", c.accept, c.expected, v)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	n := time.Date(2022, time.July, 29, 20, 0, 0, 0, time.UTC)
+	x := &ratus.Task{
+		ID:        "1",
+		Topic:     "test",
+		State:     ratus.TaskStateActive,
+		Scheduled: &n,
+		Payload:   map[string]any{"url": "https://example.com", "depth": int64(2), "tags": []any{"a"}},
+		Labels:    map[string]string{"tenant": "a"},
+	}
+	for _, f := range []string{wire.JSON, wire.MsgPack, wire.CBOR} {
+		f := f
+		t.Run(f, func(t *testing.T) {
+			t.Parallel()
+			var b bytes.Buffer
+			if err := wire.Encode(&b, f, x); err != nil {
+				t.Fatal(err)
+			}
+			var v ratus.Task
+			if err := wire.Decode(&b, f, &v); err != nil {
+				t.Fatal(err)
+			}
+			if v.ID != x.ID || v.Topic != x.Topic || v.State != x.State || !v.Scheduled.Equal(n) {
+				t.Errorf("incorrect task, expected %+v, got %+v", x, v)
+			}
+			if !reflect.DeepEqual(v.Labels, x.Labels) {
+				t.Errorf("incorrect labels, expected %v, got %v", x.Labels, v.Labels)
+			}
+
+			// Payloads should be decoded into types that can be encoded in
+			// JSON, regardless of the wire format.
+			var p struct {
+				URL string `json:"url"`
+			}
+			if err := v.Decode(&p); err != nil {
+				t.Error(err)
+			} else if p.URL != "https://example.com" {
+				t.Errorf("incorrect payload, expected %q, got %q", "https://example.com", p.URL)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+//go:build go1.23
+
+package ratus
+
+import (
+	"context"
+	"errors"
+	"iter"
+)
+
+// Tasks returns an iterator over the tasks polled from a topic, for consuming
+// tasks with a for-range loop as an alternative to Subscribe. Like Subscribe,
+// polling is paused for DefaultDrainInterval when no task is available, and
+// for DefaultErrorInterval after yielding an unexpected error, honoring the
+// Retry-After header of the error response if present. Updates of each
+// task are committed automatically once the loop body returns, unless a
+// commit has been made explicitly in the loop body. Errors from automatic
+// commits are yielded unless the loop has been stopped. The iteration stops
+// when the context times out or gets canceled.
+func (c *Client) Tasks(ctx context.Context, topic string, p *Promise) iter.Seq2[*Context, error] {
+	return func(yield func(*Context, error) bool) {
+		for ctx.Err() == nil {
+			x, err := c.Poll(ctx, topic, p)
+			if err != nil {
+
+				// The topic has been emptied, no task has reached its
+				// scheduled time of execution, or the concurrency limit of
+				// the topic has been reached, then poll again later.
+				if errors.Is(err, ErrNotFound) || errors.Is(err, ErrTooManyRequests) {
+					c.sleep(ctx, pause(err, DefaultDrainInterval))
+					continue
+				}
+
+				// Handle unexpected errors.
+				if ctx.Err() != nil || !yield(nil, err) {
+					return
+				}
+				c.sleep(ctx, pause(err, DefaultErrorInterval))
+				continue
+			}
+
+			ok := yield(x, nil)
+			if err := x.Commit(); err != nil && ok {
+				ok = yield(nil, err)
+			}
+			if !ok {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,132 @@
+//go:build go1.23
+
+package ratus_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/hyperonym/ratus"
+	"github.com/hyperonym/ratus/clock"
+	"github.com/hyperonym/ratus/internal/engine/stub"
+)
+
+func TestTasks(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+
+	t.Run("normal", func(t *testing.T) {
+		t.Parallel()
+		client := newClient(t, &stub.Engine{})
+		var n int
+		for c, err := range client.Tasks(context.Background(), "topic", &ratus.Promise{Timeout: "30s"}) {
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.Task == nil || c.Task.Topic != "topic" {
+				t.Fail()
+			}
+			if n++; n == 2 {
+				break
+			}
+		}
+		if n != 2 {
+			t.Fail()
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		t.Parallel()
+		client := newClient(t, &stub.Engine{Err: ratus.ErrInternalServerError})
+		var n int
+		for c, err := range client.Tasks(context.Background(), "topic", &ratus.Promise{Timeout: "30s"}) {
+			if c != nil || !errors.Is(err, ratus.ErrInternalServerError) {
+				t.Fail()
+			}
+			n++
+			break
+		}
+		if n != 1 {
+			t.Fail()
+		}
+	})
+
+	t.Run("retry-after", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		// The first poll is asked to slow down for an hour.
+		var polls atomic.Int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			switch {
+			case r.Method == http.MethodPost && polls.Add(1) == 1:
+				w.Header().Set("Retry-After", "3600")
+				w.WriteHeader(http.StatusTooManyRequests)
+				json.NewEncoder(w).Encode(ratus.NewError(ratus.ErrTooManyRequests))
+			case r.Method == http.MethodPost:
+				json.NewEncoder(w).Encode(&ratus.Task{ID: "id", Topic: "topic", Nonce: "nonce"})
+			default:
+				json.NewEncoder(w).Encode(&ratus.Task{ID: "id", Topic: "topic"})
+			}
+		}))
+		defer ts.Close()
+
+		k := clock.NewFake(time.Now())
+		client, err := ratus.NewClient(&ratus.ClientOptions{Origin: ts.URL, Clock: k})
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan error, 1)
+		go func() {
+			for _, err := range client.Tasks(ctx, "topic", &ratus.Promise{Timeout: "30s"}) {
+				done <- err
+				return
+			}
+		}()
+
+		// Advancing the clock by the drain interval should not be enough.
+		for k.Waiters() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		k.Advance(ratus.DefaultDrainInterval)
+		select {
+		case <-done:
+			t.Fatal("expected the iterator to wait for as long as advised")
+		case <-time.After(100 * time.Millisecond):
+		}
+		k.Advance(time.Hour)
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Error(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the topic to be polled again after advancing the clock")
+		}
+		if v := polls.Load(); v != 2 {
+			t.Errorf("incorrect number of polls, expected 2, got %d", v)
+		}
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		client := newClient(t, &stub.Engine{Err: ratus.ErrNotFound})
+		for range client.Tasks(ctx, "topic", &ratus.Promise{Timeout: "30s"}) {
+			t.Fail()
+		}
+		if ctx.Err() == nil {
+			t.Fail()
+		}
+	})
+}
@@ -0,0 +1,125 @@
+package ratus
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// headerIdempotencyKey is the header field for making POST and PATCH requests
+// idempotent, so that retries do not apply the same request more than once.
+const headerIdempotencyKey = "Idempotency-Key"
+
+// RequestOption configures an individual request made by the client, which
+// overrides the settings in ClientOptions for the request.
+type RequestOption func(*requestOptions)
+
+// requestOptions contains the settings of an individual request.
+type requestOptions struct {
+	timeout time.Duration
+	retries int
+	backoff time.Duration
+	header  http.Header
+	confirm string
+
+	// ID of the task and its topic for encrypting the payloads of commits.
+	task  string
+	topic string
+}
+
+// WithTimeout specifies a time limit for the request, including retries,
+// which overrides the Timeout in ClientOptions. A timeout of zero means no
+// timeout.
+func WithTimeout(d time.Duration) RequestOption {
+	return func(o *requestOptions) {
+		o.timeout = d
+	}
+}
+
+// WithRetry retries the request up to n times if it fails due to network
+// errors or with ErrTooManyRequests or ErrServiceUnavailable, pausing for the
+// backoff duration before the first retry and doubling it for each one after.
+// POST and PATCH requests are sent with an Idempotency-Key header if none has
+// been set, so that the server applies them at most once within its
+// idempotency window.
+func WithRetry(n int, backoff time.Duration) RequestOption {
+	return func(o *requestOptions) {
+		o.retries = n
+		o.backoff = backoff
+	}
+}
+
+// WithHeader adds a header field to the request, in addition to the common
+// Headers in ClientOptions.
+func WithHeader(key, value string) RequestOption {
+	return func(o *requestOptions) {
+		if o.header == nil {
+			o.header = make(http.Header)
+		}
+		o.header.Add(key, value)
+	}
+}
+
+// WithConfirm confirms a destructive request with the value expected by the
+// server, which is the name of the topic for deleting a topic, or the number
+// of topics for deleting all topics. The value is sent as the confirm query
+// parameter, and overrides the name of the topic that DeleteTopic confirms
+// with by default.
+func WithConfirm(v string) RequestOption {
+	return func(o *requestOptions) {
+		o.confirm = v
+	}
+}
+
+// withQuery returns the endpoint with the query parameter added.
+func withQuery(endpoint, key, value string) string {
+	sep := "?"
+	if strings.Contains(endpoint, "?") {
+		sep = "&"
+	}
+	return endpoint + sep + url.QueryEscape(key) + "=" + url.QueryEscape(value)
+}
+
+// withTask specifies the task the commit in the request body is made to, so
+// that its payloads can be encrypted for the task.
+func withTask(id, topic string) RequestOption {
+	return func(o *requestOptions) {
+		o.task = id
+		o.topic = topic
+	}
+}
+
+// newRequestOptions applies the options on top of the settings of the client.
+func newRequestOptions(c *Client, method string, opts []RequestOption) *requestOptions {
+	o := requestOptions{timeout: c.timeout}
+	for _, f := range opts {
+		f(&o)
+	}
+
+	// Generate an idempotency key to be shared by all attempts of requests
+	// that are not idempotent by themselves.
+	if o.retries > 0 && (method == http.MethodPost || method == http.MethodPatch) && o.header.Get(headerIdempotencyKey) == "" {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err == nil {
+			if o.header == nil {
+				o.header = make(http.Header)
+			}
+			o.header.Set(headerIdempotencyKey, hex.EncodeToString(b))
+		}
+	}
+
+	return &o
+}
+
+// sleep pauses for the duration on the clock of the client or until the
+// context is done.
+func (c *Client) sleep(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-c.clock.After(d):
+	}
+}
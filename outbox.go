@@ -0,0 +1,327 @@
+package ratus
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DefaultFlushInterval is the default value of OutboxOptions's FlushInterval.
+const DefaultFlushInterval = 5 * time.Second
+
+// outboxBatchSize is the maximum number of buffered tasks inserted at a time.
+const outboxBatchSize = 1000
+
+// ErrOutboxFull is returned when a task can not be buffered because the
+// outbox has reached its capacity.
+var ErrOutboxFull = errors.New("outbox is full")
+
+// OutboxOptions contains options for buffering tasks in an outbox.
+type OutboxOptions struct {
+
+	// Path of the file for persisting buffered tasks, so that they survive
+	// restarts of the producer. Buffered tasks are only kept in memory if
+	// the path is empty.
+	Path string
+
+	// Maximum number of buffered tasks, after which inserting tasks fails
+	// with ErrOutboxFull while the server is unreachable.
+	// A Capacity of zero means no limit.
+	Capacity int
+
+	// Pause duration between attempts to flush buffered tasks in Run.
+	// If zero, DefaultFlushInterval is used.
+	FlushInterval time.Duration
+
+	// Function called with buffered tasks that the server rejected with
+	// ErrBadRequest, which are removed from the buffer afterwards so that
+	// they do not block the tasks behind them. Payloads of the tasks are
+	// encrypted if the client has a cipher. Rejected tasks are discarded if
+	// the function is nil.
+	DeadLetter func(t *Task, err error)
+}
+
+// Outbox buffers tasks inserted while the server is unreachable, and flushes
+// them once the server is reachable again, for producers with unreliable
+// connectivity. Since inserting tasks ignores existing ones, tasks are
+// deduplicated by their IDs both in the buffer and on the server.
+type Outbox struct {
+	client *Client
+	path   string
+	limit  int
+	delay  time.Duration
+	dead   func(*Task, error)
+
+	// Buffered tasks in the order they were inserted, and their IDs.
+	mu    sync.Mutex
+	tasks []*Task
+	ids   map[string]struct{}
+
+	// Flushes are serialized so that batches are not inserted twice.
+	flush sync.Mutex
+}
+
+// NewOutbox creates an outbox for inserting tasks with the client, restoring
+// the tasks persisted by previous instances if a path is specified.
+func NewOutbox(c *Client, o *OutboxOptions) (*Outbox, error) {
+	d := o.FlushInterval
+	if d <= 0 {
+		d = DefaultFlushInterval
+	}
+	b := Outbox{
+		client: c,
+		path:   o.Path,
+		limit:  o.Capacity,
+		delay:  d,
+		dead:   o.DeadLetter,
+		ids:    make(map[string]struct{}),
+	}
+	if err := b.load(); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// InsertTask inserts a new task, or buffers it if the server is unreachable
+// or unavailable. Zero counts are returned for buffered tasks. Tasks are
+// buffered without being sent while there are other buffered tasks that
+// could not be flushed, to preserve the order of insertion.
+func (b *Outbox) InsertTask(ctx context.Context, t *Task, opts ...RequestOption) (*Updated, error) {
+	if b.Len() > 0 {
+		if err := b.Flush(ctx, opts...); err != nil && !unreachable(err) {
+			return nil, err
+		}
+	}
+	if b.Len() == 0 {
+		v, err := b.client.InsertTask(ctx, t, opts...)
+		if err == nil || !unreachable(err) {
+			return v, err
+		}
+	}
+	if err := b.push(t); err != nil {
+		return nil, err
+	}
+	return &Updated{}, nil
+}
+
+// Flush inserts the buffered tasks in batches, and removes them from the
+// buffer once they have been inserted. Batches rejected by the server are
+// inserted again one task at a time, and the rejected tasks are passed to
+// the dead letter function instead of being retried forever.
+func (b *Outbox) Flush(ctx context.Context, opts ...RequestOption) error {
+	b.flush.Lock()
+	defer b.flush.Unlock()
+	for {
+		b.mu.Lock()
+		ts := b.tasks[:min(len(b.tasks), outboxBatchSize)]
+		b.mu.Unlock()
+		if len(ts) == 0 {
+			return nil
+		}
+		_, err := b.client.InsertTasks(ctx, ts, opts...)
+		if errors.Is(err, ErrBadRequest) {
+			err = b.isolate(ctx, ts, opts...)
+		}
+		if err != nil {
+			return err
+		}
+		if err := b.pop(len(ts)); err != nil {
+			return err
+		}
+	}
+}
+
+// isolate inserts the tasks of a rejected batch one at a time, and passes the
+// tasks rejected by the server to the dead letter function. Tasks that have
+// been handled are removed from the buffer if other errors occur.
+func (b *Outbox) isolate(ctx context.Context, ts []*Task, opts ...RequestOption) error {
+	for i, t := range ts {
+		_, err := b.client.InsertTasks(ctx, []*Task{t}, opts...)
+		if errors.Is(err, ErrBadRequest) {
+			if b.dead != nil {
+				b.dead(t, err)
+			}
+			continue
+		}
+		if err != nil {
+			if i > 0 {
+				return errors.Join(err, b.pop(i))
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Run flushes the buffered tasks periodically. Calling Run will block the
+// calling goroutine indefinitely unless the context times out or gets
+// canceled. Errors other than those caused by the server being unreachable
+// are returned.
+func (b *Outbox) Run(ctx context.Context) error {
+	for {
+		if err := b.Flush(ctx); err != nil && !unreachable(err) && ctx.Err() == nil {
+			return err
+		}
+		b.client.sleep(ctx, b.delay)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
+
+// Len returns the number of buffered tasks.
+func (b *Outbox) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.tasks)
+}
+
+// push appends a task to the buffer unless a task with the same ID has been
+// buffered. Payloads are encrypted before being buffered if the client has a
+// cipher, so that they are never persisted in plaintext.
+func (b *Outbox) push(t *Task) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.ids[t.ID]; ok {
+		return nil
+	}
+	if b.limit > 0 && len(b.tasks) >= b.limit {
+		return fmt.Errorf("%w: capacity of %d tasks reached", ErrOutboxFull, b.limit)
+	}
+	v, err := sealBody(b.client.cipher, nil, t)
+	if err != nil {
+		return err
+	}
+	u := *v.(*Task)
+	if err := b.append(&u); err != nil {
+		return err
+	}
+	b.tasks = append(b.tasks, &u)
+	b.ids[u.ID] = struct{}{}
+	return nil
+}
+
+// pop removes the first n tasks from the buffer, and compacts the file.
+func (b *Outbox) pop(n int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, t := range b.tasks[:n] {
+		delete(b.ids, t.ID)
+	}
+	b.tasks = append([]*Task(nil), b.tasks[n:]...)
+	return b.compact()
+}
+
+// append persists a task by appending it to the file as a line of JSON, which
+// is synced to disk before returning. The file is truncated to its previous
+// size if the line can not be written completely.
+func (b *Outbox) append(t *Task) error {
+	if b.path == "" {
+		return nil
+	}
+	p, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(b.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	s, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(append(p, '\n')); err != nil {
+		f.Truncate(s.Size())
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// load reads the persisted tasks as newline-delimited JSON. A partially
+// written line at the end of the file is discarded by compacting the file.
+func (b *Outbox) load() error {
+	if b.path == "" {
+		return nil
+	}
+	f, err := os.Open(b.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	d := json.NewDecoder(bufio.NewReader(f))
+	for d.More() {
+		var t Task
+		if err := d.Decode(&t); errors.Is(err, io.ErrUnexpectedEOF) {
+			return b.compact()
+		} else if err != nil {
+			return err
+		}
+		// Payloads encrypted before being buffered are kept in their
+		// envelopes, so that they are not encrypted again when flushed.
+		t.Payload, t.Result = envelop(t.Payload), envelop(t.Result)
+		if _, ok := b.ids[t.ID]; !ok {
+			b.tasks = append(b.tasks, &t)
+			b.ids[t.ID] = struct{}{}
+		}
+	}
+	return nil
+}
+
+// compact persists the buffered tasks as newline-delimited JSON. The file is
+// written to a temporary location, synced and renamed, so that it is replaced
+// atomically and never left partially written.
+func (b *Outbox) compact() error {
+	if b.path == "" {
+		return nil
+	}
+	f, err := os.CreateTemp(filepath.Dir(b.path), filepath.Base(b.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	w := bufio.NewWriter(f)
+	e := json.NewEncoder(w)
+	for _, t := range b.tasks {
+		if err := e.Encode(t); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), b.path)
+}
+
+// unreachable returns whether the error is caused by the server being
+// unreachable or unavailable, e.g. due to network errors.
+func unreachable(err error) bool {
+	var e *url.Error
+	return errors.As(err, &e) || errors.Is(err, ErrServiceUnavailable)
+}
@@ -0,0 +1,200 @@
+package ratus_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/hyperonym/ratus"
+	"github.com/hyperonym/ratus/internal/engine/stub"
+)
+
+func TestOutbox(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+
+	// Create a client for a server that is no longer reachable.
+	ts := httptest.NewServer(http.NotFoundHandler())
+	ts.Close()
+	offline, err := ratus.NewClient(&ratus.ClientOptions{Origin: ts.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("persist", func(t *testing.T) {
+		t.Parallel()
+		ctx := context.Background()
+		p := filepath.Join(t.TempDir(), "outbox")
+
+		// Tasks should be buffered and deduplicated while offline.
+		b, err := ratus.NewOutbox(offline, &ratus.OutboxOptions{Path: p})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, id := range []string{"a", "b", "a"} {
+			if v, err := b.InsertTask(ctx, &ratus.Task{ID: id, Topic: "topic"}); err != nil {
+				t.Error(err)
+			} else if v.Created != 0 {
+				t.Fail()
+			}
+		}
+		if n := b.Len(); n != 2 {
+			t.Errorf("incorrect number of buffered tasks, expected 2, got %d", n)
+		}
+
+		// Buffered tasks should be restored and flushed once online.
+		b, err = ratus.NewOutbox(newClient(t, &stub.Engine{}), &ratus.OutboxOptions{Path: p})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := b.Len(); n != 2 {
+			t.Errorf("incorrect number of restored tasks, expected 2, got %d", n)
+		}
+		if v, err := b.InsertTask(ctx, &ratus.Task{ID: "c", Topic: "topic"}); err != nil {
+			t.Error(err)
+		} else if v.Created == 0 {
+			t.Fail()
+		}
+		if n := b.Len(); n != 0 {
+			t.Errorf("incorrect number of buffered tasks after flushing, expected 0, got %d", n)
+		}
+		b, err = ratus.NewOutbox(offline, &ratus.OutboxOptions{Path: p})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := b.Len(); n != 0 {
+			t.Errorf("flushed tasks should not be restored, got %d", n)
+		}
+	})
+
+	t.Run("capacity", func(t *testing.T) {
+		t.Parallel()
+		ctx := context.Background()
+		b, err := ratus.NewOutbox(offline, &ratus.OutboxOptions{Capacity: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.InsertTask(ctx, &ratus.Task{ID: "a", Topic: "topic"}); err != nil {
+			t.Error(err)
+		}
+		if _, err := b.InsertTask(ctx, &ratus.Task{ID: "b", Topic: "topic"}); !errors.Is(err, ratus.ErrOutboxFull) {
+			t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrOutboxFull, err)
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		t.Parallel()
+		ctx := context.Background()
+		b, err := ratus.NewOutbox(newClient(t, &stub.Engine{Err: ratus.ErrBadRequest}), &ratus.OutboxOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.InsertTask(ctx, &ratus.Task{ID: "a", Topic: "topic"}); !errors.Is(err, ratus.ErrBadRequest) {
+			t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrBadRequest, err)
+		}
+		if b.Len() != 0 {
+			t.Fail()
+		}
+	})
+
+	t.Run("dead-letter", func(t *testing.T) {
+		t.Parallel()
+		ctx := context.Background()
+		p := filepath.Join(t.TempDir(), "outbox")
+		b, err := ratus.NewOutbox(offline, &ratus.OutboxOptions{Path: p})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, id := range []string{"a", "b"} {
+			if _, err := b.InsertTask(ctx, &ratus.Task{ID: id, Topic: "topic"}); err != nil {
+				t.Error(err)
+			}
+		}
+
+		// Tasks rejected by the server should not block the buffer.
+		var dead []string
+		b, err = ratus.NewOutbox(newClient(t, &stub.Engine{Err: ratus.ErrBadRequest}), &ratus.OutboxOptions{
+			Path: p,
+			DeadLetter: func(t *ratus.Task, err error) {
+				if errors.Is(err, ratus.ErrBadRequest) {
+					dead = append(dead, t.ID)
+				}
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Flush(ctx); err != nil {
+			t.Error(err)
+		}
+		if len(dead) != 2 || dead[0] != "a" || dead[1] != "b" {
+			t.Errorf("incorrect dead letters, expected [a b], got %v", dead)
+		}
+		if n := b.Len(); n != 0 {
+			t.Errorf("incorrect number of buffered tasks after flushing, expected 0, got %d", n)
+		}
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		t.Parallel()
+		ctx := context.Background()
+		p := filepath.Join(t.TempDir(), "outbox")
+		b, err := ratus.NewOutbox(offline, &ratus.OutboxOptions{Path: p})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.InsertTask(ctx, &ratus.Task{ID: "a", Topic: "topic"}); err != nil {
+			t.Error(err)
+		}
+
+		// Partially written lines should be discarded on restore, without
+		// corrupting tasks buffered afterwards.
+		f, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.WriteString(`{"_id":"b","to`); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		b, err = ratus.NewOutbox(offline, &ratus.OutboxOptions{Path: p})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.InsertTask(ctx, &ratus.Task{ID: "c", Topic: "topic"}); err != nil {
+			t.Error(err)
+		}
+		b, err = ratus.NewOutbox(offline, &ratus.OutboxOptions{Path: p})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := b.Len(); n != 2 {
+			t.Errorf("incorrect number of restored tasks, expected 2, got %d", n)
+		}
+	})
+
+	t.Run("run", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		b, err := ratus.NewOutbox(offline, &ratus.OutboxOptions{FlushInterval: 10 * time.Millisecond})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.InsertTask(ctx, &ratus.Task{ID: "a", Topic: "topic"}); err != nil {
+			t.Error(err)
+		}
+		if err := b.Run(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("incorrect error type, expected %q, got %q", context.DeadlineExceeded, err)
+		}
+		if b.Len() != 1 {
+			t.Fail()
+		}
+	})
+}
@@ -29,12 +29,22 @@ var (
 	// ErrBadRequest is returned when the request is malformed.
 	ErrBadRequest = errors.New("bad request")
 
+	// ErrUnauthorized is returned when the request lacks valid credentials.
+	ErrUnauthorized = errors.New("unauthorized")
+
 	// ErrNotFound is returned when the requested resource is not found.
 	ErrNotFound = errors.New("not found")
 
 	// ErrConflict is returned when the resource conflicts with existing ones.
 	ErrConflict = errors.New("conflict")
 
+	// ErrPreconditionRequired is returned when a destructive request is not
+	// explicitly confirmed.
+	ErrPreconditionRequired = errors.New("precondition required")
+
+	// ErrTooManyRequests is returned when the request exceeds a limit.
+	ErrTooManyRequests = errors.New("too many requests")
+
 	// ErrClientClosedRequest is returned when the client closed the request.
 	ErrClientClosedRequest = errors.New("client closed request")
 
@@ -75,6 +85,13 @@ const (
 	// The "archived" state indicates that the task is stored as an archive.
 	// Archived tasks will never be deleted due to expiration.
 	TaskStateArchived
+
+	// The "failed" state indicates that the consumer has given up on the task
+	// due to an error, which is usually recorded in the last error field of
+	// the task. Like archived tasks, failed tasks will never be deleted due to
+	// expiration, but they are kept apart for inspection and dead-letter
+	// handling.
+	TaskStateFailed
 )
 
 // Topic refers to an ordered subset of tasks with the same topic name property.
@@ -85,6 +102,106 @@ type Topic struct {
 
 	// The number of tasks that belong to the topic.
 	Count int64 `json:"count,omitempty" bson:"count,omitempty"`
+
+	// The number of tasks in each state that belong to the topic.
+	// These fields are only populated when getting a single topic.
+	Pending   int64 `json:"pending,omitempty" bson:"pending,omitempty"`
+	Active    int64 `json:"active,omitempty" bson:"active,omitempty"`
+	Completed int64 `json:"completed,omitempty" bson:"completed,omitempty"`
+	Archived  int64 `json:"archived,omitempty" bson:"archived,omitempty"`
+	Failed    int64 `json:"failed,omitempty" bson:"failed,omitempty"`
+
+	// Retention period of completed tasks in the topic, which overrides the
+	// retention period configured for the storage engine. The value must be a
+	// valid duration string parsable by time.ParseDuration. Empty values fall
+	// back to the retention period of the storage engine.
+	Retention string `json:"retention,omitempty" bson:"retention,omitempty"`
+
+	// Whether to poll tasks in the topic fairly across producers. If enabled,
+	// consumers receive available tasks from different producers in a
+	// round-robin fashion rather than strictly in the order of the scheduled
+	// time, so that a producer flooding the topic can not starve the others.
+	Fair bool `json:"fair,omitempty" bson:"fair,omitempty"`
+
+	// Whether to poll tasks in the topic by their priorities. If enabled,
+	// consumers receive available tasks with higher priorities first, and
+	// tasks with the same priority in the order of the scheduled time. It can
+	// not be combined with fair polling.
+	Prioritized bool `json:"prioritized,omitempty" bson:"prioritized,omitempty"`
+
+	// Maximum number of tasks in the topic that can be active at the same
+	// time. Polling the topic fails with ErrTooManyRequests once the limit is
+	// reached, until some of the active tasks are committed or timed out.
+	// Zero means there is no limit.
+	Concurrency int64 `json:"concurrency,omitempty" bson:"concurrency,omitempty"`
+
+	// Duration for which deduplication keys of tasks in the topic are held
+	// after the tasks were produced. Background jobs release the keys once
+	// the window has passed, allowing new tasks with the same keys to be
+	// inserted. The value must be a valid duration string parsable by
+	// time.ParseDuration. Empty values hold the keys as long as the tasks
+	// exist.
+	DedupWindow string `json:"dedup_window,omitempty" bson:"dedup_window,omitempty"`
+
+	// Whether tasks in the topic are delivered at most once. If enabled,
+	// polled tasks are marked as completed immediately instead of becoming
+	// active, which saves the round trip of committing for idempotent or
+	// low-value work, at the cost of losing tasks whose execution fails.
+	AtMostOnce bool `json:"at_most_once,omitempty" bson:"at_most_once,omitempty"`
+
+	// Default values of fields applied to tasks inserted into the topic, so
+	// that producers do not need to repeat them on every insert.
+	Defaults *TaskDefaults `json:"defaults,omitempty" bson:"defaults,omitempty"`
+
+	// Operational hints for consumers of the topic, which subscribers can
+	// fetch on startup instead of having them baked into every consumer.
+	Config *TopicConfig `json:"config,omitempty" bson:"config,omitempty"`
+}
+
+// TaskDefaults contains default values of fields applied to tasks when they
+// are inserted or upserted into a topic without specifying the fields.
+type TaskDefaults struct {
+
+	// Default duration to defer the scheduled time of tasks by, which is only
+	// applied if neither the scheduled time nor the defer duration of the
+	// task is specified.
+	Defer string `json:"defer,omitempty" bson:"defer,omitempty"`
+
+	// Default jitter of the scheduled time of tasks, which is only applied if
+	// the jitter of the task is not specified.
+	Jitter string `json:"jitter,omitempty" bson:"jitter,omitempty"`
+
+	// Default labels of tasks, which are merged into the labels of the task
+	// without overriding the ones specified by the producer.
+	Labels map[string]string `json:"labels,omitempty" bson:"labels,omitempty"`
+}
+
+// TopicConfig contains operational hints for consumers of a topic. The hints
+// are advisory and are not enforced by the server, durations must be valid
+// duration strings parsable by time.ParseDuration.
+type TopicConfig struct {
+
+	// Recommended number of tasks executed concurrently by each subscriber.
+	Concurrency int `json:"concurrency,omitempty" bson:"concurrency,omitempty"`
+	// Recommended maximum number of tasks executed concurrently by each
+	// subscriber when there is a backlog.
+	MaxConcurrency int `json:"max_concurrency,omitempty" bson:"max_concurrency,omitempty"`
+	// Recommended delay before starting each polling goroutine.
+	ConcurrencyDelay string `json:"concurrency_delay,omitempty" bson:"concurrency_delay,omitempty"`
+	// Recommended pause duration after each successful poll.
+	PollInterval string `json:"poll_interval,omitempty" bson:"poll_interval,omitempty"`
+	// Recommended pause duration once the topic has been emptied.
+	DrainInterval string `json:"drain_interval,omitempty" bson:"drain_interval,omitempty"`
+	// Recommended pause duration after errors occur.
+	ErrorInterval string `json:"error_interval,omitempty" bson:"error_interval,omitempty"`
+	// Recommended timeout of promises for executing tasks in the topic.
+	Timeout string `json:"timeout,omitempty" bson:"timeout,omitempty"`
+	// Recommended maximum number of tasks claimed by each subscriber per
+	// second. Zero means there is no limit.
+	RateLimit float64 `json:"rate_limit,omitempty" bson:"rate_limit,omitempty"`
+	// Schema of the payloads of tasks in the topic, such as a JSON Schema,
+	// for consumers to validate payloads against or generate code from.
+	Schema any `json:"schema,omitempty" bson:"schema,omitempty"`
 }
 
 // Task references an idempotent unit of work that should be executed asynchronously.
@@ -99,7 +216,7 @@ type Task struct {
 	Topic string `json:"topic" bson:"topic"`
 
 	// Current state of the task. At a given moment, the state of a task may be
-	// either "pending", "active", "completed" or "archived".
+	// either "pending", "active", "completed", "archived" or "failed".
 	State TaskState `json:"state" bson:"state"`
 
 	// The nonce field stores a random string for implementing an optimistic
@@ -108,6 +225,22 @@ type Task struct {
 	// the promise was made by verifying the nonce field.
 	Nonce string `json:"nonce" bson:"nonce"`
 
+	// Signed commit token of the claim, which is only returned when claiming
+	// the task if the server is configured with a token key. Downstream
+	// systems sharing the key can verify the token with VerifyToken, and
+	// consumers can commit with the token instead of the nonce. Tokens are
+	// not stored with the task.
+	Token string `json:"token,omitempty" bson:"-"`
+
+	// Version of the task, which starts from 1 when the task is created and
+	// is incremented every time the task is updated, consumed, committed or
+	// recovered. When upserting a single task, a non-zero version makes the
+	// update conditional on the current version of the task, so that
+	// administrative edits do not clobber concurrent commits. The version is
+	// exposed as the ETag of the task and can be provided with the If-Match
+	// header.
+	Version int64 `json:"version,omitempty" bson:"version,omitempty"`
+
 	// Identifier of the producer instance who produced the task.
 	Producer string `json:"producer,omitempty" bson:"producer,omitempty"`
 	// Identifier of the consumer instance who consumed the task.
@@ -136,6 +269,51 @@ type Task struct {
 	// use a minimal descriptor as the payload to reference the task.
 	Payload any `json:"payload,omitempty" bson:"payload,omitempty"`
 
+	// Output of the task recorded by the consumer in a commit. The result is
+	// stored separately from the payload, so that producers can read the
+	// output of a task without losing its original input.
+	Result any `json:"result,omitempty" bson:"result,omitempty"`
+
+	// IDs of other tasks that must be completed before the task can be
+	// polled. Dependencies are re-evaluated by background jobs, which remove
+	// completed ones from the list, and the task becomes available for polling
+	// once the list is empty. Tasks that depend on missing tasks will never
+	// become available.
+	DependsOn []string `json:"depends_on,omitempty" bson:"depends_on,omitempty"`
+
+	// Priority of the task in topics polled by priority, where available
+	// tasks with higher priorities are claimed first, and tasks with the same
+	// priority are claimed in the order of the scheduled time. Priorities have
+	// no effect in other topics.
+	Priority int `json:"priority,omitempty" bson:"priority,omitempty"`
+
+	// Optional deduplication key of the task. Tasks with the same key in the
+	// same topic are considered duplicates, and inserting a duplicate of an
+	// existing task either fails with ErrConflict or is ignored in batches.
+	// The key is held until the deduplication window of the topic has passed.
+	Dedup string `json:"dedup,omitempty" bson:"dedup,omitempty"`
+
+	// Arbitrary key-value pairs for grouping tasks beyond the topic, such as
+	// by tenant, region or job ID. Tasks can be selected by their labels when
+	// listing, deleting and polling tasks.
+	Labels map[string]string `json:"labels,omitempty" bson:"labels,omitempty"`
+
+	// Recent state transitions of the task in chronological order. History
+	// is only recorded if enabled in the storage engine, which keeps a
+	// bounded number of the latest transitions. It is omitted from responses
+	// unless explicitly requested.
+	History []*Transition `json:"history,omitempty" bson:"history,omitempty"`
+
+	// Error message of the last failed attempt to execute the task, as
+	// reported by the consumer in a commit. The message is kept until it is
+	// replaced by a subsequent commit with another error.
+	LastError string `json:"last_error,omitempty" bson:"last_error,omitempty"`
+
+	// Progress of the execution as last reported by the consumer of the
+	// active task, for showing the progress of long-running tasks. It is
+	// cleared when the task is consumed again.
+	Progress *Progress `json:"progress,omitempty" bson:"progress,omitempty"`
+
 	// A duration relative to the time the task is accepted, indicating that
 	// the task will be scheduled to execute after this duration. When the
 	// absolute scheduled time is specified, the scheduled time will take
@@ -145,23 +323,101 @@ type Task struct {
 	// used when creating a task and will be cleared after converting to an
 	// absolute scheduled time.
 	Defer string `json:"defer,omitempty" bson:"-"`
+
+	// Maximum random offset applied to the scheduled time of the task in
+	// either direction, so that large batches of tasks scheduled for the
+	// same time spread out instead of becoming available all at once. The
+	// value must be a valid duration string parsable by time.ParseDuration.
+	// This field is only used when creating a task and will be cleared after
+	// applying the offset.
+	Jitter string `json:"jitter,omitempty" bson:"-"`
+
+	// Cipher for decrypting the payload and blob store for fetching the
+	// offloaded payload, which are associated with the task by the client
+	// that retrieved it.
+	cipher Cipher
+	blobs  BlobStore
 }
 
 // Decode parses the payload of the task and stores the result in the value
-// pointed by the specified pointer.
+// pointed by the specified pointer. Payloads offloaded and encrypted on the
+// client side are fetched and decrypted if the task was retrieved by a client
+// with a blob store and a cipher.
 func (t *Task) Decode(v any) error {
+	return decodePayload(t.cipher, t.blobs, t.ID, t.Payload, v)
+}
+
+// DecodeResult parses the result of the task and stores it in the value
+// pointed by the specified pointer, in the same way as Decode.
+func (t *Task) DecodeResult(v any) error {
+	return decodePayload(t.cipher, t.blobs, t.ID, t.Result, v)
+}
+
+// decodePayload parses the payload of the task and stores the result in the
+// value pointed by the specified pointer, fetching and decrypting the payload
+// if necessary.
+func decodePayload(c Cipher, s BlobStore, id string, p, v any) error {
+	p, err := fetch(context.Background(), s, p)
+	if err != nil {
+		return err
+	}
 
 	// Counterintuitively, the seemingly dumb approach of just marshalling
 	// input into JSON bytes and decoding it from those bytes is actually both
 	// 29.5% faster (than reflection) and causes less memory allocations.
 	// Reference: https://github.com/mitchellh/mapstructure/issues/37
-	b, err := json.Marshal(t.Payload)
+	b, err := open(c, id, p)
 	if err != nil {
 		return err
 	}
 	return json.Unmarshal(b, v)
 }
 
+// Result contains the output of a task recorded by the consumer, which can be
+// retrieved without the rest of the task.
+type Result struct {
+
+	// Unique ID of the task.
+	ID string `json:"_id" bson:"_id"`
+
+	// Current state of the task. The result is usually only available after
+	// the task has been completed.
+	State TaskState `json:"state" bson:"state"`
+
+	// Output of the task recorded by the consumer in a commit, which is empty
+	// if no result has been recorded.
+	Result any `json:"result,omitempty" bson:"result,omitempty"`
+
+	// Cipher and blob store associated by the client that retrieved the
+	// result, the same as those of tasks.
+	cipher Cipher
+	blobs  BlobStore
+}
+
+// Decode parses the output of the task and stores it in the value pointed by
+// the specified pointer, in the same way as Task.Decode.
+func (r *Result) Decode(v any) error {
+	return decodePayload(r.cipher, r.blobs, r.ID, r.Result, v)
+}
+
+// Transition records a change of the state of a task.
+type Transition struct {
+
+	// State of the task after the transition.
+	State TaskState `json:"state" bson:"state"`
+
+	// The time the transition happened.
+	Time *time.Time `json:"time,omitempty" bson:"time,omitempty"`
+
+	// Identifier of the consumer instance who claimed the task, if the
+	// transition was caused by consuming the task.
+	Consumer string `json:"consumer,omitempty" bson:"consumer,omitempty"`
+
+	// Error message describing why the transition happened, such as the
+	// task having timed out.
+	Error string `json:"error,omitempty" bson:"error,omitempty"`
+}
+
 // Promise represents a claim on the ownership of an active task.
 type Promise struct {
 
@@ -187,6 +443,18 @@ type Promise struct {
 	// parsable by time.ParseDuration. This field is only used when creating a
 	// promise and will be cleared after converting to an absolute deadline.
 	Timeout string `json:"timeout,omitempty" bson:"-" form:"timeout"`
+
+	// Label selector of a wildcard promise. Only tasks whose labels contain
+	// all of the key-value pairs can be claimed. This field is only used when
+	// polling and is not stored with the promise.
+	Labels map[string]string `json:"labels,omitempty" bson:"-" form:"-"`
+
+	// Whether the claimed task is delivered at most once, in which case it
+	// is marked as completed immediately rather than becoming active. Tasks
+	// polled from topics delivering at most once are always marked as
+	// completed. This field is only used when claiming tasks and is not
+	// stored with the promise.
+	AtMostOnce bool `json:"at_most_once,omitempty" bson:"-" form:"at_most_once"`
 }
 
 // Commit contains a set of updates to be applied to a task.
@@ -196,6 +464,21 @@ type Commit struct {
 	// corresponding nonce of the target task.
 	Nonce string `json:"nonce,omitempty" bson:"nonce,omitempty"`
 
+	// If not empty, the commit will be accepted only if the signature of the
+	// token is valid and the nonce in its claims matches the corresponding
+	// nonce of the target task. This field is only used when creating a
+	// commit and will be cleared after verifying the token.
+	Token string `json:"token,omitempty" bson:"-"`
+
+	// If not empty, the commit will be accepted only if the value matches the
+	// consumer of the target task, which catches consumers committing tasks
+	// claimed by others. Servers may require it along with nonces and tokens.
+	Consumer string `json:"consumer,omitempty" bson:"consumer,omitempty"`
+
+	// If not zero, the commit will be accepted only if the value matches the
+	// current version of the target task.
+	Version int64 `json:"version,omitempty" bson:"version,omitempty"`
+
 	// If not empty, transfer the task to the specified topic.
 	Topic string `json:"topic,omitempty" bson:"topic,omitempty"`
 
@@ -209,6 +492,15 @@ type Commit struct {
 	// If not nil, use this value to replace the payload of the task.
 	Payload any `json:"payload,omitempty" bson:"payload,omitempty"`
 
+	// If not nil, record the value as the result of the task, leaving the
+	// payload unchanged.
+	Result any `json:"result,omitempty" bson:"result,omitempty"`
+
+	// If not empty, record the message as the last error of the task. It is
+	// usually specified along with the "failed" state, or with the "pending"
+	// state when retrying after an error.
+	Error string `json:"error,omitempty" bson:"error,omitempty"`
+
 	// A duration relative to the time the commit is accepted, indicating that
 	// the task will be scheduled to execute after this duration. When the
 	// absolute scheduled time is specified, the scheduled time will take
@@ -220,19 +512,132 @@ type Commit struct {
 	Defer string `json:"defer,omitempty" bson:"-"`
 }
 
+// Progress reports how far the execution of an active task has proceeded.
+// Reporting progress changes neither the state nor the nonce of the task.
+type Progress struct {
+
+	// If not empty, the progress will be accepted only if the value matches
+	// the corresponding nonce of the target task. This field is only used
+	// when reporting progress and is not stored with the task.
+	Nonce string `json:"nonce,omitempty" bson:"-"`
+
+	// Percentage of the execution that has been completed, from 0 to 100.
+	Percent int `json:"percent" bson:"percent"`
+
+	// Optional message describing the current step of the execution.
+	Message string `json:"message,omitempty" bson:"message,omitempty"`
+
+	// The time the progress was reported, which is set by the server.
+	Time *time.Time `json:"time,omitempty" bson:"time,omitempty"`
+}
+
+// Handoff contains a committed task and the next task claimed from the same
+// topic in the same request, which saves a round trip for consumers that poll
+// again right after committing.
+type Handoff struct {
+
+	// Task committed with the updates of the request.
+	Committed *Task `json:"committed"`
+
+	// Next task claimed with the promise of the commit request. It is nil if
+	// no task is available, or if the task could not be claimed, in which
+	// case consumers should poll as usual.
+	Next *Task `json:"next,omitempty"`
+}
+
+// Move contains the destination and filters of tasks to be moved between
+// topics in bulk.
+type Move struct {
+
+	// Name of the topic to move the tasks to.
+	Topic string `json:"topic"`
+
+	// If not empty, only move tasks that carry all of the key-value pairs.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// If not nil, only move tasks in the specified state.
+	State *TaskState `json:"state,omitempty"`
+}
+
+// BatchGet contains the unique IDs of tasks to be retrieved in bulk.
+type BatchGet struct {
+
+	// Unique IDs of the tasks to retrieve. Tasks are returned in the order of
+	// their IDs, and IDs of tasks that do not exist are skipped.
+	IDs []string `json:"ids"`
+}
+
+// Consumer contains information about a consumer instance and the tasks it is
+// currently executing.
+type Consumer struct {
+
+	// Identifier of the consumer instance, which is the consumer field of the
+	// promises made by the consumer.
+	Name string `json:"name"`
+
+	// The time the consumer was last seen, which is the latest of the time it
+	// consumed an active task, polled a topic or sent a heartbeat.
+	Seen *time.Time `json:"seen,omitempty"`
+
+	// Promises made by the consumer for its in-flight tasks, which are the
+	// active tasks consumed by the consumer.
+	Promises []*Promise `json:"promises,omitempty"`
+}
+
+// Quota limits the rate at which a producer can insert tasks and the number of
+// its tasks that can be pending at the same time. Inserting tasks fails with
+// ErrTooManyRequests once either limit is reached. Quotas are kept by each
+// server instance separately and are not persisted.
+type Quota struct {
+
+	// Name of the producer the quota applies to, which is the producer field
+	// of the tasks it inserts.
+	Producer string `json:"producer"`
+
+	// Maximum number of tasks the producer can insert per minute through each
+	// instance. Zero means there is no limit.
+	Rate int `json:"rate,omitempty"`
+
+	// Maximum number of pending tasks the producer can have in each topic.
+	// Zero means there is no limit.
+	Pending int64 `json:"pending,omitempty"`
+}
+
 // Topics contains a list of topic resources.
 type Topics struct {
 	Data []*Topic `json:"data"`
+
+	// Opaque cursor for retrieving the next page of results when paginating
+	// with cursors. It is empty if there are no more results.
+	Next string `json:"next,omitempty"`
 }
 
 // Tasks contains a list of task resources.
 type Tasks struct {
 	Data []*Task `json:"data"`
+
+	// Opaque cursor for retrieving the next page of results when paginating
+	// with cursors. It is empty if there are no more results.
+	Next string `json:"next,omitempty"`
 }
 
 // Promises contains a list of promise resources.
 type Promises struct {
 	Data []*Promise `json:"data"`
+
+	// Opaque cursor for retrieving the next page of results when paginating
+	// with cursors. It is empty if there are no more results.
+	Next string `json:"next,omitempty"`
+}
+
+// Consumers contains a list of consumer resources.
+type Consumers struct {
+	Data []*Consumer `json:"data"`
+}
+
+// Quotas contains a list of quota resources.
+type Quotas struct {
+	Data []*Quota `json:"data"`
 }
 
 // Updated contains result of an update operation.
@@ -252,6 +657,130 @@ type Deleted struct {
 	Deleted int64 `json:"deleted"`
 }
 
+// Chore contains result of running background jobs.
+type Chore struct {
+
+	// Number of timed out tasks recovered to the "pending" state.
+	Recovered int64 `json:"recovered"`
+
+	// Number of expired tasks deleted.
+	Expired int64 `json:"expired"`
+
+	// Number of tasks moved out of the task storage for archiving.
+	Archived int64 `json:"archived"`
+
+	// Timed out tasks recovered to the "pending" state, for alerting on tasks
+	// whose consumers repeatedly fail to commit them before the deadlines.
+	Recoveries []*Recovery `json:"recoveries,omitempty"`
+}
+
+// Recovery describes a timed out task recovered by background jobs.
+type Recovery struct {
+
+	// User-defined unique ID of the task.
+	ID string `json:"_id" bson:"_id"`
+
+	// Topic that the task belongs to.
+	Topic string `json:"topic" bson:"topic"`
+
+	// Identifier of the producer instance who produced the task.
+	Producer string `json:"producer,omitempty" bson:"producer,omitempty"`
+
+	// Identifier of the consumer instance who failed to commit the task.
+	Consumer string `json:"consumer,omitempty" bson:"consumer,omitempty"`
+
+	// The deadline that the consumer failed to meet.
+	Deadline *time.Time `json:"deadline,omitempty" bson:"deadline,omitempty"`
+}
+
+// Stats contains statistics of tasks across all topics, for building
+// dashboards without listing and counting every topic.
+type Stats struct {
+
+	// The number of tasks in each state across all topics.
+	Count     int64 `json:"count"`
+	Pending   int64 `json:"pending"`
+	Active    int64 `json:"active"`
+	Completed int64 `json:"completed"`
+	Archived  int64 `json:"archived"`
+	Failed    int64 `json:"failed"`
+
+	// Statistics of each topic that has tasks, ordered by the names of the
+	// topics.
+	Topics []*TopicStats `json:"topics"`
+}
+
+// TopicStats contains statistics of tasks in a topic.
+type TopicStats struct {
+
+	// Name of the topic.
+	Name string `json:"name"`
+
+	// The number of tasks in each state that belong to the topic. Since each
+	// active task is claimed by a promise, the number of active tasks is also
+	// the number of active promises in the topic.
+	Count     int64 `json:"count"`
+	Pending   int64 `json:"pending"`
+	Active    int64 `json:"active"`
+	Completed int64 `json:"completed"`
+	Archived  int64 `json:"archived"`
+	Failed    int64 `json:"failed"`
+
+	// Scheduled time of the oldest pending task that has reached its
+	// scheduled time, whose age indicates how long tasks in the topic have
+	// been waiting for consumers. Omitted if no pending task is available.
+	Oldest *time.Time `json:"oldest,omitempty"`
+}
+
+// Capabilities contains the optional features supported by the storage
+// engine, allowing generic clients to adapt their behavior to the deployment.
+type Capabilities struct {
+
+	// Whether completed tasks are deleted by background jobs once they have
+	// been retained for longer than the retention period.
+	TTL bool `json:"ttl"`
+
+	// Whether operations spanning multiple tasks are performed atomically.
+	Transactions bool `json:"transactions"`
+
+	// Whether changes of tasks are pushed by the storage engine as they happen
+	// instead of being checked periodically.
+	ChangeStreams bool `json:"change_streams"`
+
+	// Whether tasks can be filtered by labels when listing, counting and
+	// deleting them.
+	FilteredList bool `json:"filtered_list"`
+
+	// Whether available tasks are polled in the order of their priorities in
+	// topics with priority polling enabled.
+	Priorities bool `json:"priorities"`
+}
+
+// Build contains the version and configuration of an instance, allowing fleet
+// tooling to verify what has been deployed.
+type Build struct {
+
+	// Version of the binary.
+	Version string `json:"version"`
+
+	// Hash of the commit that the binary was built from, omitted if the build
+	// information is not available.
+	Commit string `json:"commit,omitempty"`
+
+	// Version of Go that the binary was built with.
+	Go string `json:"go"`
+
+	// Name of the storage engine.
+	Engine string `json:"engine"`
+
+	// Role of the instance.
+	Role string `json:"role"`
+
+	// Settings of the instance keyed by the names of environment variables,
+	// with secrets and credentials in URLs redacted.
+	Config map[string]string `json:"config,omitempty"`
+}
+
 // Error contains an error message.
 type Error struct {
 
@@ -263,6 +792,12 @@ type Error struct {
 
 		// Message of the error.
 		Message string `json:"message"`
+
+		// Scheduled time of the next pending task in the topic, which is only
+		// included when polling finds no task available yet, so that
+		// consumers can wait until then instead of polling at fixed
+		// intervals.
+		Scheduled *time.Time `json:"scheduled,omitempty"`
 	} `json:"error"`
 }
 
@@ -277,10 +812,16 @@ func (e *Error) Err() error {
 		err = ErrClientClosedRequest
 	case http.StatusBadRequest:
 		err = ErrBadRequest
+	case http.StatusUnauthorized:
+		err = ErrUnauthorized
 	case http.StatusNotFound:
 		err = ErrNotFound
 	case http.StatusConflict:
 		err = ErrConflict
+	case http.StatusPreconditionRequired:
+		err = ErrPreconditionRequired
+	case http.StatusTooManyRequests:
+		err = ErrTooManyRequests
 	case http.StatusInternalServerError:
 		err = ErrInternalServerError
 	case http.StatusServiceUnavailable:
@@ -306,16 +847,24 @@ func NewError(err error) *Error {
 	switch {
 	case errors.Is(err, context.Canceled):
 		s = StatusClientClosedRequest
+	case errors.Is(err, context.DeadlineExceeded):
+		s = http.StatusServiceUnavailable
 	case errors.Is(err, io.ErrUnexpectedEOF):
 		s = StatusClientClosedRequest
 	case errors.Is(err, ErrClientClosedRequest):
 		s = StatusClientClosedRequest
 	case errors.Is(err, ErrBadRequest):
 		s = http.StatusBadRequest
+	case errors.Is(err, ErrUnauthorized):
+		s = http.StatusUnauthorized
 	case errors.Is(err, ErrNotFound):
 		s = http.StatusNotFound
 	case errors.Is(err, ErrConflict):
 		s = http.StatusConflict
+	case errors.Is(err, ErrPreconditionRequired):
+		s = http.StatusPreconditionRequired
+	case errors.Is(err, ErrTooManyRequests):
+		s = http.StatusTooManyRequests
 	case errors.Is(err, ErrServiceUnavailable):
 		s = http.StatusServiceUnavailable
 	default:
@@ -8,6 +8,8 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -184,6 +186,132 @@ func TestTask(t *testing.T) {
 				t.Fail()
 			}
 		})
+
+		t.Run("encrypted", func(t *testing.T) {
+			t.Parallel()
+			var p string
+			v := ratus.Task{Payload: map[string]any{"encryption": "ratus/v1", "ciphertext": "Zm9v"}}
+			if err := v.Decode(&p); !errors.Is(err, ratus.ErrEncryptedPayload) {
+				t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrEncryptedPayload, err)
+			}
+
+			// Payloads without the version of the envelope format are
+			// not encrypted.
+			var q map[string]string
+			v = ratus.Task{Payload: map[string]any{"ciphertext": "Zm9v"}}
+			if err := v.Decode(&q); err != nil {
+				t.Error(err)
+			} else if q["ciphertext"] != "Zm9v" {
+				t.Errorf("incorrect payload, expected plaintext, got %v", q)
+			}
+		})
+	})
+}
+
+func TestCipher(t *testing.T) {
+	t.Run("aes", func(t *testing.T) {
+		t.Parallel()
+		c, err := ratus.NewAESCipher(bytes.Repeat([]byte{1}, 32))
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := []byte("id")
+		a, err := c.Encrypt([]byte("hello"), d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := c.Encrypt([]byte("hello"), d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(a, b) || bytes.Contains(a, []byte("hello")) {
+			t.Errorf("ciphertext should be randomized and not contain the plaintext, got %x and %x", a, b)
+		}
+		if p, err := c.Decrypt(a, d); err != nil {
+			t.Error(err)
+		} else if string(p) != "hello" {
+			t.Errorf("incorrect plaintext, expected %q, got %q", "hello", p)
+		}
+		if _, err := c.Decrypt(a, []byte("other")); err == nil {
+			t.Error("expected error for mismatched additional data")
+		}
+		a[len(a)-1] ^= 0xff
+		if _, err := c.Decrypt(a, d); err == nil {
+			t.Error("expected error for tampered ciphertext")
+		}
+		if _, err := c.Decrypt([]byte("foo"), d); err == nil {
+			t.Error("expected error for short ciphertext")
+		}
+	})
+
+	t.Run("key", func(t *testing.T) {
+		t.Parallel()
+		if _, err := ratus.NewAESCipher([]byte("foo")); err == nil {
+			t.Fail()
+		}
+	})
+}
+
+func TestBlobStore(t *testing.T) {
+	ctx := context.Background()
+	d := filepath.Join(t.TempDir(), "blobs")
+	s, err := ratus.NewDirBlobStore(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(ctx, "foo", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := s.Get(ctx, "foo"); err != nil {
+		t.Error(err)
+	} else if string(b) != "hello" {
+		t.Errorf("incorrect data, expected %q, got %q", "hello", b)
+	}
+	if _, err := s.Get(ctx, "bar"); err == nil {
+		t.Error("expected error for missing blob")
+	}
+
+	// Keys escaping the directory should be rejected.
+	for _, k := range []string{"", "..", "../foo", "a/b"} {
+		if _, err := s.Get(ctx, k); err == nil {
+			t.Errorf("expected error for invalid key %q", k)
+		}
+		if err := s.Put(ctx, k, nil); err == nil {
+			t.Errorf("expected error for invalid key %q", k)
+		}
+	}
+}
+
+func TestToken(t *testing.T) {
+	t.Run("verify", func(t *testing.T) {
+		t.Parallel()
+		k := []byte("secret")
+		s := (&ratus.Token{Topic: "topic", ID: "id", Nonce: "nonce"}).Sign(k)
+		v, err := ratus.VerifyToken(k, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.Topic != "topic" || v.ID != "id" || v.Nonce != "nonce" {
+			t.Errorf("incorrect claims, got %+v", v)
+		}
+		if _, err := ratus.VerifyToken([]byte("other"), s); !errors.Is(err, ratus.ErrInvalidToken) {
+			t.Errorf("incorrect error type, expected %q, got %q", ratus.ErrInvalidToken, err)
+		}
+	})
+
+	t.Run("parse", func(t *testing.T) {
+		t.Parallel()
+		s := (&ratus.Token{Topic: "topic", ID: "id", Nonce: "nonce"}).Sign([]byte("secret"))
+		if v, err := ratus.ParseToken(s); err != nil {
+			t.Error(err)
+		} else if v.ID != "id" {
+			t.Errorf("incorrect ID, expected %q, got %q", "id", v.ID)
+		}
+		for _, s := range []string{"", "foo", "!.foo", "e30.foo"} {
+			if _, err := ratus.ParseToken(s); !errors.Is(err, ratus.ErrInvalidToken) {
+				t.Errorf("incorrect error type for %q, expected %q, got %q", s, ratus.ErrInvalidToken, err)
+			}
+		}
 	})
 }
 
@@ -208,12 +336,22 @@ func TestError(t *testing.T) {
 		}
 	})
 
+	t.Run("timeout", func(t *testing.T) {
+		t.Parallel()
+		if e := ratus.NewError(fmt.Errorf("query: %w", context.DeadlineExceeded)); e.Error.Code != http.StatusServiceUnavailable {
+			t.Errorf("incorrect error code %d for %q", e.Error.Code, context.DeadlineExceeded)
+		}
+	})
+
 	t.Run("sentinel", func(t *testing.T) {
 		t.Parallel()
 		var s = []error{
 			ratus.ErrBadRequest,
+			ratus.ErrUnauthorized,
 			ratus.ErrNotFound,
 			ratus.ErrConflict,
+			ratus.ErrPreconditionRequired,
+			ratus.ErrTooManyRequests,
 			ratus.ErrClientClosedRequest,
 			ratus.ErrInternalServerError,
 			ratus.ErrServiceUnavailable,
@@ -0,0 +1,205 @@
+// Package ratustest provides an in-process Ratus server backed by MemDB for
+// unit testing producers and consumers without running a real instance.
+package ratustest
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/hyperonym/ratus"
+	"github.com/hyperonym/ratus/clock"
+	"github.com/hyperonym/ratus/internal/config"
+	"github.com/hyperonym/ratus/internal/controller"
+	"github.com/hyperonym/ratus/internal/engine/memdb"
+	"github.com/hyperonym/ratus/internal/middleware"
+	"github.com/hyperonym/ratus/internal/router"
+)
+
+// retentionPeriod is the retention period for completed tasks, which is long
+// enough for them to outlive any test.
+const retentionPeriod = 24 * time.Hour
+
+// Options contains options for creating fake servers.
+type Options struct {
+
+	// Clock for telling the current time on the server, which allows tests
+	// to expire promises by advancing a fake clock before calling Chore.
+	// If nil, the system clock is used.
+	Clock clock.Clock
+}
+
+// Server is a Ratus server running in the process of the test, which serves
+// the same API as a real instance with tasks stored in memory.
+type Server struct {
+
+	// URL of the server in the form of http://ipaddr:port without a
+	// trailing slash, which can be used as the origin of clients.
+	URL string
+
+	t      testing.TB
+	engine *memdb.Engine
+
+	// Tasks committed through the API in the order they were committed.
+	mu        sync.Mutex
+	committed []*ratus.Task
+}
+
+// NewServer starts a fake server, which is shut down and cleared when the test
+// and all its subtests complete. Options may be nil.
+func NewServer(t testing.TB, o *Options) *Server {
+	t.Helper()
+	if o == nil {
+		o = &Options{}
+	}
+	k := o.Clock
+	if k == nil {
+		k = clock.System
+	}
+	g, err := memdb.New(&memdb.Config{RetentionPeriod: retentionPeriod, Clock: k})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := g.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{t: t, engine: g}
+
+	// Mount the endpoints of both API versions in release mode, which keeps
+	// the router from logging requests to the output of tests.
+	gin.SetMode(gin.ReleaseMode)
+	pc := config.PaginationConfig{MaxLimit: 100, MaxOffset: 10000}
+	v := controller.V1{
+		Pagination: middleware.Pagination(&pc),
+		Topic:      controller.NewTopicController(g, &config.DeleteConfig{}),
+		Task:       controller.NewTaskController(g, &config.TokenConfig{}),
+		Promise:    controller.NewPromiseController(g, &config.TokenConfig{}),
+		Consumer:   controller.NewConsumerController(g, &config.ConsumerConfig{Window: time.Minute}),
+		Quota:      controller.NewQuotaController(g, &config.QuotaConfig{}),
+		Health:     controller.NewHealthController(g),
+		Metrics:    controller.NewMetricsController(g),
+	}
+	v.Task.Bridge = s.record
+	v2 := controller.V2{V1: v}
+	v2.Pagination = middleware.Cursor(&pc)
+	r := router.New([]gin.HandlerFunc{middleware.Clock(k)}, &v, &v2)
+	ts := httptest.NewServer(r.Handler())
+	s.URL = ts.URL
+
+	t.Cleanup(func() {
+		ts.Close()
+		if err := g.Destroy(ctx); err != nil {
+			t.Error(err)
+		}
+	})
+	return s
+}
+
+// NewClient creates a client connected to the server with the options, whose
+// origin is overridden by the URL of the server. Options may be nil.
+func (s *Server) NewClient(o *ratus.ClientOptions) *ratus.Client {
+	s.t.Helper()
+	var v ratus.ClientOptions
+	if o != nil {
+		v = *o
+	}
+	v.Origin = s.URL
+	c, err := ratus.NewClient(&v)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return c
+}
+
+// Insert inserts tasks through the API as a producer would, failing the test
+// if any of them can not be inserted.
+func (s *Server) Insert(ts ...*ratus.Task) {
+	s.t.Helper()
+	if _, err := s.NewClient(nil).InsertTasks(context.Background(), ts); err != nil {
+		s.t.Fatal(err)
+	}
+}
+
+// Task returns the current state of a task, or nil if it does not exist.
+func (s *Server) Task(id string) *ratus.Task {
+	s.t.Helper()
+	v, err := s.engine.GetTask(context.Background(), id)
+	if errors.Is(err, ratus.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return v
+}
+
+// Tasks returns all tasks in a topic in the order of their IDs.
+func (s *Server) Tasks(topic string) []*ratus.Task {
+	s.t.Helper()
+	var v []*ratus.Task
+	if err := s.engine.StreamTasks(context.Background(), topic, func(t *ratus.Task) error {
+		v = append(v, t)
+		return nil
+	}); err != nil {
+		s.t.Fatal(err)
+	}
+	return v
+}
+
+// Committed returns the tasks committed through the API in the order they
+// were committed, as they were right after each commit.
+func (s *Server) Committed() []*ratus.Task {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*ratus.Task(nil), s.committed...)
+}
+
+// Chore runs the background jobs of the server once, which recovers timed out
+// tasks and resolves dependencies. Real instances run them periodically.
+func (s *Server) Chore() *ratus.Chore {
+	s.t.Helper()
+	v, err := s.engine.Chore(context.Background())
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return v
+}
+
+// AssertState reports an error if the task does not exist or is not in the
+// state.
+func (s *Server) AssertState(id string, state ratus.TaskState) {
+	s.t.Helper()
+	v := s.Task(id)
+	if v == nil {
+		s.t.Errorf("task %q does not exist", id)
+		return
+	}
+	if v.State != state {
+		s.t.Errorf("incorrect state of task %q, expected %d, got %d", id, state, v.State)
+	}
+}
+
+// AssertCommitted reports an error if the task has not been committed through
+// the API.
+func (s *Server) AssertCommitted(id string) {
+	s.t.Helper()
+	for _, v := range s.Committed() {
+		if v.ID == id {
+			return
+		}
+	}
+	s.t.Errorf("task %q has not been committed", id)
+}
+
+// record records a committed task.
+func (s *Server) record(t *ratus.Task) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.committed = append(s.committed, t)
+}
@@ -0,0 +1,89 @@
+package ratustest_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hyperonym/ratus"
+	"github.com/hyperonym/ratus/clock"
+	"github.com/hyperonym/ratus/ratustest"
+)
+
+func TestServer(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("subscribe", func(t *testing.T) {
+		s := ratustest.NewServer(t, nil)
+		s.Insert(
+			&ratus.Task{ID: "1", Topic: "test", Payload: "ok"},
+			&ratus.Task{ID: "2", Topic: "test", Payload: "bad"},
+		)
+
+		// Run a consumer until both tasks have been handled.
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		c := s.NewClient(nil)
+		var n int
+		c.Subscribe(ctx, &ratus.SubscribeOptions{Promise: &ratus.Promise{Consumer: "test"}, Topic: "test", PollInterval: time.Millisecond}, func(x *ratus.Context, err error) {
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			var v string
+			x.Task.Decode(&v)
+			if v == "bad" {
+				x.Fail(errors.New("bad payload"))
+			}
+
+			// Commit before canceling the subscription, which would otherwise
+			// cancel the automatic commit of the last task.
+			if err := x.Commit(); err != nil {
+				t.Error(err)
+			}
+			if n++; n == 2 {
+				cancel()
+			}
+		})
+
+		s.AssertState("1", ratus.TaskStateCompleted)
+		s.AssertState("2", ratus.TaskStateFailed)
+		s.AssertCommitted("1")
+		s.AssertCommitted("2")
+		if v := s.Committed(); len(v) != 2 {
+			t.Errorf("incorrect number of committed tasks, expected 2, got %d", len(v))
+		}
+		if v := s.Task("2"); v.LastError != "bad payload" {
+			t.Errorf("incorrect last error, got %q", v.LastError)
+		}
+		if v := s.Tasks("test"); len(v) != 2 || v[0].ID != "1" || v[1].ID != "2" {
+			t.Errorf("incorrect tasks, got %v", v)
+		}
+		if v := s.Task("3"); v != nil {
+			t.Errorf("expected nil for missing task, got %v", v)
+		}
+	})
+
+	t.Run("clock", func(t *testing.T) {
+		k := clock.NewFake(time.Now())
+		s := ratustest.NewServer(t, &ratustest.Options{Clock: k})
+		s.Insert(&ratus.Task{ID: "1", Topic: "test"})
+
+		// Claimed tasks are recovered once the fake clock passes their
+		// deadlines.
+		c := s.NewClient(nil)
+		if _, err := c.Poll(ctx, "test", &ratus.Promise{Consumer: "test", Timeout: "1m"}); err != nil {
+			t.Fatal(err)
+		}
+		if v := s.Chore(); v.Recovered != 0 {
+			t.Errorf("incorrect number of recovered tasks, expected 0, got %d", v.Recovered)
+		}
+		s.AssertState("1", ratus.TaskStateActive)
+		k.Advance(2 * time.Minute)
+		if v := s.Chore(); v.Recovered != 1 {
+			t.Errorf("incorrect number of recovered tasks, expected 1, got %d", v.Recovered)
+		}
+		s.AssertState("1", ratus.TaskStatePending)
+	})
+}
@@ -0,0 +1,80 @@
+package ratus
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// ErrInvalidToken is returned when a commit token is malformed or its
+// signature does not match the key.
+var ErrInvalidToken = errors.New("invalid commit token")
+
+// Token contains the claims of a commit token, which identify the claim of a
+// task made by a promise. Tokens are issued when claiming tasks if the server
+// is configured with a token key, and are signed with HMAC-SHA256 so that
+// downstream systems sharing the key can verify them. Consumers can record
+// tokens along with the side effects of tasks, e.g. in the same transaction,
+// and commit with the recorded tokens after recovering from failures.
+type Token struct {
+
+	// Topic of the claimed task.
+	Topic string `json:"topic"`
+
+	// Unique ID of the claimed task.
+	ID string `json:"id"`
+
+	// Nonce of the claim, which is different for each claim of the task.
+	Nonce string `json:"nonce"`
+}
+
+// Sign returns the token signed with the key, in the form of the base64
+// encoded claims and signature separated by a dot.
+func (t *Token) Sign(key []byte) string {
+	b, _ := json.Marshal(t)
+	p := base64.RawURLEncoding.EncodeToString(b)
+	return p + "." + base64.RawURLEncoding.EncodeToString(signature(key, p))
+}
+
+// ParseToken returns the claims of a commit token without verifying its
+// signature, which is only suitable for consumers that do not have the key.
+func ParseToken(s string) (*Token, error) {
+	p, _, ok := strings.Cut(s, ".")
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	b, err := base64.RawURLEncoding.DecodeString(p)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	var t Token
+	if err := json.Unmarshal(b, &t); err != nil || t.ID == "" || t.Nonce == "" {
+		return nil, ErrInvalidToken
+	}
+	return &t, nil
+}
+
+// VerifyToken verifies the signature of a commit token with the key, and
+// returns its claims if the signature matches.
+func VerifyToken(key []byte, s string) (*Token, error) {
+	t, err := ParseToken(s)
+	if err != nil {
+		return nil, err
+	}
+	p, q, _ := strings.Cut(s, ".")
+	b, err := base64.RawURLEncoding.DecodeString(q)
+	if err != nil || !hmac.Equal(b, signature(key, p)) {
+		return nil, ErrInvalidToken
+	}
+	return t, nil
+}
+
+// signature returns the HMAC-SHA256 of the encoded claims.
+func signature(key []byte, claims string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(claims))
+	return h.Sum(nil)
+}
@@ -0,0 +1,28 @@
+// Package ui embeds the web dashboard.
+package ui
+
+import (
+	_ "embed"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+//go:embed index.html
+var index []byte
+
+// Dashboard implements endpoint mounting for the web dashboard, which is a
+// single page that only consumes the existing API endpoints.
+type Dashboard struct{}
+
+// Prefixes returns the common path prefixes for endpoints in the group.
+func (d *Dashboard) Prefixes() []string {
+	return []string{"/ui"}
+}
+
+// Mount initializes group-level middlewares and mounts the endpoints.
+func (d *Dashboard) Mount(r *gin.RouterGroup) {
+	r.GET("/", func(c *gin.Context) {
+		c.Data(http.StatusOK, "text/html; charset=utf-8", index)
+	})
+}
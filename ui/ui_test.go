@@ -0,0 +1,33 @@
+package ui_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/hyperonym/ratus/internal/reqtest"
+	"github.com/hyperonym/ratus/ui"
+)
+
+func TestDashboard(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+	h := reqtest.NewHandler(&ui.Dashboard{})
+
+	t.Run("index", func(t *testing.T) {
+		t.Parallel()
+		req := httptest.NewRequest(http.MethodGet, "/ui/", nil)
+		r := reqtest.Record(t, h, req)
+		r.AssertStatusCode(http.StatusOK)
+		r.AssertHeaderContains("Content-Type", "text/html")
+		r.AssertBodyContains("</head>")
+	})
+
+	t.Run("redirect", func(t *testing.T) {
+		t.Parallel()
+		req := httptest.NewRequest(http.MethodGet, "/ui", nil)
+		r := reqtest.Record(t, h, req)
+		r.AssertStatusCode(http.StatusMovedPermanently)
+	})
+}
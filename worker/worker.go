@@ -0,0 +1,344 @@
+// Package worker runs groups of subscriptions under a supervisor in the style
+// of Erlang/OTP, which restarts workers that crash, reports their liveness and
+// shuts them down cleanly, so that consumers do not have to build the same
+// scaffolding around Client.Subscribe.
+package worker
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hyperonym/ratus"
+)
+
+// Default values of supervisor options.
+const (
+	DefaultMaxRestarts     = 5
+	DefaultPeriod          = time.Minute
+	DefaultBackoff         = time.Second
+	DefaultMaxBackoff      = 30 * time.Second
+	DefaultShutdownTimeout = 30 * time.Second
+)
+
+var (
+	// ErrTooManyRestarts is returned by Run when workers have been restarted
+	// more often than allowed, in which case all workers are stopped.
+	ErrTooManyRestarts = errors.New("too many restarts")
+
+	// ErrShutdownTimeout is returned by Run when workers have not stopped
+	// within the shutdown timeout, e.g. because handlers ignore cancellation.
+	ErrShutdownTimeout = errors.New("shutdown timed out")
+)
+
+// Restart specifies whether a worker is restarted after it exits.
+type Restart int
+
+// Restart policies of workers.
+const (
+	// Permanent workers are always restarted after they exit, e.g. because
+	// their handlers panicked.
+	Permanent Restart = iota
+	// Temporary workers are never restarted, and the group keeps running
+	// without them.
+	Temporary
+)
+
+// Spec describes a worker, which subscribes to a topic with the handler.
+type Spec struct {
+
+	// Unique name of the worker in the group.
+	Name string
+
+	// Options for subscribing to the topic.
+	Options *ratus.SubscribeOptions
+
+	// Function called with claimed tasks and errors of the subscription.
+	// Panics in the handler crash the worker after leaving the task to be
+	// retried with the panic recorded as the error.
+	Handler ratus.SubscribeHandler
+
+	// Policy for restarting the worker after it exits.
+	Restart Restart
+}
+
+// Options contains options for supervising workers.
+type Options struct {
+
+	// Maximum number of restarts of workers in the group within Period,
+	// beyond which the supervisor gives up and stops all workers.
+	// If zero, DefaultMaxRestarts is used.
+	MaxRestarts int
+	// Time window for counting restarts.
+	// If zero, DefaultPeriod is used.
+	Period time.Duration
+
+	// Delay before restarting a worker, which is doubled for each restart
+	// within Period up to MaxBackoff.
+	// If zero, DefaultBackoff is used.
+	Backoff time.Duration
+	// Maximum delay before restarting a worker.
+	// If zero, DefaultMaxBackoff is used.
+	MaxBackoff time.Duration
+
+	// Interval of sending heartbeats for the consumers of running workers,
+	// which keeps idle workers listed by the server.
+	// If zero, no heartbeat is sent.
+	HeartbeatInterval time.Duration
+
+	// Time to wait for workers to finish their tasks when shutting down.
+	// If zero, DefaultShutdownTimeout is used.
+	ShutdownTimeout time.Duration
+}
+
+// Status reports the liveness of a worker.
+type Status struct {
+
+	// Name of the worker.
+	Name string
+
+	// Whether the worker is subscribed to its topic.
+	Running bool
+
+	// Number of times the worker has been restarted.
+	Restarts int
+
+	// The time the handler of the worker was last called, which indicates
+	// whether the worker is making progress.
+	LastSeen time.Time
+
+	// The last error reported to the handler, or the reason the worker last
+	// exited.
+	LastError error
+}
+
+// Supervisor runs a group of workers and restarts them according to their
+// restart policies.
+type Supervisor struct {
+	client   *ratus.Client
+	specs    []Spec
+	options  Options
+	mu       sync.Mutex
+	status   []Status
+	restarts []time.Time
+}
+
+// New creates a supervisor for the workers with the options.
+func New(c *ratus.Client, o *Options, specs ...Spec) (*Supervisor, error) {
+	if len(specs) == 0 {
+		return nil, errors.New("no worker to supervise")
+	}
+	ss := make([]Status, len(specs))
+	ns := make(map[string]bool, len(specs))
+	for i, s := range specs {
+		switch {
+		case s.Name == "":
+			return nil, errors.New("worker name must not be empty")
+		case ns[s.Name]:
+			return nil, fmt.Errorf("duplicate worker %q", s.Name)
+		case s.Options == nil || s.Options.Promise == nil:
+			return nil, fmt.Errorf("worker %q must have subscribe options with a promise", s.Name)
+		case s.Handler == nil:
+			return nil, fmt.Errorf("worker %q must have a handler", s.Name)
+		}
+		ns[s.Name] = true
+		ss[i].Name = s.Name
+	}
+
+	// Use the default values for unspecified options.
+	v := *o
+	if v.MaxRestarts <= 0 {
+		v.MaxRestarts = DefaultMaxRestarts
+	}
+	if v.Period <= 0 {
+		v.Period = DefaultPeriod
+	}
+	if v.Backoff <= 0 {
+		v.Backoff = DefaultBackoff
+	}
+	if v.MaxBackoff <= 0 {
+		v.MaxBackoff = DefaultMaxBackoff
+	}
+	if v.ShutdownTimeout <= 0 {
+		v.ShutdownTimeout = DefaultShutdownTimeout
+	}
+
+	return &Supervisor{client: c, specs: specs, options: v, status: ss}, nil
+}
+
+// Run starts the workers and blocks until the context is canceled, all
+// workers have exited without being restarted, or workers have been restarted
+// too often. Workers are stopped before returning, and are given up to the
+// shutdown timeout to finish the tasks being executed.
+func (s *Supervisor) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	// Stop the group once no worker is left running.
+	var wg sync.WaitGroup
+	for i := range s.specs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.supervise(ctx, cancel, i)
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+		cancel(nil)
+	}()
+	if s.options.HeartbeatInterval > 0 {
+		go s.heartbeat(ctx)
+	}
+
+	<-ctx.Done()
+	t := time.NewTimer(s.options.ShutdownTimeout)
+	defer t.Stop()
+	select {
+	case <-done:
+	case <-t.C:
+		return ErrShutdownTimeout
+	}
+	if err := context.Cause(ctx); errors.Is(err, ErrTooManyRestarts) {
+		return err
+	}
+	return nil
+}
+
+// Status returns the status of the workers in the order of their specs.
+func (s *Supervisor) Status() []Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Status(nil), s.status...)
+}
+
+// supervise runs the worker and restarts it according to its policy until the
+// context is canceled. The group is canceled if restarts are too frequent.
+func (s *Supervisor) supervise(ctx context.Context, cancel context.CancelCauseFunc, i int) {
+	for {
+		err := s.run(ctx, i)
+		if ctx.Err() != nil || s.specs[i].Restart == Temporary {
+			return
+		}
+		d, ok := s.restart(i)
+		if !ok {
+			cancel(fmt.Errorf("%w: worker %q exited: %v", ErrTooManyRestarts, s.specs[i].Name, err))
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(d):
+		}
+	}
+}
+
+// run subscribes to the topic of the worker until the context is canceled or
+// the handler panics, and returns the reason the worker exited.
+func (s *Supervisor) run(ctx context.Context, i int) error {
+	wc, stop := context.WithCancelCause(ctx)
+	defer stop(nil)
+	s.update(i, func(v *Status) { v.Running = true })
+
+	// Leave the task to be retried and stop the subscription if the handler
+	// panics. The commit is made before stopping, since the context of the
+	// task is derived from the subscription.
+	h := s.specs[i].Handler
+	f := func(x *ratus.Context, err error) {
+		s.update(i, func(v *Status) {
+			v.LastSeen = time.Now()
+			if err != nil {
+				v.LastError = err
+			}
+		})
+		defer func() {
+			if r := recover(); r != nil {
+				e := fmt.Errorf("worker panicked: %v", r)
+				if x != nil {
+					x.Reset().Abstain().SetError(e).Commit()
+				}
+				stop(e)
+			}
+		}()
+		h(x, err)
+	}
+	// Give the tasks being executed until the shutdown timeout to finish and
+	// be committed once the worker is stopped.
+	o := *s.specs[i].Options
+	o.ShutdownTimeout = cmp.Or(o.ShutdownTimeout, s.options.ShutdownTimeout)
+	err := s.client.Subscribe(wc, &o, f)
+	if c := context.Cause(wc); c != nil && ctx.Err() == nil {
+		err = c
+	}
+	if err == nil {
+		err = errors.New("worker returned")
+	}
+
+	s.update(i, func(v *Status) {
+		v.Running = false
+		if ctx.Err() == nil {
+			v.LastError = err
+		}
+	})
+	return err
+}
+
+// restart records a restart of the worker, and returns the delay before the
+// restart and whether the restart is allowed.
+func (s *Supervisor) restart(i int) (time.Duration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := time.Now()
+	k := 0
+	for _, t := range s.restarts {
+		if n.Sub(t) < s.options.Period {
+			s.restarts[k] = t
+			k++
+		}
+	}
+	s.restarts = append(s.restarts[:k], n)
+	if len(s.restarts) > s.options.MaxRestarts {
+		return 0, false
+	}
+	s.status[i].Restarts++
+	d := s.options.Backoff
+	for range len(s.restarts) - 1 {
+		if d *= 2; d >= s.options.MaxBackoff {
+			break
+		}
+	}
+	return min(d, s.options.MaxBackoff), true
+}
+
+// heartbeat sends heartbeats for the consumers of running workers at the
+// interval until the context is canceled.
+func (s *Supervisor) heartbeat(ctx context.Context) {
+	t := time.NewTicker(s.options.HeartbeatInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		cs := make(map[string]bool)
+		for i, v := range s.Status() {
+			if c := s.specs[i].Options.Promise.Consumer; c != "" && v.Running && !cs[c] {
+				cs[c] = true
+				s.client.Heartbeat(ctx, c)
+			}
+		}
+	}
+}
+
+// update applies the function to the status of the worker.
+func (s *Supervisor) update(i int, f func(*Status)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f(&s.status[i])
+}
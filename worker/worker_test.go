@@ -0,0 +1,227 @@
+package worker_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hyperonym/ratus"
+	"github.com/hyperonym/ratus/worker"
+)
+
+// server serves an endless supply of tasks and records the commits and the
+// heartbeats it receives.
+type server struct {
+	mu         sync.Mutex
+	commits    []ratus.Commit
+	heartbeats atomic.Int32
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/v1/consumers/"):
+		s.heartbeats.Add(1)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case r.Method == http.MethodPatch:
+		var m ratus.Commit
+		json.NewDecoder(r.Body).Decode(&m)
+		s.mu.Lock()
+		s.commits = append(s.commits, m)
+		s.mu.Unlock()
+	}
+	n := time.Now()
+	d := n.Add(time.Minute)
+	json.NewEncoder(w).Encode(&ratus.Task{ID: "id", Topic: "topic", State: ratus.TaskStateActive, Nonce: "nonce", Consumed: &n, Deadline: &d})
+}
+
+func newClient(t *testing.T, s *server) *ratus.Client {
+	t.Helper()
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+	c, err := ratus.NewClient(&ratus.ClientOptions{Origin: ts.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func spec(name string, restart worker.Restart, h ratus.SubscribeHandler) worker.Spec {
+	return worker.Spec{
+		Name:    name,
+		Options: &ratus.SubscribeOptions{Promise: &ratus.Promise{Consumer: "consumer"}, Topic: "topic", PollInterval: time.Millisecond},
+		Handler: h,
+		Restart: restart,
+	}
+}
+
+func TestNew(t *testing.T) {
+	h := func(*ratus.Context, error) {}
+	for _, ss := range [][]worker.Spec{
+		nil,
+		{spec("", worker.Permanent, h)},
+		{spec("a", worker.Permanent, h), spec("a", worker.Permanent, h)},
+		{spec("a", worker.Permanent, nil)},
+		{{Name: "a", Options: &ratus.SubscribeOptions{}, Handler: h}},
+	} {
+		if _, err := worker.New(nil, &worker.Options{}, ss...); err == nil {
+			t.Errorf("expected error for specs %+v", ss)
+		}
+	}
+}
+
+func TestSupervisor(t *testing.T) {
+	t.Parallel()
+
+	t.Run("restart", func(t *testing.T) {
+		t.Parallel()
+		var s server
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		// The handler panics on the first task and cancels the group once it
+		// has been restarted.
+		var calls atomic.Int32
+		g, err := worker.New(newClient(t, &s), &worker.Options{Backoff: time.Millisecond, HeartbeatInterval: time.Millisecond}, spec("a", worker.Permanent, func(x *ratus.Context, err error) {
+			if calls.Add(1) == 1 {
+				panic("boom")
+			}
+			time.Sleep(10 * time.Millisecond)
+			cancel()
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := g.Run(ctx); err != nil {
+			t.Error(err)
+		}
+
+		v := g.Status()[0]
+		if v.Name != "a" || v.Running || v.Restarts != 1 || v.LastSeen.IsZero() {
+			t.Errorf("incorrect status, got %+v", v)
+		}
+		if v.LastError == nil || !strings.Contains(v.LastError.Error(), "boom") {
+			t.Errorf("incorrect last error, got %v", v.LastError)
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if len(s.commits) == 0 || *s.commits[0].State != ratus.TaskStatePending || s.commits[0].Error != "worker panicked: boom" || s.commits[0].Nonce != "nonce" {
+			t.Errorf("incorrect commit after panic, got %+v", s.commits)
+		}
+		if s.heartbeats.Load() == 0 {
+			t.Error("expected heartbeats for running workers")
+		}
+	})
+
+	t.Run("too-many-restarts", func(t *testing.T) {
+		t.Parallel()
+		var s server
+		var calls atomic.Int32
+		g, err := worker.New(newClient(t, &s), &worker.Options{MaxRestarts: 2, Backoff: time.Millisecond}, spec("a", worker.Permanent, func(x *ratus.Context, err error) {
+			calls.Add(1)
+			panic("boom")
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := g.Run(ctx); !errors.Is(err, worker.ErrTooManyRestarts) {
+			t.Errorf("incorrect error, expected %q, got %v", worker.ErrTooManyRestarts, err)
+		}
+		if n := calls.Load(); n != 3 {
+			t.Errorf("incorrect number of runs, expected 3, got %d", n)
+		}
+	})
+
+	t.Run("temporary", func(t *testing.T) {
+		t.Parallel()
+		var s server
+		g, err := worker.New(newClient(t, &s), &worker.Options{}, spec("a", worker.Temporary, func(x *ratus.Context, err error) {
+			panic("boom")
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The group stops once its only worker has exited.
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := g.Run(ctx); err != nil {
+			t.Error(err)
+		}
+		if ctx.Err() != nil {
+			t.Error("expected the group to stop without workers")
+		}
+		if v := g.Status()[0]; v.Running || v.Restarts != 0 {
+			t.Errorf("incorrect status, got %+v", v)
+		}
+	})
+
+	t.Run("shutdown", func(t *testing.T) {
+		t.Parallel()
+		var s server
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		// The group is stopped while the first task is being executed, which
+		// is still committed once the handler returns.
+		var once sync.Once
+		var alive atomic.Bool
+		g, err := worker.New(newClient(t, &s), &worker.Options{ShutdownTimeout: 5 * time.Second}, spec("a", worker.Permanent, func(x *ratus.Context, err error) {
+			if err != nil {
+				return
+			}
+			once.Do(func() {
+				cancel()
+				time.Sleep(20 * time.Millisecond)
+				alive.Store(x.Err() == nil)
+			})
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := g.Run(ctx); err != nil {
+			t.Error(err)
+		}
+		if !alive.Load() {
+			t.Error("expected the context of the task to remain valid during shutdown")
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if len(s.commits) == 0 {
+			t.Fatal("expected the task to be committed during shutdown")
+		}
+		for _, m := range s.commits {
+			if m.State == nil || *m.State != ratus.TaskStateCompleted {
+				t.Errorf("incorrect commit during shutdown, got %+v", m)
+			}
+		}
+	})
+
+	t.Run("shutdown-timeout", func(t *testing.T) {
+		t.Parallel()
+		var s server
+		block := make(chan struct{})
+		defer close(block)
+		g, err := worker.New(newClient(t, &s), &worker.Options{ShutdownTimeout: 10 * time.Millisecond}, spec("a", worker.Permanent, func(x *ratus.Context, err error) {
+			<-block
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		if err := g.Run(ctx); !errors.Is(err, worker.ErrShutdownTimeout) {
+			t.Errorf("incorrect error, expected %q, got %v", worker.ErrShutdownTimeout, err)
+		}
+	})
+}